@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// benchOptions are the flags of the bench subcommand
+type benchOptions struct {
+	addr        string
+	count       int
+	duration    time.Duration
+	concurrency int
+	sizes       []int
+	from        string
+	to          []string
+	tls         string
+	insecure    bool
+	username    string
+	password    string
+	reuse       bool
+	timeout     time.Duration
+}
+
+// benchResult is the outcome of sending one message
+type benchResult struct {
+	size    int // the -size it was sent with
+	bytes   int // of the whole message
+	latency time.Duration
+	err     error
+}
+
+// benchConn is an open SMTP connection
+type benchConn struct {
+	*smtp.Client
+	conn net.Conn
+}
+
+// benchStats collects the results of a size, or of the whole run
+type benchStats struct {
+	accepted  int
+	failed    int
+	bytes     int64
+	latencies []time.Duration
+}
+
+func (st *benchStats) add(r benchResult) {
+	if r.err != nil {
+		st.failed++
+		return
+	}
+	st.accepted++
+	st.bytes += int64(r.bytes)
+	st.latencies = append(st.latencies, r.latency)
+}
+
+// percentile returns the latency below which p percent of the accepted
+// messages were
+func (st *benchStats) percentile(p float64) time.Duration {
+	if len(st.latencies) == 0 {
+		return 0
+	}
+	i := int(float64(len(st.latencies))*p/100+0.5) - 1
+	return st.latencies[min(max(i, 0), len(st.latencies)-1)]
+}
+
+// runBench implements the bench subcommand, which sends messages to an
+// SMTP server as fast as it accepts them and reports its throughput,
+// latency and errors
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	var opts benchOptions
+	fs.StringVar(&opts.addr, "addr", "localhost:1025", "SMTP server to send to, as host:port")
+	fs.IntVar(&opts.count, "count", 1000, "Number of messages to send")
+	fs.DurationVar(&opts.duration, "duration", 0, "Send for this long instead of -count messages")
+	fs.IntVar(&opts.concurrency, "concurrency", 10, "Number of concurrent SMTP connections")
+	sizes := fs.String("size", "10KB", "Comma-separated body sizes, such as 1KB,100KB,5MB, sent in turn")
+	fs.StringVar(&opts.from, "from", "bench@example.com", "Envelope and header sender")
+	to := fs.String("to", "bench@example.com", "Comma-separated recipients")
+	fs.StringVar(&opts.tls, "tls", "none", "none, starttls or tls")
+	fs.BoolVar(&opts.insecure, "insecure", false, "Do not verify the server's certificate")
+	fs.StringVar(&opts.username, "username", "", "Authenticate with this username (AUTH PLAIN)")
+	fs.StringVar(&opts.password, "password", "", "Password for -username")
+	fs.BoolVar(&opts.reuse, "reuse", true, "Send several messages per connection; false connects for each")
+	fs.DurationVar(&opts.timeout, "timeout", 30*time.Second, "Time limit for sending one message")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gowebmail bench [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	for _, s := range strings.Split(*sizes, ",") {
+		size, err := parseSize(s)
+		if err != nil {
+			return err
+		}
+		opts.sizes = append(opts.sizes, size)
+	}
+	for _, address := range strings.Split(*to, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			opts.to = append(opts.to, address)
+		}
+	}
+	switch {
+	case len(opts.to) == 0:
+		return errors.New("-to needs at least one recipient")
+	case opts.concurrency < 1:
+		return errors.New("-concurrency must be at least 1")
+	case opts.count < 1 && opts.duration <= 0:
+		return errors.New("-count must be at least 1")
+	case opts.tls != "none" && opts.tls != "starttls" && opts.tls != "tls":
+		return fmt.Errorf("unknown -tls %q; use none, starttls or tls", opts.tls)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if opts.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.duration)
+		defer cancel()
+	}
+
+	if opts.duration > 0 {
+		fmt.Printf("Sending to %s for %s over %d connections\n", opts.addr, opts.duration, opts.concurrency)
+	} else {
+		fmt.Printf("Sending %d messages to %s over %d connections\n", opts.count, opts.addr, opts.concurrency)
+	}
+
+	start := time.Now()
+	results := bench(ctx, &opts)
+	benchReport(&opts, results, time.Since(start))
+
+	for _, r := range results {
+		if r.err == nil {
+			return nil
+		}
+	}
+	return errors.New("no message was accepted")
+}
+
+// bench sends messages until -count are sent or ctx is done, and returns
+// the results in the order they completed
+func bench(ctx context.Context, opts *benchOptions) []benchResult {
+	bodies := make(map[int][]byte)
+	for _, size := range opts.sizes {
+		bodies[size] = benchBody(size)
+	}
+
+	// Each message number is taken once; with -duration there is no limit
+	next := make(chan int)
+	go func() {
+		defer close(next)
+		for n := 1; opts.duration > 0 || n <= opts.count; n++ {
+			select {
+			case next <- n:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var (
+		mu      sync.Mutex
+		results []benchResult
+		wg      sync.WaitGroup
+	)
+	for range opts.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var c *benchConn
+			defer func() {
+				if c != nil {
+					c.Quit()
+				}
+			}()
+
+			for n := range next {
+				size := opts.sizes[(n-1)%len(opts.sizes)]
+				msg := benchMessage(opts, n, bodies[size])
+
+				begin := time.Now()
+				var err error
+				if c == nil {
+					c, err = benchDial(opts)
+				}
+				if err == nil {
+					err = benchSend(c, opts, msg)
+				}
+				r := benchResult{size: size, bytes: len(msg), latency: time.Since(begin), err: err}
+
+				// A connection in an unknown state is not reused
+				if c != nil && (err != nil || !opts.reuse) {
+					if err == nil {
+						c.Quit()
+					}
+					c.Close()
+					c = nil
+				}
+
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// benchDial connects to the server, securing and authenticating the
+// connection as configured
+func benchDial(opts *benchOptions) (*benchConn, error) {
+	host, _, err := net.SplitHostPort(opts.addr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: opts.insecure}
+	dialer := &net.Dialer{Timeout: opts.timeout}
+
+	var conn net.Conn
+	if opts.tls == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", opts.addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", opts.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(opts.timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if opts.tls == "starttls" {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("starttls failed: %w", err)
+		}
+	}
+	if opts.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", opts.username, opts.password, host)); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	return &benchConn{Client: c, conn: conn}, nil
+}
+
+// benchSend sends one message on an open connection
+func benchSend(c *benchConn, opts *benchOptions, msg []byte) error {
+	c.conn.SetDeadline(time.Now().Add(opts.timeout))
+	if err := c.Reset(); err != nil {
+		return err
+	}
+	if err := c.Mail(opts.from); err != nil {
+		return err
+	}
+	for _, rcpt := range opts.to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// benchMessage returns message n, with a body of the given size
+func benchMessage(opts *benchOptions, n int, body []byte) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", opts.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(opts.to, ", "))
+	fmt.Fprintf(&b, "Subject: Bench message %d\r\n", n)
+	fmt.Fprintf(&b, "Message-ID: <bench-%d-%d@gowebmail>\r\n", time.Now().UnixNano(), n)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=us-ascii\r\nX-Gowebmail-Bench: true\r\n\r\n")
+	return append([]byte(b.String()), body...)
+}
+
+// benchBody returns size bytes of text in lines of 78 characters
+func benchBody(size int) []byte {
+	const letters = "abcdefghijklmnopqrstuvwxyz     "
+	body := make([]byte, size)
+	for i := range body {
+		if i%80 >= 78 {
+			body[i] = "\r\n"[i%80-78]
+		} else {
+			body[i] = letters[rand.Intn(len(letters))]
+		}
+	}
+	return body
+}
+
+// benchReport prints the throughput, latency and errors of a run
+func benchReport(opts *benchOptions, results []benchResult, elapsed time.Duration) {
+	var total benchStats
+	bySize := make(map[int]*benchStats)
+	errs := make(map[string]int)
+	for _, r := range results {
+		total.add(r)
+		if bySize[r.size] == nil {
+			bySize[r.size] = &benchStats{}
+		}
+		bySize[r.size].add(r)
+		if r.err != nil {
+			errs[benchError(r.err)]++
+		}
+	}
+
+	seconds := elapsed.Seconds()
+	fmt.Printf("\nSent %d messages in %s\n", len(results), elapsed.Round(time.Millisecond))
+	fmt.Printf("  accepted  %d (%.1f/s, %s/s)\n", total.accepted, float64(total.accepted)/seconds, formatBytes(int64(float64(total.bytes)/seconds)))
+	fmt.Printf("  failed    %d (%.1f%%)\n", total.failed, percent(total.failed, len(results)))
+	printLatency("  latency   ", &total)
+
+	if len(opts.sizes) > 1 {
+		fmt.Println("\nBy size")
+		for _, size := range opts.sizes {
+			st := bySize[size]
+			if st == nil {
+				continue
+			}
+			fmt.Printf("  %-8s  %d accepted, %d failed\n", formatBytes(int64(size)), st.accepted, st.failed)
+			printLatency("            ", st)
+		}
+	}
+
+	if len(errs) > 0 {
+		messages := make([]string, 0, len(errs))
+		for msg := range errs {
+			messages = append(messages, msg)
+		}
+		sort.Slice(messages, func(i, j int) bool { return errs[messages[i]] > errs[messages[j]] })
+		fmt.Println("\nErrors")
+		for _, msg := range messages {
+			fmt.Printf("  %6d  %s\n", errs[msg], msg)
+		}
+	}
+}
+
+func printLatency(prefix string, st *benchStats) {
+	if len(st.latencies) == 0 {
+		return
+	}
+	sort.Slice(st.latencies, func(i, j int) bool { return st.latencies[i] < st.latencies[j] })
+	fmt.Printf("%sp50 %s  p90 %s  p99 %s  max %s\n", prefix,
+		st.percentile(50).Round(10*time.Microsecond), st.percentile(90).Round(10*time.Microsecond),
+		st.percentile(99).Round(10*time.Microsecond), st.latencies[len(st.latencies)-1].Round(10*time.Microsecond))
+}
+
+// benchError groups errors: SMTP replies by code and text, others by
+// message
+func benchError(err error) string {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return strconv.Itoa(reply.Code) + " " + reply.Msg
+	}
+	return err.Error()
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// parseSize parses a size such as 512, 10KB or 5MB
+func parseSize(text string) (int, error) {
+	s := strings.ToUpper(strings.TrimSpace(text))
+	unit := 1
+	for _, u := range []struct {
+		suffix string
+		size   int
+	}{{"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, unit = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.size
+			break
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid size %q", text)
+	}
+	return n * unit, nil
+}
+
+// formatBytes formats a number of bytes as B, KB or MB
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gowebmail/internal/config"
+)
+
+// checker prints the results of the check subcommand and counts failures
+type checker struct {
+	errors   int
+	warnings int
+}
+
+func (c *checker) ok(format string, args ...interface{}) {
+	fmt.Printf("  ok    %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *checker) warn(format string, args ...interface{}) {
+	c.warnings++
+	fmt.Printf("  warn  %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *checker) fail(format string, args ...interface{}) {
+	c.errors++
+	fmt.Printf("  FAIL  %s\n", fmt.Sprintf(format, args...))
+}
+
+// problems prints configuration problems
+func (c *checker) problems(problems []config.Problem) {
+	for _, p := range problems {
+		if p.Warning {
+			c.warn("%s", p)
+		} else {
+			c.fail("%s", p)
+		}
+	}
+}
+
+// runCheck implements the check subcommand, which validates the
+// configuration and the environment the server would start in without
+// starting it
+func runCheck(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := fs.String("config", "gowebmail.yml", "Path to configuration file")
+	settings := settingOverrides(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gowebmail check [flags]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var c checker
+
+	fmt.Printf("Configuration (%s)\n", *configPath)
+	c.problems(config.CheckFile(*configPath))
+	cfg, err := loadConfig(*configPath, *settings)
+	if err != nil {
+		// Already reported by CheckFile, unless the file is unreadable
+		if c.errors == 0 {
+			c.fail("%v", err)
+		}
+		return c.result()
+	}
+	problems := cfg.Validate()
+	c.problems(problems)
+	if c.errors == 0 && c.warnings == 0 {
+		c.ok("settings are valid")
+	}
+	if len(config.Errors(problems)) > 0 {
+		// Ports and paths of an invalid configuration mean little
+		return c.result()
+	}
+
+	fmt.Println("Ports")
+	c.port("smtp", cfg.SMTP.Host, cfg.SMTP.Port)
+	c.port("http", cfg.HTTP.Host, cfg.HTTP.Port)
+	if cfg.POP3.Enabled {
+		c.port("pop3", cfg.POP3.Host, cfg.POP3.Port)
+	}
+	if cfg.IMAP.Enabled {
+		c.port("imap", cfg.IMAP.Host, cfg.IMAP.Port)
+	}
+	if addr := cfg.HTTP.TLS.RedirectAddr; cfg.HTTP.TLS.Enabled && addr != "" {
+		host, port, err := net.SplitHostPort(addr)
+		n, _ := strconv.Atoi(port)
+		if err != nil {
+			c.fail("http.tls.redirect_addr: %v", err)
+		} else {
+			c.port("https redirect", host, n)
+		}
+	}
+	for _, ns := range cfg.Namespaces {
+		if ns.SMTPPort != 0 {
+			c.port("smtp "+ns.Name, cfg.SMTP.Host, ns.SMTPPort)
+		}
+	}
+
+	fmt.Println("Files")
+	c.writableFile("storage.path", cfg.Storage.Path)
+	c.writableDir("storage.backup_path", cfg.Storage.BackupPath)
+	if cfg.Storage.Blobs.Type == "filesystem" {
+		c.writableDir("storage.blobs.path", cfg.Storage.Blobs.Path)
+	}
+	for _, ns := range cfg.Namespaces {
+		c.writableFile("namespace "+ns.Name, cfg.Namespace(ns).Storage.Path)
+	}
+	if cfg.Storage.Fixtures != "" {
+		c.fixtures("storage.fixtures", cfg.Storage.Fixtures)
+	}
+	if tlsCfg := cfg.HTTP.TLS; tlsCfg.Enabled {
+		if tlsCfg.ACME.Enabled {
+			c.writableDir("http.tls.acme.cache_dir", tlsCfg.ACME.CacheDir)
+		} else if _, err := tls.LoadX509KeyPair(tlsCfg.CertFile, tlsCfg.KeyFile); err != nil {
+			c.fail("http.tls: cannot load cert_file and key_file: %v", err)
+		} else {
+			c.ok("http.tls: certificate %s loads", tlsCfg.CertFile)
+		}
+		if ca := tlsCfg.ClientAuth; ca.Enabled {
+			if data, err := os.ReadFile(ca.CAFile); err != nil {
+				c.fail("http.tls.client_auth.ca_file: %v", err)
+			} else if !x509.NewCertPool().AppendCertsFromPEM(data) {
+				c.fail("http.tls.client_auth.ca_file: no PEM certificates in %s", ca.CAFile)
+			} else {
+				c.ok("http.tls.client_auth.ca_file: %s loads", ca.CAFile)
+			}
+		}
+	}
+	if out := cfg.Logging.Output; out != "" && out != "stdout" && out != "discard" {
+		c.writableFile("logging.output", out)
+	}
+
+	return c.result()
+}
+
+// result summarizes the check and fails if there were errors
+func (c *checker) result() error {
+	fmt.Println()
+	if c.errors > 0 {
+		return fmt.Errorf("%d errors, %d warnings", c.errors, c.warnings)
+	}
+	fmt.Printf("No errors, %d warnings\n", c.warnings)
+	return nil
+}
+
+// port checks that a server could listen on host:port
+func (c *checker) port(name, host string, port int) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	l, err := net.Listen("tcp", addr)
+	switch {
+	case err == nil:
+		l.Close()
+		c.ok("%s: %s is free", name, addr)
+	case errors.Is(err, syscall.EADDRINUSE):
+		c.fail("%s: %s is already in use; stop the process using it (another gowebmail?) or change the port", name, addr)
+	case errors.Is(err, syscall.EACCES):
+		c.fail("%s: not allowed to listen on %s; ports below 1024 need privileges", name, addr)
+	default:
+		c.fail("%s: cannot listen on %s: %v", name, addr, err)
+	}
+}
+
+// writableFile checks that a file can be opened for writing, or created
+// if it does not exist
+func (c *checker) writableFile(name, path string) {
+	if path == ":memory:" {
+		c.ok("%s: in memory", name)
+		return
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err == nil {
+		f.Close()
+		c.ok("%s: %s is writable", name, path)
+		return
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		c.fail("%s: %s is not writable: %v", name, path, err)
+		return
+	}
+
+	if dir, err := creatableDir(filepath.Dir(path)); err != nil {
+		c.fail("%s: %s cannot be created: %v", name, path, err)
+	} else {
+		c.ok("%s: %s will be created in %s", name, path, dir)
+	}
+}
+
+// writableDir checks that files can be created in a directory, or that it
+// can be created if it does not exist
+func (c *checker) writableDir(name, path string) {
+	dir, err := creatableDir(path)
+	switch {
+	case err != nil:
+		c.fail("%s: %s cannot be written: %v", name, path, err)
+	case dir != filepath.Clean(path):
+		c.ok("%s: %s will be created in %s", name, path, dir)
+	default:
+		c.ok("%s: %s is writable", name, path)
+	}
+}
+
+// fixtures checks that a fixtures directory can be read and counts the
+// fixtures in it
+func (c *checker) fixtures(name, dir string) {
+	if info, err := os.Stat(dir); err != nil {
+		c.fail("%s: %v", name, err)
+		return
+	} else if !info.IsDir() {
+		c.fail("%s: %s is not a directory", name, dir)
+		return
+	}
+
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && strings.EqualFold(filepath.Ext(path), ".eml") {
+			count++
+		}
+		return err
+	})
+	switch {
+	case err != nil:
+		c.fail("%s: %v", name, err)
+	case count == 0:
+		c.warn("%s: %s has no .eml files", name, dir)
+	default:
+		c.ok("%s: %d .eml files in %s", name, count, dir)
+	}
+}
+
+// creatableDir returns the closest existing directory at or above path,
+// after checking that files can be created in it
+func creatableDir(path string) (string, error) {
+	dir := filepath.Clean(path)
+	for {
+		info, err := os.Stat(dir)
+		if err == nil {
+			if !info.IsDir() {
+				return "", fmt.Errorf("%s is not a directory", dir)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", err
+		}
+		dir = parent
+	}
+
+	f, err := os.CreateTemp(dir, ".gowebmail-check-*")
+	if err != nil {
+		return "", fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	return dir, nil
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gowebmail/internal/api"
+	"gowebmail/internal/storage"
+)
+
+// clientCommands are the subcommands that talk to the API of a running
+// instance rather than starting one
+var clientCommands = map[string]func(args []string) error{
+	"list":   runList,
+	"get":    runGet,
+	"delete": runDelete,
+	"search": runSearch,
+	"export": runExport,
+	"seed":   runSeed,
+	"tail":   runTail,
+	"watch":  runTail,
+}
+
+// client calls the API of a running instance
+type client struct {
+	baseURL *url.URL
+	apiKey  string
+	http    *http.Client
+}
+
+// clientFlags registers the flags shared by the client subcommands on fs.
+// The returned function creates the client once fs has been parsed.
+func clientFlags(fs *flag.FlagSet) func() (*client, error) {
+	defaultURL := os.Getenv("GOWEBMAIL_URL")
+	if defaultURL == "" {
+		defaultURL = "http://localhost:8080"
+	}
+	rawURL := fs.String("url", defaultURL, "URL of the gowebmail instance (env GOWEBMAIL_URL)")
+	apiKey := fs.String("api-key", os.Getenv("GOWEBMAIL_API_KEY"), "API key, if authentication is enabled (env GOWEBMAIL_API_KEY)")
+
+	return func() (*client, error) {
+		u, err := url.Parse(strings.TrimSuffix(*rawURL, "/"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q", *rawURL)
+		}
+		return &client{
+			baseURL: u,
+			apiKey:  *apiKey,
+			http:    &http.Client{},
+		}, nil
+	}
+}
+
+// newClientFlagSet creates the flag set of a client subcommand
+func newClientFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: gowebmail %s %s\n", name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// do sends a request to path, relative to the API root, with in encoded as
+// the JSON body unless it is nil, and returns the response if it succeeded
+func (c *client) do(ctx context.Context, method, path string, query url.Values, in interface{}) (*http.Response, error) {
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var body struct {
+			Error *api.APIError `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&body) == nil && body.Error != nil {
+			return nil, fmt.Errorf("%s: %s", body.Error.Code, body.Error.Message)
+		}
+		return nil, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// call sends a request and decodes the data of the API response into out,
+// unless out is nil
+func (c *client) call(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	resp, err := c.do(ctx, method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body.Data, out)
+}
+
+// emailList is the data of the list and search endpoints
+type emailList struct {
+	Emails []*storage.Email `json:"emails"`
+	Total  int              `json:"total"`
+}
+
+// filterFlags registers the email filter flags on fs. The returned
+// function adds the flags that were set to a query.
+func filterFlags(fs *flag.FlagSet) func(url.Values) {
+	texts := map[string]*string{
+		"from":    fs.String("from", "", "Only emails whose sender contains this"),
+		"to":      fs.String("to", "", "Only emails whose recipients contain this"),
+		"subject": fs.String("subject", "", "Only emails whose subject contains this"),
+		"rcpt":    fs.String("rcpt", "", "Only emails with this envelope recipient"),
+		"tag":     fs.String("tag", "", "Only emails with this tag"),
+		"since":   fs.String("since", "", "Only emails received at or after this RFC 3339 time"),
+		"until":   fs.String("until", "", "Only emails received before this RFC 3339 time"),
+	}
+	bools := map[string]*bool{
+		"unread": fs.Bool("unread", false, "Only unread emails"),
+		"pinned": fs.Bool("pinned", false, "Only pinned emails"),
+		"spam":   fs.Bool("spam", false, "Only emails classified as spam"),
+	}
+
+	return func(query url.Values) {
+		for name, value := range texts {
+			if *value != "" {
+				query.Set(name, *value)
+			}
+		}
+		for name, value := range bools {
+			if *value {
+				query.Set(name, "true")
+			}
+		}
+	}
+}
+
+// runList implements the list subcommand
+func runList(args []string) error {
+	fs := newClientFlagSet("list", "[flags]")
+	newClient := clientFlags(fs)
+	addFilter := filterFlags(fs)
+	limit := fs.Int("limit", 50, "Maximum number of emails to list (at most 100)")
+	offset := fs.Int("offset", 0, "Number of emails to skip")
+	asJSON := fs.Bool("json", false, "Print the emails as JSON")
+	fs.Parse(args)
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	addFilter(query)
+	query.Set("limit", strconv.Itoa(*limit))
+	query.Set("offset", strconv.Itoa(*offset))
+
+	var list emailList
+	if err := c.call(context.Background(), http.MethodGet, "/api/emails", query, nil, &list); err != nil {
+		return err
+	}
+	return printEmails(&list, *offset, *asJSON)
+}
+
+// runSearch implements the search subcommand
+func runSearch(args []string) error {
+	fs := newClientFlagSet("search", "[flags] <query>")
+	newClient := clientFlags(fs)
+	limit := fs.Int("limit", 50, "Maximum number of emails to list (at most 100)")
+	offset := fs.Int("offset", 0, "Number of emails to skip")
+	asJSON := fs.Bool("json", false, "Print the emails as JSON")
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("a search query is required")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("q", strings.Join(fs.Args(), " "))
+	query.Set("limit", strconv.Itoa(*limit))
+	query.Set("offset", strconv.Itoa(*offset))
+
+	var list emailList
+	if err := c.call(context.Background(), http.MethodGet, "/api/emails/search", query, nil, &list); err != nil {
+		return err
+	}
+	return printEmails(&list, *offset, *asJSON)
+}
+
+// printEmails prints a page of emails as a table, or as JSON
+func printEmails(list *emailList, offset int, asJSON bool) error {
+	if asJSON {
+		return printJSON(list)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tRECEIVED\tFROM\tSUBJECT")
+	for _, e := range list.Emails {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", e.ID, e.ReceivedAt.Local().Format(time.DateTime), e.From, e.Subject)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// Keep stdout to the table so it can be piped
+	if shown := offset + len(list.Emails); shown < list.Total {
+		fmt.Fprintf(os.Stderr, "%d-%d of %d emails; use -offset for more\n", offset+1, shown, list.Total)
+	}
+	return nil
+}
+
+// printJSON prints v as indented JSON
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// runGet implements the get subcommand
+func runGet(args []string) error {
+	fs := newClientFlagSet("get", "[flags] <id>")
+	newClient := clientFlags(fs)
+	raw := fs.Bool("raw", false, "Print the raw message")
+	asJSON := fs.Bool("json", false, "Print the email as JSON")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("an email ID is required")
+	}
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid email ID %q", fs.Arg(0))
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	path := fmt.Sprintf("/api/emails/%d", id)
+	if *raw {
+		resp, err := c.do(ctx, http.MethodGet, path+"/raw", nil, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+
+	var e storage.Email
+	if err := c.call(ctx, http.MethodGet, path, nil, nil, &e); err != nil {
+		return err
+	}
+	if *asJSON {
+		return printJSON(&e)
+	}
+
+	fmt.Printf("From:     %s\n", e.From)
+	fmt.Printf("To:       %s\n", strings.Join(e.To, ", "))
+	if len(e.CC) > 0 {
+		fmt.Printf("Cc:       %s\n", strings.Join(e.CC, ", "))
+	}
+	fmt.Printf("Subject:  %s\n", e.Subject)
+	fmt.Printf("Received: %s\n", e.ReceivedAt.Local().Format(time.DateTime))
+	if len(e.Tags) > 0 {
+		fmt.Printf("Tags:     %s\n", strings.Join(e.Tags, ", "))
+	}
+	for _, a := range e.Attachments {
+		fmt.Printf("Attached: %s (%s, %d bytes)\n", a.Filename, a.ContentType, a.Size)
+	}
+	fmt.Println()
+	switch {
+	case e.BodyPlain != "":
+		fmt.Println(e.BodyPlain)
+	case e.BodyHTML != "":
+		fmt.Println("(HTML only; use -raw or the web UI to view it)")
+	}
+	return nil
+}
+
+// runDelete implements the delete subcommand
+func runDelete(args []string) error {
+	fs := newClientFlagSet("delete", "[flags] <id>... | -all")
+	newClient := clientFlags(fs)
+	all := fs.Bool("all", false, "Delete all emails")
+	fs.Parse(args)
+
+	if *all == (fs.NArg() > 0) {
+		fs.Usage()
+		return errors.New("give either email IDs or -all")
+	}
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if *all {
+		if err := c.call(ctx, http.MethodDelete, "/api/emails", nil, nil, nil); err != nil {
+			return err
+		}
+		fmt.Println("Deleted all emails")
+		return nil
+	}
+
+	for _, arg := range fs.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid email ID %q", arg)
+		}
+		if err := c.call(ctx, http.MethodDelete, fmt.Sprintf("/api/emails/%d", id), nil, nil, nil); err != nil {
+			return fmt.Errorf("email %d: %w", id, err)
+		}
+		fmt.Printf("Deleted email %d\n", id)
+	}
+	return nil
+}
+
+// runExport implements the export subcommand
+func runExport(args []string) error {
+	fs := newClientFlagSet("export", "[flags]")
+	newClient := clientFlags(fs)
+	addFilter := filterFlags(fs)
+	format := fs.String("format", "mbox", "Export format: mbox, eml-zip or jsonl")
+	output := fs.String("o", "", "File to write the export to (default stdout)")
+	fs.Parse(args)
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	addFilter(query)
+	query.Set("format", *format)
+
+	resp, err := c.do(context.Background(), http.MethodGet, "/api/emails/export", query, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return err
+	}
+	if *output != "" {
+		fmt.Fprintf(os.Stderr, "Wrote %d bytes to %s\n", n, *output)
+	}
+	return nil
+}
+
+// runSeed implements the seed subcommand, which fills an instance with
+// made-up emails for UI development and demos
+func runSeed(args []string) error {
+	fs := newClientFlagSet("seed", "[flags]")
+	newClient := clientFlags(fs)
+	count := fs.Int("count", 20, "Number of emails to generate")
+	seed := fs.Int64("seed", 0, "Seed that repeats the same emails (default random)")
+	to := fs.String("to", "", "Comma-separated recipients (default a made-up team)")
+	spread := fs.Duration("spread", 24*time.Hour, "How far back receipt times go")
+	fs.Parse(args)
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	req := api.GenerateRequest{
+		Count:  *count,
+		Seed:   *seed,
+		Spread: spread.String(),
+	}
+	for _, address := range strings.Split(*to, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			req.To = append(req.To, address)
+		}
+	}
+
+	var result api.GenerateResult
+	if err := c.call(context.Background(), http.MethodPost, "/api/dev/generate", nil, &req, &result); err != nil {
+		return err
+	}
+	fmt.Printf("Generated %d emails (seed %d)\n", result.Count, result.Seed)
+	return nil
+}
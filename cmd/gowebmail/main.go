@@ -4,17 +4,13 @@ import (
 	"context"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 
-	"gowebmail/internal/api"
 	"gowebmail/internal/config"
-	"gowebmail/internal/retention"
-	"gowebmail/internal/smtp"
-	"gowebmail/internal/storage"
+	"gowebmail/pkg/gowebmail"
 
 	"github.com/rs/zerolog"
 )
@@ -27,9 +23,48 @@ var (
 )
 
 func main() {
+	// Run subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "restore":
+			if err := runRestore(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "restore: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "check":
+			if err := runCheck(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "check: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "bench":
+			if err := runBench(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "vapid-key":
+			if err := runVAPIDKey(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "vapid-key: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+		if run, ok := clientCommands[os.Args[1]]; ok {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	// Parse command line flags
 	configPath := flag.String("config", "gowebmail.yml", "Path to configuration file")
+	watchConfig := flag.Bool("watch-config", false, "Reload the configuration when the file changes, as on SIGHUP")
 	showVersion := flag.Bool("version", false, "Show version information")
+	settings := settingOverrides(flag.CommandLine)
 	flag.Parse()
 
 	// Show version and exit
@@ -42,123 +77,79 @@ func main() {
 	}
 
 	// Load configuration
-	cfg, err := config.Load(*configPath)
+	cfg, err := loadConfig(*configPath, *settings)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	problems := cfg.Validate()
+	if errs := config.Errors(problems); len(errs) > 0 {
+		fmt.Fprintln(os.Stderr, "Invalid configuration:")
+		for _, p := range errs {
+			fmt.Fprintf(os.Stderr, "  %s\n", p)
+		}
+		fmt.Fprintln(os.Stderr, "Run \"gowebmail check\" for details.")
+		os.Exit(1)
 	}
 
 	// Setup logger
-	logger := setupLogger(cfg.Logging)
+	logger := gowebmail.NewLogger(cfg.Logging)
 	logger.Info().
 		Str("version", version).
 		Str("commit", commit).
 		Str("date", date).
 		Msg("Starting GoWebMail")
-
-	// Initialize storage
-	store, err := storage.NewSQLiteStorage(cfg.Storage.Path, logger)
-	if err != nil {
-		logger.Fatal().Err(err).Msg("Failed to initialize storage")
+	for _, p := range problems {
+		logger.Warn().Str("setting", p.Field).Msg(p.Message)
 	}
-	defer store.Close()
 
-	// Create HTTP server
-	httpServer := api.NewServer(cfg, store, logger)
-
-	// Create SMTP server
-	smtpServer := smtp.NewServer(&cfg.SMTP, store, logger)
-
-	// Set callback for new emails to broadcast via WebSocket
-	smtpServer.SetNewMailCallback(func(email *storage.Email) {
-		httpServer.BroadcastNewEmail(email)
-	})
-
-	// Start retention policy manager
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	if cfg.Retention.Enabled {
-		retentionMgr := retention.NewManager(&cfg.Retention, store, logger)
-		go retentionMgr.Start(ctx)
+	// Start storage and servers
+	srv, err := gowebmail.Start(cfg, logger)
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to start")
 	}
 
-	// Start servers in goroutines
-	go func() {
-		if err := smtpServer.Start(); err != nil {
-			logger.Fatal().Err(err).Msg("SMTP server failed")
-		}
-	}()
-
-	go func() {
-		if err := httpServer.Start(); err != nil {
-			logger.Fatal().Err(err).Msg("HTTP server failed")
-		}
-	}()
-
 	logger.Info().
-		Int("smtp_port", cfg.SMTP.Port).
-		Int("http_port", cfg.HTTP.Port).
+		Str("smtp_addr", srv.SMTPAddr()).
+		Str("http_addr", srv.HTTPAddr()).
 		Msg("GoWebMail started successfully")
 
-	// Wait for shutdown signal
-	waitForShutdown(smtpServer, httpServer, logger)
+	// Reload on SIGHUP until a shutdown signal
+	var changed <-chan struct{}
+	if *watchConfig {
+		changed = watchFile(*configPath, configWatchInterval)
+	}
+	waitForShutdown(srv, logger, *configPath, *settings, changed)
 }
 
-// setupLogger configures the logger based on configuration
-func setupLogger(cfg config.LoggingConfig) zerolog.Logger {
-	// Set log level
-	level := zerolog.InfoLevel
-	switch cfg.Level {
-	case "debug":
-		level = zerolog.DebugLevel
-	case "info":
-		level = zerolog.InfoLevel
-	case "warn":
-		level = zerolog.WarnLevel
-	case "error":
-		level = zerolog.ErrorLevel
-	}
-	zerolog.SetGlobalLevel(level)
-
-	// Configure output
-	var output io.Writer = os.Stdout
-	if cfg.Output != "stdout" && cfg.Output != "" {
-		file, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		if err == nil {
-			output = file
+// waitForShutdown waits for a shutdown signal and gracefully shuts down
+// servers. Meanwhile SIGHUP, or a signal on changed, reloads the
+// configuration.
+func waitForShutdown(srv *gowebmail.Server, logger zerolog.Logger, configPath string, settings []setting, changed <-chan struct{}) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig != syscall.SIGHUP {
+				logger.Info().Msg("Shutdown signal received")
+				shutdown(srv)
+				return
+			}
+			logger.Info().Msg("SIGHUP received; reloading configuration")
+		case <-changed:
+			logger.Info().Str("config", configPath).Msg("Configuration file changed; reloading")
 		}
+		reloadConfig(srv, configPath, settings, logger)
 	}
-
-	// Configure format
-	if cfg.Format == "text" {
-		output = zerolog.ConsoleWriter{Out: output, TimeFormat: time.RFC3339}
-	}
-
-	return zerolog.New(output).With().Timestamp().Logger()
 }
 
-// waitForShutdown waits for a shutdown signal and gracefully shuts down servers
-func waitForShutdown(smtpServer *smtp.Server, httpServer *api.Server, logger zerolog.Logger) {
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-
-	<-sigChan
-	logger.Info().Msg("Shutdown signal received")
-
+// shutdown gracefully shuts down the servers
+func shutdown(srv *gowebmail.Server) {
 	// Create shutdown context with timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	// Shutdown servers gracefully
-	logger.Info().Msg("Shutting down SMTP server...")
-	if err := smtpServer.Shutdown(ctx); err != nil {
-		logger.Error().Err(err).Msg("SMTP server shutdown error")
-	}
-
-	logger.Info().Msg("Shutting down HTTP server...")
-	if err := httpServer.Shutdown(ctx); err != nil {
-		logger.Error().Err(err).Msg("HTTP server shutdown error")
-	}
-
-	logger.Info().Msg("Shutdown complete")
+	srv.Shutdown(ctx)
 }
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/pkg/gowebmail"
+)
+
+// configWatchInterval is how often -watch-config checks the file
+const configWatchInterval = 2 * time.Second
+
+// reloadConfig reads the configuration file and environment again and
+// applies them, with the settings given on the command line. On failure
+// the running configuration is kept.
+func reloadConfig(srv *gowebmail.Server, path string, settings []setting, logger zerolog.Logger) {
+	cfg, err := loadConfig(path, settings)
+	if err == nil {
+		err = srv.Reload(cfg)
+	}
+	if err != nil {
+		logger.Error().Err(err).Str("config", path).Msg("Failed to reload configuration; keeping the current one")
+	}
+}
+
+// watchFile signals when the file at path is modified, checking every
+// interval. A file that is missing, e.g. while an editor replaces it, is
+// not a change.
+func watchFile(path string, interval time.Duration) <-chan struct{} {
+	changed := make(chan struct{}, 1)
+	modified := func() (time.Time, bool) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return info.ModTime(), true
+	}
+
+	last, _ := modified()
+	go func() {
+		for range time.Tick(interval) {
+			modTime, ok := modified()
+			if !ok || modTime.Equal(last) {
+				continue
+			}
+			last = modTime
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changed
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+	"gowebmail/pkg/gowebmail"
+)
+
+// runRestore implements the restore subcommand, which loads a backup
+// created by POST /api/admin/backup into the configured database
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := fs.String("config", "gowebmail.yml", "Path to configuration file")
+	force := fs.Bool("force", false, "Replace an existing database")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gowebmail restore [flags] <backup-file>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("a backup file is required")
+	}
+	backup := fs.Arg(0)
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		return err
+	}
+
+	version, err := storage.RestoreBackup(backup, &cfg.Storage, *force)
+	if err != nil {
+		if errors.Is(err, storage.ErrDatabaseExists) {
+			return fmt.Errorf("%w (use -force to replace it; stop the server first)", err)
+		}
+		return err
+	}
+
+	// Open the restored database once to apply any pending migrations
+	logger := gowebmail.NewLogger(cfg.Logging)
+	store, err := storage.NewSQLiteStorage(&cfg.Storage, logger)
+	if err != nil {
+		return fmt.Errorf("restored database could not be opened: %w", err)
+	}
+	defer store.Close()
+
+	count, err := store.GetEmailCount()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s to %s (schema version %d, %d emails)\n", backup, cfg.Storage.Path, version, count)
+	if cfg.Storage.Blobs.Type != "" && cfg.Storage.Blobs.Type != "database" {
+		fmt.Printf("Note: attachments in the %s blob store are not part of database backups\n", cfg.Storage.Blobs.Type)
+	}
+
+	return nil
+}
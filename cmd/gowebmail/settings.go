@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"strings"
+
+	"gowebmail/internal/config"
+)
+
+// settingFlags are shorthand flags for common settings
+var settingFlags = []struct {
+	name  string
+	path  string
+	usage string
+}{
+	{"smtp-host", "smtp.host", "SMTP listen `address`"},
+	{"smtp-port", "smtp.port", "SMTP `port`"},
+	{"http-host", "http.host", "Web UI and API listen `address`"},
+	{"http-port", "http.port", "Web UI and API `port`"},
+	{"storage-path", "storage.path", "Database `file`, or :memory:"},
+	{"fixtures", "storage.fixtures", "Load the .eml files in `dir` at startup"},
+	{"log-level", "logging.level", "Log `level`: debug, info, warn or error"},
+	{"log-format", "logging.format", "Log `format`: json or text"},
+}
+
+// setting is a setting given on the command line
+type setting struct {
+	path  string
+	value string
+}
+
+// settingOverrides registers the setting flags on fs. The returned list
+// holds the settings given, in order, once fs has been parsed.
+func settingOverrides(fs *flag.FlagSet) *[]setting {
+	settings := &[]setting{}
+	add := func(path, value string) error {
+		// Check the path and value now rather than after loading the file
+		if err := config.Default().Set(path, value); err != nil {
+			return err
+		}
+		*settings = append(*settings, setting{path, value})
+		return nil
+	}
+
+	for _, f := range settingFlags {
+		path := f.path
+		fs.Func(f.name, f.usage+" (sets "+path+")", func(value string) error {
+			return add(path, value)
+		})
+	}
+	fs.Func("set", "Set any setting as `path=value`, e.g. retention.max_count=500; repeatable", func(v string) error {
+		path, value, ok := strings.Cut(v, "=")
+		if !ok {
+			return errors.New("want path=value")
+		}
+		return add(path, value)
+	})
+	return settings
+}
+
+// loadConfig loads the configuration file and environment, then applies
+// the settings given on the command line, which take precedence
+func loadConfig(path string, settings []setting) (*config.Config, error) {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range settings {
+		if err := cfg.Set(s.path, s.value); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gowebmail/internal/api"
+	"gowebmail/internal/storage"
+)
+
+// tailReconnectDelay is how long tail waits before reconnecting
+const tailReconnectDelay = 2 * time.Second
+
+// tailFilter matches new emails whose field contains value. An empty
+// field matches the sender, recipients or subject.
+type tailFilter struct {
+	field string
+	value string
+}
+
+// tailFields are the fields of new email events that filters can match
+var tailFields = []string{"from", "to", "subject"}
+
+// filterList collects repeated -filter flags
+type filterList []tailFilter
+
+func (l *filterList) String() string {
+	parts := make([]string, len(*l))
+	for i, f := range *l {
+		parts[i] = f.field + "=" + f.value
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *filterList) Set(value string) error {
+	field, text, ok := strings.Cut(value, "=")
+	if !ok {
+		field, text = "", value
+	}
+	field = strings.ToLower(field)
+	if field != "" && field != "from" && field != "to" && field != "subject" {
+		return fmt.Errorf("unknown field %q; use from, to or subject", field)
+	}
+	if text == "" {
+		return errors.New("empty filter")
+	}
+	*l = append(*l, tailFilter{field: field, value: strings.ToLower(text)})
+	return nil
+}
+
+// match reports whether the data of a new email event passes the filter
+func (f tailFilter) match(data map[string]interface{}) bool {
+	fields := tailFields
+	if f.field != "" {
+		fields = []string{f.field}
+	}
+	for _, field := range fields {
+		if strings.Contains(strings.ToLower(eventText(data[field])), f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventText formats a value of decoded event data
+func eventText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, item := range v {
+			parts[i] = eventText(item)
+		}
+		return strings.Join(parts, ", ")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// tailOptions are the flags of the tail subcommand
+type tailOptions struct {
+	savedSearch string
+	filters     filterList
+	json        bool
+	body        bool
+	events      bool
+}
+
+// runTail implements the tail subcommand, which prints emails as they
+// arrive until interrupted, reconnecting if the connection is lost
+func runTail(args []string) error {
+	fs := newClientFlagSet("tail", "[flags]")
+	newClient := clientFlags(fs)
+	var opts tailOptions
+	fs.Var(&opts.filters, "filter", "Only emails whose from, to or subject contains this; field=value matches one field. Repeat to require several")
+	fs.StringVar(&opts.savedSearch, "saved-search", "", "Only emails matching this saved search")
+	fs.BoolVar(&opts.json, "json", false, "Print each event as a line of JSON")
+	fs.BoolVar(&opts.body, "body", false, "Print the text body of each email")
+	fs.BoolVar(&opts.events, "events", false, "Also print updates and deletions, not just new emails")
+	reconnect := fs.Bool("reconnect", true, "Reconnect when the connection is lost")
+	fs.Parse(args)
+
+	c, err := newClient()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	connected := false
+	for {
+		err := c.tail(ctx, &opts, func() {
+			if connected {
+				fmt.Fprintln(os.Stderr, "Reconnected")
+			} else {
+				fmt.Fprintf(os.Stderr, "Tailing %s\n", c.baseURL)
+			}
+			connected = true
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		// A first connection that fails is likely a wrong URL or key
+		if !*reconnect || !connected {
+			return err
+		}
+
+		fmt.Fprintf(os.Stderr, "Connection lost: %v; reconnecting\n", err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(tailReconnectDelay):
+		}
+	}
+}
+
+// tail connects to the WebSocket endpoint and prints events until the
+// connection ends or ctx is done. onConnect is called once connected.
+func (c *client) tail(ctx context.Context, opts *tailOptions, onConnect func()) error {
+	u := *c.baseURL
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u.Path += "/ws"
+	if opts.savedSearch != "" {
+		u.RawQuery = url.Values{"savedSearch": {opts.savedSearch}}.Encode()
+	}
+	header := http.Header{}
+	if c.apiKey != "" {
+		header.Set("X-API-Key", c.apiKey)
+	}
+
+	conn, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("failed to connect: %s", resp.Status)
+		}
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	onConnect()
+
+	// Closing the connection ends the read loop on interrupt
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+				time.Now().Add(time.Second))
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		var msg api.WebSocketMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		if err := c.printEvent(ctx, opts, &msg); err != nil {
+			return err
+		}
+	}
+}
+
+// printEvent prints an event if it passes the options
+func (c *client) printEvent(ctx context.Context, opts *tailOptions, msg *api.WebSocketMessage) error {
+	if msg.Type != "email.new" {
+		if !opts.events || msg.Type == "pong" {
+			return nil
+		}
+	} else {
+		for _, f := range opts.filters {
+			if !f.match(msg.Data) {
+				return nil
+			}
+		}
+	}
+
+	if opts.json {
+		return json.NewEncoder(os.Stdout).Encode(msg)
+	}
+
+	now := time.Now().Format(time.TimeOnly)
+	if msg.Type != "email.new" {
+		data, _ := json.Marshal(msg.Data)
+		fmt.Printf("%s  %s  %s\n", now, msg.Type, data)
+		return nil
+	}
+
+	received := now
+	if t, err := time.Parse(time.RFC3339, eventText(msg.Data["receivedAt"])); err == nil {
+		received = t.Local().Format(time.TimeOnly)
+	}
+	id := eventText(msg.Data["id"])
+	fmt.Printf("%s  #%s  %s -> %s  %s\n", received, id,
+		eventText(msg.Data["from"]), eventText(msg.Data["to"]), eventText(msg.Data["subject"]))
+
+	if opts.body {
+		// Events only carry a summary
+		var e storage.Email
+		if err := c.call(ctx, http.MethodGet, "/api/emails/"+id, nil, nil, &e); err != nil {
+			fmt.Fprintf(os.Stderr, "    (body unavailable: %v)\n", err)
+			return nil
+		}
+		body := strings.TrimRight(strings.ReplaceAll(e.BodyPlain, "\r\n", "\n"), "\n")
+		if body == "" && e.BodyHTML != "" {
+			body = "(HTML only)"
+		}
+		for _, line := range strings.Split(body, "\n") {
+			fmt.Println("    " + line)
+		}
+		fmt.Println()
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"gowebmail/internal/notify"
+)
+
+// runVAPIDKey prints a new key for signing Web Push requests, as a line
+// of the push section of the configuration file
+func runVAPIDKey(args []string) error {
+	fs := flag.NewFlagSet("vapid-key", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gowebmail vapid-key")
+		fmt.Fprintln(fs.Output(), "Prints a new push.vapid_private_key. Changing the key cancels the browser subscriptions made with the old one.")
+	}
+	fs.Parse(args)
+
+	key, err := notify.GenerateVAPIDKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("vapid_private_key: %q\n", key)
+	return nil
+}
@@ -0,0 +1,133 @@
+// Package access limits the clients of the listeners by IP address
+package access
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+// List decides which client addresses a listener accepts
+type List struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// New compiles the allow and deny lists of a listener
+func New(cfg *config.AccessConfig) (*List, error) {
+	allow, err := ParsePrefixes(cfg.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("access.allow: %w", err)
+	}
+	deny, err := ParsePrefixes(cfg.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("access.deny: %w", err)
+	}
+	return &List{allow: allow, deny: deny}, nil
+}
+
+// ParsePrefixes parses CIDR ranges, and single addresses as ranges of one
+func ParsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address or CIDR range %q", entry)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR range %q", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Empty reports whether the list accepts every address
+func (l *List) Empty() bool {
+	return len(l.allow) == 0 && len(l.deny) == 0
+}
+
+// Allows reports whether a client may connect from addr. Denied ranges
+// win over allowed ones; without allowed ranges, every address not denied
+// is allowed.
+func (l *List) Allows(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if contains(l.deny, addr) {
+		return false
+	}
+	return len(l.allow) == 0 || contains(l.allow, addr)
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener returns ln limited to the clients cfg allows, or ln itself
+// when cfg allows every client. Connections from other addresses are
+// closed as soon as they are accepted, before anything is read from them.
+func Listener(ln net.Listener, cfg *config.AccessConfig, logger zerolog.Logger) (net.Listener, error) {
+	list, err := New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if list.Empty() {
+		return ln, nil
+	}
+	return &listener{Listener: ln, list: list, logger: logger}, nil
+}
+
+// listener closes the connections its list does not allow
+type listener struct {
+	net.Listener
+	list   *List
+	logger zerolog.Logger
+}
+
+// Accept returns the next allowed connection
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		addr, ok := remoteAddr(conn)
+		if ok && l.list.Allows(addr) {
+			return conn, nil
+		}
+		// Debug only, as scanners of an exposed instance would flood the log
+		l.logger.Debug().
+			Str("remote", conn.RemoteAddr().String()).
+			Str("listener", l.Addr().String()).
+			Msg("Connection refused by access list")
+		conn.Close()
+	}
+}
+
+// remoteAddr returns the IP address a connection comes from
+func remoteAddr(conn net.Conn) (netip.Addr, bool) {
+	if tcp, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		addr, ok := netip.AddrFromSlice(tcp.IP)
+		return addr, ok
+	}
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr(), true
+}
@@ -0,0 +1,283 @@
+// Package acme obtains and renews TLS certificates from an ACME certificate
+// authority such as Let's Encrypt, using HTTP-01 challenges
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+const (
+	// challengePath is where HTTP-01 challenge tokens are served
+	challengePath = "/.well-known/acme-challenge/"
+	// checkInterval is the longest time between certificate expiry checks
+	checkInterval = 12 * time.Hour
+	// retryInterval is the wait after a failed issuance; CAs rate limit
+	// failed validations
+	retryInterval = time.Hour
+)
+
+// ErrNoCertificate is returned by GetCertificate until the first
+// certificate has been issued
+var ErrNoCertificate = errors.New("acme: certificate not yet issued")
+
+// Manager keeps a certificate for the configured domains, issuing it on
+// start and renewing it before it expires
+type Manager struct {
+	config *config.ACMEConfig
+	logger zerolog.Logger
+	client *http.Client
+
+	mu     sync.RWMutex
+	cert   *tls.Certificate
+	tokens map[string]string // HTTP-01 token -> key authorization
+}
+
+// NewManager creates a new certificate manager. Certificates are issued
+// when Start runs.
+func NewManager(cfg *config.ACMEConfig, logger zerolog.Logger) *Manager {
+	return &Manager{
+		config: cfg,
+		logger: logger,
+		client: &http.Client{Timeout: 30 * time.Second},
+		tokens: make(map[string]string),
+	}
+}
+
+// GetCertificate returns the current certificate, for tls.Config
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil {
+		return nil, ErrNoCertificate
+	}
+	return m.cert, nil
+}
+
+// HTTPHandler answers HTTP-01 challenges and passes other requests to
+// fallback
+func (m *Manager) HTTPHandler(fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.URL.Path, challengePath)
+		if !ok {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		m.mu.RLock()
+		keyAuth, ok := m.tokens[token]
+		m.mu.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(keyAuth))
+	})
+}
+
+// Start loads the cached certificate and keeps it renewed until ctx is
+// cancelled
+func (m *Manager) Start(ctx context.Context) {
+	if len(m.config.Domains) == 0 {
+		m.logger.Error().Msg("ACME enabled without domains; no certificate will be issued")
+		return
+	}
+
+	if cert, err := tls.LoadX509KeyPair(m.certPath(), m.keyPath()); err == nil {
+		m.setCertificate(&cert)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		m.logger.Warn().Err(err).Msg("Ignoring unreadable cached certificate")
+	}
+
+	for {
+		wait := m.renew(ctx)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			m.logger.Info().Msg("ACME certificate manager stopped")
+			return
+		}
+	}
+}
+
+// renew issues a certificate if there is none or it is due for renewal,
+// and returns how long to wait before checking again
+func (m *Manager) renew(ctx context.Context) time.Duration {
+	m.mu.RLock()
+	cert := m.cert
+	m.mu.RUnlock()
+
+	if cert != nil && m.covers(cert.Leaf) {
+		renewAt := cert.Leaf.NotAfter.Add(-m.config.RenewBefore)
+		if wait := time.Until(renewAt); wait > 0 {
+			return min(wait, checkInterval)
+		}
+	}
+
+	m.logger.Info().Strs("domains", m.config.Domains).Msg("Requesting certificate")
+	if err := m.obtain(ctx); err != nil {
+		if ctx.Err() == nil {
+			m.logger.Error().Err(err).Dur("retry_in", retryInterval).Msg("Failed to obtain certificate")
+		}
+		return retryInterval
+	}
+
+	m.mu.RLock()
+	expires := m.cert.Leaf.NotAfter
+	m.mu.RUnlock()
+	m.logger.Info().Time("expires", expires).Msg("Certificate issued")
+	return checkInterval
+}
+
+// obtain runs an ACME order for the configured domains and installs and
+// caches the issued certificate
+func (m *Manager) obtain(ctx context.Context) error {
+	accountKey, err := m.accountKey()
+	if err != nil {
+		return err
+	}
+
+	c := &client{http: m.client, key: accountKey}
+	if err := c.discover(ctx, m.config.DirectoryURL); err != nil {
+		return err
+	}
+	if err := c.register(ctx, m.config.Email); err != nil {
+		return err
+	}
+
+	o, orderURL, err := c.newOrder(ctx, m.config.Domains)
+	if err != nil {
+		return err
+	}
+
+	var tokens []string
+	defer func() {
+		m.mu.Lock()
+		for _, token := range tokens {
+			delete(m.tokens, token)
+		}
+		m.mu.Unlock()
+	}()
+	for _, authz := range o.Authorizations {
+		err := c.authorize(ctx, authz, func(token, keyAuth string) {
+			m.mu.Lock()
+			m.tokens[token] = keyAuth
+			m.mu.Unlock()
+			tokens = append(tokens, token)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	certKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: m.config.Domains}, certKey)
+	if err != nil {
+		return err
+	}
+
+	chain, err := c.finalize(ctx, o, orderURL, csr)
+	if err != nil {
+		return err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(certKey)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	cert, err := tls.X509KeyPair(chain, keyPEM)
+	if err != nil {
+		return fmt.Errorf("acme: issued certificate is unusable: %w", err)
+	}
+	m.setCertificate(&cert)
+
+	if err := os.WriteFile(m.keyPath(), keyPEM, 0600); err != nil {
+		m.logger.Warn().Err(err).Msg("Failed to cache certificate key")
+	} else if err := os.WriteFile(m.certPath(), chain, 0644); err != nil {
+		m.logger.Warn().Err(err).Msg("Failed to cache certificate")
+	}
+	return nil
+}
+
+// accountKey loads the cached account key, creating it on first use
+func (m *Manager) accountKey() (*ecdsa.PrivateKey, error) {
+	path := filepath.Join(m.config.CacheDir, "account.key")
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("acme: %s is not a PEM key", path)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(m.config.CacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create ACME cache directory: %w", err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return nil, fmt.Errorf("failed to save ACME account key: %w", err)
+	}
+	return key, nil
+}
+
+// covers reports whether cert is valid for every configured domain, which
+// is not the case for a cached certificate after domains were added
+func (m *Manager) covers(cert *x509.Certificate) bool {
+	for _, domain := range m.config.Domains {
+		if cert.VerifyHostname(domain) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *Manager) setCertificate(cert *tls.Certificate) {
+	m.mu.Lock()
+	m.cert = cert
+	m.mu.Unlock()
+}
+
+// certPath and keyPath name the cached certificate after its first domain
+func (m *Manager) certPath() string {
+	return filepath.Join(m.config.CacheDir, m.config.Domains[0]+".crt")
+}
+
+func (m *Manager) keyPath() string {
+	return filepath.Join(m.config.CacheDir, m.config.Domains[0]+".key")
+}
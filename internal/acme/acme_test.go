@@ -0,0 +1,496 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+func init() {
+	pollInterval = 10 * time.Millisecond
+}
+
+// fakeCA is an ACME server (RFC 8555) that checks requests as Pebble
+// does: every POST is a JWS with a fresh nonce and its own URL, signed
+// by the account key, and HTTP-01 challenges are validated against the
+// manager's handler
+type fakeCA struct {
+	srv     *httptest.Server
+	manager *Manager
+	domains []string
+	caKey   *ecdsa.PrivateKey
+	caCert  *x509.Certificate
+
+	// badNonce rejects the next new order as sent with a stale nonce;
+	// wrongKeyAuth makes validation fetch another response
+	badNonce, wrongKeyAuth bool
+
+	mu          sync.Mutex
+	nonce       int
+	nonces      map[string]bool
+	accountKey  *ecdsa.PublicKey
+	thumbprints []string          // of the accounts registered
+	authzs      map[string]*authz // by path
+	fetches     map[string]int
+	certificate []byte
+}
+
+// authz is the state of an authorization of the fake CA
+type authz struct {
+	domain, token string
+	status        string
+	err           *problem
+}
+
+func newFakeCA(t *testing.T, domains ...string) *fakeCA {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME Root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+
+	ca := &fakeCA{
+		domains: domains,
+		caKey:   caKey,
+		caCert:  caCert,
+		nonces:  make(map[string]bool),
+		authzs:  make(map[string]*authz),
+		fetches: make(map[string]int),
+	}
+	ca.srv = httptest.NewServer(http.HandlerFunc(ca.serve))
+	t.Cleanup(ca.srv.Close)
+	return ca
+}
+
+// newManager returns a manager of the CA's domains caching in dir
+func (ca *fakeCA) newManager(dir string) *Manager {
+	ca.manager = NewManager(&config.ACMEConfig{
+		Enabled:      true,
+		Domains:      ca.domains,
+		Email:        "admin@example.com",
+		DirectoryURL: ca.srv.URL + "/directory",
+		CacheDir:     dir,
+		RenewBefore:  30 * 24 * time.Hour,
+	}, zerolog.Nop())
+	return ca.manager
+}
+
+func (ca *fakeCA) serve(w http.ResponseWriter, r *http.Request) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+
+	ca.nonce++
+	nonce := fmt.Sprintf("nonce-%d", ca.nonce)
+	ca.nonces[nonce] = true
+	w.Header().Set("Replay-Nonce", nonce)
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/directory":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"newNonce":   ca.srv.URL + "/new-nonce",
+			"newAccount": ca.srv.URL + "/new-account",
+			"newOrder":   ca.srv.URL + "/new-order",
+			"revokeCert": ca.srv.URL + "/revoke-cert",
+			"meta":       map[string]string{"termsOfService": ca.srv.URL + "/terms"},
+		})
+		return
+	case r.Method == http.MethodHead && r.URL.Path == "/new-nonce":
+		return
+	case r.Method != http.MethodPost:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	payload, err := ca.verify(r)
+	if err != nil {
+		ca.fail(w, http.StatusBadRequest, err)
+		return
+	}
+	postAsGet := len(payload) == 0
+
+	switch path := r.URL.Path; {
+	case path == "/new-account":
+		var account struct {
+			TermsOfServiceAgreed bool
+			Contact              []string
+		}
+		json.Unmarshal(payload, &account)
+		if !account.TermsOfServiceAgreed || !slices.Equal(account.Contact, []string{"mailto:admin@example.com"}) {
+			ca.fail(w, http.StatusBadRequest, &problem{Type: "urn:ietf:params:acme:error:malformed", Detail: string(payload)})
+			return
+		}
+		w.Header().Set("Location", ca.srv.URL+"/acct/1")
+		ca.reply(w, http.StatusCreated, map[string]interface{}{"status": "valid", "contact": account.Contact})
+
+	case path == "/new-order":
+		if ca.badNonce {
+			ca.badNonce = false
+			ca.fail(w, http.StatusBadRequest, &problem{Type: "urn:ietf:params:acme:error:badNonce", Detail: "JWS has an invalid anti-replay nonce"})
+			return
+		}
+		var o struct{ Identifiers []identifier }
+		json.Unmarshal(payload, &o)
+		var urls []string
+		for i, id := range o.Identifiers {
+			if id.Type != "dns" || id.Value != ca.domains[i] {
+				ca.fail(w, http.StatusBadRequest, &problem{Type: "urn:ietf:params:acme:error:rejectedIdentifier", Detail: id.Value})
+				return
+			}
+			p := fmt.Sprintf("/authz/%d", i)
+			ca.authzs[p] = &authz{domain: id.Value, token: fmt.Sprintf("tok_%d-%s", i, strings.Repeat("x", 32)), status: "pending"}
+			urls = append(urls, ca.srv.URL+p)
+		}
+		w.Header().Set("Location", ca.srv.URL+"/order/1")
+		ca.reply(w, http.StatusCreated, map[string]interface{}{
+			"status":         "pending",
+			"expires":        time.Now().Add(time.Hour).Format(time.RFC3339),
+			"identifiers":    o.Identifiers,
+			"authorizations": urls,
+			"finalize":       ca.srv.URL + "/finalize/1",
+		})
+
+	case strings.HasPrefix(path, "/authz/") && postAsGet:
+		a := ca.authzs[path]
+		if a == nil {
+			ca.fail(w, http.StatusNotFound, &problem{Type: "urn:ietf:params:acme:error:malformed", Detail: "no authorization"})
+			return
+		}
+		// Validation is reported once the authorization was polled
+		status := a.status
+		if ca.fetches[path]++; ca.fetches[path] == 2 && (status == "valid" || status == "invalid") {
+			status = "processing"
+		}
+		http01 := map[string]interface{}{"type": "http-01", "url": ca.srv.URL + "/chal" + path, "token": a.token, "status": status}
+		if status == "invalid" {
+			http01["error"] = a.err
+		}
+		ca.reply(w, http.StatusOK, map[string]interface{}{
+			"status":     status,
+			"identifier": identifier{Type: "dns", Value: a.domain},
+			"challenges": []interface{}{
+				map[string]string{"type": "dns-01", "url": ca.srv.URL + "/chal/dns", "token": "dns-token", "status": "pending"},
+				http01,
+				map[string]string{"type": "tls-alpn-01", "url": ca.srv.URL + "/chal/alpn", "token": "alpn-token", "status": "pending"},
+			},
+		})
+
+	case strings.HasPrefix(path, "/chal/authz/"):
+		a := ca.authzs[strings.TrimPrefix(path, "/chal")]
+		if a == nil || string(payload) != "{}" {
+			ca.fail(w, http.StatusBadRequest, &problem{Type: "urn:ietf:params:acme:error:malformed", Detail: "bad challenge response " + string(payload)})
+			return
+		}
+		ca.validate(a)
+		ca.reply(w, http.StatusOK, map[string]string{"type": "http-01", "status": "processing", "token": a.token})
+
+	case path == "/finalize/1":
+		for _, a := range ca.authzs {
+			if a.status != "valid" {
+				ca.fail(w, http.StatusForbidden, &problem{Type: "urn:ietf:params:acme:error:orderNotReady", Detail: "order is not ready"})
+				return
+			}
+		}
+		var f struct{ CSR string }
+		json.Unmarshal(payload, &f)
+		if err := ca.issue(f.CSR); err != nil {
+			ca.fail(w, http.StatusBadRequest, &problem{Type: "urn:ietf:params:acme:error:badCSR", Detail: err.Error()})
+			return
+		}
+		w.Header().Set("Location", ca.srv.URL+"/order/1")
+		ca.reply(w, http.StatusOK, map[string]interface{}{"status": "processing", "finalize": ca.srv.URL + "/finalize/1"})
+
+	case path == "/order/1" && postAsGet:
+		ca.reply(w, http.StatusOK, map[string]interface{}{"status": "valid", "certificate": ca.srv.URL + "/cert/1"})
+
+	case path == "/cert/1" && postAsGet:
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(ca.certificate)
+
+	default:
+		ca.fail(w, http.StatusNotFound, &problem{Type: "urn:ietf:params:acme:error:malformed", Detail: "unexpected request to " + path})
+	}
+}
+
+// verify checks the JWS of a request and returns its payload
+func (ca *fakeCA) verify(r *http.Request) ([]byte, error) {
+	if r.Header.Get("Content-Type") != "application/jose+json" {
+		return nil, errors.New("content type is not application/jose+json")
+	}
+	var jws struct{ Protected, Payload, Signature string }
+	if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+		return nil, err
+	}
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(jws.Protected)
+	if err != nil {
+		return nil, err
+	}
+	var protected struct {
+		Alg, Nonce, URL, Kid string
+		JWK                  *struct{ Crv, Kty, X, Y string }
+	}
+	if err := json.Unmarshal(protectedJSON, &protected); err != nil {
+		return nil, err
+	}
+
+	if protected.Alg != "ES256" {
+		return nil, fmt.Errorf("alg %s", protected.Alg)
+	}
+	if !ca.nonces[protected.Nonce] {
+		return nil, &problem{Type: "urn:ietf:params:acme:error:badNonce", Detail: "unknown or used nonce " + protected.Nonce}
+	}
+	delete(ca.nonces, protected.Nonce)
+	if protected.URL != ca.srv.URL+r.URL.Path {
+		return nil, fmt.Errorf("url %s signed for %s", protected.URL, r.URL.Path)
+	}
+
+	// Only new accounts are signed by a JWK, others name the account
+	key := ca.accountKey
+	if r.URL.Path == "/new-account" {
+		if protected.JWK == nil || protected.Kid != "" {
+			return nil, errors.New("new account without a jwk")
+		}
+		jwk := protected.JWK
+		x, _ := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, _ := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if jwk.Kty != "EC" || jwk.Crv != "P-256" || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("jwk is not a P-256 key")
+		}
+		if key, err = ecdsa.ParseUncompressedPublicKey(elliptic.P256(), append(append([]byte{4}, x...), y...)); err != nil {
+			return nil, err
+		}
+		ca.accountKey = key
+		// The thumbprint hashes the required members in order (RFC 7638)
+		thumbprint := sha256.Sum256([]byte(`{"crv":"P-256","kty":"EC","x":"` + jwk.X + `","y":"` + jwk.Y + `"}`))
+		ca.thumbprints = append(ca.thumbprints, base64.RawURLEncoding.EncodeToString(thumbprint[:]))
+	} else if protected.JWK != nil || protected.Kid != ca.srv.URL+"/acct/1" || key == nil {
+		return nil, fmt.Errorf("request signed by %q", protected.Kid)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(jws.Signature)
+	if err != nil || len(signature) != 64 {
+		return nil, errors.New("signature is not r || s")
+	}
+	digest := sha256.Sum256([]byte(jws.Protected + "." + jws.Payload))
+	if !ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		return nil, errors.New("bad signature")
+	}
+	return base64.RawURLEncoding.DecodeString(jws.Payload)
+}
+
+// validate fetches the key authorization of a challenge from the manager,
+// as the CA does over HTTP from the domain
+func (ca *fakeCA) validate(a *authz) {
+	req := httptest.NewRequest(http.MethodGet, "http://"+a.domain+"/.well-known/acme-challenge/"+a.token, nil)
+	if ca.wrongKeyAuth {
+		req.URL.Path += "x"
+	}
+	rec := httptest.NewRecorder()
+	ca.manager.HTTPHandler(http.NotFoundHandler()).ServeHTTP(rec, req)
+
+	want := a.token + "." + ca.thumbprints[len(ca.thumbprints)-1]
+	if got := rec.Body.String(); rec.Code != http.StatusOK || got != want {
+		a.status = "invalid"
+		a.err = &problem{Type: "urn:ietf:params:acme:error:unauthorized", Detail: fmt.Sprintf("The key authorization file from the server did not match this challenge: %d %q", rec.Code, got), Status: 403}
+		return
+	}
+	a.status = "valid"
+}
+
+// issue signs a certificate for a CSR of the order's domains
+func (ca *fakeCA) issue(csr64 string) error {
+	der, err := base64.RawURLEncoding.DecodeString(csr64)
+	if err != nil {
+		return err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return err
+	}
+	if !slices.Equal(csr.DNSNames, ca.domains) {
+		return fmt.Errorf("CSR for %v", csr.DNSNames)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		DNSNames:     csr.DNSNames,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leaf, err := x509.CreateCertificate(rand.Reader, template, ca.caCert, csr.PublicKey, ca.caKey)
+	if err != nil {
+		return err
+	}
+	ca.certificate = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.caCert.Raw})...)
+	return nil
+}
+
+func (ca *fakeCA) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// fail answers with a problem document
+func (ca *fakeCA) fail(w http.ResponseWriter, status int, err error) {
+	p, ok := err.(*problem)
+	if !ok {
+		p = &problem{Type: "urn:ietf:params:acme:error:malformed", Detail: err.Error()}
+	}
+	p.Status = status
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func TestObtain(t *testing.T) {
+	ca := newFakeCA(t, "mail.example.com", "example.com")
+	ca.badNonce = true
+	dir := filepath.Join(t.TempDir(), "acme")
+	m := ca.newManager(dir)
+
+	if _, err := m.GetCertificate(nil); err != ErrNoCertificate {
+		t.Errorf("before issuance: got %v", err)
+	}
+	if err := m.obtain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := m.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cert.Certificate) != 2 || !slices.Equal(cert.Leaf.DNSNames, ca.domains) || !m.covers(cert.Leaf) {
+		t.Errorf("certificate for %v with %d certificates", cert.Leaf.DNSNames, len(cert.Certificate))
+	}
+	if ca.badNonce {
+		t.Error("new order not retried")
+	}
+
+	// The key and certificate are cached, and challenges are no longer
+	// answered
+	for name, mode := range map[string]os.FileMode{"account.key": 0600, "mail.example.com.key": 0600, "mail.example.com.crt": 0644} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Error(err)
+		} else if info.Mode().Perm() != mode {
+			t.Errorf("%s: mode %v", name, info.Mode().Perm())
+		}
+	}
+	for _, a := range ca.authzs {
+		rec := httptest.NewRecorder()
+		m.HTTPHandler(nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, challengePath+a.token, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("token %s still served", a.token)
+		}
+	}
+
+	// A renewal finds the account by its cached key
+	if err := ca.newManager(dir).obtain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(ca.thumbprints) != 2 || ca.thumbprints[0] != ca.thumbprints[1] {
+		t.Errorf("accounts %v", ca.thumbprints)
+	}
+}
+
+func TestObtainValidationFails(t *testing.T) {
+	ca := newFakeCA(t, "mail.example.com")
+	ca.wrongKeyAuth = true
+	m := ca.newManager(t.TempDir())
+
+	err := m.obtain(context.Background())
+	var p *problem
+	if !errors.As(err, &p) || p.Type != "urn:ietf:params:acme:error:unauthorized" ||
+		!strings.HasPrefix(err.Error(), "acme: validation of mail.example.com failed: ") {
+		t.Errorf("got %v", err)
+	}
+	if _, err := m.GetCertificate(nil); err != ErrNoCertificate {
+		t.Errorf("got %v", err)
+	}
+	if len(m.tokens) != 0 {
+		t.Errorf("tokens %v", m.tokens)
+	}
+}
+
+func TestObtainCancelled(t *testing.T) {
+	ca := newFakeCA(t, "mail.example.com")
+	m := ca.newManager(t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.obtain(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDiscoverRejectsIncompleteDirectory(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"newNonce":"https://ca.invalid/nonce","newAccount":"https://ca.invalid/acct"}`))
+	}))
+	defer srv.Close()
+	c := &client{http: srv.Client()}
+	if err := c.discover(context.Background(), srv.URL); err == nil || !strings.Contains(err.Error(), "missing required endpoints") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestHTTPHandler(t *testing.T) {
+	m := NewManager(&config.ACMEConfig{}, zerolog.Nop())
+	m.tokens["abc"] = "abc.thumbprint"
+	fallback := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	for path, want := range map[string]string{
+		challengePath + "abc": "200 abc.thumbprint",
+		challengePath + "abd": "404 404 page not found\n",
+		challengePath:         "404 404 page not found\n",
+		"/api/emails":         "418 ",
+	} {
+		rec := httptest.NewRecorder()
+		m.HTTPHandler(fallback).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if got := fmt.Sprintf("%d %s", rec.Code, rec.Body); got != want {
+			t.Errorf("%s: got %q, want %q", path, got, want)
+		}
+	}
+}
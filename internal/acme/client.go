@@ -0,0 +1,386 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// pollInterval and pollAttempts bound how long issuance waits for the CA
+var pollInterval = 2 * time.Second
+
+const pollAttempts = 60
+
+// client speaks the subset of RFC 8555 needed to order certificates with
+// HTTP-01 challenges
+type client struct {
+	http      *http.Client
+	key       *ecdsa.PrivateKey // account key
+	directory directory
+	kid       string // account URL, once registered
+	nonce     string
+}
+
+type directory struct {
+	NewNonce   string `json:"newNonce"`
+	NewAccount string `json:"newAccount"`
+	NewOrder   string `json:"newOrder"`
+}
+
+type identifier struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type order struct {
+	Status         string   `json:"status"`
+	Authorizations []string `json:"authorizations"`
+	Finalize       string   `json:"finalize"`
+	Certificate    string   `json:"certificate"`
+	Error          *problem `json:"error"`
+}
+
+type authorization struct {
+	Status     string      `json:"status"`
+	Identifier identifier  `json:"identifier"`
+	Challenges []challenge `json:"challenges"`
+}
+
+type challenge struct {
+	Type   string   `json:"type"`
+	URL    string   `json:"url"`
+	Token  string   `json:"token"`
+	Status string   `json:"status"`
+	Error  *problem `json:"error"`
+}
+
+// problem is an RFC 7807 error document returned by the CA
+type problem struct {
+	Type   string `json:"type"`
+	Detail string `json:"detail"`
+	Status int    `json:"status"`
+}
+
+func (p *problem) Error() string {
+	return fmt.Sprintf("acme: %s: %s", p.Type, p.Detail)
+}
+
+// discover fetches the directory of the CA
+func (c *client) discover(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("acme: failed to fetch directory: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("acme: directory returned %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&c.directory); err != nil {
+		return fmt.Errorf("acme: invalid directory: %w", err)
+	}
+	if c.directory.NewNonce == "" || c.directory.NewAccount == "" || c.directory.NewOrder == "" {
+		return errors.New("acme: directory is missing required endpoints")
+	}
+	return nil
+}
+
+// register creates the account, or looks up the existing one for the key
+func (c *client) register(ctx context.Context, email string) error {
+	payload := map[string]interface{}{"termsOfServiceAgreed": true}
+	if email != "" {
+		payload["contact"] = []string{"mailto:" + email}
+	}
+
+	header, _, err := c.post(ctx, c.directory.NewAccount, payload)
+	if err != nil {
+		return err
+	}
+	c.kid = header.Get("Location")
+	if c.kid == "" {
+		return errors.New("acme: account response has no Location")
+	}
+	return nil
+}
+
+// newOrder starts an order for domains and returns it with its URL
+func (c *client) newOrder(ctx context.Context, domains []string) (*order, string, error) {
+	ids := make([]identifier, len(domains))
+	for i, domain := range domains {
+		ids[i] = identifier{Type: "dns", Value: domain}
+	}
+
+	header, body, err := c.post(ctx, c.directory.NewOrder, map[string]interface{}{"identifiers": ids})
+	if err != nil {
+		return nil, "", err
+	}
+	var o order
+	if err := json.Unmarshal(body, &o); err != nil {
+		return nil, "", fmt.Errorf("acme: invalid order: %w", err)
+	}
+	return &o, header.Get("Location"), nil
+}
+
+// authorize completes the HTTP-01 challenge of an authorization. serve is
+// called with the token and key authorization before the CA is told to
+// validate it.
+func (c *client) authorize(ctx context.Context, url string, serve func(token, keyAuth string)) error {
+	var authz authorization
+	if err := c.fetch(ctx, url, &authz); err != nil {
+		return err
+	}
+	if authz.Status == "valid" {
+		return nil
+	}
+
+	var chal *challenge
+	for i := range authz.Challenges {
+		if authz.Challenges[i].Type == "http-01" {
+			chal = &authz.Challenges[i]
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acme: no http-01 challenge offered for %s", authz.Identifier.Value)
+	}
+
+	keyAuth, err := c.keyAuthorization(chal.Token)
+	if err != nil {
+		return err
+	}
+	serve(chal.Token, keyAuth)
+
+	if _, _, err := c.post(ctx, chal.URL, struct{}{}); err != nil {
+		return err
+	}
+
+	for i := 0; i < pollAttempts; i++ {
+		if err := sleep(ctx, pollInterval); err != nil {
+			return err
+		}
+		if err := c.fetch(ctx, url, &authz); err != nil {
+			return err
+		}
+		switch authz.Status {
+		case "valid":
+			return nil
+		case "pending", "processing":
+			continue
+		}
+		for _, ch := range authz.Challenges {
+			if ch.Type == "http-01" && ch.Error != nil {
+				return fmt.Errorf("acme: validation of %s failed: %w", authz.Identifier.Value, ch.Error)
+			}
+		}
+		return fmt.Errorf("acme: authorization for %s is %s", authz.Identifier.Value, authz.Status)
+	}
+	return fmt.Errorf("acme: timed out validating %s", authz.Identifier.Value)
+}
+
+// finalize submits the CSR and returns the PEM certificate chain once the
+// CA has issued it
+func (c *client) finalize(ctx context.Context, o *order, orderURL string, csr []byte) ([]byte, error) {
+	_, body, err := c.post(ctx, o.Finalize, map[string]string{"csr": base64.RawURLEncoding.EncodeToString(csr)})
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, o); err != nil {
+		return nil, fmt.Errorf("acme: invalid order: %w", err)
+	}
+
+	for i := 0; o.Status != "valid"; i++ {
+		if o.Status == "invalid" {
+			if o.Error != nil {
+				return nil, o.Error
+			}
+			return nil, errors.New("acme: order is invalid")
+		}
+		if i == pollAttempts {
+			return nil, errors.New("acme: timed out waiting for the certificate")
+		}
+		if err := sleep(ctx, pollInterval); err != nil {
+			return nil, err
+		}
+		if err := c.fetch(ctx, orderURL, o); err != nil {
+			return nil, err
+		}
+	}
+
+	_, chain, err := c.post(ctx, o.Certificate, nil)
+	return chain, err
+}
+
+// fetch reads a resource with POST-as-GET and decodes it into v
+func (c *client) fetch(ctx context.Context, url string, v interface{}) error {
+	_, body, err := c.post(ctx, url, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("acme: invalid response from %s: %w", url, err)
+	}
+	return nil
+}
+
+// post sends a JWS-signed request. A nil payload makes it a POST-as-GET.
+// Requests rejected for a stale nonce are retried once.
+func (c *client) post(ctx context.Context, url string, payload interface{}) (http.Header, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		header, body, err := c.postOnce(ctx, url, payload)
+		var p *problem
+		if attempt == 0 && errors.As(err, &p) && p.Type == "urn:ietf:params:acme:error:badNonce" {
+			continue
+		}
+		return header, body, err
+	}
+}
+
+func (c *client) postOnce(ctx context.Context, url string, payload interface{}) (http.Header, []byte, error) {
+	if c.nonce == "" {
+		if err := c.fetchNonce(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	jws, err := c.sign(url, payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jws))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("acme: request to %s failed: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode >= 400 {
+		p := &problem{Status: resp.StatusCode}
+		if json.Unmarshal(body, p) != nil || p.Type == "" {
+			return nil, nil, fmt.Errorf("acme: %s returned %s", url, resp.Status)
+		}
+		return nil, nil, p
+	}
+	return resp.Header, body, nil
+}
+
+func (c *client) fetchNonce(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.directory.NewNonce, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("acme: failed to get nonce: %w", err)
+	}
+	resp.Body.Close()
+
+	c.nonce = resp.Header.Get("Replay-Nonce")
+	if c.nonce == "" {
+		return errors.New("acme: no nonce returned")
+	}
+	return nil
+}
+
+// sign encodes payload as a flattened JWS signed with the account key.
+// Requests before registration carry the public key instead of the
+// account URL.
+func (c *client) sign(url string, payload interface{}) ([]byte, error) {
+	protected := map[string]interface{}{
+		"alg":   "ES256",
+		"nonce": c.nonce,
+		"url":   url,
+	}
+	if c.kid != "" {
+		protected["kid"] = c.kid
+	} else {
+		jwk, err := c.jwk()
+		if err != nil {
+			return nil, err
+		}
+		protected["jwk"] = jwk
+	}
+	c.nonce = ""
+
+	protectedJSON, err := json.Marshal(protected)
+	if err != nil {
+		return nil, err
+	}
+	payload64 := ""
+	if payload != nil {
+		payloadJSON, err := json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+		payload64 = base64.RawURLEncoding.EncodeToString(payloadJSON)
+	}
+	protected64 := base64.RawURLEncoding.EncodeToString(protectedJSON)
+
+	digest := sha256.Sum256([]byte(protected64 + "." + payload64))
+	r, s, err := ecdsa.Sign(rand.Reader, c.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	return json.Marshal(map[string]string{
+		"protected": protected64,
+		"payload":   payload64,
+		"signature": base64.RawURLEncoding.EncodeToString(sig),
+	})
+}
+
+// jwk returns the public account key as a JWK, with its members in the
+// order required for thumbprints (RFC 7638)
+func (c *client) jwk() (json.RawMessage, error) {
+	pub, err := c.key.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	point := pub.Bytes() // 0x04 || X || Y
+	return json.RawMessage(fmt.Sprintf(`{"crv":"P-256","kty":"EC","x":"%s","y":"%s"}`,
+		base64.RawURLEncoding.EncodeToString(point[1:33]),
+		base64.RawURLEncoding.EncodeToString(point[33:]))), nil
+}
+
+// keyAuthorization returns the response to an HTTP-01 challenge token
+func (c *client) keyAuthorization(token string) (string, error) {
+	jwk, err := c.jwk()
+	if err != nil {
+		return "", err
+	}
+	thumbprint := sha256.Sum256(jwk)
+	return token + "." + base64.RawURLEncoding.EncodeToString(thumbprint[:]), nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
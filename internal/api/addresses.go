@@ -0,0 +1,26 @@
+package api
+
+import (
+	"net/http"
+	"net/mail"
+
+	"github.com/gorilla/mux"
+)
+
+// handleAddressEmails handles GET /api/addresses/{address}/emails, which
+// lists the emails delivered to an address as GET /api/emails does. With
+// plus-addressing, an address without a tag such as qa@example.com also
+// gets the mail of its subaddresses such as qa+run42@example.com, while a
+// subaddress gets only its own, so parallel test runs can each tag their
+// address and read their own mail. exact=true matches the address alone.
+func (s *Server) handleAddressEmails(w http.ResponseWriter, r *http.Request) {
+	address := mux.Vars(r)["address"]
+	if parsed, err := mail.ParseAddress(address); err != nil || parsed.Address != address {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ADDRESS", "Invalid address "+address)
+		return
+	}
+
+	filter := parseEmailFilter(r)
+	filter.Inbox, filter.InboxExact = address, parseBoolParam(r, "exact")
+	s.sendEmailList(w, r, filter)
+}
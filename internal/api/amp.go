@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+
+	"gowebmail/internal/email"
+	"gowebmail/internal/storage"
+)
+
+// handleGetAMP handles GET /api/emails/{id}/amp, which returns the AMP for
+// Email body of an email validated against the AMP4Email rules
+func (s *Server) handleGetAMP(w http.ResponseWriter, r *http.Request) {
+	id := parseIDParam(r)
+	if id == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid email ID")
+		return
+	}
+
+	emailData, err := s.storage.GetEmail(id)
+	if err == storage.ErrNotFound {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		return
+	} else if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	if emailData.BodyAMP == "" {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "No AMP body available")
+		return
+	}
+
+	warnings := email.ValidateAMP(emailData.BodyAMP, emailData.BodyHTML != "")
+	counts := map[string]int{
+		email.SeverityError:   0,
+		email.SeverityWarning: 0,
+	}
+	for _, warning := range warnings {
+		counts[warning.Severity]++
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"id":       id,
+		"html":     emailData.BodyAMP,
+		"valid":    counts[email.SeverityError] == 0,
+		"warnings": warnings,
+		"count":    len(warnings),
+		"counts":   counts,
+	})
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// apiKeyPrefix marks keys generated by gowebmail so they are easy to spot
+// in configuration and secret scanners
+const apiKeyPrefix = "gwm_"
+
+// CreateAPIKeyRequest is the body of POST /api/admin/api-keys
+type CreateAPIKeyRequest struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"` // read or full; defaults to full
+}
+
+// requestAPIKey returns the API key sent with r, if any
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// lookupAPIKey returns the name and scope of key, or false if it is not a
+// valid key. Configured keys are checked first, then keys created through
+// the admin API.
+func (s *Server) lookupAPIKey(key string) (name, scope string, ok bool, err error) {
+	for _, configured := range s.auth.Load().APIKeys {
+		if configured.Key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(configured.Key)) == 1 {
+			if configured.Scope == "" {
+				return configured.Name, storage.ScopeFull, true, nil
+			}
+			return configured.Name, configured.Scope, true, nil
+		}
+	}
+
+	stored, err := s.storage.FindAPIKey(hashAPIKey(key))
+	if err == storage.ErrNotFound {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+	return stored.Name, stored.Scope, true, nil
+}
+
+// scopeAllows reports whether scope permits r. Read-only keys may only make
+// GET and HEAD requests, and never to the admin API or debug endpoints.
+func scopeAllows(scope string, r *http.Request) bool {
+	if scope == storage.ScopeFull {
+		return true
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	return !strings.HasPrefix(r.URL.Path, "/api/admin/") && !strings.HasPrefix(r.URL.Path, "/debug/")
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleListAPIKeys handles GET /api/admin/api-keys
+func (s *Server) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.storage.ListAPIKeys()
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"keys":  keys,
+		"count": len(keys),
+	})
+}
+
+// handleCreateAPIKey handles POST /api/admin/api-keys. The key is only
+// returned in this response; afterwards only its hash is stored.
+func (s *Server) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "name must not be empty")
+		return
+	}
+	if req.Scope == "" {
+		req.Scope = storage.ScopeFull
+	}
+	if req.Scope != storage.ScopeRead && req.Scope != storage.ScopeFull {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "scope must be read or full")
+		return
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		s.sendError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return
+	}
+	secret := apiKeyPrefix + hex.EncodeToString(b)
+
+	key := &storage.APIKey{
+		Name:   req.Name,
+		Prefix: secret[:len(apiKeyPrefix)+8],
+		Scope:  req.Scope,
+	}
+	if err := s.storage.CreateAPIKey(key, hashAPIKey(secret)); err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.audit(r, "api_key.create", strconv.FormatInt(key.ID, 10), map[string]interface{}{"name": key.Name, "scope": key.Scope})
+
+	s.sendSuccess(w, map[string]interface{}{
+		"apiKey": key,
+		"key":    secret,
+	})
+}
+
+// handleDeleteAPIKey handles DELETE /api/admin/api-keys/{id}
+func (s *Server) handleDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := parseIDParam(r)
+	if id == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid API key ID")
+		return
+	}
+
+	if err := s.storage.DeleteAPIKey(id); err != nil {
+		if err == storage.ErrNotFound {
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "API key not found")
+		} else {
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		}
+		return
+	}
+
+	s.audit(r, "api_key.delete", strconv.FormatInt(id, 10), nil)
+
+	s.sendSuccess(w, map[string]interface{}{
+		"message": "API key deleted",
+	})
+}
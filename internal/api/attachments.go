@@ -0,0 +1,35 @@
+package api
+
+import (
+	"math"
+	"net/http"
+
+	"gowebmail/internal/storage"
+)
+
+// handleListAttachments handles GET /api/attachments, which lists the
+// attachments of all emails matching the list filters, such as every PDF
+// received since a test run started, with the emails they belong to
+func (s *Server) handleListAttachments(w http.ResponseWriter, r *http.Request) {
+	limit := parseIntParam(r, "limit", 50, 1, 100)
+	offset := parseIntParam(r, "offset", 0, 0, math.MaxInt)
+
+	filter := &storage.AttachmentFilter{
+		ContentType: r.URL.Query().Get("contentType"),
+		Filename:    r.URL.Query().Get("filename"),
+		MinSize:     int64(parseIntParam(r, "minSize", 0, 0, math.MaxInt)),
+		Emails:      parseEmailFilter(r),
+	}
+	result, err := s.storage.ListAttachments(filter, limit, offset)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"attachments": result.Attachments,
+		"total":       result.Total,
+		"limit":       limit,
+		"offset":      offset,
+	})
+}
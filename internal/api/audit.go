@@ -0,0 +1,119 @@
+package api
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	"gowebmail/internal/storage"
+)
+
+// Authentication methods recorded in the audit log
+const (
+	authNone    = "none"
+	authBasic   = "basic"
+	authOIDC    = "oidc"
+	authAPIKey  = "api_key"
+	authCert    = "client_cert"
+	authSession = "session"
+)
+
+type contextKey int
+
+const identityKey contextKey = iota
+
+// identity is who made a request, as established by authMiddleware
+type identity struct {
+	Name string // user name, OIDC email or subject, or API key name
+	Auth string
+
+	// Mailboxes are the address patterns of the mail a user sees; nil for
+	// identities that see all mail
+	Mailboxes []string
+}
+
+// withIdentity returns r with the authenticated identity attached
+func withIdentity(r *http.Request, id identity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), identityKey, id))
+}
+
+// requestIdentity returns who made r; requests are anonymous without auth
+func requestIdentity(r *http.Request) identity {
+	if id, ok := r.Context().Value(identityKey).(identity); ok {
+		return id
+	}
+	return identity{Auth: authNone}
+}
+
+// audit records an action performed by the sender of r. Failures are
+// logged; the action has already happened and is not undone.
+func (s *Server) audit(r *http.Request, action, target string, details map[string]interface{}) {
+	id := requestIdentity(r)
+	entry := &storage.AuditEntry{
+		Action:   action,
+		Actor:    id.Name,
+		Auth:     id.Auth,
+		RemoteIP: remoteIP(r),
+		Target:   target,
+		Details:  details,
+	}
+
+	if err := s.storage.RecordAudit(entry); err != nil {
+		s.logger.Error().Err(err).Str("action", action).Msg("Failed to record audit entry")
+		return
+	}
+
+	s.logger.Info().
+		Str("action", action).
+		Str("actor", entry.Actor).
+		Str("auth", entry.Auth).
+		Str("remote", entry.RemoteIP).
+		Str("target", entry.Target).
+		Msg("Audit")
+}
+
+// remoteIP returns the address r was sent from, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// handleListAudit handles GET /api/audit
+func (s *Server) handleListAudit(w http.ResponseWriter, r *http.Request) {
+	limit := parseIntParam(r, "limit", 50, 1, 1000)
+	offset := parseIntParam(r, "offset", 0, 0, math.MaxInt)
+
+	query := r.URL.Query()
+	filter := &storage.AuditFilter{
+		Action: query.Get("action"),
+		Actor:  query.Get("actor"),
+	}
+	if since := query.Get("since"); since != "" {
+		if t, err := time.Parse(time.RFC3339, since); err == nil {
+			filter.Since = &t
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if t, err := time.Parse(time.RFC3339, until); err == nil {
+			filter.Until = &t
+		}
+	}
+
+	result, err := s.storage.ListAudit(filter, limit, offset)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"entries": result.Entries,
+		"total":   result.Total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
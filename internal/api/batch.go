@@ -0,0 +1,206 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"gowebmail/internal/storage"
+)
+
+// maxBatchIDs is the largest number of emails a batch request may touch
+const maxBatchIDs = 1000
+
+// BatchActionRelease relays the emails to their recipients through the
+// configured upstream server
+const BatchActionRelease = "release"
+
+// BatchRequest represents the body of POST /api/emails/batch
+type BatchRequest struct {
+	IDs    []int64  `json:"ids"`
+	Action string   `json:"action"`
+	Tags   []string `json:"tags,omitempty"` // for tag and untag
+	To     []string `json:"to,omitempty"`   // release recipients; defaults to the envelope
+}
+
+// handleBatchEmails handles POST /api/emails/batch
+func (s *Server) handleBatchEmails(w http.ResponseWriter, r *http.Request) {
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if len(req.IDs) == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "ids must not be empty")
+		return
+	}
+	if len(req.IDs) > maxBatchIDs {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("at most %d ids are allowed", maxBatchIDs))
+		return
+	}
+
+	for _, id := range req.IDs {
+		visible, err := s.visible(r, id)
+		if err != nil {
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+			return
+		}
+		if !visible {
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", fmt.Sprintf("Email %d not found", id))
+			return
+		}
+	}
+
+	var results []storage.BatchItemResult
+	switch req.Action {
+	case storage.BatchDelete, storage.BatchMarkRead, storage.BatchMarkUnread:
+	case storage.BatchTag, storage.BatchUntag:
+		if len(req.Tags) == 0 {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "tags must not be empty")
+			return
+		}
+	case BatchActionRelease:
+		if s.relay == nil {
+			s.sendError(w, http.StatusBadRequest, "RELAY_DISABLED", "Relay is not configured")
+			return
+		}
+	default:
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("unknown action %q", req.Action))
+		return
+	}
+
+	// Tags the emails already have do not fire relay rules again
+	var before map[int64][]string
+	if req.Action == storage.BatchTag && s.tagRelayRules() {
+		before = make(map[int64][]string)
+		for _, id := range req.IDs {
+			if email, err := s.storage.GetEmail(id); err == nil {
+				before[id] = email.Tags
+			}
+		}
+	}
+
+	if req.Action == BatchActionRelease {
+		// Delivery cannot be rolled back, so each email is released on its own
+		results = make([]storage.BatchItemResult, len(req.IDs))
+		for i, id := range req.IDs {
+			results[i].ID = id
+			if err := s.releaseEmail(id, req.To); err != nil {
+				results[i].Error = err.Error()
+			} else {
+				results[i].Success = true
+			}
+		}
+	} else {
+		var err error
+		results, err = s.storage.BatchEmails(req.IDs, &storage.BatchOperation{
+			Action: req.Action,
+			Tags:   req.Tags,
+		})
+		if err != nil {
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+			return
+		}
+	}
+
+	succeeded := []int64{}
+	for _, result := range results {
+		if result.Success {
+			succeeded = append(succeeded, result.ID)
+			s.broadcastBatchResult(req.Action, result.ID)
+		}
+	}
+
+	if before != nil {
+		for _, id := range succeeded {
+			email, err := s.storage.GetEmail(id)
+			if err != nil {
+				continue
+			}
+			if added := addedTags(before[id], email.Tags); len(added) > 0 {
+				go s.autoRelay(email, added)
+			}
+		}
+	}
+
+	if len(succeeded) > 0 {
+		switch req.Action {
+		case storage.BatchDelete:
+			s.audit(r, "email.batch_delete", "", map[string]interface{}{"ids": succeeded})
+		case BatchActionRelease:
+			s.audit(r, "email.release", "", map[string]interface{}{"ids": succeeded, "to": req.To})
+		}
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"action":    req.Action,
+		"results":   results,
+		"succeeded": len(succeeded),
+		"failed":    len(results) - len(succeeded),
+	})
+}
+
+// releaseEmail relays an email to to, or to its original recipients
+func (s *Server) releaseEmail(id int64, to []string) error {
+	email, err := s.storage.GetEmail(id)
+	if err != nil {
+		return err
+	}
+
+	raw, err := s.storage.GetRawEmail(id)
+	if err == storage.ErrRawNotAvailable {
+		raw = reconstructRaw(email)
+	} else if err != nil {
+		return err
+	}
+
+	if len(to) == 0 {
+		to = email.EnvelopeTo
+	}
+	if len(to) == 0 {
+		to = email.To
+	}
+
+	from := email.EnvelopeFrom
+	if from == "" {
+		from = email.From
+	}
+
+	if err := s.relay.Send(from, to, raw); err != nil {
+		return err
+	}
+
+	s.publish(&WebSocketMessage{
+		Type: "email.released",
+		Data: map[string]interface{}{"id": id, "to": to},
+	})
+	return nil
+}
+
+// broadcastBatchResult notifies WebSocket clients of a change made by a batch action
+func (s *Server) broadcastBatchResult(action string, id int64) {
+	switch action {
+	case storage.BatchDelete:
+		s.BroadcastDeletedEmail(id)
+	case storage.BatchMarkRead, storage.BatchMarkUnread:
+		read := action == storage.BatchMarkRead
+		s.publish(&WebSocketMessage{
+			Type: "email.read",
+			Data: map[string]interface{}{"id": id, "read": read},
+		})
+		s.publish(&WebSocketMessage{
+			Type: "email.updated",
+			Data: map[string]interface{}{"id": id, "read": read},
+		})
+	case storage.BatchTag, storage.BatchUntag:
+		email, err := s.storage.GetEmail(id)
+		if err != nil {
+			return
+		}
+		s.publish(&WebSocketMessage{
+			Type: "email.updated",
+			Data: map[string]interface{}{"id": id, "tags": email.Tags},
+		})
+	}
+}
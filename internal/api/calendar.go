@@ -0,0 +1,33 @@
+package api
+
+import (
+	"net/http"
+
+	"gowebmail/internal/storage"
+)
+
+// handleGetCalendar handles GET /api/emails/{id}/calendar, which returns
+// the events of an email's iCalendar part, such as a meeting invitation
+func (s *Server) handleGetCalendar(w http.ResponseWriter, r *http.Request) {
+	id := parseIDParam(r)
+	if id == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid email ID")
+		return
+	}
+
+	emailData, err := s.storage.GetEmail(id)
+	if err == storage.ErrNotFound {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		return
+	} else if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	if emailData.Calendar == nil {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "No calendar available")
+		return
+	}
+
+	s.sendSuccess(w, emailData.Calendar)
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"gowebmail/internal/email"
+	"gowebmail/internal/linkcheck"
+	"gowebmail/internal/storage"
+)
+
+// CheckedLink is a link of an email with the result of fetching it
+type CheckedLink struct {
+	*linkcheck.Result
+	Element string `json:"element"` // a, img, area or text
+}
+
+// handleCheckLinks handles POST /api/emails/{id}/checklinks. Every http and
+// https link of the HTML and text bodies is fetched, following redirects.
+func (s *Server) handleCheckLinks(w http.ResponseWriter, r *http.Request) {
+	if s.links == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "LINK_CHECK_DISABLED", "Link checking is not enabled")
+		return
+	}
+
+	id := parseIDParam(r)
+	if id == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid email ID")
+		return
+	}
+
+	emailData, err := s.storage.GetEmail(id)
+	if err == storage.ErrNotFound {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		return
+	} else if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	links := email.ExtractLinks(emailData.BodyHTML, emailData.BodyPlain)
+	urls := make([]string, len(links))
+	for i, link := range links {
+		urls[i] = link.URL
+	}
+
+	results := s.links.Check(r.Context(), urls)
+	checked := make([]CheckedLink, len(results))
+	counts := map[string]int{
+		linkcheck.StatusOK:     0,
+		linkcheck.StatusBroken: 0,
+		linkcheck.StatusError:  0,
+	}
+	for i, result := range results {
+		checked[i] = CheckedLink{Result: result, Element: links[i].Element}
+		counts[result.Status]++
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"id":        id,
+		"links":     checked,
+		"count":     len(checked),
+		"counts":    counts,
+		"skipped":   len(links) - len(results),
+		"checkedAt": time.Now(),
+	})
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+)
+
+// loadCertPool reads the PEM certificates of a file into a pool
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no PEM certificates found in " + file)
+	}
+	return pool, nil
+}
+
+// clientCertificate returns the verified client certificate r was sent
+// with, or nil
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certificateNames returns the identities of a certificate: its email
+// addresses, then its common name
+func certificateNames(cert *x509.Certificate) []string {
+	names := append([]string{}, cert.EmailAddresses...)
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return names
+}
+
+// certAuthenticate authenticates r with its client certificate. A
+// certificate naming a configured user signs in as that user. With users
+// configured, other certificates are refused; without, the CA vouches for
+// them.
+func (s *Server) certAuthenticate(w http.ResponseWriter, r *http.Request, next http.Handler, cert *x509.Certificate) {
+	auth := s.auth.Load()
+	names := certificateNames(cert)
+	for _, name := range names {
+		if user := findUser(auth, name); user != nil {
+			s.serveUser(w, r, next, userIdentity(user, authCert))
+			return
+		}
+	}
+
+	if len(auth.Users) > 0 {
+		s.sendError(w, http.StatusForbidden, "FORBIDDEN", "Client certificate does not belong to a user")
+		return
+	}
+
+	name := cert.Subject.String()
+	if len(names) > 0 {
+		name = names[0]
+	}
+	next.ServeHTTP(w, withIdentity(r, identity{Name: name, Auth: authCert}))
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressibleTypes are the response media types worth compressing; images,
+// archives and other binary payloads are already compressed
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/mbox":       true,
+	"application/x-ndjson":   true,
+	"image/svg+xml":          true,
+	"message/rfc822":         true,
+}
+
+func isCompressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType]
+}
+
+// compressionMiddleware compresses responses with zstd, gzip or deflate,
+// as negotiated with Accept-Encoding. Small and binary responses are sent as is.
+func (s *Server) compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// WebSocket upgrades hijack the connection, and compressed bodies
+		// cannot serve byte ranges
+		if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		w.Header().Add("Vary", "Accept-Encoding")
+		if encoding == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		level := s.config.HTTP.Compression.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			level:          level,
+			minSize:        s.config.HTTP.Compression.MinSize,
+		}
+		defer cw.Close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks zstd, gzip or deflate from an Accept-Encoding
+// header, preferring them in that order, or returns "" if none is
+// acceptable
+func negotiateEncoding(header string) string {
+	quality := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		quality[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range []string{"zstd", "gzip", "deflate"} {
+		q, ok := quality[encoding]
+		if !ok {
+			q, ok = quality["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressWriter buffers the start of a response until it knows whether
+// compressing it is worthwhile
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	level    int
+	minSize  int
+
+	status      int
+	wroteHeader bool // passed on to the underlying writer
+	buf         []byte
+	zw          io.WriteCloser // set once compression has started
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.status == 0 {
+		cw.status = code
+	}
+	// Informational responses are passed straight through
+	if code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+		cw.status = 0
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+	if cw.zw != nil {
+		return cw.zw.Write(p)
+	}
+	if cw.wroteHeader {
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.start(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// start decides how to send the response and writes out the buffer.
+// Streamed responses are compressed however little has been written yet.
+func (cw *compressWriter) start(streaming bool) error {
+	h := cw.Header()
+	if h.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	compress := (streaming || len(cw.buf) >= cw.minSize) &&
+		h.Get("Content-Encoding") == "" &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified &&
+		isCompressible(h.Get("Content-Type"))
+
+	if compress {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+
+		var err error
+		switch cw.encoding {
+		case "zstd":
+			cw.zw, err = newZstdWriter(cw.ResponseWriter, cw.level)
+		case "gzip":
+			cw.zw, err = gzip.NewWriterLevel(cw.ResponseWriter, cw.level)
+		default:
+			cw.zw, err = flate.NewWriter(cw.ResponseWriter, cw.level)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid compression level: %w", err)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	cw.wroteHeader = true
+
+	buf := cw.buf
+	cw.buf = nil
+	if cw.zw != nil {
+		_, err := cw.zw.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// newZstdWriter creates a zstd encoder for a response. The gzip level is
+// mapped onto the zstd levels, and the window is kept within the 8 MiB
+// that browsers decode (RFC 9659).
+func newZstdWriter(w io.Writer, level int) (*zstd.Encoder, error) {
+	if level == gzip.DefaultCompression {
+		level = 3 // the zstd default
+	}
+	return zstd.NewWriter(w,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithWindowSize(8<<20),
+	)
+}
+
+// Close sends any buffered response and finishes the compressed stream
+func (cw *compressWriter) Close() error {
+	if !cw.wroteHeader {
+		if cw.status == 0 {
+			// Nothing was written; let net/http send its default response
+			return nil
+		}
+		if err := cw.start(false); err != nil {
+			return err
+		}
+	}
+	if cw.zw != nil {
+		return cw.zw.Close()
+	}
+	return nil
+}
+
+// Flush sends what has been written so far; streaming handlers such as
+// export call it
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader && cw.status != 0 {
+		if err := cw.start(true); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.zw.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// Hijack is passed through for connections that were not compressed
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok || cw.wroteHeader {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
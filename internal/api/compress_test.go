@@ -0,0 +1,78 @@
+package api
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"gowebmail/internal/config"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		want   string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"gzip, deflate, br", "gzip"},
+		{"deflate", "deflate"},
+		{"zstd;q=0.5, gzip;q=0.8", "gzip"},
+		{"ZSTD", "zstd"},
+		{"*", "zstd"},
+		{"*;q=0.5, zstd;q=0", "gzip"},
+		{"gzip;q=0, deflate;q=0, zstd;q=0", ""},
+	} {
+		if got := negotiateEncoding(tc.header); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestCompressionMiddleware(t *testing.T) {
+	s := &Server{config: &config.Config{}}
+	s.config.HTTP.Compression = config.CompressionConfig{Enabled: true, Level: 5, MinSize: 1024}
+	body := strings.Repeat(`{"subject":"Hello"}`, 200)
+	handler := s.compressionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"abc"`)
+		io.WriteString(w, body)
+	}))
+
+	for _, tc := range []struct {
+		accept string
+		decode func(io.Reader) (io.Reader, error)
+	}{
+		{"gzip, deflate, br, zstd", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+		{"gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/api/emails", nil)
+		req.Header.Set("Accept-Encoding", tc.accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		encoding := negotiateEncoding(tc.accept)
+		if got := rec.Header().Get("Content-Encoding"); got != encoding {
+			t.Errorf("%s: Content-Encoding %q", encoding, got)
+		}
+		if got := rec.Header().Get("ETag"); got != `W/"abc"` {
+			t.Errorf("%s: ETag %s", encoding, got)
+		}
+		if rec.Body.Len() >= len(body) {
+			t.Errorf("%s: %d bytes", encoding, rec.Body.Len())
+		}
+		r, err := tc.decode(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := io.ReadAll(r); err != nil || string(got) != body {
+			t.Errorf("%s: got %d bytes, %v", encoding, len(got), err)
+		}
+	}
+}
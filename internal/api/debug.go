@@ -0,0 +1,97 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// setupDebugRoutes registers pprof and the runtime stats endpoint under
+// /debug
+func (s *Server) setupDebugRoutes() {
+	debug := s.router.PathPrefix("/debug").Subrouter()
+	debug.Use(s.debugMiddleware)
+
+	debug.HandleFunc("/runtime", s.handleRuntimeStats).Methods("GET")
+
+	debug.HandleFunc("/pprof/cmdline", pprof.Cmdline)
+	debug.HandleFunc("/pprof/profile", pprof.Profile)
+	debug.HandleFunc("/pprof/symbol", pprof.Symbol)
+	debug.HandleFunc("/pprof/trace", pprof.Trace)
+	// Index also serves the named profiles, e.g. /debug/pprof/heap
+	debug.PathPrefix("/pprof/").HandlerFunc(pprof.Index)
+}
+
+// debugMiddleware requires debug.api_key, when set
+func (s *Server) debugMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := s.config.Debug.APIKey; key != "" {
+			if s.lockedOut(w, r, "") {
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(requestAPIKey(r)), []byte(key)) != 1 {
+				s.authFailed(r, authAPIKey, "")
+				s.sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid debug API key")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleRuntimeStats handles GET /debug/runtime
+func (s *Server) handleRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var lastGC *time.Time
+	if mem.LastGC != 0 {
+		t := time.Unix(0, int64(mem.LastGC))
+		lastGC = &t
+	}
+
+	s.wsHub.mu.RLock()
+	wsClients := len(s.wsHub.clients)
+	s.wsHub.mu.RUnlock()
+	s.graphqlConns.mu.Lock()
+	graphqlConns := len(s.graphqlConns.conns)
+	s.graphqlConns.mu.Unlock()
+
+	s.sendSuccess(w, map[string]interface{}{
+		"goVersion":     runtime.Version(),
+		"uptimeSeconds": int64(time.Since(s.started).Seconds()),
+		"startedAt":     s.started,
+		"goroutines":    runtime.NumGoroutine(),
+		"numCPU":        runtime.NumCPU(),
+		"gomaxprocs":    runtime.GOMAXPROCS(0),
+		"memory": map[string]interface{}{
+			"alloc":        mem.Alloc,
+			"totalAlloc":   mem.TotalAlloc,
+			"sys":          mem.Sys,
+			"heapAlloc":    mem.HeapAlloc,
+			"heapInuse":    mem.HeapInuse,
+			"heapIdle":     mem.HeapIdle,
+			"heapReleased": mem.HeapReleased,
+			"heapObjects":  mem.HeapObjects,
+			"stackInuse":   mem.StackInuse,
+			"mallocs":      mem.Mallocs,
+			"frees":        mem.Frees,
+		},
+		"gc": map[string]interface{}{
+			"numGC":        mem.NumGC,
+			"pauseTotalNs": mem.PauseTotalNs,
+			"lastPauseNs":  mem.PauseNs[(mem.NumGC+255)%256],
+			"lastGC":       lastGC,
+			"nextGC":       mem.NextGC,
+			"cpuFraction":  mem.GCCPUFraction,
+			"forcedGC":     mem.NumForcedGC,
+		},
+		"connections": map[string]interface{}{
+			"websocket": wsClients,
+			"graphql":   graphqlConns,
+		},
+	})
+}
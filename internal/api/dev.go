@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"gowebmail/internal/ingest"
+	"gowebmail/internal/quota"
+	"gowebmail/internal/seed"
+)
+
+// GenerateRequest is the body of POST /api/dev/generate
+type GenerateRequest struct {
+	Count  int      `json:"count,omitempty"`
+	Seed   int64    `json:"seed,omitempty"`
+	To     []string `json:"to,omitempty"`
+	Spread string   `json:"spread,omitempty"` // duration, e.g. "72h"
+}
+
+// GenerateResult is the result of POST /api/dev/generate
+type GenerateResult struct {
+	Count int     `json:"count"`
+	Seed  int64   `json:"seed"` // repeats the same emails when sent again
+	IDs   []int64 `json:"ids"`
+}
+
+// handleGenerateEmails handles POST /api/dev/generate. It stores made-up
+// emails, delivered through the same pipeline as mail received over SMTP,
+// so the UI can be developed and demoed without an external sender.
+func (s *Server) handleGenerateEmails(w http.ResponseWriter, r *http.Request) {
+	if s.ingest == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "INGEST_UNAVAILABLE", "Ingestion is not configured")
+		return
+	}
+
+	req := GenerateRequest{Count: 10, Spread: "24h"}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	spread, err := time.ParseDuration(req.Spread)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "spread must be a duration, e.g. 24h")
+		return
+	}
+	if req.Count > seed.MaxCount {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", fmt.Sprintf("count must be at most %d", seed.MaxCount))
+		return
+	}
+	if req.Seed == 0 {
+		req.Seed = time.Now().UnixNano()
+	}
+
+	messages, err := seed.Generate(seed.Options{
+		Count:  req.Count,
+		Seed:   req.Seed,
+		To:     req.To,
+		Spread: spread,
+	})
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	result := GenerateResult{Seed: req.Seed, IDs: make([]int64, 0, len(messages))}
+	for _, msg := range messages {
+		stored, err := s.ingest.Deliver(bytes.NewReader(msg.Raw), &ingest.Envelope{
+			Source:     "seed",
+			From:       msg.From,
+			To:         msg.To,
+			ReceivedAt: msg.ReceivedAt,
+		})
+		if err != nil {
+			if errors.Is(err, quota.ErrQuotaExceeded) {
+				s.sendError(w, http.StatusInsufficientStorage, "QUOTA_EXCEEDED", err.Error())
+				return
+			}
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+			return
+		}
+		result.IDs = append(result.IDs, stored.ID)
+	}
+	result.Count = len(result.IDs)
+
+	s.logger.Info().Int("count", result.Count).Int64("seed", req.Seed).Msg("Sample emails generated")
+	s.sendSuccess(w, result)
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// checkETag sets the ETag of the response and reports whether the client
+// already has it, in which case a 304 has been written. ETags are weak, so
+// they survive response compression.
+func checkETag(w http.ResponseWriter, r *http.Request, version string) bool {
+	etag := `W/"` + version + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, using
+// the weak comparison required for If-None-Match
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
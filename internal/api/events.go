@@ -0,0 +1,43 @@
+package api
+
+// listenerBuffer is the number of events queued for a slow listener
+// before further events are dropped
+const listenerBuffer = 64
+
+// publish sends an event to WebSocket clients, webhooks, event sinks and
+// in-process listeners
+func (s *Server) publish(message *WebSocketMessage) {
+	s.wsHub.Broadcast(message)
+
+	s.webhooks.Dispatch(message.Type, message.Data)
+	s.events.Publish(message.Type, message.Data)
+
+	s.listenersMu.RLock()
+	defer s.listenersMu.RUnlock()
+	for listener := range s.listeners {
+		select {
+		case listener <- message:
+		default:
+			s.logger.Warn().Str("type", message.Type).Msg("Event listener full, event dropped")
+		}
+	}
+}
+
+// subscribe registers a listener for published events. The returned
+// function unregisters it and closes the channel.
+func (s *Server) subscribe() (<-chan *WebSocketMessage, func()) {
+	listener := make(chan *WebSocketMessage, listenerBuffer)
+
+	s.listenersMu.Lock()
+	s.listeners[listener] = struct{}{}
+	s.listenersMu.Unlock()
+
+	return listener, func() {
+		s.listenersMu.Lock()
+		defer s.listenersMu.Unlock()
+		if _, ok := s.listeners[listener]; ok {
+			delete(s.listeners, listener)
+			close(listener)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"gowebmail/internal/email"
+	"gowebmail/internal/storage"
+)
+
+// exportFlushInterval is how many messages are written between flushes
+const exportFlushInterval = 50
+
+// exportFormat describes one of the formats supported by the export endpoint
+type exportFormat struct {
+	contentType string
+	extension   string
+	// newWriter returns the function that writes each email and the
+	// function that finishes the file
+	newWriter func(w io.Writer) (func(e *storage.Email) error, func() error)
+}
+
+// exportFormats are the supported values of the format parameter
+var exportFormats = map[string]exportFormat{
+	"mbox": {
+		contentType: "application/mbox",
+		extension:   "mbox",
+		newWriter: func(w io.Writer) (func(*storage.Email) error, func() error) {
+			write := func(e *storage.Email) error {
+				return email.WriteMbox(w, e.From, e.ReceivedAt, exportRaw(e))
+			}
+			return write, func() error { return nil }
+		},
+	},
+	"eml-zip": {
+		contentType: "application/zip",
+		extension:   "zip",
+		newWriter: func(w io.Writer) (func(*storage.Email) error, func() error) {
+			zw := zip.NewWriter(w)
+			write := func(e *storage.Email) error {
+				f, err := zw.CreateHeader(&zip.FileHeader{
+					Name:     emlFilename(e),
+					Method:   zip.Deflate,
+					Modified: e.ReceivedAt,
+				})
+				if err != nil {
+					return err
+				}
+				_, err = f.Write(exportRaw(e))
+				return err
+			}
+			return write, zw.Close
+		},
+	},
+	"jsonl": {
+		contentType: "application/x-ndjson",
+		extension:   "jsonl",
+		newWriter: func(w io.Writer) (func(*storage.Email) error, func() error) {
+			encoder := json.NewEncoder(w)
+			write := func(e *storage.Email) error {
+				return encoder.Encode(e)
+			}
+			return write, func() error { return nil }
+		},
+	},
+}
+
+// exportRaw returns the stored raw message, or a reconstruction for emails
+// captured before raw storage was added
+func exportRaw(e *storage.Email) []byte {
+	if e.Raw == nil {
+		return reconstructRaw(e)
+	}
+	return e.Raw
+}
+
+// handleExportEmails handles GET /api/emails/export
+func (s *Server) handleExportEmails(w http.ResponseWriter, r *http.Request) {
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = "mbox"
+	}
+	format, ok := exportFormats[formatName]
+	if !ok {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Unsupported export format: "+formatName)
+		return
+	}
+
+	filter := parseEmailFilter(r)
+	rc := http.NewResponseController(w)
+
+	filename := fmt.Sprintf("gowebmail-%s.%s", time.Now().Format("20060102-150405"), format.extension)
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	write, finish := format.newWriter(w)
+
+	count := 0
+	err := s.storage.ForEachEmail(filter, func(e *storage.Email) error {
+		// Large exports outlive the server's write timeout; extend it per message
+		rc.SetWriteDeadline(time.Now().Add(s.config.HTTP.WriteTimeout))
+
+		if err := write(e); err != nil {
+			return err
+		}
+
+		count++
+		if count%exportFlushInterval == 0 {
+			rc.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = finish()
+	}
+	if err != nil {
+		if count == 0 {
+			w.Header().Del("Content-Disposition")
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+			return
+		}
+		// Data has already been sent, so the best we can do is log and truncate
+		s.logger.Error().Err(err).Int("exported", count).Msg("Export failed")
+		return
+	}
+
+	s.logger.Info().Int("count", count).Str("format", formatName).Msg("Emails exported")
+}
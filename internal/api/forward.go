@@ -0,0 +1,168 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strconv"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/relay"
+	"gowebmail/internal/storage"
+)
+
+// ForwardRequest is the body of POST /api/emails/{id}/forward
+type ForwardRequest struct {
+	To []string `json:"to"`
+	// From replaces the sender, in the envelope and the From header
+	From  string        `json:"from,omitempty"`
+	Relay *ForwardRelay `json:"relay,omitempty"` // defaults to the configured relay
+}
+
+// ForwardRelay is an SMTP server given with a forward request
+type ForwardRelay struct {
+	Host               string `json:"host"`
+	Port               int    `json:"port,omitempty"`
+	Username           string `json:"username,omitempty"`
+	Password           string `json:"password,omitempty"`
+	TLS                string `json:"tls,omitempty"` // none, starttls (default) or tls
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+// handleForwardEmail handles POST /api/emails/{id}/forward
+func (s *Server) handleForwardEmail(w http.ResponseWriter, r *http.Request) {
+	var req ForwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if len(req.To) == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "to must not be empty")
+		return
+	}
+	for _, address := range append([]string{req.From}, req.To...) {
+		if address == "" {
+			continue
+		}
+		if _, err := mail.ParseAddress(address); err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid address "+address)
+			return
+		}
+	}
+
+	relayer := s.relay
+	switch {
+	case req.Relay != nil:
+		cfg, err := forwardRelayConfig(req.Relay, s.config.Relay.AllowedRecipients)
+		if err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+		relayer = relay.NewRelayer(cfg, s.logger)
+	case relayer != nil && req.From != "":
+		// The requested sender takes precedence over relay.from
+		cfg := s.config.Relay
+		cfg.From = req.From
+		relayer = relay.NewRelayer(&cfg, s.logger)
+	}
+	if relayer == nil {
+		s.sendError(w, http.StatusBadRequest, "RELAY_DISABLED", "Relay is not configured; pass relay settings with the request")
+		return
+	}
+
+	id := parseIDParam(r)
+	if id == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid email ID")
+		return
+	}
+
+	email, err := s.storage.GetEmail(id)
+	if err == storage.ErrNotFound {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		return
+	} else if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	raw, err := s.storage.GetRawEmail(id)
+	if err == storage.ErrRawNotAvailable {
+		raw = reconstructRaw(email)
+	} else if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	sender := req.From
+	if sender == "" {
+		sender = email.EnvelopeFrom
+	}
+	if sender == "" {
+		sender = email.From
+	}
+
+	raw = relay.ForwardMessage(raw, sender, req.To, req.From)
+	if err := relayer.Send(sender, req.To, raw); err != nil {
+		if errors.Is(err, relay.ErrRecipientNotAllowed) {
+			s.sendError(w, http.StatusForbidden, "RECIPIENT_NOT_ALLOWED", err.Error())
+			return
+		}
+		s.logger.Warn().Err(err).Int64("id", id).Msg("Failed to forward email")
+		s.sendError(w, http.StatusBadGateway, "RELAY_ERROR", err.Error())
+		return
+	}
+
+	s.audit(r, "email.forward", strconv.FormatInt(id, 10), map[string]interface{}{"to": req.To})
+
+	s.publish(&WebSocketMessage{
+		Type: "email.forwarded",
+		Data: map[string]interface{}{"id": id, "to": req.To},
+	})
+
+	s.sendSuccess(w, map[string]interface{}{
+		"id": id,
+		"to": req.To,
+	})
+}
+
+// forwardRelayConfig builds the configuration of a relay given with a
+// request. The allow list of the configured relay still applies, and its
+// credentials are never sent to another server.
+func forwardRelayConfig(r *ForwardRelay, allowed []string) (*config.RelayConfig, error) {
+	if r.Host == "" {
+		return nil, errors.New("relay.host must not be empty")
+	}
+
+	cfg := &config.RelayConfig{
+		Enabled:            true,
+		Host:               r.Host,
+		Port:               r.Port,
+		Username:           r.Username,
+		Password:           r.Password,
+		TLS:                r.TLS,
+		InsecureSkipVerify: r.InsecureSkipVerify,
+		AllowedRecipients:  allowed,
+	}
+	if cfg.TLS == "" {
+		cfg.TLS = "starttls"
+	}
+	if cfg.Port == 0 {
+		switch cfg.TLS {
+		case "tls":
+			cfg.Port = 465
+		case "starttls":
+			cfg.Port = 587
+		default:
+			cfg.Port = 25
+		}
+	}
+
+	switch cfg.TLS {
+	case "none", "starttls", "tls":
+	default:
+		return nil, errors.New("relay.tls must be none, starttls or tls")
+	}
+	return cfg, nil
+}
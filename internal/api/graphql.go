@@ -0,0 +1,592 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"gowebmail/internal/graphql"
+	"gowebmail/internal/storage"
+)
+
+// dateTimeScalar is an RFC 3339 timestamp
+var dateTimeScalar = &graphql.Scalar{
+	Name:        "DateTime",
+	Description: "An RFC 3339 timestamp.",
+	Serialize: func(value interface{}) (interface{}, error) {
+		t, ok := value.(time.Time)
+		if !ok {
+			return nil, fmt.Errorf("DateTime cannot represent %v", value)
+		}
+		return t.Format(time.RFC3339Nano), nil
+	},
+	ParseValue: func(value interface{}) (interface{}, error) {
+		s, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("DateTime cannot represent %v", value)
+		}
+		return time.Parse(time.RFC3339, s)
+	},
+	ParseLiteral: func(value graphql.Value) (interface{}, error) {
+		s, ok := value.(graphql.StringValue)
+		if !ok {
+			return nil, fmt.Errorf("DateTime must be a string")
+		}
+		return time.Parse(time.RFC3339, string(s))
+	},
+}
+
+// graphqlAttachment adds the owning email to attachment metadata so the
+// download URL can be built
+type graphqlAttachment struct {
+	*storage.Attachment
+	EmailID int64
+}
+
+// graphqlHeader is one header value
+type graphqlHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// graphqlSchema builds the schema served at /api/graphql
+func (s *Server) graphqlSchema() *graphql.Schema {
+	nonNull := func(t graphql.Type) graphql.Type { return &graphql.NonNull{OfType: t} }
+	listOf := func(t graphql.Type) graphql.Type { return &graphql.NonNull{OfType: &graphql.List{OfType: nonNull(t)}} }
+
+	attachmentType := &graphql.Object{
+		Name: "Attachment",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "id", Type: nonNull(graphql.ID)},
+			{Name: "filename", Type: nonNull(graphql.String)},
+			{Name: "contentType", Type: nonNull(graphql.String)},
+			{Name: "size", Type: nonNull(graphql.Int)},
+			{Name: "contentId", Type: graphql.String, Description: "Content-ID referenced by cid: URLs in the HTML body"},
+			{Name: "inline", Type: nonNull(graphql.Boolean)},
+			{Name: "detectedType", Type: graphql.String, Description: "Type sniffed from the data's magic bytes"},
+			{Name: "typeMismatch", Type: graphql.String, Description: "How the detected type contradicts contentType or the filename extension"},
+			{Name: "url", Type: nonNull(graphql.String), Description: "Download URL",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					att := p.Source.(*graphqlAttachment)
+					return fmt.Sprintf("/api/emails/%d/attachments/%d", att.EmailID, att.ID), nil
+				}},
+		},
+	}
+
+	headerType := &graphql.Object{
+		Name: "Header",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "name", Type: nonNull(graphql.String)},
+			{Name: "value", Type: nonNull(graphql.String)},
+		},
+	}
+
+	searchMatchType := &graphql.Object{
+		Name:        "SearchMatch",
+		Description: "Where a search matched; subject and body are HTML with matches in <mark> tags",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "fields", Type: listOf(graphql.String)},
+			{Name: "subject", Type: graphql.String},
+			{Name: "body", Type: graphql.String},
+		},
+	}
+
+	spamRuleType := &graphql.Object{
+		Name: "SpamRule",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "name", Type: nonNull(graphql.String)},
+			{Name: "score", Type: nonNull(graphql.Float)},
+			{Name: "description", Type: graphql.String},
+		},
+	}
+
+	spamResultType := &graphql.Object{
+		Name: "SpamResult",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "engine", Type: nonNull(graphql.String)},
+			{Name: "score", Type: nonNull(graphql.Float)},
+			{Name: "threshold", Type: nonNull(graphql.Float)},
+			{Name: "isSpam", Type: nonNull(graphql.Boolean)},
+			{Name: "action", Type: graphql.String},
+			{Name: "rules", Type: listOf(spamRuleType)},
+			{Name: "checkedAt", Type: nonNull(dateTimeScalar)},
+		},
+	}
+
+	spfResultType := &graphql.Object{
+		Name: "SPFResult",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "result", Type: nonNull(graphql.String)},
+			{Name: "domain", Type: nonNull(graphql.String)},
+			{Name: "ip", Type: nonNull(graphql.String)},
+			{Name: "reason", Type: graphql.String},
+		},
+	}
+
+	dkimResultType := &graphql.Object{
+		Name: "DKIMResult",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "result", Type: nonNull(graphql.String)},
+			{Name: "domain", Type: nonNull(graphql.String)},
+			{Name: "selector", Type: nonNull(graphql.String)},
+			{Name: "algorithm", Type: nonNull(graphql.String)},
+			{Name: "headers", Type: listOf(graphql.String)},
+			{Name: "reason", Type: graphql.String},
+		},
+	}
+
+	dmarcResultType := &graphql.Object{
+		Name: "DMARCResult",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "result", Type: nonNull(graphql.String)},
+			{Name: "domain", Type: nonNull(graphql.String)},
+			{Name: "policy", Type: graphql.String},
+			{Name: "spfAligned", Type: nonNull(graphql.Boolean)},
+			{Name: "dkimAligned", Type: nonNull(graphql.Boolean)},
+			{Name: "reason", Type: graphql.String},
+		},
+	}
+
+	authResultsType := &graphql.Object{
+		Name: "AuthResults",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "spf", Type: nonNull(spfResultType)},
+			{Name: "dkim", Type: listOf(dkimResultType)},
+			{Name: "dmarc", Type: nonNull(dmarcResultType)},
+			{Name: "checkedAt", Type: nonNull(dateTimeScalar)},
+		},
+	}
+
+	emailType := &graphql.Object{
+		Name: "Email",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "id", Type: nonNull(graphql.ID)},
+			{Name: "messageId", Type: nonNull(graphql.String)},
+			{Name: "from", Type: nonNull(graphql.String)},
+			{Name: "to", Type: listOf(graphql.String)},
+			{Name: "cc", Type: listOf(graphql.String)},
+			{Name: "bcc", Type: listOf(graphql.String)},
+			{Name: "subject", Type: nonNull(graphql.String)},
+			{Name: "bodyPlain", Type: nonNull(graphql.String)},
+			{Name: "bodyHTML", Type: nonNull(graphql.String)},
+			{Name: "bodyAMP", Type: graphql.String, Description: "AMP for Email (text/x-amp-html) body"},
+			{
+				Name: "headers", Type: listOf(headerType),
+				Description: "Headers sorted by name, optionally only those with the given name",
+				Args:        []*graphql.ArgumentDefinition{{Name: "name", Type: graphql.String}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return emailHeaders(p.Source.(*storage.Email), p.Args["name"]), nil
+				},
+			},
+			{
+				Name: "attachments", Type: listOf(attachmentType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return s.emailAttachments(p.Source.(*storage.Email))
+				},
+			},
+			{Name: "size", Type: nonNull(graphql.Int)},
+			{Name: "receivedAt", Type: nonNull(dateTimeScalar)},
+			{Name: "read", Type: nonNull(graphql.Boolean)},
+			{Name: "pinned", Type: nonNull(graphql.Boolean)},
+			{Name: "tags", Type: listOf(graphql.String)},
+			{Name: "envelopeFrom", Type: nonNull(graphql.String)},
+			{Name: "envelopeTo", Type: listOf(graphql.String)},
+			{Name: "replyTo", Type: listOf(graphql.String)},
+			{Name: "sender", Type: graphql.String, Description: "Sender header, when sent on behalf of from"},
+			{Name: "returnPath", Type: graphql.String, Description: "Where bounces go: MAIL FROM, or the Return-Path header"},
+			{Name: "priority", Type: graphql.String, Description: "high, normal or low, when the headers flag a priority"},
+			{Name: "threadId", Type: nonNull(graphql.String)},
+			{Name: "updatedAt", Type: nonNull(dateTimeScalar)},
+			{Name: "missingAlternative", Type: graphql.String, Description: "plain or html, when the email has only the other body"},
+			{Name: "spam", Type: spamResultType, Description: "Set when spam scoring is enabled"},
+			{Name: "auth", Type: authResultsType, Description: "DKIM, SPF and DMARC; set when mail_auth is enabled"},
+			{Name: "match", Type: searchMatchType, Description: "Set on search results"},
+		},
+	}
+
+	connectionType := &graphql.Object{
+		Name: "EmailConnection",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "emails", Type: listOf(emailType)},
+			{Name: "total", Type: nonNull(graphql.Int)},
+			{Name: "nextCursor", Type: graphql.String, Description: "Pass as after to fetch the next page"},
+		},
+	}
+
+	quotaType := &graphql.Object{
+		Name: "Quota",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "maxMessages", Type: nonNull(graphql.Int), Description: "0 means unlimited"},
+			{Name: "maxBytes", Type: nonNull(graphql.Int), Description: "0 means unlimited"},
+		},
+	}
+
+	mailboxType := &graphql.Object{
+		Name: "Mailbox",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "address", Type: nonNull(graphql.String)},
+			{Name: "messages", Type: nonNull(graphql.Int)},
+			{Name: "bytes", Type: nonNull(graphql.Int)},
+			{Name: "quota", Type: quotaType, Description: "Set when quotas are enabled"},
+		},
+	}
+
+	dailyCountType := &graphql.Object{
+		Name: "DailyCount",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "date", Type: nonNull(graphql.String)},
+			{Name: "count", Type: nonNull(graphql.Int)},
+			{Name: "bytes", Type: nonNull(graphql.Int)},
+		},
+	}
+
+	storageStatsType := &graphql.Object{
+		Name: "StorageStats",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "databaseBytes", Type: nonNull(graphql.Int)},
+			{Name: "walBytes", Type: nonNull(graphql.Int)},
+			{Name: "emailCount", Type: nonNull(graphql.Int)},
+			{Name: "emailBytes", Type: nonNull(graphql.Int)},
+			{Name: "attachmentCount", Type: nonNull(graphql.Int)},
+			{Name: "attachmentBytes", Type: nonNull(graphql.Int)},
+			{Name: "blobCount", Type: nonNull(graphql.Int)},
+			{Name: "blobBytes", Type: nonNull(graphql.Int)},
+			{Name: "dailyCounts", Type: listOf(dailyCountType)},
+		},
+	}
+
+	mailboxCountType := &graphql.Object{
+		Name: "MailboxCount",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "address", Type: nonNull(graphql.String)},
+			{Name: "total", Type: nonNull(graphql.Int)},
+			{Name: "unread", Type: nonNull(graphql.Int)},
+		},
+	}
+
+	tagCountType := &graphql.Object{
+		Name: "TagCount",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "tag", Type: nonNull(graphql.String)},
+			{Name: "total", Type: nonNull(graphql.Int)},
+			{Name: "unread", Type: nonNull(graphql.Int)},
+		},
+	}
+
+	statsType := &graphql.Object{
+		Name: "Stats",
+		Fields: []*graphql.FieldDefinition{
+			{Name: "totalEmails", Type: nonNull(graphql.Int)},
+			{Name: "todayCount", Type: nonNull(graphql.Int)},
+			{Name: "unreadCount", Type: nonNull(graphql.Int)},
+			{Name: "mailboxes", Type: listOf(mailboxCountType), Description: "All and unread emails by To address"},
+			{Name: "tags", Type: listOf(tagCountType), Description: "All and unread emails by tag"},
+			{
+				Name: "storage", Type: nonNull(storageStatsType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return s.storage.Stats()
+				},
+			},
+		},
+	}
+
+	paging := []*graphql.ArgumentDefinition{
+		{Name: "limit", Type: graphql.Int, DefaultValue: 50, Description: "Capped at 100"},
+		{Name: "offset", Type: graphql.Int, DefaultValue: 0},
+	}
+
+	query := &graphql.Object{
+		Name: "Query",
+		Fields: []*graphql.FieldDefinition{
+			{
+				Name: "emails", Type: nonNull(connectionType),
+				Description: "Emails, newest first",
+				Args: append([]*graphql.ArgumentDefinition{
+					{Name: "from", Type: graphql.String},
+					{Name: "to", Type: graphql.String},
+					{Name: "subject", Type: graphql.String},
+					{Name: "rcpt", Type: graphql.String, Description: "Envelope recipient, including BCC"},
+					{Name: "replyTo", Type: graphql.String},
+					{Name: "sender", Type: graphql.String},
+					{Name: "returnPath", Type: graphql.String},
+					{Name: "priority", Type: graphql.String, Description: "high, normal or low"},
+					{Name: "tag", Type: graphql.String},
+					{Name: "pinned", Type: graphql.Boolean},
+					{Name: "unread", Type: graphql.Boolean},
+					{Name: "since", Type: dateTimeScalar},
+					{Name: "until", Type: dateTimeScalar},
+					{Name: "spam", Type: graphql.Boolean, Description: "Classified as spam"},
+					{Name: "minSpamScore", Type: graphql.Float},
+					{Name: "missingAlternative", Type: graphql.String, Description: "plain or html: only emails without that body"},
+					{Name: "after", Type: graphql.String, Description: "nextCursor of the previous page; offset is ignored"},
+				}, paging...),
+				Resolve: s.resolveEmails,
+			},
+			{
+				Name: "email", Type: emailType,
+				Args: []*graphql.ArgumentDefinition{{Name: "id", Type: nonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					id, ok := p.Args["id"].(int64)
+					if !ok {
+						return nil, nil
+					}
+					email, err := s.storage.GetEmail(id)
+					if errors.Is(err, storage.ErrNotFound) {
+						return nil, nil
+					}
+					return email, err
+				},
+			},
+			{
+				Name: "search", Type: nonNull(connectionType),
+				Description: "Full-text search; the arguments that are set must all match",
+				Args: append([]*graphql.ArgumentDefinition{
+					{Name: "query", Type: graphql.String, Description: "Words, \"phrases\", OR, -excluded, subject:word"},
+					{Name: "subject", Type: graphql.String, Description: "Searched in the subject alone"},
+					{Name: "body", Type: graphql.String, Description: "Searched in the plain-text body alone"},
+					{Name: "header", Type: graphql.String, Description: "Name of a header the emails have"},
+					{Name: "headerValue", Type: graphql.String, Description: "Text a value of header contains"},
+				}, paging...),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					limit, offset := graphqlPaging(p.Args)
+					query := &storage.SearchQuery{}
+					query.Text, _ = p.Args["query"].(string)
+					query.Subject, _ = p.Args["subject"].(string)
+					query.Body, _ = p.Args["body"].(string)
+					query.Header, _ = p.Args["header"].(string)
+					query.HeaderValue, _ = p.Args["headerValue"].(string)
+					return s.storage.SearchEmails(query, nil, limit, offset)
+				},
+			},
+			{
+				Name: "mailboxes", Type: listOf(mailboxType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return s.mailboxInfos()
+				},
+			},
+			{
+				Name: "stats", Type: nonNull(statsType),
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return s.emailStats(nil)
+				},
+			},
+		},
+	}
+
+	subscription := &graphql.Object{
+		Name: "Subscription",
+		Fields: []*graphql.FieldDefinition{
+			{
+				Name: "emailReceived", Type: nonNull(emailType),
+				Description: "New emails, optionally only those whose header or envelope recipients contain to",
+				Args:        []*graphql.ArgumentDefinition{{Name: "to", Type: graphql.String}},
+				Subscribe:   s.subscribeEmailReceived,
+			},
+		},
+	}
+
+	return &graphql.Schema{Query: query, Subscription: subscription}
+}
+
+// graphqlPaging reads the limit and offset arguments, clamped like the
+// REST parameters
+func graphqlPaging(args map[string]interface{}) (int, int) {
+	limit, _ := args["limit"].(int)
+	offset, _ := args["offset"].(int)
+	if limit < 1 {
+		limit = 1
+	}
+	if limit > 100 {
+		limit = 100
+	}
+	if offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// resolveEmails resolves Query.emails
+func (s *Server) resolveEmails(p graphql.ResolveParams) (interface{}, error) {
+	filter := &storage.EmailFilter{}
+	filter.From, _ = p.Args["from"].(string)
+	filter.To, _ = p.Args["to"].(string)
+	filter.Subject, _ = p.Args["subject"].(string)
+	filter.EnvelopeTo, _ = p.Args["rcpt"].(string)
+	filter.ReplyTo, _ = p.Args["replyTo"].(string)
+	filter.Sender, _ = p.Args["sender"].(string)
+	filter.ReturnPath, _ = p.Args["returnPath"].(string)
+	filter.Priority, _ = p.Args["priority"].(string)
+	filter.Tag, _ = p.Args["tag"].(string)
+	filter.Pinned, _ = p.Args["pinned"].(bool)
+	filter.Unread, _ = p.Args["unread"].(bool)
+	filter.Spam, _ = p.Args["spam"].(bool)
+	filter.MissingAlternative, _ = p.Args["missingAlternative"].(string)
+	if score, ok := p.Args["minSpamScore"].(float64); ok {
+		filter.MinSpamScore = &score
+	}
+	if since, ok := p.Args["since"].(time.Time); ok {
+		filter.Since = &since
+	}
+	if until, ok := p.Args["until"].(time.Time); ok {
+		filter.Until = &until
+	}
+
+	limit, offset := graphqlPaging(p.Args)
+	if after, ok := p.Args["after"].(string); ok && after != "" {
+		cursor, err := storage.ParseCursor(after)
+		if err != nil {
+			return nil, err
+		}
+		filter.Cursor = cursor
+		offset = 0
+	}
+
+	return s.storage.ListEmails(filter, limit, offset)
+}
+
+// emailHeaders flattens the headers of an email, sorted by name
+func emailHeaders(email *storage.Email, name interface{}) []graphqlHeader {
+	only, _ := name.(string)
+
+	names := make([]string, 0, len(email.Headers))
+	for key := range email.Headers {
+		if only == "" || strings.EqualFold(key, only) {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+
+	headers := []graphqlHeader{}
+	for _, key := range names {
+		for _, value := range email.Headers[key] {
+			headers = append(headers, graphqlHeader{Name: key, Value: value})
+		}
+	}
+	return headers
+}
+
+// emailAttachments returns the attachment metadata of an email, loading it
+// for emails from list results, which do not include attachments
+func (s *Server) emailAttachments(email *storage.Email) ([]*graphqlAttachment, error) {
+	attachments := email.Attachments
+	if attachments == nil {
+		full, err := s.storage.GetEmail(email.ID)
+		if err != nil {
+			return nil, err
+		}
+		attachments = full.Attachments
+	}
+
+	result := make([]*graphqlAttachment, len(attachments))
+	for i, att := range attachments {
+		result[i] = &graphqlAttachment{Attachment: att, EmailID: email.ID}
+	}
+	return result, nil
+}
+
+// subscribeEmailReceived streams new emails to Subscription.emailReceived
+func (s *Server) subscribeEmailReceived(p graphql.ResolveParams) (<-chan interface{}, error) {
+	to, _ := p.Args["to"].(string)
+	to = strings.ToLower(to)
+
+	events, unsubscribe := s.subscribe()
+	emails := make(chan interface{})
+	go func() {
+		defer close(emails)
+		defer unsubscribe()
+		for {
+			select {
+			case <-p.Context.Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				if event.Type != "email.new" {
+					continue
+				}
+				id, _ := event.Data["id"].(int64)
+				email, err := s.storage.GetEmail(id)
+				if err != nil {
+					continue
+				}
+				if to != "" && !recipientMatches(email, to) {
+					continue
+				}
+				select {
+				case emails <- email:
+				case <-p.Context.Done():
+					return
+				}
+			}
+		}
+	}()
+	return emails, nil
+}
+
+// recipientMatches reports whether any header or envelope recipient
+// contains the lowercase substring to
+func recipientMatches(email *storage.Email, to string) bool {
+	for _, list := range [][]string{email.To, email.CC, email.EnvelopeTo} {
+		for _, address := range list {
+			if strings.Contains(strings.ToLower(address), to) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleGraphQL handles GET and POST /api/graphql. GET requests that ask
+// for a WebSocket upgrade are served with the graphql-transport-ws
+// protocol for subscriptions.
+func (s *Server) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphql.Request
+
+	switch r.Method {
+	case http.MethodGet:
+		if isWebSocketUpgrade(r) {
+			s.serveGraphQLWS(w, r)
+			return
+		}
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				writeGraphQL(w, http.StatusBadRequest, &graphql.Result{Errors: []*graphql.Error{{Message: "variables must be a JSON object"}}})
+				return
+			}
+		}
+		if req.OperationType() == "mutation" {
+			writeGraphQL(w, http.StatusMethodNotAllowed, &graphql.Result{Errors: []*graphql.Error{{Message: "mutations require POST"}}})
+			return
+		}
+	default:
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeGraphQL(w, http.StatusBadRequest, &graphql.Result{Errors: []*graphql.Error{{Message: "invalid JSON body"}}})
+			return
+		}
+	}
+
+	if req.Query == "" {
+		writeGraphQL(w, http.StatusBadRequest, &graphql.Result{Errors: []*graphql.Error{{Message: "query is required"}}})
+		return
+	}
+
+	writeGraphQL(w, http.StatusOK, s.graphql.Execute(r.Context(), &req))
+}
+
+func writeGraphQL(w http.ResponseWriter, status int, result *graphql.Result) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+// isWebSocketUpgrade reports whether r asks for a WebSocket connection
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
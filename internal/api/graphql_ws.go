@@ -0,0 +1,295 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"gowebmail/internal/graphql"
+)
+
+const (
+	// graphqlWSProtocol is the WebSocket subprotocol for subscriptions
+	graphqlWSProtocol = "graphql-transport-ws"
+
+	// Time allowed for the client to send connection_init
+	graphqlInitTimeout = 10 * time.Second
+
+	// Maximum size of a message from a GraphQL client
+	graphqlMaxMessageSize = 64 << 10
+)
+
+// Close codes defined by the graphql-transport-ws protocol
+const (
+	closeInvalidMessage     = 4400
+	closeUnauthorized       = 4401
+	closeInitTimeout        = 4408
+	closeSubscriberExists   = 4409
+	closeTooManyInitRequest = 4429
+)
+
+var graphqlUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	Subprotocols:    []string{graphqlWSProtocol},
+	CheckOrigin: func(r *http.Request) bool {
+		return true // Allow all origins for development
+	},
+}
+
+// graphqlWSMessage is a graphql-transport-ws protocol message
+type graphqlWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// connSet tracks open GraphQL WebSocket connections so they can be closed
+// on shutdown
+type connSet struct {
+	mu    sync.Mutex
+	conns map[*websocket.Conn]struct{}
+}
+
+func newConnSet() *connSet {
+	return &connSet{conns: make(map[*websocket.Conn]struct{})}
+}
+
+func (c *connSet) add(conn *websocket.Conn) {
+	c.mu.Lock()
+	c.conns[conn] = struct{}{}
+	c.mu.Unlock()
+}
+
+func (c *connSet) remove(conn *websocket.Conn) {
+	c.mu.Lock()
+	delete(c.conns, conn)
+	c.mu.Unlock()
+}
+
+// closeAll sends each connection a close frame and closes it
+func (c *connSet) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for conn := range c.conns {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(writeWait))
+		conn.Close()
+		delete(c.conns, conn)
+	}
+}
+
+// graphqlWSConn is one client connection
+type graphqlWSConn struct {
+	server *Server
+	conn   *websocket.Conn
+	ctx    context.Context
+
+	writeMu sync.Mutex
+	subsMu  sync.Mutex
+	subs    map[string]context.CancelFunc
+}
+
+// serveGraphQLWS serves GraphQL operations over a WebSocket using the
+// graphql-transport-ws protocol
+func (s *Server) serveGraphQLWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := graphqlUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("GraphQL WebSocket upgrade failed")
+		return
+	}
+	if conn.Subprotocol() != graphqlWSProtocol {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, "unsupported subprotocol"),
+			time.Now().Add(writeWait))
+		conn.Close()
+		return
+	}
+
+	s.graphqlConns.add(conn)
+	defer s.graphqlConns.remove(conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := &graphqlWSConn{
+		server: s,
+		conn:   conn,
+		ctx:    ctx,
+		subs:   make(map[string]context.CancelFunc),
+	}
+	c.run()
+}
+
+func (c *graphqlWSConn) run() {
+	defer c.conn.Close()
+
+	c.conn.SetReadLimit(graphqlMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(graphqlInitTimeout))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	go c.keepalive()
+
+	acknowledged := false
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if !acknowledged {
+				c.close(closeInitTimeout, "Connection initialisation timeout")
+			}
+			return
+		}
+
+		var msg graphqlWSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.close(closeInvalidMessage, "Invalid message")
+			return
+		}
+
+		switch msg.Type {
+		case "connection_init":
+			if acknowledged {
+				c.close(closeTooManyInitRequest, "Too many initialisation requests")
+				return
+			}
+			acknowledged = true
+			c.conn.SetReadDeadline(time.Now().Add(pongWait))
+			c.write(&graphqlWSMessage{Type: "connection_ack"})
+
+		case "ping":
+			c.write(&graphqlWSMessage{Type: "pong", Payload: msg.Payload})
+
+		case "pong":
+			// Answers a protocol ping; the server only sends WebSocket ping frames
+
+		case "subscribe":
+			if !acknowledged {
+				c.close(closeUnauthorized, "Unauthorized")
+				return
+			}
+			var req graphql.Request
+			if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil {
+				c.close(closeInvalidMessage, "Invalid subscribe message")
+				return
+			}
+			if !c.start(msg.ID, &req) {
+				c.close(closeSubscriberExists, "Subscriber for "+msg.ID+" already exists")
+				return
+			}
+
+		case "complete":
+			c.stop(msg.ID)
+
+		default:
+			c.close(closeInvalidMessage, "Unknown message type "+msg.Type)
+			return
+		}
+	}
+}
+
+// start runs an operation; it returns false if the id is already in use
+func (c *graphqlWSConn) start(id string, req *graphql.Request) bool {
+	c.subsMu.Lock()
+	if _, ok := c.subs[id]; ok {
+		c.subsMu.Unlock()
+		return false
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.subs[id] = cancel
+	c.subsMu.Unlock()
+
+	go func() {
+		defer c.finish(id)
+
+		if req.OperationType() != "subscription" {
+			c.next(id, c.server.graphql.Execute(ctx, req))
+			return
+		}
+
+		results, errResult := c.server.graphql.Subscribe(ctx, req)
+		if errResult != nil {
+			payload, _ := json.Marshal(errResult.Errors)
+			c.write(&graphqlWSMessage{ID: id, Type: "error", Payload: payload})
+			c.forget(id)
+			return
+		}
+		for result := range results {
+			c.next(id, result)
+		}
+	}()
+	return true
+}
+
+// stop cancels an operation at the client's request
+func (c *graphqlWSConn) stop(id string) {
+	if cancel := c.forget(id); cancel != nil {
+		cancel()
+	}
+}
+
+// forget removes an operation without sending complete
+func (c *graphqlWSConn) forget(id string) context.CancelFunc {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+	cancel := c.subs[id]
+	delete(c.subs, id)
+	return cancel
+}
+
+// finish sends complete if the operation ended on the server side
+func (c *graphqlWSConn) finish(id string) {
+	if cancel := c.forget(id); cancel != nil {
+		cancel()
+		c.write(&graphqlWSMessage{ID: id, Type: "complete"})
+	}
+}
+
+func (c *graphqlWSConn) next(id string, result *graphql.Result) {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	c.write(&graphqlWSMessage{ID: id, Type: "next", Payload: payload})
+}
+
+func (c *graphqlWSConn) write(msg *graphqlWSMessage) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	c.conn.WriteJSON(msg)
+}
+
+func (c *graphqlWSConn) close(code int, reason string) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(writeWait))
+}
+
+// keepalive pings the client until the connection is done
+func (c *graphqlWSConn) keepalive() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			c.writeMu.Lock()
+			err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+			c.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -1,16 +1,25 @@
 package api
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/gorilla/mux"
 
+	"gowebmail/internal/config"
 	"gowebmail/internal/email"
+	"gowebmail/internal/quota"
 	"gowebmail/internal/storage"
 )
 
@@ -29,27 +38,41 @@ type APIError struct {
 
 // handleListEmails handles GET /api/emails
 func (s *Server) handleListEmails(w http.ResponseWriter, r *http.Request) {
-	// Parse query parameters
+	s.sendEmailList(w, r, parseEmailFilter(r))
+}
+
+// sendEmailList sends the page of emails matching filter that the limit,
+// offset, cursor and fields query parameters ask for
+func (s *Server) sendEmailList(w http.ResponseWriter, r *http.Request, filter *storage.EmailFilter) {
 	limit := parseIntParam(r, "limit", 50, 1, 100)
 	offset := parseIntParam(r, "offset", 0, 0, math.MaxInt)
 
-	// Build filter
-	filter := &storage.EmailFilter{
-		From:    r.URL.Query().Get("from"),
-		To:      r.URL.Query().Get("to"),
-		Subject: r.URL.Query().Get("subject"),
+	// Bodies and headers are left out unless fields=full
+	fields := r.URL.Query().Get("fields")
+	if fields != "" && fields != "summary" && fields != "full" {
+		s.sendError(w, http.StatusBadRequest, "INVALID_FIELDS", "fields must be summary or full")
+		return
 	}
 
-	// Parse date filters
-	if since := r.URL.Query().Get("since"); since != "" {
-		if t, err := time.Parse(time.RFC3339, since); err == nil {
-			filter.Since = &t
+	filter.Summary = fields != "full"
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		cursor, err := storage.ParseCursor(token)
+		if err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_CURSOR", "Invalid cursor")
+			return
 		}
+		filter.Cursor = cursor
+		offset = 0
 	}
-	if until := r.URL.Query().Get("until"); until != "" {
-		if t, err := time.Parse(time.RFC3339, until); err == nil {
-			filter.Until = &t
-		}
+
+	// Answer polling clients from the version alone when nothing changed
+	version, err := s.storage.EmailsVersion()
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+	if checkETag(w, r, version) {
+		return
 	}
 
 	// Get emails
@@ -59,11 +82,21 @@ func (s *Server) handleListEmails(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var emails interface{} = result.Emails
+	if filter.Summary {
+		summaries := make([]*storage.EmailSummary, len(result.Emails))
+		for i, e := range result.Emails {
+			summaries[i] = e.Summary()
+		}
+		emails = summaries
+	}
+
 	s.sendSuccess(w, map[string]interface{}{
-		"emails": result.Emails,
-		"total":  result.Total,
-		"limit":  limit,
-		"offset": offset,
+		"emails":     emails,
+		"total":      result.Total,
+		"limit":      limit,
+		"offset":     offset,
+		"nextCursor": result.NextCursor,
 	})
 }
 
@@ -85,6 +118,35 @@ func (s *Server) handleGetEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if checkETag(w, r, fmt.Sprintf("%d-%d", email.ID, email.UpdatedAt.UnixMilli())) {
+		return
+	}
+
+	s.sendSuccess(w, email)
+}
+
+// handleGetEmailByMessageID handles GET and HEAD
+// /api/emails/by-message-id/{messageId}. Content-Location names the email,
+// so existence checks with HEAD also learn its ID.
+func (s *Server) handleGetEmailByMessageID(w http.ResponseWriter, r *http.Request) {
+	email, err := s.storage.GetEmailByMessageID(mux.Vars(r)["messageId"])
+	if err == nil && !seesEmail(requestIdentity(r).Mailboxes, email) {
+		err = storage.ErrNotFound
+	}
+	if err != nil {
+		if err == storage.ErrNotFound {
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		} else {
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Location", fmt.Sprintf("/api/emails/%d", email.ID))
+	if checkETag(w, r, fmt.Sprintf("%d-%d", email.ID, email.UpdatedAt.UnixMilli())) {
+		return
+	}
+
 	s.sendSuccess(w, email)
 }
 
@@ -96,6 +158,12 @@ func (s *Server) handleDeleteEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Kept for the audit log, which outlives the email
+	details := map[string]interface{}{}
+	if email, err := s.storage.GetEmail(id); err == nil {
+		details["from"], details["subject"] = email.From, email.Subject
+	}
+
 	err := s.storage.DeleteEmail(id)
 	if err != nil {
 		if err == storage.ErrNotFound {
@@ -105,26 +173,152 @@ func (s *Server) handleDeleteEmail(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	s.audit(r, "email.delete", strconv.FormatInt(id, 10), details)
 
 	// Notify WebSocket clients
-	s.wsHub.Broadcast(&WebSocketMessage{
-		Type: "email.deleted",
-		Data: map[string]interface{}{"id": id},
-	})
+	s.BroadcastDeletedEmail(id)
 
 	s.sendSuccess(w, map[string]interface{}{"deleted": id})
 }
 
+// parseEmailUpdate decodes a JSON merge patch (RFC 7396) of the mutable
+// email fields. Absent fields are left unchanged and null resets a field
+// to its default.
+func parseEmailUpdate(body io.Reader) (*storage.EmailUpdate, error) {
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(body).Decode(&patch); err != nil {
+		return nil, fmt.Errorf("invalid request body")
+	}
+
+	update := &storage.EmailUpdate{}
+	for field, value := range patch {
+		isNull := bytes.Equal(bytes.TrimSpace(value), []byte("null"))
+
+		switch field {
+		case "read", "pinned":
+			flag := false
+			if !isNull {
+				if err := json.Unmarshal(value, &flag); err != nil {
+					return nil, fmt.Errorf("%s must be a boolean", field)
+				}
+			}
+			if field == "read" {
+				update.Read = &flag
+			} else {
+				update.Pinned = &flag
+			}
+		case "tags":
+			tags := []string{}
+			if !isNull {
+				if err := json.Unmarshal(value, &tags); err != nil {
+					return nil, fmt.Errorf("tags must be an array of strings")
+				}
+			}
+			update.Tags = &tags
+		default:
+			return nil, fmt.Errorf("field %q cannot be updated", field)
+		}
+	}
+
+	return update, nil
+}
+
+// handleUpdateEmail handles PATCH /api/emails/{id}
+func (s *Server) handleUpdateEmail(w http.ResponseWriter, r *http.Request) {
+	id := parseIDParam(r)
+	if id == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid email ID")
+		return
+	}
+
+	update, err := parseEmailUpdate(r.Body)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	// Tags the email already has do not fire relay rules again
+	var before []string
+	if update.Tags != nil && s.tagRelayRules() {
+		email, err := s.storage.GetEmail(id)
+		if err == nil {
+			before = email.Tags
+		}
+	}
+
+	if err := s.storage.UpdateEmail(id, update); err != nil {
+		if err == storage.ErrNotFound {
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		} else {
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		}
+		return
+	}
+
+	email, err := s.storage.GetEmail(id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		} else {
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		}
+		return
+	}
+
+	// Notify WebSocket clients
+	s.broadcastEmailUpdate(email, update)
+
+	if update.Tags != nil && s.tagRelayRules() {
+		if added := addedTags(before, email.Tags); len(added) > 0 {
+			go s.autoRelay(email, added)
+		}
+	}
+
+	s.sendSuccess(w, email)
+}
+
+// broadcastEmailUpdate notifies WebSocket clients of the fields changed by update
+func (s *Server) broadcastEmailUpdate(email *storage.Email, update *storage.EmailUpdate) {
+	changes := map[string]interface{}{"id": email.ID}
+	if update.Read != nil {
+		changes["read"] = email.Read
+
+		// Kept for clients that only track read state
+		s.publish(&WebSocketMessage{
+			Type: "email.read",
+			Data: map[string]interface{}{"id": email.ID, "read": email.Read},
+		})
+	}
+	if update.Pinned != nil {
+		changes["pinned"] = email.Pinned
+	}
+	if update.Tags != nil {
+		changes["tags"] = email.Tags
+	}
+
+	s.publish(&WebSocketMessage{
+		Type: "email.updated",
+		Data: changes,
+	})
+}
+
 // handleDeleteAllEmails handles DELETE /api/emails
 func (s *Server) handleDeleteAllEmails(w http.ResponseWriter, r *http.Request) {
-	err := s.storage.DeleteAllEmails()
+	count, err := s.storage.GetEmailCount()
 	if err != nil {
 		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
 		return
 	}
 
+	err = s.storage.DeleteAllEmails()
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+	s.audit(r, "email.delete_all", "", map[string]interface{}{"count": count})
+
 	// Notify WebSocket clients
-	s.wsHub.Broadcast(&WebSocketMessage{
+	s.publish(&WebSocketMessage{
 		Type: "emails.cleared",
 		Data: map[string]interface{}{},
 	})
@@ -134,8 +328,18 @@ func (s *Server) handleDeleteAllEmails(w http.ResponseWriter, r *http.Request) {
 
 // handleSearchEmails handles GET /api/emails/search
 func (s *Server) handleSearchEmails(w http.ResponseWriter, r *http.Request) {
-	query := r.URL.Query().Get("q")
-	if query == "" {
+	query := &storage.SearchQuery{
+		Text:        r.URL.Query().Get("q"),
+		Subject:     r.URL.Query().Get("subject_q"),
+		Body:        r.URL.Query().Get("body_q"),
+		Header:      r.URL.Query().Get("header"),
+		HeaderValue: r.URL.Query().Get("header_value"),
+	}
+	if query.HeaderValue != "" && query.Header == "" {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "header_value needs a header")
+		return
+	}
+	if query.Text == "" && query.Subject == "" && query.Body == "" && query.Header == "" {
 		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Search query is required")
 		return
 	}
@@ -143,8 +347,13 @@ func (s *Server) handleSearchEmails(w http.ResponseWriter, r *http.Request) {
 	limit := parseIntParam(r, "limit", 50, 1, 100)
 	offset := parseIntParam(r, "offset", 0, 0, math.MaxInt)
 
-	result, err := s.storage.SearchEmails(query, limit, offset)
-	if err != nil {
+	// The list filters narrow the search, and users restricted to
+	// mailboxes search their own
+	result, err := s.storage.SearchEmails(query, parseEmailFilter(r), limit, offset)
+	if errors.Is(err, storage.ErrInvalidSearch) {
+		s.sendError(w, http.StatusBadRequest, "INVALID_QUERY", err.Error())
+		return
+	} else if err != nil {
 		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
 		return
 	}
@@ -165,6 +374,29 @@ func (s *Server) handleGetEmailRaw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	raw, err := s.storage.GetRawEmail(id)
+	if err == storage.ErrRawNotAvailable {
+		// Emails captured before raw storage was added
+		s.writeReconstructedRaw(w, id)
+		return
+	}
+	if err != nil {
+		if err == storage.ErrNotFound {
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		} else {
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+	w.Write(raw)
+}
+
+// writeReconstructedRaw writes an approximation of the raw message built
+// from the stored headers and body
+func (s *Server) writeReconstructedRaw(w http.ResponseWriter, id int64) {
 	email, err := s.storage.GetEmail(id)
 	if err != nil {
 		if err == storage.ErrNotFound {
@@ -175,24 +407,91 @@ func (s *Server) handleGetEmailRaw(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Build raw email
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	
+	w.Write(reconstructRaw(email))
+}
+
+// reconstructRaw builds an approximation of the raw message from the stored
+// headers and body, for emails captured before raw storage was added
+func reconstructRaw(email *storage.Email) []byte {
+	var buf bytes.Buffer
+
 	// Write headers
 	for key, values := range email.Headers {
 		for _, value := range values {
-			fmt.Fprintf(w, "%s: %s\r\n", key, value)
+			fmt.Fprintf(&buf, "%s: %s\r\n", key, value)
 		}
 	}
-	
-	fmt.Fprintf(w, "\r\n")
-	
+
+	buf.WriteString("\r\n")
+
 	// Write body (prefer plain text)
 	if email.BodyPlain != "" {
-		fmt.Fprint(w, email.BodyPlain)
+		buf.WriteString(email.BodyPlain)
 	} else if email.BodyHTML != "" {
-		fmt.Fprint(w, email.BodyHTML)
+		buf.WriteString(email.BodyHTML)
 	}
+
+	return buf.Bytes()
+}
+
+// handleDownloadEmail handles GET /api/emails/{id}/download
+func (s *Server) handleDownloadEmail(w http.ResponseWriter, r *http.Request) {
+	id := parseIDParam(r)
+	if id == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid email ID")
+		return
+	}
+
+	email, err := s.storage.GetEmail(id)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		} else {
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		}
+		return
+	}
+
+	raw, err := s.storage.GetRawEmail(id)
+	if err == storage.ErrRawNotAvailable {
+		raw = reconstructRaw(email)
+	} else if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	// FormatMediaType falls back to RFC 2231 encoding for non-ASCII subjects
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": emlFilename(email)}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(raw)))
+	w.Write(raw)
+}
+
+// maxFilenameSubject is the most subject characters used in download filenames
+const maxFilenameSubject = 60
+
+// emlFilename names a downloaded email after its ID and subject, e.g.
+// "42-Welcome-to-Example.eml", keeping only letters and digits so the name
+// is valid on every platform
+func emlFilename(email *storage.Email) string {
+	var slug []rune
+	for _, r := range email.Subject {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			slug = append(slug, r)
+		} else if len(slug) > 0 && slug[len(slug)-1] != '-' {
+			slug = append(slug, '-')
+		}
+		if len(slug) == maxFilenameSubject {
+			break
+		}
+	}
+
+	name := strings.Trim(string(slug), "-")
+	if name == "" {
+		return fmt.Sprintf("email-%d.eml", email.ID)
+	}
+	return fmt.Sprintf("%d-%s.eml", email.ID, name)
 }
 
 // handleGetEmailHTML handles GET /api/emails/{id}/html
@@ -218,35 +517,107 @@ func (s *Server) handleGetEmailHTML(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Point cid: URLs at the attachment view endpoint before sanitizing,
+	// which would otherwise strip them
+	body, inlined := email.RewriteCIDs(emailData.BodyHTML, func(contentID string) string {
+		if att := findContentID(emailData, contentID); att != nil {
+			return fmt.Sprintf("/api/emails/%d/attachments/%d/view", emailData.ID, att.ID)
+		}
+		return ""
+	})
+
 	// Sanitize HTML
 	sanitizer := email.NewSanitizer()
-	sanitized := sanitizer.Sanitize(emailData.BodyHTML)
+	sanitized := sanitizer.Sanitize(body)
+
+	imgSrc := "data:"
+	if inlined {
+		imgSrc = "'self' data:"
+	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src data:")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src "+imgSrc)
 	fmt.Fprint(w, sanitized)
 }
 
-// handleGetAttachment handles GET /api/emails/{id}/attachments/{aid}
-func (s *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	
-	aid, err := strconv.ParseInt(vars["aid"], 10, 64)
-	if err != nil || aid <= 0 {
-		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid attachment ID")
+// findContentID returns the attachment of e referenced by a cid: URL
+func findContentID(e *storage.Email, contentID string) *storage.Attachment {
+	for _, att := range e.Attachments {
+		if att.ContentID != "" && strings.EqualFold(att.ContentID, contentID) {
+			return att
+		}
+	}
+	return nil
+}
+
+// handleGetEmailScreenshot handles GET /api/emails/{id}/screenshot
+func (s *Server) handleGetEmailScreenshot(w http.ResponseWriter, r *http.Request) {
+	if s.renderer == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "RENDER_DISABLED", "Screenshots are not enabled")
 		return
 	}
 
-	attachment, err := s.storage.GetAttachment(aid)
+	id := parseIDParam(r)
+	if id == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid email ID")
+		return
+	}
+
+	emailData, err := s.storage.GetEmail(id)
 	if err != nil {
 		if err == storage.ErrNotFound {
-			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Attachment not found")
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
 		} else {
 			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
 		}
 		return
 	}
 
+	if emailData.BodyHTML == "" {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "No HTML body available")
+		return
+	}
+
+	width := parseIntParam(r, "width", s.config.Render.Width, 100, 4000)
+	height := parseIntParam(r, "height", s.config.Render.Height, 100, 10000)
+
+	// Render what the /html endpoint serves. The renderer cannot reach
+	// this server, so inline images are embedded as data URIs instead.
+	body, _ := email.RewriteCIDs(emailData.BodyHTML, func(contentID string) string {
+		att := findContentID(emailData, contentID)
+		if att == nil {
+			return ""
+		}
+		full, err := s.storage.GetAttachment(att.ID)
+		if err != nil {
+			return ""
+		}
+		contentType := previewContentType(full)
+		if !strings.HasPrefix(contentType, "image/") {
+			return ""
+		}
+		return "data:" + contentType + ";base64," + base64.StdEncoding.EncodeToString(full.Data)
+	})
+	sanitized := email.NewSanitizer().Sanitize(body)
+	png, err := s.renderer.Screenshot(r.Context(), sanitized, width, height)
+	if err != nil {
+		s.logger.Error().Err(err).Int64("id", id).Msg("Failed to render screenshot")
+		s.sendError(w, http.StatusInternalServerError, "RENDER_ERROR", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(png)))
+	w.Write(png)
+}
+
+// handleGetAttachment handles GET /api/emails/{id}/attachments/{aid}
+func (s *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment := s.loadAttachment(w, r)
+	if attachment == nil {
+		return
+	}
+
 	// Set headers
 	w.Header().Set("Content-Type", attachment.ContentType)
 	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", attachment.Filename))
@@ -256,26 +627,368 @@ func (s *Server) handleGetAttachment(w http.ResponseWriter, r *http.Request) {
 	w.Write(attachment.Data)
 }
 
+// previewableTypes are the content types served inline by the attachment
+// view endpoint. Types that can run script, such as HTML and SVG, are
+// deliberately missing.
+var previewableTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"image/bmp":       true,
+	"application/pdf": true,
+	"text/plain":      true,
+}
+
+// handleViewAttachment handles GET /api/emails/{id}/attachments/{aid}/view
+func (s *Server) handleViewAttachment(w http.ResponseWriter, r *http.Request) {
+	attachment := s.loadAttachment(w, r)
+	if attachment == nil {
+		return
+	}
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; img-src 'self' data:")
+	w.Header().Set("Content-Length", strconv.Itoa(len(attachment.Data)))
+
+	contentType := previewContentType(attachment)
+	if contentType == "" {
+		// Not safe to render; let the browser download it instead
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": attachment.Filename}))
+		w.Write(attachment.Data)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": attachment.Filename}))
+	w.Write(attachment.Data)
+}
+
+// previewContentType returns the type to serve an attachment inline as, or
+// "" if it should not be rendered by the browser. The type is taken from
+// the data rather than the sender's declaration, so an HTML page labelled
+// image/png is not served as either.
+func previewContentType(attachment *storage.Attachment) string {
+	sniffed, _, _ := mime.ParseMediaType(http.DetectContentType(attachment.Data))
+	if sniffed == "text/plain" {
+		// Plain text is only recognised when declared, since any data
+		// without a binary signature sniffs as text
+		declared, _, _ := mime.ParseMediaType(attachment.ContentType)
+		if declared != "text/plain" {
+			return ""
+		}
+		return "text/plain; charset=utf-8"
+	}
+	if !previewableTypes[sniffed] {
+		return ""
+	}
+	return sniffed
+}
+
+// loadAttachment loads the attachment named by the aid path parameter,
+// writing an error response and returning nil if it cannot be loaded
+func (s *Server) loadAttachment(w http.ResponseWriter, r *http.Request) *storage.Attachment {
+	vars := mux.Vars(r)
+
+	aid, err := strconv.ParseInt(vars["aid"], 10, 64)
+	if err != nil || aid <= 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid attachment ID")
+		return nil
+	}
+
+	attachment, err := s.storage.GetAttachment(aid)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Attachment not found")
+		} else {
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		}
+		return nil
+	}
+
+	return attachment
+}
+
+// EmailStats are the email counts reported by GET /api/stats
+type EmailStats struct {
+	TotalEmails int64 `json:"totalEmails"`
+	TodayCount  int64 `json:"todayCount"`
+	UnreadCount int64 `json:"unreadCount"`
+	*storage.EmailCounts
+}
+
+// emailStats counts all, today's and unread emails, in all and by mailbox
+// and tag
+func (s *Server) emailStats(mailboxes []string) (*EmailStats, error) {
+	counts, err := s.storage.CountEmails(mailboxes)
+	if err != nil {
+		return nil, err
+	}
+	stats := &EmailStats{EmailCounts: counts}
+	if mailboxes == nil {
+		count, err := s.storage.GetEmailCount()
+		if err != nil {
+			return nil, err
+		}
+		stats.TotalEmails = count
+	} else {
+		result, err := s.storage.ListEmails(&storage.EmailFilter{Mailboxes: mailboxes, Summary: true}, 1, 0)
+		if err != nil {
+			return nil, err
+		}
+		stats.TotalEmails = result.Total
+	}
+
+	// Get today's count
+	today := time.Now().Truncate(24 * time.Hour)
+	filter := &storage.EmailFilter{Since: &today, Mailboxes: mailboxes}
+	if todayResult, _ := s.storage.ListEmails(filter, 1, 0); todayResult != nil {
+		stats.TodayCount = todayResult.Total
+	}
+
+	// Get unread count
+	if unreadResult, _ := s.storage.ListEmails(&storage.EmailFilter{Unread: true, Mailboxes: mailboxes}, 1, 0); unreadResult != nil {
+		stats.UnreadCount = unreadResult.Total
+	}
+
+	return stats, nil
+}
+
+// StatsResponse combines the overall counts with analytics for a time range
+type StatsResponse struct {
+	*EmailStats
+	*storage.Analytics
+}
+
 // handleGetStats handles GET /api/stats
 func (s *Server) handleGetStats(w http.ResponseWriter, r *http.Request) {
-	count, err := s.storage.GetEmailCount()
+	mailboxes := requestIdentity(r).Mailboxes
+	stats, err := s.emailStats(mailboxes)
 	if err != nil {
 		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
 		return
 	}
 
-	// Get today's count
-	today := time.Now().Truncate(24 * time.Hour)
-	filter := &storage.EmailFilter{Since: &today}
-	todayResult, _ := s.storage.ListEmails(filter, 1, 0)
-	todayCount := int64(0)
-	if todayResult != nil {
-		todayCount = todayResult.Total
+	// Analytics cover all mail, so users restricted to mailboxes get the
+	// counts alone
+	if mailboxes != nil {
+		s.sendSuccess(w, StatsResponse{EmailStats: stats})
+		return
+	}
+
+	// The range defaults to the last day by hour, or the last 30 days by day
+	q := &storage.AnalyticsQuery{
+		Interval: r.URL.Query().Get("interval"),
+		Until:    time.Now(),
+		Top:      parseIntParam(r, "top", 10, 1, 100),
+	}
+	switch q.Interval {
+	case "":
+		q.Interval = storage.IntervalDay
+	case storage.IntervalDay, storage.IntervalHour:
+	default:
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "interval must be hour or day")
+		return
+	}
+	if until := r.URL.Query().Get("until"); until != "" {
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "until must be an RFC 3339 time")
+			return
+		}
+		q.Until = t
+	}
+	q.Since = q.Until.AddDate(0, 0, -30)
+	if q.Interval == storage.IntervalHour {
+		q.Since = q.Until.Add(-24 * time.Hour)
+	}
+	if since := r.URL.Query().Get("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "since must be an RFC 3339 time")
+			return
+		}
+		q.Since = t
+	}
+	if q.Since.After(q.Until) {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "since must not be after until")
+		return
+	}
+
+	analytics, err := s.storage.Analytics(q)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, StatsResponse{EmailStats: stats, Analytics: analytics})
+}
+
+// handleGetIngestStats handles GET /api/stats/ingest
+func (s *Server) handleGetIngestStats(w http.ResponseWriter, r *http.Request) {
+	// Emails saved but not yet checked and announced
+	jobs, err := s.storage.CountJobs()
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	writer, ok := s.storage.(*storage.BatchWriter)
+	if !ok {
+		s.sendSuccess(w, map[string]interface{}{
+			"batching":    false,
+			"pendingJobs": jobs,
+		})
+		return
 	}
 
 	s.sendSuccess(w, map[string]interface{}{
-		"totalEmails": count,
-		"todayCount":  todayCount,
+		"batching":    true,
+		"stats":       writer.BatchStats(),
+		"pendingJobs": jobs,
+	})
+}
+
+// MailboxInfo reports a mailbox's usage together with its quota
+type MailboxInfo struct {
+	*storage.MailboxUsage
+	Quota *config.QuotaLimit `json:"quota,omitempty"`
+}
+
+// mailboxInfos lists the mailboxes with their quotas
+func (s *Server) mailboxInfos() ([]MailboxInfo, error) {
+	mailboxes, err := s.storage.ListMailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]MailboxInfo, len(mailboxes))
+	for i, usage := range mailboxes {
+		result[i].MailboxUsage = usage
+		if s.config.Quotas.Enabled {
+			limit := quota.Limit(&s.config.Quotas, usage.Address)
+			result[i].Quota = &limit
+		}
+	}
+	return result, nil
+}
+
+// handleListMailboxes handles GET /api/mailboxes
+func (s *Server) handleListMailboxes(w http.ResponseWriter, r *http.Request) {
+	result, err := s.mailboxInfos()
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+	if mailboxes := requestIdentity(r).Mailboxes; mailboxes != nil {
+		visible := []MailboxInfo{}
+		for _, info := range result {
+			if seesAddress(mailboxes, info.Address) {
+				visible = append(visible, info)
+			}
+		}
+		result = visible
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"mailboxes": result,
+		"total":     len(result),
+	})
+}
+
+// handleGetStorageStats handles GET /api/stats/storage
+func (s *Server) handleGetStorageStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := s.storage.Stats()
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, stats)
+}
+
+// handleBackup handles POST /api/admin/backup
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	info, err := s.storage.Backup(s.config.Storage.BackupPath)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, info)
+}
+
+// handleGetMaintenance handles GET /api/admin/maintenance
+func (s *Server) handleGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	if s.maintenance == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "MAINTENANCE_UNAVAILABLE", "Maintenance is not configured")
+		return
+	}
+
+	s.sendSuccess(w, s.maintenance.Status())
+}
+
+// handleRunMaintenance handles POST /api/admin/maintenance
+func (s *Server) handleRunMaintenance(w http.ResponseWriter, r *http.Request) {
+	if s.maintenance == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "MAINTENANCE_UNAVAILABLE", "Maintenance is not configured")
+		return
+	}
+
+	result, err := s.maintenance.Run()
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+	s.audit(r, "maintenance.run", "", nil)
+
+	s.sendSuccess(w, result)
+}
+
+// handleRunRetention handles POST /api/admin/retention/run. With
+// dry_run=true it lists what would be deleted instead; dry runs work while
+// retention is disabled, to preview a policy before enabling it.
+func (s *Server) handleRunRetention(w http.ResponseWriter, r *http.Request) {
+	if s.retention == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "RETENTION_UNAVAILABLE", "Retention is not configured")
+		return
+	}
+
+	dryRun := parseBoolParam(r, "dry_run")
+	if !dryRun && !s.retention.Config().Enabled {
+		s.sendError(w, http.StatusConflict, "RETENTION_DISABLED", "Retention is disabled; enable it or use dry_run=true")
+		return
+	}
+
+	result, err := s.retention.Run(dryRun)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+	if !dryRun {
+		s.audit(r, "retention.run", "", map[string]interface{}{"deleted": result.Deleted})
+	}
+
+	s.sendSuccess(w, result)
+}
+
+// handleListWebhookDeliveries handles GET /api/webhooks/deliveries
+func (s *Server) handleListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !s.webhooks.Enabled() {
+		s.sendError(w, http.StatusServiceUnavailable, "WEBHOOKS_DISABLED", "Webhooks are not configured")
+		return
+	}
+
+	limit := parseIntParam(r, "limit", 50, 1, 1000)
+	deliveries := s.webhooks.Deliveries(r.URL.Query().Get("status"))
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"deliveries": deliveries,
+		"count":      len(deliveries),
 	})
 }
 
@@ -331,6 +1044,53 @@ func parseIntParam(r *http.Request, name string, defaultValue, min, max int) int
 	return parsed
 }
 
+// parseEmailFilter builds an email filter from the list query parameters
+func parseEmailFilter(r *http.Request) *storage.EmailFilter {
+	filter := &storage.EmailFilter{
+		From:    r.URL.Query().Get("from"),
+		To:      r.URL.Query().Get("to"),
+		Subject: r.URL.Query().Get("subject"),
+		Unread:  parseBoolParam(r, "unread"),
+
+		EnvelopeTo: r.URL.Query().Get("rcpt"),
+		ReplyTo:    r.URL.Query().Get("replyTo"),
+		Sender:     r.URL.Query().Get("sender"),
+		ReturnPath: r.URL.Query().Get("returnPath"),
+		Priority:   r.URL.Query().Get("priority"),
+		Tag:        r.URL.Query().Get("tag"),
+		Pinned:     parseBoolParam(r, "pinned"),
+		Spam:       parseBoolParam(r, "spam"),
+
+		MissingAlternative: r.URL.Query().Get("missingAlternative"),
+
+		// Users see only the mail of their mailboxes
+		Mailboxes: requestIdentity(r).Mailboxes,
+	}
+	if score, err := strconv.ParseFloat(r.URL.Query().Get("minSpamScore"), 64); err == nil {
+		filter.MinSpamScore = &score
+	}
+
+	// Parse date filters
+	if since := r.URL.Query().Get("since"); since != "" {
+		if t, err := time.Parse(time.RFC3339, since); err == nil {
+			filter.Since = &t
+		}
+	}
+	if until := r.URL.Query().Get("until"); until != "" {
+		if t, err := time.Parse(time.RFC3339, until); err == nil {
+			filter.Until = &t
+		}
+	}
+
+	return filter
+}
+
+// parseBoolParam parses a boolean query parameter, defaulting to false
+func parseBoolParam(r *http.Request, name string) bool {
+	parsed, err := strconv.ParseBool(r.URL.Query().Get(name))
+	return err == nil && parsed
+}
+
 // parseIDParam parses the ID parameter from the URL
 func parseIDParam(r *http.Request) int64 {
 	vars := mux.Vars(r)
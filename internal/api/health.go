@@ -0,0 +1,73 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// readinessTimeout bounds each readiness check
+const readinessTimeout = 2 * time.Second
+
+// readinessCheck is a dependency that must be up before traffic is routed
+// to this instance
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// AddReadinessCheck adds a check to /readyz, such as the SMTP listener.
+// Storage is always checked.
+func (s *Server) AddReadinessCheck(name string, check func(ctx context.Context) error) {
+	s.readiness = append(s.readiness, readinessCheck{name: name, check: check})
+}
+
+// handleLivez handles GET /livez. It only shows that the process serves
+// HTTP; dependencies are left to /readyz so a slow database does not get
+// the instance restarted.
+func (s *Server) handleLivez(w http.ResponseWriter, r *http.Request) {
+	s.sendSuccess(w, map[string]interface{}{
+		"status": "alive",
+	})
+}
+
+// handleReadyz handles GET /readyz, answering 503 while any check fails or
+// the server is shutting down
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := append([]readinessCheck{{name: "storage", check: s.storage.Ping}}, s.readiness...)
+
+	results := make(map[string]string, len(checks))
+	ready := true
+	if s.draining.Load() {
+		results["server"] = "shutting down"
+		ready = false
+	}
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		err := c.check(ctx)
+		cancel()
+		if err != nil {
+			results[c.name] = err.Error()
+			ready = false
+		} else {
+			results[c.name] = "ok"
+		}
+	}
+
+	if !ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(APIResponse{
+			Success: false,
+			Data:    map[string]interface{}{"status": "not ready", "checks": results},
+			Error:   &APIError{Code: "NOT_READY", Message: "One or more readiness checks failed"},
+		})
+		return
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"status": "ready",
+		"checks": results,
+	})
+}
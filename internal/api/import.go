@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"gowebmail/internal/email"
+	"gowebmail/internal/ingest"
+)
+
+// ImportResult is the outcome of importing one message
+type ImportResult struct {
+	Index   int    `json:"index"` // position in the upload, from 0
+	ID      int64  `json:"id,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// importer delivers the messages of one import request
+type importer struct {
+	server  *Server
+	rc      *http.ResponseController
+	results []ImportResult
+}
+
+// handleImportEmails handles POST /api/emails/import
+func (s *Server) handleImportEmails(w http.ResponseWriter, r *http.Request) {
+	if s.ingest == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "IMPORT_UNAVAILABLE", "Import is not configured")
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	imp := &importer{server: s, rc: http.NewResponseController(w)}
+
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		err = imp.importMultipart(r, format)
+	} else {
+		err = imp.importStream(r.Body, format)
+	}
+
+	if err != nil {
+		if len(imp.results) == 0 {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+		// Earlier messages are already stored, so report them with the error
+		imp.results = append(imp.results, ImportResult{Index: len(imp.results), Error: err.Error()})
+	}
+	if len(imp.results) == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "No messages found")
+		return
+	}
+
+	imported := 0
+	for _, result := range imp.results {
+		if result.Error == "" {
+			imported++
+		}
+	}
+
+	s.logger.Info().Int("imported", imported).Int("failed", len(imp.results)-imported).Msg("Emails imported")
+
+	s.sendSuccess(w, map[string]interface{}{
+		"results":  imp.results,
+		"imported": imported,
+		"failed":   len(imp.results) - imported,
+	})
+}
+
+// importMultipart imports every file uploaded in the "file" field
+func (imp *importer) importMultipart(r *http.Request, format string) error {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if part.FormName() != "file" {
+			continue
+		}
+		if err := imp.importStream(part, format); err != nil {
+			return fmt.Errorf("%s: %w", part.FileName(), err)
+		}
+	}
+}
+
+// importStream imports a single .eml message or an mbox file. Without an
+// explicit format, mbox files are recognised by their leading "From " line.
+func (imp *importer) importStream(r io.Reader, format string) error {
+	br := bufio.NewReader(r)
+	if format == "" {
+		format = "eml"
+		if prefix, _ := br.Peek(5); string(prefix) == "From " {
+			format = "mbox"
+		}
+	}
+
+	if format == "eml" {
+		raw, err := readMessage(br, imp.server.config.SMTP.MaxMessageSize)
+		if err == errMessageTooLarge {
+			imp.fail(err)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(raw)) > 0 {
+			imp.deliver(raw, &ingest.Envelope{Source: "import"})
+		}
+		return nil
+	}
+
+	mbox := email.NewMboxReader(br)
+	for {
+		imp.extendDeadlines()
+		msg, err := mbox.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if max := imp.server.config.SMTP.MaxMessageSize; max > 0 && int64(len(msg.Raw)) > max {
+			imp.fail(errMessageTooLarge)
+			continue
+		}
+		imp.deliver(msg.Raw, &ingest.Envelope{
+			Source:     "import",
+			From:       msg.Sender,
+			ReceivedAt: msg.Date,
+		})
+	}
+}
+
+// errMessageTooLarge is reported for messages over smtp.max_message_size
+var errMessageTooLarge = errors.New("message exceeds the maximum message size")
+
+// readMessage reads a whole message of at most max bytes; max <= 0 means
+// no limit
+func readMessage(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return io.ReadAll(r)
+	}
+	raw, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > max {
+		return nil, errMessageTooLarge
+	}
+	return raw, nil
+}
+
+// deliver runs a message through the ingest pipeline and records the result
+func (imp *importer) deliver(raw []byte, env *ingest.Envelope) {
+	stored, err := imp.server.ingest.Deliver(bytes.NewReader(raw), env)
+	if err != nil {
+		imp.fail(err)
+		return
+	}
+	imp.results = append(imp.results, ImportResult{
+		Index:   len(imp.results),
+		ID:      stored.ID,
+		Subject: stored.Subject,
+	})
+}
+
+func (imp *importer) fail(err error) {
+	imp.results = append(imp.results, ImportResult{Index: len(imp.results), Error: err.Error()})
+}
+
+// extendDeadlines keeps large uploads from hitting the server timeouts
+func (imp *importer) extendDeadlines() {
+	cfg := imp.server.config.HTTP
+	if cfg.ReadTimeout > 0 {
+		imp.rc.SetReadDeadline(time.Now().Add(cfg.ReadTimeout))
+	}
+	if cfg.WriteTimeout > 0 {
+		imp.rc.SetWriteDeadline(time.Now().Add(cfg.WriteTimeout))
+	}
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+
+	"gowebmail/internal/email"
+	"gowebmail/internal/ingest"
+)
+
+// snsMessage is an Amazon SNS HTTP(S) delivery. Signatures are not
+// verified, as gowebmail only stands in for the real endpoint in testing.
+type snsMessage struct {
+	Type         string `json:"Type"`
+	MessageID    string `json:"MessageId"`
+	TopicArn     string `json:"TopicArn"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+// sesNotification is an Amazon SES receipt notification, as published by
+// an SNS receipt rule action
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	Mail             struct {
+		Timestamp   time.Time `json:"timestamp"`
+		Source      string    `json:"source"`
+		Destination []string  `json:"destination"`
+	} `json:"mail"`
+	Receipt struct {
+		Recipients []string `json:"recipients"`
+		Action     struct {
+			Type     string `json:"type"`
+			Encoding string `json:"encoding"`
+		} `json:"action"`
+	} `json:"receipt"`
+	Content string `json:"content"`
+}
+
+// handleInboundSES handles POST /api/inbound/ses. It takes SNS deliveries
+// of SES receipt notifications, or the bare notification, and stores the
+// message they carry. Subscription confirmations are confirmed.
+func (s *Server) handleInboundSES(w http.ResponseWriter, r *http.Request) {
+	if s.ingest == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "INGEST_UNAVAILABLE", "Ingestion is not configured")
+		return
+	}
+
+	// Messages are base64 encoded and escaped as a JSON string
+	limit := int64(maxRequestBodySize)
+	if max := s.config.SMTP.MaxMessageSize; max > 0 {
+		limit += max * 2
+	}
+	body, err := readMessage(r.Body, limit)
+	if errors.Is(err, errMessageTooLarge) {
+		s.sendError(w, http.StatusRequestEntityTooLarge, "MESSAGE_TOO_LARGE", err.Error())
+		return
+	}
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Failed to read request body")
+		return
+	}
+
+	var msg snsMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		if err := s.confirmSNSSubscription(r, msg.SubscribeURL); err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+		s.logger.Info().Str("topic", msg.TopicArn).Msg("Confirmed SNS subscription")
+		s.sendSuccess(w, map[string]interface{}{"confirmed": true})
+		return
+	case "Notification":
+		body = []byte(msg.Message)
+	case "":
+		// A bare SES notification, e.g. forwarded by a Lambda function
+	default:
+		s.sendSuccess(w, map[string]interface{}{"ignored": msg.Type})
+		return
+	}
+
+	var notification sesNotification
+	if err := json.Unmarshal(body, &notification); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid SES notification")
+		return
+	}
+	if notification.NotificationType != "Received" {
+		s.sendSuccess(w, map[string]interface{}{"ignored": notification.NotificationType})
+		return
+	}
+
+	raw := []byte(notification.Content)
+	if len(raw) == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Notification has no content; only SNS receipt actions include the message")
+		return
+	}
+	if strings.EqualFold(notification.Receipt.Action.Encoding, "BASE64") {
+		if raw, err = base64.StdEncoding.DecodeString(notification.Content); err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Content is not valid base64")
+			return
+		}
+	}
+
+	rcpts := notification.Receipt.Recipients
+	if len(rcpts) == 0 {
+		rcpts = notification.Mail.Destination
+	}
+	s.deliverRaw(w, raw, &ingest.Envelope{
+		Source:     "ses",
+		From:       notification.Mail.Source,
+		To:         rcpts,
+		ReceivedAt: notification.Mail.Timestamp,
+	})
+}
+
+// confirmSNSSubscription visits the SubscribeURL of a subscription
+// confirmation. Only SNS endpoints are visited.
+func (s *Server) confirmSNSSubscription(r *http.Request, subscribeURL string) error {
+	u, err := url.Parse(subscribeURL)
+	if err != nil || u.Scheme != "https" || !strings.HasSuffix(u.Hostname(), ".amazonaws.com") {
+		return errors.New("SubscribeURL must be an https amazonaws.com URL")
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to confirm subscription: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to confirm subscription: %s", resp.Status)
+	}
+	return nil
+}
+
+// sendGridEnvelope is the envelope field of a SendGrid Inbound Parse post
+type sendGridEnvelope struct {
+	From string   `json:"from"`
+	To   []string `json:"to"`
+}
+
+// sendGridAttachmentInfo describes an uploaded attachment
+type sendGridAttachmentInfo struct {
+	Filename string `json:"filename"`
+	Type     string `json:"type"`
+}
+
+// handleInboundSendGrid handles POST /api/inbound/sendgrid, which takes
+// SendGrid Inbound Parse posts. With "POST the raw, full MIME message"
+// the message is stored as is; otherwise it is composed from the parsed
+// fields, keeping the Message-ID, Date and threading headers.
+func (s *Server) handleInboundSendGrid(w http.ResponseWriter, r *http.Request) {
+	if s.ingest == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "INGEST_UNAVAILABLE", "Ingestion is not configured")
+		return
+	}
+
+	if max := s.config.SMTP.MaxMessageSize; max > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, max*2+maxRequestBodySize)
+	}
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			s.sendError(w, http.StatusRequestEntityTooLarge, "MESSAGE_TOO_LARGE", errMessageTooLarge.Error())
+			return
+		}
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Expected a multipart/form-data body")
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	env := &ingest.Envelope{Source: "sendgrid"}
+	if field := r.FormValue("envelope"); field != "" {
+		var envelope sendGridEnvelope
+		if err := json.Unmarshal([]byte(field), &envelope); err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid envelope field")
+			return
+		}
+		env.From = envelope.From
+		env.To = envelope.To
+	}
+
+	raw := []byte(r.FormValue("email"))
+	if len(raw) == 0 {
+		var err error
+		if raw, err = composeSendGrid(r); err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+	}
+	if max := s.config.SMTP.MaxMessageSize; max > 0 && int64(len(raw)) > max {
+		s.sendError(w, http.StatusRequestEntityTooLarge, "MESSAGE_TOO_LARGE", errMessageTooLarge.Error())
+		return
+	}
+
+	s.deliverRaw(w, raw, env)
+}
+
+// sendGridHeaders are the original header fields kept when a message is
+// composed from parsed fields
+var sendGridHeaders = []string{"Message-Id", "Date", "In-Reply-To", "References", "Reply-To"}
+
+// composeSendGrid builds a message from the parsed fields of a SendGrid
+// Inbound Parse post
+func composeSendGrid(r *http.Request) ([]byte, error) {
+	draft := &email.Draft{
+		From:    r.FormValue("from"),
+		Subject: r.FormValue("subject"),
+		Text:    r.FormValue("text"),
+		HTML:    r.FormValue("html"),
+		Headers: make(map[string]string),
+	}
+	if draft.From == "" {
+		return nil, errors.New("the from or email field is required")
+	}
+	for _, field := range []struct {
+		name string
+		list *[]string
+	}{{"to", &draft.To}, {"cc", &draft.CC}} {
+		if value := r.FormValue(field.name); value != "" {
+			addrs, err := mail.ParseAddressList(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s field", field.name)
+			}
+			for _, addr := range addrs {
+				*field.list = append(*field.list, addr.String())
+			}
+		}
+	}
+
+	if value := r.FormValue("headers"); value != "" {
+		header, _ := textproto.NewReader(bufio.NewReader(strings.NewReader(value + "\r\n"))).ReadMIMEHeader()
+		for _, name := range sendGridHeaders {
+			if v := header.Get(name); v != "" {
+				draft.Headers[name] = v
+			}
+		}
+	}
+
+	var info map[string]sendGridAttachmentInfo
+	if value := r.FormValue("attachment-info"); value != "" {
+		json.Unmarshal([]byte(value), &info)
+	}
+	// Files are uploaded as attachment1, attachment2, ...
+	for i := 1; ; i++ {
+		name := fmt.Sprintf("attachment%d", i)
+		files := r.MultipartForm.File[name]
+		if len(files) == 0 {
+			break
+		}
+		file := files[0]
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		attachment := email.DraftAttachment{
+			Filename:    file.Filename,
+			ContentType: file.Header.Get("Content-Type"),
+			Content:     content,
+		}
+		if meta, ok := info[name]; ok {
+			if meta.Filename != "" {
+				attachment.Filename = meta.Filename
+			}
+			if meta.Type != "" {
+				attachment.ContentType = meta.Type
+			}
+		}
+		draft.Attachments = append(draft.Attachments, attachment)
+	}
+
+	return email.Compose(draft)
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"gowebmail/internal/ingest"
+	"gowebmail/internal/quota"
+)
+
+// maxIngestFieldSize bounds the envelope fields of a multipart ingest
+const maxIngestFieldSize = 64 << 10
+
+// handleIngestEmail handles POST /api/ingest. The body is the raw message
+// with the envelope in the query, or a multipart form with the message in
+// a "message" field or file next to from, to and receivedAt fields. The
+// message goes through the same pipeline as mail received over SMTP.
+func (s *Server) handleIngestEmail(w http.ResponseWriter, r *http.Request) {
+	if s.ingest == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "INGEST_UNAVAILABLE", "Ingestion is not configured")
+		return
+	}
+
+	var raw []byte
+	var env *ingest.Envelope
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		raw, env, err = s.readIngestForm(r)
+	} else {
+		query := r.URL.Query()
+		env, err = ingestEnvelope(query.Get("from"), query["to"], query.Get("receivedAt"))
+		if err == nil {
+			raw, err = readMessage(r.Body, s.config.SMTP.MaxMessageSize)
+		}
+	}
+	if errors.Is(err, errMessageTooLarge) {
+		s.sendError(w, http.StatusRequestEntityTooLarge, "MESSAGE_TOO_LARGE", err.Error())
+		return
+	}
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Message is empty")
+		return
+	}
+
+	s.deliverRaw(w, raw, env)
+}
+
+// deliverRaw runs a raw message through the ingest pipeline and replies
+// with the stored email
+func (s *Server) deliverRaw(w http.ResponseWriter, raw []byte, env *ingest.Envelope) {
+	stored, err := s.ingest.Deliver(bytes.NewReader(raw), env)
+	if err != nil {
+		switch {
+		case errors.Is(err, ingest.ErrInvalidMessage):
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		case errors.Is(err, quota.ErrQuotaExceeded):
+			s.sendError(w, http.StatusInsufficientStorage, "QUOTA_EXCEEDED", err.Error())
+		default:
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		}
+		return
+	}
+
+	s.sendSuccess(w, stored)
+}
+
+// readIngestForm reads the message and envelope of a multipart ingest
+func (s *Server) readIngestForm(r *http.Request) ([]byte, *ingest.Envelope, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var raw []byte
+	var from, receivedAt string
+	var to []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if part.FormName() == "message" {
+			if raw, err = readMessage(part, s.config.SMTP.MaxMessageSize); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxIngestFieldSize))
+		if err != nil {
+			return nil, nil, err
+		}
+		switch part.FormName() {
+		case "from":
+			from = string(value)
+		case "to":
+			to = append(to, string(value))
+		case "receivedAt":
+			receivedAt = string(value)
+		}
+	}
+
+	if raw == nil {
+		return nil, nil, errors.New("the message field is required")
+	}
+	env, err := ingestEnvelope(from, to, receivedAt)
+	return raw, env, err
+}
+
+// ingestEnvelope builds the envelope of an ingested message. Recipients
+// may be repeated or comma-separated; without any, the pipeline uses the
+// header recipients.
+func ingestEnvelope(from string, to []string, receivedAt string) (*ingest.Envelope, error) {
+	env := &ingest.Envelope{Source: "ingest"}
+
+	if from = strings.TrimSpace(from); from != "" {
+		addr, err := mail.ParseAddress(from)
+		if err != nil {
+			return nil, errors.New("from must be a valid address")
+		}
+		env.From = addr.Address
+	}
+
+	for _, list := range to {
+		for _, address := range strings.Split(list, ",") {
+			if address = strings.TrimSpace(address); address == "" {
+				continue
+			}
+			addr, err := mail.ParseAddress(address)
+			if err != nil {
+				return nil, fmt.Errorf("invalid recipient %s", address)
+			}
+			env.To = append(env.To, addr.Address)
+		}
+	}
+
+	if receivedAt != "" {
+		t, err := time.Parse(time.RFC3339, receivedAt)
+		if err != nil {
+			return nil, errors.New("receivedAt must be an RFC 3339 timestamp")
+		}
+		env.ReceivedAt = t
+	}
+
+	return env, nil
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"net/http"
+
+	"gowebmail/internal/email"
+	"gowebmail/internal/storage"
+)
+
+// handleLintEmail handles GET /api/emails/{id}/lint
+func (s *Server) handleLintEmail(w http.ResponseWriter, r *http.Request) {
+	id := parseIDParam(r)
+	if id == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid email ID")
+		return
+	}
+
+	emailData, err := s.storage.GetEmail(id)
+	if err == storage.ErrNotFound {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		return
+	} else if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	if emailData.BodyHTML == "" {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "No HTML body available")
+		return
+	}
+
+	warnings := email.Lint(emailData.BodyHTML)
+	counts := map[string]int{
+		email.SeverityError:   0,
+		email.SeverityWarning: 0,
+		email.SeverityInfo:    0,
+	}
+	for _, warning := range warnings {
+		counts[warning.Severity]++
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"id":       id,
+		"warnings": warnings,
+		"count":    len(warnings),
+		"counts":   counts,
+	})
+}
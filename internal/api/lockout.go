@@ -0,0 +1,162 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"gowebmail/internal/config"
+)
+
+// failures is the failed sign-in attempts of one IP address or username
+type failures struct {
+	count  int
+	last   time.Time
+	locked time.Time // attempts are refused until then
+}
+
+// lock is a key locked out by a failed attempt
+type lock struct {
+	key      string
+	failures int
+	duration time.Duration
+}
+
+// lockout counts failed sign-in attempts by IP address and by username,
+// and locks those with too many out for a time that doubles with every
+// further failure. It is kept in memory.
+type lockout struct {
+	mu   sync.Mutex
+	keys map[string]*failures
+}
+
+func newLockout() *lockout {
+	return &lockout{keys: make(map[string]*failures)}
+}
+
+// lockedFor returns how much longer the longest locked of keys stays
+// locked, or 0
+func (l *lockout) lockedFor(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var longest time.Duration
+	now := time.Now()
+	for _, key := range keys {
+		if f, ok := l.keys[key]; ok {
+			longest = max(longest, f.locked.Sub(now))
+		}
+	}
+	return longest
+}
+
+// fail records a failed attempt for each of keys, and returns the keys
+// it locked
+func (l *lockout) fail(cfg *config.LockoutConfig, keys ...string) []lock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.forget(cfg, now)
+
+	var locked []lock
+	for _, key := range keys {
+		f, ok := l.keys[key]
+		if !ok {
+			f = &failures{}
+			l.keys[key] = f
+		}
+		f.count++
+		f.last = now
+		if f.count < cfg.MaxFailures {
+			continue
+		}
+
+		d := lockoutDelay(cfg, f.count-cfg.MaxFailures)
+		f.locked = now.Add(d)
+		locked = append(locked, lock{key: key, failures: f.count, duration: d})
+	}
+	return locked
+}
+
+// lockoutDelay returns the lock after the nth failure past the limit:
+// the delay, doubled n times, up to the maximum
+func lockoutDelay(cfg *config.LockoutConfig, n int) time.Duration {
+	d := cfg.Delay
+	for ; n > 0 && d < cfg.MaxDelay; n-- {
+		d *= 2
+	}
+	return min(d, cfg.MaxDelay)
+}
+
+// succeed forgets the failures of keys
+func (l *lockout) succeed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.keys, key)
+	}
+}
+
+// forget drops the keys no longer locked and without a failure within the
+// window, so the map does not grow without bound
+func (l *lockout) forget(cfg *config.LockoutConfig, now time.Time) {
+	for key, f := range l.keys {
+		if now.After(f.locked) && now.Sub(f.last) > cfg.Window {
+			delete(l.keys, key)
+		}
+	}
+}
+
+// lockoutKeys returns the keys the attempts of r count against: its IP
+// address and, when one is given, the username
+func lockoutKeys(r *http.Request, username string) []string {
+	keys := []string{"ip " + remoteIP(r)}
+	if username != "" {
+		keys = append(keys, "user "+username)
+	}
+	return keys
+}
+
+// lockedOut refuses r when its IP address or username is locked out, and
+// reports whether it did. Credentials are not checked while locked, so
+// guessing stays slow.
+func (s *Server) lockedOut(w http.ResponseWriter, r *http.Request, username string) bool {
+	if !s.auth.Load().Lockout.Enabled {
+		return false
+	}
+	d := s.lockout.lockedFor(lockoutKeys(r, username)...)
+	if d <= 0 {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+	s.sendError(w, http.StatusTooManyRequests, "TOO_MANY_ATTEMPTS", "Too many failed sign-in attempts; try again later")
+	return true
+}
+
+// authFailed records a failed attempt with credentials of kind method,
+// and locks out the IP address and username once they reach the limit
+func (s *Server) authFailed(r *http.Request, method, username string) {
+	s.logger.Warn().Str("auth", method).Str("username", username).Str("remote", remoteIP(r)).Msg("Authentication failed")
+
+	cfg := s.auth.Load().Lockout
+	if !cfg.Enabled {
+		return
+	}
+	r = withIdentity(r, identity{Name: username, Auth: method})
+	s.audit(r, "auth.failed", remoteIP(r), nil)
+
+	for _, l := range s.lockout.fail(&cfg, lockoutKeys(r, username)...) {
+		s.audit(r, "auth.locked", l.key, map[string]interface{}{
+			"failures": l.failures,
+			"seconds":  int(l.duration.Seconds()),
+		})
+	}
+}
+
+// authSucceeded forgets the failed attempts for a username that signed in
+func (s *Server) authSucceeded(username string) {
+	if username != "" {
+		s.lockout.succeed("user " + username)
+	}
+}
@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+
+	"gowebmail/internal/email"
+	"gowebmail/internal/storage"
+)
+
+// AttachedMessage is an email attached to another, as returned by
+// GET /api/emails/{id}/attachments/{aid}/message
+type AttachedMessage struct {
+	storage.MessageInfo
+	BodyPlain string              `json:"bodyPlain"`
+	BodyHTML  string              `json:"bodyHTML"`
+	Headers   map[string][]string `json:"headers"`
+	Size      int64               `json:"size"`
+}
+
+// handleGetAttachedMessage handles
+// GET /api/emails/{id}/attachments/{aid}/message, which parses an
+// attached email, such as one forwarded as an attachment
+func (s *Server) handleGetAttachedMessage(w http.ResponseWriter, r *http.Request) {
+	attachment := s.loadAttachment(w, r)
+	if attachment == nil {
+		return
+	}
+	if attachment.Message == nil {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Attachment is not an email")
+		return
+	}
+
+	parser := email.NewParser()
+	nested, err := parser.ParseMessage(attachment)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return
+	}
+	defer parser.Release(nested)
+
+	// The summary stored with the attachment lists nested attachments
+	// with the emails they hold in turn
+	message := &AttachedMessage{
+		MessageInfo: *attachment.Message,
+		BodyPlain:   nested.BodyPlain,
+		BodyHTML:    nested.BodyHTML,
+		Headers:     nested.Headers,
+		Size:        nested.Size,
+	}
+	s.sendSuccess(w, message)
+}
@@ -1,9 +1,15 @@
 package api
 
 import (
+	"bufio"
 	"crypto/subtle"
+	"fmt"
+	"net"
 	"net/http"
+	"strings"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
 // responseWriter wraps http.ResponseWriter to capture status code
@@ -17,6 +23,21 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades take over the connection
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	rw.statusCode = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
 // loggingMiddleware logs HTTP requests
 func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -41,8 +62,9 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 func (s *Server) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-CSRF-Token, If-None-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -71,32 +93,115 @@ func (s *Server) recoveryMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// authMiddleware provides basic authentication
+// authMiddleware authenticates requests with a client certificate, then
+// an API key, sent as a bearer token or X-API-Key header, and then with
+// OIDC, or a web UI session or basic authentication, as the shared
+// credentials or one of the configured users
 func (s *Server) authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Skip auth for health check and WebSocket
-		if r.URL.Path == "/api/health" || r.URL.Path == "/ws" {
+		// OIDC and client certificates imply auth
+		auth := s.auth.Load()
+		if !auth.Enabled && s.oidc == nil && !s.config.ClientCertificates() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Skip auth for health checks, WebSocket and the login flow. The
+		// debug endpoints check their own key when one is configured. With
+		// users, WebSocket clients authenticate to get the events of their
+		// mailboxes.
+		if r.URL.Path == "/api/health" || r.URL.Path == "/livez" || r.URL.Path == "/readyz" || (r.URL.Path == "/ws" && len(auth.Users) == 0) || (s.oidc != nil && strings.HasPrefix(r.URL.Path, "/auth/")) ||
+			(s.config.Debug.APIKey != "" && strings.HasPrefix(r.URL.Path, "/debug/")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The web UI signs in with a password on its own login form, so its
+		// files are public; the mail it shows is not
+		if s.passwordLogin() && (r.URL.Path == "/api/login" || r.URL.Path == "/api/logout" ||
+			(mux.CurrentRoute(r) == s.static && !strings.HasPrefix(r.URL.Path, "/api/"))) {
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		if cert := clientCertificate(r); cert != nil {
+			s.certAuthenticate(w, r, next, cert)
+			return
+		}
+		if !auth.Enabled && s.oidc == nil {
+			s.sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Client certificate required")
+			return
+		}
+
+		if key := requestAPIKey(r); key != "" && (s.oidc == nil || key != bearerToken(r)) {
+			if s.lockedOut(w, r, "") {
+				return
+			}
+			name, scope, ok, err := s.lookupAPIKey(key)
+			if err != nil {
+				s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+				return
+			}
+			if !ok {
+				s.authFailed(r, authAPIKey, "")
+				s.sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid API key")
+				return
+			}
+			if !scopeAllows(scope, r) {
+				s.sendError(w, http.StatusForbidden, "FORBIDDEN", "API key is read-only")
+				return
+			}
+			next.ServeHTTP(w, withIdentity(r, identity{Name: name, Auth: authAPIKey}))
+			return
+		}
+
+		if s.oidc != nil {
+			s.oidcAuthenticate(w, r, next)
+			return
+		}
+
+		if s.sessionAuthenticate(w, r, next, auth) {
+			return
+		}
+
 		username, password, ok := r.BasicAuth()
 		if !ok {
-			w.Header().Set("WWW-Authenticate", `Basic realm="GoWebMail"`)
+			basicChallenge(w, r)
 			s.sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Authentication required")
 			return
 		}
 
+		if s.lockedOut(w, r, username) {
+			return
+		}
+
+		if user := checkUser(auth, username, password); user != nil {
+			s.authSucceeded(username)
+			s.serveUser(w, r, next, userIdentity(user, authBasic))
+			return
+		}
+
 		// Constant time comparison to prevent timing attacks
-		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(s.config.Web.Auth.Username)) == 1
-		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(s.config.Web.Auth.Password)) == 1
+		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1
+		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) == 1
 
 		if !usernameMatch || !passwordMatch {
-			w.Header().Set("WWW-Authenticate", `Basic realm="GoWebMail"`)
+			s.authFailed(r, authBasic, username)
+			basicChallenge(w, r)
 			s.sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid credentials")
 			return
 		}
+		s.authSucceeded(username)
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(w, withIdentity(r, identity{Name: username, Auth: authBasic}))
 	})
 }
+
+// basicChallenge asks for basic authentication, except of the web UI,
+// which shows its login form rather than the browser's popup
+func basicChallenge(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="GoWebMail"`)
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+
+	"gowebmail/internal/storage"
+)
+
+// maxNoteLength is the longest note body, in characters
+const maxNoteLength = 10000
+
+// NoteRequest is the body of POST /api/emails/{id}/notes and
+// PUT /api/emails/{id}/notes/{nid}
+type NoteRequest struct {
+	Body   string `json:"body"`
+	Author string `json:"author,omitempty"`
+}
+
+// handleListNotes handles GET /api/emails/{id}/notes
+func (s *Server) handleListNotes(w http.ResponseWriter, r *http.Request) {
+	notes, err := s.storage.ListNotes(parseIDParam(r))
+	if err != nil {
+		s.sendNoteError(w, err)
+		return
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"notes": notes,
+		"count": len(notes),
+	})
+}
+
+// handleCreateNote handles POST /api/emails/{id}/notes. Without an author,
+// the basic auth user name is used.
+func (s *Server) handleCreateNote(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.decodeNote(w, r)
+	if !ok {
+		return
+	}
+	if note.Author == "" {
+		if user, _, ok := r.BasicAuth(); ok {
+			note.Author = user
+		}
+	}
+
+	if err := s.storage.CreateNote(note); err != nil {
+		s.sendNoteError(w, err)
+		return
+	}
+
+	s.publish(&WebSocketMessage{
+		Type: "note.created",
+		Data: map[string]interface{}{"emailId": note.EmailID, "note": note},
+	})
+	s.sendSuccess(w, note)
+}
+
+// handleUpdateNote handles PUT /api/emails/{id}/notes/{nid}. The author is
+// kept unless the request names one.
+func (s *Server) handleUpdateNote(w http.ResponseWriter, r *http.Request) {
+	note, ok := s.decodeNote(w, r)
+	if !ok {
+		return
+	}
+	note.ID = parseNoteIDParam(r)
+
+	if err := s.storage.UpdateNote(note); err != nil {
+		s.sendNoteError(w, err)
+		return
+	}
+
+	s.publish(&WebSocketMessage{
+		Type: "note.updated",
+		Data: map[string]interface{}{"emailId": note.EmailID, "note": note},
+	})
+	s.sendSuccess(w, note)
+}
+
+// handleDeleteNote handles DELETE /api/emails/{id}/notes/{nid}
+func (s *Server) handleDeleteNote(w http.ResponseWriter, r *http.Request) {
+	emailID, id := parseIDParam(r), parseNoteIDParam(r)
+	if err := s.storage.DeleteNote(emailID, id); err != nil {
+		s.sendNoteError(w, err)
+		return
+	}
+	s.audit(r, "note.delete", strconv.FormatInt(id, 10), map[string]interface{}{"emailId": emailID})
+
+	s.publish(&WebSocketMessage{
+		Type: "note.deleted",
+		Data: map[string]interface{}{"emailId": emailID, "id": id},
+	})
+	s.sendSuccess(w, map[string]interface{}{
+		"message": "Note deleted",
+	})
+}
+
+// decodeNote reads a note from the request body
+func (s *Server) decodeNote(w http.ResponseWriter, r *http.Request) (*storage.Note, bool) {
+	var req NoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return nil, false
+	}
+
+	req.Body = strings.TrimSpace(req.Body)
+	if req.Body == "" {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "body must not be empty")
+		return nil, false
+	}
+	if utf8.RuneCountInString(req.Body) > maxNoteLength {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "body must be at most "+strconv.Itoa(maxNoteLength)+" characters")
+		return nil, false
+	}
+
+	return &storage.Note{
+		EmailID: parseIDParam(r),
+		Author:  strings.TrimSpace(req.Author),
+		Body:    req.Body,
+	}, true
+}
+
+func (s *Server) sendNoteError(w http.ResponseWriter, err error) {
+	if err == storage.ErrNotFound {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email or note not found")
+		return
+	}
+	s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+}
+
+func parseNoteIDParam(r *http.Request) int64 {
+	id, err := strconv.ParseInt(mux.Vars(r)["nid"], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return id
+}
@@ -0,0 +1,171 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gowebmail/internal/oidc"
+)
+
+const (
+	// sessionCookie holds the ID token of a user signed in through the UI
+	sessionCookie = "gowebmail_session"
+	// loginCookie holds the state, nonce and PKCE verifier of a login in
+	// progress, and the page to return to
+	loginCookie  = "gowebmail_login"
+	loginTimeout = 10 * time.Minute
+)
+
+// oidcAuthenticate authenticates r with a JWT, sent as a bearer token or in
+// the session cookie set by the login flow. Unauthenticated page loads are
+// sent to the identity provider when the login flow is configured.
+func (s *Server) oidcAuthenticate(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	token, fromCookie := bearerToken(r), false
+	if token == "" {
+		if cookie, err := r.Cookie(sessionCookie); err == nil {
+			token, fromCookie = cookie.Value, true
+		}
+	}
+
+	if token != "" {
+		claims, err := s.oidc.Verify(r.Context(), token)
+		if err == nil {
+			name := claims.Email
+			if name == "" {
+				name = claims.Subject
+			}
+			if user := findUser(s.auth.Load(), name); user != nil {
+				s.serveUser(w, r, next, userIdentity(user, authOIDC))
+				return
+			}
+			next.ServeHTTP(w, withIdentity(r, identity{Name: name, Auth: authOIDC}))
+			return
+		}
+		if !errors.Is(err, oidc.ErrInvalidToken) {
+			s.logger.Error().Err(err).Msg("Failed to validate token")
+			s.sendError(w, http.StatusBadGateway, "OIDC_ERROR", "Could not reach the identity provider")
+			return
+		}
+		s.logger.Debug().Err(err).Msg("Token rejected")
+		if fromCookie {
+			s.setCookie(w, sessionCookie, "", "/", -1)
+		}
+	}
+
+	if s.oidc.LoginEnabled() && r.Method == http.MethodGet && !strings.HasPrefix(r.URL.Path, "/api/") {
+		http.Redirect(w, r, "/auth/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Bearer realm="GoWebMail"`)
+	s.sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Authentication required")
+}
+
+// handleLogin handles GET /auth/login by redirecting to the identity provider
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	var values [3]string
+	for i := range values {
+		v, err := oidc.RandomString()
+		if err != nil {
+			s.sendError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+			return
+		}
+		values[i] = v
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	target, err := s.oidc.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to start OIDC login")
+		s.sendError(w, http.StatusBadGateway, "OIDC_ERROR", err.Error())
+		return
+	}
+
+	next := base64.RawURLEncoding.EncodeToString([]byte(localPath(r.URL.Query().Get("next"))))
+	s.setCookie(w, loginCookie, strings.Join([]string{state, nonce, verifier, next}, "."), "/auth/", int(loginTimeout.Seconds()))
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleLoginCallback handles GET /auth/callback, where the identity
+// provider sends the browser back with an authorization code
+func (s *Server) handleLoginCallback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		s.sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Login failed: "+e+" "+query.Get("error_description"))
+		return
+	}
+
+	cookie, err := r.Cookie(loginCookie)
+	parts := []string{}
+	if err == nil {
+		parts = strings.Split(cookie.Value, ".")
+	}
+	if len(parts) != 4 || subtle.ConstantTimeCompare([]byte(parts[0]), []byte(query.Get("state"))) != 1 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Login state mismatch; start again at /auth/login")
+		return
+	}
+	s.setCookie(w, loginCookie, "", "/auth/", -1)
+
+	token, claims, err := s.oidc.Exchange(r.Context(), query.Get("code"), parts[2], parts[1])
+	if err != nil {
+		s.logger.Warn().Err(err).Msg("OIDC login failed")
+		s.sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Login failed")
+		return
+	}
+
+	s.setCookie(w, sessionCookie, token, "/", int(time.Until(claims.ExpiresAt()).Seconds()))
+	s.logger.Info().Str("subject", claims.Subject).Str("email", claims.Email).Msg("User signed in")
+
+	next, _ := base64.RawURLEncoding.DecodeString(parts[3])
+	http.Redirect(w, r, localPath(string(next)), http.StatusFound)
+}
+
+// handleLogout handles GET /auth/logout by clearing the session cookie. The
+// session at the identity provider is left alone.
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	s.setCookie(w, sessionCookie, "", "/", -1)
+	s.sendSuccess(w, map[string]interface{}{"message": "Signed out"})
+}
+
+// setCookie sets an HttpOnly cookie; maxAge < 0 deletes it. SameSite=Lax
+// keeps the session cookie off cross-site form posts, and cookies are
+// Secure when the UI is served over HTTPS.
+func (s *Server) setCookie(w http.ResponseWriter, name, value, path string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   s.config.HTTP.TLS.Enabled || strings.HasPrefix(s.config.Web.Auth.OIDC.RedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// bearerToken returns a JWT sent as a bearer token. Other bearer tokens are
+// API keys.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(auth[7:])
+	if strings.Count(token, ".") != 2 {
+		return ""
+	}
+	return token
+}
+
+// localPath returns p if it is a path on this server, so logins cannot be
+// used to redirect to other sites
+func localPath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") || strings.HasPrefix(p, "/\\") {
+		return "/"
+	}
+	return p
+}
@@ -0,0 +1,1569 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// schema is a JSON Schema fragment as used by OpenAPI 3.1
+type schema map[string]interface{}
+
+// parameter describes a path or query parameter of an operation
+type parameter struct {
+	Name        string
+	In          string // path or query
+	Description string
+	Required    bool
+	Schema      schema
+}
+
+// operation describes one API endpoint. The operations table drives both
+// the served OpenAPI document and request validation, so every route
+// registered in setupRoutes should have an entry here.
+type operation struct {
+	Method   string
+	Path     string // relative to /api, e.g. /emails/{id}
+	ID       string
+	Summary  string
+	Tag      string
+	Params   []parameter
+	Body     schema
+	Produces string // content type of the success response; JSON when empty
+	Result   schema // data of the JSON success response
+
+	// MessageBody is set when the body carries a whole message, so it may
+	// be as large as smtp.max_message_size
+	MessageBody bool
+}
+
+func ref(name string) schema {
+	return schema{"$ref": "#/components/schemas/" + name}
+}
+
+func arrayOf(items schema) schema {
+	return schema{"type": "array", "items": items}
+}
+
+var (
+	stringSchema   = schema{"type": "string"}
+	integerSchema  = schema{"type": "integer"}
+	numberSchema   = schema{"type": "number"}
+	booleanSchema  = schema{"type": "boolean"}
+	dateTimeSchema = schema{"type": "string", "format": "date-time"}
+	objectSchema   = schema{"type": "object"}
+)
+
+// authResultSchema is a DKIM, SPF or DMARC result (RFC 8601)
+var authResultSchema = schema{
+	"type": "string",
+	"enum": []string{"pass", "fail", "softfail", "neutral", "none", "temperror", "permerror"},
+}
+
+// idParam is the email ID path parameter
+var idParam = parameter{Name: "id", In: "path", Required: true, Description: "Email ID", Schema: integerSchema}
+
+// messageIDParam is the Message-ID path parameter, with or without angle
+// brackets
+var messageIDParam = parameter{Name: "messageId", In: "path", Required: true, Description: "Message-ID, URL-encoded, with or without angle brackets", Schema: stringSchema}
+
+// paginationParams are accepted by paginated list endpoints
+var paginationParams = []parameter{
+	{Name: "limit", In: "query", Description: "Number of results, capped at 100", Schema: schema{"type": "integer", "minimum": 1, "default": 50}},
+	{Name: "offset", In: "query", Description: "Number of results to skip", Schema: schema{"type": "integer", "minimum": 0, "default": 0}},
+}
+
+// filterParams are the email filters understood by parseEmailFilter
+var filterParams = []parameter{
+	{Name: "from", In: "query", Description: "Sender address, or a part of it", Schema: stringSchema},
+	{Name: "to", In: "query", Description: "To recipient address, or a part of it", Schema: stringSchema},
+	{Name: "subject", In: "query", Description: "Subject contains", Schema: stringSchema},
+	{Name: "rcpt", In: "query", Description: "Envelope recipient address, including BCC, or a part of it", Schema: stringSchema},
+	{Name: "replyTo", In: "query", Description: "Reply-To address, or a part of it", Schema: stringSchema},
+	{Name: "sender", In: "query", Description: "Sender header address, or a part of it", Schema: stringSchema},
+	{Name: "returnPath", In: "query", Description: "Return path (MAIL FROM) address, or a part of it", Schema: stringSchema},
+	{Name: "priority", In: "query", Description: "Flagged with this priority by the X-Priority, Importance, X-MSMail-Priority or Priority header", Schema: schema{"type": "string", "enum": []string{"high", "normal", "low"}}},
+	{Name: "tag", In: "query", Description: "Has this tag", Schema: stringSchema},
+	{Name: "pinned", In: "query", Description: "Only pinned emails", Schema: booleanSchema},
+	{Name: "unread", In: "query", Description: "Only unread emails", Schema: booleanSchema},
+	{Name: "since", In: "query", Description: "Received at or after (RFC 3339)", Schema: dateTimeSchema},
+	{Name: "until", In: "query", Description: "Received at or before (RFC 3339)", Schema: dateTimeSchema},
+	{Name: "spam", In: "query", Description: "Only emails the spam filter classified as spam", Schema: booleanSchema},
+	{Name: "minSpamScore", In: "query", Description: "Spam score at least", Schema: numberSchema},
+	{Name: "missingAlternative", In: "query", Description: "Only emails without a plain-text (plain) or HTML (html) body that have the other", Schema: schema{"type": "string", "enum": []string{"plain", "html"}}},
+}
+
+// searchIDParam is the saved search ID path parameter
+var searchIDParam = parameter{Name: "id", In: "path", Required: true, Description: "Saved search ID", Schema: integerSchema}
+
+// pushIDParam is the push subscription ID path parameter
+var pushIDParam = parameter{Name: "id", In: "path", Required: true, Description: "Push subscription ID", Schema: integerSchema}
+
+// noteIDParam is the note ID path parameter
+var noteIDParam = parameter{Name: "nid", In: "path", Required: true, Description: "Note ID", Schema: integerSchema}
+
+// noteBody is the body of the note create and update operations
+var noteBody = schema{
+	"type":     "object",
+	"required": []string{"body"},
+	"properties": schema{
+		"body":   stringSchema,
+		"author": stringSchema,
+	},
+	"additionalProperties": false,
+}
+
+// savedSearchBody is the body of the saved search create and update
+// operations
+var savedSearchBody = schema{
+	"type":     "object",
+	"required": []string{"name"},
+	"properties": schema{
+		"name":    stringSchema,
+		"query":   stringSchema,
+		"from":    stringSchema,
+		"to":      stringSchema,
+		"subject": stringSchema,
+		"rcpt":    stringSchema,
+		"tag":     stringSchema,
+		"unread":  booleanSchema,
+		"pinned":  booleanSchema,
+	},
+	"additionalProperties": false,
+}
+
+func params(groups ...[]parameter) []parameter {
+	var all []parameter
+	for _, group := range groups {
+		all = append(all, group...)
+	}
+	return all
+}
+
+// operations lists every API endpoint
+var operations = []operation{
+	{
+		Method: "GET", Path: "/emails", ID: "listEmails", Tag: "emails",
+		Summary: "List emails, newest first",
+		Params: params(paginationParams, filterParams, []parameter{
+			{Name: "cursor", In: "query", Description: "nextCursor from a previous page; takes precedence over offset", Schema: stringSchema},
+			{Name: "fields", In: "query", Description: "summary leaves out bodies and headers; full returns whole emails", Schema: schema{"type": "string", "enum": []string{"summary", "full"}, "default": "summary"}},
+		}),
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"emails":     arrayOf(schema{"oneOf": []schema{ref("EmailSummary"), ref("Email")}}),
+				"total":      integerSchema,
+				"limit":      integerSchema,
+				"offset":     integerSchema,
+				"nextCursor": stringSchema,
+			},
+		},
+	},
+	{
+		Method: "GET", Path: "/emails/{id}", ID: "getEmail", Tag: "emails",
+		Summary: "Get an email",
+		Params:  []parameter{idParam},
+		Result:  ref("Email"),
+	},
+	{
+		Method: "GET", Path: "/emails/by-message-id/{messageId}", ID: "getEmailByMessageID", Tag: "emails",
+		Summary: "Get the most recent email with a Message-ID",
+		Params:  []parameter{messageIDParam},
+		Result:  ref("Email"),
+	},
+	{
+		Method: "HEAD", Path: "/emails/by-message-id/{messageId}", ID: "headEmailByMessageID", Tag: "emails",
+		Summary: "Check whether an email with a Message-ID was captured",
+		Params:  []parameter{messageIDParam},
+	},
+	{
+		Method: "PATCH", Path: "/emails/{id}", ID: "updateEmail", Tag: "emails",
+		Summary: "Update mutable email fields (JSON merge patch)",
+		Params:  []parameter{idParam},
+		Body: schema{
+			"type": "object",
+			"properties": schema{
+				"read":   schema{"type": []string{"boolean", "null"}},
+				"pinned": schema{"type": []string{"boolean", "null"}},
+				"tags":   schema{"type": []string{"array", "null"}, "items": stringSchema},
+			},
+			"additionalProperties": false,
+		},
+		Result: ref("Email"),
+	},
+	{
+		Method: "DELETE", Path: "/emails/{id}", ID: "deleteEmail", Tag: "emails",
+		Summary: "Delete an email",
+		Params:  []parameter{idParam},
+		Result:  objectSchema,
+	},
+	{
+		Method: "DELETE", Path: "/emails", ID: "deleteAllEmails", Tag: "emails",
+		Summary: "Delete all emails",
+		Result:  objectSchema,
+	},
+	{
+		Method: "GET", Path: "/emails/search", ID: "searchEmails", Tag: "emails",
+		Summary: "Full-text search; the search parameters that are set must all match, and at least one is required",
+		Params: params([]parameter{
+			{Name: "q", In: "query", Description: "Words, \"exact phrases\", prefix*, OR, -excluded or NOT excluded, (groups), and subject:, from:, to: or body: terms", Schema: stringSchema},
+			{Name: "subject_q", In: "query", Description: "Searched in the subject alone, with the syntax of q", Schema: stringSchema},
+			{Name: "body_q", In: "query", Description: "Searched in the plain-text body alone, with the syntax of q", Schema: stringSchema},
+			{Name: "header", In: "query", Description: "Name of a header the emails must have", Schema: stringSchema},
+			{Name: "header_value", In: "query", Description: "Text a value of header must contain, ignoring case", Schema: stringSchema},
+		}, paginationParams, filterParams),
+		Result: ref("EmailList"),
+	},
+	{
+		Method: "GET", Path: "/emails/export", ID: "exportEmails", Tag: "emails",
+		Summary: "Stream matching emails as an mbox file, a zip of .eml files or JSON lines",
+		Params: params([]parameter{
+			{Name: "format", In: "query", Schema: schema{"type": "string", "enum": []string{"mbox", "eml-zip", "jsonl"}, "default": "mbox"}},
+		}, filterParams),
+		Produces: "application/mbox",
+	},
+	{
+		Method: "POST", Path: "/emails/import", ID: "importEmails", Tag: "emails",
+		Summary: "Import an .eml message or mbox file, sent as the request body or as multipart \"file\" uploads",
+		Params: []parameter{
+			{Name: "format", In: "query", Description: "Detected from the content when omitted", Schema: schema{"type": "string", "enum": []string{"eml", "mbox"}}},
+		},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"results": arrayOf(schema{
+					"type": "object",
+					"properties": schema{
+						"index":   integerSchema,
+						"id":      integerSchema,
+						"subject": stringSchema,
+						"error":   stringSchema,
+					},
+				}),
+				"imported": integerSchema,
+				"failed":   integerSchema,
+			},
+		},
+	},
+	{
+		Method: "POST", Path: "/emails/batch", ID: "batchEmails", Tag: "emails",
+		Summary: "Apply an action to many emails",
+		Body: schema{
+			"type":     "object",
+			"required": []string{"ids", "action"},
+			"properties": schema{
+				"ids": schema{"type": "array", "items": integerSchema, "minItems": 1, "maxItems": maxBatchIDs},
+				"action": schema{"type": "string", "enum": []string{
+					storage.BatchDelete, storage.BatchMarkRead, storage.BatchMarkUnread,
+					storage.BatchTag, storage.BatchUntag, BatchActionRelease,
+				}},
+				"tags": arrayOf(stringSchema),
+				"to":   arrayOf(stringSchema),
+			},
+			"additionalProperties": false,
+		},
+		Result: objectSchema,
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/raw", ID: "getEmailRaw", Tag: "emails",
+		Summary:  "Get the raw RFC 822 message",
+		Params:   []parameter{idParam},
+		Produces: "text/plain",
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/download", ID: "downloadEmail", Tag: "emails",
+		Summary:  "Download the original message as an .eml file",
+		Params:   []parameter{idParam},
+		Produces: "message/rfc822",
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/html", ID: "getEmailHTML", Tag: "emails",
+		Summary:  "Get the sanitized HTML body",
+		Params:   []parameter{idParam},
+		Produces: "text/html",
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/screenshot", ID: "getEmailScreenshot", Tag: "emails",
+		Summary: "Render the sanitized HTML body to a PNG with headless Chrome",
+		Params: []parameter{idParam,
+			{Name: "width", In: "query", Description: "Viewport width in pixels, 100-4000", Schema: schema{"type": "integer", "minimum": 100, "default": 600}},
+			{Name: "height", In: "query", Description: "Viewport height in pixels, 100-10000", Schema: schema{"type": "integer", "minimum": 100, "default": 800}},
+		},
+		Produces: "image/png",
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/lint", ID: "lintEmail", Tag: "emails",
+		Summary: "Check the HTML body against known email client limitations",
+		Params:  []parameter{idParam},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"id":       integerSchema,
+				"warnings": arrayOf(ref("LintWarning")),
+				"count":    integerSchema,
+				"counts":   schema{"type": "object", "additionalProperties": integerSchema},
+			},
+		},
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/amp", ID: "getEmailAMP", Tag: "emails",
+		Summary: "Get the AMP for Email (text/x-amp-html) body, validated against the AMP4Email rules",
+		Params:  []parameter{idParam},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"id":       integerSchema,
+				"html":     stringSchema,
+				"valid":    booleanSchema,
+				"warnings": arrayOf(ref("LintWarning")),
+				"count":    integerSchema,
+				"counts":   schema{"type": "object", "additionalProperties": integerSchema},
+			},
+		},
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/calendar", ID: "getEmailCalendar", Tag: "emails",
+		Summary: "Get the events of the email's iCalendar part, such as a meeting invitation",
+		Params:  []parameter{idParam},
+		Result:  ref("Calendar"),
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/received", ID: "getEmailReceived", Tag: "emails",
+		Summary: "Get the relays the email passed through, parsed from its Received headers, with the delay at each",
+		Params:  []parameter{idParam},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"hops":           arrayOf(ref("ReceivedHop")),
+				"totalDelayMs":   integerSchema,
+				"arrivalDelayMs": integerSchema,
+			},
+		},
+	},
+	{
+		Method: "POST", Path: "/emails/{id}/checklinks", ID: "checkEmailLinks", Tag: "emails",
+		Summary: "Fetch every link of an email and record status codes and redirect chains",
+		Params:  []parameter{idParam},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"id":        integerSchema,
+				"links":     arrayOf(ref("CheckedLink")),
+				"count":     integerSchema,
+				"counts":    schema{"type": "object", "additionalProperties": integerSchema},
+				"skipped":   integerSchema,
+				"checkedAt": dateTimeSchema,
+			},
+		},
+	},
+	{
+		Method: "POST", Path: "/emails/{id}/unsubscribe-test", ID: "testEmailUnsubscribe", Tag: "emails",
+		Summary: "Unsubscribe as a mailbox provider would, with the one-click POST of RFC 8058 and the mailto request, and save the outcome",
+		Params:  []parameter{idParam},
+		Result:  ref("UnsubscribeTest"),
+	},
+	{
+		Method: "POST", Path: "/emails/{id}/forward", ID: "forwardEmail", Tag: "emails",
+		Summary: "Forward an email to another address through the relay or a given SMTP server",
+		Params:  []parameter{idParam},
+		Body: schema{
+			"type":     "object",
+			"required": []string{"to"},
+			"properties": schema{
+				"to":   schema{"type": "array", "items": stringSchema, "minItems": 1},
+				"from": stringSchema,
+				"relay": schema{
+					"type":     "object",
+					"required": []string{"host"},
+					"properties": schema{
+						"host":               stringSchema,
+						"port":               integerSchema,
+						"username":           stringSchema,
+						"password":           stringSchema,
+						"tls":                schema{"type": "string", "enum": []string{"none", "starttls", "tls"}},
+						"insecureSkipVerify": schema{"type": "boolean"},
+					},
+					"additionalProperties": false,
+				},
+			},
+			"additionalProperties": false,
+		},
+		Result: objectSchema,
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/notes", ID: "listNotes", Tag: "notes",
+		Summary: "List the notes on an email",
+		Params:  []parameter{idParam},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"notes": arrayOf(ref("Note")),
+				"count": integerSchema,
+			},
+		},
+	},
+	{
+		Method: "POST", Path: "/emails/{id}/notes", ID: "createNote", Tag: "notes",
+		Summary: "Add a note to an email",
+		Params:  []parameter{idParam},
+		Body:    noteBody,
+		Result:  ref("Note"),
+	},
+	{
+		Method: "PUT", Path: "/emails/{id}/notes/{nid}", ID: "updateNote", Tag: "notes",
+		Summary: "Replace the text of a note",
+		Params:  []parameter{idParam, noteIDParam},
+		Body:    noteBody,
+		Result:  ref("Note"),
+	},
+	{
+		Method: "DELETE", Path: "/emails/{id}/notes/{nid}", ID: "deleteNote", Tag: "notes",
+		Summary: "Delete a note",
+		Params:  []parameter{idParam, noteIDParam},
+		Result:  objectSchema,
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/attachments/{aid}", ID: "getAttachment", Tag: "emails",
+		Summary: "Download an attachment",
+		Params: []parameter{idParam,
+			{Name: "aid", In: "path", Required: true, Description: "Attachment ID", Schema: integerSchema},
+		},
+		Produces: "application/octet-stream",
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/attachments/{aid}/view", ID: "viewAttachment", Tag: "emails",
+		Summary: "Serve an image, PDF or text attachment inline for preview; other types are downloaded",
+		Params: []parameter{idParam,
+			{Name: "aid", In: "path", Required: true, Description: "Attachment ID", Schema: integerSchema},
+		},
+		Produces: "application/octet-stream",
+	},
+	{
+		Method: "GET", Path: "/emails/{id}/attachments/{aid}/message", ID: "getAttachedMessage", Tag: "emails",
+		Summary: "Parse an attached email, such as one forwarded as an attachment",
+		Params: []parameter{idParam,
+			{Name: "aid", In: "path", Required: true, Description: "Attachment ID", Schema: integerSchema},
+		},
+		Result: ref("AttachedMessage"),
+	},
+	{
+		Method: "GET", Path: "/attachments", ID: "listAttachments", Tag: "emails",
+		Summary: "List the attachments of the emails matching the filters, newest emails first",
+		Params: params([]parameter{
+			{Name: "contentType", In: "query", Description: "Declared type, such as application/pdf; image/* matches every image type", Schema: stringSchema},
+			{Name: "filename", In: "query", Description: "Glob such as invoice-*.pdf, or a part of the file name; case-insensitive", Schema: stringSchema},
+			{Name: "minSize", In: "query", Description: "Minimum size in bytes", Schema: schema{"type": "integer", "minimum": 0}},
+		}, paginationParams, filterParams),
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"attachments": arrayOf(ref("AttachmentListing")),
+				"total":       integerSchema,
+				"limit":       integerSchema,
+				"offset":      integerSchema,
+			},
+		},
+	},
+	{
+		Method: "POST", Path: "/send", ID: "sendEmail", Tag: "emails",
+		Summary: "Compose a message and deliver it to gowebmail itself",
+		Body: schema{
+			"type":     "object",
+			"required": []string{"from"},
+			"properties": schema{
+				"from":    stringSchema,
+				"to":      arrayOf(stringSchema),
+				"cc":      arrayOf(stringSchema),
+				"bcc":     arrayOf(stringSchema),
+				"subject": stringSchema,
+				"text":    stringSchema,
+				"html":    stringSchema,
+				"headers": schema{"type": "object", "additionalProperties": stringSchema},
+				"attachments": arrayOf(schema{
+					"type":     "object",
+					"required": []string{"filename", "content"},
+					"properties": schema{
+						"filename":    stringSchema,
+						"contentType": stringSchema,
+						"content":     schema{"type": "string", "contentEncoding": "base64"},
+					},
+					"additionalProperties": false,
+				}),
+			},
+			"additionalProperties": false,
+		},
+		Result:      ref("Email"),
+		MessageBody: true,
+	},
+	{
+		Method: "POST", Path: "/ingest", ID: "ingestEmail", Tag: "emails",
+		Summary: "Deliver a raw message, sent as the body or as a multipart \"message\" field with from, to and receivedAt fields",
+		Params: []parameter{
+			{Name: "from", In: "query", Description: "Envelope sender (MAIL FROM)", Schema: stringSchema},
+			{Name: "to", In: "query", Description: "Envelope recipients, repeated or comma-separated; the header recipients when omitted", Schema: stringSchema},
+			{Name: "receivedAt", In: "query", Description: "Time of receipt; now when omitted", Schema: dateTimeSchema},
+		},
+		Result: ref("Email"),
+	},
+	{
+		Method: "POST", Path: "/inbound/ses", ID: "inboundSES", Tag: "emails",
+		Summary: "Store the message of an Amazon SES receipt notification delivered by SNS; subscription confirmations are confirmed",
+		Result:  ref("Email"),
+	},
+	{
+		Method: "POST", Path: "/inbound/sendgrid", ID: "inboundSendGrid", Tag: "emails",
+		Summary: "Store a message posted by SendGrid Inbound Parse, raw or parsed",
+		Result:  ref("Email"),
+	},
+	{
+		Method: "POST", Path: "/dev/generate", ID: "generateEmails", Tag: "emails",
+		Summary: "Store realistic made-up emails, with threads, HTML templates and attachments, for UI development and demos",
+		Body: schema{
+			"type": "object",
+			"properties": schema{
+				"count":  schema{"type": "integer", "minimum": 1, "default": 10},
+				"seed":   integerSchema,
+				"to":     arrayOf(stringSchema),
+				"spread": schema{"type": "string", "default": "24h"},
+			},
+			"additionalProperties": false,
+		},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"count": integerSchema,
+				"seed":  integerSchema,
+				"ids":   arrayOf(integerSchema),
+			},
+		},
+	},
+	{
+		Method: "GET", Path: "/threads", ID: "listThreads", Tag: "threads",
+		Summary: "List conversation threads, most recently active first",
+		Params:  paginationParams,
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"threads": arrayOf(ref("Thread")),
+				"total":   integerSchema,
+				"limit":   integerSchema,
+				"offset":  integerSchema,
+			},
+		},
+	},
+	{
+		Method: "GET", Path: "/threads/{tid}", ID: "getThread", Tag: "threads",
+		Summary: "Get the emails of a thread in the order they were received",
+		Params: []parameter{
+			{Name: "tid", In: "path", Required: true, Description: "Thread ID", Schema: stringSchema},
+		},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"threadId": stringSchema,
+				"emails":   arrayOf(ref("Email")),
+				"count":    integerSchema,
+			},
+		},
+	},
+	{
+		Method: "GET", Path: "/templates", ID: "listTemplates", Tag: "templates",
+		Summary: "Group the emails matching the filters by the template named in the templates.header header",
+		Params: params(paginationParams, filterParams, []parameter{
+			{Name: "samples", In: "query", Description: "Latest emails to include per template", Schema: schema{"type": "integer", "minimum": 0, "maximum": 10, "default": 3}},
+		}),
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"header":    stringSchema,
+				"templates": arrayOf(ref("TemplateGroup")),
+				"total":     integerSchema,
+				"untagged":  schema{"type": "integer", "description": "Emails matching the filters without the header"},
+				"limit":     integerSchema,
+				"offset":    integerSchema,
+			},
+		},
+	},
+	{
+		Method: "GET", Path: "/searches", ID: "listSavedSearches", Tag: "searches",
+		Summary: "List saved searches",
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"searches": arrayOf(ref("SavedSearch")),
+				"count":    integerSchema,
+			},
+		},
+	},
+	{
+		Method: "POST", Path: "/searches", ID: "createSavedSearch", Tag: "searches",
+		Summary: "Save a search",
+		Body:    savedSearchBody,
+		Result:  ref("SavedSearch"),
+	},
+	{
+		Method: "GET", Path: "/searches/{id}", ID: "getSavedSearch", Tag: "searches",
+		Summary: "Get a saved search",
+		Params:  []parameter{searchIDParam},
+		Result:  ref("SavedSearch"),
+	},
+	{
+		Method: "PUT", Path: "/searches/{id}", ID: "updateSavedSearch", Tag: "searches",
+		Summary: "Replace the name and criteria of a saved search",
+		Params:  []parameter{searchIDParam},
+		Body:    savedSearchBody,
+		Result:  ref("SavedSearch"),
+	},
+	{
+		Method: "DELETE", Path: "/searches/{id}", ID: "deleteSavedSearch", Tag: "searches",
+		Summary: "Delete a saved search",
+		Params:  []parameter{searchIDParam},
+		Result:  objectSchema,
+	},
+	{
+		Method: "GET", Path: "/searches/{id}/emails", ID: "runSavedSearch", Tag: "searches",
+		Summary: "Emails matching a saved search, newest first",
+		Params: params([]parameter{searchIDParam}, paginationParams, []parameter{
+			{Name: "cursor", In: "query", Description: "nextCursor from a previous page; takes precedence over offset", Schema: stringSchema},
+		}),
+		Result: ref("EmailList"),
+	},
+	{
+		Method: "GET", Path: "/push", ID: "getPush", Tag: "push",
+		Summary: "Whether push notifications are enabled, the ntfy server and the VAPID key browsers subscribe with",
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"enabled":        booleanSchema,
+				"ntfyServer":     stringSchema,
+				"vapidPublicKey": stringSchema,
+			},
+		},
+	},
+	{
+		Method: "GET", Path: "/push/subscriptions", ID: "listPushSubscriptions", Tag: "push",
+		Summary: "List push subscriptions",
+		Params: []parameter{
+			{Name: "address", In: "query", Description: "Only the subscriptions of this address", Schema: stringSchema},
+		},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"subscriptions": arrayOf(ref("PushSubscription")),
+				"count":         integerSchema,
+			},
+		},
+	},
+	{
+		Method: "POST", Path: "/push/subscriptions", ID: "createPushSubscription", Tag: "push",
+		Summary: "Subscribe an ntfy topic or a browser to the new mail of an address",
+		Body: schema{
+			"type":     "object",
+			"required": []string{"address", "type"},
+			"properties": schema{
+				"address":  stringSchema,
+				"type":     schema{"type": "string", "enum": []string{"ntfy", "webpush"}},
+				"topic":    stringSchema,
+				"token":    stringSchema,
+				"endpoint": stringSchema,
+				"keys": schema{
+					"type": "object",
+					"properties": schema{
+						"p256dh": stringSchema,
+						"auth":   stringSchema,
+					},
+				},
+			},
+			"additionalProperties": false,
+		},
+		Result: ref("PushSubscription"),
+	},
+	{
+		Method: "DELETE", Path: "/push/subscriptions/{id}", ID: "deletePushSubscription", Tag: "push",
+		Summary: "Delete a push subscription",
+		Params:  []parameter{pushIDParam},
+		Result:  objectSchema,
+	},
+	{
+		Method: "POST", Path: "/push/subscriptions/{id}/test", ID: "testPushSubscription", Tag: "push",
+		Summary: "Send a test notification to a push subscription",
+		Params:  []parameter{pushIDParam},
+		Result:  objectSchema,
+	},
+	{
+		Method: "GET", Path: "/mailboxes", ID: "listMailboxes", Tag: "mailboxes",
+		Summary: "List recipient mailboxes with usage and quota",
+		Result:  objectSchema,
+	},
+	{
+		Method: "GET", Path: "/addresses/{address}/emails", ID: "listAddressEmails", Tag: "mailboxes",
+		Summary: "List the emails delivered to an address; without a tag, those of its subaddresses too",
+		Params: params([]parameter{
+			{Name: "address", In: "path", Required: true, Description: "Email address, such as qa@example.com or qa+run42@example.com", Schema: stringSchema},
+			{Name: "exact", In: "query", Description: "Match the address alone, without normalizing plus-addressing and dots", Schema: schema{"type": "boolean", "default": false}},
+			{Name: "cursor", In: "query", Description: "nextCursor from a previous page; takes precedence over offset", Schema: stringSchema},
+			{Name: "fields", In: "query", Description: "summary leaves out bodies and headers; full returns whole emails", Schema: schema{"type": "string", "enum": []string{"summary", "full"}, "default": "summary"}},
+		}, paginationParams, filterParams),
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"emails":     arrayOf(schema{"oneOf": []schema{ref("EmailSummary"), ref("Email")}}),
+				"total":      integerSchema,
+				"limit":      integerSchema,
+				"offset":     integerSchema,
+				"nextCursor": stringSchema,
+			},
+		},
+	},
+	{
+		Method: "GET", Path: "/stats", ID: "getStats", Tag: "stats",
+		Summary: "Email counts and analytics for a time range",
+		Params: []parameter{
+			{Name: "since", In: "query", Description: "Start of the range (RFC 3339); defaults to 30 days, or 24 hours by hour, before until", Schema: dateTimeSchema},
+			{Name: "until", In: "query", Description: "End of the range (RFC 3339); defaults to now", Schema: dateTimeSchema},
+			{Name: "interval", In: "query", Description: "Histogram bucket size", Schema: schema{"type": "string", "enum": []string{"hour", "day"}, "default": "day"}},
+			{Name: "top", In: "query", Description: "Number of top senders and recipients, capped at 100", Schema: schema{"type": "integer", "minimum": 1, "default": 10}},
+		},
+		Result: ref("Stats"),
+	},
+	{
+		Method: "GET", Path: "/stats/storage", ID: "getStorageStats", Tag: "stats",
+		Summary: "Storage usage",
+		Result:  objectSchema,
+	},
+	{
+		Method: "GET", Path: "/stats/ingest", ID: "getIngestStats", Tag: "stats",
+		Summary: "Batched write statistics and pending jobs",
+		Result:  objectSchema,
+	},
+	{
+		Method: "POST", Path: "/admin/backup", ID: "createBackup", Tag: "admin",
+		Summary: "Write a database snapshot",
+		Result:  objectSchema,
+	},
+	{
+		Method: "GET", Path: "/admin/maintenance", ID: "getMaintenance", Tag: "admin",
+		Summary: "Database maintenance history",
+		Result:  objectSchema,
+	},
+	{
+		Method: "POST", Path: "/admin/maintenance", ID: "runMaintenance", Tag: "admin",
+		Summary: "Run database maintenance now",
+		Result:  objectSchema,
+	},
+	{
+		Method: "POST", Path: "/admin/retention/run", ID: "runRetention", Tag: "admin",
+		Summary: "Apply the retention policy now, or preview what it would delete",
+		Params: []parameter{
+			{Name: "dry_run", In: "query", Description: "List the emails that would be deleted, and why, without deleting them", Schema: booleanSchema},
+		},
+		Result: objectSchema,
+	},
+	{
+		Method: "GET", Path: "/admin/api-keys", ID: "listAPIKeys", Tag: "admin",
+		Summary: "List API keys created through the API",
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"keys":  arrayOf(ref("APIKey")),
+				"count": integerSchema,
+			},
+		},
+	},
+	{
+		Method: "POST", Path: "/admin/api-keys", ID: "createAPIKey", Tag: "admin",
+		Summary: "Create an API key; the key is only returned once",
+		Body: schema{
+			"type":     "object",
+			"required": []string{"name"},
+			"properties": schema{
+				"name":  stringSchema,
+				"scope": schema{"type": "string", "enum": []string{"read", "full"}, "default": "full"},
+			},
+			"additionalProperties": false,
+		},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"apiKey": ref("APIKey"),
+				"key":    stringSchema,
+			},
+		},
+	},
+	{
+		Method: "DELETE", Path: "/admin/api-keys/{id}", ID: "deleteAPIKey", Tag: "admin",
+		Summary: "Revoke an API key",
+		Params:  []parameter{{Name: "id", In: "path", Required: true, Description: "API key ID", Schema: integerSchema}},
+		Result:  objectSchema,
+	},
+	{
+		Method: "GET", Path: "/audit", ID: "listAudit", Tag: "admin",
+		Summary: "Audit log of destructive and administrative actions, newest first",
+		Params: []parameter{
+			{Name: "action", In: "query", Description: "Only this action, or actions starting with a prefix ending in \".\", e.g. email.", Schema: stringSchema},
+			{Name: "actor", In: "query", Description: "Only actions by this user or API key", Schema: stringSchema},
+			{Name: "since", In: "query", Description: "At or after (RFC 3339)", Schema: dateTimeSchema},
+			{Name: "until", In: "query", Description: "At or before (RFC 3339)", Schema: dateTimeSchema},
+			{Name: "limit", In: "query", Description: "Number of results, capped at 1000", Schema: schema{"type": "integer", "minimum": 1, "default": 50}},
+			paginationParams[1],
+		},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"entries": arrayOf(ref("AuditEntry")),
+				"total":   integerSchema,
+				"limit":   integerSchema,
+				"offset":  integerSchema,
+			},
+		},
+	},
+	{
+		Method: "POST", Path: "/login", ID: "login", Tag: "session",
+		Summary: "Sign in to the web UI; the session is kept in an HttpOnly cookie, and requests that change something send its csrfToken as X-CSRF-Token",
+		Body: schema{
+			"type":     "object",
+			"required": []string{"username", "password"},
+			"properties": schema{
+				"username": stringSchema,
+				"password": stringSchema,
+			},
+			"additionalProperties": false,
+		},
+		Result: ref("Session"),
+	},
+	{
+		Method: "POST", Path: "/logout", ID: "logout", Tag: "session",
+		Summary: "Sign out of the web UI",
+		Result:  objectSchema,
+	},
+	{
+		Method: "GET", Path: "/session", ID: "getSession", Tag: "session",
+		Summary: "Who is signed in, and the CSRF token of a web UI session",
+		Result:  ref("Session"),
+	},
+	{
+		Method: "GET", Path: "/health", ID: "health", Tag: "system",
+		Summary: "Health check",
+		Result:  objectSchema,
+	},
+	{
+		Method: "GET", Path: "/webhooks/deliveries", ID: "listWebhookDeliveries", Tag: "webhooks",
+		Summary: "Recent webhook deliveries, newest first",
+		Params: []parameter{
+			{Name: "status", In: "query", Description: "Only deliveries with this status", Schema: schema{"type": "string", "enum": []string{"pending", "delivered", "failed"}}},
+			{Name: "limit", In: "query", Description: "Number of results, capped at 1000", Schema: schema{"type": "integer", "minimum": 1, "default": 50}},
+		},
+		Result: schema{
+			"type": "object",
+			"properties": schema{
+				"deliveries": arrayOf(ref("WebhookDelivery")),
+				"count":      integerSchema,
+			},
+		},
+	},
+	{
+		Method: "POST", Path: "/graphql", ID: "graphql", Tag: "graphql",
+		Summary: "Run a GraphQL query",
+		Body: schema{
+			"type":     "object",
+			"required": []string{"query"},
+			"properties": schema{
+				"query":         stringSchema,
+				"operationName": schema{"type": []string{"string", "null"}},
+				"variables":     schema{"type": []string{"object", "null"}},
+				"extensions":    schema{"type": []string{"object", "null"}},
+			},
+			"additionalProperties": false,
+		},
+		Produces: "application/json",
+	},
+	{
+		Method: "GET", Path: "/graphql", ID: "graphqlGet", Tag: "graphql",
+		Summary: "Run a GraphQL query from the URL, or open a graphql-transport-ws WebSocket for subscriptions",
+		Params: []parameter{
+			{Name: "query", In: "query", Schema: stringSchema},
+			{Name: "operationName", In: "query", Schema: stringSchema},
+			{Name: "variables", In: "query", Description: "JSON object", Schema: stringSchema},
+		},
+		Produces: "application/json",
+	},
+	{
+		Method: "GET", Path: "/openapi.json", ID: "openapi", Tag: "system",
+		Summary:  "This document",
+		Produces: "application/json",
+	},
+}
+
+// componentSchemas are the shared schemas referenced by operations
+var componentSchemas = schema{
+	"Error": schema{
+		"type": "object",
+		"properties": schema{
+			"success": booleanSchema,
+			"error": schema{
+				"type": "object",
+				"properties": schema{
+					"code":    stringSchema,
+					"message": stringSchema,
+				},
+			},
+		},
+	},
+	"Attachment": schema{
+		"type": "object",
+		"properties": schema{
+			"id":           integerSchema,
+			"filename":     stringSchema,
+			"contentType":  stringSchema,
+			"size":         integerSchema,
+			"contentId":    stringSchema,
+			"inline":       booleanSchema,
+			"message":      ref("MessageInfo"),
+			"detectedType": schema{"type": "string", "description": "Type sniffed from the data's magic bytes"},
+			"typeMismatch": schema{"type": "string", "description": "How the detected type contradicts contentType or the filename extension"},
+		},
+	},
+	"AttachmentListing": schema{
+		"allOf": []schema{
+			ref("Attachment"),
+			{
+				"type": "object",
+				"properties": schema{
+					"emailId": integerSchema,
+					"email":   ref("EmailSummary"),
+				},
+			},
+		},
+	},
+	"MessageInfo": schema{
+		"type": "object",
+		"properties": schema{
+			"messageId":   stringSchema,
+			"from":        stringSchema,
+			"to":          arrayOf(stringSchema),
+			"cc":          arrayOf(stringSchema),
+			"subject":     stringSchema,
+			"date":        dateTimeSchema,
+			"attachments": arrayOf(ref("Attachment")),
+		},
+	},
+	"AttachedMessage": schema{
+		"type": "object",
+		"properties": schema{
+			"messageId":   stringSchema,
+			"from":        stringSchema,
+			"to":          arrayOf(stringSchema),
+			"cc":          arrayOf(stringSchema),
+			"subject":     stringSchema,
+			"date":        dateTimeSchema,
+			"attachments": arrayOf(ref("Attachment")),
+			"bodyPlain":   stringSchema,
+			"bodyHTML":    stringSchema,
+			"headers":     schema{"type": "object", "additionalProperties": arrayOf(stringSchema)},
+			"size":        integerSchema,
+		},
+	},
+	"Email": schema{
+		"type": "object",
+		"properties": schema{
+			"id":           integerSchema,
+			"messageId":    stringSchema,
+			"from":         stringSchema,
+			"to":           arrayOf(stringSchema),
+			"cc":           arrayOf(stringSchema),
+			"bcc":          arrayOf(stringSchema),
+			"subject":      stringSchema,
+			"bodyPlain":    stringSchema,
+			"bodyHTML":     stringSchema,
+			"bodyAMP":      stringSchema,
+			"headers":      schema{"type": "object", "additionalProperties": arrayOf(stringSchema)},
+			"attachments":  arrayOf(ref("Attachment")),
+			"size":         integerSchema,
+			"receivedAt":   dateTimeSchema,
+			"read":         booleanSchema,
+			"pinned":       booleanSchema,
+			"tags":         arrayOf(stringSchema),
+			"envelopeFrom": stringSchema,
+			"envelopeTo":   arrayOf(stringSchema),
+			"replyTo":      arrayOf(stringSchema),
+			"sender":       stringSchema,
+			"returnPath":   schema{"type": "string", "description": "Where bounces go: the MAIL FROM address, or the Return-Path header of an email not received over SMTP"},
+			"priority":     schema{"type": "string", "enum": []string{"high", "normal", "low"}, "description": "Set when the headers flag a priority"},
+			"threadId":     stringSchema,
+			"updatedAt":    dateTimeSchema,
+			"missingAlternative": schema{
+				"type":        "string",
+				"enum":        []string{"plain", "html"},
+				"description": "Set when the email has only one body; bodyPlain of an email missing plain is derived from its HTML",
+			},
+			"spam":          ref("SpamResult"),
+			"auth":          ref("AuthResults"),
+			"calendar":      ref("Calendar"),
+			"security":      ref("Security"),
+			"received":      arrayOf(ref("ReceivedHop")),
+			"sizeBreakdown": ref("SizeBreakdown"),
+			"match": schema{
+				"type": "object",
+				"properties": schema{
+					"fields":  arrayOf(stringSchema),
+					"subject": stringSchema,
+					"body":    stringSchema,
+				},
+			},
+		},
+	},
+	"Calendar": schema{
+		"type": "object",
+		"properties": schema{
+			"method": stringSchema,
+			"events": arrayOf(schema{
+				"type": "object",
+				"properties": schema{
+					"uid":         stringSchema,
+					"summary":     stringSchema,
+					"description": stringSchema,
+					"location":    stringSchema,
+					"start":       dateTimeSchema,
+					"end":         dateTimeSchema,
+					"allDay":      booleanSchema,
+					"timeZone":    stringSchema,
+					"recurrence":  stringSchema,
+					"status":      stringSchema,
+					"sequence":    integerSchema,
+					"organizer":   ref("CalendarAttendee"),
+					"attendees":   arrayOf(ref("CalendarAttendee")),
+				},
+			}),
+		},
+	},
+	"CalendarAttendee": schema{
+		"type": "object",
+		"properties": schema{
+			"email":  stringSchema,
+			"name":   stringSchema,
+			"role":   stringSchema,
+			"status": stringSchema,
+			"rsvp":   booleanSchema,
+		},
+	},
+	"SpamResult": schema{
+		"type": "object",
+		"properties": schema{
+			"engine":    stringSchema,
+			"score":     numberSchema,
+			"threshold": numberSchema,
+			"isSpam":    booleanSchema,
+			"action":    stringSchema,
+			"rules": arrayOf(schema{
+				"type": "object",
+				"properties": schema{
+					"name":        stringSchema,
+					"score":       numberSchema,
+					"description": stringSchema,
+				},
+			}),
+			"checkedAt": dateTimeSchema,
+		},
+	},
+	"Security": schema{
+		"type":        "object",
+		"description": "S/MIME or PGP signatures and encryption of a signed or encrypted email",
+		"properties": schema{
+			"format":     schema{"type": "string", "enum": []string{"smime", "pgp"}},
+			"signed":     booleanSchema,
+			"encrypted":  booleanSchema,
+			"decrypted":  booleanSchema,
+			"recipients": arrayOf(stringSchema),
+			"signatures": arrayOf(ref("Signature")),
+			"reason":     stringSchema,
+		},
+	},
+	"Unsubscribe": schema{
+		"type":        "object",
+		"description": "The List-Unsubscribe and List-Unsubscribe-Post headers of an email",
+		"properties": schema{
+			"mailto":   arrayOf(stringSchema),
+			"urls":     arrayOf(stringSchema),
+			"oneClick": booleanSchema,
+			"problems": arrayOf(stringSchema),
+			"test":     ref("UnsubscribeTest"),
+		},
+	},
+	"UnsubscribeTest": schema{
+		"type": "object",
+		"properties": schema{
+			"testedAt": dateTimeSchema,
+			"results": arrayOf(schema{
+				"type": "object",
+				"properties": schema{
+					"method":     schema{"type": "string", "enum": []string{"one-click", "link", "mailto"}},
+					"target":     stringSchema,
+					"status":     schema{"type": "string", "enum": []string{"ok", "failed", "skipped"}},
+					"statusCode": integerSchema,
+					"error":      stringSchema,
+					"durationMs": integerSchema,
+				},
+			}),
+		},
+	},
+	"ReceivedHop": schema{
+		"type":        "object",
+		"description": "A relay the email passed through, from its Received header; hops are in the order the email reached them",
+		"properties": schema{
+			"from":      stringSchema,
+			"fromHost":  stringSchema,
+			"fromIp":    stringSchema,
+			"by":        stringSchema,
+			"protocol":  stringSchema,
+			"id":        stringSchema,
+			"for":       stringSchema,
+			"timestamp": dateTimeSchema,
+			"delayMs":   integerSchema,
+			"header":    stringSchema,
+		},
+	},
+	"SizeBreakdown": schema{
+		"type":        "object",
+		"description": "Bytes of the message header, bodies and attachments as encoded in the message; structure is the part headers and boundaries, and all add up to the email's size",
+		"properties": schema{
+			"headers":     integerSchema,
+			"text":        integerSchema,
+			"html":        integerSchema,
+			"amp":         integerSchema,
+			"attachments": integerSchema,
+			"structure":   integerSchema,
+			"parts": arrayOf(schema{
+				"type": "object",
+				"properties": schema{
+					"part":        stringSchema,
+					"contentType": stringSchema,
+					"kind":        schema{"type": "string", "enum": []string{"text", "html", "amp", "attachment"}},
+					"filename":    stringSchema,
+					"encoding":    stringSchema,
+					"size":        integerSchema,
+					"decodedSize": integerSchema,
+				},
+			}),
+		},
+	},
+	"Signature": schema{
+		"type": "object",
+		"properties": schema{
+			"result":      schema{"type": "string", "enum": []string{"pass", "fail", "none"}},
+			"signer":      stringSchema,
+			"keyId":       stringSchema,
+			"fingerprint": stringSchema,
+			"algorithm":   stringSchema,
+			"signedAt":    dateTimeSchema,
+			"subject":     stringSchema,
+			"issuer":      stringSchema,
+			"notBefore":   dateTimeSchema,
+			"notAfter":    dateTimeSchema,
+			"reason":      stringSchema,
+		},
+	},
+	"AuthResults": schema{
+		"type": "object",
+		"properties": schema{
+			"spf": schema{
+				"type": "object",
+				"properties": schema{
+					"result": authResultSchema,
+					"domain": stringSchema,
+					"ip":     stringSchema,
+					"reason": stringSchema,
+				},
+			},
+			"dkim": arrayOf(schema{
+				"type": "object",
+				"properties": schema{
+					"result":    authResultSchema,
+					"domain":    stringSchema,
+					"selector":  stringSchema,
+					"algorithm": stringSchema,
+					"headers":   arrayOf(stringSchema),
+					"reason":    stringSchema,
+				},
+			}),
+			"dmarc": schema{
+				"type": "object",
+				"properties": schema{
+					"result":      authResultSchema,
+					"domain":      stringSchema,
+					"policy":      schema{"type": "string", "enum": []string{"none", "quarantine", "reject"}},
+					"spfAligned":  booleanSchema,
+					"dkimAligned": booleanSchema,
+					"reason":      stringSchema,
+				},
+			},
+			"checkedAt": dateTimeSchema,
+		},
+	},
+	"EmailSummary": schema{
+		"type": "object",
+		"properties": schema{
+			"id":           integerSchema,
+			"messageId":    stringSchema,
+			"from":         stringSchema,
+			"to":           arrayOf(stringSchema),
+			"cc":           arrayOf(stringSchema),
+			"bcc":          arrayOf(stringSchema),
+			"subject":      stringSchema,
+			"preview":      stringSchema,
+			"size":         integerSchema,
+			"receivedAt":   dateTimeSchema,
+			"read":         booleanSchema,
+			"pinned":       booleanSchema,
+			"tags":         arrayOf(stringSchema),
+			"envelopeFrom": stringSchema,
+			"envelopeTo":   arrayOf(stringSchema),
+			"replyTo":      arrayOf(stringSchema),
+			"sender":       stringSchema,
+			"returnPath":   schema{"type": "string", "description": "Where bounces go: the MAIL FROM address, or the Return-Path header of an email not received over SMTP"},
+			"priority":     schema{"type": "string", "enum": []string{"high", "normal", "low"}, "description": "Set when the headers flag a priority"},
+			"threadId":     stringSchema,
+			"updatedAt":    dateTimeSchema,
+			"missingAlternative": schema{
+				"type":        "string",
+				"enum":        []string{"plain", "html"},
+				"description": "Set when the email has only one body; bodyPlain of an email missing plain is derived from its HTML",
+			},
+			"spam":     ref("SpamResult"),
+			"auth":     ref("AuthResults"),
+			"security": ref("Security"),
+		},
+	},
+	"EmailList": schema{
+		"type": "object",
+		"properties": schema{
+			"emails":     arrayOf(ref("Email")),
+			"total":      integerSchema,
+			"limit":      integerSchema,
+			"offset":     integerSchema,
+			"nextCursor": stringSchema,
+		},
+	},
+	"Thread": schema{
+		"type": "object",
+		"properties": schema{
+			"threadId":        stringSchema,
+			"subject":         stringSchema,
+			"participants":    arrayOf(stringSchema),
+			"count":           integerSchema,
+			"unreadCount":     integerSchema,
+			"firstEmailId":    integerSchema,
+			"lastEmailId":     integerSchema,
+			"firstReceivedAt": dateTimeSchema,
+			"lastReceivedAt":  dateTimeSchema,
+		},
+	},
+	"TemplateGroup": schema{
+		"type": "object",
+		"properties": schema{
+			"template":        stringSchema,
+			"count":           integerSchema,
+			"firstEmailId":    integerSchema,
+			"lastEmailId":     integerSchema,
+			"firstReceivedAt": dateTimeSchema,
+			"lastReceivedAt":  dateTimeSchema,
+			"samples":         arrayOf(ref("EmailSummary")),
+		},
+	},
+	"Stats": schema{
+		"type": "object",
+		"properties": schema{
+			"totalEmails": integerSchema,
+			"todayCount":  integerSchema,
+			"unreadCount": integerSchema,
+			"mailboxes": arrayOf(schema{
+				"type": "object",
+				"properties": schema{
+					"address": stringSchema,
+					"total":   integerSchema,
+					"unread":  integerSchema,
+				},
+			}),
+			"tags": arrayOf(schema{
+				"type": "object",
+				"properties": schema{
+					"tag":    stringSchema,
+					"total":  integerSchema,
+					"unread": integerSchema,
+				},
+			}),
+			"since":    dateTimeSchema,
+			"until":    dateTimeSchema,
+			"interval": stringSchema,
+			"received": integerSchema,
+			"bytes":    integerSchema,
+			"histogram": arrayOf(schema{
+				"type": "object",
+				"properties": schema{
+					"start": stringSchema,
+					"count": integerSchema,
+					"bytes": integerSchema,
+				},
+			}),
+			"topSenders":    arrayOf(ref("AddressCount")),
+			"topRecipients": arrayOf(ref("AddressCount")),
+			"sizes": schema{
+				"type": "object",
+				"properties": schema{
+					"min":     integerSchema,
+					"max":     integerSchema,
+					"average": schema{"type": "number"},
+					"p50":     integerSchema,
+					"p90":     integerSchema,
+					"p99":     integerSchema,
+				},
+			},
+			"parseFailures": integerSchema,
+		},
+	},
+	"AddressCount": schema{
+		"type": "object",
+		"properties": schema{
+			"address": stringSchema,
+			"count":   integerSchema,
+		},
+	},
+	"LintWarning": schema{
+		"type": "object",
+		"properties": schema{
+			"rule":     stringSchema,
+			"severity": schema{"type": "string", "enum": []string{"error", "warning", "info"}},
+			"message":  stringSchema,
+			"clients":  arrayOf(stringSchema),
+			"line":     integerSchema,
+			"count":    integerSchema,
+		},
+	},
+	"CheckedLink": schema{
+		"type": "object",
+		"properties": schema{
+			"url":        stringSchema,
+			"element":    schema{"type": "string", "enum": []string{"a", "img", "area", "text"}},
+			"status":     schema{"type": "string", "enum": []string{"ok", "broken", "error"}},
+			"statusCode": integerSchema,
+			"finalUrl":   stringSchema,
+			"redirects": arrayOf(schema{
+				"type": "object",
+				"properties": schema{
+					"url":        stringSchema,
+					"statusCode": integerSchema,
+					"location":   stringSchema,
+				},
+			}),
+			"error":      stringSchema,
+			"durationMs": integerSchema,
+		},
+	},
+	"Note": schema{
+		"type": "object",
+		"properties": schema{
+			"id":        integerSchema,
+			"emailId":   integerSchema,
+			"author":    stringSchema,
+			"body":      stringSchema,
+			"createdAt": dateTimeSchema,
+			"updatedAt": dateTimeSchema,
+		},
+	},
+	"SavedSearch": schema{
+		"type": "object",
+		"properties": schema{
+			"id":        integerSchema,
+			"name":      stringSchema,
+			"query":     stringSchema,
+			"from":      stringSchema,
+			"to":        stringSchema,
+			"subject":   stringSchema,
+			"rcpt":      stringSchema,
+			"tag":       stringSchema,
+			"unread":    booleanSchema,
+			"pinned":    booleanSchema,
+			"createdAt": dateTimeSchema,
+			"updatedAt": dateTimeSchema,
+		},
+	},
+	"PushSubscription": schema{
+		"type": "object",
+		"properties": schema{
+			"id":        integerSchema,
+			"address":   stringSchema,
+			"type":      schema{"type": "string", "enum": []string{"ntfy", "webpush"}},
+			"topic":     stringSchema,
+			"endpoint":  stringSchema,
+			"createdAt": dateTimeSchema,
+		},
+	},
+	"APIKey": schema{
+		"type": "object",
+		"properties": schema{
+			"id":        integerSchema,
+			"name":      stringSchema,
+			"prefix":    stringSchema,
+			"scope":     schema{"type": "string", "enum": []string{"read", "full"}},
+			"createdAt": dateTimeSchema,
+		},
+	},
+	"Session": schema{
+		"type": "object",
+		"properties": schema{
+			"username":  stringSchema,
+			"auth":      stringSchema,
+			"admin":     booleanSchema,
+			"mailboxes": arrayOf(stringSchema),
+			"csrfToken": stringSchema,
+		},
+	},
+	"AuditEntry": schema{
+		"type": "object",
+		"properties": schema{
+			"id":       integerSchema,
+			"time":     dateTimeSchema,
+			"action":   stringSchema,
+			"actor":    stringSchema,
+			"auth":     schema{"type": "string", "enum": []string{"basic", "oidc", "api_key", "client_cert", "session", "none"}},
+			"remoteIp": stringSchema,
+			"target":   stringSchema,
+			"details":  objectSchema,
+		},
+	},
+	"WebhookDelivery": schema{
+		"type": "object",
+		"properties": schema{
+			"id":          stringSchema,
+			"eventId":     stringSchema,
+			"event":       stringSchema,
+			"url":         stringSchema,
+			"status":      schema{"type": "string", "enum": []string{"pending", "delivered", "failed"}},
+			"attempts":    integerSchema,
+			"statusCode":  integerSchema,
+			"error":       stringSchema,
+			"createdAt":   dateTimeSchema,
+			"lastAttempt": dateTimeSchema,
+			"nextAttempt": dateTimeSchema,
+		},
+	},
+}
+
+// openAPISpec builds the OpenAPI document from the operations table
+func openAPISpec() schema {
+	paths := schema{}
+	for _, op := range operations {
+		item, ok := paths["/api"+op.Path].(schema)
+		if !ok {
+			item = schema{}
+			paths["/api"+op.Path] = item
+		}
+
+		spec := schema{
+			"operationId": op.ID,
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"responses":   operationResponses(op),
+		}
+
+		if len(op.Params) > 0 {
+			var list []schema
+			for _, p := range op.Params {
+				param := schema{
+					"name":     p.Name,
+					"in":       p.In,
+					"required": p.Required,
+					"schema":   p.Schema,
+				}
+				if p.Description != "" {
+					param["description"] = p.Description
+				}
+				list = append(list, param)
+			}
+			spec["parameters"] = list
+		}
+
+		if op.Body != nil {
+			spec["requestBody"] = schema{
+				"required": true,
+				"content": schema{
+					"application/json": schema{"schema": op.Body},
+				},
+			}
+		}
+
+		item[strings.ToLower(op.Method)] = spec
+	}
+
+	return schema{
+		"openapi": "3.1.0",
+		"info": schema{
+			"title":   "GoWebMail API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": schema{
+			"schemas": componentSchemas,
+			"securitySchemes": schema{
+				"basicAuth":   schema{"type": "http", "scheme": "basic"},
+				"bearerAuth":  schema{"type": "http", "scheme": "bearer"},
+				"apiKeyAuth":  schema{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"sessionAuth": schema{"type": "apiKey", "in": "cookie", "name": loginSessionCookie},
+			},
+		},
+	}
+}
+
+// operationResponses describes the success and error responses of op
+func operationResponses(op operation) schema {
+	success := schema{"description": "Success"}
+	switch {
+	case op.Produces != "":
+		success["content"] = schema{op.Produces: schema{}}
+	case op.Result != nil:
+		success["content"] = schema{
+			"application/json": schema{
+				"schema": schema{
+					"type": "object",
+					"properties": schema{
+						"success": booleanSchema,
+						"data":    op.Result,
+					},
+				},
+			},
+		}
+	}
+
+	return schema{
+		"200": success,
+		"default": schema{
+			"description": "Error",
+			"content": schema{
+				"application/json": schema{"schema": ref("Error")},
+			},
+		},
+	}
+}
+
+// routeVariable matches a mux path variable with a pattern, e.g. {id:[0-9]+}
+var routeVariable = regexp.MustCompile(`\{([^}:]+):[^}]+\}`)
+
+// findOperation returns the operation registered for a mux path template
+func findOperation(method, template string) *operation {
+	path := strings.TrimPrefix(routeVariable.ReplaceAllString(template, "{$1}"), "/api")
+	for i := range operations {
+		if operations[i].Method == method && operations[i].Path == path {
+			return &operations[i]
+		}
+	}
+	return nil
+}
+
+// handleOpenAPI handles GET /api/openapi.json
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPISpec())
+}
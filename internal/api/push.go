@@ -0,0 +1,222 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gowebmail/internal/notify"
+	"gowebmail/internal/storage"
+)
+
+// ntfyTopicName matches the topic names ntfy accepts
+var ntfyTopicName = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)
+
+// PushSubscriptionRequest is the body of POST /api/push/subscriptions.
+// Endpoint and Keys are those of the browser's PushSubscription.
+type PushSubscriptionRequest struct {
+	Address  string `json:"address"`
+	Type     string `json:"type"`
+	Topic    string `json:"topic"`
+	Token    string `json:"token"`
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256DH string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// handleGetPush handles GET /api/push, which tells clients how to
+// subscribe
+func (s *Server) handleGetPush(w http.ResponseWriter, r *http.Request) {
+	s.sendSuccess(w, map[string]interface{}{
+		"enabled":        s.pusher.Enabled(),
+		"ntfyServer":     s.pusher.NtfyServer(),
+		"vapidPublicKey": s.pusher.VAPIDPublicKey(),
+	})
+}
+
+// handleListPushSubscriptions handles GET /api/push/subscriptions, of one
+// address with ?address=. Users restricted to mailboxes see the
+// subscriptions of their addresses.
+func (s *Server) handleListPushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subs, err := s.storage.ListPushSubscriptions(strings.TrimSpace(r.URL.Query().Get("address")))
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+	if mailboxes := requestIdentity(r).Mailboxes; mailboxes != nil {
+		visible := []*storage.PushSubscription{}
+		for _, sub := range subs {
+			if seesAddress(mailboxes, sub.Address) {
+				visible = append(visible, sub)
+			}
+		}
+		subs = visible
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"subscriptions": subs,
+		"count":         len(subs),
+	})
+}
+
+// handleCreatePushSubscription handles POST /api/push/subscriptions
+func (s *Server) handleCreatePushSubscription(w http.ResponseWriter, r *http.Request) {
+	if !s.pusher.Enabled() {
+		s.sendError(w, http.StatusServiceUnavailable, "PUSH_DISABLED", "Push notifications are not enabled")
+		return
+	}
+
+	var req PushSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	sub := &storage.PushSubscription{
+		Address: strings.TrimSpace(req.Address),
+		Type:    req.Type,
+	}
+	if !strings.ContainsAny(sub.Address, "@*") {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "address must be an email address or a pattern such as *@example.com")
+		return
+	}
+	if !seesAddress(requestIdentity(r).Mailboxes, sub.Address) {
+		s.sendError(w, http.StatusForbidden, "FORBIDDEN", "address is not in your mailboxes")
+		return
+	}
+
+	switch req.Type {
+	case "ntfy":
+		sub.Topic = strings.TrimSpace(req.Topic)
+		sub.Token = req.Token
+		if !validNtfyTopic(sub.Topic) {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "topic must be an ntfy topic name or an http(s) URL of one")
+			return
+		}
+	case "webpush":
+		if s.pusher.VAPIDPublicKey() == "" {
+			s.sendError(w, http.StatusServiceUnavailable, "WEB_PUSH_DISABLED", "Web Push needs push.vapid_private_key")
+			return
+		}
+		u, err := url.Parse(req.Endpoint)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "endpoint must be an https URL")
+			return
+		}
+		if len(decodeKey(req.Keys.P256DH)) != 65 || len(decodeKey(req.Keys.Auth)) != 16 {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "keys must hold the p256dh and auth keys of the subscription")
+			return
+		}
+		sub.Endpoint, sub.P256DH, sub.Auth = req.Endpoint, req.Keys.P256DH, req.Keys.Auth
+	default:
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "type must be ntfy or webpush")
+		return
+	}
+
+	if err := s.storage.CreatePushSubscription(sub); err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, sub)
+}
+
+// handleDeletePushSubscription handles DELETE /api/push/subscriptions/{id}
+func (s *Server) handleDeletePushSubscription(w http.ResponseWriter, r *http.Request) {
+	id := parseIDParam(r)
+	if _, err := s.pushSubscription(r, id); err != nil {
+		s.sendPushError(w, err)
+		return
+	}
+	if err := s.storage.DeletePushSubscription(id); err != nil {
+		s.sendPushError(w, err)
+		return
+	}
+	s.audit(r, "push.unsubscribe", strconv.FormatInt(id, 10), nil)
+
+	s.sendSuccess(w, map[string]interface{}{
+		"message": "Push subscription deleted",
+	})
+}
+
+// handleTestPushSubscription handles POST /api/push/subscriptions/{id}/test,
+// which sends a notification now and reports whether it was accepted
+func (s *Server) handleTestPushSubscription(w http.ResponseWriter, r *http.Request) {
+	if !s.pusher.Enabled() {
+		s.sendError(w, http.StatusServiceUnavailable, "PUSH_DISABLED", "Push notifications are not enabled")
+		return
+	}
+
+	sub, err := s.pushSubscription(r, parseIDParam(r))
+	if err != nil {
+		s.sendPushError(w, err)
+		return
+	}
+
+	err = s.pusher.Send(sub, &notify.PushMessage{
+		Title: "GoWebMail test notification",
+		Body:  "New mail for " + sub.Address + " will be announced like this.",
+	})
+	if err == notify.ErrPushGone {
+		s.sendError(w, http.StatusGone, "SUBSCRIPTION_GONE", "The browser subscription has expired and was deleted")
+		return
+	}
+	if err != nil {
+		s.sendError(w, http.StatusBadGateway, "PUSH_FAILED", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"message": "Test notification sent",
+	})
+}
+
+// pushSubscription returns a subscription the sender of r sees. Those of
+// other mailboxes are not found.
+func (s *Server) pushSubscription(r *http.Request, id int64) (*storage.PushSubscription, error) {
+	sub, err := s.storage.GetPushSubscription(id)
+	if err != nil {
+		return nil, err
+	}
+	if !seesAddress(requestIdentity(r).Mailboxes, sub.Address) {
+		return nil, storage.ErrNotFound
+	}
+	return sub, nil
+}
+
+func (s *Server) sendPushError(w http.ResponseWriter, err error) {
+	if err == storage.ErrNotFound {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Push subscription not found")
+		return
+	}
+	s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+}
+
+// validNtfyTopic reports whether topic is a topic name, or the URL of a
+// topic on another server
+func validNtfyTopic(topic string) bool {
+	if !strings.Contains(topic, "://") {
+		return ntfyTopicName.MatchString(topic)
+	}
+	u, err := url.Parse(topic)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	return ntfyTopicName.MatchString(u.Path[strings.LastIndex(u.Path, "/")+1:])
+}
+
+// decodeKey decodes a base64url key of a browser subscription, or
+// returns nil
+func decodeKey(s string) []byte {
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil
+	}
+	return key
+}
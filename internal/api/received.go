@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+
+	"gowebmail/internal/storage"
+)
+
+// DeliveryPath is the route an email took to gowebmail, as returned by
+// GET /api/emails/{id}/received
+type DeliveryPath struct {
+	Hops []*storage.ReceivedHop `json:"hops"`
+
+	// TotalDelayMs is the time from the first hop with a timestamp until
+	// gowebmail received the email, and ArrivalDelayMs that from the last
+	TotalDelayMs   *int64 `json:"totalDelayMs,omitempty"`
+	ArrivalDelayMs *int64 `json:"arrivalDelayMs,omitempty"`
+}
+
+// handleGetReceived handles GET /api/emails/{id}/received, which returns
+// the relays an email passed through, parsed from its Received headers
+func (s *Server) handleGetReceived(w http.ResponseWriter, r *http.Request) {
+	id := parseIDParam(r)
+	if id == 0 {
+		s.sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid email ID")
+		return
+	}
+
+	emailData, err := s.storage.GetEmail(id)
+	if err == storage.ErrNotFound {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+		return
+	} else if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	if len(emailData.Received) == 0 {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "No Received headers")
+		return
+	}
+
+	path := &DeliveryPath{Hops: emailData.Received}
+	for _, hop := range emailData.Received {
+		if hop.Timestamp == nil {
+			continue
+		}
+		delay := emailData.ReceivedAt.Sub(*hop.Timestamp).Milliseconds()
+		if path.TotalDelayMs == nil {
+			path.TotalDelayMs = &delay
+		}
+		path.ArrivalDelayMs = &delay
+	}
+
+	s.sendSuccess(w, path)
+}
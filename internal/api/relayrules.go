@@ -0,0 +1,114 @@
+package api
+
+import (
+	"gowebmail/internal/relay"
+	"gowebmail/internal/storage"
+)
+
+// autoRelay relays email by the configured relay rules. A new email, with
+// added nil, goes through the rules without a tag; an email that was
+// tagged goes through the rules for the added tags.
+func (s *Server) autoRelay(email *storage.Email, added []string) {
+	if s.relay == nil {
+		return
+	}
+
+	for i := range s.config.Relay.Rules {
+		rule := &s.config.Relay.Rules[i]
+		if added == nil && rule.Tag != "" || added != nil && !containsTag(added, rule.Tag) {
+			continue
+		}
+
+		to := s.relay.RuleRecipients(rule, email)
+		if len(to) == 0 {
+			continue
+		}
+		if err := s.relayByRule(email, rule.From, to); err != nil {
+			s.logger.Warn().Err(err).Int64("id", email.ID).Str("rule", rule.Name).Msg("Failed to relay email by rule")
+			continue
+		}
+
+		s.publish(&WebSocketMessage{
+			Type: "email.released",
+			Data: map[string]interface{}{"id": email.ID, "to": to, "rule": rule.Name},
+		})
+	}
+}
+
+// relayByRule relays email to to. When the sender or the recipients
+// differ from the envelope's, the message is sent as a forward, like with
+// POST /api/emails/{id}/forward; otherwise it goes out unchanged, like a
+// release.
+func (s *Server) relayByRule(email *storage.Email, from string, to []string) error {
+	raw, err := s.storage.GetRawEmail(email.ID)
+	if err == storage.ErrRawNotAvailable {
+		raw = reconstructRaw(email)
+	} else if err != nil {
+		return err
+	}
+
+	relayer := s.relay
+	sender := email.EnvelopeFrom
+	if sender == "" {
+		sender = email.From
+	}
+	if from != "" {
+		// The rule's sender takes precedence over relay.from
+		cfg := s.config.Relay
+		cfg.From = from
+		relayer = relay.NewRelayer(&cfg, s.logger)
+		sender = from
+	}
+
+	if from != "" || !sameAddresses(to, email.EnvelopeTo) {
+		raw = relay.ForwardMessage(raw, sender, to, from)
+	}
+	return relayer.Send(sender, to, raw)
+}
+
+// tagRelayRules reports whether a relay rule fires when emails are tagged
+func (s *Server) tagRelayRules() bool {
+	if s.relay == nil {
+		return false
+	}
+	for _, rule := range s.config.Relay.Rules {
+		if rule.Tag != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// addedTags returns the tags of after that are not in before
+func addedTags(before, after []string) []string {
+	added := []string{}
+	for _, tag := range after {
+		if !containsTag(before, tag) {
+			added = append(added, tag)
+		}
+	}
+	return added
+}
+
+// containsTag reports whether tags contains tag
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// sameAddresses reports whether a and b list the same addresses in order
+func sameAddresses(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// SavedSearchRequest is the body of POST /api/searches and
+// PUT /api/searches/{id}
+type SavedSearchRequest struct {
+	Name string `json:"name"`
+	storage.SearchCriteria
+}
+
+// handleListSavedSearches handles GET /api/searches
+func (s *Server) handleListSavedSearches(w http.ResponseWriter, r *http.Request) {
+	searches, err := s.storage.ListSavedSearches()
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"searches": searches,
+		"count":    len(searches),
+	})
+}
+
+// handleCreateSavedSearch handles POST /api/searches
+func (s *Server) handleCreateSavedSearch(w http.ResponseWriter, r *http.Request) {
+	search, ok := s.decodeSavedSearch(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.storage.CreateSavedSearch(search); err != nil {
+		s.sendSavedSearchError(w, err)
+		return
+	}
+
+	s.sendSuccess(w, search)
+}
+
+// handleGetSavedSearch handles GET /api/searches/{id}
+func (s *Server) handleGetSavedSearch(w http.ResponseWriter, r *http.Request) {
+	search, err := s.storage.GetSavedSearch(parseIDParam(r))
+	if err != nil {
+		s.sendSavedSearchError(w, err)
+		return
+	}
+
+	s.sendSuccess(w, search)
+}
+
+// handleUpdateSavedSearch handles PUT /api/searches/{id}, which replaces
+// the name and criteria
+func (s *Server) handleUpdateSavedSearch(w http.ResponseWriter, r *http.Request) {
+	search, ok := s.decodeSavedSearch(w, r)
+	if !ok {
+		return
+	}
+	search.ID = parseIDParam(r)
+
+	if err := s.storage.UpdateSavedSearch(search); err != nil {
+		s.sendSavedSearchError(w, err)
+		return
+	}
+
+	s.sendSuccess(w, search)
+}
+
+// handleDeleteSavedSearch handles DELETE /api/searches/{id}
+func (s *Server) handleDeleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+	id := parseIDParam(r)
+	if err := s.storage.DeleteSavedSearch(id); err != nil {
+		s.sendSavedSearchError(w, err)
+		return
+	}
+	s.audit(r, "search.delete", strconv.FormatInt(id, 10), nil)
+
+	s.sendSuccess(w, map[string]interface{}{
+		"message": "Saved search deleted",
+	})
+}
+
+// handleRunSavedSearch handles GET /api/searches/{id}/emails
+func (s *Server) handleRunSavedSearch(w http.ResponseWriter, r *http.Request) {
+	search, err := s.storage.GetSavedSearch(parseIDParam(r))
+	if err != nil {
+		s.sendSavedSearchError(w, err)
+		return
+	}
+
+	limit := parseIntParam(r, "limit", 50, 1, 100)
+	offset := parseIntParam(r, "offset", 0, 0, math.MaxInt)
+
+	filter := search.Filter()
+	filter.Mailboxes = requestIdentity(r).Mailboxes
+	if token := r.URL.Query().Get("cursor"); token != "" {
+		cursor, err := storage.ParseCursor(token)
+		if err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_CURSOR", "Invalid cursor")
+			return
+		}
+		filter.Cursor = cursor
+		offset = 0
+	}
+
+	result, err := s.storage.ListEmails(filter, limit, offset)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"search":     search,
+		"emails":     result.Emails,
+		"total":      result.Total,
+		"limit":      limit,
+		"offset":     offset,
+		"nextCursor": result.NextCursor,
+	})
+}
+
+// decodeSavedSearch reads and checks a saved search from the request body.
+// The query is run once so syntax errors are reported now rather than when
+// the search is used.
+func (s *Server) decodeSavedSearch(w http.ResponseWriter, r *http.Request) (*storage.SavedSearch, bool) {
+	var req SavedSearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return nil, false
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "name must not be empty")
+		return nil, false
+	}
+
+	search := &storage.SavedSearch{Name: req.Name, SearchCriteria: req.SearchCriteria}
+	if search.Query != "" {
+		if err := storage.ValidateSearch(search.Query); err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_QUERY", err.Error())
+			return nil, false
+		}
+		if _, err := s.storage.ListEmails(search.Filter(), 1, 0); err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_QUERY", "Invalid search query: "+err.Error())
+			return nil, false
+		}
+	}
+	return search, true
+}
+
+func (s *Server) sendSavedSearchError(w http.ResponseWriter, err error) {
+	switch err {
+	case storage.ErrNotFound:
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Saved search not found")
+	case storage.ErrNameTaken:
+		s.sendError(w, http.StatusConflict, "NAME_TAKEN", "A saved search with this name already exists")
+	default:
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+	}
+}
+
+// matchingSearches returns the names of the saved searches email matches
+func (s *Server) matchingSearches(email *storage.Email) []string {
+	names := []string{}
+
+	searches, err := s.storage.ListSavedSearches()
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Failed to list saved searches")
+		return names
+	}
+	for _, search := range searches {
+		match, err := s.storage.EmailMatches(email.ID, search.Filter())
+		if err != nil {
+			s.logger.Warn().Err(err).Str("search", search.Name).Msg("Failed to match saved search")
+			continue
+		}
+		if match {
+			names = append(names, search.Name)
+		}
+	}
+	return names
+}
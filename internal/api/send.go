@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"gowebmail/internal/email"
+	"gowebmail/internal/ingest"
+	"gowebmail/internal/quota"
+)
+
+// SendRequest is the body of POST /api/send
+type SendRequest struct {
+	From        string            `json:"from"`
+	To          []string          `json:"to"`
+	CC          []string          `json:"cc,omitempty"`
+	BCC         []string          `json:"bcc,omitempty"` // envelope only
+	Subject     string            `json:"subject"`
+	Text        string            `json:"text,omitempty"`
+	HTML        string            `json:"html,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Attachments []SendAttachment  `json:"attachments,omitempty"`
+}
+
+// SendAttachment is an attachment of a SendRequest
+type SendAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType,omitempty"`
+	Content     string `json:"content"` // base64
+}
+
+// handleSendEmail handles POST /api/send. The message is composed from the
+// request and delivered through the same pipeline as mail received over
+// SMTP.
+func (s *Server) handleSendEmail(w http.ResponseWriter, r *http.Request) {
+	if s.ingest == nil {
+		s.sendError(w, http.StatusServiceUnavailable, "SEND_UNAVAILABLE", "Sending is not configured")
+		return
+	}
+
+	var req SendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	draft, rcpts, err := req.draft()
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	raw, err := email.Compose(draft)
+	if err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	if max := s.config.SMTP.MaxMessageSize; max > 0 && int64(len(raw)) > max {
+		s.sendError(w, http.StatusRequestEntityTooLarge, "MESSAGE_TOO_LARGE", errMessageTooLarge.Error())
+		return
+	}
+
+	from, _ := mail.ParseAddress(req.From)
+	stored, err := s.ingest.Deliver(bytes.NewReader(raw), &ingest.Envelope{
+		Source: "api",
+		From:   from.Address,
+		To:     rcpts,
+	})
+	if err != nil {
+		if errors.Is(err, quota.ErrQuotaExceeded) {
+			s.sendError(w, http.StatusInsufficientStorage, "QUOTA_EXCEEDED", err.Error())
+			return
+		}
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, stored)
+}
+
+// draft checks the request and returns the message to compose and the
+// envelope recipients
+func (req *SendRequest) draft() (*email.Draft, []string, error) {
+	if _, err := mail.ParseAddress(req.From); err != nil {
+		return nil, nil, errors.New("from must be a valid address")
+	}
+
+	var rcpts []string
+	for _, list := range [][]string{req.To, req.CC, req.BCC} {
+		for _, address := range list {
+			parsed, err := mail.ParseAddress(address)
+			if err != nil {
+				return nil, nil, errors.New("invalid recipient " + address)
+			}
+			rcpts = append(rcpts, parsed.Address)
+		}
+	}
+	if len(rcpts) == 0 {
+		return nil, nil, errors.New("at least one of to, cc or bcc is required")
+	}
+
+	for name := range req.Headers {
+		if name == "" || strings.ContainsAny(name, ": \t\r\n") {
+			return nil, nil, errors.New("invalid header name " + name)
+		}
+	}
+
+	draft := &email.Draft{
+		From:    req.From,
+		To:      req.To,
+		CC:      req.CC,
+		Subject: req.Subject,
+		Text:    req.Text,
+		HTML:    req.HTML,
+		Headers: req.Headers,
+	}
+	for _, a := range req.Attachments {
+		content, err := base64.StdEncoding.DecodeString(a.Content)
+		if err != nil {
+			return nil, nil, errors.New("content of attachment " + a.Filename + " is not valid base64")
+		}
+		if a.Filename == "" {
+			return nil, nil, errors.New("attachments need a filename")
+		}
+		draft.Attachments = append(draft.Attachments, email.DraftAttachment{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Content:     content,
+		})
+	}
+	return draft, rcpts, nil
+}
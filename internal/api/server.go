@@ -3,23 +3,85 @@ package api
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 
+	"gowebmail/internal/access"
+	"gowebmail/internal/acme"
 	"gowebmail/internal/config"
+	"gowebmail/internal/events"
+	"gowebmail/internal/graphql"
+	"gowebmail/internal/ingest"
+	"gowebmail/internal/linkcheck"
+	"gowebmail/internal/maintenance"
+	"gowebmail/internal/notify"
+	"gowebmail/internal/oidc"
+	"gowebmail/internal/relay"
+	"gowebmail/internal/render"
+	"gowebmail/internal/retention"
 	"gowebmail/internal/storage"
+	"gowebmail/internal/webhook"
 )
 
 // Server represents the HTTP API server
 type Server struct {
 	config  *config.Config
+	auth    atomic.Pointer[config.AuthConfig] // replaced by Reload
 	storage storage.Storage
 	router  *mux.Router
 	logger  zerolog.Logger
 	wsHub   *WebSocketHub
 	server  *http.Server
+	relay   *relay.Relayer
+	started time.Time
+
+	webhooks *webhook.Dispatcher
+	notifier *notify.Notifier
+	pusher   *notify.Pusher
+	events   *events.Publisher
+	renderer *render.Renderer
+	links    *linkcheck.Checker
+	oidc     *oidc.Provider
+
+	maintenance *maintenance.Manager
+	retention   *retention.Manager
+	ingest      *ingest.Pipeline
+
+	// Readiness: checks besides storage, and whether Shutdown has begun
+	readiness []readinessCheck
+	draining  atomic.Bool
+
+	// In-process event listeners, see publish
+	listeners   map[chan *WebSocketMessage]struct{}
+	listenersMu sync.RWMutex
+
+	graphql      *graphql.Schema
+	graphqlConns *connSet
+
+	// HTTPS: certificates from ACME, and the plain HTTP listener that
+	// redirects to HTTPS
+	acme     *acme.Manager
+	redirect *http.Server
+	stopACME context.CancelFunc
+
+	// sessions are those of the web UI, signed in at POST /api/login
+	sessions *sessionStore
+	// lockout slows down guessing of passwords and API keys
+	lockout *lockout
+	// static is the route of the web UI's files, which are public when
+	// the UI signs in with a password
+	static *mux.Route
+
+	// namespaces are the servers of the namespaces, by name, served under
+	// /ns/<name>/
+	namespaces map[string]*Server
 }
 
 // NewServer creates a new HTTP API server
@@ -30,6 +92,40 @@ func NewServer(cfg *config.Config, store storage.Storage, logger zerolog.Logger)
 		router:  mux.NewRouter(),
 		logger:  logger,
 		wsHub:   NewWebSocketHub(logger),
+		started: time.Now(),
+
+		listeners:    make(map[chan *WebSocketMessage]struct{}),
+		graphqlConns: newConnSet(),
+		sessions:     newSessionStore(),
+		lockout:      newLockout(),
+	}
+	s.graphql = s.graphqlSchema()
+	s.auth.Store(&cfg.Web.Auth)
+
+	if cfg.Relay.Enabled {
+		s.relay = relay.NewRelayer(&cfg.Relay, logger)
+	}
+
+	// Created even when disabled, so Reload can enable webhooks
+	s.webhooks = webhook.NewDispatcher(&cfg.Webhooks, logger)
+	s.notifier = notify.NewNotifier(&cfg.Notifications, logger)
+	s.pusher = notify.NewPusher(&cfg.Push, store, logger)
+	s.events = events.NewPublisher(&cfg.Events, store, logger)
+
+	if cfg.Render.Enabled {
+		s.renderer = render.NewRenderer(&cfg.Render, logger)
+	}
+
+	if cfg.LinkCheck.Enabled {
+		s.links = linkcheck.NewChecker(&cfg.LinkCheck, logger)
+	}
+
+	if cfg.Web.Auth.OIDC.Enabled {
+		s.oidc = oidc.NewProvider(&cfg.Web.Auth.OIDC, logger)
+	}
+
+	if cfg.HTTP.TLS.Enabled && cfg.HTTP.TLS.ACME.Enabled {
+		s.acme = acme.NewManager(&cfg.HTTP.TLS.ACME, logger)
 	}
 
 	s.setupRoutes()
@@ -37,7 +133,7 @@ func NewServer(cfg *config.Config, store storage.Storage, logger zerolog.Logger)
 
 	s.server = &http.Server{
 		Addr:         fmt.Sprintf("%s:%d", cfg.HTTP.Host, cfg.HTTP.Port),
-		Handler:      s.router,
+		Handler:      http.HandlerFunc(s.serveHTTP),
 		ReadTimeout:  cfg.HTTP.ReadTimeout,
 		WriteTimeout: cfg.HTTP.WriteTimeout,
 	}
@@ -53,26 +149,125 @@ func (s *Server) setupRoutes() {
 	// Email endpoints
 	api.HandleFunc("/emails", s.handleListEmails).Methods("GET")
 	api.HandleFunc("/emails/{id:[0-9]+}", s.handleGetEmail).Methods("GET")
+	api.HandleFunc("/emails/by-message-id/{messageId:.+}", s.handleGetEmailByMessageID).Methods("GET", "HEAD")
+	api.HandleFunc("/emails/{id:[0-9]+}", s.handleUpdateEmail).Methods("PATCH")
 	api.HandleFunc("/emails/{id:[0-9]+}", s.handleDeleteEmail).Methods("DELETE")
 	api.HandleFunc("/emails", s.handleDeleteAllEmails).Methods("DELETE")
 	api.HandleFunc("/emails/search", s.handleSearchEmails).Methods("GET")
+	api.HandleFunc("/emails/export", s.handleExportEmails).Methods("GET")
+	api.HandleFunc("/emails/batch", s.handleBatchEmails).Methods("POST")
+	api.HandleFunc("/emails/import", s.handleImportEmails).Methods("POST")
 	api.HandleFunc("/emails/{id:[0-9]+}/raw", s.handleGetEmailRaw).Methods("GET")
+	api.HandleFunc("/emails/{id:[0-9]+}/download", s.handleDownloadEmail).Methods("GET")
 	api.HandleFunc("/emails/{id:[0-9]+}/html", s.handleGetEmailHTML).Methods("GET")
+	api.HandleFunc("/emails/{id:[0-9]+}/screenshot", s.handleGetEmailScreenshot).Methods("GET")
+	api.HandleFunc("/emails/{id:[0-9]+}/lint", s.handleLintEmail).Methods("GET")
+	api.HandleFunc("/emails/{id:[0-9]+}/amp", s.handleGetAMP).Methods("GET")
+	api.HandleFunc("/emails/{id:[0-9]+}/calendar", s.handleGetCalendar).Methods("GET")
+	api.HandleFunc("/emails/{id:[0-9]+}/received", s.handleGetReceived).Methods("GET")
+	api.HandleFunc("/emails/{id:[0-9]+}/checklinks", s.handleCheckLinks).Methods("POST")
+	api.HandleFunc("/emails/{id:[0-9]+}/unsubscribe-test", s.handleUnsubscribeTest).Methods("POST")
+	api.HandleFunc("/emails/{id:[0-9]+}/forward", s.handleForwardEmail).Methods("POST")
+	api.HandleFunc("/emails/{id:[0-9]+}/notes", s.handleListNotes).Methods("GET")
+	api.HandleFunc("/emails/{id:[0-9]+}/notes", s.handleCreateNote).Methods("POST")
+	api.HandleFunc("/emails/{id:[0-9]+}/notes/{nid:[0-9]+}", s.handleUpdateNote).Methods("PUT")
+	api.HandleFunc("/emails/{id:[0-9]+}/notes/{nid:[0-9]+}", s.handleDeleteNote).Methods("DELETE")
 	api.HandleFunc("/emails/{id:[0-9]+}/attachments/{aid:[0-9]+}", s.handleGetAttachment).Methods("GET")
+	api.HandleFunc("/emails/{id:[0-9]+}/attachments/{aid:[0-9]+}/view", s.handleViewAttachment).Methods("GET")
+	api.HandleFunc("/emails/{id:[0-9]+}/attachments/{aid:[0-9]+}/message", s.handleGetAttachedMessage).Methods("GET")
+	api.HandleFunc("/attachments", s.handleListAttachments).Methods("GET")
 
-	// Stats endpoint
+	// Compose a message and deliver it locally
+	api.HandleFunc("/send", s.handleSendEmail).Methods("POST")
+	api.HandleFunc("/ingest", s.handleIngestEmail).Methods("POST")
+	api.HandleFunc("/inbound/ses", s.handleInboundSES).Methods("POST")
+	api.HandleFunc("/inbound/sendgrid", s.handleInboundSendGrid).Methods("POST")
+	api.HandleFunc("/dev/generate", s.handleGenerateEmails).Methods("POST")
+
+	// Threads
+	api.HandleFunc("/threads", s.handleListThreads).Methods("GET")
+	api.HandleFunc("/threads/{tid:[0-9a-f]+}", s.handleGetThread).Methods("GET")
+	api.HandleFunc("/templates", s.handleListTemplates).Methods("GET")
+
+	// Saved search endpoints
+	api.HandleFunc("/searches", s.handleListSavedSearches).Methods("GET")
+	api.HandleFunc("/searches", s.handleCreateSavedSearch).Methods("POST")
+	api.HandleFunc("/searches/{id:[0-9]+}", s.handleGetSavedSearch).Methods("GET")
+	api.HandleFunc("/searches/{id:[0-9]+}", s.handleUpdateSavedSearch).Methods("PUT")
+	api.HandleFunc("/searches/{id:[0-9]+}", s.handleDeleteSavedSearch).Methods("DELETE")
+	api.HandleFunc("/searches/{id:[0-9]+}/emails", s.handleRunSavedSearch).Methods("GET")
+
+	// Push notification subscriptions
+	api.HandleFunc("/push", s.handleGetPush).Methods("GET")
+	api.HandleFunc("/push/subscriptions", s.handleListPushSubscriptions).Methods("GET")
+	api.HandleFunc("/push/subscriptions", s.handleCreatePushSubscription).Methods("POST")
+	api.HandleFunc("/push/subscriptions/{id:[0-9]+}", s.handleDeletePushSubscription).Methods("DELETE")
+	api.HandleFunc("/push/subscriptions/{id:[0-9]+}/test", s.handleTestPushSubscription).Methods("POST")
+
+	// Mailbox endpoints
+	api.HandleFunc("/mailboxes", s.handleListMailboxes).Methods("GET")
+	api.HandleFunc("/addresses/{address}/emails", s.handleAddressEmails).Methods("GET")
+
+	// Stats endpoints
 	api.HandleFunc("/stats", s.handleGetStats).Methods("GET")
+	api.HandleFunc("/stats/storage", s.handleGetStorageStats).Methods("GET")
+	api.HandleFunc("/stats/ingest", s.handleGetIngestStats).Methods("GET")
+
+	// Admin endpoints
+	api.HandleFunc("/admin/backup", s.handleBackup).Methods("POST")
+	api.HandleFunc("/admin/maintenance", s.handleGetMaintenance).Methods("GET")
+	api.HandleFunc("/admin/maintenance", s.handleRunMaintenance).Methods("POST")
+	api.HandleFunc("/admin/retention/run", s.handleRunRetention).Methods("POST")
+	api.HandleFunc("/admin/api-keys", s.handleListAPIKeys).Methods("GET")
+	api.HandleFunc("/admin/api-keys", s.handleCreateAPIKey).Methods("POST")
+	api.HandleFunc("/admin/api-keys/{id:[0-9]+}", s.handleDeleteAPIKey).Methods("DELETE")
+
+	// Audit log
+	api.HandleFunc("/audit", s.handleListAudit).Methods("GET")
+
+	// Web UI sessions
+	api.HandleFunc("/login", s.handleSessionLogin).Methods("POST")
+	api.HandleFunc("/logout", s.handleSessionLogout).Methods("POST")
+	api.HandleFunc("/session", s.handleGetSession).Methods("GET")
 
 	// Health check
 	api.HandleFunc("/health", s.handleHealth).Methods("GET")
+	s.router.HandleFunc("/livez", s.handleLivez).Methods("GET")
+	s.router.HandleFunc("/readyz", s.handleReadyz).Methods("GET")
+
+	// Webhooks
+	api.HandleFunc("/webhooks/deliveries", s.handleListWebhookDeliveries).Methods("GET")
+
+	// GraphQL endpoint; GET also accepts WebSocket subscriptions
+	api.HandleFunc("/graphql", s.handleGraphQL).Methods("GET", "POST")
+
+	// OpenAPI document; requests are validated against it
+	api.HandleFunc("/openapi.json", s.handleOpenAPI).Methods("GET")
+	api.Use(s.userAccessMiddleware)
+	api.Use(s.validationMiddleware)
 
 	// WebSocket
 	s.router.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		s.wsHub.ServeWS(w, r)
 	})
 
+	// OIDC login flow for the web UI
+	if s.oidc != nil {
+		s.router.HandleFunc("/auth/login", s.handleLogin).Methods("GET")
+		s.router.HandleFunc("/auth/callback", s.handleLoginCallback).Methods("GET")
+		s.router.HandleFunc("/auth/logout", s.handleLogout).Methods("GET", "POST")
+	}
+
+	// Profiling and runtime stats
+	if s.config.Debug.Enabled {
+		if s.config.Debug.APIKey == "" && !s.auth.Load().Enabled && s.oidc == nil {
+			s.logger.Warn().Msg("Debug endpoints are enabled without authentication")
+		}
+		s.setupDebugRoutes()
+	}
+
 	// Static files (web UI)
-	s.router.PathPrefix("/").Handler(http.FileServer(http.Dir("./web")))
+	s.static = s.router.PathPrefix("/").Handler(http.FileServer(http.Dir("./web")))
 }
 
 // setupMiddleware configures middleware
@@ -81,41 +276,199 @@ func (s *Server) setupMiddleware() {
 	s.router.Use(s.corsMiddleware)
 	s.router.Use(s.recoveryMiddleware)
 
-	// Optional auth middleware
-	if s.config.Web.Auth.Enabled {
-		s.router.Use(s.authMiddleware)
+	if s.config.HTTP.Compression.Enabled {
+		s.router.Use(s.compressionMiddleware)
 	}
+
+	// Auth middleware, which passes requests through while auth is
+	// disabled, so Reload can enable it
+	s.router.Use(s.authMiddleware)
+}
+
+// Reload applies the settings of cfg that can change while running: web
+// authentication credentials and API keys, webhooks and notifications.
+// OIDC, and everything else, keep their settings until restarted.
+func (s *Server) Reload(cfg *config.Config) {
+	auth := cfg.Web.Auth
+	auth.OIDC = s.auth.Load().OIDC
+	s.auth.Store(&auth)
+	s.webhooks.SetConfig(cfg.Webhooks)
+	s.notifier.SetConfig(cfg.Notifications)
+}
+
+// SetNamespaces sets the servers of the namespaces, served under
+// /ns/<name>/ with their own credentials. They are shut down with s.
+func (s *Server) SetNamespaces(namespaces map[string]*Server) {
+	s.namespaces = namespaces
+	for _, ns := range namespaces {
+		go ns.wsHub.Run()
+	}
+}
+
+// serveHTTP serves the namespaces, and everything else with the router
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/ns/")
+	if !ok {
+		s.router.ServeHTTP(w, r)
+		return
+	}
+
+	name, _, found := strings.Cut(rest, "/")
+	ns, ok := s.namespaces[name]
+	if !ok {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Namespace not found")
+		return
+	}
+	if !found {
+		http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+		return
+	}
+	http.StripPrefix("/ns/"+name, ns.router).ServeHTTP(w, r)
+}
+
+// SetMaintenanceManager sets the manager used by the maintenance endpoints
+func (s *Server) SetMaintenanceManager(m *maintenance.Manager) {
+	s.maintenance = m
+}
+
+// SetRetentionManager sets the manager used by the retention endpoint
+func (s *Server) SetRetentionManager(m *retention.Manager) {
+	s.retention = m
+}
+
+// SetIngestPipeline sets the pipeline used to import emails
+func (s *Server) SetIngestPipeline(p *ingest.Pipeline) {
+	s.ingest = p
 }
 
 // Start starts the HTTP server
 func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve serves HTTP, or HTTPS if TLS is enabled, on l until Shutdown is
+// called
+func (s *Server) Serve(l net.Listener) error {
+	// Refuse clients outside the access lists before anything else
+	l, err := access.Listener(l, &s.config.HTTP.Access, s.logger)
+	if err != nil {
+		return err
+	}
+
 	// Start WebSocket hub
 	go s.wsHub.Run()
 
+	if !s.config.HTTP.TLS.Enabled {
+		s.logger.Info().
+			Str("addr", l.Addr().String()).
+			Msg("Starting HTTP server")
+
+		return s.server.Serve(l)
+	}
+
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return err
+	}
+	s.server.TLSConfig = tlsConfig
+
+	if s.acme != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.stopACME = cancel
+		go s.acme.Start(ctx)
+	}
+
+	// HTTP-01 challenges arrive on port 80
+	redirectAddr := s.config.HTTP.TLS.RedirectAddr
+	if redirectAddr == "" && s.acme != nil {
+		redirectAddr = ":80"
+	}
+	if redirectAddr != "" {
+		s.redirect = &http.Server{
+			Addr:         redirectAddr,
+			Handler:      s.redirectHandler(),
+			ReadTimeout:  s.config.HTTP.ReadTimeout,
+			WriteTimeout: s.config.HTTP.WriteTimeout,
+		}
+		go func() {
+			if err := s.redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.logger.Error().Err(err).Str("addr", redirectAddr).Msg("HTTP redirect listener failed")
+			}
+		}()
+	}
+
 	s.logger.Info().
-		Str("addr", s.server.Addr).
-		Msg("Starting HTTP server")
+		Str("addr", l.Addr().String()).
+		Str("redirect_addr", redirectAddr).
+		Bool("acme", s.acme != nil).
+		Msg("Starting HTTPS server")
 
-	return s.server.ListenAndServe()
+	return s.server.ServeTLS(l, "", "")
 }
 
 // Shutdown gracefully shuts down the HTTP server
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.logger.Info().Msg("Shutting down HTTP server")
-	s.wsHub.Shutdown()
+	for _, ns := range s.namespaces {
+		ns.shutdown(ctx)
+	}
+	s.shutdown(ctx)
+	if s.stopACME != nil {
+		s.stopACME()
+	}
+	if s.redirect != nil {
+		s.redirect.Shutdown(ctx)
+	}
 	return s.server.Shutdown(ctx)
 }
 
-// BroadcastNewEmail broadcasts a new email notification via WebSocket
+// shutdown closes the connections that outlive requests, and stops
+// webhook deliveries and event publishing
+func (s *Server) shutdown(ctx context.Context) {
+	s.draining.Store(true)
+	s.wsHub.Shutdown(ctx)
+	s.graphqlConns.closeAll()
+	s.webhooks.Stop()
+	s.notifier.Stop()
+	s.pusher.Stop()
+	s.events.Stop()
+}
+
+// BroadcastNewEmail broadcasts a new email notification via WebSocket and
+// webhooks, posts it to the chat notifications it matches and pushes it
+// to its recipients' subscriptions
 func (s *Server) BroadcastNewEmail(email *storage.Email) {
-	s.wsHub.Broadcast(&WebSocketMessage{
-		Type: "email.new",
+	searches := s.matchingSearches(email)
+	s.notifier.Notify(email, searches)
+	s.pusher.Notify(email)
+	s.publish(&WebSocketMessage{
+		Type:       "email.new",
+		recipients: emailRecipients(email),
 		Data: map[string]interface{}{
 			"id":         email.ID,
 			"from":       email.From,
 			"to":         email.To,
 			"subject":    email.Subject,
 			"receivedAt": email.ReceivedAt,
+			"threadId":   email.ThreadID,
+
+			// Names of the saved searches the email matches, used to
+			// filter WebSocket and webhook subscriptions
+			"savedSearches": searches,
 		},
 	})
+	s.autoRelay(email, nil)
+}
+
+// BroadcastDeletedEmail announces the deletion of an email via WebSocket,
+// webhooks and event sinks
+func (s *Server) BroadcastDeletedEmail(id int64) {
+	s.publish(&WebSocketMessage{
+		Type: "email.deleted",
+		Data: map[string]interface{}{"id": id},
+	})
 }
@@ -0,0 +1,276 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gowebmail/internal/config"
+)
+
+const (
+	// loginSessionCookie holds the session of a user signed in with a
+	// password at POST /api/login
+	loginSessionCookie = "gowebmail_sid"
+	// csrfHeader carries the CSRF token of the session on requests that
+	// change something
+	csrfHeader = "X-CSRF-Token"
+)
+
+// LoginRequest is the body of POST /api/login
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loginSession is a web UI session. It keeps a digest of the password
+// signed in with, so changing the password ends it.
+type loginSession struct {
+	username string
+	password [sha256.Size]byte
+	csrf     string
+	expires  time.Time
+}
+
+// sessionStore holds the web UI sessions, by token. Sessions live in
+// memory, so a restart signs everyone out.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]*loginSession
+}
+
+func newSessionStore() *sessionStore {
+	return &sessionStore{sessions: make(map[string]*loginSession)}
+}
+
+// create starts a session and returns its token
+func (st *sessionStore) create(username, password string, timeout time.Duration) (string, *loginSession, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	csrf, err := randomToken()
+	if err != nil {
+		return "", nil, err
+	}
+	sess := &loginSession{
+		username: username,
+		password: sha256.Sum256([]byte(password)),
+		csrf:     csrf,
+		expires:  time.Now().Add(timeout),
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	now := time.Now()
+	for t, other := range st.sessions {
+		if now.After(other.expires) {
+			delete(st.sessions, t)
+		}
+	}
+	st.sessions[token] = sess
+	return token, sess, nil
+}
+
+// get returns the session of a token, or nil when there is none or it has
+// expired. Using a session extends it by timeout.
+func (st *sessionStore) get(token string, timeout time.Duration) *loginSession {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	sess, ok := st.sessions[token]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if now.After(sess.expires) {
+		delete(st.sessions, token)
+		return nil
+	}
+	sess.expires = now.Add(timeout)
+	c := *sess
+	return &c
+}
+
+func (st *sessionStore) delete(token string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	delete(st.sessions, token)
+}
+
+// randomToken returns 32 random bytes, base64url encoded
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// checkPassword returns the identity of the shared account or a configured
+// user with these credentials
+func checkPassword(auth *config.AuthConfig, username, password string) (identity, bool) {
+	if user := checkUser(auth, username, password); user != nil {
+		return userIdentity(user, authSession), true
+	}
+
+	// Constant time comparison to prevent timing attacks
+	usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1
+	passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) == 1
+	if !usernameMatch || !passwordMatch {
+		return identity{}, false
+	}
+	return identity{Name: username, Auth: authSession}, true
+}
+
+// sessionIdentity returns the identity of a session under the current
+// credentials. Sessions of removed users, or signed in with a password
+// that has since changed, are no longer valid.
+func sessionIdentity(auth *config.AuthConfig, sess *loginSession) (identity, bool) {
+	if user := findUser(auth, sess.username); user != nil {
+		if user.Password == "" || !samePassword(sess, user.Password) {
+			return identity{}, false
+		}
+		return userIdentity(user, authSession), true
+	}
+	if sess.username != auth.Username || !samePassword(sess, auth.Password) {
+		return identity{}, false
+	}
+	return identity{Name: sess.username, Auth: authSession}, true
+}
+
+func samePassword(sess *loginSession, password string) bool {
+	sum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(sum[:], sess.password[:]) == 1
+}
+
+// sessionAuthenticate authenticates r with its session cookie, and
+// reports whether it did. Requests that change something must also send
+// the session's CSRF token, which other sites cannot read.
+func (s *Server) sessionAuthenticate(w http.ResponseWriter, r *http.Request, next http.Handler, auth *config.AuthConfig) bool {
+	cookie, err := r.Cookie(loginSessionCookie)
+	if err != nil {
+		return false
+	}
+	sess := s.sessions.get(cookie.Value, auth.SessionTimeout)
+	if sess == nil {
+		return false
+	}
+	id, ok := sessionIdentity(auth, sess)
+	if !ok {
+		s.sessions.delete(cookie.Value)
+		return false
+	}
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(sess.csrf)) != 1 {
+		s.sendError(w, http.StatusForbidden, "CSRF_TOKEN_INVALID", "Missing or invalid "+csrfHeader+" header")
+		return true
+	}
+	s.serveUser(w, r, next, id)
+	return true
+}
+
+// passwordLogin reports whether the web UI signs in with a password at
+// POST /api/login. OIDC replaces it.
+func (s *Server) passwordLogin() bool {
+	return s.auth.Load().Enabled && s.oidc == nil
+}
+
+// handleSessionLogin handles POST /api/login, which starts a session of
+// the web UI in an HttpOnly cookie and returns its CSRF token
+func (s *Server) handleSessionLogin(w http.ResponseWriter, r *http.Request) {
+	if !s.passwordLogin() {
+		s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Password login is not enabled")
+		return
+	}
+
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if s.lockedOut(w, r, req.Username) {
+		return
+	}
+	auth := s.auth.Load()
+	id, ok := checkPassword(auth, req.Username, req.Password)
+	if !ok {
+		s.authFailed(r, authSession, req.Username)
+		s.sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid credentials")
+		return
+	}
+	s.authSucceeded(req.Username)
+
+	token, sess, err := s.sessions.create(req.Username, req.Password, auth.SessionTimeout)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "INTERNAL_ERROR", err.Error())
+		return
+	}
+	// The cookie outlives the session; the server decides when it expires
+	s.setCookie(w, loginSessionCookie, token, cookiePath(r), 0)
+	s.audit(withIdentity(r, id), "session.login", id.Name, nil)
+
+	s.sendSuccess(w, sessionInfo(id, sess.csrf))
+}
+
+// handleSessionLogout handles POST /api/logout, which ends the session of
+// the cookie it is sent with
+func (s *Server) handleSessionLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(loginSessionCookie); err == nil {
+		if sess := s.sessions.get(cookie.Value, 0); sess != nil {
+			s.sessions.delete(cookie.Value)
+			if id, ok := sessionIdentity(s.auth.Load(), sess); ok {
+				s.audit(withIdentity(r, id), "session.logout", id.Name, nil)
+			}
+		}
+	}
+	s.setCookie(w, loginSessionCookie, "", cookiePath(r), -1)
+	s.sendSuccess(w, map[string]interface{}{"message": "Signed out"})
+}
+
+// handleGetSession handles GET /api/session, which tells the web UI who is
+// signed in, and the CSRF token of a session
+func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request) {
+	id := requestIdentity(r)
+	csrf := ""
+	if id.Auth == authSession {
+		if cookie, err := r.Cookie(loginSessionCookie); err == nil {
+			if sess := s.sessions.get(cookie.Value, s.auth.Load().SessionTimeout); sess != nil {
+				csrf = sess.csrf
+			}
+		}
+	}
+	s.sendSuccess(w, sessionInfo(id, csrf))
+}
+
+func sessionInfo(id identity, csrf string) map[string]interface{} {
+	info := map[string]interface{}{
+		"username": id.Name,
+		"auth":     id.Auth,
+		"admin":    id.Mailboxes == nil,
+	}
+	if id.Mailboxes != nil {
+		info["mailboxes"] = id.Mailboxes
+	}
+	if csrf != "" {
+		info["csrfToken"] = csrf
+	}
+	return info
+}
+
+// cookiePath returns the path of the UI r was sent from: / or, for a
+// namespace, /ns/<name>/, so that each namespace has its own session
+func cookiePath(r *http.Request) string {
+	uri, _, _ := strings.Cut(r.RequestURI, "?")
+	if prefix, ok := strings.CutSuffix(uri, r.URL.Path); ok && prefix != "" {
+		return prefix + "/"
+	}
+	return "/"
+}
@@ -0,0 +1,31 @@
+package api
+
+import (
+	"math"
+	"net/http"
+)
+
+// handleListTemplates handles GET /api/templates, which groups the emails
+// matching the list filters by the template named in the templates.header
+// header, so the templates a test run covered can be checked
+func (s *Server) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+	limit := parseIntParam(r, "limit", 50, 1, 100)
+	offset := parseIntParam(r, "offset", 0, 0, math.MaxInt)
+	samples := parseIntParam(r, "samples", 3, 0, 10)
+
+	header := s.config.Templates.Header
+	result, err := s.storage.ListTemplates(header, parseEmailFilter(r), samples, limit, offset)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"header":    header,
+		"templates": result.Templates,
+		"total":     result.Total,
+		"untagged":  result.Untagged,
+		"limit":     limit,
+		"offset":    offset,
+	})
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/gorilla/mux"
+
+	"gowebmail/internal/storage"
+)
+
+// handleListThreads handles GET /api/threads
+func (s *Server) handleListThreads(w http.ResponseWriter, r *http.Request) {
+	limit := parseIntParam(r, "limit", 50, 1, 100)
+	offset := parseIntParam(r, "offset", 0, 0, math.MaxInt)
+
+	result, err := s.storage.ListThreads(limit, offset)
+	if err != nil {
+		s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		return
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"threads": result.Threads,
+		"total":   result.Total,
+		"limit":   limit,
+		"offset":  offset,
+	})
+}
+
+// handleGetThread handles GET /api/threads/{tid}
+func (s *Server) handleGetThread(w http.ResponseWriter, r *http.Request) {
+	threadID := mux.Vars(r)["tid"]
+
+	emails, err := s.storage.GetThread(threadID)
+	if err != nil {
+		if err == storage.ErrNotFound {
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Thread not found")
+		} else {
+			s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+		}
+		return
+	}
+
+	// Users restricted to mailboxes see their part of the thread
+	if mailboxes := requestIdentity(r).Mailboxes; mailboxes != nil {
+		visible := []*storage.Email{}
+		for _, email := range emails {
+			if seesEmail(mailboxes, email) {
+				visible = append(visible, email)
+			}
+		}
+		if len(visible) == 0 {
+			s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Thread not found")
+			return
+		}
+		emails = visible
+	}
+
+	s.sendSuccess(w, map[string]interface{}{
+		"threadId": threadID,
+		"emails":   emails,
+		"count":    len(emails),
+	})
+}
@@ -0,0 +1,140 @@
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+// certCheckInterval limits how often certificate files are checked for
+// changes
+const certCheckInterval = time.Minute
+
+// tlsConfig returns the TLS configuration of the HTTP server, with
+// certificates from ACME or from the configured files, and the CAs of
+// client certificates
+func (s *Server) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if clientAuth := s.config.HTTP.TLS.ClientAuth; clientAuth.Enabled {
+		pool, err := loadCertPool(clientAuth.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("client_auth.ca_file: %w", err)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if clientAuth.Required {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	if s.acme != nil {
+		cfg.GetCertificate = s.acme.GetCertificate
+		return cfg, nil
+	}
+
+	certs, err := newCertReloader(&s.config.HTTP.TLS, s.logger)
+	if err != nil {
+		return nil, err
+	}
+	cfg.GetCertificate = certs.GetCertificate
+	return cfg, nil
+}
+
+// redirectHandler sends plain HTTP requests to the HTTPS listener. ACME
+// challenges are answered before redirecting.
+func (s *Server) redirectHandler() http.Handler {
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if s.config.HTTP.Port != 443 {
+			host = net.JoinHostPort(host, fmt.Sprint(s.config.HTTP.Port))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusFound)
+	})
+
+	if s.acme != nil {
+		handler = s.acme.HTTPHandler(handler)
+	}
+	return handler
+}
+
+// certReloader serves a certificate from files and reloads it when they
+// change, so certificates renewed by an external tool are picked up
+// without a restart
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   zerolog.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(cfg *config.TLSConfig, logger zerolog.Logger) (*certReloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, fmt.Errorf("TLS requires cert_file and key_file, or ACME")
+	}
+
+	c := &certReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile, logger: logger}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// GetCertificate returns the certificate, for tls.Config
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if modTime := c.lastModified(); modTime.After(c.modTime) {
+			if err := c.load(); err != nil {
+				c.logger.Error().Err(err).Msg("Failed to reload TLS certificate; keeping the current one")
+			} else {
+				c.logger.Info().Str("cert_file", c.certFile).Msg("TLS certificate reloaded")
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// load reads the certificate and key; the caller holds mu unless the
+// reloader is not yet shared
+func (c *certReloader) load() error {
+	c.checked = time.Now()
+	modTime := c.lastModified()
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// lastModified returns the later modification time of the two files
+func (c *certReloader) lastModified() time.Time {
+	var latest time.Time
+	for _, path := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
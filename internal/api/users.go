@@ -0,0 +1,202 @@
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// userOperations are the operations open to users restricted to their
+// mailboxes, by operation ID. Their handlers limit the emails they list or
+// act on to the user's; the rest of the API is for admins.
+var userOperations = map[string]bool{
+	"listEmails":           true,
+	"getEmail":             true,
+	"getEmailByMessageID":  true,
+	"headEmailByMessageID": true,
+	"updateEmail":          true,
+	"deleteEmail":          true,
+	"searchEmails":         true,
+	"exportEmails":         true,
+	"batchEmails":          true,
+	"getEmailRaw":          true,
+	"getEmailReceived":     true,
+	"downloadEmail":        true,
+	"getEmailHTML":         true,
+	"getEmailAMP":          true,
+	"getEmailScreenshot":   true,
+	"getEmailCalendar":     true,
+	"lintEmail":            true,
+	"checkEmailLinks":      true,
+	"testEmailUnsubscribe": true,
+	"forwardEmail":         true,
+	"listNotes":            true,
+	"createNote":           true,
+	"updateNote":           true,
+	"deleteNote":           true,
+	"getAttachment":        true,
+	"viewAttachment":       true,
+	"getAttachedMessage":   true,
+	"listAttachments":      true,
+	"sendEmail":            true,
+	"getThread":            true,
+	"listSavedSearches":    true,
+	"getSavedSearch":       true,
+	"runSavedSearch":       true,
+
+	"getPush":                true,
+	"listPushSubscriptions":  true,
+	"createPushSubscription": true,
+	"deletePushSubscription": true,
+	"testPushSubscription":   true,
+
+	"listMailboxes":     true,
+	"listAddressEmails": true,
+	"listTemplates":     true,
+	"getStats":          true,
+	"health":            true,
+	"openapi":           true,
+
+	"login":      true,
+	"logout":     true,
+	"getSession": true,
+}
+
+// findUser returns the configured user named username, or nil
+func findUser(auth *config.AuthConfig, username string) *config.UserConfig {
+	for i := range auth.Users {
+		if auth.Users[i].Username == username {
+			return &auth.Users[i]
+		}
+	}
+	return nil
+}
+
+// checkUser returns the configured user with these credentials, or nil
+func checkUser(auth *config.AuthConfig, username, password string) *config.UserConfig {
+	user := findUser(auth, username)
+	if user == nil || user.Password == "" {
+		return nil
+	}
+	// Constant time comparison to prevent timing attacks
+	if subtle.ConstantTimeCompare([]byte(password), []byte(user.Password)) != 1 {
+		return nil
+	}
+	return user
+}
+
+// userIdentity returns the identity of a configured user
+func userIdentity(user *config.UserConfig, auth string) identity {
+	id := identity{Name: user.Username, Auth: auth}
+	if !user.Admin {
+		// Never nil, which would see all mail
+		id.Mailboxes = append([]string{}, user.Mailboxes...)
+	}
+	return id
+}
+
+// serveUser passes a request of a configured user on. The debug endpoints
+// are for admins.
+func (s *Server) serveUser(w http.ResponseWriter, r *http.Request, next http.Handler, id identity) {
+	if id.Mailboxes != nil && strings.HasPrefix(r.URL.Path, "/debug/") {
+		s.sendError(w, http.StatusForbidden, "FORBIDDEN", "Not available to users restricted to mailboxes")
+		return
+	}
+	next.ServeHTTP(w, withIdentity(r, id))
+}
+
+// userAccessMiddleware keeps users restricted to mailboxes to the
+// operations open to them, and to the emails of their mailboxes. Emails
+// of other mailboxes are reported as not found.
+func (s *Server) userAccessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestIdentity(r).Mailboxes == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		var op *operation
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				op = findOperation(r.Method, template)
+			}
+		}
+		if op == nil || !userOperations[op.ID] {
+			s.sendError(w, http.StatusForbidden, "FORBIDDEN", "Not available to users restricted to mailboxes")
+			return
+		}
+
+		if strings.HasPrefix(op.Path, "/emails/{id}") {
+			visible, err := s.visible(r, parseIDParam(r))
+			if err != nil {
+				s.sendError(w, http.StatusInternalServerError, "STORAGE_ERROR", err.Error())
+				return
+			}
+			if !visible {
+				s.sendError(w, http.StatusNotFound, "NOT_FOUND", "Email not found")
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// visible reports whether the sender of r sees the email with this ID
+func (s *Server) visible(r *http.Request, id int64) (bool, error) {
+	mailboxes := requestIdentity(r).Mailboxes
+	if mailboxes == nil {
+		return true, nil
+	}
+	return s.storage.EmailMatches(id, &storage.EmailFilter{Mailboxes: mailboxes})
+}
+
+// seesAddress reports whether address, or an address pattern, is in one of
+// mailboxes. Nil mailboxes see every address.
+func seesAddress(mailboxes []string, address string) bool {
+	if mailboxes == nil {
+		return true
+	}
+	address = strings.ToLower(strings.TrimSpace(address))
+	for _, pattern := range mailboxes {
+		if ok, _ := path.Match(strings.ToLower(pattern), address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// seesEmail reports whether an email is addressed to one of mailboxes, in
+// a recipient field or the envelope, as EmailFilter.Mailboxes matches it
+func seesEmail(mailboxes []string, email *storage.Email) bool {
+	return seesAnyAddress(mailboxes, emailRecipients(email))
+}
+
+// seesAnyAddress reports whether one of addresses is in one of mailboxes
+func seesAnyAddress(mailboxes []string, addresses []string) bool {
+	if mailboxes == nil {
+		return true
+	}
+	for _, address := range addresses {
+		if seesAddress(mailboxes, address) {
+			return true
+		}
+	}
+	return false
+}
+
+// emailRecipients returns every recipient of an email: those of the
+// headers and the envelope
+func emailRecipients(email *storage.Email) []string {
+	var addresses []string
+	addresses = append(addresses, email.To...)
+	addresses = append(addresses, email.CC...)
+	addresses = append(addresses, email.BCC...)
+	return append(addresses, email.EnvelopeTo...)
+}
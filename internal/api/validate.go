@@ -0,0 +1,283 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxRequestBodySize bounds JSON request bodies read for validation
+const maxRequestBodySize = 1 << 20
+
+// validationMiddleware rejects API requests that do not match the
+// operation's parameters and body schema in the OpenAPI document
+func (s *Server) validationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		op := findOperation(r.Method, template)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := validateParams(op, r); err != nil {
+			s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+			return
+		}
+
+		if op.Body != nil {
+			limit := int64(maxRequestBodySize)
+			if op.MessageBody {
+				// Attachments are base64 encoded, which adds a third
+				limit = max(limit, s.config.SMTP.MaxMessageSize*4/3+maxRequestBodySize)
+			}
+			body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+			if err != nil {
+				s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Failed to read request body")
+				return
+			}
+			if int64(len(body)) > limit {
+				s.sendError(w, http.StatusRequestEntityTooLarge, "INVALID_REQUEST", "Request body too large")
+				return
+			}
+			if err := validateBody(op.Body, body); err != nil {
+				s.sendError(w, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// validateParams checks the query and path parameters of r against op
+func validateParams(op *operation, r *http.Request) error {
+	query := r.URL.Query()
+	vars := mux.Vars(r)
+
+	known := make(map[string]bool)
+	for _, p := range op.Params {
+		var value string
+		var present bool
+		switch p.In {
+		case "query":
+			known[p.Name] = true
+			value, present = query.Get(p.Name), query.Has(p.Name)
+		case "path":
+			value, present = vars[p.Name]
+		}
+
+		if !present || value == "" {
+			if p.Required {
+				return fmt.Errorf("missing required parameter %q", p.Name)
+			}
+			continue
+		}
+		if err := validateParam(p.Schema, value); err != nil {
+			return fmt.Errorf("parameter %q: %w", p.Name, err)
+		}
+	}
+
+	var unknown []string
+	for name := range query {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown parameter %q", unknown[0])
+	}
+
+	return nil
+}
+
+// validateParam checks a string parameter value against a schema
+func validateParam(sch schema, value string) error {
+	switch sch["type"] {
+	case "integer":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("must be an integer")
+		}
+		if min, ok := sch["minimum"].(int); ok && n < int64(min) {
+			return fmt.Errorf("must be at least %d", min)
+		}
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("must be a number")
+		}
+	case "boolean":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("must be a boolean")
+		}
+	case "string":
+		if sch["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, value); err != nil {
+				return fmt.Errorf("must be an RFC 3339 timestamp")
+			}
+		}
+	}
+	return validateEnum(sch, value)
+}
+
+// validateBody checks a JSON request body against a schema
+func validateBody(sch schema, body []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Errorf("invalid JSON body")
+	}
+	if decoder.More() {
+		return fmt.Errorf("invalid JSON body")
+	}
+
+	return validateValue(sch, value, "body")
+}
+
+// validateValue checks a decoded JSON value against the subset of JSON
+// Schema used in the operations table
+func validateValue(sch schema, value interface{}, path string) error {
+	if !matchesType(sch["type"], value) {
+		return fmt.Errorf("%s must be of type %s", path, typeName(sch["type"]))
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, _ := sch["properties"].(schema)
+		if required, ok := sch["required"].([]string); ok {
+			for _, name := range required {
+				if _, ok := v[name]; !ok {
+					return fmt.Errorf("%s.%s is required", path, name)
+				}
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := properties[name].(schema)
+			if !ok {
+				if sch["additionalProperties"] == false {
+					return fmt.Errorf("%s.%s is not allowed", path, name)
+				}
+				continue
+			}
+			if err := validateValue(prop, v[name], path+"."+name); err != nil {
+				return err
+			}
+		}
+
+	case []interface{}:
+		if min, ok := sch["minItems"].(int); ok && len(v) < min {
+			return fmt.Errorf("%s must have at least %d items", path, min)
+		}
+		if max, ok := sch["maxItems"].(int); ok && len(v) > max {
+			return fmt.Errorf("%s must have at most %d items", path, max)
+		}
+		if items, ok := sch["items"].(schema); ok {
+			for i, item := range v {
+				if err := validateValue(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+
+	case json.Number:
+		if min, ok := sch["minimum"].(int); ok {
+			if n, err := v.Float64(); err == nil && n < float64(min) {
+				return fmt.Errorf("%s must be at least %d", path, min)
+			}
+		}
+
+	case string:
+		if err := validateEnum(sch, v); err != nil {
+			return fmt.Errorf("%s %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// validateEnum checks value against the schema's enum, if any
+func validateEnum(sch schema, value string) error {
+	enum, ok := sch["enum"].([]string)
+	if !ok {
+		return nil
+	}
+	for _, allowed := range enum {
+		if value == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(enum, ", "))
+}
+
+// matchesType reports whether value has one of the schema types
+func matchesType(typ interface{}, value interface{}) bool {
+	switch t := typ.(type) {
+	case nil:
+		return true
+	case string:
+		return matchesSingleType(t, value)
+	case []string:
+		for _, single := range t {
+			if matchesSingleType(single, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchesSingleType(typ string, value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case string:
+		return typ == "string"
+	case []interface{}:
+		return typ == "array"
+	case map[string]interface{}:
+		return typ == "object"
+	case json.Number:
+		if typ == "number" {
+			return true
+		}
+		_, err := v.Int64()
+		return typ == "integer" && err == nil
+	}
+	return false
+}
+
+func typeName(typ interface{}) string {
+	if types, ok := typ.([]string); ok {
+		return strings.Join(types, " or ")
+	}
+	return fmt.Sprint(typ)
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"sync"
@@ -22,6 +23,9 @@ const (
 
 	// Maximum message size allowed from peer
 	maxMessageSize = 512
+
+	// Time allowed for the peer to answer a close frame
+	closeGracePeriod = time.Second
 )
 
 var upgrader = websocket.Upgrader{
@@ -40,6 +44,13 @@ type WebSocketHub struct {
 	unregister chan *WebSocketClient
 	logger     zerolog.Logger
 	mu         sync.RWMutex
+
+	// Shutdown: closing stops new clients, quit stops Run, which closes
+	// done when it returns, and writers tracks the write pumps
+	closing bool
+	quit    chan struct{}
+	done    chan struct{}
+	writers sync.WaitGroup
 }
 
 // WebSocketClient represents a connected WebSocket client
@@ -47,12 +58,36 @@ type WebSocketClient struct {
 	hub  *WebSocketHub
 	conn *websocket.Conn
 	send chan *WebSocketMessage
+
+	// readDone is closed when the read pump returns
+	readDone chan struct{}
+
+	// savedSearch limits email.new events to emails matching the saved
+	// search with this name
+	savedSearch string
+
+	// mailboxes are those of a user restricted to mailboxes; nil for
+	// clients that get all events
+	mailboxes []string
 }
 
 // WebSocketMessage represents a message sent over WebSocket
 type WebSocketMessage struct {
 	Type string                 `json:"type"`
 	Data map[string]interface{} `json:"data"`
+
+	// recipients of an email.new event, to send it to users restricted to
+	// mailboxes
+	recipients []string
+}
+
+// userEvents are the events sent to users restricted to mailboxes besides
+// the new emails of their mailboxes. They carry email IDs and flags only.
+var userEvents = map[string]bool{
+	"email.deleted":  true,
+	"email.read":     true,
+	"email.updated":  true,
+	"emails.cleared": true,
 }
 
 // NewWebSocketHub creates a new WebSocket hub
@@ -63,12 +98,15 @@ func NewWebSocketHub(logger zerolog.Logger) *WebSocketHub {
 		register:   make(chan *WebSocketClient),
 		unregister: make(chan *WebSocketClient),
 		logger:     logger,
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 }
 
-// Run starts the WebSocket hub
+// Run starts the WebSocket hub. It returns once Shutdown is called.
 func (h *WebSocketHub) Run() {
 	h.logger.Info().Msg("WebSocket hub started")
+	defer close(h.done)
 
 	for {
 		select {
@@ -88,17 +126,45 @@ func (h *WebSocketHub) Run() {
 			h.logger.Debug().Int("total", len(h.clients)).Msg("WebSocket client disconnected")
 
 		case message := <-h.broadcast:
-			h.mu.RLock()
-			for client := range h.clients {
+			h.deliver(message)
+
+		case <-h.quit:
+			// Deliver what was broadcast before shutdown. Closing the send
+			// channels lets each write pump flush its queue and send a
+			// close frame.
+			for drained := false; !drained; {
 				select {
-				case client.send <- message:
+				case message := <-h.broadcast:
+					h.deliver(message)
 				default:
-					// Client's send buffer is full, close it
-					close(client.send)
-					delete(h.clients, client)
+					drained = true
 				}
 			}
-			h.mu.RUnlock()
+			h.mu.Lock()
+			for client := range h.clients {
+				close(client.send)
+			}
+			h.mu.Unlock()
+			return
+		}
+	}
+}
+
+// deliver queues a message for every client that wants it
+func (h *WebSocketHub) deliver(message *WebSocketMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients {
+		if !client.wants(message) {
+			continue
+		}
+		select {
+		case client.send <- message:
+		default:
+			// Client's send buffer is full, close it
+			close(client.send)
+			delete(h.clients, client)
 		}
 	}
 }
@@ -112,21 +178,55 @@ func (h *WebSocketHub) Broadcast(message *WebSocketMessage) {
 	}
 }
 
-// Shutdown gracefully shuts down the WebSocket hub
-func (h *WebSocketHub) Shutdown() {
-	h.logger.Info().Msg("Shutting down WebSocket hub")
-
+// Shutdown stops accepting clients, delivers pending broadcasts and sends
+// each client a close frame. Connections that have not drained when ctx
+// ends are closed.
+func (h *WebSocketHub) Shutdown(ctx context.Context) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
+	if h.closing {
+		h.mu.Unlock()
+		return
+	}
+	h.closing = true
+	clients := len(h.clients)
+	h.mu.Unlock()
+
+	h.logger.Info().Int("clients", clients).Msg("Shutting down WebSocket hub")
+	close(h.quit)
+
+	drained := make(chan struct{})
+	go func() {
+		<-h.done
+		h.writers.Wait()
+		close(drained)
+	}()
 
-	for client := range h.clients {
-		client.conn.Close()
-		delete(h.clients, client)
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		h.logger.Warn().Msg("WebSocket clients did not drain in time, closing connections")
+		h.mu.Lock()
+		for client := range h.clients {
+			client.conn.Close()
+		}
+		h.mu.Unlock()
 	}
 }
 
+// isClosing reports whether Shutdown has been called
+func (h *WebSocketHub) isClosing() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.closing
+}
+
 // ServeWS handles WebSocket requests from clients
 func (h *WebSocketHub) ServeWS(w http.ResponseWriter, r *http.Request) {
+	if h.isClosing() {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		h.logger.Error().Err(err).Msg("WebSocket upgrade failed")
@@ -134,23 +234,65 @@ func (h *WebSocketHub) ServeWS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	client := &WebSocketClient{
-		hub:  h,
-		conn: conn,
-		send: make(chan *WebSocketMessage, 256),
+		hub:      h,
+		conn:     conn,
+		send:     make(chan *WebSocketMessage, 256),
+		readDone: make(chan struct{}),
+
+		savedSearch: r.URL.Query().Get("savedSearch"),
+		mailboxes:   requestIdentity(r).Mailboxes,
 	}
 
-	client.hub.register <- client
+	// Added before registering, so Shutdown's Wait, which follows Run's
+	// exit, sees it
+	h.writers.Add(1)
+	select {
+	case client.hub.register <- client:
+	case <-h.done:
+		h.writers.Done()
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(writeWait))
+		conn.Close()
+		return
+	}
 
 	// Start goroutines for reading and writing
 	go client.writePump()
 	go client.readPump()
 }
 
+// wants reports whether the client subscribed to message
+func (c *WebSocketClient) wants(message *WebSocketMessage) bool {
+	if c.mailboxes != nil {
+		if message.Type != "email.new" {
+			return userEvents[message.Type]
+		}
+		if !seesAnyAddress(c.mailboxes, message.recipients) {
+			return false
+		}
+	}
+	if c.savedSearch == "" || message.Type != "email.new" {
+		return true
+	}
+	names, _ := message.Data["savedSearches"].([]string)
+	for _, name := range names {
+		if name == c.savedSearch {
+			return true
+		}
+	}
+	return false
+}
+
 // readPump pumps messages from the WebSocket connection to the hub
 func (c *WebSocketClient) readPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
 		c.conn.Close()
+		close(c.readDone)
 	}()
 
 	c.conn.SetReadLimit(maxMessageSize)
@@ -178,6 +320,7 @@ func (c *WebSocketClient) writePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		c.hub.writers.Done()
 	}()
 
 	for {
@@ -186,7 +329,7 @@ func (c *WebSocketClient) writePump() {
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
 				// The hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.sendClose()
 				return
 			}
 
@@ -212,3 +355,21 @@ func (c *WebSocketClient) writePump() {
 		}
 	}
 }
+
+// sendClose sends a close frame and waits briefly for the client to answer
+// it, so the client sees a clean close rather than a dropped connection
+func (c *WebSocketClient) sendClose() {
+	code, text := websocket.ClosePolicyViolation, "send buffer full"
+	if c.hub.isClosing() {
+		code, text = websocket.CloseGoingAway, "server shutting down"
+	}
+	err := c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(writeWait))
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-c.readDone:
+	case <-time.After(closeGracePeriod):
+	}
+}
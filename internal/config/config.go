@@ -3,7 +3,6 @@ package config
 import (
 	"fmt"
 	"os"
-	"strconv"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -11,12 +10,37 @@ import (
 
 // Config represents the application configuration
 type Config struct {
-	SMTP      SMTPConfig      `yaml:"smtp"`
-	HTTP      HTTPConfig      `yaml:"http"`
-	Storage   StorageConfig   `yaml:"storage"`
-	Retention RetentionConfig `yaml:"retention"`
-	Web       WebConfig       `yaml:"web"`
-	Logging   LoggingConfig   `yaml:"logging"`
+	SMTP          SMTPConfig       `yaml:"smtp"`
+	POP3          POP3Config       `yaml:"pop3"`
+	IMAP          IMAPConfig       `yaml:"imap"`
+	HTTP          HTTPConfig       `yaml:"http"`
+	Storage       StorageConfig    `yaml:"storage"`
+	Retention     RetentionConfig  `yaml:"retention"`
+	Quotas        QuotaConfig      `yaml:"quotas"`
+	Relay         RelayConfig      `yaml:"relay"`
+	Webhooks      WebhookConfig    `yaml:"webhooks"`
+	Notifications NotifyConfig     `yaml:"notifications"`
+	Push          PushConfig       `yaml:"push"`
+	Events        EventsConfig     `yaml:"events"`
+	Render        RenderConfig     `yaml:"render"`
+	LinkCheck     LinkCheckConfig  `yaml:"link_check"`
+	Spam          SpamConfig       `yaml:"spam"`
+	MailAuth      MailAuthConfig   `yaml:"mail_auth"`
+	Decryption    DecryptionConfig `yaml:"decryption"`
+	Processing    ProcessingConfig `yaml:"processing"`
+	Templates     TemplatesConfig  `yaml:"templates"`
+	Addresses     AddressesConfig  `yaml:"addresses"`
+	Web           WebConfig        `yaml:"web"`
+	Logging       LoggingConfig    `yaml:"logging"`
+	Debug         DebugConfig      `yaml:"debug"`
+
+	// Namespaces split the mail of one instance between teams; mail routed
+	// to no namespace stays in the default one described above
+	Namespaces []NamespaceConfig `yaml:"namespaces"`
+
+	// envProblems are the environment variables Load could not apply,
+	// reported by Validate
+	envProblems []Problem
 }
 
 // SMTPConfig holds SMTP server configuration
@@ -25,6 +49,61 @@ type SMTPConfig struct {
 	Port           int           `yaml:"port"`
 	MaxMessageSize int64         `yaml:"max_message_size"`
 	Timeout        time.Duration `yaml:"timeout"`
+
+	Access AccessConfig `yaml:"access"`
+}
+
+// AccessConfig limits the clients of a listener by IP address, before
+// they get to authenticate. Entries are CIDR ranges or single addresses.
+// Clients in Deny are refused, as are clients outside Allow unless it is
+// empty.
+type AccessConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// POP3Config holds the POP3 server that lets mail clients download
+// captured mail
+type POP3Config struct {
+	Enabled bool          `yaml:"enabled"`
+	Host    string        `yaml:"host"`
+	Port    int           `yaml:"port"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Username and Password are required to log in; an empty password
+	// accepts any. With PerRecipient the user name is a recipient address
+	// and only mail delivered to it is listed, so Username is not checked.
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PerRecipient bool   `yaml:"per_recipient"`
+
+	// MaxMessages is how many of the most recent emails a mailbox lists
+	MaxMessages int `yaml:"max_messages"`
+
+	// Delete makes DELE remove emails from storage at QUIT; otherwise
+	// they are only hidden for the rest of the session
+	Delete bool `yaml:"delete"`
+
+	Access AccessConfig `yaml:"access"`
+}
+
+// IMAPConfig holds the IMAP server that lets mail clients browse captured
+// mail. Recipient mailboxes and tags are offered as folders besides INBOX.
+type IMAPConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Host    string        `yaml:"host"`
+	Port    int           `yaml:"port"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Username, Password and PerRecipient work as for POP3Config
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PerRecipient bool   `yaml:"per_recipient"`
+
+	// MaxMessages is how many of the most recent emails a folder lists
+	MaxMessages int `yaml:"max_messages"`
+
+	Access AccessConfig `yaml:"access"`
 }
 
 // HTTPConfig holds HTTP server configuration
@@ -33,12 +112,115 @@ type HTTPConfig struct {
 	Port         int           `yaml:"port"`
 	ReadTimeout  time.Duration `yaml:"read_timeout"`
 	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	Compression CompressionConfig `yaml:"compression"`
+	TLS         TLSConfig         `yaml:"tls"`
+	Access      AccessConfig      `yaml:"access"`
+}
+
+// TLSConfig holds HTTPS configuration for the HTTP server
+type TLSConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	CertFile string `yaml:"cert_file"` // PEM certificate chain; reloaded when it changes
+	KeyFile  string `yaml:"key_file"`
+
+	// RedirectAddr is a plain HTTP listener that redirects to HTTPS and
+	// answers ACME HTTP-01 challenges, e.g. ":80"; empty disables it
+	RedirectAddr string `yaml:"redirect_addr"`
+
+	ACME       ACMEConfig       `yaml:"acme"`
+	ClientAuth ClientAuthConfig `yaml:"client_auth"`
+}
+
+// ClientAuthConfig holds mutual TLS: authentication with client
+// certificates issued by the CAs in CAFile. A certificate maps to the
+// user named by one of its email addresses or its common name.
+type ClientAuthConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	CAFile  string `yaml:"ca_file"` // PEM certificates of the accepted CAs
+
+	// Required refuses connections without a certificate; otherwise the
+	// other authentication methods are accepted as well
+	Required bool `yaml:"required"`
+}
+
+// ACMEConfig holds automatic certificate management configuration. It
+// replaces cert_file and key_file.
+type ACMEConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	Domains      []string      `yaml:"domains"`
+	Email        string        `yaml:"email"`
+	DirectoryURL string        `yaml:"directory_url"`
+	CacheDir     string        `yaml:"cache_dir"` // account key and certificates
+	RenewBefore  time.Duration `yaml:"renew_before"`
+}
+
+// CompressionConfig holds HTTP response compression configuration
+type CompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Level   int  `yaml:"level"`    // 1 (fastest) to 9 (smallest)
+	MinSize int  `yaml:"min_size"` // smaller responses are sent uncompressed
 }
 
 // StorageConfig holds storage configuration
 type StorageConfig struct {
-	Type string `yaml:"type"`
-	Path string `yaml:"path"`
+	Type          string            `yaml:"type"`
+	Path          string            `yaml:"path"`
+	BackupPath    string            `yaml:"backup_path"`
+	Compression   string            `yaml:"compression"`    // none, gzip or zstd
+	EncryptionKey string            `yaml:"encryption_key"` // hex or base64 encoded 256-bit key
+	Blobs         BlobConfig        `yaml:"blobs"`
+	Maintenance   MaintenanceConfig `yaml:"maintenance"`
+	Batch         BatchConfig       `yaml:"batch"`
+
+	// ReadConnections is the size of the pool of read-only connections
+	// that queries use, so they do not wait behind writes. With 0, queries
+	// share the single writer connection.
+	ReadConnections int `yaml:"read_connections"`
+
+	// CacheSize is how many bytes of the emails and attachments read last
+	// are kept in memory, so that reading them again does not query the
+	// database. 0 disables the cache.
+	CacheSize int64 `yaml:"cache_size"`
+
+	// Fixtures is a directory of .eml files stored at startup, unless an
+	// email with the same Message-ID is already stored
+	Fixtures string `yaml:"fixtures"`
+}
+
+// BatchConfig holds configuration for coalescing email writes into
+// shared transactions
+type BatchConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	MaxSize       int           `yaml:"max_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// MaintenanceConfig holds scheduled database maintenance configuration
+type MaintenanceConfig struct {
+	Enabled           bool          `yaml:"enabled"`
+	Interval          time.Duration `yaml:"interval"`
+	IncrementalVacuum bool          `yaml:"incremental_vacuum"`
+	Analyze           bool          `yaml:"analyze"`
+}
+
+// BlobConfig holds configuration for where large payloads such as
+// attachments are stored
+type BlobConfig struct {
+	Type string   `yaml:"type"` // database, filesystem or s3
+	Path string   `yaml:"path"`
+	S3   S3Config `yaml:"s3"`
+}
+
+// S3Config holds configuration for an S3-compatible blob store
+type S3Config struct {
+	Endpoint        string `yaml:"endpoint"` // defaults to AWS for the region
+	Region          string `yaml:"region"`
+	Bucket          string `yaml:"bucket"`
+	Prefix          string `yaml:"prefix"`
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	PathStyle       bool   `yaml:"path_style"` // required by most MinIO setups
 }
 
 // RetentionConfig holds retention policy configuration
@@ -49,17 +231,347 @@ type RetentionConfig struct {
 	CleanupInterval time.Duration `yaml:"cleanup_interval"`
 }
 
+// QuotaConfig holds per-recipient mailbox quotas
+type QuotaConfig struct {
+	Enabled    bool                  `yaml:"enabled"`
+	QuotaLimit `yaml:",inline"`      // default for every mailbox
+	Overflow   string                `yaml:"overflow"`  // reject or evict
+	Mailboxes  map[string]QuotaLimit `yaml:"mailboxes"` // overrides by address
+}
+
+// QuotaLimit holds the limits of a single mailbox; zero means unlimited
+type QuotaLimit struct {
+	MaxMessages int   `yaml:"max_messages" json:"maxMessages"`
+	MaxBytes    int64 `yaml:"max_bytes" json:"maxBytes"`
+}
+
+// RelayConfig holds the upstream SMTP server used to release captured
+// emails to real recipients
+type RelayConfig struct {
+	Enabled            bool     `yaml:"enabled"`
+	Host               string   `yaml:"host"`
+	Port               int      `yaml:"port"`
+	Username           string   `yaml:"username"`
+	Password           string   `yaml:"password"`
+	TLS                string   `yaml:"tls"`  // none, starttls or tls
+	From               string   `yaml:"from"` // overrides the envelope sender
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+	AllowedRecipients  []string `yaml:"allowed_recipients"` // glob patterns, e.g. *@example.com
+
+	// Rules relay matching captured emails without anyone releasing them
+	Rules []RelayRule `yaml:"rules"`
+}
+
+// RelayRule relays captured emails automatically: when they arrive, or
+// when Tag is added to them if it is set
+type RelayRule struct {
+	Name       string   `yaml:"name"`
+	Recipients []string `yaml:"recipients"` // glob patterns; empty matches every recipient
+	Tag        string   `yaml:"tag"`
+	To         []string `yaml:"to"`   // delivered to instead of the matching recipients
+	From       string   `yaml:"from"` // rewrites the sender, in the envelope and the From header
+}
+
+// WebhookConfig holds the outgoing webhooks that are notified of email events
+type WebhookConfig struct {
+	Enabled        bool              `yaml:"enabled"`
+	Timeout        time.Duration     `yaml:"timeout"`
+	MaxAttempts    int               `yaml:"max_attempts"`
+	InitialBackoff time.Duration     `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration     `yaml:"max_backoff"`
+	LogSize        int               `yaml:"log_size"` // deliveries kept for the delivery log
+	Endpoints      []WebhookEndpoint `yaml:"endpoints"`
+}
+
+// WebhookEndpoint is a URL that receives webhook payloads
+type WebhookEndpoint struct {
+	URL    string   `yaml:"url"`
+	Secret string   `yaml:"secret"` // HMAC-SHA256 signing key
+	Events []string `yaml:"events"` // empty for all email events
+
+	// SavedSearch limits email.new events to emails matching the saved
+	// search with this name
+	SavedSearch string `yaml:"saved_search"`
+}
+
+// NotifyConfig holds the chat notifications posted when emails arrive
+type NotifyConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// BaseURL is where the web UI is reached, e.g.
+	// https://mail.example.com, for links to the email; without it
+	// messages have no link
+	BaseURL string `yaml:"base_url"`
+
+	Rules []NotifyRule `yaml:"rules"`
+}
+
+// NotifyRule posts the new emails matching all of its conditions to a
+// chat webhook. From, To and Subject are patterns where * matches any
+// characters, compared ignoring case; empty conditions match every email.
+type NotifyRule struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // slack, discord or teams
+	URL  string `yaml:"url"`  // the channel's incoming webhook
+
+	From        string `yaml:"from"`
+	To          string `yaml:"to"` // any recipient, e.g. alerts@*
+	Subject     string `yaml:"subject"`
+	SavedSearch string `yaml:"saved_search"`
+}
+
+// PushConfig holds the desktop and phone notifications that users
+// subscribe to, through the API, for the mail of their address: ntfy
+// topics and browsers with Web Push
+type PushConfig struct {
+	Enabled bool          `yaml:"enabled"`
+	Timeout time.Duration `yaml:"timeout"`
+
+	// BaseURL is where the web UI is reached, for links to the email
+	BaseURL string `yaml:"base_url"`
+
+	// NtfyServer serves the ntfy topics subscribed to by name
+	NtfyServer string `yaml:"ntfy_server"`
+
+	// VAPIDPrivateKey signs Web Push requests: a P-256 private key,
+	// base64url encoded, as printed by "gowebmail vapid-key". Browsers
+	// cannot subscribe without one. VAPIDSubject is a mailto: or https:
+	// contact for the push services.
+	VAPIDPrivateKey string `yaml:"vapid_private_key"`
+	VAPIDSubject    string `yaml:"vapid_subject"`
+}
+
+// EventsConfig holds the message brokers that email events are published
+// to
+type EventsConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Timeout   time.Duration `yaml:"timeout"`    // for connecting and for each publish
+	QueueSize int           `yaml:"queue_size"` // events waiting per sink; more are dropped
+	Sinks     []EventSink   `yaml:"sinks"`
+}
+
+// EventSink is a Kafka topic, NATS server, MQTT broker or AMQP exchange
+// that receives email events
+type EventSink struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // kafka, nats, mqtt or amqp
+
+	// URL is the NATS (nats:// or tls://), MQTT (mqtt:// or mqtts://) or
+	// AMQP (amqp:// or amqps://) server, with any credentials
+	URL string `yaml:"url"`
+
+	// Brokers are the Kafka bootstrap servers, as host:port
+	Brokers []string `yaml:"brokers"`
+	TLS     bool     `yaml:"tls"` // connect to the Kafka brokers over TLS
+	Topic   string   `yaml:"topic"`
+
+	// Subject prefixes the NATS subjects, MQTT topics and AMQP routing keys
+	// events are published with, e.g. gowebmail.email.new
+	Subject  string `yaml:"subject"`
+	Exchange string `yaml:"exchange"` // AMQP exchange
+
+	Events []string `yaml:"events"` // empty for email.new and email.deleted
+	Detail string   `yaml:"detail"` // summary, full or raw
+}
+
+// RenderConfig holds the headless browser used to screenshot HTML emails
+type RenderConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	ChromePath    string        `yaml:"chrome_path"` // searched on PATH when empty
+	Timeout       time.Duration `yaml:"timeout"`
+	Width         int           `yaml:"width"` // default viewport size
+	Height        int           `yaml:"height"`
+	MaxConcurrent int           `yaml:"max_concurrent"`
+	NoSandbox     bool          `yaml:"no_sandbox"` // required when running as root, e.g. in Docker
+}
+
+// LinkCheckConfig holds the checker that fetches the links of captured
+// emails on demand
+type LinkCheckConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	Timeout      time.Duration `yaml:"timeout"` // per link, including redirects
+	MaxRedirects int           `yaml:"max_redirects"`
+	MaxLinks     int           `yaml:"max_links"` // per email; further links are not checked
+	Concurrency  int           `yaml:"concurrency"`
+	UserAgent    string        `yaml:"user_agent"`
+
+	// BlockPrivate refuses links to loopback, private and link-local
+	// addresses, e.g. when the server can reach internal services
+	BlockPrivate bool `yaml:"block_private"`
+}
+
+// SpamConfig holds the spam filter that scores incoming emails
+type SpamConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Engine   string        `yaml:"engine"`   // rspamd or spamassassin
+	URL      string        `yaml:"url"`      // rspamd controller or normal worker, e.g. http://localhost:11333
+	Address  string        `yaml:"address"`  // spamd host:port, e.g. localhost:783
+	Password string        `yaml:"password"` // rspamd only
+	User     string        `yaml:"user"`     // spamd only; selects per-user preferences
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// ProcessingConfig holds the workers that process new emails once they
+// are saved: DKIM, SPF and DMARC verification, spam scoring, and the
+// webhooks, notifications and events announcing them
+type ProcessingConfig struct {
+	Workers     int           `yaml:"workers"`
+	MaxAttempts int           `yaml:"max_attempts"` // of a failing check, before it is given up
+	RetryDelay  time.Duration `yaml:"retry_delay"`  // doubled after every failed attempt
+}
+
+// TemplatesConfig names the header that identifies the template an email
+// was generated from, by which GET /api/templates groups mail
+type TemplatesConfig struct {
+	Header string `yaml:"header"`
+}
+
+// AddressesConfig says which addresses GET /api/addresses/{address}/emails
+// takes to be the same mailbox
+type AddressesConfig struct {
+	// SubaddressSeparators are the characters that start the tag of a
+	// subaddress, as + does in qa+run42@example.com; empty turns
+	// plus-addressing off
+	SubaddressSeparators string `yaml:"subaddress_separators"`
+
+	// IgnoreDots ignores dots in the local part, as Gmail does
+	IgnoreDots bool `yaml:"ignore_dots"`
+}
+
+// MailAuthConfig holds DKIM, SPF and DMARC verification of incoming emails
+type MailAuthConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	DNSServer string        `yaml:"dns_server"` // host:port; the system resolver when empty
+	Timeout   time.Duration `yaml:"timeout"`    // per message
+
+	// Records answer lookups before DNS, e.g. to test a DKIM key or SPF
+	// policy before publishing it. With StaticOnly, DNS is never queried.
+	Records    []DNSRecord `yaml:"records"`
+	StaticOnly bool        `yaml:"static_only"`
+}
+
+// DecryptionConfig holds the keys that decrypt incoming S/MIME and PGP
+// emails. Signed and encrypted emails are detected without them.
+type DecryptionConfig struct {
+	SMIME []SMIMEKeyConfig `yaml:"smime"`
+	PGP   []PGPKeyConfig   `yaml:"pgp"`
+}
+
+// SMIMEKeyConfig is the certificate and private key of an S/MIME
+// recipient, as PEM files
+type SMIMEKeyConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// PGPKeyConfig is a PGP secret key, armored or binary, as exported by gpg
+// --export-secret-keys. RSA and ECDH subkeys are used.
+type PGPKeyConfig struct {
+	KeyFile    string `yaml:"key_file"`
+	Passphrase string `yaml:"passphrase"` // if the key is protected
+}
+
+// DNSRecord is a static DNS record used by mail authentication
+type DNSRecord struct {
+	Name  string `yaml:"name"`  // e.g. selector._domainkey.example.com
+	Type  string `yaml:"type"`  // TXT, A, AAAA or MX
+	Value string `yaml:"value"` // MX values are "preference host" or just the host
+}
+
 // WebConfig holds web interface configuration
 type WebConfig struct {
 	Enabled bool       `yaml:"enabled"`
 	Auth    AuthConfig `yaml:"auth"`
 }
 
+// NamespaceConfig describes a namespace: mail kept apart from the rest of
+// the instance, in its own database, and served under /ns/<name>/ with its
+// own credentials
+type NamespaceConfig struct {
+	Name string `yaml:"name"`
+
+	// Mail is routed to the namespace when it arrives on SMTPPort, when the
+	// SMTP client authenticates as one of SMTPUsers, or otherwise for the
+	// RCPT TO addresses matching Recipients, e.g. *@team-a.example.com
+	SMTPPort   int      `yaml:"smtp_port"`
+	SMTPUsers  []string `yaml:"smtp_users"`
+	Recipients []string `yaml:"recipients"`
+
+	// StoragePath defaults to storage.path with the name appended, e.g.
+	// gowebmail-team-a.db
+	StoragePath string `yaml:"storage_path"`
+
+	// Auth protects the namespace's API, web UI and WebSocket; OIDC is not
+	// supported
+	Auth AuthConfig `yaml:"auth"`
+}
+
 // AuthConfig holds authentication configuration
 type AuthConfig struct {
-	Enabled  bool   `yaml:"enabled"`
+	Enabled  bool           `yaml:"enabled"`
+	Username string         `yaml:"username"`
+	Password string         `yaml:"password"`
+	APIKeys  []APIKeyConfig `yaml:"api_keys"`
+	OIDC     OIDCConfig     `yaml:"oidc"`
+
+	// Users sign in with their own credentials, next to the ones above,
+	// and see only the mail of their mailboxes
+	Users []UserConfig `yaml:"users"`
+
+	// SessionTimeout signs a web UI session, started at POST /api/login,
+	// out after this long without a request
+	SessionTimeout time.Duration `yaml:"session_timeout"`
+
+	Lockout LockoutConfig `yaml:"lockout"`
+}
+
+// LockoutConfig slows down guessing of passwords and API keys. After
+// MaxFailures failed attempts from an IP address, or for a username,
+// attempts are refused for Delay, doubled with every further failure up
+// to MaxDelay. Failures are forgotten after Window without one.
+type LockoutConfig struct {
+	Enabled     bool          `yaml:"enabled"`
+	MaxFailures int           `yaml:"max_failures"`
+	Delay       time.Duration `yaml:"delay"`
+	MaxDelay    time.Duration `yaml:"max_delay"`
+	Window      time.Duration `yaml:"window"`
+}
+
+// UserConfig is a user of the web UI and API. With OIDC, the user signs in
+// at the identity provider as Username, an email address or subject, and
+// Password is not used.
+type UserConfig struct {
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
+
+	// Mailboxes are the address patterns of the mail the user sees, e.g.
+	// alice@example.com or *@team-a.example.com. Admins see all mail and
+	// may use the rest of the API.
+	Mailboxes []string `yaml:"mailboxes"`
+	Admin     bool     `yaml:"admin"`
+}
+
+// OIDCConfig holds JWT / OpenID Connect authentication configuration. When
+// enabled it replaces basic auth; API keys keep working.
+type OIDCConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"` // expected aud claim; defaults to client_id
+	JWKSURL  string `yaml:"jwks_url"` // defaults to the issuer's discovery document
+
+	// The web UI login flow needs a client registered with the provider
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"` // e.g. https://mail.example.com/auth/callback
+	Scopes       []string `yaml:"scopes"`
+}
+
+// APIKeyConfig is an API key defined in the configuration
+type APIKeyConfig struct {
+	Name  string `yaml:"name"`
+	Key   string `yaml:"key"`
+	Scope string `yaml:"scope"` // read or full; defaults to full
 }
 
 // LoggingConfig holds logging configuration
@@ -67,6 +579,48 @@ type LoggingConfig struct {
 	Level  string `yaml:"level"`
 	Format string `yaml:"format"`
 	Output string `yaml:"output"`
+
+	// Syslog and GELF send the log to a syslog daemon or Graylog as well
+	// as to Output
+	Syslog SyslogConfig `yaml:"syslog"`
+	GELF   GELFConfig   `yaml:"gelf"`
+}
+
+// SyslogConfig sends the log to the local syslog daemon or a remote one
+type SyslogConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Network  string `yaml:"network"` // udp, tcp or tls for a remote daemon; empty for the local one
+	Address  string `yaml:"address"` // host:port of the remote daemon
+	Facility string `yaml:"facility"`
+	Tag      string `yaml:"tag"`
+}
+
+// SyslogFacilities are the facility codes of RFC 5424 by name
+var SyslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// GELFConfig sends the log to a Graylog GELF input
+type GELFConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Network string `yaml:"network"` // udp, tcp or tls
+	Address string `yaml:"address"` // host:port of the input
+	Host    string `yaml:"host"`    // the source shown in Graylog; defaults to the hostname
+
+	// Fields are added to every message, e.g. environment: staging
+	Fields map[string]string `yaml:"fields"`
+}
+
+// DebugConfig holds the pprof and runtime stats endpoints under /debug
+type DebugConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// APIKey is required for the debug endpoints when set, instead of the
+	// normal authentication
+	APIKey string `yaml:"api_key"`
 }
 
 // Load loads configuration from file and applies environment variable overrides
@@ -101,46 +655,8 @@ func loadFromFile(path string, cfg *Config) error {
 	return yaml.Unmarshal(data, cfg)
 }
 
-// applyEnvOverrides applies environment variable overrides to the configuration
-func applyEnvOverrides(cfg *Config) {
-	// SMTP overrides
-	if v := os.Getenv("GOWEBMAIL_SMTP_HOST"); v != "" {
-		cfg.SMTP.Host = v
-	}
-	if v := os.Getenv("GOWEBMAIL_SMTP_PORT"); v != "" {
-		if port, err := strconv.Atoi(v); err == nil {
-			cfg.SMTP.Port = port
-		}
-	}
-
-	// HTTP overrides
-	if v := os.Getenv("GOWEBMAIL_HTTP_HOST"); v != "" {
-		cfg.HTTP.Host = v
-	}
-	if v := os.Getenv("GOWEBMAIL_HTTP_PORT"); v != "" {
-		if port, err := strconv.Atoi(v); err == nil {
-			cfg.HTTP.Port = port
-		}
-	}
-
-	// Storage overrides
-	if v := os.Getenv("GOWEBMAIL_STORAGE_PATH"); v != "" {
-		cfg.Storage.Path = v
-	}
-
-	// Logging overrides
-	if v := os.Getenv("GOWEBMAIL_LOG_LEVEL"); v != "" {
-		cfg.Logging.Level = v
-	}
-
-	// Web auth overrides
-	if v := os.Getenv("GOWEBMAIL_WEB_AUTH_ENABLED"); v != "" {
-		cfg.Web.Auth.Enabled = v == "true" || v == "1"
-	}
-	if v := os.Getenv("GOWEBMAIL_WEB_AUTH_USERNAME"); v != "" {
-		cfg.Web.Auth.Username = v
-	}
-	if v := os.Getenv("GOWEBMAIL_WEB_AUTH_PASSWORD"); v != "" {
-		cfg.Web.Auth.Password = v
-	}
+// ClientCertificates reports whether the HTTP server authenticates clients
+// with certificates
+func (c *Config) ClientCertificates() bool {
+	return c.HTTP.TLS.Enabled && c.HTTP.TLS.ClientAuth.Enabled
 }
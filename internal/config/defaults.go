@@ -11,15 +11,68 @@ func Default() *Config {
 			MaxMessageSize: 10 * 1024 * 1024, // 10MB
 			Timeout:        30 * time.Second,
 		},
+		POP3: POP3Config{
+			Enabled:     false,
+			Host:        "0.0.0.0",
+			Port:        1110,
+			Timeout:     10 * time.Minute,
+			MaxMessages: 1000,
+			Delete:      true,
+		},
+		IMAP: IMAPConfig{
+			Enabled:     false,
+			Host:        "0.0.0.0",
+			Port:        1143,
+			Timeout:     30 * time.Minute,
+			MaxMessages: 1000,
+		},
 		HTTP: HTTPConfig{
 			Host:         "0.0.0.0",
 			Port:         8080,
 			ReadTimeout:  30 * time.Second,
 			WriteTimeout: 30 * time.Second,
+			Compression: CompressionConfig{
+				Enabled: true,
+				Level:   5,
+				MinSize: 1024,
+			},
+			TLS: TLSConfig{
+				ACME: ACMEConfig{
+					DirectoryURL: "https://acme-v02.api.letsencrypt.org/directory",
+					CacheDir:     "./data/acme",
+					RenewBefore:  30 * 24 * time.Hour,
+				},
+				ClientAuth: ClientAuthConfig{
+					Required: true,
+				},
+			},
 		},
 		Storage: StorageConfig{
-			Type: "sqlite",
-			Path: "./data/gowebmail.db",
+			Type:            "sqlite",
+			Path:            "./data/gowebmail.db",
+			BackupPath:      "./data/backups",
+			Compression:     "none",
+			ReadConnections: 4,
+			CacheSize:       64 << 20, // 64 MiB
+			Blobs: BlobConfig{
+				Type: "database",
+				Path: "./data/blobs",
+				S3: S3Config{
+					Region: "us-east-1",
+					Prefix: "gowebmail",
+				},
+			},
+			Maintenance: MaintenanceConfig{
+				Enabled:           true,
+				Interval:          6 * time.Hour,
+				IncrementalVacuum: false,
+				Analyze:           true,
+			},
+			Batch: BatchConfig{
+				Enabled:       false,
+				MaxSize:       100,
+				FlushInterval: 10 * time.Millisecond,
+			},
 		},
 		Retention: RetentionConfig{
 			Enabled:         true,
@@ -27,18 +80,110 @@ func Default() *Config {
 			MaxCount:        1000,
 			CleanupInterval: 1 * time.Hour,
 		},
+		Relay: RelayConfig{
+			Enabled: false,
+			Port:    587,
+			TLS:     "starttls",
+		},
+		Webhooks: WebhookConfig{
+			Enabled:        false,
+			Timeout:        10 * time.Second,
+			MaxAttempts:    5,
+			InitialBackoff: 1 * time.Second,
+			MaxBackoff:     5 * time.Minute,
+			LogSize:        100,
+		},
+		Notifications: NotifyConfig{
+			Enabled: false,
+			Timeout: 10 * time.Second,
+		},
+		Push: PushConfig{
+			Enabled:      false,
+			Timeout:      10 * time.Second,
+			NtfyServer:   "https://ntfy.sh",
+			VAPIDSubject: "mailto:gowebmail@localhost",
+		},
+		Events: EventsConfig{
+			Enabled:   false,
+			Timeout:   10 * time.Second,
+			QueueSize: 1000,
+		},
+		Render: RenderConfig{
+			Enabled:       false,
+			Timeout:       30 * time.Second,
+			Width:         600,
+			Height:        800,
+			MaxConcurrent: 2,
+		},
+		LinkCheck: LinkCheckConfig{
+			Enabled:      false,
+			Timeout:      10 * time.Second,
+			MaxRedirects: 10,
+			MaxLinks:     200,
+			Concurrency:  8,
+			UserAgent:    "gowebmail-linkcheck/1.0",
+		},
+		Spam: SpamConfig{
+			Enabled: false,
+			Engine:  "rspamd",
+			URL:     "http://localhost:11333",
+			Address: "localhost:783",
+			Timeout: 10 * time.Second,
+		},
+		MailAuth: MailAuthConfig{
+			Enabled: false,
+			Timeout: 10 * time.Second,
+		},
+		Processing: ProcessingConfig{
+			Workers:     4,
+			MaxAttempts: 5,
+			RetryDelay:  30 * time.Second,
+		},
+		Templates: TemplatesConfig{
+			Header: "X-Template-ID",
+		},
+		Addresses: AddressesConfig{
+			SubaddressSeparators: "+",
+		},
+		Quotas: QuotaConfig{
+			Enabled:  false,
+			Overflow: "reject",
+		},
 		Web: WebConfig{
 			Enabled: true,
 			Auth: AuthConfig{
-				Enabled:  false,
-				Username: "admin",
-				Password: "changeme",
+				Enabled:        false,
+				Username:       "admin",
+				Password:       "changeme",
+				SessionTimeout: 12 * time.Hour,
+				Lockout: LockoutConfig{
+					Enabled:     true,
+					MaxFailures: 5,
+					Delay:       30 * time.Second,
+					MaxDelay:    15 * time.Minute,
+					Window:      15 * time.Minute,
+				},
+				OIDC: OIDCConfig{
+					Scopes: []string{"openid", "email", "profile"},
+				},
 			},
 		},
 		Logging: LoggingConfig{
 			Level:  "info",
 			Format: "json",
 			Output: "stdout",
+			Syslog: SyslogConfig{
+				Enabled:  false,
+				Facility: "daemon",
+				Tag:      "gowebmail",
+			},
+			GELF: GELFConfig{
+				Enabled: false,
+				Network: "udp",
+			},
+		},
+		Debug: DebugConfig{
+			Enabled: false,
 		},
 	}
 }
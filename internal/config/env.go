@@ -0,0 +1,287 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the name of every environment variable that overrides a
+// setting
+const EnvPrefix = "GOWEBMAIL_"
+
+// EnvName returns the environment variable that overrides the setting at
+// a YAML path, e.g. GOWEBMAIL_SMTP_PORT for smtp.port
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// Settings returns the YAML paths of every setting that can be overridden,
+// in the order of the configuration file
+func Settings() []string {
+	var paths []string
+	walkSettings(reflect.ValueOf(Default()).Elem(), "", func(path string, _ reflect.Value) {
+		paths = append(paths, path)
+	})
+	return paths
+}
+
+// SecretsDirEnv names the directory of secret files, e.g. /run/secrets
+const SecretsDirEnv = "GOWEBMAIL_SECRETS_DIR"
+
+// applyEnvOverrides applies environment variable overrides to the
+// configuration. Every setting has one, named by EnvName; invalid values
+// are ignored and reported by Validate.
+func applyEnvOverrides(cfg *Config) {
+	env := cfg.newEnv()
+	walkSettings(reflect.ValueOf(cfg).Elem(), "", func(path string, field reflect.Value) {
+		env.apply(EnvName(path), func(v string) error { return setValue(field, v) })
+	})
+
+	// Shorthands that predate the generic names
+	env.apply("GOWEBMAIL_LOG_LEVEL", func(v string) error {
+		cfg.Logging.Level = v
+		return nil
+	})
+	env.apply("GOWEBMAIL_WEB_AUTH_API_KEY", func(v string) error {
+		cfg.Web.Auth.APIKeys = append(cfg.Web.Auth.APIKeys, APIKeyConfig{Name: "env", Key: v})
+		return nil
+	})
+	env.apply("GOWEBMAIL_WEBHOOKS_URL", func(v string) error {
+		endpoint := WebhookEndpoint{URL: v}
+		endpoint.Secret, _ = env.lookup("GOWEBMAIL_WEBHOOKS_SECRET")
+		cfg.Webhooks.Endpoints = append(cfg.Webhooks.Endpoints, endpoint)
+		return nil
+	})
+}
+
+// env reads overrides from the environment. A variable can also be given
+// as the path of a file holding its value, in NAME_FILE, or as a file
+// named NAME in the secrets directory, so that secrets can be mounted
+// rather than written into the environment.
+type env struct {
+	cfg     *Config
+	secrets map[string]string // variable name to file
+}
+
+func (c *Config) newEnv() *env {
+	e := &env{cfg: c, secrets: make(map[string]string)}
+
+	dir := os.Getenv(SecretsDirEnv)
+	if dir == "" {
+		return e
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		c.envError(SecretsDirEnv, err)
+		return e
+	}
+	for _, entry := range entries {
+		// Kubernetes keeps its bookkeeping in hidden entries
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		name := strings.ToUpper(entry.Name())
+		if !strings.HasPrefix(name, EnvPrefix) {
+			name = EnvPrefix + name
+		}
+		e.secrets[name] = filepath.Join(dir, entry.Name())
+	}
+	return e
+}
+
+// lookup returns the value of a variable, from the environment, from the
+// file named by NAME_FILE, or from the secrets directory, in that order.
+// The source is the variable or file the value came from.
+func (e *env) lookup(name string) (value, source string) {
+	if v := os.Getenv(name); v != "" {
+		return v, name
+	}
+
+	file := os.Getenv(name + "_FILE")
+	source = name + "_FILE"
+	if file == "" {
+		file, source = e.secrets[name], e.secrets[name]
+	}
+	if file == "" {
+		return "", ""
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		e.cfg.envError(source, err)
+		return "", ""
+	}
+	// Files written by editors and echo end in a newline
+	return strings.TrimRight(string(data), "\r\n"), source
+}
+
+// apply calls set with the value of a variable, if it has one
+func (e *env) apply(name string, set func(v string) error) {
+	v, source := e.lookup(name)
+	if v == "" {
+		return
+	}
+	err := set(v)
+	switch {
+	case err == nil:
+	case source == name:
+		e.cfg.invalidEnv(name, v, err.Error())
+	default:
+		// Values from files are likely secrets, so not repeated
+		e.cfg.envProblems = append(e.cfg.envProblems, Problem{
+			Field:   source,
+			Message: fmt.Sprintf("must contain %s; the file is ignored", err),
+			Warning: true,
+		})
+	}
+}
+
+// Set sets the setting at a YAML path, e.g. smtp.port, parsing value as
+// environment variables are: lists are comma-separated, and lists of
+// sections and maps are YAML, e.g. [{url: http://hooks.example.com}]
+func (c *Config) Set(path, value string) error {
+	field := reflect.ValueOf(c).Elem()
+	for _, name := range strings.Split(path, ".") {
+		var ok bool
+		if field.Kind() != reflect.Struct {
+			return fmt.Errorf("unknown setting %s", path)
+		}
+		if field, ok = settingField(field, name); !ok {
+			return fmt.Errorf("unknown setting %s", path)
+		}
+	}
+	if field.Kind() == reflect.Struct {
+		return fmt.Errorf("%s is a section; set its settings instead", path)
+	}
+	if err := setValue(field, value); err != nil {
+		return fmt.Errorf("%s must be %s, got %q", path, err, value)
+	}
+	return nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// walkSettings calls fn with the path and value of every setting in v, a
+// section, leaving out the sections themselves
+func walkSettings(v reflect.Value, path string, fn func(path string, field reflect.Value)) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		fieldPath := path
+		if name != "" { // inline sections share the path of their parent
+			fieldPath = strings.TrimPrefix(path+"."+name, ".")
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			walkSettings(v.Field(i), fieldPath, fn)
+		} else {
+			fn(fieldPath, v.Field(i))
+		}
+	}
+}
+
+// settingField returns the field of a section with a YAML name, looking
+// into inline sections
+func settingField(v reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if tag == name {
+			return v.Field(i), true
+		}
+		if tag == "" && field.Type.Kind() == reflect.Struct {
+			if inner, ok := settingField(v.Field(i), name); ok {
+				return inner, true
+			}
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// setValue parses s into a setting. The error describes what s must be.
+func setValue(field reflect.Value, s string) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return errors.New("a duration, e.g. 30s")
+		}
+		field.SetInt(int64(d))
+		return nil
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items).Convert(field.Type()))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		switch strings.ToLower(s) {
+		case "true", "1":
+			field.SetBool(true)
+		case "false", "0":
+			field.SetBool(false)
+		default:
+			return errors.New("true or false")
+		}
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return errors.New("an integer")
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.New("a number")
+		}
+		field.SetFloat(f)
+	default:
+		// Lists of sections and maps
+		value := reflect.New(field.Type())
+		if err := yaml.Unmarshal([]byte(s), value.Interface()); err != nil {
+			return errors.New("YAML")
+		}
+		field.Set(value.Elem())
+	}
+	return nil
+}
+
+// invalidEnv records an environment variable that could not be applied
+func (c *Config) invalidEnv(name, v, want string) {
+	c.envProblems = append(c.envProblems, Problem{
+		Field:   name,
+		Message: fmt.Sprintf("must be %s, got %q; the variable is ignored", want, v),
+		Warning: true,
+	})
+}
+
+// envError records a secret file or directory that could not be read.
+// Unlike an invalid value it is an error, since running without a
+// credential is rarely what was meant.
+func (c *Config) envError(name string, err error) {
+	c.envProblems = append(c.envProblems, Problem{
+		Field:   name,
+		Message: err.Error(),
+	})
+}
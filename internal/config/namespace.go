@@ -0,0 +1,140 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// validNamespace matches namespace names, which appear in URLs and file
+// names
+var validNamespace = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Namespace returns the configuration of a namespace: the instance's
+// settings, with the namespace's storage and credentials. The namespace is
+// served by the instance, so features tied to the listeners or to outside
+// systems, such as TLS, webhooks, notifications, push notifications, event
+// sinks and the debug endpoints, are left to the default namespace.
+func (c *Config) Namespace(ns NamespaceConfig) *Config {
+	cfg := *c
+	cfg.Namespaces = nil
+	cfg.envProblems = nil
+
+	cfg.Storage.Path = ns.StoragePath
+	if cfg.Storage.Path == "" {
+		cfg.Storage.Path = namespacePath(c.Storage.Path, ns.Name)
+	}
+	cfg.Storage.BackupPath = filepath.Join(c.Storage.BackupPath, ns.Name)
+	cfg.Storage.Fixtures = ""
+
+	// Blobs are removed once no email refers to them, so namespaces
+	// cannot share a store
+	cfg.Storage.Blobs.Path = filepath.Join(c.Storage.Blobs.Path, ns.Name)
+	cfg.Storage.Blobs.S3.Prefix = c.Storage.Blobs.S3.Prefix + ns.Name + "/"
+
+	cfg.Web.Auth = ns.Auth
+	cfg.Web.Auth.OIDC = OIDCConfig{}
+	if cfg.Web.Auth.SessionTimeout == 0 {
+		cfg.Web.Auth.SessionTimeout = c.Web.Auth.SessionTimeout
+	}
+	if cfg.Web.Auth.Lockout == (LockoutConfig{}) {
+		cfg.Web.Auth.Lockout = c.Web.Auth.Lockout
+	}
+	cfg.HTTP.TLS = TLSConfig{}
+	cfg.Webhooks = WebhookConfig{}
+	cfg.Events = EventsConfig{}
+	cfg.Notifications = NotifyConfig{}
+	cfg.Push = PushConfig{}
+	cfg.Debug = DebugConfig{}
+	cfg.POP3.Enabled = false
+	cfg.IMAP.Enabled = false
+
+	if ns.SMTPPort != 0 {
+		cfg.SMTP.Port = ns.SMTPPort
+	}
+	return &cfg
+}
+
+// namespacePath returns the database file of a namespace, beside the
+// default one
+func namespacePath(path, name string) string {
+	if path == ":memory:" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "-" + name + ext
+}
+
+// MatchRecipient reports whether a RCPT TO address matches one of the
+// namespace's recipient patterns, ignoring case
+func (ns *NamespaceConfig) MatchRecipient(addr string) bool {
+	addr = strings.ToLower(addr)
+	for _, pattern := range ns.Recipients {
+		if ok, _ := path.Match(strings.ToLower(pattern), addr); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateNamespaces checks the namespaces section
+func (c *Config) validateNamespaces(ps *problems) {
+	names := make(map[string]bool)
+	users := make(map[string]string)
+	paths := map[string]string{c.Storage.Path: "default"}
+	for i, ns := range c.Namespaces {
+		field := fmt.Sprintf("namespaces[%d]", i)
+		if !validNamespace.MatchString(ns.Name) {
+			ps.errorf(field+".name", "must be lower case letters, digits, - and _, got %q", ns.Name)
+		} else if names[ns.Name] {
+			ps.errorf(field+".name", "%q is used by another namespace", ns.Name)
+		}
+		names[ns.Name] = true
+
+		if ns.SMTPPort != 0 {
+			ps.port(field+".smtp_port", ns.SMTPPort)
+			if ns.SMTPPort == c.SMTP.Port {
+				ps.errorf(field+".smtp_port", "is the port of the default SMTP listener")
+			}
+		}
+		for _, user := range ns.SMTPUsers {
+			if other, ok := users[user]; ok {
+				ps.errorf(field+".smtp_users", "%q is also routed to namespace %q", user, other)
+			}
+			users[user] = ns.Name
+		}
+		for j, pattern := range ns.Recipients {
+			if _, err := path.Match(pattern, ""); err != nil {
+				ps.errorf(fmt.Sprintf("%s.recipients[%d]", field, j), "is not a valid pattern: %q", pattern)
+			}
+		}
+		if ns.SMTPPort == 0 && len(ns.SMTPUsers) == 0 && len(ns.Recipients) == 0 {
+			ps.warnf(field, "has no smtp_port, smtp_users or recipients, so no mail is routed to it")
+		}
+
+		// Every :memory: database is a separate one
+		if path := c.Namespace(ns).Storage.Path; path != ":memory:" {
+			if other, ok := paths[path]; ok {
+				ps.errorf(field+".storage_path", "%s is the database of namespace %q", path, other)
+			}
+			paths[path] = ns.Name
+		}
+
+		if !ns.Auth.Enabled {
+			ps.warnf(field+".auth", "is disabled, so anyone can read the namespace's mail")
+		}
+		if ns.Auth.OIDC.Enabled {
+			ps.errorf(field+".auth.oidc", "is not supported for namespaces")
+		}
+		for j, key := range ns.Auth.APIKeys {
+			if key.Key == "" {
+				ps.errorf(fmt.Sprintf("%s.auth.api_keys[%d].key", field, j), "must not be empty")
+			}
+			ps.oneOf(fmt.Sprintf("%s.auth.api_keys[%d].scope", field, j), key.Scope, "", "read", "full")
+		}
+		validateUsers(ps, field+".auth", &ns.Auth, c.ClientCertificates())
+		validateLockout(ps, field+".auth.lockout", &ns.Auth.Lockout)
+	}
+}
@@ -0,0 +1,567 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Problem is a configuration value the server cannot use, or, if Warning
+// is set, one it can use but that is likely a mistake
+type Problem struct {
+	Field   string // YAML path, e.g. retention.max_age, or the environment variable
+	Message string
+	Warning bool
+}
+
+func (p Problem) String() string {
+	return p.Field + ": " + p.Message
+}
+
+// Errors returns the problems that are not warnings
+func Errors(problems []Problem) []Problem {
+	var errs []Problem
+	for _, p := range problems {
+		if !p.Warning {
+			errs = append(errs, p)
+		}
+	}
+	return errs
+}
+
+// headerNamePattern matches a header field name (RFC 5322)
+var headerNamePattern = regexp.MustCompile(`^[!-9;-~]+$`)
+
+// problems collects the problems found by Validate
+type problems []Problem
+
+func (ps *problems) errorf(field, format string, args ...interface{}) {
+	*ps = append(*ps, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (ps *problems) warnf(field, format string, args ...interface{}) {
+	*ps = append(*ps, Problem{Field: field, Message: fmt.Sprintf(format, args...), Warning: true})
+}
+
+// port checks a TCP port number; 0 picks a free port
+func (ps *problems) port(field string, port int) {
+	if port < 0 || port > 65535 {
+		ps.errorf(field, "must be a port number between 0 and 65535, got %d", port)
+	}
+}
+
+// nonNegative checks a number where 0 means none or unlimited
+func (ps *problems) nonNegative(field string, v int64) {
+	if v < 0 {
+		ps.errorf(field, "must not be negative, got %d", v)
+	}
+}
+
+// nonNegativeDuration checks a duration where 0 means none or unlimited
+func (ps *problems) nonNegativeDuration(field string, d time.Duration) {
+	if d < 0 {
+		ps.errorf(field, "must not be negative, got %s", d)
+	}
+}
+
+// positiveDuration checks an interval or timeout that must be set
+func (ps *problems) positiveDuration(field string, d time.Duration) {
+	if d <= 0 {
+		ps.errorf(field, "must be a positive duration such as \"30s\" or \"1h\", got %s", d)
+	}
+}
+
+// oneOf checks an enumerated value
+func (ps *problems) oneOf(field, value string, allowed ...string) {
+	if oneOf(value, allowed...) {
+		return
+	}
+	ps.errorf(field, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+}
+
+// hostPort checks that a setting is an address as host:port
+func (ps *problems) hostPort(field, addr string) {
+	if _, _, err := net.SplitHostPort(addr); err != nil || addr == "" {
+		ps.errorf(field, "must be host:port, got %q", addr)
+	}
+}
+
+// access checks the address ranges of a listener's access lists
+func (ps *problems) access(field string, access *AccessConfig) {
+	lists := []struct {
+		name    string
+		entries []string
+	}{{"allow", access.Allow}, {"deny", access.Deny}}
+	for _, list := range lists {
+		for i, entry := range list.entries {
+			entry = strings.TrimSpace(entry)
+			var err error
+			if strings.Contains(entry, "/") {
+				_, err = netip.ParsePrefix(entry)
+			} else {
+				_, err = netip.ParseAddr(entry)
+			}
+			if err != nil {
+				ps.errorf(fmt.Sprintf("%s.%s[%d]", field, list.name, i), "must be an IP address or CIDR range, got %q", entry)
+			}
+		}
+	}
+}
+
+// oneOf reports whether value is one of allowed
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the configuration, including the environment variables
+// applied by Load, and returns the problems it finds
+func (c *Config) Validate() []Problem {
+	ps := problems(append([]Problem(nil), c.envProblems...))
+
+	ps.port("smtp.port", c.SMTP.Port)
+	ps.nonNegative("smtp.max_message_size", c.SMTP.MaxMessageSize)
+	ps.positiveDuration("smtp.timeout", c.SMTP.Timeout)
+	ps.access("smtp.access", &c.SMTP.Access)
+
+	if c.POP3.Enabled {
+		ps.port("pop3.port", c.POP3.Port)
+		ps.positiveDuration("pop3.timeout", c.POP3.Timeout)
+		ps.access("pop3.access", &c.POP3.Access)
+		if c.POP3.MaxMessages <= 0 {
+			ps.errorf("pop3.max_messages", "must be positive, got %d", c.POP3.MaxMessages)
+		}
+	}
+	if c.IMAP.Enabled {
+		ps.port("imap.port", c.IMAP.Port)
+		ps.positiveDuration("imap.timeout", c.IMAP.Timeout)
+		ps.access("imap.access", &c.IMAP.Access)
+		if c.IMAP.MaxMessages <= 0 {
+			ps.errorf("imap.max_messages", "must be positive, got %d", c.IMAP.MaxMessages)
+		}
+	}
+
+	c.validateHTTP(&ps)
+	c.validateStorage(&ps)
+
+	if c.Retention.Enabled {
+		ps.nonNegativeDuration("retention.max_age", c.Retention.MaxAge)
+		ps.nonNegative("retention.max_count", int64(c.Retention.MaxCount))
+		ps.positiveDuration("retention.cleanup_interval", c.Retention.CleanupInterval)
+		if c.Retention.MaxAge == 0 && c.Retention.MaxCount == 0 {
+			ps.warnf("retention", "enabled without max_age or max_count, so nothing is removed")
+		}
+	}
+
+	if c.Quotas.Enabled {
+		ps.oneOf("quotas.overflow", c.Quotas.Overflow, "reject", "evict")
+		ps.nonNegative("quotas.max_messages", int64(c.Quotas.MaxMessages))
+		ps.nonNegative("quotas.max_bytes", c.Quotas.MaxBytes)
+		for addr, limit := range c.Quotas.Mailboxes {
+			ps.nonNegative("quotas.mailboxes."+addr+".max_messages", int64(limit.MaxMessages))
+			ps.nonNegative("quotas.mailboxes."+addr+".max_bytes", limit.MaxBytes)
+		}
+	}
+
+	if c.Relay.Enabled {
+		if c.Relay.Host == "" {
+			ps.errorf("relay.host", "is required when relay is enabled")
+		}
+		ps.port("relay.port", c.Relay.Port)
+		ps.oneOf("relay.tls", c.Relay.TLS, "none", "starttls", "tls")
+	} else if len(c.Relay.Rules) > 0 {
+		ps.warnf("relay.rules", "are ignored because relay is disabled")
+	}
+	for i, rule := range c.Relay.Rules {
+		field := fmt.Sprintf("relay.rules[%d]", i)
+		if len(rule.Recipients) == 0 && rule.Tag == "" {
+			ps.errorf(field, "needs recipients or a tag; a rule without either would relay every email")
+		}
+		for j, pattern := range rule.Recipients {
+			if _, err := path.Match(pattern, ""); err != nil {
+				ps.errorf(fmt.Sprintf("%s.recipients[%d]", field, j), "is not a valid pattern: %q", pattern)
+			}
+		}
+		for j, to := range rule.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				ps.errorf(fmt.Sprintf("%s.to[%d]", field, j), "is not a valid address: %q", to)
+			}
+		}
+		if rule.From != "" {
+			if _, err := mail.ParseAddress(rule.From); err != nil {
+				ps.errorf(field+".from", "is not a valid address: %q", rule.From)
+			}
+		}
+	}
+
+	if c.Webhooks.Enabled {
+		ps.positiveDuration("webhooks.timeout", c.Webhooks.Timeout)
+		if c.Webhooks.MaxAttempts < 1 {
+			ps.errorf("webhooks.max_attempts", "must be at least 1, got %d", c.Webhooks.MaxAttempts)
+		}
+		ps.nonNegativeDuration("webhooks.initial_backoff", c.Webhooks.InitialBackoff)
+		ps.nonNegativeDuration("webhooks.max_backoff", c.Webhooks.MaxBackoff)
+		if len(c.Webhooks.Endpoints) == 0 {
+			ps.warnf("webhooks.endpoints", "webhooks are enabled without any endpoints")
+		}
+		for i, endpoint := range c.Webhooks.Endpoints {
+			u, err := url.Parse(endpoint.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				ps.errorf(fmt.Sprintf("webhooks.endpoints[%d].url", i), "must be an http or https URL, got %q", endpoint.URL)
+			}
+		}
+	}
+
+	if c.Notifications.Enabled {
+		ps.positiveDuration("notifications.timeout", c.Notifications.Timeout)
+		if len(c.Notifications.Rules) == 0 {
+			ps.warnf("notifications.rules", "notifications are enabled without any rules")
+		}
+		for i, rule := range c.Notifications.Rules {
+			field := fmt.Sprintf("notifications.rules[%d]", i)
+			ps.oneOf(field+".type", rule.Type, "slack", "discord", "teams")
+			u, err := url.Parse(rule.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				ps.errorf(field+".url", "must be an http or https URL, got %q", rule.URL)
+			}
+		}
+	}
+
+	if c.Push.Enabled {
+		ps.positiveDuration("push.timeout", c.Push.Timeout)
+		u, err := url.Parse(c.Push.NtfyServer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			ps.errorf("push.ntfy_server", "must be an http or https URL, got %q", c.Push.NtfyServer)
+		}
+		if c.Push.VAPIDPrivateKey == "" {
+			ps.warnf("push.vapid_private_key", "is not set, so browsers cannot subscribe; run \"gowebmail vapid-key\" to generate one")
+		} else if key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(c.Push.VAPIDPrivateKey, "=")); err != nil || len(key) != 32 {
+			ps.errorf("push.vapid_private_key", "must be a base64url encoded 32-byte P-256 private key")
+		}
+		if !strings.HasPrefix(c.Push.VAPIDSubject, "mailto:") && !strings.HasPrefix(c.Push.VAPIDSubject, "https:") {
+			ps.errorf("push.vapid_subject", "must be a mailto: or https: URL, got %q", c.Push.VAPIDSubject)
+		}
+	}
+
+	if c.Events.Enabled {
+		ps.positiveDuration("events.timeout", c.Events.Timeout)
+		if c.Events.QueueSize < 1 {
+			ps.errorf("events.queue_size", "must be at least 1, got %d", c.Events.QueueSize)
+		}
+		if len(c.Events.Sinks) == 0 {
+			ps.warnf("events.sinks", "events are enabled without any sinks")
+		}
+		for i, sink := range c.Events.Sinks {
+			field := fmt.Sprintf("events.sinks[%d]", i)
+			ps.oneOf(field+".type", sink.Type, "kafka", "nats", "mqtt", "amqp")
+			ps.oneOf(field+".detail", sink.Detail, "", "summary", "full", "raw")
+			switch sink.Type {
+			case "kafka":
+				if len(sink.Brokers) == 0 {
+					ps.errorf(field+".brokers", "is required for kafka")
+				}
+				for j, broker := range sink.Brokers {
+					ps.hostPort(fmt.Sprintf("%s.brokers[%d]", field, j), broker)
+				}
+			case "nats":
+				u, err := url.Parse(sink.URL)
+				if err != nil || (u.Scheme != "nats" && u.Scheme != "tls") || u.Host == "" {
+					ps.errorf(field+".url", "must be a nats:// or tls:// URL, got %q", sink.URL)
+				}
+			case "mqtt":
+				u, err := url.Parse(sink.URL)
+				if err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts") || u.Host == "" {
+					ps.errorf(field+".url", "must be an mqtt:// or mqtts:// URL, got %q", sink.URL)
+				}
+			case "amqp":
+				u, err := url.Parse(sink.URL)
+				if err != nil || (u.Scheme != "amqp" && u.Scheme != "amqps") || u.Host == "" {
+					ps.errorf(field+".url", "must be an amqp:// or amqps:// URL, got %q", sink.URL)
+				}
+			}
+		}
+	}
+
+	if c.Render.Enabled {
+		ps.positiveDuration("render.timeout", c.Render.Timeout)
+		if c.Render.Width <= 0 || c.Render.Height <= 0 {
+			ps.errorf("render", "width and height must be positive, got %dx%d", c.Render.Width, c.Render.Height)
+		}
+		if c.Render.MaxConcurrent < 1 {
+			ps.errorf("render.max_concurrent", "must be at least 1, got %d", c.Render.MaxConcurrent)
+		}
+	}
+
+	if c.LinkCheck.Enabled {
+		ps.positiveDuration("link_check.timeout", c.LinkCheck.Timeout)
+		ps.nonNegative("link_check.max_redirects", int64(c.LinkCheck.MaxRedirects))
+		if c.LinkCheck.Concurrency < 1 {
+			ps.errorf("link_check.concurrency", "must be at least 1, got %d", c.LinkCheck.Concurrency)
+		}
+	}
+
+	if c.Spam.Enabled {
+		ps.oneOf("spam.engine", c.Spam.Engine, "rspamd", "spamassassin")
+		ps.positiveDuration("spam.timeout", c.Spam.Timeout)
+		if c.Spam.Engine == "rspamd" && c.Spam.URL == "" {
+			ps.errorf("spam.url", "is required for rspamd")
+		}
+		if c.Spam.Engine == "spamassassin" && c.Spam.Address == "" {
+			ps.errorf("spam.address", "is required for spamassassin")
+		}
+	}
+
+	if c.Processing.Workers < 1 {
+		ps.errorf("processing.workers", "must be at least 1, got %d", c.Processing.Workers)
+	}
+	if c.Processing.MaxAttempts < 1 {
+		ps.errorf("processing.max_attempts", "must be at least 1, got %d", c.Processing.MaxAttempts)
+	}
+	ps.positiveDuration("processing.retry_delay", c.Processing.RetryDelay)
+
+	if !headerNamePattern.MatchString(c.Templates.Header) {
+		ps.errorf("templates.header", "must be a header name, got %q", c.Templates.Header)
+	}
+	if strings.ContainsAny(c.Addresses.SubaddressSeparators, "@. \t\"") {
+		ps.errorf("addresses.subaddress_separators", "cannot contain @, dots, spaces or quotes, got %q", c.Addresses.SubaddressSeparators)
+	}
+
+	if c.MailAuth.Enabled {
+		ps.positiveDuration("mail_auth.timeout", c.MailAuth.Timeout)
+		for i, record := range c.MailAuth.Records {
+			ps.oneOf(fmt.Sprintf("mail_auth.records[%d].type", i), strings.ToUpper(record.Type), "TXT", "A", "AAAA", "MX")
+		}
+	}
+
+	for i, key := range c.Decryption.SMIME {
+		if key.CertFile == "" || key.KeyFile == "" {
+			ps.errorf(fmt.Sprintf("decryption.smime[%d]", i), "cert_file and key_file are required")
+		}
+	}
+	for i, key := range c.Decryption.PGP {
+		if key.KeyFile == "" {
+			ps.errorf(fmt.Sprintf("decryption.pgp[%d].key_file", i), "is required")
+		}
+	}
+
+	if c.Web.Auth.Enabled {
+		if c.Web.Auth.Password == "changeme" && !c.Web.Auth.OIDC.Enabled {
+			ps.warnf("web.auth.password", "is the default; change it")
+		}
+		if c.Web.Auth.OIDC.Enabled && c.Web.Auth.OIDC.Issuer == "" {
+			ps.errorf("web.auth.oidc.issuer", "is required when OIDC is enabled")
+		}
+		if !c.Web.Auth.OIDC.Enabled {
+			ps.positiveDuration("web.auth.session_timeout", c.Web.Auth.SessionTimeout)
+		}
+	}
+	for i, key := range c.Web.Auth.APIKeys {
+		if key.Key == "" {
+			ps.errorf(fmt.Sprintf("web.auth.api_keys[%d].key", i), "must not be empty")
+		}
+		ps.oneOf(fmt.Sprintf("web.auth.api_keys[%d].scope", i), key.Scope, "", "read", "full")
+	}
+	validateUsers(&ps, "web.auth", &c.Web.Auth, c.ClientCertificates())
+	validateLockout(&ps, "web.auth.lockout", &c.Web.Auth.Lockout)
+
+	c.validateNamespaces(&ps)
+
+	// Unknown logging settings fall back to info and JSON
+	if !oneOf(c.Logging.Level, "debug", "info", "warn", "error") {
+		ps.warnf("logging.level", "must be debug, info, warn or error, got %q; using info", c.Logging.Level)
+	}
+	if !oneOf(c.Logging.Format, "json", "text") {
+		ps.warnf("logging.format", "must be json or text, got %q; using json", c.Logging.Format)
+	}
+	if syslog := c.Logging.Syslog; syslog.Enabled {
+		ps.oneOf("logging.syslog.network", syslog.Network, "", "udp", "tcp", "tls")
+		if syslog.Network != "" {
+			ps.hostPort("logging.syslog.address", syslog.Address)
+		}
+		if _, ok := SyslogFacilities[syslog.Facility]; !ok {
+			ps.errorf("logging.syslog.facility", "must be a syslog facility such as daemon or local0, got %q", syslog.Facility)
+		}
+	}
+	if gelf := c.Logging.GELF; gelf.Enabled {
+		ps.oneOf("logging.gelf.network", gelf.Network, "udp", "tcp", "tls")
+		ps.hostPort("logging.gelf.address", gelf.Address)
+	}
+
+	return ps
+}
+
+// validateHTTP checks the http section
+func (c *Config) validateHTTP(ps *problems) {
+	ps.port("http.port", c.HTTP.Port)
+	ps.nonNegativeDuration("http.read_timeout", c.HTTP.ReadTimeout)
+	ps.nonNegativeDuration("http.write_timeout", c.HTTP.WriteTimeout)
+	ps.access("http.access", &c.HTTP.Access)
+
+	if c.HTTP.Compression.Enabled && (c.HTTP.Compression.Level < 1 || c.HTTP.Compression.Level > 9) {
+		ps.errorf("http.compression.level", "must be between 1 and 9, got %d", c.HTTP.Compression.Level)
+	}
+
+	tls := c.HTTP.TLS
+	if !tls.Enabled {
+		if tls.ClientAuth.Enabled {
+			ps.errorf("http.tls.client_auth", "needs http.tls to be enabled")
+		}
+		return
+	}
+	if tls.ACME.Enabled {
+		if len(tls.ACME.Domains) == 0 {
+			ps.errorf("http.tls.acme.domains", "at least one domain is required for ACME")
+		}
+		ps.positiveDuration("http.tls.acme.renew_before", tls.ACME.RenewBefore)
+	} else if tls.CertFile == "" || tls.KeyFile == "" {
+		ps.errorf("http.tls", "cert_file and key_file are required unless acme is enabled")
+	}
+	if tls.ClientAuth.Enabled && tls.ClientAuth.CAFile == "" {
+		ps.errorf("http.tls.client_auth.ca_file", "is required when client certificates are enabled")
+	}
+}
+
+// validateStorage checks the storage section
+func (c *Config) validateStorage(ps *problems) {
+	s := c.Storage
+	ps.oneOf("storage.type", s.Type, "sqlite")
+	if s.Path == "" {
+		ps.errorf("storage.path", "must not be empty")
+	}
+	ps.oneOf("storage.compression", s.Compression, "none", "gzip", "zstd")
+	if s.ReadConnections < 0 {
+		ps.errorf("storage.read_connections", "must not be negative, got %d", s.ReadConnections)
+	}
+	if s.CacheSize < 0 {
+		ps.errorf("storage.cache_size", "must not be negative, got %d", s.CacheSize)
+	}
+
+	if s.EncryptionKey != "" {
+		raw, err := hex.DecodeString(s.EncryptionKey)
+		if err != nil {
+			raw, err = base64.StdEncoding.DecodeString(s.EncryptionKey)
+		}
+		if err != nil {
+			ps.errorf("storage.encryption_key", "must be hex or base64 encoded")
+		} else if len(raw) != 32 {
+			ps.errorf("storage.encryption_key", "must be 32 bytes, got %d", len(raw))
+		}
+	}
+
+	ps.oneOf("storage.blobs.type", s.Blobs.Type, "database", "filesystem", "s3")
+	if s.Blobs.Type == "s3" && s.Blobs.S3.Bucket == "" {
+		ps.errorf("storage.blobs.s3.bucket", "is required for the s3 blob store")
+	}
+
+	if s.Maintenance.Enabled {
+		ps.positiveDuration("storage.maintenance.interval", s.Maintenance.Interval)
+	}
+	if s.Batch.Enabled {
+		if s.Batch.MaxSize < 1 {
+			ps.errorf("storage.batch.max_size", "must be at least 1, got %d", s.Batch.MaxSize)
+		}
+		ps.positiveDuration("storage.batch.flush_interval", s.Batch.FlushInterval)
+	}
+}
+
+// CheckFile reports problems with the configuration file itself: a
+// missing file, which Load treats as empty, and keys that do not match any
+// setting, which Load ignores
+func CheckFile(path string) []Problem {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Problem{{Field: path, Message: "file not found; using defaults and environment variables", Warning: true}}
+	}
+	if err != nil {
+		return []Problem{{Field: path, Message: err.Error()}}
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(Default())
+
+	var typeErr *yaml.TypeError
+	switch {
+	case err == nil || errors.Is(err, io.EOF):
+		return nil
+	case errors.As(err, &typeErr):
+		var ps problems
+		for _, msg := range typeErr.Errors {
+			if strings.Contains(msg, "not found in type") {
+				ps.warnf(path, "%s; the setting is ignored", msg)
+			} else {
+				ps.errorf(path, "%s", msg)
+			}
+		}
+		return ps
+	default:
+		return []Problem{{Field: path, Message: err.Error()}}
+	}
+}
+
+// validateLockout checks the lockout of an auth section
+func validateLockout(ps *problems, field string, lockout *LockoutConfig) {
+	if !lockout.Enabled {
+		return
+	}
+	if lockout.MaxFailures < 1 {
+		ps.errorf(field+".max_failures", "must be at least 1, got %d", lockout.MaxFailures)
+	}
+	ps.positiveDuration(field+".delay", lockout.Delay)
+	ps.positiveDuration(field+".window", lockout.Window)
+	if lockout.MaxDelay < lockout.Delay {
+		ps.errorf(field+".max_delay", "must be at least the delay, %s", lockout.Delay)
+	}
+}
+
+// validateUsers checks the users of an auth section. Users may sign in
+// without a password with OIDC or client certificates.
+func validateUsers(ps *problems, field string, auth *AuthConfig, certificates bool) {
+	if len(auth.Users) > 0 && !auth.Enabled && !auth.OIDC.Enabled && !certificates {
+		ps.warnf(field+".users", "are ignored because auth is disabled")
+	}
+
+	names := make(map[string]bool)
+	for i, user := range auth.Users {
+		userField := fmt.Sprintf("%s.users[%d]", field, i)
+		switch {
+		case user.Username == "":
+			ps.errorf(userField+".username", "must not be empty")
+		case names[user.Username]:
+			ps.errorf(userField+".username", "%q is used by another user", user.Username)
+		case user.Username == auth.Username && !auth.OIDC.Enabled:
+			ps.errorf(userField+".username", "%q is %s.username", user.Username, field)
+		}
+		names[user.Username] = true
+
+		if user.Password == "" && !auth.OIDC.Enabled && !certificates {
+			ps.errorf(userField+".password", "must not be empty")
+		}
+		if len(user.Mailboxes) == 0 && !user.Admin {
+			ps.errorf(userField+".mailboxes", "must not be empty unless the user is an admin")
+		}
+		for j, pattern := range user.Mailboxes {
+			if _, err := path.Match(pattern, ""); err != nil {
+				ps.errorf(fmt.Sprintf("%s.mailboxes[%d]", userField, j), "is not a valid pattern: %q", pattern)
+			}
+		}
+	}
+}
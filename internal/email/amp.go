@@ -0,0 +1,262 @@
+package email
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AMPType is the media type of the AMP for Email alternative
+const AMPType = "text/x-amp-html"
+
+// AMP for Email requirements
+const (
+	ampRuntime     = "https://cdn.ampproject.org/v0.js"
+	ampBoilerplate = "body{visibility:hidden}"
+	ampMaxCSS      = 75000 // bytes of amp-custom CSS and style attributes together
+)
+
+// ampEmailComponents are the AMP extensions allowed in emails, by the name
+// their script declares in custom-element or custom-template
+var ampEmailComponents = map[string]bool{
+	"amp-accordion":      true,
+	"amp-anim":           true,
+	"amp-autocomplete":   true,
+	"amp-bind":           true,
+	"amp-carousel":       true,
+	"amp-fit-text":       true,
+	"amp-form":           true,
+	"amp-image-lightbox": true,
+	"amp-lightbox":       true,
+	"amp-list":           true,
+	"amp-mustache":       true,
+	"amp-selector":       true,
+	"amp-sidebar":        true,
+	"amp-timeago":        true,
+}
+
+// ampDisallowedElements are not allowed in AMP emails, with what to use
+// instead if anything
+var ampDisallowedElements = map[string]string{
+	"img":      "use <amp-img>",
+	"video":    "",
+	"audio":    "",
+	"iframe":   "",
+	"frame":    "",
+	"frameset": "",
+	"object":   "",
+	"param":    "",
+	"applet":   "",
+	"embed":    "",
+	"base":     "",
+	"link":     "external stylesheets and fonts cannot be loaded",
+	"picture":  "use <amp-img>",
+	"source":   "",
+	"canvas":   "",
+	"svg":      "",
+}
+
+// ampLayoutsWithoutSize are the layouts of an amp-img that need no width
+// and height
+var ampLayoutsWithoutSize = map[string]bool{"fill": true, "flex-item": true, "nodisplay": true, "container": true}
+
+var (
+	cssImportant = regexp.MustCompile(`(?i)!\s*important`)
+	cssPosition  = regexp.MustCompile(`(?i)position\s*:\s*(fixed|sticky)`)
+)
+
+// ValidateAMP checks the AMP for Email body of an email against the rules
+// of the AMP4Email format: the required markup, the allowed components,
+// elements and attributes, and the CSS limits. fallback reports whether
+// the email has the text/html body that clients without AMP show. Problems
+// of severity error make email clients such as Gmail fall back to it.
+func ValidateAMP(doc string, fallback bool) []*LintWarning {
+	l := &linter{doc: doc, warnings: []*LintWarning{}, byKey: make(map[string]*LintWarning)}
+
+	if !fallback {
+		l.add(0, "amp-fallback", SeverityError, "the email has no text/html body to show in clients without AMP")
+	}
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(doc)), "<!doctype html>") {
+		l.add(0, "amp-doctype", SeverityError, "the document must start with <!doctype html>")
+	}
+
+	var html, head, body, charset, runtime, boilerplate bool
+	customStyles, cssSize := 0, 0
+	for _, tag := range scanTags(doc) {
+		if tag.Closing {
+			continue
+		}
+
+		if reason, ok := ampDisallowedElements[tag.Name]; ok {
+			message := "<" + tag.Name + "> is not allowed in AMP emails"
+			if reason != "" {
+				message += "; " + reason
+			}
+			l.add(tag.Start, "amp-disallowed-element", SeverityError, message)
+		}
+		l.checkAMPAttributes(tag, &cssSize)
+
+		switch tag.Name {
+		case "html":
+			html = true
+			_, bolt := tag.Attrs["⚡4email"]
+			_, named := tag.Attrs["amp4email"]
+			if !bolt && !named {
+				l.add(tag.Start, "amp-html-attribute", SeverityError, "<html> must have the ⚡4email or amp4email attribute")
+			}
+			if _, ok := tag.Attrs["data-css-strict"]; !ok {
+				l.add(tag.Start, "amp-css-strict", SeverityError, "<html> must have the data-css-strict attribute")
+			}
+		case "head":
+			head = true
+		case "body":
+			body = true
+		case "meta":
+			if strings.EqualFold(tag.Attrs["charset"], "utf-8") {
+				charset = true
+			} else if _, ok := tag.Attrs["http-equiv"]; ok {
+				l.add(tag.Start, "amp-disallowed-element", SeverityError, "<meta http-equiv> is not allowed in AMP emails")
+			}
+		case "script":
+			l.checkAMPScript(tag, &runtime)
+		case "style":
+			_, custom := tag.Attrs["amp-custom"]
+			_, isBoilerplate := tag.Attrs["amp4email-boilerplate"]
+			switch {
+			case isBoilerplate:
+				boilerplate = true
+				if strings.Join(strings.Fields(tag.Text), "") != ampBoilerplate {
+					l.add(tag.Start, "amp-boilerplate", SeverityError, "the amp4email-boilerplate style must be exactly "+ampBoilerplate)
+				}
+			case custom:
+				customStyles++
+				if customStyles > 1 {
+					l.add(tag.Start, "amp-custom-style", SeverityError, "only one <style amp-custom> is allowed")
+				}
+				cssSize += len(tag.Text)
+				l.checkAMPCSS(tag.Start, tag.Text)
+			default:
+				l.add(tag.Start, "amp-custom-style", SeverityError, "<style> must be the amp4email-boilerplate or amp-custom one")
+			}
+		case "template":
+			if tag.Attrs["type"] != "amp-mustache" {
+				l.add(tag.Start, "amp-template", SeverityError, "<template> must have type=\"amp-mustache\"")
+			}
+		case "amp-img", "amp-anim":
+			if src := tag.Attrs["src"]; !strings.HasPrefix(src, "https://") {
+				l.add(tag.Start, "amp-https-url", SeverityError, "<"+tag.Name+"> src must be an absolute https URL")
+			}
+			if !ampLayoutsWithoutSize[tag.Attrs["layout"]] && (tag.Attrs["width"] == "" || tag.Attrs["height"] == "") {
+				l.add(tag.Start, "amp-img-size", SeverityError, "<"+tag.Name+"> needs width and height, unless its layout is fill, flex-item, container or nodisplay")
+			}
+			if _, ok := tag.Attrs["alt"]; !ok {
+				l.add(tag.Start, "amp-img-alt", SeverityWarning, "<"+tag.Name+"> has no alt text")
+			}
+		case "amp-list":
+			if src := tag.Attrs["src"]; src != "" && !strings.HasPrefix(src, "https://") && !strings.HasPrefix(src, "amp-state:") {
+				l.add(tag.Start, "amp-https-url", SeverityError, "<amp-list> src must be an absolute https URL")
+			}
+		case "form":
+			if _, ok := tag.Attrs["action"]; ok {
+				l.add(tag.Start, "amp-form-action", SeverityError, "<form> must use action-xhr rather than action")
+			}
+			if xhr, ok := tag.Attrs["action-xhr"]; !ok || !strings.HasPrefix(xhr, "https://") {
+				l.add(tag.Start, "amp-form-action", SeverityError, "<form> needs an absolute https action-xhr URL")
+			}
+		case "input":
+			switch strings.ToLower(tag.Attrs["type"]) {
+			case "file", "image", "password":
+				l.add(tag.Start, "amp-disallowed-element", SeverityError, "<input type="+strings.ToLower(tag.Attrs["type"])+"> is not allowed in AMP emails")
+			}
+		}
+	}
+
+	if !html {
+		l.add(0, "amp-html-attribute", SeverityError, "the document has no <html ⚡4email> element")
+	}
+	if !head || !body {
+		l.add(0, "amp-structure", SeverityError, "the document must have <head> and <body> elements")
+	}
+	if !charset {
+		l.add(0, "amp-charset", SeverityError, "<head> must contain <meta charset=\"utf-8\">")
+	}
+	if !runtime {
+		l.add(0, "amp-runtime", SeverityError, "the AMP runtime <script async src=\""+ampRuntime+"\"> is missing")
+	}
+	if !boilerplate {
+		l.add(0, "amp-boilerplate", SeverityError, "<style amp4email-boilerplate>"+ampBoilerplate+"</style> is missing")
+	}
+	if cssSize > ampMaxCSS {
+		l.add(0, "amp-css-size", SeverityError, "CSS is "+strconv.Itoa(cssSize)+" bytes; AMP emails allow "+strconv.Itoa(ampMaxCSS)+" in <style amp-custom> and style attributes together")
+	}
+	return l.sorted()
+}
+
+// checkAMPScript checks that a script is the AMP runtime or an extension
+// allowed in emails
+func (l *linter) checkAMPScript(tag htmlTag, runtime *bool) {
+	src := tag.Attrs["src"]
+	if src == ampRuntime {
+		*runtime = true
+		if _, ok := tag.Attrs["async"]; !ok {
+			l.add(tag.Start, "amp-script", SeverityError, "the AMP runtime script must be async")
+		}
+		return
+	}
+	if tag.Attrs["type"] == "application/json" || tag.Attrs["type"] == "application/ld+json" {
+		return // data, as for amp-state
+	}
+
+	name := tag.Attrs["custom-element"]
+	if name == "" {
+		name = tag.Attrs["custom-template"]
+	}
+	switch {
+	case name == "" || !strings.HasPrefix(src, "https://cdn.ampproject.org/"):
+		l.add(tag.Start, "amp-script", SeverityError, "scripts other than the AMP runtime and components are not allowed")
+	case !ampEmailComponents[name]:
+		l.add(tag.Start, "amp-component", SeverityError, name+" is not allowed in AMP emails")
+	}
+}
+
+// checkAMPAttributes checks the attributes of any element, adding the size
+// of its style attribute to cssSize
+func (l *linter) checkAMPAttributes(tag htmlTag, cssSize *int) {
+	names := make([]string, 0, len(tag.Attrs))
+	for name := range tag.Attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := tag.Attrs[name]
+		switch {
+		case len(name) > 2 && strings.HasPrefix(name, "on"):
+			l.add(tag.Start, "amp-event-handler", SeverityError, name+" attributes are not allowed; use on=\"tap:...\" actions")
+		case name == "style":
+			*cssSize += len(value)
+			l.checkAMPCSS(tag.Start, value)
+		case name == "href" && strings.HasPrefix(strings.ToLower(strings.TrimSpace(value)), "javascript:"):
+			l.add(tag.Start, "amp-javascript-url", SeverityError, "javascript: URLs are not allowed")
+		case name == "class" || name == "id":
+			for _, n := range strings.Fields(value) {
+				if strings.HasPrefix(n, "-amp-") || strings.HasPrefix(n, "i-amp-") {
+					l.add(tag.Start, "amp-reserved-name", SeverityError, "class and id names starting with -amp- or i-amp- are reserved")
+				}
+			}
+		}
+	}
+}
+
+// checkAMPCSS checks CSS for what AMP emails do not allow
+func (l *linter) checkAMPCSS(offset int, css string) {
+	if cssImportant.MatchString(css) {
+		l.add(offset, "amp-css-important", SeverityError, "!important is not allowed in AMP emails")
+	}
+	if cssImport.MatchString(css) {
+		l.add(offset, "amp-css-import", SeverityError, "@import is not allowed in AMP emails")
+	}
+	if m := cssPosition.FindStringSubmatch(css); m != nil {
+		l.add(offset, "amp-css-position", SeverityError, "position: "+strings.ToLower(m[1])+" is not allowed in AMP emails")
+	}
+}
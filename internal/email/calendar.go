@@ -0,0 +1,432 @@
+package email
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowebmail/internal/storage"
+)
+
+// calendarComponent is a BEGIN/END block of an iCalendar object, such as
+// VCALENDAR, VEVENT or VTIMEZONE
+type calendarComponent struct {
+	name     string
+	props    []*calendarProp
+	children []*calendarComponent
+}
+
+// calendarProp is a content line: NAME;PARAM=value:value
+type calendarProp struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// prop returns the first property called name, or nil
+func (c *calendarComponent) prop(name string) *calendarProp {
+	for _, p := range c.props {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// text returns the unescaped value of the property called name, or ""
+func (c *calendarComponent) text(name string) string {
+	if p := c.prop(name); p != nil {
+		return unescapeCalendarText(p.value)
+	}
+	return ""
+}
+
+// IsCalendarType reports whether mediaType holds iCalendar data
+func IsCalendarType(mediaType string) bool {
+	return mediaType == "text/calendar" || mediaType == "application/ics"
+}
+
+// ParseCalendar parses the VEVENTs of an iCalendar object (RFC 5545). Time
+// zones are resolved from the IANA database, or else from the object's
+// own VTIMEZONE definitions, as Outlook uses Windows time zone names.
+func ParseCalendar(data []byte) (*storage.Calendar, error) {
+	root, err := parseCalendarComponents(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	cal := &storage.Calendar{
+		Method: strings.ToUpper(root.text("METHOD")),
+		Events: []*storage.CalendarEvent{},
+	}
+	zones := make(map[string]*calendarComponent)
+	for _, child := range root.children {
+		if child.name == "VTIMEZONE" {
+			zones[child.text("TZID")] = child
+		}
+	}
+	for _, child := range root.children {
+		if child.name == "VEVENT" {
+			cal.Events = append(cal.Events, calendarEvent(child, zones))
+		}
+	}
+	return cal, nil
+}
+
+// parseCalendarComponents unfolds and parses the content lines of an
+// iCalendar object, and returns its VCALENDAR
+func parseCalendarComponents(text string) (*calendarComponent, error) {
+	// Lines are folded by a line break followed by a space or tab
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\n ", "")
+	text = strings.ReplaceAll(text, "\n\t", "")
+
+	var root *calendarComponent
+	var stack []*calendarComponent
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		prop := parseCalendarLine(line)
+		if prop == nil {
+			continue
+		}
+
+		switch prop.name {
+		case "BEGIN":
+			c := &calendarComponent{name: strings.ToUpper(prop.value)}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, c)
+			} else if c.name == "VCALENDAR" && root == nil {
+				root = c
+			}
+			stack = append(stack, c)
+		case "END":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		default:
+			if len(stack) > 0 {
+				c := stack[len(stack)-1]
+				c.props = append(c.props, prop)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, errors.New("no VCALENDAR found")
+	}
+	return root, nil
+}
+
+// parseCalendarLine parses a content line, or returns nil if it has no
+// value. Parameter values may be quoted, and contain : and ; when they are.
+func parseCalendarLine(line string) *calendarProp {
+	// The name and parameters end at the first colon outside quotes
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			quoted = !quoted
+		case ';', ':':
+			if quoted {
+				continue
+			}
+			parts = append(parts, line[start:i])
+			start = i + 1
+			if line[i] == ':' {
+				prop := &calendarProp{
+					name:   strings.ToUpper(parts[0]),
+					params: make(map[string]string),
+					value:  line[start:],
+				}
+				for _, param := range parts[1:] {
+					name, value, _ := strings.Cut(param, "=")
+					prop.params[strings.ToUpper(name)] = strings.Trim(value, `"`)
+				}
+				return prop
+			}
+		}
+	}
+	return nil
+}
+
+// unescapeCalendarText unescapes a TEXT value
+func unescapeCalendarText(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i == len(value)-1 {
+			b.WriteByte(value[i])
+			continue
+		}
+		i++
+		switch value[i] {
+		case 'n', 'N':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+	return b.String()
+}
+
+// calendarEvent converts a VEVENT
+func calendarEvent(c *calendarComponent, zones map[string]*calendarComponent) *storage.CalendarEvent {
+	event := &storage.CalendarEvent{
+		UID:         c.text("UID"),
+		Summary:     c.text("SUMMARY"),
+		Description: c.text("DESCRIPTION"),
+		Location:    c.text("LOCATION"),
+		Recurrence:  c.text("RRULE"),
+		Status:      strings.ToUpper(c.text("STATUS")),
+		Attendees:   []*storage.CalendarAttendee{},
+	}
+	event.Sequence, _ = strconv.Atoi(c.text("SEQUENCE"))
+
+	if p := c.prop("DTSTART"); p != nil {
+		if start, allDay, ok := calendarTime(p, zones); ok {
+			event.Start = &start
+			event.AllDay = allDay
+			event.TimeZone = p.params["TZID"]
+		}
+	}
+	if p := c.prop("DTEND"); p != nil {
+		if end, _, ok := calendarTime(p, zones); ok {
+			event.End = &end
+		}
+	} else if p := c.prop("DURATION"); p != nil && event.Start != nil {
+		if d, ok := calendarDuration(p.value); ok {
+			end := event.Start.Add(d)
+			event.End = &end
+		}
+	}
+
+	for _, p := range c.props {
+		switch p.name {
+		case "ORGANIZER":
+			event.Organizer = calendarAttendee(p)
+		case "ATTENDEE":
+			event.Attendees = append(event.Attendees, calendarAttendee(p))
+		}
+	}
+	return event
+}
+
+// calendarAttendee converts an ORGANIZER or ATTENDEE property
+func calendarAttendee(p *calendarProp) *storage.CalendarAttendee {
+	address := p.value
+	if len(address) >= 7 && strings.EqualFold(address[:7], "mailto:") {
+		address = address[7:]
+	}
+	return &storage.CalendarAttendee{
+		Email:  address,
+		Name:   p.params["CN"],
+		Role:   strings.ToUpper(p.params["ROLE"]),
+		Status: strings.ToUpper(p.params["PARTSTAT"]),
+		RSVP:   strings.EqualFold(p.params["RSVP"], "TRUE"),
+	}
+}
+
+// calendarTime parses a DATE or DATE-TIME property, and reports whether
+// it is a date
+func calendarTime(p *calendarProp, zones map[string]*calendarComponent) (time.Time, bool, bool) {
+	value := p.value
+	if p.params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.Parse("20060102", value)
+		return t, true, err == nil
+	}
+
+	utc := strings.HasSuffix(value, "Z")
+	wall, err := time.Parse("20060102T150405", strings.TrimSuffix(value, "Z"))
+	if err != nil {
+		return time.Time{}, false, false
+	}
+	tzid := p.params["TZID"]
+	if utc || tzid == "" {
+		return wall, false, true
+	}
+
+	if loc, err := time.LoadLocation(tzid); err == nil {
+		return time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0, loc), false, true
+	}
+	if zone := zones[tzid]; zone != nil {
+		if offset, ok := zoneOffset(zone, wall); ok {
+			return time.Date(wall.Year(), wall.Month(), wall.Day(), wall.Hour(), wall.Minute(), wall.Second(), 0,
+				time.FixedZone(tzid, offset)), false, true
+		}
+	}
+	return wall, false, true
+}
+
+// zoneOffset returns the UTC offset in seconds of a VTIMEZONE at a wall
+// clock time: that of the STANDARD or DAYLIGHT observance that started
+// last before it. Yearly rules by month and weekday are supported, which
+// is what calendar clients emit.
+func zoneOffset(zone *calendarComponent, wall time.Time) (int, bool) {
+	var latest time.Time
+	offset, found := 0, false
+	for _, obs := range zone.children {
+		if obs.name != "STANDARD" && obs.name != "DAYLIGHT" {
+			continue
+		}
+		to, ok := parseUTCOffset(obs.text("TZOFFSETTO"))
+		if !ok {
+			continue
+		}
+		start, err := time.Parse("20060102T150405", obs.text("DTSTART"))
+		if err != nil {
+			continue
+		}
+
+		// The observance's last start at or before wall, this year or
+		// the year before
+		for _, year := range []int{wall.Year(), wall.Year() - 1} {
+			at, ok := observanceStart(start, obs.text("RRULE"), year)
+			if !ok || at.After(wall) {
+				continue
+			}
+			if !found || at.After(latest) {
+				latest, offset, found = at, to, true
+			}
+			break
+		}
+	}
+	return offset, found
+}
+
+// observanceStart returns when an observance starting at start, repeating
+// by rrule, starts in year
+func observanceStart(start time.Time, rrule string, year int) (time.Time, bool) {
+	if rrule == "" {
+		return start, year >= start.Year()
+	}
+	rule := make(map[string]string)
+	for _, part := range strings.Split(rrule, ";") {
+		if name, value, ok := strings.Cut(part, "="); ok {
+			rule[strings.ToUpper(name)] = strings.ToUpper(value)
+		}
+	}
+	if rule["FREQ"] != "YEARLY" || year < start.Year() {
+		return time.Time{}, false
+	}
+	month, err := strconv.Atoi(rule["BYMONTH"])
+	if err != nil || month < 1 || month > 12 {
+		return time.Time{}, false
+	}
+	day := time.Date(year, time.Month(month), start.Day(), start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+
+	byDay := rule["BYDAY"]
+	if byDay == "" {
+		return day, true
+	}
+	weekday, ok := calendarWeekdays[byDay[max(len(byDay)-2, 0):]]
+	if !ok {
+		return time.Time{}, false
+	}
+	n := 1
+	if len(byDay) > 2 {
+		if n, err = strconv.Atoi(byDay[:len(byDay)-2]); err != nil || n == 0 {
+			return time.Time{}, false
+		}
+	}
+
+	// The nth weekday of the month, counted from its end when negative
+	if n > 0 {
+		first := time.Date(year, time.Month(month), 1, start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+		shift := (int(weekday) - int(first.Weekday()) + 7) % 7
+		return first.AddDate(0, 0, shift+(n-1)*7), true
+	}
+	last := time.Date(year, time.Month(month)+1, 0, start.Hour(), start.Minute(), start.Second(), 0, time.UTC)
+	shift := (int(last.Weekday()) - int(weekday) + 7) % 7
+	return last.AddDate(0, 0, -shift+(n+1)*7), true
+}
+
+var calendarWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// parseUTCOffset parses a UTC-OFFSET value such as +0100 or -043000 into
+// seconds
+func parseUTCOffset(value string) (int, bool) {
+	if len(value) != 5 && len(value) != 7 {
+		return 0, false
+	}
+	sign := 1
+	switch value[0] {
+	case '-':
+		sign = -1
+	case '+':
+	default:
+		return 0, false
+	}
+	seconds := 0
+	for i, unit := range []int{3600, 60, 1} {
+		if 1+2*i >= len(value) {
+			break
+		}
+		n, err := strconv.Atoi(value[1+2*i : 3+2*i])
+		if err != nil {
+			return 0, false
+		}
+		seconds += n * unit
+	}
+	return sign * seconds, true
+}
+
+// calendarDuration parses a DURATION value such as PT1H30M, P1D or -P2W
+func calendarDuration(value string) (time.Duration, bool) {
+	sign := time.Duration(1)
+	if strings.HasPrefix(value, "-") {
+		sign, value = -1, value[1:]
+	}
+	value = strings.TrimPrefix(value, "+")
+	if !strings.HasPrefix(value, "P") {
+		return 0, false
+	}
+
+	var d time.Duration
+	inTime := false
+	n := 0
+	digits := false
+	for _, r := range value[1:] {
+		switch {
+		case r >= '0' && r <= '9':
+			n = n*10 + int(r-'0')
+			digits = true
+			continue
+		case r == 'T':
+			inTime = true
+			continue
+		}
+		if !digits {
+			return 0, false
+		}
+		var unit time.Duration
+		switch {
+		case r == 'W' && !inTime:
+			unit = 7 * 24 * time.Hour
+		case r == 'D' && !inTime:
+			unit = 24 * time.Hour
+		case r == 'H' && inTime:
+			unit = time.Hour
+		case r == 'M' && inTime:
+			unit = time.Minute
+		case r == 'S' && inTime:
+			unit = time.Second
+		default:
+			return 0, false
+		}
+		d += time.Duration(n) * unit
+		n, digits = 0, false
+	}
+	return sign * d, !digits
+}
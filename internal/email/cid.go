@@ -0,0 +1,39 @@
+package email
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// cidURL matches cid: URLs (RFC 2392) in src and background attributes
+// and CSS url() values
+var cidURL = regexp.MustCompile(`(?i)(\b(?:src|background)\s*=\s*["']?|url\(\s*["']?)cid:([^"'\s)>]+)`)
+
+// NormalizeContentID strips the angle brackets of a Content-ID header
+func NormalizeContentID(id string) string {
+	id = strings.TrimSpace(id)
+	id = strings.TrimPrefix(id, "<")
+	return strings.TrimSuffix(id, ">")
+}
+
+// RewriteCIDs replaces the cid: URLs of an HTML body with the URLs
+// returned by resolve, which is given the referenced Content-ID and
+// returns "" for unknown ones. It reports whether anything was replaced.
+func RewriteCIDs(html string, resolve func(contentID string) string) (string, bool) {
+	rewritten := false
+	html = cidURL.ReplaceAllStringFunc(html, func(match string) string {
+		m := cidURL.FindStringSubmatch(match)
+		id := m[2]
+		if unescaped, err := url.PathUnescape(id); err == nil {
+			id = unescaped
+		}
+		target := resolve(id)
+		if target == "" {
+			return match
+		}
+		rewritten = true
+		return m[1] + target
+	})
+	return html, rewritten
+}
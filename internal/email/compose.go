@@ -0,0 +1,225 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Draft is a message to compose
+type Draft struct {
+	From        string
+	To          []string
+	CC          []string
+	Subject     string
+	Text        string
+	HTML        string
+	Headers     map[string]string // extra header fields
+	Attachments []DraftAttachment
+}
+
+// DraftAttachment is a file attached to a draft
+type DraftAttachment struct {
+	Filename    string
+	ContentType string // guessed from the file extension when empty
+	Content     []byte
+}
+
+// composedHeaders are set by Compose and cannot be overridden by Headers
+var composedHeaders = map[string]bool{
+	"From": true, "To": true, "Cc": true, "Bcc": true, "Subject": true,
+	"Mime-Version": true, "Content-Type": true, "Content-Transfer-Encoding": true,
+}
+
+// Compose builds an RFC 5322 message from d. Text and HTML bodies become a
+// multipart/alternative part, and attachments a multipart/mixed message.
+func Compose(d *Draft) ([]byte, error) {
+	from, err := mail.ParseAddress(d.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address: %w", err)
+	}
+
+	var buf bytes.Buffer
+	header := textproto.MIMEHeader{}
+	header.Set("From", from.String())
+	if len(d.To) > 0 {
+		header.Set("To", strings.Join(d.To, ", "))
+	}
+	if len(d.CC) > 0 {
+		header.Set("Cc", strings.Join(d.CC, ", "))
+	}
+	header.Set("Subject", mime.QEncoding.Encode("utf-8", d.Subject))
+	header.Set("Date", time.Now().Format(time.RFC1123Z))
+	header.Set("Message-Id", newMessageID(from.Address))
+	header.Set("Mime-Version", "1.0")
+	for name, value := range d.Headers {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if !composedHeaders[name] {
+			// Line breaks would start new header fields
+			header.Set(name, strings.NewReplacer("\r", " ", "\n", " ").Replace(value))
+		}
+	}
+
+	body, bodyHeader, err := composeBody(d)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(d.Attachments) == 0 {
+		for name, values := range bodyHeader {
+			header[name] = values
+		}
+		writeHeader(&buf, header)
+		buf.Write(body)
+		return buf.Bytes(), nil
+	}
+
+	var parts bytes.Buffer
+	mw := multipart.NewWriter(&parts)
+	w, err := mw.CreatePart(bodyHeader)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(body)
+	for _, a := range d.Attachments {
+		if err := writeAttachment(mw, &a); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	header.Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	writeHeader(&buf, header)
+	buf.Write(parts.Bytes())
+	return buf.Bytes(), nil
+}
+
+// composeBody returns the text and HTML bodies of d as one part
+func composeBody(d *Draft) ([]byte, textproto.MIMEHeader, error) {
+	if d.HTML == "" || d.Text == "" {
+		if d.HTML != "" {
+			return textPart("text/html", d.HTML)
+		}
+		return textPart("text/plain", d.Text)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, p := range []struct{ contentType, content string }{{"text/plain", d.Text}, {"text/html", d.HTML}} {
+		body, header, err := textPart(p.contentType, p.content)
+		if err != nil {
+			return nil, nil, err
+		}
+		w, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, nil, err
+		}
+		w.Write(body)
+	}
+	if err := mw.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", "multipart/alternative; boundary="+mw.Boundary())
+	return buf.Bytes(), header, nil
+}
+
+// textPart encodes content as a quoted-printable UTF-8 part
+func textPart(contentType, content string) ([]byte, textproto.MIMEHeader, error) {
+	var buf bytes.Buffer
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(content)); err != nil {
+		return nil, nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType+"; charset=utf-8")
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return buf.Bytes(), header, nil
+}
+
+// writeAttachment adds a as a base64 encoded part
+func writeAttachment(mw *multipart.Writer, a *DraftAttachment) error {
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(a.Filename))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"name": a.Filename}))
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	w, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+
+	// Base64 lines are wrapped at 76 characters (RFC 2045)
+	encoded := base64.StdEncoding.EncodeToString(a.Content)
+	for len(encoded) > 76 {
+		fmt.Fprintf(w, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	_, err = fmt.Fprintf(w, "%s\r\n", encoded)
+	return err
+}
+
+// headerOrder puts the fields people read first at the top
+var headerOrder = map[string]int{"From": 1, "To": 2, "Cc": 3, "Subject": 4, "Date": 5, "Message-Id": 6}
+
+// writeHeader writes header in a stable order, ending with the blank line
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		oi, oj := headerOrder[names[i]], headerOrder[names[j]]
+		if oi == 0 || oj == 0 {
+			if oi != oj {
+				return oj == 0
+			}
+			return names[i] < names[j]
+		}
+		return oi < oj
+	})
+
+	for _, name := range names {
+		for _, value := range header[name] {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+		}
+	}
+	buf.WriteString("\r\n")
+}
+
+// newMessageID returns a new Message-ID in the domain of address
+func newMessageID(address string) string {
+	domain := "gowebmail.local"
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		domain = address[at+1:]
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
@@ -0,0 +1,150 @@
+package email
+
+import (
+	"html"
+	"strings"
+)
+
+// htmlTag is a start or end tag found by scanTags
+type htmlTag struct {
+	Name    string            // lowercased
+	Attrs   map[string]string // lowercased names, unescaped values
+	Closing bool
+	Start   int    // offset of '<'
+	End     int    // offset after '>'
+	Text    string // contents of style and script elements
+}
+
+// scanTags returns the tags of an HTML document in order. It is a lenient
+// scanner rather than a full parser: comments, including the conditional
+// comments of Outlook, are skipped, and style and script contents are
+// returned as text.
+func scanTags(doc string) []htmlTag {
+	var tags []htmlTag
+	lower := strings.ToLower(doc)
+
+	for i := 0; i < len(doc); {
+		lt := strings.IndexByte(doc[i:], '<')
+		if lt < 0 {
+			break
+		}
+		i += lt
+
+		switch {
+		case strings.HasPrefix(doc[i:], "<!--"):
+			end := strings.Index(doc[i+4:], "-->")
+			if end < 0 {
+				return tags
+			}
+			i += 4 + end + 3
+			continue
+		case strings.HasPrefix(doc[i:], "<!") || strings.HasPrefix(doc[i:], "<?"):
+			end := strings.IndexByte(doc[i:], '>')
+			if end < 0 {
+				return tags
+			}
+			i += end + 1
+			continue
+		}
+
+		tag, ok := scanTag(doc, i)
+		if !ok {
+			i++
+			continue
+		}
+		i = tag.End
+
+		// Style and script contents are text up to the end tag
+		if !tag.Closing && (tag.Name == "style" || tag.Name == "script") {
+			end := strings.Index(lower[i:], "</"+tag.Name)
+			if end < 0 {
+				end = len(doc) - i
+			}
+			tag.Text = doc[i : i+end]
+			i += end
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// scanTag reads the tag starting at doc[start], which is '<'
+func scanTag(doc string, start int) (htmlTag, bool) {
+	tag := htmlTag{Start: start, Attrs: make(map[string]string)}
+	i := start + 1
+	if i < len(doc) && doc[i] == '/' {
+		tag.Closing = true
+		i++
+	}
+
+	nameStart := i
+	for i < len(doc) && isTagNameChar(doc[i]) {
+		i++
+	}
+	if i == nameStart {
+		return tag, false
+	}
+	tag.Name = strings.ToLower(doc[nameStart:i])
+
+	for i < len(doc) {
+		for i < len(doc) && (isSpace(doc[i]) || doc[i] == '/') {
+			i++
+		}
+		if i >= len(doc) {
+			break
+		}
+		if doc[i] == '>' {
+			tag.End = i + 1
+			return tag, true
+		}
+
+		attrStart := i
+		for i < len(doc) && !isSpace(doc[i]) && doc[i] != '=' && doc[i] != '>' && doc[i] != '/' {
+			i++
+		}
+		name := strings.ToLower(doc[attrStart:i])
+		for i < len(doc) && isSpace(doc[i]) {
+			i++
+		}
+
+		value := ""
+		if i < len(doc) && doc[i] == '=' {
+			i++
+			for i < len(doc) && isSpace(doc[i]) {
+				i++
+			}
+			if i < len(doc) && (doc[i] == '"' || doc[i] == '\'') {
+				quote := doc[i]
+				end := strings.IndexByte(doc[i+1:], quote)
+				if end < 0 {
+					return tag, false
+				}
+				value = doc[i+1 : i+1+end]
+				i += end + 2
+			} else {
+				valueStart := i
+				for i < len(doc) && !isSpace(doc[i]) && doc[i] != '>' {
+					i++
+				}
+				value = doc[valueStart:i]
+			}
+		}
+		if _, dup := tag.Attrs[name]; !dup && name != "" {
+			tag.Attrs[name] = html.UnescapeString(value)
+		}
+	}
+	return tag, false
+}
+
+func isTagNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == ':'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
+
+// lineOf returns the 1-based line number of an offset in doc
+func lineOf(doc string, offset int) int {
+	return strings.Count(doc[:offset], "\n") + 1
+}
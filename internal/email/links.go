@@ -0,0 +1,52 @@
+package email
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Link is an http or https URL found in an email body
+type Link struct {
+	URL     string `json:"url"`
+	Element string `json:"element"` // a, img, area or text
+}
+
+// textURL matches URLs in plain text
+var textURL = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+// linkAttrs are the attributes holding URLs, by element
+var linkAttrs = map[string]string{
+	"a":    "href",
+	"area": "href",
+	"img":  "src",
+}
+
+// ExtractLinks returns the http and https URLs of the HTML and plain-text
+// bodies, each once, in order of appearance
+func ExtractLinks(html, text string) []Link {
+	links := []Link{}
+	seen := make(map[string]bool)
+	add := func(raw, element string) {
+		raw = strings.TrimSpace(raw)
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return
+		}
+		if !seen[raw] {
+			seen[raw] = true
+			links = append(links, Link{URL: raw, Element: element})
+		}
+	}
+
+	for _, tag := range scanTags(html) {
+		if attr, ok := linkAttrs[tag.Name]; ok && !tag.Closing {
+			add(tag.Attrs[attr], tag.Name)
+		}
+	}
+	for _, match := range textURL.FindAllString(text, -1) {
+		// Sentence punctuation and closing brackets rarely end a URL
+		add(strings.TrimRight(match, ".,;:!?)]}>"), "text")
+	}
+	return links
+}
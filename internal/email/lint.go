@@ -0,0 +1,260 @@
+package email
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Lint severities
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// LintWarning is an email client compatibility problem found in an HTML
+// body. Repeated problems are reported once, at their first line.
+type LintWarning struct {
+	Rule     string   `json:"rule"`
+	Severity string   `json:"severity"`
+	Message  string   `json:"message"`
+	Clients  []string `json:"clients,omitempty"` // clients known to be affected
+	Line     int      `json:"line"`
+	Count    int      `json:"count"`
+}
+
+// Client limits
+const (
+	maxEmailWidth     = 600        // px; wider layouts scroll in preview panes and on phones
+	gmailClipSize     = 102 * 1024 // bytes; Gmail clips longer messages
+	gmailMaxStyleSize = 16 * 1024  // bytes; Gmail drops larger style blocks
+)
+
+const (
+	outlook = "Outlook (Windows)"
+	gmail   = "Gmail"
+	yahoo   = "Yahoo Mail"
+)
+
+// cssRule describes a CSS property with poor email client support
+type cssRule struct {
+	value   string // only values containing this, if set
+	clients []string
+	message string
+}
+
+// unsupportedCSS lists CSS properties by name
+var unsupportedCSS = map[string][]cssRule{
+	"position":         {{clients: []string{gmail, outlook, yahoo}, message: "position is not supported; use tables for layout"}},
+	"display":          {{value: "flex", clients: []string{outlook}, message: "display: flex is not supported; use tables for layout"}, {value: "grid", clients: []string{gmail, outlook}, message: "display: grid is not supported; use tables for layout"}},
+	"float":            {{clients: []string{outlook}, message: "float is not supported; use align or tables"}},
+	"box-shadow":       {{clients: []string{outlook}, message: "box-shadow is not supported"}},
+	"border-radius":    {{clients: []string{outlook}, message: "border-radius is not supported; corners will be square"}},
+	"max-width":        {{clients: []string{outlook}, message: "max-width is not supported; set a fixed width attribute"}},
+	"min-width":        {{clients: []string{outlook}, message: "min-width is not supported"}},
+	"max-height":       {{clients: []string{outlook}, message: "max-height is not supported"}},
+	"background-image": {{clients: []string{outlook}, message: "background images are not supported; use VML or a solid background-color fallback"}},
+	"background":       {{value: "url(", clients: []string{outlook}, message: "background images are not supported; use VML or a solid background-color fallback"}},
+	"transform":        {{clients: []string{gmail, outlook}, message: "transform is not supported"}},
+	"transition":       {{clients: []string{gmail, outlook, yahoo}, message: "transition is not supported"}},
+	"animation":        {{clients: []string{gmail, outlook, yahoo}, message: "animation is not supported"}},
+	"object-fit":       {{clients: []string{gmail, outlook}, message: "object-fit is not supported"}},
+}
+
+// unsupportedElements are removed or not rendered by most clients
+var unsupportedElements = map[string]string{
+	"script":   SeverityError,
+	"iframe":   SeverityError,
+	"object":   SeverityError,
+	"embed":    SeverityError,
+	"form":     SeverityWarning,
+	"input":    SeverityWarning,
+	"select":   SeverityWarning,
+	"textarea": SeverityWarning,
+	"button":   SeverityWarning,
+	"video":    SeverityWarning,
+	"audio":    SeverityWarning,
+	"canvas":   SeverityWarning,
+	"svg":      SeverityWarning,
+}
+
+var (
+	cssComment   = regexp.MustCompile(`(?s)/\*.*?\*/`)
+	cssBlock     = regexp.MustCompile(`\{([^{}]*)\}`)
+	cssImport    = regexp.MustCompile(`(?i)@import\b`)
+	cssFontFace  = regexp.MustCompile(`(?i)@font-face\b`)
+	cssPixelSize = regexp.MustCompile(`^\s*([0-9.]+)\s*px\b`)
+)
+
+// linter collects warnings, merging repeated ones
+type linter struct {
+	doc      string
+	warnings []*LintWarning
+	byKey    map[string]*LintWarning
+}
+
+func (l *linter) add(offset int, rule, severity, message string, clients ...string) {
+	key := rule + "\x00" + message
+	if w, ok := l.byKey[key]; ok {
+		w.Count++
+		return
+	}
+	w := &LintWarning{
+		Rule:     rule,
+		Severity: severity,
+		Message:  message,
+		Clients:  clients,
+		Line:     lineOf(l.doc, offset),
+		Count:    1,
+	}
+	l.byKey[key] = w
+	l.warnings = append(l.warnings, w)
+}
+
+// Lint checks an HTML body against known email client limitations:
+// unsupported CSS and elements, images without alt text or dimensions,
+// layouts wider than 600px, web fonts and Gmail's size limits
+func Lint(doc string) []*LintWarning {
+	l := &linter{doc: doc, byKey: make(map[string]*LintWarning)}
+
+	if len(doc) > gmailClipSize {
+		l.add(0, "gmail-clipping", SeverityWarning,
+			"HTML is larger than 102KB; Gmail clips the message behind a \"View entire message\" link", gmail)
+	}
+
+	styleSize := 0
+	for _, tag := range scanTags(doc) {
+		if tag.Closing {
+			continue
+		}
+
+		if severity, ok := unsupportedElements[tag.Name]; ok {
+			l.add(tag.Start, "unsupported-element", severity, "<"+tag.Name+"> is removed or not rendered by most email clients")
+		}
+
+		switch tag.Name {
+		case "style":
+			styleSize += len(tag.Text)
+			l.lintStylesheet(tag.Start, tag.Text)
+		case "link":
+			if strings.Contains(strings.ToLower(tag.Attrs["rel"]), "stylesheet") {
+				if isFontURL(tag.Attrs["href"]) {
+					l.add(tag.Start, "external-font", SeverityWarning,
+						"web fonts are not loaded; make sure the font-family stack ends with a web-safe font", gmail, outlook)
+				} else {
+					l.add(tag.Start, "external-stylesheet", SeverityWarning,
+						"external stylesheets are removed; inline the styles", gmail, outlook, yahoo)
+				}
+			}
+		case "img":
+			if _, ok := tag.Attrs["alt"]; !ok {
+				l.add(tag.Start, "missing-alt", SeverityWarning,
+					"<img> has no alt text, shown when images are blocked; use alt=\"\" for decorative images")
+			}
+			if _, ok := tag.Attrs["width"]; !ok {
+				l.add(tag.Start, "missing-image-width", SeverityInfo,
+					"<img> has no width attribute; Outlook shows images at their natural size", outlook)
+			}
+		case "a":
+			if strings.HasPrefix(strings.ToLower(strings.TrimSpace(tag.Attrs["href"])), "javascript:") {
+				l.add(tag.Start, "javascript-link", SeverityError, "javascript: links are removed by every email client")
+			}
+		}
+
+		if width, ok := pixels(tag.Attrs["width"]); ok && width > maxEmailWidth {
+			l.add(tag.Start, "too-wide", SeverityWarning,
+				"width of "+strconv.Itoa(width)+"px is wider than 600px; readers will have to scroll in preview panes and on phones")
+		}
+		if style, ok := tag.Attrs["style"]; ok {
+			l.lintDeclarations(tag.Start, style)
+		}
+	}
+
+	if styleSize > gmailMaxStyleSize {
+		l.add(0, "style-too-large", SeverityWarning,
+			"<style> blocks are larger than 16KB; Gmail removes them, so inline the styles", gmail)
+	}
+
+	return l.sorted()
+}
+
+// sorted returns the warnings by severity, then line
+func (l *linter) sorted() []*LintWarning {
+	severityOrder := map[string]int{SeverityError: 0, SeverityWarning: 1, SeverityInfo: 2}
+	sort.SliceStable(l.warnings, func(i, j int) bool {
+		a, b := l.warnings[i], l.warnings[j]
+		if a.Severity != b.Severity {
+			return severityOrder[a.Severity] < severityOrder[b.Severity]
+		}
+		return a.Line < b.Line
+	})
+	return l.warnings
+}
+
+// lintStylesheet checks the contents of a style element
+func (l *linter) lintStylesheet(offset int, css string) {
+	css = cssComment.ReplaceAllString(css, "")
+	if cssFontFace.MatchString(css) || cssImport.MatchString(css) && isFontURL(css) {
+		l.add(offset, "external-font", SeverityWarning,
+			"web fonts are not loaded; make sure the font-family stack ends with a web-safe font", gmail, outlook)
+	} else if cssImport.MatchString(css) {
+		l.add(offset, "external-stylesheet", SeverityWarning,
+			"@import is not supported; inline the styles", gmail, outlook, yahoo)
+	}
+	for _, block := range cssBlock.FindAllStringSubmatch(css, -1) {
+		l.lintDeclarations(offset, block[1])
+	}
+}
+
+// lintDeclarations checks CSS declarations such as a style attribute
+func (l *linter) lintDeclarations(offset int, declarations string) {
+	for _, declaration := range strings.Split(declarations, ";") {
+		property, value, ok := strings.Cut(declaration, ":")
+		if !ok {
+			continue
+		}
+		property = strings.ToLower(strings.TrimSpace(property))
+		value = strings.ToLower(strings.TrimSpace(value))
+
+		if strings.Contains(value, "var(") {
+			l.add(offset, "unsupported-css", SeverityWarning, "CSS custom properties (var()) are not supported", gmail, outlook)
+		}
+		for _, rule := range unsupportedCSS[property] {
+			if rule.value == "" || strings.Contains(value, rule.value) {
+				l.add(offset, "unsupported-css", SeverityWarning, rule.message, rule.clients...)
+			}
+		}
+		if property == "width" || property == "min-width" {
+			if width, ok := pixels(value); ok && width > maxEmailWidth {
+				l.add(offset, "too-wide", SeverityWarning,
+					"width of "+strconv.Itoa(width)+"px is wider than 600px; readers will have to scroll in preview panes and on phones")
+			}
+		}
+	}
+}
+
+// pixels parses a width such as "640" or "640px"
+func pixels(s string) (int, bool) {
+	s = strings.TrimSpace(s)
+	if m := cssPixelSize.FindStringSubmatch(s); m != nil {
+		s = m[1]
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return int(f), true
+}
+
+// isFontURL reports whether s refers to a web font service
+func isFontURL(s string) bool {
+	s = strings.ToLower(s)
+	for _, host := range []string{"fonts.googleapis.com", "fonts.gstatic.com", "use.typekit.net", "fonts.bunny.net", "fast.fonts.net"} {
+		if strings.Contains(s, host) {
+			return true
+		}
+	}
+	return false
+}
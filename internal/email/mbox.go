@@ -0,0 +1,135 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// mboxFromLine matches body lines that must be quoted in mboxrd format
+var mboxFromLine = regexp.MustCompile(`^>*From `)
+
+// WriteMbox writes a single message to w in mboxrd format. Line endings are
+// normalized to LF and lines starting with "From " (after any number of
+// ">") are quoted with an extra ">".
+func WriteMbox(w io.Writer, sender string, date time.Time, raw []byte) error {
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString("From " + sender + " " + date.UTC().Format(time.ANSIC) + "\n")
+
+	raw = bytes.TrimRight(raw, "\r\n")
+	for _, line := range bytes.Split(raw, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if mboxFromLine.Match(line) {
+			bw.WriteByte('>')
+		}
+		bw.Write(line)
+		bw.WriteByte('\n')
+	}
+
+	// Messages are separated by an empty line
+	bw.WriteByte('\n')
+
+	return bw.Flush()
+}
+
+// MboxMessage is a message read from an mbox file
+type MboxMessage struct {
+	Sender string    // from the "From " separator line
+	Date   time.Time // from the separator line; zero if it cannot be parsed
+	Raw    []byte
+}
+
+// MboxReader reads messages from an mboxrd file, as written by WriteMbox.
+// Quoted "From " lines are unquoted and line endings converted to CRLF.
+type MboxReader struct {
+	r       *bufio.Reader
+	pending []byte // separator line of the next message
+	started bool
+}
+
+// NewMboxReader creates a reader for the mbox data in r
+func NewMboxReader(r io.Reader) *MboxReader {
+	return &MboxReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next message, or io.EOF when there are no more
+func (m *MboxReader) Next() (*MboxMessage, error) {
+	if !m.started {
+		m.started = true
+		line, err := m.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(line, []byte("From ")) {
+			return nil, errors.New("not an mbox file: missing From line")
+		}
+		m.pending = line
+	}
+	if m.pending == nil {
+		return nil, io.EOF
+	}
+
+	msg := parseMboxSeparator(m.pending)
+	m.pending = nil
+
+	var buf bytes.Buffer
+	for {
+		line, err := m.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(line, []byte("From ")) {
+			m.pending = line
+			break
+		}
+		if len(line) > 0 && line[0] == '>' && mboxFromLine.Match(line[1:]) {
+			line = line[1:]
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+
+	// Drop the empty line that separates messages
+	msg.Raw = bytes.TrimRight(buf.Bytes(), "\r\n")
+	msg.Raw = append(msg.Raw, "\r\n"...)
+	return msg, nil
+}
+
+// readLine returns the next line without its line ending
+func (m *MboxReader) readLine() ([]byte, error) {
+	line, err := m.r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// parseMboxSeparator reads the sender and date from a "From " line
+func parseMboxSeparator(line []byte) *MboxMessage {
+	fields := strings.SplitN(string(line[len("From "):]), " ", 2)
+	msg := &MboxMessage{Sender: fields[0]}
+	if msg.Sender == "MAILER-DAEMON" {
+		msg.Sender = ""
+	}
+	if len(fields) == 2 {
+		if date, err := time.Parse(time.ANSIC, strings.TrimSpace(fields[1])); err == nil {
+			msg.Date = date
+		}
+	}
+	return msg
+}
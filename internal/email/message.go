@@ -0,0 +1,66 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"os"
+
+	"gowebmail/internal/storage"
+)
+
+// maxMessageDepth is how deep emails attached to emails are parsed; those
+// nested deeper are kept as plain attachments
+const maxMessageDepth = 10
+
+// IsMessageType reports whether mediaType holds an email, such as one
+// forwarded as an attachment
+func IsMessageType(mediaType string) bool {
+	return mediaType == "message/rfc822" || mediaType == "message/global"
+}
+
+// ParseMessage parses the email held by a message/rfc822 attachment. The
+// caller must Release it.
+func (p *Parser) ParseMessage(att *storage.Attachment) (*storage.Email, error) {
+	return p.parse(bytes.NewReader(att.Data), 1)
+}
+
+// summarizeMessage parses the email held by an attachment, depth levels
+// deep, and returns its summary, or nil if it does not parse
+func (p *Parser) summarizeMessage(att *storage.Attachment, depth int) *storage.MessageInfo {
+	if depth > maxMessageDepth {
+		return nil
+	}
+
+	var r io.Reader = bytes.NewReader(att.Data)
+	if att.Spool != "" {
+		f, err := os.Open(att.Spool)
+		if err != nil {
+			return nil
+		}
+		defer f.Close()
+		r = f
+	}
+
+	nested, err := p.parse(r, depth)
+	if err != nil {
+		return nil
+	}
+	defer p.Release(nested)
+
+	info := &storage.MessageInfo{
+		MessageID: nested.MessageID,
+		From:      nested.From,
+		To:        nested.To,
+		CC:        nested.CC,
+		Subject:   nested.Subject,
+	}
+	if date, err := mail.Header(nested.Headers).Date(); err == nil {
+		info.Date = &date
+	}
+	for _, a := range nested.Attachments {
+		meta := a.AttachmentMeta
+		info.Attachments = append(info.Attachments, &meta)
+	}
+	return info
+}
@@ -2,37 +2,52 @@ package email
 
 import (
 	"bytes"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"mime"
-	"mime/quotedprintable"
 	"net/mail"
+	"os"
+	"regexp"
 	"strings"
 
 	"github.com/emersion/go-message"
 	"gowebmail/internal/storage"
 )
 
-// Parser handles email parsing
-type Parser struct{}
+// defaultSpoolThreshold is the size above which messages and decoded
+// attachments are spooled to temporary files
+const defaultSpoolThreshold = 1 << 20
+
+// Parser handles email parsing. A message is read once, as go-message
+// parses it; messages and attachments larger than SpoolThreshold are
+// written to temporary files as they are read rather than held in memory
+// until they are stored. Release removes those files.
+type Parser struct {
+	SpoolThreshold int64
+	SpoolDir       string // the system's temporary directory when empty
+}
 
 // NewParser creates a new email parser
 func NewParser() *Parser {
-	return &Parser{}
+	return &Parser{SpoolThreshold: defaultSpoolThreshold}
 }
 
-// Parse parses an email from a reader
+// messageIDPattern matches the Message-IDs in In-Reply-To and References
+var messageIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// Parse parses an email from a reader. The caller must Release the email
+// once it has been stored.
 func (p *Parser) Parse(r io.Reader) (*storage.Email, error) {
-	// Read all data
-	data, err := io.ReadAll(r)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read email: %w", err)
-	}
+	return p.parse(r, 0)
+}
 
-	// Parse message
-	msg, err := mail.ReadMessage(bytes.NewReader(data))
+// parse parses an email nested depth levels deep in message/rfc822 parts
+func (p *Parser) parse(r io.Reader, depth int) (*storage.Email, error) {
+	// Keep the original bytes as go-message reads them
+	raw := &spool{threshold: p.SpoolThreshold, dir: p.SpoolDir}
+	entity, err := message.Read(io.TeeReader(r, raw))
 	if err != nil {
+		raw.remove()
 		return nil, fmt.Errorf("failed to parse email: %w", err)
 	}
 
@@ -41,34 +56,81 @@ func (p *Parser) Parse(r io.Reader) (*storage.Email, error) {
 	}
 
 	// Parse headers
-	p.parseHeaders(msg.Header, email)
+	header := make(mail.Header)
+	fields := entity.Header.Fields()
+	for fields.Next() {
+		header[fields.Key()] = append(header[fields.Key()], fields.Value())
+	}
+	p.parseHeaders(header, email)
+	email.Received = ParseReceived(entity.Header.Values("Received"))
+	email.Unsubscribe = ParseUnsubscribe(entity.Header.Get("List-Unsubscribe"), entity.Header.Get("List-Unsubscribe-Post"))
 
 	// Parse body
-	entity, err := message.Read(bytes.NewReader(data))
+	attachments, err := p.parseBody(entity, email, depth)
+	email.Attachments = attachments
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse MIME: %w", err)
+		raw.remove()
+		p.Release(email)
+		return nil, fmt.Errorf("failed to parse body: %w", err)
 	}
+	checkAlternatives(email)
 
-	attachments, err := p.parseBody(entity, email)
+	// Whatever follows the last part, such as an epilogue, is not parsed
+	_, err = io.Copy(raw, r)
+	if closeErr := raw.close(); err == nil {
+		err = closeErr
+	}
+	email.RawSpool = raw.path
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse body: %w", err)
+		p.Release(email)
+		return nil, fmt.Errorf("failed to read email: %w", err)
 	}
 
-	// Convert attachments to metadata
-	for _, att := range attachments {
-		email.Attachments = append(email.Attachments, storage.AttachmentMeta{
-			Filename:    att.Filename,
-			ContentType: att.ContentType,
-			Size:        att.Size,
-		})
+	email.Size = raw.size
+	if raw.path == "" {
+		email.Raw = raw.buf.Bytes()
+	}
+	if depth == 0 {
+		sizes, err := p.measure(email)
+		if err != nil {
+			p.Release(email)
+			return nil, fmt.Errorf("failed to read email: %w", err)
+		}
+		email.SizeBreakdown = sizes
 	}
-
-	// Calculate size
-	email.Size = int64(len(data))
 
 	return email, nil
 }
 
+// measure returns the size breakdown of a parsed email, reading a spooled
+// message from its file
+func (p *Parser) measure(email *storage.Email) (*storage.SizeBreakdown, error) {
+	if email.RawSpool == "" {
+		return MeasureSize(email.Raw), nil
+	}
+	f, err := os.Open(email.RawSpool)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return MeasureSizeAt(f, email.Size), nil
+}
+
+// Release removes the temporary files of a spooled email and its spooled
+// attachments
+func (p *Parser) Release(email *storage.Email) {
+	if email.RawSpool != "" {
+		os.Remove(email.RawSpool)
+		email.RawSpool = ""
+	}
+	for _, att := range email.Attachments {
+		if att.Spool != "" {
+			os.Remove(att.Spool)
+			att.Spool = ""
+		}
+	}
+}
+
 // parseHeaders extracts headers from the email
 func (p *Parser) parseHeaders(header mail.Header, email *storage.Email) {
 	// Copy all headers
@@ -80,6 +142,12 @@ func (p *Parser) parseHeaders(header mail.Header, email *storage.Email) {
 	email.MessageID = header.Get("Message-ID")
 	email.Subject = p.decodeHeader(header.Get("Subject"))
 
+	// Threading headers
+	if ids := messageIDPattern.FindAllString(header.Get("In-Reply-To"), -1); len(ids) > 0 {
+		email.InReplyTo = ids[0]
+	}
+	email.References = messageIDPattern.FindAllString(header.Get("References"), -1)
+
 	// From address
 	if from := header.Get("From"); from != "" {
 		if addr, err := mail.ParseAddress(from); err == nil {
@@ -89,6 +157,28 @@ func (p *Parser) parseHeaders(header mail.Header, email *storage.Email) {
 		}
 	}
 
+	// Sender, which is set when someone sends on behalf of From
+	if sender := header.Get("Sender"); sender != "" {
+		if addr, err := mail.ParseAddress(sender); err == nil {
+			email.Sender = addr.Address
+		} else {
+			email.Sender = sender
+		}
+	}
+
+	// Reply-To addresses
+	if replyTo := header.Get("Reply-To"); replyTo != "" {
+		email.ReplyTo = p.parseAddressList(replyTo)
+	}
+
+	// Return-Path, added on delivery by the last MTA; <> is the null
+	// return path of bounces
+	if returnPath := header.Get("Return-Path"); returnPath != "" {
+		email.ReturnPath = strings.TrimSpace(strings.Trim(strings.TrimSpace(returnPath), "<>"))
+	}
+
+	email.Priority = ParsePriority(header)
+
 	// To addresses
 	if to := header.Get("To"); to != "" {
 		email.To = p.parseAddressList(to)
@@ -138,7 +228,7 @@ func (p *Parser) decodeHeader(header string) string {
 }
 
 // parseBody parses the email body and extracts text and attachments
-func (p *Parser) parseBody(entity *message.Entity, email *storage.Email) ([]*storage.Attachment, error) {
+func (p *Parser) parseBody(entity *message.Entity, email *storage.Email, depth int) ([]*storage.Attachment, error) {
 	var attachments []*storage.Attachment
 
 	mediaType, _, err := entity.Header.ContentType()
@@ -155,29 +245,30 @@ func (p *Parser) parseBody(entity *message.Entity, email *storage.Email) ([]*sto
 				break
 			}
 			if err != nil {
-				return nil, err
+				return attachments, err
 			}
 
-			atts, err := p.parsePart(part, email)
+			atts, err := p.parsePart(part, email, mediaType == "multipart/related", depth)
+			attachments = append(attachments, atts...)
 			if err != nil {
-				return nil, err
+				return attachments, err
 			}
-			attachments = append(attachments, atts...)
 		}
 	} else {
 		// Handle single part
-		atts, err := p.parsePart(entity, email)
+		atts, err := p.parsePart(entity, email, false, depth)
+		attachments = append(attachments, atts...)
 		if err != nil {
-			return nil, err
+			return attachments, err
 		}
-		attachments = append(attachments, atts...)
 	}
 
 	return attachments, nil
 }
 
-// parsePart parses a single MIME part
-func (p *Parser) parsePart(entity *message.Entity, email *storage.Email) ([]*storage.Attachment, error) {
+// parsePart parses a single MIME part. related is set for the parts of a
+// multipart/related body, whose resources are shown inline.
+func (p *Parser) parsePart(entity *message.Entity, email *storage.Email, related bool, depth int) ([]*storage.Attachment, error) {
 	var attachments []*storage.Attachment
 
 	mediaType, params, err := entity.Header.ContentType()
@@ -186,9 +277,14 @@ func (p *Parser) parsePart(entity *message.Entity, email *storage.Email) ([]*sto
 		params = nil
 	}
 
-	// Check if it's an attachment
+	// Every part but the text, HTML and AMP bodies is kept as an attachment,
+	// named or not. Parts with a Content-ID, such as the images of a
+	// multipart/related body, keep it so cid: URLs resolve.
 	disposition, dispParams, _ := entity.Header.ContentDisposition()
-	isAttachment := disposition == "attachment" || (disposition == "inline" && dispParams["filename"] != "")
+	contentID := NormalizeContentID(entity.Header.Get("Content-Id"))
+	isBody := (mediaType == "text/plain" || mediaType == "text/html" || mediaType == AMPType) &&
+		disposition != "attachment" && dispParams["filename"] == ""
+	isAttachment := !isBody && !strings.HasPrefix(mediaType, "multipart/")
 
 	if isAttachment {
 		// Handle attachment
@@ -197,43 +293,64 @@ func (p *Parser) parsePart(entity *message.Entity, email *storage.Email) ([]*sto
 			filename = params["name"]
 		}
 		if filename == "" {
-			filename = "attachment"
+			filename = contentID
 		}
-
-		data, err := io.ReadAll(entity.Body)
-		if err != nil {
-			return nil, err
+		if filename == "" && IsCalendarType(mediaType) {
+			filename = "invite.ics"
+		}
+		if filename == "" && IsMessageType(mediaType) {
+			filename = "message.eml"
+		}
+		if filename == "" {
+			filename = "attachment"
 		}
 
-		// Decode if needed
-		encoding := entity.Header.Get("Content-Transfer-Encoding")
-		data = p.decodeContent(data, encoding)
-
-		attachments = append(attachments, &storage.Attachment{
+		att := &storage.Attachment{
 			AttachmentMeta: storage.AttachmentMeta{
 				Filename:    filename,
 				ContentType: mediaType,
-				Size:        int64(len(data)),
+				ContentID:   contentID,
+				Inline:      disposition == "inline" || (disposition == "" && (contentID != "" || related)),
 			},
-			Data: data,
-		})
-	} else if strings.HasPrefix(mediaType, "text/") {
-		// Handle text content
+		}
+		// Returned even on error, so that a partial spool is released
+		attachments = append(attachments, att)
+		if err := p.readAttachment(entity.Body, att); err != nil {
+			return attachments, err
+		}
+
+		// The first calendar is the invitation; a copy attached as .ics
+		// is usually the same. Calendars that do not parse are only kept
+		// as attachments.
+		if IsCalendarType(mediaType) && email.Calendar == nil && att.Data != nil {
+			if cal, err := ParseCalendar(att.Data); err == nil {
+				if cal.Method == "" {
+					cal.Method = strings.ToUpper(params["method"])
+				}
+				email.Calendar = cal
+			}
+		}
+
+		// Attached emails, such as forwarded ones, are summarized
+		if IsMessageType(mediaType) {
+			att.Message = p.summarizeMessage(att, depth+1)
+		}
+	} else if isBody {
+		// Handle text content; go-message has decoded the transfer
+		// encoding
 		data, err := io.ReadAll(entity.Body)
 		if err != nil {
-			return nil, err
+			return attachments, err
 		}
 
-		// Decode if needed
-		encoding := entity.Header.Get("Content-Transfer-Encoding")
-		data = p.decodeContent(data, encoding)
-
 		text := string(data)
 
 		if mediaType == "text/plain" {
 			email.BodyPlain = text
 		} else if mediaType == "text/html" {
 			email.BodyHTML = text
+		} else if mediaType == AMPType {
+			email.BodyAMP = text
 		}
 	} else if strings.HasPrefix(mediaType, "multipart/") {
 		// Handle nested multipart
@@ -244,38 +361,100 @@ func (p *Parser) parsePart(entity *message.Entity, email *storage.Email) ([]*sto
 				break
 			}
 			if err != nil {
-				return nil, err
+				return attachments, err
 			}
 
-			atts, err := p.parsePart(part, email)
+			atts, err := p.parsePart(part, email, mediaType == "multipart/related", depth)
+			attachments = append(attachments, atts...)
 			if err != nil {
-				return nil, err
+				return attachments, err
 			}
-			attachments = append(attachments, atts...)
 		}
 	}
 
 	return attachments, nil
 }
 
-// decodeContent decodes content based on transfer encoding
-func (p *Parser) decodeContent(data []byte, encoding string) []byte {
-	encoding = strings.ToLower(strings.TrimSpace(encoding))
+// readAttachment reads the decoded body of an attachment into att: into
+// Data, or into a spool file when it is larger than SpoolThreshold. Its
+// type is detected from the start of the data.
+func (p *Parser) readAttachment(body io.Reader, att *storage.Attachment) error {
+	data, err := io.ReadAll(io.LimitReader(body, p.SpoolThreshold+1))
+	if err != nil {
+		return err
+	}
+	sniffAttachment(att, data)
+	if int64(len(data)) <= p.SpoolThreshold {
+		att.Data = data
+		att.Size = int64(len(data))
+		return nil
+	}
+
+	f, err := os.CreateTemp(p.SpoolDir, "gowebmail-part-*")
+	if err != nil {
+		return fmt.Errorf("failed to spool attachment: %w", err)
+	}
+	defer f.Close()
+	att.Spool = f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("failed to spool attachment: %w", err)
+	}
+	n, err := io.Copy(f, body)
+	if err != nil {
+		return fmt.Errorf("failed to spool attachment: %w", err)
+	}
+	att.Size = int64(len(data)) + n
+	return f.Close()
+}
+
+// spool holds what is written to it in memory up to threshold bytes, and
+// moves it to a temporary file beyond that
+type spool struct {
+	threshold int64
+	dir       string
+	buf       bytes.Buffer
+	file      *os.File
+	path      string
+	size      int64
+}
 
-	switch encoding {
-	case "base64":
-		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
-		n, err := base64.StdEncoding.Decode(decoded, data)
-		if err == nil {
-			return decoded[:n]
+func (s *spool) Write(b []byte) (int, error) {
+	if s.file == nil && s.size+int64(len(b)) > s.threshold {
+		f, err := os.CreateTemp(s.dir, "gowebmail-raw-*")
+		if err != nil {
+			return 0, fmt.Errorf("failed to spool email: %w", err)
 		}
-	case "quoted-printable":
-		reader := quotedprintable.NewReader(bytes.NewReader(data))
-		decoded, err := io.ReadAll(reader)
-		if err == nil {
-			return decoded
+		s.file, s.path = f, f.Name()
+		if _, err := f.Write(s.buf.Bytes()); err != nil {
+			return 0, fmt.Errorf("failed to spool email: %w", err)
 		}
+		s.buf = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(b)
+	} else {
+		n, err = s.buf.Write(b)
 	}
+	s.size += int64(n)
+	return n, err
+}
 
-	return data
+// close closes the spool file, if any
+func (s *spool) close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// remove closes and removes the spool file, if any
+func (s *spool) remove() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.path)
+	}
 }
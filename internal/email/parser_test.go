@@ -0,0 +1,91 @@
+package email
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// spoolMessage has an attachment of 3000 decoded bytes
+var spoolMessage = "From: a@example.com\r\nTo: b@example.com\r\nSubject: Report\r\n" +
+	"Content-Type: multipart/mixed; boundary=XX\r\n\r\n" +
+	"--XX\r\nContent-Type: text/plain\r\n\r\nSee attached.\r\n" +
+	"--XX\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=report.bin\r\n" +
+	"Content-Transfer-Encoding: base64\r\n\r\n" + strings.Repeat("QUJDREVGR0hJSktMTU5PUFFSU1RVVldYWVo0\r\n", 111) + "QUJD\r\n" +
+	"--XX--\r\n"
+
+// spoolFiles lists the files in dir
+func spoolFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestParseSpool(t *testing.T) {
+	for _, tc := range []struct {
+		threshold  int64
+		rawSpooled bool
+		attSpooled bool
+	}{
+		{1 << 20, false, false},
+		{4000, true, false},
+		{1000, true, true},
+	} {
+		dir := t.TempDir()
+		p := &Parser{SpoolThreshold: tc.threshold, SpoolDir: dir}
+		email, err := p.Parse(strings.NewReader(spoolMessage))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw := email.Raw
+		if (email.RawSpool != "") != tc.rawSpooled || (email.Raw == nil) != tc.rawSpooled {
+			t.Errorf("%d: raw %d bytes, spool %q", tc.threshold, len(email.Raw), email.RawSpool)
+		}
+		if email.RawSpool != "" {
+			if raw, err = os.ReadFile(email.RawSpool); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(raw) != spoolMessage || email.Size != int64(len(spoolMessage)) {
+			t.Errorf("%d: raw message of %d bytes", tc.threshold, email.Size)
+		}
+		if want := MeasureSize([]byte(spoolMessage)); !reflect.DeepEqual(email.SizeBreakdown, want) {
+			t.Errorf("%d: size breakdown %+v, want %+v", tc.threshold, email.SizeBreakdown, want)
+		}
+
+		att := email.Attachments[0]
+		if (att.Spool != "") != tc.attSpooled || att.Size != 3000 {
+			t.Errorf("%d: attachment of %d bytes, spool %q", tc.threshold, att.Size, att.Spool)
+		}
+		if email.BodyPlain != "See attached." {
+			t.Errorf("%d: body %q", tc.threshold, email.BodyPlain)
+		}
+
+		p.Release(email)
+		if files := spoolFiles(t, dir); len(files) != 0 {
+			t.Errorf("%d: %v left after Release", tc.threshold, files)
+		}
+	}
+}
+
+func TestParseSpoolFailure(t *testing.T) {
+	// A body that does not decode leaves no spool files
+	dir := t.TempDir()
+	p := &Parser{SpoolThreshold: 100, SpoolDir: dir}
+	broken := strings.Replace(spoolMessage, "QUJD\r\n--XX--", "QUJD=\r\n--XX--", 1)
+	if _, err := p.Parse(strings.NewReader(broken)); err == nil {
+		t.Fatal("parsed")
+	}
+	if files := spoolFiles(t, dir); len(files) != 0 {
+		t.Errorf("%v left after failure", files)
+	}
+}
@@ -0,0 +1,156 @@
+package email
+
+import (
+	"bytes"
+	"html"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// Alternatives an email may lack, as set in MissingAlternative
+const (
+	MissingPlain = "plain"
+	MissingHTML  = "html"
+)
+
+// checkAlternatives flags an email with only one of a plain-text and an
+// HTML body. The plain-text body of an HTML-only email is derived from its
+// HTML so that it can be previewed and searched like any other.
+func checkAlternatives(email *storage.Email) {
+	switch {
+	case email.BodyPlain == "" && email.BodyHTML != "":
+		email.MissingAlternative = MissingPlain
+		email.BodyPlain = HTMLToText(email.BodyHTML)
+	case email.BodyHTML == "" && email.BodyPlain != "":
+		email.MissingAlternative = MissingHTML
+	}
+}
+
+// paragraphTags are separated from what surrounds them by a blank line,
+// and lineTags by a line break
+var (
+	paragraphTags = map[string]bool{
+		"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+		"table": true, "ul": true, "ol": true, "blockquote": true, "pre": true, "hr": true,
+	}
+	lineTags = map[string]bool{
+		"br": true, "div": true, "tr": true, "li": true, "dt": true, "dd": true,
+		"section": true, "article": true, "header": true, "footer": true, "center": true,
+	}
+)
+
+// HTMLToText renders an HTML body as plain text, as a mail client would
+// for its text alternative: paragraphs and list items on lines of their
+// own, links followed by their URL, and images replaced by their alt
+// text. Whitespace, including non-breaking spaces, is collapsed outside
+// pre elements, and the head, style and script elements are left out.
+func HTMLToText(doc string) string {
+	var b []byte
+	var pre, hidden int
+	var href string
+	linkStart := 0
+
+	// breakLines ends the text so far with n line breaks, counting those
+	// it already ends with
+	breakLines := func(n int) {
+		b = bytes.TrimRight(b, " ")
+		if len(b) == 0 {
+			return
+		}
+		for i := len(b) - 1; i >= 0 && b[i] == '\n' && n > 0; i-- {
+			n--
+		}
+		for ; n > 0; n-- {
+			b = append(b, '\n')
+		}
+	}
+	write := func(text string) {
+		if hidden > 0 {
+			return
+		}
+		text = html.UnescapeString(text)
+		if pre == 0 {
+			text = collapseSpace(text)
+			// Collapsed spaces at the start of a line are dropped
+			if len(b) == 0 || b[len(b)-1] == '\n' || b[len(b)-1] == ' ' {
+				text = strings.TrimLeft(text, " ")
+			}
+		}
+		b = append(b, text...)
+	}
+
+	pos := 0
+	for _, tag := range scanTags(doc) {
+		write(doc[pos:tag.Start])
+		pos = tag.End + len(tag.Text)
+
+		depth := 1
+		if tag.Closing {
+			depth = -1
+		}
+		switch tag.Name {
+		case "head", "title":
+			hidden = max(hidden+depth, 0)
+		case "a":
+			if !tag.Closing {
+				href, linkStart = tag.Attrs["href"], len(b)
+				continue
+			}
+			text := string(bytes.TrimSpace(b[linkStart:]))
+			if (strings.HasPrefix(href, "http://") || strings.HasPrefix(href, "https://")) && text != href {
+				write(" (" + href + ")")
+			}
+			href = ""
+		case "img":
+			if alt := tag.Attrs["alt"]; alt != "" {
+				write(" " + alt + " ")
+			}
+		case "td", "th":
+			write(" ")
+		default:
+			if paragraphTags[tag.Name] {
+				if tag.Name == "pre" {
+					pre = max(pre+depth, 0)
+				}
+				breakLines(2)
+				if tag.Name == "hr" {
+					b = append(b, "----\n\n"...)
+				}
+			} else if lineTags[tag.Name] {
+				breakLines(1)
+				if tag.Name == "li" && !tag.Closing {
+					b = append(b, "- "...)
+				}
+			}
+		}
+	}
+	write(doc[pos:])
+
+	text := strings.TrimSpace(string(b))
+	if text == "" {
+		return ""
+	}
+	return text + "\n"
+}
+
+// collapseSpace replaces each run of whitespace in s with a single space
+func collapseSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' || r == '\u00a0' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
@@ -0,0 +1,49 @@
+package email
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// Priorities an email may be flagged with, as set in Priority
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// priorityHeaders are the headers mail clients flag priority with, in the
+// order they are looked at, and how their values map to a priority.
+// X-Priority is handled separately, being a number.
+var priorityHeaders = []struct {
+	name   string
+	values map[string]string
+}{
+	{"Importance", map[string]string{"high": PriorityHigh, "normal": PriorityNormal, "low": PriorityLow}},
+	{"X-MSMail-Priority", map[string]string{"high": PriorityHigh, "normal": PriorityNormal, "low": PriorityLow}},
+	{"Priority", map[string]string{"urgent": PriorityHigh, "normal": PriorityNormal, "non-urgent": PriorityLow}}, // RFC 2156
+}
+
+// ParsePriority returns the priority an email is flagged with by its
+// X-Priority, Importance, X-MSMail-Priority or Priority header, the first
+// with a value it understands, or "" when it has none. X-Priority runs
+// from 1, the highest, to 5, and is usually followed by a description as
+// in "1 (Highest)".
+func ParsePriority(header mail.Header) string {
+	if value := strings.TrimSpace(header.Get("X-Priority")); value != "" {
+		switch value[0] {
+		case '1', '2':
+			return PriorityHigh
+		case '3':
+			return PriorityNormal
+		case '4', '5':
+			return PriorityLow
+		}
+	}
+	for _, h := range priorityHeaders {
+		if priority, ok := h.values[strings.ToLower(strings.TrimSpace(header.Get(h.name)))]; ok {
+			return priority
+		}
+	}
+	return ""
+}
@@ -0,0 +1,146 @@
+package email
+
+import (
+	"net"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// receivedClauses are the clauses of a Received header that parseReceived
+// reads; others, such as via, are skipped
+var receivedClauses = map[string]bool{
+	"from": true, "by": true, "via": true, "with": true, "id": true, "for": true,
+}
+
+// addressLiteralPattern matches an address literal such as [192.0.2.1] or
+// [IPv6:2001:db8::1]
+var addressLiteralPattern = regexp.MustCompile(`\[(?i:IPv6:)?([0-9A-Fa-f:.]+)\]`)
+
+// heloPattern matches the greeting name Exim and others record in a
+// comment, as in (helo=mail.example.com)
+var heloPattern = regexp.MustCompile(`(?i)\bhelo=([^\s()\]]+)`)
+
+// ParseReceived parses the Received headers of an email, given top to
+// bottom as relays prepend them, into its hops in the order the email
+// reached them. Headers that do not parse still make a hop, with only
+// Header set.
+func ParseReceived(headers []string) []*storage.ReceivedHop {
+	var hops []*storage.ReceivedHop
+	for i := len(headers) - 1; i >= 0; i-- {
+		hops = append(hops, parseReceived(headers[i]))
+	}
+
+	var last *storage.ReceivedHop
+	for _, hop := range hops {
+		if hop.Timestamp == nil {
+			continue
+		}
+		if last != nil {
+			delay := hop.Timestamp.Sub(*last.Timestamp).Milliseconds()
+			hop.DelayMs = &delay
+		}
+		last = hop
+	}
+	return hops
+}
+
+// parseReceived parses a Received header (RFC 5321 section 4.4), such as
+//
+//	from mail.example.com (mail.example.com [192.0.2.1]) by mx.example.net
+//	with ESMTPS id 4F1A2 for <bob@example.net>; Tue, 14 Jul 2026 09:12:00 +0200
+//
+// Relays differ in what they write, so each clause is optional and any
+// comment following it is searched for what it lacks.
+func parseReceived(header string) *storage.ReceivedHop {
+	header = strings.Join(strings.Fields(header), " ")
+	hop := &storage.ReceivedHop{Header: header}
+
+	clauses := header
+	if i := strings.LastIndex(header, ";"); i >= 0 {
+		clauses = header[:i]
+		if t, err := mail.ParseDate(strings.TrimSpace(header[i+1:])); err == nil {
+			hop.Timestamp = &t
+		}
+	}
+
+	var clause string
+	var value, comments strings.Builder
+	flush := func() {
+		v := strings.TrimSpace(value.String())
+		c := comments.String()
+		switch clause {
+		case "from":
+			hop.From = strings.Trim(v, "[]")
+			if ip := net.ParseIP(hop.From); ip != nil {
+				hop.From, hop.FromIP = "", ip.String()
+			} else if m := addressLiteralPattern.FindStringSubmatch(v); m != nil {
+				hop.From = ""
+				hop.FromIP = literalIP(m[1])
+			}
+			if m := addressLiteralPattern.FindStringSubmatchIndex(c); m != nil {
+				if hop.FromIP == "" {
+					hop.FromIP = literalIP(c[m[2]:m[3]])
+				}
+				// The host name looked up for the address comes before it
+				if fields := strings.Fields(strings.TrimRight(c[:m[0]], " (")); len(fields) > 0 {
+					host := strings.TrimSuffix(strings.Trim(fields[len(fields)-1], "("), ".")
+					if strings.Contains(host, ".") && !strings.Contains(host, "=") {
+						hop.FromHost = host
+					}
+				}
+			}
+			if m := heloPattern.FindStringSubmatch(c); m != nil && hop.From == "" {
+				hop.From = m[1]
+			}
+		case "by":
+			hop.By = v
+		case "with":
+			hop.Protocol = v
+		case "id":
+			hop.ID = v
+		case "for":
+			hop.For = strings.Trim(v, "<>")
+		}
+		value.Reset()
+		comments.Reset()
+	}
+
+	depth := 0
+	for _, word := range strings.Fields(clauses) {
+		if depth == 0 && !strings.HasPrefix(word, "(") && receivedClauses[strings.ToLower(word)] {
+			flush()
+			clause = strings.ToLower(word)
+			continue
+		}
+		opening := strings.Count(word, "(")
+		if depth > 0 || opening > 0 {
+			comments.WriteString(word + " ")
+			depth += opening - strings.Count(word, ")")
+			if depth < 0 {
+				depth = 0
+			}
+			continue
+		}
+		// A clause has a single value; anything after it is a comment
+		// only some relays leave unparenthesized
+		if value.Len() == 0 {
+			value.WriteString(word)
+		} else {
+			comments.WriteString(word + " ")
+		}
+	}
+	flush()
+	return hop
+}
+
+// literalIP returns the IP address of an address literal, or "" if it is
+// not one
+func literalIP(s string) string {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,258 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// Kinds of parts in a size breakdown
+const (
+	partText       = "text"
+	partHTML       = "html"
+	partAMP        = "amp"
+	partAttachment = "attachment"
+)
+
+// MeasureSize breaks the size of a raw message down into its header, its
+// bodies and attachments as they are encoded in the message, and the
+// structure around them: part headers, boundaries and preambles. Parts are
+// numbered as IMAP does, and the sizes add up to the size of the message.
+func MeasureSize(raw []byte) *storage.SizeBreakdown {
+	return MeasureSizeAt(bytes.NewReader(raw), int64(len(raw)))
+}
+
+// MeasureSizeAt is MeasureSize for a message of size bytes read from r,
+// such as a spool file. The message is scanned a window at a time rather
+// than read whole.
+func MeasureSizeAt(r io.ReaderAt, size int64) *storage.SizeBreakdown {
+	header, body := splitHeader(io.NewSectionReader(r, 0, size))
+	sizes := &storage.SizeBreakdown{Headers: header.Size(), Parts: []*storage.PartSize{}}
+	measurePart(sizes, header, body, "")
+
+	sizes.Structure = size - sizes.Headers - sizes.Text - sizes.HTML - sizes.AMP - sizes.Attachments
+	return sizes
+}
+
+// measurePart adds the leaf parts of the part with header and body to
+// sizes. number is that of the part, "" for the message itself.
+func measurePart(sizes *storage.SizeBreakdown, header, body *io.SectionReader, number string) {
+	h, _ := textproto.NewReader(bufio.NewReader(io.MultiReader(header, strings.NewReader("\r\n")))).ReadMIMEHeader()
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		for i, part := range splitMultipart(body, params["boundary"]) {
+			partHeader, partBody := splitHeader(part)
+			child := strconv.Itoa(i + 1)
+			if number != "" {
+				child = number + "." + child
+			}
+			measurePart(sizes, partHeader, partBody, child)
+		}
+		return
+	}
+
+	if number == "" {
+		number = "1"
+	}
+	disposition, dispParams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(filename); err == nil {
+		filename = decoded
+	}
+	encoding := strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding")))
+
+	part := &storage.PartSize{
+		Part:        number,
+		ContentType: mediaType,
+		Kind:        partAttachment,
+		Encoding:    encoding,
+		Size:        body.Size(),
+		DecodedSize: decodedSize(body, encoding),
+	}
+	// Bodies are told from attachments as the parser does
+	if disposition != "attachment" && dispParams["filename"] == "" {
+		switch mediaType {
+		case "text/plain":
+			part.Kind = partText
+		case "text/html":
+			part.Kind = partHTML
+		case AMPType:
+			part.Kind = partAMP
+		}
+	}
+	if part.Kind == partAttachment {
+		part.Filename = filename
+	}
+
+	switch part.Kind {
+	case partText:
+		sizes.Text += part.Size
+	case partHTML:
+		sizes.HTML += part.Size
+	case partAMP:
+		sizes.AMP += part.Size
+	default:
+		sizes.Attachments += part.Size
+	}
+	sizes.Parts = append(sizes.Parts, part)
+}
+
+// scanWindow is how much of a message is read at a time to search it
+const scanWindow = 32 << 10
+
+// index returns the offset in s of the first sep at or after from, or -1
+func index(s *io.SectionReader, from int64, sep string) int64 {
+	buf := make([]byte, scanWindow+len(sep)-1)
+	for from < s.Size() {
+		n, _ := s.ReadAt(buf, from)
+		if n < len(sep) {
+			return -1
+		}
+		if i := bytes.Index(buf[:n], []byte(sep)); i >= 0 {
+			return from + int64(i)
+		}
+		// The next window starts early enough for a separator split
+		// across the two
+		from += int64(n - len(sep) + 1)
+	}
+	return -1
+}
+
+// hasPrefixAt reports whether the bytes of s at off begin with prefix
+func hasPrefixAt(s *io.SectionReader, off int64, prefix string) bool {
+	buf := make([]byte, len(prefix))
+	n, _ := s.ReadAt(buf, off)
+	return n == len(buf) && string(buf) == prefix
+}
+
+// byteAt returns the byte of s at off
+func byteAt(s *io.SectionReader, off int64) byte {
+	var b [1]byte
+	s.ReadAt(b[:], off)
+	return b[0]
+}
+
+// splitHeader splits an entity at the blank line ending its header, which
+// stays with the header
+func splitHeader(entity *io.SectionReader) (header, body *io.SectionReader) {
+	end := entity.Size()
+	switch {
+	case hasPrefixAt(entity, 0, "\r\n"):
+		end = 2
+	case hasPrefixAt(entity, 0, "\n"):
+		end = 1
+	default:
+		if i := index(entity, 0, "\n\r\n"); i >= 0 {
+			end = i + 3
+		}
+		if i := index(io.NewSectionReader(entity, 0, end), 0, "\n\n"); i >= 0 && i+2 < end {
+			end = i + 2
+		}
+	}
+	return io.NewSectionReader(entity, 0, end), io.NewSectionReader(entity, end, entity.Size()-end)
+}
+
+// splitMultipart returns the parts of a multipart body, without the line
+// break before each delimiter, which belongs to it (RFC 2046)
+func splitMultipart(body *io.SectionReader, boundary string) []*io.SectionReader {
+	delimiter := "--" + boundary
+	size := body.Size()
+
+	var delimiters []int64
+	for i := int64(0); i < size; {
+		j := index(body, i, delimiter)
+		if j < 0 {
+			break
+		}
+		i = j + int64(len(delimiter))
+		if j > 0 && byteAt(body, j-1) != '\n' {
+			continue
+		}
+		if i < size && !strings.ContainsRune("\r\n \t-", rune(byteAt(body, i))) {
+			continue // a longer boundary
+		}
+		delimiters = append(delimiters, j)
+	}
+
+	var parts []*io.SectionReader
+	for k, d := range delimiters {
+		after := d + int64(len(delimiter))
+		if hasPrefixAt(body, after, "--") {
+			break // the close delimiter
+		}
+		eol := index(body, after, "\n")
+		if eol < 0 {
+			break
+		}
+		start, end := eol+1, size
+		if k+1 < len(delimiters) {
+			end = delimiters[k+1]
+			if end > start && byteAt(body, end-1) == '\n' {
+				end--
+			}
+			if end > start && byteAt(body, end-1) == '\r' {
+				end--
+			}
+		}
+		if end < start {
+			end = start
+		}
+		parts = append(parts, io.NewSectionReader(body, start, end-start))
+	}
+	return parts
+}
+
+// decodedSize returns the size of a body once its transfer encoding is
+// decoded
+func decodedSize(body *io.SectionReader, encoding string) int64 {
+	var r io.Reader
+	switch encoding {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, &spaceless{r: body})
+	case "quoted-printable":
+		r = quotedprintable.NewReader(body)
+	default:
+		return body.Size()
+	}
+	n, _ := io.Copy(io.Discard, r)
+	return n
+}
+
+// spaceless reads from r without the white space that base64 bodies are
+// broken into lines with
+type spaceless struct {
+	r io.Reader
+}
+
+func (s *spaceless) Read(p []byte) (int, error) {
+	for {
+		n, err := s.r.Read(p)
+		kept := 0
+		for _, c := range p[:n] {
+			switch c {
+			case ' ', '\t', '\r', '\n', '\v', '\f':
+			default:
+				p[kept] = c
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package email
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// sniffLen is how much of an attachment is looked at to detect its type
+const sniffLen = 512
+
+// typeAliases maps the other names types are declared with to those
+// http.DetectContentType returns
+var typeAliases = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"image/x-ms-bmp":               "image/bmp",
+	"image/vnd.microsoft.icon":     "image/x-icon",
+	"application/x-pdf":            "application/pdf",
+	"application/gzip":             "application/x-gzip",
+	"application/x-zip-compressed": "application/zip",
+	"application/vnd.rar":          "application/x-rar-compressed",
+	"application/x-rar":            "application/x-rar-compressed",
+	"application/font-woff":        "font/woff",
+	"application/x-font-ttf":       "font/ttf",
+	"audio/mp3":                    "audio/mpeg",
+	"audio/wav":                    "audio/wave",
+	"audio/x-wav":                  "audio/wave",
+	"audio/vnd.wave":               "audio/wave",
+	"audio/x-aiff":                 "audio/aiff",
+	"audio/mid":                    "audio/midi",
+	"audio/ogg":                    "application/ogg",
+	"audio/opus":                   "application/ogg",
+	"video/ogg":                    "application/ogg",
+	"video/x-msvideo":              "video/avi",
+}
+
+// signatureTypes are the types http.DetectContentType recognizes by their
+// magic bytes, so data declared as one of them that sniffs as plain text
+// is not what it claims to be. Other types, such as text/csv or
+// application/msword, have no signature it knows and sniff as text or
+// application/octet-stream.
+var signatureTypes = map[string]bool{
+	"application/pdf": true, "application/postscript": true, "application/ogg": true,
+	"application/zip": true, "application/x-gzip": true, "application/x-rar-compressed": true,
+	"application/wasm": true, "application/vnd.ms-fontobject": true,
+	"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true, "image/bmp": true, "image/x-icon": true,
+	"audio/mpeg": true, "audio/wave": true, "audio/aiff": true, "audio/basic": true, "audio/midi": true,
+	"video/mp4": true, "video/webm": true, "video/avi": true,
+	"font/ttf": true, "font/otf": true, "font/woff": true, "font/woff2": true, "font/collection": true,
+}
+
+// containerTypes lists, by detected type, the prefixes of the types of
+// formats built on it, such as Office documents, which are ZIP archives
+var containerTypes = map[string][]string{
+	"application/zip": {
+		"application/vnd.openxmlformats-officedocument.", "application/vnd.oasis.opendocument.",
+		"application/vnd.ms-", "application/java-archive", "application/x-java-archive",
+		"application/vnd.android.package-archive",
+	},
+	"application/x-gzip": {"application/x-tar", "application/x-gtar", "application/x-tgz", "application/x-compressed-tar"},
+	"video/mp4":          {"video/", "audio/mp4", "audio/m4a", "audio/x-m4a"},
+	"text/html":          {"application/xhtml+xml"},
+	"text/xml":           {"text/html", "application/xhtml+xml", "image/svg+xml"},
+}
+
+// sniffAttachment sets the type of an attachment detected from the start
+// of its data, and notes when that contradicts the type it was declared
+// with or the type its file name suggests, as with a report.pdf that is
+// an HTML error page
+func sniffAttachment(att *storage.Attachment, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if len(data) > sniffLen {
+		data = data[:sniffLen]
+	}
+	att.DetectedType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+
+	if declared, _, _ := mime.ParseMediaType(att.ContentType); !compatibleType(att.DetectedType, declared) {
+		att.TypeMismatch = "content is " + att.DetectedType + ", not " + declared + " as declared"
+		return
+	}
+	ext := strings.ToLower(filepath.Ext(att.Filename))
+	if ext == "" {
+		return
+	}
+	if byName, _, _ := mime.ParseMediaType(mime.TypeByExtension(ext)); !compatibleType(att.DetectedType, byName) {
+		att.TypeMismatch = "content is " + att.DetectedType + ", not " + byName + " as the " + ext + " extension suggests"
+	}
+}
+
+// compatibleType reports whether data sniffed as detected may be of the
+// claimed type. Data that could be anything, and claims of no particular
+// type, are taken to be compatible.
+func compatibleType(detected, claimed string) bool {
+	claimed = strings.ToLower(claimed)
+	if alias, ok := typeAliases[claimed]; ok {
+		claimed = alias
+	}
+	if claimed == "" || claimed == "application/octet-stream" || detected == "application/octet-stream" || detected == claimed {
+		return true
+	}
+
+	switch detected {
+	case "text/plain":
+		// Any data without a signature sniffs as text
+		return !signatureTypes[claimed]
+	case "application/zip":
+		if strings.HasSuffix(claimed, "+zip") {
+			return true
+		}
+	case "text/xml":
+		if strings.HasSuffix(claimed, "+xml") || strings.HasSuffix(claimed, "/xml") {
+			return true
+		}
+	}
+	for _, prefix := range containerTypes[detected] {
+		if strings.HasPrefix(claimed, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package email
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// oneClickPost is the List-Unsubscribe-Post value of one-click unsubscribe
+// (RFC 8058)
+const oneClickPost = "List-Unsubscribe=One-Click"
+
+// bracketedURIPattern matches the URIs of a List-Unsubscribe header, which
+// are enclosed in angle brackets
+var bracketedURIPattern = regexp.MustCompile(`<([^>]*)>`)
+
+// ParseUnsubscribe parses the List-Unsubscribe and List-Unsubscribe-Post
+// headers of an email, and notes where they fall short of the one-click
+// unsubscribe that mailbox providers require of bulk senders. It returns
+// nil when the email has neither header.
+func ParseUnsubscribe(listUnsubscribe, listUnsubscribePost string) *storage.Unsubscribe {
+	listUnsubscribePost = strings.TrimSpace(listUnsubscribePost)
+	if strings.TrimSpace(listUnsubscribe) == "" && listUnsubscribePost == "" {
+		return nil
+	}
+
+	unsub := &storage.Unsubscribe{
+		OneClick: strings.EqualFold(listUnsubscribePost, oneClickPost),
+	}
+	https := false
+	for _, m := range bracketedURIPattern.FindAllStringSubmatch(listUnsubscribe, -1) {
+		// Whitespace in a URI is ignored, as it may be folded (RFC 2369)
+		uri := strings.Join(strings.Fields(m[1]), "")
+		u, err := url.Parse(uri)
+		if err != nil {
+			unsub.Problems = append(unsub.Problems, "invalid URI "+uri)
+			continue
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "mailto":
+			unsub.Mailto = append(unsub.Mailto, uri)
+		case "https":
+			https = true
+			unsub.URLs = append(unsub.URLs, uri)
+		case "http":
+			unsub.URLs = append(unsub.URLs, uri)
+		default:
+			unsub.Problems = append(unsub.Problems, "unsupported URI "+uri)
+		}
+	}
+
+	switch {
+	case len(unsub.Mailto) == 0 && len(unsub.URLs) == 0:
+		unsub.Problems = append(unsub.Problems, "List-Unsubscribe has no mailto or http URI")
+	case !https:
+		unsub.Problems = append(unsub.Problems, "List-Unsubscribe has no https URI for one-click unsubscribe")
+	}
+	switch {
+	case listUnsubscribePost == "":
+		unsub.Problems = append(unsub.Problems, "List-Unsubscribe-Post is missing")
+	case !unsub.OneClick:
+		unsub.Problems = append(unsub.Problems, "List-Unsubscribe-Post is not "+oneClickPost)
+	}
+	return unsub
+}
+
+// ParseMailto parses a mailto URI (RFC 6068) into its recipients, subject
+// and body
+func ParseMailto(uri string) (to []string, subject, body string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, "", "", err
+	}
+	addresses, err := url.PathUnescape(u.Opaque)
+	if err != nil {
+		return nil, "", "", err
+	}
+	query := u.Query()
+	for _, list := range append([]string{addresses}, query["to"]...) {
+		for _, addr := range strings.Split(list, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				to = append(to, addr)
+			}
+		}
+	}
+	return to, query.Get("subject"), query.Get("body"), nil
+}
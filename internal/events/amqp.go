@@ -0,0 +1,413 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gowebmail/internal/config"
+)
+
+// AMQP 0-9-1 frame types
+const (
+	amqpFrameMethod = 1
+	amqpFrameHeader = 2
+	amqpFrameBody   = 3
+	amqpFrameEnd    = 0xCE
+)
+
+// AMQP 0-9-1 classes and methods, as class<<16 | method
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelClose      = 20<<16 | 40
+	amqpBasicPublish      = 60<<16 | 40
+	amqpBasicAck          = 60<<16 | 80
+	amqpBasicNack         = 60<<16 | 120
+	amqpConfirmSelect     = 85<<16 | 10
+	amqpConfirmSelectOk   = 85<<16 | 11
+)
+
+// amqpClassBasic is the class of the content header of published messages
+const amqpClassBasic = 60
+
+// amqpFrameMax is the largest frame gowebmail asks the server for
+const amqpFrameMax = 128 << 10
+
+// amqpConn publishes to an exchange over AMQP 0-9-1, the protocol of
+// RabbitMQ. It opens one channel in confirm mode, so every publish waits
+// for the broker's acknowledgement.
+type amqpConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	timeout  time.Duration
+	frameMax int
+	exchange string
+	subject  string
+}
+
+// amqpError is a connection or channel closed by the broker
+type amqpError struct {
+	code int
+	text string
+}
+
+func (e *amqpError) Error() string {
+	return fmt.Sprintf("amqp: %d %s", e.code, e.text)
+}
+
+// dialAMQP connects to the AMQP server of a sink and opens a channel. The
+// URL holds the credentials, guest:guest by default, and the virtual
+// host, / by default.
+func dialAMQP(sc *config.EventSink, timeout time.Duration) (conn, error) {
+	u, err := url.Parse(sc.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "5672"
+		if u.Scheme == "amqps" {
+			port = "5671"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	user, password := "guest", "guest"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	vhost := "/"
+	if p := strings.TrimPrefix(u.Path, "/"); p != "" {
+		vhost = p
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var nc net.Conn
+	if u.Scheme == "amqps" {
+		nc, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		nc, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &amqpConn{
+		conn:     nc,
+		r:        bufio.NewReader(nc),
+		timeout:  timeout,
+		frameMax: amqpFrameMax,
+		exchange: sc.Exchange,
+		subject:  sc.Subject,
+	}
+	if err := c.handshake(user, password, vhost); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// handshake opens the connection and a channel in confirm mode
+func (c *amqpConn) handshake(user, password, vhost string) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	if _, err := c.conn.Write([]byte("AMQP\x00\x00\x09\x01")); err != nil {
+		return err
+	}
+
+	args, err := c.expect(amqpConnectionStart)
+	if err != nil {
+		return err
+	}
+	// version-major, version-minor, server-properties, mechanisms
+	r := bytes.NewReader(args[2:])
+	skipTable(r)
+	mechanisms, _ := readLongString(r)
+	if !strings.Contains(" "+mechanisms+" ", " PLAIN ") {
+		return fmt.Errorf("amqp: server does not offer PLAIN authentication (%s)", mechanisms)
+	}
+
+	var startOk bytes.Buffer
+	writeTable(&startOk, map[string]string{"product": "gowebmail"})
+	writeShortString(&startOk, "PLAIN")
+	writeLongString(&startOk, "\x00"+user+"\x00"+password)
+	writeShortString(&startOk, "en_US")
+	if err := c.writeMethod(0, amqpConnectionStartOk, startOk.Bytes()); err != nil {
+		return err
+	}
+
+	args, err = c.expect(amqpConnectionTune)
+	if err != nil {
+		return err
+	}
+	if len(args) < 8 {
+		return errors.New("amqp: short connection.tune")
+	}
+	channelMax := binary.BigEndian.Uint16(args[0:])
+	if frameMax := int(binary.BigEndian.Uint32(args[2:])); frameMax != 0 && frameMax < c.frameMax {
+		c.frameMax = frameMax
+	}
+
+	// No heartbeats: the connection is used at least every event, and a
+	// dead one is replaced on the next publish
+	tuneOk := binary.BigEndian.AppendUint16(nil, channelMax)
+	tuneOk = binary.BigEndian.AppendUint32(tuneOk, uint32(c.frameMax))
+	tuneOk = binary.BigEndian.AppendUint16(tuneOk, 0)
+	if err := c.writeMethod(0, amqpConnectionTuneOk, tuneOk); err != nil {
+		return err
+	}
+
+	var open bytes.Buffer
+	writeShortString(&open, vhost)
+	writeShortString(&open, "")
+	open.WriteByte(0)
+	if err := c.writeMethod(0, amqpConnectionOpen, open.Bytes()); err != nil {
+		return err
+	}
+	if _, err := c.expect(amqpConnectionOpenOk); err != nil {
+		return err
+	}
+
+	if err := c.writeMethod(1, amqpChannelOpen, []byte{0}); err != nil {
+		return err
+	}
+	if _, err := c.expect(amqpChannelOpenOk); err != nil {
+		return err
+	}
+
+	if err := c.writeMethod(1, amqpConfirmSelect, []byte{0}); err != nil {
+		return err
+	}
+	_, err = c.expect(amqpConfirmSelectOk)
+	return err
+}
+
+// publish sends body to the exchange, routed by the subject of the event,
+// and waits for the broker to confirm it
+func (c *amqpConn) publish(event, key string, mailboxes []string, body []byte) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	var method bytes.Buffer
+	method.Write([]byte{0, 0}) // reserved
+	writeShortString(&method, c.exchange)
+	writeShortString(&method, c.subject+"."+event)
+	method.WriteByte(0) // neither mandatory nor immediate
+
+	// content-type, delivery-mode, message-id, timestamp, type and app-id
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, uint16(amqpClassBasic))
+	binary.Write(&header, binary.BigEndian, uint16(0))
+	binary.Write(&header, binary.BigEndian, uint64(len(body)))
+	binary.Write(&header, binary.BigEndian, uint16(1<<15|1<<12|1<<7|1<<6|1<<5|1<<3))
+	writeShortString(&header, "application/json")
+	header.WriteByte(2) // persistent
+	writeShortString(&header, key)
+	binary.Write(&header, binary.BigEndian, uint64(time.Now().Unix()))
+	writeShortString(&header, event)
+	writeShortString(&header, "gowebmail")
+
+	w := bufio.NewWriter(c.conn)
+	writeFrame(w, amqpFrameMethod, 1, append(methodID(amqpBasicPublish), method.Bytes()...))
+	writeFrame(w, amqpFrameHeader, 1, header.Bytes())
+	for max := c.frameMax - 8; len(body) > 0; {
+		n := min(len(body), max)
+		writeFrame(w, amqpFrameBody, 1, body[:n])
+		body = body[n:]
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		method, _, err := c.readMethod()
+		if err != nil {
+			return err
+		}
+		switch method {
+		case amqpBasicAck:
+			return nil
+		case amqpBasicNack:
+			return errors.New("amqp: broker rejected the message")
+		}
+	}
+}
+
+// expect reads the next method, which must be want
+func (c *amqpConn) expect(want uint32) ([]byte, error) {
+	method, args, err := c.readMethod()
+	if err != nil {
+		return nil, err
+	}
+	if method != want {
+		return nil, fmt.Errorf("amqp: unexpected method %d.%d", method>>16, method&0xFFFF)
+	}
+	return args, nil
+}
+
+// readMethod reads frames up to the next method, skipping heartbeats and
+// returning the broker closing the connection or channel as an error
+func (c *amqpConn) readMethod() (uint32, []byte, error) {
+	for {
+		frameType, channel, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		if frameType != amqpFrameMethod {
+			continue
+		}
+		if len(payload) < 4 {
+			return 0, nil, errors.New("amqp: short method frame")
+		}
+
+		method := binary.BigEndian.Uint32(payload)
+		args := payload[4:]
+		switch method {
+		case amqpConnectionClose, amqpChannelClose:
+			reason := closeReason(args)
+			if method == amqpConnectionClose {
+				c.writeMethod(0, amqpConnectionCloseOk, nil)
+			} else {
+				c.writeMethod(channel, amqpChannelClose+1, nil) // channel.close-ok
+			}
+			return 0, nil, reason
+		}
+		return method, args, nil
+	}
+}
+
+// closeReason decodes the reply code and text of a close method
+func closeReason(args []byte) error {
+	e := &amqpError{}
+	if len(args) >= 2 {
+		e.code = int(binary.BigEndian.Uint16(args))
+		e.text, _ = readShortString(bytes.NewReader(args[2:]))
+	}
+	return e
+}
+
+// readFrame reads one frame
+func (c *amqpConn) readFrame() (frameType byte, channel uint16, payload []byte, err error) {
+	var head [7]byte
+	if _, err = io.ReadFull(c.r, head[:]); err != nil {
+		return
+	}
+	frameType = head[0]
+	channel = binary.BigEndian.Uint16(head[1:])
+	size := binary.BigEndian.Uint32(head[3:])
+	if size > amqpFrameMax*4 {
+		return 0, 0, nil, fmt.Errorf("amqp: frame of %d bytes is too large", size)
+	}
+	payload = make([]byte, size+1)
+	if _, err = io.ReadFull(c.r, payload); err != nil {
+		return
+	}
+	if payload[size] != amqpFrameEnd {
+		return 0, 0, nil, errors.New("amqp: malformed frame")
+	}
+	return frameType, channel, payload[:size], nil
+}
+
+// writeMethod sends a method frame
+func (c *amqpConn) writeMethod(channel uint16, method uint32, args []byte) error {
+	w := bufio.NewWriter(c.conn)
+	writeFrame(w, amqpFrameMethod, channel, append(methodID(method), args...))
+	return w.Flush()
+}
+
+// close closes the connection, telling the broker first
+func (c *amqpConn) close() error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	args := binary.BigEndian.AppendUint16(nil, 200)
+	args = append(args, 0)          // reply-text
+	args = append(args, 0, 0, 0, 0) // class-id, method-id
+	if c.writeMethod(0, amqpConnectionClose, args) == nil {
+		c.readMethod()
+	}
+	return c.conn.Close()
+}
+
+// methodID encodes the class and method ID of a method frame
+func methodID(method uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, method)
+}
+
+// writeFrame writes one frame to w
+func writeFrame(w *bufio.Writer, frameType byte, channel uint16, payload []byte) {
+	w.WriteByte(frameType)
+	binary.Write(w, binary.BigEndian, channel)
+	binary.Write(w, binary.BigEndian, uint32(len(payload)))
+	w.Write(payload)
+	w.WriteByte(amqpFrameEnd)
+}
+
+func writeShortString(b *bytes.Buffer, s string) {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	b.WriteByte(byte(len(s)))
+	b.WriteString(s)
+}
+
+func writeLongString(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint32(len(s)))
+	b.WriteString(s)
+}
+
+// writeTable writes a field table of string values
+func writeTable(b *bytes.Buffer, fields map[string]string) {
+	var table bytes.Buffer
+	for name, value := range fields {
+		writeShortString(&table, name)
+		table.WriteByte('S')
+		writeLongString(&table, value)
+	}
+	writeLongString(b, table.String())
+}
+
+func readShortString(r *bytes.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(r, b)
+	return string(b), err
+}
+
+func readLongString(r *bytes.Reader) (string, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return "", err
+	}
+	if int64(n) > int64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return string(b), err
+}
+
+// skipTable skips a field table, which is prefixed with its length
+func skipTable(r *bytes.Reader) {
+	var n uint32
+	if binary.Read(r, binary.BigEndian, &n) == nil {
+		r.Seek(int64(n), io.SeekCurrent)
+	}
+}
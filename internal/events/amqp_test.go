@@ -0,0 +1,302 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"gowebmail/internal/config"
+)
+
+// amqpFrame is a frame read by the fake broker
+type amqpFrame struct {
+	frameType byte
+	channel   uint16
+	payload   []byte
+}
+
+func readAMQPFrame(r io.Reader) (*amqpFrame, error) {
+	var head [7]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, err
+	}
+	f := &amqpFrame{frameType: head[0], channel: binary.BigEndian.Uint16(head[1:])}
+	f.payload = make([]byte, binary.BigEndian.Uint32(head[3:])+1)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return nil, err
+	}
+	if f.payload[len(f.payload)-1] != 0xce {
+		return nil, fmt.Errorf("frame end % x", f.payload[len(f.payload)-1])
+	}
+	f.payload = f.payload[:len(f.payload)-1]
+	return f, nil
+}
+
+// expectAMQPMethod reads a method frame for class.method on channel and
+// returns its arguments
+func expectAMQPMethod(r io.Reader, channel uint16, class, method uint16) ([]byte, error) {
+	f, err := readAMQPFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.frameType != 1 || f.channel != channel || len(f.payload) < 4 {
+		return nil, fmt.Errorf("got frame type %d on channel %d, want method %d.%d", f.frameType, f.channel, class, method)
+	}
+	if got := binary.BigEndian.Uint32(f.payload); got != uint32(class)<<16|uint32(method) {
+		return nil, fmt.Errorf("got method %d.%d, want %d.%d", got>>16, got&0xffff, class, method)
+	}
+	return f.payload[4:], nil
+}
+
+// amqpMethodFrame encodes a method frame as RabbitMQ sends it; the
+// arguments are hex
+func amqpMethodFrame(channel, class, method uint16, args string) []byte {
+	payload := binary.BigEndian.AppendUint16(nil, class)
+	payload = binary.BigEndian.AppendUint16(payload, method)
+	a, err := hex.DecodeString(strings.ReplaceAll(args, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	payload = append(payload, a...)
+
+	frame := []byte{1}
+	frame = binary.BigEndian.AppendUint16(frame, channel)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(payload)))
+	return append(append(frame, payload...), 0xce)
+}
+
+// The server's frames of a RabbitMQ handshake
+var (
+	// connection.start: version 0-9, a table with product "RabbitMQ",
+	// mechanisms "AMQPLAIN PLAIN", locales "en_US"
+	brokerStart = amqpMethodFrame(0, 10, 10, "00 09"+
+		" 00 00 00 15 07 70 72 6f 64 75 63 74 53 00 00 00 08 52 61 62 62 69 74 4d 51"+
+		" 00 00 00 0e 41 4d 51 50 4c 41 49 4e 20 50 4c 41 49 4e"+
+		" 00 00 00 05 65 6e 5f 55 53")
+	// connection.tune: channel-max 2047, frame-max 4096, heartbeat 60
+	brokerTune   = amqpMethodFrame(0, 10, 30, "07 ff 00 00 10 00 00 3c")
+	brokerOpenOk = amqpMethodFrame(0, 10, 41, "00")
+	// channel.open-ok with an empty long string
+	brokerChannelOpenOk = amqpMethodFrame(1, 20, 11, "00 00 00 00")
+	brokerSelectOk      = amqpMethodFrame(1, 85, 11, "")
+	// basic.ack of delivery tag 1
+	brokerAck = amqpMethodFrame(1, 60, 80, "00 00 00 00 00 00 00 01 00")
+	// channel.close: 404 NOT_FOUND, for basic.publish (60.40)
+	brokerNotFound = amqpMethodFrame(1, 20, 40, "01 94 2b"+
+		" 4e 4f 54 5f 46 4f 55 4e 44 20 2d 20 6e 6f 20 65 78 63 68 61 6e 67 65 20 27 6d 61 69 6c 27 20 69 6e 20 76 68 6f 73 74 20 27 2f 27"+
+		" 00 3c 00 28")
+)
+
+// amqpHandshake plays the server side of connecting and returns the
+// SASL response and virtual host
+func amqpHandshake(conn net.Conn, r *bufio.Reader) (string, string, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", "", err
+	}
+	if string(header) != "AMQP\x00\x00\x09\x01" {
+		return "", "", fmt.Errorf("protocol header %q", header)
+	}
+
+	conn.Write(brokerStart)
+	args, err := expectAMQPMethod(r, 0, 10, 11)
+	if err != nil {
+		return "", "", err
+	}
+	ar := bytes.NewReader(args)
+	skipTable(ar)
+	mechanism, _ := readShortString(ar)
+	response, _ := readLongString(ar)
+	if mechanism != "PLAIN" {
+		return "", "", fmt.Errorf("mechanism %q", mechanism)
+	}
+
+	conn.Write(brokerTune)
+	args, err = expectAMQPMethod(r, 0, 10, 31)
+	if err != nil {
+		return "", "", err
+	}
+	// The client takes the smaller frame-max and turns heartbeats off
+	if want := []byte{0x07, 0xff, 0, 0, 0x10, 0, 0, 0}; !bytes.Equal(args, want) {
+		return "", "", fmt.Errorf("tune-ok % x", args)
+	}
+
+	args, err = expectAMQPMethod(r, 0, 10, 40)
+	if err != nil {
+		return "", "", err
+	}
+	vhost, _ := readShortString(bytes.NewReader(args))
+	conn.Write(brokerOpenOk)
+
+	if _, err := expectAMQPMethod(r, 1, 20, 10); err != nil {
+		return "", "", err
+	}
+	conn.Write(brokerChannelOpenOk)
+	if _, err := expectAMQPMethod(r, 1, 85, 10); err != nil {
+		return "", "", err
+	}
+	conn.Write(brokerSelectOk)
+	return response, vhost, nil
+}
+
+// amqpMessage is a message published to the fake broker
+type amqpMessage struct {
+	exchange, routingKey string
+	contentType, typ     string
+	bodyFrames           int
+	body                 []byte
+}
+
+// readAMQPPublish reads a basic.publish with its content
+func readAMQPPublish(r io.Reader) (*amqpMessage, error) {
+	args, err := expectAMQPMethod(r, 1, 60, 40)
+	if err != nil {
+		return nil, err
+	}
+	ar := bytes.NewReader(args[2:])
+	m := &amqpMessage{}
+	m.exchange, _ = readShortString(ar)
+	m.routingKey, _ = readShortString(ar)
+
+	f, err := readAMQPFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.frameType != 2 || binary.BigEndian.Uint16(f.payload) != 60 {
+		return nil, fmt.Errorf("content header % x", f.payload)
+	}
+	size := binary.BigEndian.Uint64(f.payload[4:])
+	flags := binary.BigEndian.Uint16(f.payload[12:])
+	hr := bytes.NewReader(f.payload[14:])
+	if flags&(1<<15) != 0 {
+		m.contentType, _ = readShortString(hr)
+	}
+	if flags&(1<<12) != 0 {
+		hr.ReadByte() // delivery mode
+	}
+	if flags&(1<<7) != 0 {
+		readShortString(hr) // message ID
+	}
+	if flags&(1<<6) != 0 {
+		hr.Seek(8, io.SeekCurrent) // timestamp
+	}
+	if flags&(1<<5) != 0 {
+		m.typ, _ = readShortString(hr)
+	}
+
+	for uint64(len(m.body)) < size {
+		f, err := readAMQPFrame(r)
+		if err != nil {
+			return nil, err
+		}
+		if f.frameType != 3 || len(f.payload) > 4096-8 {
+			return nil, fmt.Errorf("body frame of type %d and %d bytes", f.frameType, len(f.payload))
+		}
+		m.body = append(m.body, f.payload...)
+		m.bodyFrames++
+	}
+	return m, nil
+}
+
+func TestAMQPPublish(t *testing.T) {
+	logins := make(chan string, 1)
+	messages := make(chan *amqpMessage, 2)
+	addr := fakeBroker(t, func(conn net.Conn) error {
+		r := bufio.NewReader(conn)
+		response, vhost, err := amqpHandshake(conn, r)
+		if err != nil {
+			return err
+		}
+		logins <- response + "|" + vhost
+
+		m, err := readAMQPPublish(r)
+		if err != nil {
+			return err
+		}
+		messages <- m
+		conn.Write(brokerAck)
+
+		// The exchange is gone: the broker closes the channel
+		if m, err = readAMQPPublish(r); err != nil {
+			return err
+		}
+		messages <- m
+		conn.Write(brokerNotFound)
+		if _, err := expectAMQPMethod(r, 1, 20, 41); err != nil {
+			return err
+		}
+
+		// Closing the connection waits for close-ok
+		if _, err := expectAMQPMethod(r, 0, 10, 50); err != nil {
+			return err
+		}
+		conn.Write(amqpMethodFrame(0, 10, 51, ""))
+		return nil
+	})
+
+	c, err := dialAMQP(&config.EventSink{URL: "amqp://app:pa%3Ass@" + addr + "/mail", Exchange: "mail", Subject: "gowebmail"}, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login := <-logins; login != "\x00app\x00pa:ss|mail" {
+		t.Errorf("login %q", login)
+	}
+
+	// A body larger than frame-max is split over frames
+	body := bytes.Repeat([]byte("x"), 10000)
+	if err := c.publish("email.new", "7", nil, body); err != nil {
+		t.Fatal(err)
+	}
+	m := <-messages
+	if m.exchange != "mail" || m.routingKey != "gowebmail.email.new" || m.contentType != "application/json" || m.typ != "email.new" {
+		t.Errorf("message %+v", m)
+	}
+	if !bytes.Equal(m.body, body) || m.bodyFrames != 3 {
+		t.Errorf("body of %d bytes in %d frames", len(m.body), m.bodyFrames)
+	}
+
+	err = c.publish("email.new", "8", nil, []byte("{}"))
+	if err == nil || err.Error() != "amqp: 404 NOT_FOUND - no exchange 'mail' in vhost '/'" {
+		t.Errorf("got %v", err)
+	}
+	<-messages
+	c.close()
+}
+
+func TestAMQPRequiresPlain(t *testing.T) {
+	addr := fakeBroker(t, func(conn net.Conn) error {
+		io.ReadFull(conn, make([]byte, 8))
+		// Only EXTERNAL authentication
+		conn.Write(amqpMethodFrame(0, 10, 10, "00 09 00 00 00 00 00 00 00 08 45 58 54 45 52 4e 41 4c 00 00 00 05 65 6e 5f 55 53"))
+		return nil
+	})
+	_, err := dialAMQP(&config.EventSink{URL: "amqp://" + addr}, testTimeout)
+	if err == nil || !strings.Contains(err.Error(), "PLAIN") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestAMQPAccessRefused(t *testing.T) {
+	addr := fakeBroker(t, func(conn net.Conn) error {
+		r := bufio.NewReader(conn)
+		io.ReadFull(r, make([]byte, 8))
+		conn.Write(brokerStart)
+		if _, err := expectAMQPMethod(r, 0, 10, 11); err != nil {
+			return err
+		}
+		// connection.close: 403 ACCESS_REFUSED, for connection.start-ok
+		conn.Write(amqpMethodFrame(0, 10, 50, "01 93 0e 41 43 43 45 53 53 5f 52 45 46 55 53 45 44 00 0a 00 0b"))
+		_, err := expectAMQPMethod(r, 0, 10, 51)
+		return err
+	})
+	_, err := dialAMQP(&config.EventSink{URL: "amqp://" + addr}, testTimeout)
+	if err == nil || err.Error() != "amqp: 403 ACCESS_REFUSED" {
+		t.Errorf("got %v", err)
+	}
+}
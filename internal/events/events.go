@@ -0,0 +1,355 @@
+// Package events publishes email events to message brokers: Kafka topics,
+// NATS subjects, MQTT topics and the exchanges of RabbitMQ or other AMQP
+// 0-9-1 servers
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// DefaultEvents are published to sinks that do not list events
+var DefaultEvents = []string{"email.new", "email.deleted"}
+
+// Detail levels of the published events
+const (
+	// DetailSummary publishes the event data, as sent to WebSocket clients
+	DetailSummary = "summary"
+	// DetailFull adds the stored email, with its bodies and headers
+	DetailFull = "full"
+	// DetailRaw also adds the raw message
+	DetailRaw = "raw"
+)
+
+// Defaults of the sink settings
+const (
+	defaultTopic    = "gowebmail.events"
+	defaultSubject  = "gowebmail"
+	defaultExchange = "amq.topic"
+)
+
+// redialDelay is how long a sink whose broker could not be reached drops
+// events before connecting again
+const redialDelay = 5 * time.Second
+
+// errBrokerDown is returned for events dropped while waiting to redial
+var errBrokerDown = errors.New("broker unreachable, waiting to reconnect")
+
+// Message is the JSON published for an event
+type Message struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+
+	// Email is the stored email, for detail full and raw, if the event is
+	// about one that still exists
+	Email *storage.Email `json:"email,omitempty"`
+	// Raw is the raw message, base64 encoded, for detail raw
+	Raw []byte `json:"raw,omitempty"`
+}
+
+// conn is a connection to a message broker
+type conn interface {
+	// publish sends body for an event, waiting until the broker has it.
+	// key groups the events of one email, where the broker supports it;
+	// mailboxes are the recipients of a new email, for brokers with a
+	// topic per mailbox.
+	publish(event, key string, mailboxes []string, body []byte) error
+	close() error
+}
+
+// Publisher publishes events to the configured sinks. Each sink has a
+// queue and a connection of its own, so a slow or unreachable broker does
+// not hold up the others; events that do not fit its queue are dropped.
+type Publisher struct {
+	storage storage.Storage
+	logger  zerolog.Logger
+	timeout time.Duration
+	sinks   []*sink
+
+	mu      sync.RWMutex
+	stopped bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// sink publishes the events queued for one configured sink
+type sink struct {
+	config  config.EventSink
+	timeout time.Duration
+	logger  zerolog.Logger
+	queue   chan *Message
+
+	conn    conn
+	retryAt time.Time
+}
+
+// NewPublisher creates a publisher and starts publishing to the sinks of
+// cfg, if it is enabled. Emails are loaded from store for the sinks that
+// publish them in full.
+func NewPublisher(cfg *config.EventsConfig, store storage.Storage, logger zerolog.Logger) *Publisher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Publisher{
+		storage: store,
+		logger:  logger.With().Str("component", "events").Logger(),
+		timeout: cfg.Timeout,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if !cfg.Enabled {
+		return p
+	}
+
+	for _, sc := range cfg.Sinks {
+		s := &sink{
+			config:  withDefaults(sc),
+			timeout: cfg.Timeout,
+			logger:  p.logger.With().Str("sink", sc.Name).Str("type", sc.Type).Logger(),
+			queue:   make(chan *Message, cfg.QueueSize),
+		}
+		p.sinks = append(p.sinks, s)
+		p.wg.Add(1)
+		go p.run(s)
+	}
+	return p
+}
+
+// withDefaults fills in the unset settings of a sink
+func withDefaults(sc config.EventSink) config.EventSink {
+	if sc.Topic == "" {
+		sc.Topic = defaultTopic
+	}
+	if sc.Subject == "" {
+		sc.Subject = defaultSubject
+	}
+	if sc.Exchange == "" {
+		sc.Exchange = defaultExchange
+	}
+	if sc.Detail == "" {
+		sc.Detail = DetailSummary
+	}
+	if len(sc.Events) == 0 {
+		sc.Events = DefaultEvents
+	}
+	return sc
+}
+
+// Publish queues an event for every sink subscribed to it. It does not
+// block.
+func (p *Publisher) Publish(event string, data interface{}) {
+	if len(p.sinks) == 0 {
+		return
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		return
+	}
+
+	message := &Message{
+		ID:        newID(),
+		Event:     event,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+	for _, s := range p.sinks {
+		if !subscribed(s.config.Events, event) {
+			continue
+		}
+		select {
+		case s.queue <- message:
+		default:
+			s.logger.Warn().Str("event", event).Msg("Event queue full, event dropped")
+		}
+	}
+}
+
+// subscribed reports whether a sink publishes an event
+func subscribed(events []string, event string) bool {
+	for _, e := range events {
+		if e == event || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// run publishes the events queued for s until the queue is closed
+func (p *Publisher) run(s *sink) {
+	defer p.wg.Done()
+	defer func() {
+		if s.conn != nil {
+			s.conn.close()
+		}
+	}()
+
+	for message := range s.queue {
+		if p.ctx.Err() != nil {
+			s.logger.Warn().Str("event", message.Event).Msg("Shutting down, event dropped")
+			continue
+		}
+
+		m := *message
+		p.addDetail(&m, s.config.Detail)
+		body, err := json.Marshal(&m)
+		if err != nil {
+			s.logger.Error().Err(err).Str("event", m.Event).Msg("Failed to encode event")
+			continue
+		}
+
+		if err := s.send(m.Event, emailKey(m.Data), mailboxes(&m), body); err != nil {
+			s.logger.Warn().Err(err).Str("event", m.Event).Msg("Failed to publish event")
+			continue
+		}
+		s.logger.Debug().Str("event", m.Event).Msg("Event published")
+	}
+}
+
+// addDetail adds the email an event is about, as far as detail asks for
+func (p *Publisher) addDetail(m *Message, detail string) {
+	if detail == DetailSummary || m.Event == "email.deleted" {
+		return
+	}
+	fields, _ := m.Data.(map[string]interface{})
+	id, ok := fields["id"].(int64)
+	if !ok {
+		return
+	}
+
+	email, err := p.storage.GetEmail(id)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			p.logger.Warn().Err(err).Int64("id", id).Msg("Failed to load email for event")
+		}
+		return
+	}
+	m.Email = email
+
+	if detail == DetailRaw {
+		raw, err := p.storage.GetRawEmail(id)
+		if err != nil && err != storage.ErrRawNotAvailable {
+			p.logger.Warn().Err(err).Int64("id", id).Msg("Failed to load raw email for event")
+		}
+		m.Raw = raw
+	}
+}
+
+// emailKey returns the ID of the email an event is about, or "" for events
+// about no single email
+func emailKey(data interface{}) string {
+	fields, _ := data.(map[string]interface{})
+	if id, ok := fields["id"].(int64); ok {
+		return strconv.FormatInt(id, 10)
+	}
+	return ""
+}
+
+// mailboxes returns the recipient addresses of a new email, lower case
+// like the mailboxes of the API, or nil for other events
+func mailboxes(m *Message) []string {
+	if m.Event != "email.new" {
+		return nil
+	}
+	fields, _ := m.Data.(map[string]interface{})
+	to, _ := fields["to"].([]string)
+
+	var addrs []string
+	seen := make(map[string]bool, len(to))
+	for _, addr := range to {
+		addr = strings.ToLower(addr)
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// send publishes body, connecting first if needed. A failed publish is
+// tried once more on a new connection, since the old one may have been
+// closed by the broker.
+func (s *sink) send(event, key string, mailboxes []string, body []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if time.Now().Before(s.retryAt) {
+				return errBrokerDown
+			}
+			if s.conn, err = dial(&s.config, s.timeout); err != nil {
+				s.retryAt = time.Now().Add(redialDelay)
+				return err
+			}
+			s.logger.Info().Msg("Connected to event sink")
+		}
+
+		if err = s.conn.publish(event, key, mailboxes, body); err == nil {
+			return nil
+		}
+		s.conn.close()
+		s.conn = nil
+	}
+	return err
+}
+
+// dial connects to the broker of a sink
+func dial(sc *config.EventSink, timeout time.Duration) (conn, error) {
+	switch sc.Type {
+	case "kafka":
+		return dialKafka(sc, timeout)
+	case "nats":
+		return dialNATS(sc, timeout)
+	case "amqp":
+		return dialAMQP(sc, timeout)
+	case "mqtt":
+		return dialMQTT(sc, timeout)
+	}
+	return nil, errors.New("unknown sink type " + sc.Type)
+}
+
+// Stop publishes the events already queued and closes the connections.
+// Events still queued after the timeout are dropped.
+func (p *Publisher) Stop() {
+	p.mu.Lock()
+	if !p.stopped {
+		p.stopped = true
+		for _, s := range p.sinks {
+			close(s.queue)
+		}
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(p.timeout):
+		p.cancel()
+		<-done
+	}
+}
+
+// newID returns a random event ID
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
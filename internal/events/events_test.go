@@ -0,0 +1,143 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+// testTimeout bounds every exchange with a fake broker
+const testTimeout = 5 * time.Second
+
+// fakeBroker serves the connections made to the address it returns with
+// serve, one at a time in the order they arrive, and fails the test with
+// the errors serve returns
+func fakeBroker(t *testing.T, serve ...func(conn net.Conn) error) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, s := range serve {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.SetDeadline(time.Now().Add(testTimeout))
+			if err := s(conn); err != nil {
+				t.Errorf("broker: %v", err)
+			}
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() {
+		ln.Close()
+		wg.Wait()
+	})
+	return ln.Addr().String()
+}
+
+// expectLine reads a protocol line and checks it is want
+func expectLine(r *bufio.Reader, want string) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line != want {
+		return fmt.Errorf("got %q, want %q", line, want)
+	}
+	return nil
+}
+
+func TestPublisherPublishesSubscribedEvents(t *testing.T) {
+	received := make(chan string, 4)
+	addr := fakeBroker(t, func(conn net.Conn) error {
+		r := bufio.NewReader(conn)
+		conn.Write([]byte(natsInfoLine))
+		if _, err := r.ReadString('\n'); err != nil { // CONNECT
+			return err
+		}
+		if err := expectLine(r, "PING\r\n"); err != nil {
+			return err
+		}
+		conn.Write([]byte("PONG\r\n"))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return nil // the publisher stopped
+			}
+			var subject string
+			var size int
+			if _, err := fmt.Sscanf(line, "PUB %s %d\r\n", &subject, &size); err != nil {
+				return fmt.Errorf("unexpected %q", line)
+			}
+			body := make([]byte, size+2)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return err
+			}
+			received <- subject + " " + string(body[:size])
+			if err := expectLine(r, "PING\r\n"); err != nil {
+				return err
+			}
+			conn.Write([]byte("PONG\r\n"))
+		}
+	})
+
+	p := NewPublisher(&config.EventsConfig{
+		Enabled:   true,
+		Timeout:   testTimeout,
+		QueueSize: 10,
+		Sinks:     []config.EventSink{{Name: "nats", Type: "nats", URL: "nats://" + addr, Events: []string{"email.new"}}},
+	}, nil, zerolog.Nop())
+	p.Publish("email.deleted", map[string]interface{}{"id": int64(7)})
+	p.Publish("email.new", map[string]interface{}{"id": int64(8), "to": []string{"A@example.com"}})
+	p.Stop()
+
+	select {
+	case got := <-received:
+		subject, body, _ := strings.Cut(got, " ")
+		if subject != "gowebmail.email.new" {
+			t.Errorf("subject %q", subject)
+		}
+		var m Message
+		if err := json.Unmarshal([]byte(body), &m); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := m.Data.(map[string]interface{})
+		if m.Event != "email.new" || m.ID == "" || data["id"] != float64(8) || m.Email != nil {
+			t.Errorf("got %s", body)
+		}
+	default:
+		t.Fatal("email.new not published")
+	}
+	select {
+	case got := <-received:
+		t.Errorf("unsubscribed event published: %s", got)
+	default:
+	}
+}
+
+func TestMailboxes(t *testing.T) {
+	m := &Message{Event: "email.new", Data: map[string]interface{}{"to": []string{"A@example.com", "a@example.com", "", "b@example.com"}}}
+	if got := strings.Join(mailboxes(m), ","); got != "a@example.com,b@example.com" {
+		t.Errorf("got %s", got)
+	}
+	m.Event = "email.deleted"
+	if got := mailboxes(m); got != nil {
+		t.Errorf("deleted: got %v", got)
+	}
+}
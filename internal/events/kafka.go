@@ -0,0 +1,434 @@
+package events
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"gowebmail/internal/config"
+)
+
+// Kafka API keys and the versions used
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3 // the first with v2 record batches
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 1
+)
+
+// kafkaAcks waits for the partition leader to write the batch
+const kafkaAcks = 1
+
+// kafkaMaxResponse bounds the responses read from a broker
+const kafkaMaxResponse = 16 << 20
+
+// castagnoli is the CRC-32C table for record batch checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaConn produces to one topic. It looks up the partitions and their
+// leaders when it connects and keeps a connection to each leader it sends
+// to; when a leader moves, publishing fails and the sink reconnects,
+// looking them up again.
+type kafkaConn struct {
+	topic   string
+	tls     bool
+	timeout time.Duration
+
+	partitions []int32          // partition IDs, in order
+	leaders    map[int32]string // partition ID to leader address
+	brokers    map[string]*kafkaBroker
+	next       int // round-robin position for events without a key
+}
+
+// kafkaBroker is a connection to one broker
+type kafkaBroker struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	correlationID int32
+}
+
+// kafkaError is an error code returned by a broker
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	switch e {
+	case 3:
+		return "kafka: unknown topic or partition"
+	case 5:
+		return "kafka: leader not available"
+	case 6:
+		return "kafka: not leader for partition"
+	case 10:
+		return "kafka: message too large"
+	case 29:
+		return "kafka: topic authorization failed"
+	}
+	return "kafka: error code " + strconv.Itoa(int(e))
+}
+
+// dialKafka connects to the first reachable bootstrap broker of a sink
+// and looks up the partitions of its topic
+func dialKafka(sc *config.EventSink, timeout time.Duration) (conn, error) {
+	c := &kafkaConn{
+		topic:   sc.Topic,
+		tls:     sc.TLS,
+		timeout: timeout,
+		leaders: make(map[int32]string),
+		brokers: make(map[string]*kafkaBroker),
+	}
+
+	var err error
+	for _, addr := range sc.Brokers {
+		if err = c.loadMetadata(addr); err == nil {
+			return c, nil
+		}
+	}
+	c.close()
+	return nil, err
+}
+
+// loadMetadata asks the broker at addr for the partitions of the topic
+// and their leaders
+func (c *kafkaConn) loadMetadata(addr string) error {
+	b, err := c.broker(addr)
+	if err != nil {
+		return err
+	}
+
+	var req kafkaWriter
+	req.int32(1)
+	req.string(c.topic)
+	resp, err := b.call(c.timeout, kafkaMetadata, kafkaMetadataVersion, req.bytes())
+	if err != nil {
+		c.drop(addr)
+		return err
+	}
+
+	r := &kafkaReader{b: resp}
+	brokers := make(map[int32]string)
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.int32() // controller ID
+
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		code := r.int16()
+		name := r.string()
+		r.int8() // is internal
+		if code != 0 && name == c.topic {
+			return kafkaError(code)
+		}
+		for p := r.int32(); p > 0 && r.err == nil; p-- {
+			r.int16() // partition error code
+			id := r.int32()
+			leader := r.int32()
+			r.int32s() // replicas
+			r.int32s() // in-sync replicas
+			if name != c.topic {
+				continue
+			}
+			if addr, ok := brokers[leader]; ok {
+				c.partitions = append(c.partitions, id)
+				c.leaders[id] = addr
+			}
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(c.partitions) == 0 {
+		return kafkaError(5)
+	}
+	return nil
+}
+
+// publish produces body to a partition of the topic: the same one for
+// every event of an email, so consumers see them in order
+func (c *kafkaConn) publish(event, key string, mailboxes []string, body []byte) error {
+	var partition int32
+	if key != "" {
+		partition = c.partitions[int(murmur2([]byte(key))&0x7fffffff)%len(c.partitions)]
+	} else {
+		partition = c.partitions[c.next%len(c.partitions)]
+		c.next++
+	}
+
+	b, err := c.broker(c.leaders[partition])
+	if err != nil {
+		return err
+	}
+
+	batch := recordBatch(key, body, map[string]string{"event": event})
+
+	var req kafkaWriter
+	req.int16(-1) // no transactional ID
+	req.int16(kafkaAcks)
+	req.int32(int32(c.timeout / time.Millisecond))
+	req.int32(1) // topics
+	req.string(c.topic)
+	req.int32(1) // partitions
+	req.int32(partition)
+	req.int32(int32(len(batch)))
+	req.raw(batch)
+
+	resp, err := b.call(c.timeout, kafkaProduce, kafkaProduceVersion, req.bytes())
+	if err != nil {
+		return err
+	}
+
+	r := &kafkaReader{b: resp}
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		r.string() // topic
+		for p := r.int32(); p > 0 && r.err == nil; p-- {
+			r.int32() // partition
+			if code := r.int16(); code != 0 {
+				return kafkaError(code)
+			}
+			r.int64() // base offset
+			r.int64() // log append time
+		}
+	}
+	return r.err
+}
+
+// broker returns the connection to the broker at addr, connecting if
+// there is none
+func (c *kafkaConn) broker(addr string) (*kafkaBroker, error) {
+	if b, ok := c.brokers[addr]; ok {
+		return b, nil
+	}
+
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var nc net.Conn
+	var err error
+	if c.tls {
+		host, _, _ := net.SplitHostPort(addr)
+		nc, err = tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	} else {
+		nc, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b := &kafkaBroker{conn: nc, r: bufio.NewReader(nc)}
+	c.brokers[addr] = b
+	return b, nil
+}
+
+// drop closes the connection to the broker at addr
+func (c *kafkaConn) drop(addr string) {
+	if b, ok := c.brokers[addr]; ok {
+		b.conn.Close()
+		delete(c.brokers, addr)
+	}
+}
+
+func (c *kafkaConn) close() error {
+	for addr := range c.brokers {
+		c.drop(addr)
+	}
+	return nil
+}
+
+// call sends a request and returns the body of its response
+func (b *kafkaBroker) call(timeout time.Duration, apiKey, version int16, body []byte) ([]byte, error) {
+	b.conn.SetDeadline(time.Now().Add(timeout))
+	b.correlationID++
+
+	var req kafkaWriter
+	req.int32(0) // size, set below
+	req.int16(apiKey)
+	req.int16(version)
+	req.int32(b.correlationID)
+	req.string("gowebmail")
+	req.raw(body)
+	msg := req.bytes()
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)-4))
+	if _, err := b.conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	var head [8]byte
+	if _, err := io.ReadFull(b.r, head[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(head[:])
+	if size < 4 || size > kafkaMaxResponse {
+		return nil, fmt.Errorf("kafka: response of %d bytes", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(head[4:])); id != b.correlationID {
+		return nil, fmt.Errorf("kafka: response to request %d, expected %d", id, b.correlationID)
+	}
+	resp := make([]byte, size-4)
+	_, err := io.ReadFull(b.r, resp)
+	return resp, err
+}
+
+// recordBatch encodes a v2 record batch holding one record
+func recordBatch(key string, value []byte, headers map[string]string) []byte {
+	var record kafkaWriter
+	record.int8(0)   // attributes
+	record.varint(0) // timestamp delta
+	record.varint(0) // offset delta
+	if key == "" {
+		record.varint(-1)
+	} else {
+		record.varint(int64(len(key)))
+		record.raw([]byte(key))
+	}
+	record.varint(int64(len(value)))
+	record.raw(value)
+	record.varint(int64(len(headers)))
+	for name, v := range headers {
+		record.varint(int64(len(name)))
+		record.raw([]byte(name))
+		record.varint(int64(len(v)))
+		record.raw([]byte(v))
+	}
+
+	// The part of the batch covered by the CRC
+	now := time.Now().UnixMilli()
+	var body kafkaWriter
+	body.int16(0) // attributes: no compression, create time
+	body.int32(0) // last offset delta
+	body.int64(now)
+	body.int64(now)
+	body.int64(-1) // producer ID
+	body.int16(-1) // producer epoch
+	body.int32(-1) // base sequence
+	body.int32(1)  // records
+	body.varint(int64(len(record.bytes())))
+	body.raw(record.bytes())
+
+	var batch kafkaWriter
+	batch.int64(0) // base offset
+	batch.int32(int32(4 + 1 + 4 + len(body.bytes())))
+	batch.int32(-1) // partition leader epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(body.bytes(), castagnoli)))
+	batch.raw(body.bytes())
+	return batch.bytes()
+}
+
+// murmur2 is the hash Kafka's default partitioner uses for keys, so events
+// land on the partition Java clients would pick for the same key
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	h := uint32(seed) ^ uint32(len(data))
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+		data = data[4:]
+	}
+	switch len(data) {
+	case 3:
+		h ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// kafkaWriter encodes the primitive types of the Kafka protocol
+type kafkaWriter struct {
+	b []byte
+}
+
+func (w *kafkaWriter) bytes() []byte   { return w.b }
+func (w *kafkaWriter) raw(b []byte)    { w.b = append(w.b, b...) }
+func (w *kafkaWriter) int8(v int8)     { w.b = append(w.b, byte(v)) }
+func (w *kafkaWriter) int16(v int16)   { w.b = binary.BigEndian.AppendUint16(w.b, uint16(v)) }
+func (w *kafkaWriter) int32(v int32)   { w.b = binary.BigEndian.AppendUint32(w.b, uint32(v)) }
+func (w *kafkaWriter) int64(v int64)   { w.b = binary.BigEndian.AppendUint64(w.b, uint64(v)) }
+func (w *kafkaWriter) varint(v int64)  { w.b = binary.AppendVarint(w.b, v) }
+func (w *kafkaWriter) string(s string) { w.int16(int16(len(s))); w.b = append(w.b, s...) }
+
+// kafkaReader decodes the primitive types of the Kafka protocol, keeping
+// the first error
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.b) {
+		r.err = errors.New("kafka: truncated response")
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *kafkaReader) int8() int8 {
+	if b := r.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// string reads a nullable string; null reads as ""
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
+
+func (r *kafkaReader) int32s() {
+	for n := r.int32(); n > 0 && r.err == nil; n-- {
+		r.int32()
+	}
+}
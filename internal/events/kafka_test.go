@@ -0,0 +1,267 @@
+package events
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"gowebmail/internal/config"
+)
+
+// The murmur2 results of Kafka's own tests (UtilsTest.testMurmur2)
+func TestMurmur2(t *testing.T) {
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := int32(murmur2([]byte(key))); got != want {
+			t.Errorf("%s: got %d, want %d", key, got, want)
+		}
+	}
+}
+
+func TestCastagnoli(t *testing.T) {
+	// The check value of CRC-32C
+	if got := crc32.Checksum([]byte("123456789"), castagnoli); got != 0xe3069283 {
+		t.Errorf("got %08x", got)
+	}
+}
+
+// kafkaRequest is a request read by the fake broker
+type kafkaRequest struct {
+	apiKey, version int16
+	correlationID   int32
+	clientID        string
+	body            []byte
+}
+
+func readKafkaRequest(r io.Reader) (*kafkaRequest, error) {
+	var size int32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	req := &kafkaRequest{
+		apiKey:        int16(binary.BigEndian.Uint16(msg)),
+		version:       int16(binary.BigEndian.Uint16(msg[2:])),
+		correlationID: int32(binary.BigEndian.Uint32(msg[4:])),
+	}
+	n := int(binary.BigEndian.Uint16(msg[8:]))
+	req.clientID = string(msg[10 : 10+n])
+	req.body = msg[10+n:]
+	return req, nil
+}
+
+// writeKafkaResponse frames a response body to a request
+func writeKafkaResponse(w io.Writer, req *kafkaRequest, fields ...interface{}) error {
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, req.correlationID)
+	for _, f := range fields {
+		switch f := f.(type) {
+		case string:
+			binary.Write(&body, binary.BigEndian, int16(len(f)))
+			body.WriteString(f)
+		default:
+			binary.Write(&body, binary.BigEndian, f)
+		}
+	}
+	binary.Write(w, binary.BigEndian, int32(body.Len()))
+	_, err := w.Write(body.Bytes())
+	return err
+}
+
+// metadataResponse is a Metadata v1 response: the broker at addr, with
+// node ID 1, leads the partitions of topic, or the topic has an error
+func metadataResponse(w io.Writer, req *kafkaRequest, addr, topic string, code int16, partitions int32) error {
+	host, port, _ := net.SplitHostPort(addr)
+	p, _ := strconv.Atoi(port)
+	fields := []interface{}{
+		int32(1), int32(1), host, int32(p), int16(-1), // brokers: ID, host, port, null rack
+		int32(1),                                   // controller ID
+		int32(1), code, topic, int8(0), partitions, // topics: error, name, internal, partitions
+	}
+	for id := int32(0); id < partitions; id++ {
+		// error, ID, leader, replicas, in-sync replicas
+		fields = append(fields, int16(0), id, int32(1), int32(1), int32(1), int32(1), int32(1))
+	}
+	return writeKafkaResponse(w, req, fields...)
+}
+
+// kafkaRecord is the one record of a batch decoded by the fake broker
+type kafkaRecord struct {
+	key, value string
+	headers    map[string]string
+}
+
+// decodeRecordBatch decodes a v2 record batch holding one record and
+// checks its framing and CRC
+func decodeRecordBatch(batch []byte) (*kafkaRecord, error) {
+	if len(batch) < 61 {
+		return nil, errors.New("short batch")
+	}
+	if length := int(binary.BigEndian.Uint32(batch[8:])); length != len(batch)-12 {
+		return nil, fmt.Errorf("batch length %d of %d bytes", length, len(batch))
+	}
+	if batch[16] != 2 {
+		return nil, fmt.Errorf("magic %d", batch[16])
+	}
+	if crc := binary.BigEndian.Uint32(batch[17:]); crc != crc32.Checksum(batch[21:], crc32.MakeTable(crc32.Castagnoli)) {
+		return nil, errors.New("CRC mismatch")
+	}
+	if count := binary.BigEndian.Uint32(batch[57:]); count != 1 {
+		return nil, fmt.Errorf("%d records", count)
+	}
+
+	r := bytes.NewReader(batch[61:])
+	varint := func() int64 { v, _ := binary.ReadVarint(r); return v }
+	str := func() string {
+		n := varint()
+		if n < 0 {
+			return ""
+		}
+		b := make([]byte, n)
+		io.ReadFull(r, b)
+		return string(b)
+	}
+	length := varint()
+	if int(length) != r.Len() {
+		return nil, fmt.Errorf("record length %d of %d bytes", length, r.Len())
+	}
+	r.ReadByte() // attributes
+	varint()     // timestamp delta
+	varint()     // offset delta
+	record := &kafkaRecord{key: str(), value: str(), headers: make(map[string]string)}
+	for n := varint(); n > 0; n-- {
+		name := str()
+		record.headers[name] = str()
+	}
+	return record, nil
+}
+
+// produceRequest decodes a Produce v3 request to one partition
+func produceRequest(req *kafkaRequest) (acks int16, topic string, partition int32, batch []byte) {
+	b := req.body
+	b = b[2:] // null transactional ID
+	acks = int16(binary.BigEndian.Uint16(b))
+	b = b[2+4+4:] // acks, timeout, topic count
+	n := int(binary.BigEndian.Uint16(b))
+	topic, b = string(b[2:2+n]), b[2+n+4:]
+	partition = int32(binary.BigEndian.Uint32(b))
+	size := int(binary.BigEndian.Uint32(b[4:]))
+	return acks, topic, partition, b[8 : 8+size]
+}
+
+func TestKafkaPublish(t *testing.T) {
+	const topic = "gowebmail.events"
+	records := make(chan *kafkaRecord, 2)
+	addr := fakeBroker(t, func(conn net.Conn) error {
+		req, err := readKafkaRequest(conn)
+		if err != nil {
+			return err
+		}
+		if req.apiKey != 3 || req.version != 1 || req.clientID != "gowebmail" || req.correlationID != 1 {
+			return fmt.Errorf("metadata request %+v", req)
+		}
+		// One topic, by name
+		want := append([]byte{0, 0, 0, 1, 0, byte(len(topic))}, topic...)
+		if !bytes.Equal(req.body, want) {
+			return fmt.Errorf("metadata request body % x", req.body)
+		}
+		if err := metadataResponse(conn, req, conn.LocalAddr().String(), topic, 0, 3); err != nil {
+			return err
+		}
+
+		// The leader is the same broker, so produce requests reuse the
+		// connection: the first is acknowledged and the second fails
+		// with NOT_LEADER_FOR_PARTITION
+		for i, code := range []int16{0, 6} {
+			req, err := readKafkaRequest(conn)
+			if err != nil {
+				return err
+			}
+			if req.apiKey != 0 || req.version != 3 || req.correlationID != int32(i+2) {
+				return fmt.Errorf("produce request %+v", req)
+			}
+			acks, name, partition, batch := produceRequest(req)
+			record, err := decodeRecordBatch(batch)
+			if err != nil {
+				return err
+			}
+			if acks != 1 || name != topic {
+				return fmt.Errorf("acks %d to %s", acks, name)
+			}
+			if record.key == "42" && partition != int32(murmur2([]byte("42"))&0x7fffffff)%3 {
+				return fmt.Errorf("key 42 produced to partition %d", partition)
+			}
+			records <- record
+			err = writeKafkaResponse(conn, req,
+				int32(1), topic, int32(1), partition, code, int64(100), int64(-1), // responses
+				int32(0)) // throttle time
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	c, err := dialKafka(&config.EventSink{Brokers: []string{addr}, Topic: topic}, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+
+	if err := c.publish("email.new", "42", nil, []byte(`{"id":42}`)); err != nil {
+		t.Fatal(err)
+	}
+	record := <-records
+	if record.key != "42" || record.value != `{"id":42}` || record.headers["event"] != "email.new" {
+		t.Errorf("record %+v", record)
+	}
+
+	err = c.publish("email.purged", "", nil, []byte(`{}`))
+	if err == nil || err.Error() != "kafka: not leader for partition" {
+		t.Errorf("got %v", err)
+	}
+	if record := <-records; record.key != "" || record.value != "{}" {
+		t.Errorf("record %+v", record)
+	}
+}
+
+func TestKafkaTriesBootstrapBrokers(t *testing.T) {
+	// The first broker does not know the topic, the second is not a
+	// Kafka broker at all
+	unknown := fakeBroker(t, func(conn net.Conn) error {
+		req, err := readKafkaRequest(conn)
+		if err != nil {
+			return err
+		}
+		return metadataResponse(conn, req, "127.0.0.1:1", "events", 3, 0)
+	})
+	garbage := fakeBroker(t, func(conn net.Conn) error {
+		readKafkaRequest(conn)
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\n\r\n"))
+		return nil
+	})
+
+	_, err := dialKafka(&config.EventSink{Brokers: []string{unknown}, Topic: "events"}, testTimeout)
+	if err == nil || err.Error() != "kafka: unknown topic or partition" {
+		t.Errorf("unknown topic: got %v", err)
+	}
+	_, err = dialKafka(&config.EventSink{Brokers: []string{garbage}, Topic: "events"}, testTimeout)
+	if err == nil {
+		t.Error("garbage accepted as metadata")
+	}
+}
@@ -0,0 +1,243 @@
+package events
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gowebmail/internal/config"
+)
+
+// MQTT 3.1.1 control packet types, shifted into the first header byte
+const (
+	mqttConnect    = 1 << 4
+	mqttConnAck    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPubAck     = 4 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// MQTT CONNECT flags
+const (
+	mqttFlagUsername     = 0x80
+	mqttFlagPassword     = 0x40
+	mqttFlagCleanSession = 0x02
+)
+
+// mqttQoS1 marks a PUBLISH at QoS 1, which the broker acknowledges
+const mqttQoS1 = 1 << 1
+
+// mqttConnectErrors are the reasons of the CONNACK return codes
+var mqttConnectErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// mqttTopicEscaper replaces the characters an address cannot have in a
+// topic level: the level separator and the wildcards
+var mqttTopicEscaper = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// mqttConn publishes to an MQTT 3.1.1 broker at QoS 1, so every publish
+// waits for the broker's PUBACK. A new email is published once to the
+// topic of each of its mailboxes, <subject>/mailbox/<address>/email.new;
+// other events go to <subject>/<event>.
+type mqttConn struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	subject  string
+	timeout  time.Duration
+	packetID uint16
+}
+
+// dialMQTT connects to the MQTT broker of a sink, over TLS for an
+// mqtts:// URL. Credentials in the URL are sent as user name and
+// password. The session is clean and has a random client identifier, so
+// that several instances can publish to one broker.
+func dialMQTT(sc *config.EventSink, timeout time.Duration) (conn, error) {
+	u, err := url.Parse(sc.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if u.Scheme == "mqtts" {
+			port = "8883"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var nc net.Conn
+	if u.Scheme == "mqtts" {
+		nc, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		nc, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &mqttConn{conn: nc, r: bufio.NewReader(nc), subject: sc.Subject, timeout: timeout}
+	if err := c.connect(u.User); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// connect sends CONNECT and waits for the broker to accept it
+func (c *mqttConn) connect(user *url.Userinfo) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	id := make([]byte, 6)
+	rand.Read(id)
+
+	flags := byte(mqttFlagCleanSession)
+	var payload []byte
+	payload = appendMQTTString(payload, "gowebmail-"+hex.EncodeToString(id))
+	if user != nil {
+		flags |= mqttFlagUsername
+		payload = appendMQTTString(payload, user.Username())
+		if password, ok := user.Password(); ok {
+			flags |= mqttFlagPassword
+			payload = appendMQTTString(payload, password)
+		}
+	}
+
+	// Protocol name and level 4 (3.1.1), then a keep alive of 0: the
+	// connection is used at least every event, and a dead one is replaced
+	// on the next publish
+	header := appendMQTTString(nil, "MQTT")
+	header = append(header, 4, flags, 0, 0)
+	if err := c.writePacket(mqttConnect, append(header, payload...)); err != nil {
+		return err
+	}
+
+	kind, body, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	if kind&0xF0 != mqttConnAck || len(body) < 2 {
+		return fmt.Errorf("mqtt: expected CONNACK, got packet type %d", kind>>4)
+	}
+	if code := body[1]; code != 0 {
+		if reason, ok := mqttConnectErrors[code]; ok {
+			return errors.New("mqtt: connection refused: " + reason)
+		}
+		return fmt.Errorf("mqtt: connection refused with code %d", code)
+	}
+	return nil
+}
+
+// publish sends body to the topics of the event
+func (c *mqttConn) publish(event, key string, mailboxes []string, body []byte) error {
+	if len(mailboxes) == 0 {
+		return c.publishTopic(c.subject+"/"+event, body)
+	}
+	for _, mailbox := range mailboxes {
+		topic := c.subject + "/mailbox/" + mqttTopicEscaper.Replace(mailbox) + "/" + event
+		if err := c.publishTopic(topic, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishTopic sends body to one topic and waits for its PUBACK
+func (c *mqttConn) publishTopic(topic string, body []byte) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	c.packetID++
+	if c.packetID == 0 {
+		c.packetID = 1 // 0 is not a valid packet identifier
+	}
+	packet := appendMQTTString(nil, topic)
+	packet = binary.BigEndian.AppendUint16(packet, c.packetID)
+	if err := c.writePacket(mqttPublish|mqttQoS1, append(packet, body...)); err != nil {
+		return err
+	}
+
+	for {
+		kind, body, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		// Nothing is subscribed to, so only acknowledgements are expected
+		if kind&0xF0 == mqttPubAck && len(body) >= 2 && binary.BigEndian.Uint16(body) == c.packetID {
+			return nil
+		}
+	}
+}
+
+// writePacket writes a control packet with its remaining length
+func (c *mqttConn) writePacket(kind byte, body []byte) error {
+	packet := []byte{kind}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := c.conn.Write(append(packet, body...))
+	return err
+}
+
+// readPacket reads a control packet, returning its first header byte and
+// the rest after the remaining length
+func (c *mqttConn) readPacket() (byte, []byte, error) {
+	kind, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7F) * multiplier
+		if b&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("mqtt: malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		return 0, nil, err
+	}
+	return kind, body, nil
+}
+
+func (c *mqttConn) close() error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	c.writePacket(mqttDisconnect, nil)
+	return c.conn.Close()
+}
+
+// appendMQTTString appends s as a length-prefixed UTF-8 string
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
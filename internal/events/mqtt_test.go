@@ -0,0 +1,209 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gowebmail/internal/config"
+)
+
+// readMQTTPacket reads a control packet as the fake broker
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := binary.ReadUvarint(r) // the remaining length is a little-endian base-128 varint
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return kind, body, err
+}
+
+// mqttString splits a length-prefixed string off b
+func mqttString(b []byte) (string, []byte) {
+	if len(b) < 2 || len(b) < 2+int(binary.BigEndian.Uint16(b)) {
+		return "", nil
+	}
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	return string(b[2:n]), b[n:]
+}
+
+// mqttConnectPacket is a decoded CONNECT
+type mqttConnectPacket struct {
+	protocol       string
+	level, flags   byte
+	keepAlive      uint16
+	clientID       string
+	user, password string
+}
+
+func readMQTTConnect(r *bufio.Reader) (*mqttConnectPacket, error) {
+	kind, body, err := readMQTTPacket(r)
+	if err != nil {
+		return nil, err
+	}
+	if kind != 0x10 {
+		return nil, fmt.Errorf("got packet %02x, want CONNECT", kind)
+	}
+	p := &mqttConnectPacket{}
+	p.protocol, body = mqttString(body)
+	if len(body) < 4 {
+		return nil, fmt.Errorf("short CONNECT")
+	}
+	p.level, p.flags, p.keepAlive = body[0], body[1], binary.BigEndian.Uint16(body[2:])
+	p.clientID, body = mqttString(body[4:])
+	if p.flags&0x80 != 0 {
+		p.user, body = mqttString(body)
+	}
+	if p.flags&0x40 != 0 {
+		p.password, body = mqttString(body)
+	}
+	if len(body) != 0 {
+		return nil, fmt.Errorf("%d bytes after the CONNECT payload", len(body))
+	}
+	return p, nil
+}
+
+func TestMQTTPublish(t *testing.T) {
+	connects := make(chan *mqttConnectPacket, 1)
+	published := make(chan string, 4)
+	addr := fakeBroker(t, func(conn net.Conn) error {
+		r := bufio.NewReader(conn)
+		connect, err := readMQTTConnect(r)
+		if err != nil {
+			return err
+		}
+		connects <- connect
+		conn.Write([]byte{0x20, 0x02, 0x00, 0x00}) // CONNACK, accepted
+
+		for i := 0; i < 3; i++ {
+			kind, body, err := readMQTTPacket(r)
+			if err != nil {
+				return err
+			}
+			// QoS 1, neither DUP nor RETAIN
+			if kind != 0x32 {
+				return fmt.Errorf("got packet %02x, want PUBLISH at QoS 1", kind)
+			}
+			topic, rest := mqttString(body)
+			if len(rest) < 2 {
+				return fmt.Errorf("PUBLISH without packet identifier")
+			}
+			id := binary.BigEndian.Uint16(rest)
+			published <- fmt.Sprintf("%d %s %d", id, topic, len(rest)-2)
+
+			// An acknowledgement of another packet comes first, as from a
+			// broker still acknowledging an earlier session
+			conn.Write([]byte{0x40, 0x02, 0x00, 0x63})
+			conn.Write([]byte{0x40, 0x02, byte(id >> 8), byte(id)})
+		}
+
+		kind, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+		if kind != 0xe0 || len(body) != 0 {
+			return fmt.Errorf("got packet %02x % x, want DISCONNECT", kind, body)
+		}
+		return nil
+	})
+
+	c, err := dialMQTT(&config.EventSink{URL: "mqtt://app:s3cr%2Ft@" + addr, Subject: "gowebmail"}, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := <-connects
+	if connect.protocol != "MQTT" || connect.level != 4 || connect.flags != 0xc2 || connect.keepAlive != 0 {
+		t.Errorf("CONNECT %+v", connect)
+	}
+	if !regexp.MustCompile(`^gowebmail-[0-9a-f]{12}$`).MatchString(connect.clientID) {
+		t.Errorf("client identifier %q", connect.clientID)
+	}
+	if connect.user != "app" || connect.password != "s3cr/t" {
+		t.Errorf("credentials %q %q", connect.user, connect.password)
+	}
+
+	// A new email goes to the topic of each mailbox; a body over 127
+	// bytes takes a remaining length of two bytes
+	body := bytes.Repeat([]byte("x"), 300)
+	if err := c.publish("email.new", "1", []string{"a/b+c#d@example.com", "e@example.com"}, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.publish("email.deleted", "1", nil, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.close(); err != nil {
+		t.Error(err)
+	}
+
+	for _, want := range []string{
+		"1 gowebmail/mailbox/a_b_c_d@example.com/email.new 300",
+		"2 gowebmail/mailbox/e@example.com/email.new 300",
+		"3 gowebmail/email.deleted 2",
+	} {
+		if got := <-published; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+}
+
+func TestMQTTAnonymous(t *testing.T) {
+	connects := make(chan *mqttConnectPacket, 1)
+	addr := fakeBroker(t, func(conn net.Conn) error {
+		connect, err := readMQTTConnect(bufio.NewReader(conn))
+		if err != nil {
+			return err
+		}
+		connects <- connect
+		conn.Write([]byte{0x20, 0x02, 0x00, 0x00})
+		return nil
+	})
+	c, err := dialMQTT(&config.EventSink{URL: "mqtt://" + addr}, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.close()
+	if connect := <-connects; connect.flags != 0x02 {
+		t.Errorf("flags %02x, want a clean session only", connect.flags)
+	}
+}
+
+func TestMQTTConnectRefused(t *testing.T) {
+	for _, tc := range []struct {
+		connack string
+		want    string
+	}{
+		{"20 02 00 04", "mqtt: connection refused: bad user name or password"},
+		{"20 02 00 05", "mqtt: connection refused: not authorized"},
+		{"20 02 00 80", "mqtt: connection refused with code 128"},
+		// An MQTT 5 broker answers a CONNECT of level 4 with its own
+		// reason code and properties
+		{"20 03 00 84 00", "mqtt: connection refused with code 132"},
+		{"d0 00", "mqtt: expected CONNACK, got packet type 13"},
+		{"20 ff ff ff ff 7f", "mqtt: malformed remaining length"},
+	} {
+		connack, _ := hex.DecodeString(strings.ReplaceAll(tc.connack, " ", ""))
+		addr := fakeBroker(t, func(conn net.Conn) error {
+			if _, err := readMQTTConnect(bufio.NewReader(conn)); err != nil {
+				return err
+			}
+			conn.Write(connack)
+			return nil
+		})
+		_, err := dialMQTT(&config.EventSink{URL: "mqtt://u:p@" + addr}, testTimeout)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("%s: got %v, want %s", tc.connack, err, tc.want)
+		}
+	}
+}
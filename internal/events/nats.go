@@ -0,0 +1,152 @@
+package events
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"gowebmail/internal/config"
+)
+
+// natsConn publishes with the core NATS protocol. NATS does not
+// acknowledge messages, so every PUB is followed by a PING: the PONG
+// shows the server processed it, and an -ERR before it that it did not.
+type natsConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	subject string
+	timeout time.Duration
+}
+
+// natsInfo holds the fields of the server's INFO message that matter here
+type natsInfo struct {
+	TLSRequired  bool `json:"tls_required"`
+	AuthRequired bool `json:"auth_required"`
+}
+
+// dialNATS connects to the NATS server of a sink. A tls:// URL, or a
+// server that requires it, upgrades the connection to TLS. Credentials
+// in the URL are sent as user and password, or a lone user name as a
+// token.
+func dialNATS(sc *config.EventSink, timeout time.Duration) (conn, error) {
+	u, err := url.Parse(sc.URL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	raw, err := net.DialTimeout("tcp", host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &natsConn{conn: raw, r: bufio.NewReader(raw), subject: sc.Subject, timeout: timeout}
+	raw.SetDeadline(time.Now().Add(timeout))
+
+	line, err := c.readLine()
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	var info natsInfo
+	if op, args, _ := strings.Cut(line, " "); op != "INFO" || json.Unmarshal([]byte(args), &info) != nil {
+		raw.Close()
+		return nil, fmt.Errorf("unexpected greeting from %s: %q", host, line)
+	}
+
+	if u.Scheme == "tls" || info.TLSRequired {
+		tlsConn := tls.Client(raw, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.Handshake(); err != nil {
+			raw.Close()
+			return nil, fmt.Errorf("tls handshake with %s: %w", host, err)
+		}
+		c.conn = tlsConn
+		c.r = bufio.NewReader(tlsConn)
+	}
+
+	connect := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "gowebmail",
+		"lang":     "go",
+		"version":  "1",
+		"protocol": 1,
+	}
+	if u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			connect["user"] = u.User.Username()
+			connect["pass"] = password
+		} else {
+			connect["auth_token"] = u.User.Username()
+		}
+	}
+	options, _ := json.Marshal(connect)
+	if _, err := fmt.Fprintf(c.conn, "CONNECT %s\r\nPING\r\n", options); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	if err := c.waitPong(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// publish sends body on the subject of the event
+func (c *natsConn) publish(event, key string, mailboxes []string, body []byte) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	subject := c.subject + "." + event
+	var buf []byte
+	buf = fmt.Appendf(buf, "PUB %s %d\r\n", subject, len(body))
+	buf = append(buf, body...)
+	buf = append(buf, "\r\nPING\r\n"...)
+	if _, err := c.conn.Write(buf); err != nil {
+		return err
+	}
+	return c.waitPong()
+}
+
+// waitPong reads until the server's PONG, answering its PINGs and
+// returning its errors
+func (c *natsConn) waitPong() error {
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(op) {
+		case "PONG":
+			return nil
+		case "PING":
+			if _, err := c.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case "-ERR":
+			return errors.New("nats: " + strings.Trim(args, "'"))
+		}
+		// +OK and INFO updates need no answer
+	}
+}
+
+// readLine reads one protocol line, without the CRLF
+func (c *natsConn) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (c *natsConn) close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,127 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"gowebmail/internal/config"
+)
+
+// natsInfoLine is the greeting of a NATS 2.10 server, as sent on connect
+const natsInfoLine = `INFO {"server_id":"NCXB3ZJ6ZV4KQ","server_name":"test","version":"2.10.7","proto":1,"go":"go1.21.5","host":"0.0.0.0","port":4222,"headers":true,"auth_required":true,"max_payload":1048576,"client_id":5,"client_ip":"127.0.0.1"}` + "\r\n"
+
+// natsHandshake plays the server side of connecting and returns the
+// options of the client's CONNECT
+func natsHandshake(conn net.Conn, r *bufio.Reader) (map[string]interface{}, error) {
+	conn.Write([]byte(natsInfoLine))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	options, ok := strings.CutPrefix(line, "CONNECT ")
+	if !ok {
+		return nil, fmt.Errorf("got %q, want CONNECT", line)
+	}
+	var connect map[string]interface{}
+	if err := json.Unmarshal([]byte(options), &connect); err != nil {
+		return nil, err
+	}
+	if err := expectLine(r, "PING\r\n"); err != nil {
+		return nil, err
+	}
+	conn.Write([]byte("PONG\r\n"))
+	return connect, nil
+}
+
+func TestNATSPublish(t *testing.T) {
+	body := `{"event":"email.new"}`
+	connects := make(chan map[string]interface{}, 1)
+	addr := fakeBroker(t, func(conn net.Conn) error {
+		r := bufio.NewReader(conn)
+		connect, err := natsHandshake(conn, r)
+		if err != nil {
+			return err
+		}
+		connects <- connect
+
+		// The first publish is acknowledged after a PING of the server
+		// is answered; the second is refused
+		want := fmt.Sprintf("PUB mail.email.new %d\r\n%s\r\nPING\r\n", len(body), body)
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(r, got); err != nil {
+			return err
+		}
+		if string(got) != want {
+			return fmt.Errorf("got %q, want %q", got, want)
+		}
+		conn.Write([]byte("+OK\r\nPING\r\n"))
+		if err := expectLine(r, "PONG\r\n"); err != nil {
+			return err
+		}
+		conn.Write([]byte("PONG\r\n"))
+
+		if _, err := io.ReadFull(r, got); err != nil {
+			return err
+		}
+		conn.Write([]byte("-ERR 'Permissions Violation for Publish to \"mail.email.new\"'\r\n"))
+		return nil
+	})
+
+	c, err := dialNATS(&config.EventSink{URL: "nats://user:secret@" + addr, Subject: "mail"}, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.close()
+	if connect := <-connects; connect["user"] != "user" || connect["pass"] != "secret" || connect["verbose"] != false {
+		t.Errorf("CONNECT %v", connect)
+	}
+
+	if err := c.publish("email.new", "1", nil, []byte(body)); err != nil {
+		t.Fatal(err)
+	}
+	err = c.publish("email.new", "1", nil, []byte(body))
+	if err == nil || err.Error() != `nats: Permissions Violation for Publish to "mail.email.new"` {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestNATSTokenAndAuthorizationError(t *testing.T) {
+	connects := make(chan map[string]interface{}, 1)
+	addr := fakeBroker(t, func(conn net.Conn) error {
+		r := bufio.NewReader(conn)
+		conn.Write([]byte(natsInfoLine))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		var connect map[string]interface{}
+		json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &connect)
+		connects <- connect
+		conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+		return nil
+	})
+
+	_, err := dialNATS(&config.EventSink{URL: "nats://s3cr3t@" + addr, Subject: "mail"}, testTimeout)
+	if err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Errorf("got %v", err)
+	}
+	if connect := <-connects; connect["auth_token"] != "s3cr3t" || connect["user"] != nil {
+		t.Errorf("CONNECT %v", connect)
+	}
+}
+
+func TestNATSRejectsOtherServers(t *testing.T) {
+	addr := fakeBroker(t, func(conn net.Conn) error {
+		conn.Write([]byte("220 smtp.example.com ESMTP\r\n"))
+		return nil
+	})
+	_, err := dialNATS(&config.EventSink{URL: "nats://" + addr}, testTimeout)
+	if err == nil || !strings.Contains(err.Error(), "unexpected greeting") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+// Package fixtures stores a directory of .eml files at startup, so that
+// ephemeral instances start with a known corpus
+package fixtures
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/ingest"
+	"gowebmail/internal/storage"
+)
+
+// Result counts the fixtures of a Load
+type Result struct {
+	Loaded  int // stored by this Load
+	Skipped int // already stored
+}
+
+// Load stores every .eml file under dir, in path order, through the
+// pipeline. Files whose Message-ID is already stored are skipped, so
+// loading the same directory again changes nothing. Files without a
+// Message-ID are given one derived from their content.
+func Load(dir string, store storage.Storage, pipeline *ingest.Pipeline, logger zerolog.Logger) (*Result, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	var paths []string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.EqualFold(filepath.Ext(path), ".eml") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	result := &Result{}
+	for _, path := range paths {
+		loaded, err := load(path, store, pipeline)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", path, err)
+		}
+		if loaded {
+			result.Loaded++
+		} else {
+			result.Skipped++
+		}
+	}
+
+	logger.Info().
+		Str("dir", dir).
+		Int("loaded", result.Loaded).
+		Int("skipped", result.Skipped).
+		Msg("Fixtures loaded")
+	return result, nil
+}
+
+// load stores the fixture at path, unless it is already stored
+func load(path string, store storage.Storage, pipeline *ingest.Pipeline) (bool, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return false, fmt.Errorf("%w: %w", ingest.ErrInvalidMessage, err)
+	}
+
+	messageID := strings.TrimSpace(msg.Header.Get("Message-Id"))
+	if messageID == "" {
+		sum := sha256.Sum256(raw)
+		messageID = fmt.Sprintf("<fixture.%x@gowebmail.local>", sum[:16])
+		raw = append([]byte("Message-ID: "+messageID+"\r\n"), raw...)
+	}
+
+	_, err = store.GetEmailByMessageID(messageID)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, storage.ErrNotFound) {
+		return false, err
+	}
+
+	if _, err := pipeline.Deliver(bytes.NewReader(raw), &ingest.Envelope{Source: "fixture"}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,193 @@
+package graphql
+
+import (
+	"fmt"
+)
+
+// inputType resolves a variable type against the schema; only scalars and
+// enums (and lists of them) are accepted as inputs
+func (s *Schema) inputType(ref *TypeRef) (Type, error) {
+	var t Type
+	if ref.Elem != nil {
+		elem, err := s.inputType(ref.Elem)
+		if err != nil {
+			return nil, err
+		}
+		t = &List{OfType: elem}
+	} else {
+		switch named := s.types()[ref.Name].(type) {
+		case *Scalar, *Enum:
+			t = named
+		case nil:
+			return nil, fmt.Errorf("unknown type %q", ref.Name)
+		default:
+			return nil, fmt.Errorf("type %q cannot be used as an input", ref.Name)
+		}
+	}
+	if ref.NonNull {
+		t = &NonNull{OfType: t}
+	}
+	return t, nil
+}
+
+// coerceVariables converts the JSON variables of a request to Go values
+func (s *Schema) coerceVariables(op *Operation, raw map[string]interface{}) (map[string]interface{}, error) {
+	vars := make(map[string]interface{})
+	for _, def := range op.Variables {
+		t, err := s.inputType(def.Type)
+		if err != nil {
+			return nil, err
+		}
+
+		value, present := raw[def.Name]
+		if !present {
+			if def.Default != nil {
+				coerced, err := coerceLiteral(t, def.Default, nil)
+				if err != nil {
+					return nil, fmt.Errorf("variable $%s: %v", def.Name, err)
+				}
+				vars[def.Name] = coerced
+			} else if _, nonNull := t.(*NonNull); nonNull {
+				return nil, fmt.Errorf("variable $%s of type %q is required", def.Name, def.Type)
+			}
+			continue
+		}
+
+		coerced, err := coerceJSON(t, value)
+		if err != nil {
+			return nil, fmt.Errorf("variable $%s: %v", def.Name, err)
+		}
+		vars[def.Name] = coerced
+	}
+	return vars, nil
+}
+
+// coerceJSON converts a decoded JSON value to an input type
+func coerceJSON(t Type, value interface{}) (interface{}, error) {
+	if nonNull, ok := t.(*NonNull); ok {
+		if value == nil {
+			return nil, fmt.Errorf("expected non-null %s", nonNull.OfType)
+		}
+		return coerceJSON(nonNull.OfType, value)
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	switch t := t.(type) {
+	case *List:
+		items, ok := value.([]interface{})
+		if !ok {
+			items = []interface{}{value}
+		}
+		result := make([]interface{}, len(items))
+		for i, item := range items {
+			coerced, err := coerceJSON(t.OfType, item)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = coerced
+		}
+		return result, nil
+	case *Scalar:
+		return t.ParseValue(value)
+	case *Enum:
+		name, ok := value.(string)
+		if !ok || !t.has(name) {
+			return nil, fmt.Errorf("%s cannot represent %v", t.Name, value)
+		}
+		return name, nil
+	}
+	return nil, fmt.Errorf("type %s cannot be used as an input", t)
+}
+
+// coerceLiteral converts a document value to an input type, substituting
+// variables from vars
+func coerceLiteral(t Type, value Value, vars map[string]interface{}) (interface{}, error) {
+	if variable, ok := value.(Variable); ok {
+		coerced := vars[string(variable)]
+		if _, nonNull := t.(*NonNull); nonNull && coerced == nil {
+			return nil, fmt.Errorf("expected non-null %s for $%s", t, variable)
+		}
+		return coerced, nil
+	}
+
+	if nonNull, ok := t.(*NonNull); ok {
+		if _, null := value.(NullValue); null {
+			return nil, fmt.Errorf("expected non-null %s", nonNull.OfType)
+		}
+		return coerceLiteral(nonNull.OfType, value, vars)
+	}
+	if _, null := value.(NullValue); null {
+		return nil, nil
+	}
+
+	switch t := t.(type) {
+	case *List:
+		items, ok := value.(ListValue)
+		if !ok {
+			items = ListValue{value}
+		}
+		result := make([]interface{}, len(items))
+		for i, item := range items {
+			coerced, err := coerceLiteral(t.OfType, item, vars)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = coerced
+		}
+		return result, nil
+	case *Scalar:
+		return t.ParseLiteral(value)
+	case *Enum:
+		name, ok := value.(EnumValue)
+		if !ok || !t.has(string(name)) {
+			return nil, fmt.Errorf("%s cannot represent %s", t.Name, printValue(value))
+		}
+		return string(name), nil
+	}
+	return nil, fmt.Errorf("type %s cannot be used as an input", t)
+}
+
+// coerceArguments builds the argument values of a field
+func coerceArguments(def *FieldDefinition, args []*Argument, vars map[string]interface{}) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for _, argDef := range def.Args {
+		var arg *Argument
+		for _, a := range args {
+			if a.Name == argDef.Name {
+				arg = a
+			}
+		}
+
+		present := arg != nil
+		if variable, ok := arg.valueVariable(); ok {
+			_, present = vars[string(variable)]
+		}
+
+		if !present {
+			if argDef.DefaultValue != nil {
+				values[argDef.Name] = argDef.DefaultValue
+			} else if _, nonNull := argDef.Type.(*NonNull); nonNull {
+				return nil, fmt.Errorf("argument %q of type %q is required", argDef.Name, argDef.Type)
+			}
+			continue
+		}
+
+		value, err := coerceLiteral(argDef.Type, arg.Value, vars)
+		if err != nil {
+			return nil, fmt.Errorf("argument %q: %v", argDef.Name, err)
+		}
+		values[argDef.Name] = value
+	}
+	return values, nil
+}
+
+// valueVariable returns the variable an argument is set to, if any
+func (a *Argument) valueVariable() (Variable, bool) {
+	if a == nil {
+		return "", false
+	}
+	variable, ok := a.Value.(Variable)
+	return variable, ok
+}
@@ -0,0 +1,523 @@
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Request is a GraphQL request as sent over HTTP or WebSocket
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// OperationType returns the type of the operation the request would run,
+// or an empty string if the document is invalid
+func (r *Request) OperationType() string {
+	doc, err := Parse(r.Query)
+	if err != nil {
+		return ""
+	}
+	op, err := selectOperation(doc, r.OperationName)
+	if err != nil {
+		return ""
+	}
+	return op.Type
+}
+
+// Error is a GraphQL error in a result
+type Error struct {
+	Message   string        `json:"message"`
+	Locations []Location    `json:"locations,omitempty"`
+	Path      []interface{} `json:"path,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Result is the response to a request. Data is omitted when the request
+// failed before execution started.
+type Result struct {
+	Data   interface{}
+	Errors []*Error
+
+	executed bool
+}
+
+// MarshalJSON implements json.Marshaler
+func (r *Result) MarshalJSON() ([]byte, error) {
+	var out struct {
+		Data   json.RawMessage `json:"data,omitempty"`
+		Errors []*Error        `json:"errors,omitempty"`
+	}
+	if r.executed {
+		data, err := json.Marshal(r.Data)
+		if err != nil {
+			return nil, err
+		}
+		out.Data = data
+	}
+	out.Errors = r.Errors
+	return json.Marshal(out)
+}
+
+// errorResult returns a result for a request that could not be executed
+func errorResult(err error) *Result {
+	if syntaxErr, ok := err.(*SyntaxError); ok {
+		return &Result{Errors: []*Error{{
+			Message:   syntaxErr.Error(),
+			Locations: []Location{syntaxErr.Location},
+		}}}
+	}
+	if gqlErr, ok := err.(*Error); ok {
+		return &Result{Errors: []*Error{gqlErr}}
+	}
+	return &Result{Errors: []*Error{{Message: err.Error()}}}
+}
+
+// prepared is a validated operation ready for execution
+type prepared struct {
+	doc  *Document
+	op   *Operation
+	root *Object
+	vars map[string]interface{}
+}
+
+// prepare parses and validates a request and coerces its variables
+func (s *Schema) prepare(req *Request) (*prepared, error) {
+	doc, err := Parse(req.Query)
+	if err != nil {
+		return nil, err
+	}
+
+	op, err := selectOperation(doc, req.OperationName)
+	if err != nil {
+		return nil, err
+	}
+
+	var root *Object
+	switch op.Type {
+	case "query":
+		root = s.Query
+	case "mutation":
+		root = s.Mutation
+	case "subscription":
+		root = s.Subscription
+	}
+	if root == nil {
+		return nil, fmt.Errorf("schema does not support %ss", op.Type)
+	}
+
+	if err := s.validate(doc, op, root); err != nil {
+		return nil, err
+	}
+
+	vars, err := s.coerceVariables(op, req.Variables)
+	if err != nil {
+		return nil, err
+	}
+
+	return &prepared{doc: doc, op: op, root: root, vars: vars}, nil
+}
+
+func selectOperation(doc *Document, name string) (*Operation, error) {
+	if name == "" {
+		if len(doc.Operations) > 1 {
+			return nil, fmt.Errorf("operationName is required for documents with several operations")
+		}
+		return doc.Operations[0], nil
+	}
+	for _, op := range doc.Operations {
+		if op.Name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+// Execute runs a query or mutation
+func (s *Schema) Execute(ctx context.Context, req *Request) *Result {
+	p, err := s.prepare(req)
+	if err != nil {
+		return errorResult(err)
+	}
+	if p.op.Type == "subscription" {
+		return errorResult(fmt.Errorf("subscriptions must be executed with Subscribe"))
+	}
+
+	e := &executor{schema: s, ctx: ctx, doc: p.doc, vars: p.vars}
+	return e.run(p.root, nil, p.op.SelectionSet)
+}
+
+// Subscribe starts a subscription. It returns a stream of results, one
+// per event, which is closed when the context is done or the event source
+// ends. If the request is invalid a result describing the error is
+// returned instead.
+func (s *Schema) Subscribe(ctx context.Context, req *Request) (<-chan *Result, *Result) {
+	p, err := s.prepare(req)
+	if err != nil {
+		return nil, errorResult(err)
+	}
+	if p.op.Type != "subscription" {
+		return nil, errorResult(fmt.Errorf("operation is not a subscription"))
+	}
+
+	e := &executor{schema: s, ctx: ctx, doc: p.doc, vars: p.vars}
+	keys, groups := e.collectFields(p.root, p.op.SelectionSet, nil)
+	if len(keys) != 1 {
+		return nil, errorResult(fmt.Errorf("subscription must select exactly one top level field"))
+	}
+	field := groups[keys[0]][0]
+	def := p.root.Field(field.Name)
+
+	args, err := coerceArguments(def, field.Arguments, p.vars)
+	if err != nil {
+		return nil, errorResult(&Error{Message: err.Error(), Locations: []Location{field.Location}})
+	}
+	events, err := def.Subscribe(ResolveParams{Context: ctx, Args: args})
+	if err != nil {
+		return nil, errorResult(&Error{Message: err.Error(), Locations: []Location{field.Location}})
+	}
+
+	results := make(chan *Result)
+	go func() {
+		defer close(results)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				e := &executor{schema: s, ctx: ctx, doc: p.doc, vars: p.vars}
+				select {
+				case results <- e.run(p.root, event, p.op.SelectionSet):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return results, nil
+}
+
+// executor holds the state of one execution
+type executor struct {
+	schema *Schema
+	ctx    context.Context
+	doc    *Document
+	vars   map[string]interface{}
+	errors []*Error
+}
+
+func (e *executor) run(root *Object, source interface{}, selections []Selection) *Result {
+	data, ok := e.executeSelectionSet(root, source, selections, nil)
+	result := &Result{Errors: e.errors, executed: true}
+	if ok {
+		result.Data = data
+	}
+	return result
+}
+
+func (e *executor) fail(field *Field, path []interface{}, err error) {
+	gqlErr := &Error{Message: err.Error(), Path: path}
+	if field != nil {
+		gqlErr.Locations = []Location{field.Location}
+	}
+	e.errors = append(e.errors, gqlErr)
+}
+
+// collectFields groups the fields of a selection set by response key,
+// expanding fragments and applying @skip and @include
+func (e *executor) collectFields(obj *Object, selections []Selection, visited map[string]bool) ([]string, map[string][]*Field) {
+	var keys []string
+	groups := make(map[string][]*Field)
+
+	var collect func(selections []Selection)
+	collect = func(selections []Selection) {
+		for _, selection := range selections {
+			if !e.shouldInclude(selection.directives()) {
+				continue
+			}
+			switch sel := selection.(type) {
+			case *Field:
+				key := sel.ResponseKey()
+				if _, ok := groups[key]; !ok {
+					keys = append(keys, key)
+				}
+				groups[key] = append(groups[key], sel)
+			case *InlineFragment:
+				if sel.TypeCondition == "" || sel.TypeCondition == obj.Name {
+					collect(sel.SelectionSet)
+				}
+			case *FragmentSpread:
+				if visited == nil {
+					visited = make(map[string]bool)
+				}
+				if visited[sel.Name] {
+					continue
+				}
+				visited[sel.Name] = true
+				if fragment := e.doc.Fragments[sel.Name]; fragment != nil && fragment.TypeCondition == obj.Name {
+					collect(fragment.SelectionSet)
+				}
+			}
+		}
+	}
+	collect(selections)
+	return keys, groups
+}
+
+// shouldInclude evaluates the @skip and @include directives
+func (e *executor) shouldInclude(directives []*Directive) bool {
+	for _, directive := range directives {
+		if directive.Name != "skip" && directive.Name != "include" {
+			continue
+		}
+		var cond bool
+		for _, arg := range directive.Arguments {
+			if arg.Name == "if" {
+				value, _ := coerceLiteral(&NonNull{Boolean}, arg.Value, e.vars)
+				cond, _ = value.(bool)
+			}
+		}
+		if directive.Name == "skip" && cond || directive.Name == "include" && !cond {
+			return false
+		}
+	}
+	return true
+}
+
+// executeSelectionSet resolves the selections on an object. It returns
+// false when a non-null field failed, making the object itself null.
+func (e *executor) executeSelectionSet(obj *Object, source interface{}, selections []Selection, path []interface{}) (interface{}, bool) {
+	keys, groups := e.collectFields(obj, selections, nil)
+	result := make(orderedMap, 0, len(keys))
+	for _, key := range keys {
+		value, ok := e.executeField(obj, source, groups[key], appendPath(path, key))
+		if !ok {
+			return nil, false
+		}
+		result = append(result, orderedField{key, value})
+	}
+	return result, true
+}
+
+func (e *executor) executeField(obj *Object, source interface{}, fields []*Field, path []interface{}) (interface{}, bool) {
+	field := fields[0]
+	if field.Name == "__typename" {
+		return obj.Name, true
+	}
+
+	def := e.schema.fieldDefinition(obj, field.Name)
+	value, err := e.resolveField(obj, def, source, field)
+	if err != nil {
+		e.fail(field, path, err)
+		_, nonNull := def.Type.(*NonNull)
+		return nil, !nonNull
+	}
+
+	var selections []Selection
+	for _, f := range fields {
+		selections = append(selections, f.SelectionSet...)
+	}
+	return e.completeValue(def.Type, value, field, selections, path)
+}
+
+func (e *executor) resolveField(obj *Object, def *FieldDefinition, source interface{}, field *Field) (value interface{}, err error) {
+	args, err := coerceArguments(def, field.Arguments, e.vars)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("internal error resolving %s.%s", obj.Name, def.Name)
+		}
+	}()
+
+	switch {
+	case def.Resolve != nil:
+		return def.Resolve(ResolveParams{Context: e.ctx, Source: source, Args: args})
+	case def.Subscribe != nil:
+		// Subscription root fields resolve to the event itself
+		return source, nil
+	}
+	return defaultResolve(source, def.Name), nil
+}
+
+// completeValue converts a resolved value to its result according to the
+// field type. It returns false when the value is null for a non-null type.
+func (e *executor) completeValue(t Type, value interface{}, field *Field, selections []Selection, path []interface{}) (interface{}, bool) {
+	if nonNull, ok := t.(*NonNull); ok {
+		result, ok := e.completeNullable(nonNull.OfType, value, field, selections, path)
+		if !ok {
+			return nil, false
+		}
+		if result == nil {
+			e.fail(field, path, fmt.Errorf("cannot return null for non-null field"))
+			return nil, false
+		}
+		return result, true
+	}
+
+	result, ok := e.completeNullable(t, value, field, selections, path)
+	if !ok {
+		return nil, true
+	}
+	return result, true
+}
+
+func (e *executor) completeNullable(t Type, value interface{}, field *Field, selections []Selection, path []interface{}) (interface{}, bool) {
+	if list, ok := t.(*List); ok {
+		rv := reflect.ValueOf(value)
+		if value == nil || (rv.Kind() == reflect.Ptr && rv.IsNil()) {
+			return nil, true
+		}
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			e.fail(field, path, fmt.Errorf("expected a list, got %T", value))
+			return nil, false
+		}
+		// A nil slice is an empty list
+		items := make([]interface{}, rv.Len())
+		for i := range items {
+			item, ok := e.completeValue(list.OfType, rv.Index(i).Interface(), field, selections, appendPath(path, i))
+			if !ok {
+				return nil, false
+			}
+			items[i] = item
+		}
+		return items, true
+	}
+
+	if isNil(value) {
+		return nil, true
+	}
+
+	switch t := t.(type) {
+	case *Scalar:
+		result, err := t.Serialize(value)
+		if err != nil {
+			e.fail(field, path, err)
+			return nil, false
+		}
+		return result, true
+	case *Enum:
+		name := fmt.Sprint(value)
+		if !t.has(name) {
+			e.fail(field, path, fmt.Errorf("%s cannot represent %q", t.Name, name))
+			return nil, false
+		}
+		return name, true
+	case *Object:
+		return e.executeSelectionSet(t, value, selections, path)
+	}
+
+	e.fail(field, path, fmt.Errorf("unsupported type %s", t))
+	return nil, false
+}
+
+// fieldDefinition finds a field, including the introspection fields of
+// the query type
+func (s *Schema) fieldDefinition(obj *Object, name string) *FieldDefinition {
+	if obj == s.Query {
+		switch name {
+		case "__schema":
+			return s.schemaField()
+		case "__type":
+			return s.typeField()
+		}
+	}
+	return obj.Field(name)
+}
+
+// defaultResolve reads a field from a map or from the struct field whose
+// json tag (or name) matches
+func defaultResolve(source interface{}, name string) interface{} {
+	if m, ok := source.(map[string]interface{}); ok {
+		return m[name]
+	}
+
+	v := reflect.ValueOf(source)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	for _, sf := range reflect.VisibleFields(v.Type()) {
+		if !sf.IsExported() || sf.Anonymous {
+			continue
+		}
+		tag, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+		if tag == name || (tag == "" && strings.EqualFold(sf.Name, name)) {
+			field, err := v.FieldByIndexErr(sf.Index)
+			if err != nil {
+				return nil
+			}
+			return field.Interface()
+		}
+	}
+	return nil
+}
+
+func isNil(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(value); rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Interface, reflect.Chan, reflect.Func, reflect.Slice:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func appendPath(path []interface{}, key interface{}) []interface{} {
+	next := make([]interface{}, len(path)+1)
+	copy(next, path)
+	next[len(path)] = key
+	return next
+}
+
+// orderedMap is a JSON object that keeps the selection order of fields
+type orderedMap []orderedField
+
+type orderedField struct {
+	Key   string
+	Value interface{}
+}
+
+// MarshalJSON implements json.Marshaler
+func (m orderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, field := range m {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(field.Key)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,280 @@
+package graphql
+
+import (
+	"sort"
+)
+
+// Introspection types, built in init because they refer to each other
+var (
+	schemaType            *Object
+	typeType              *Object
+	fieldType             *Object
+	inputValueType        *Object
+	enumValueType         *Object
+	directiveType         *Object
+	typeKindType          *Enum
+	directiveLocationType *Enum
+)
+
+// directive describes a directive supported by the executor
+type directive struct {
+	Name        string
+	Description string
+	Locations   []string
+	Args        []*ArgumentDefinition
+}
+
+var directives = []*directive{
+	{
+		Name:        "skip",
+		Description: "Directs the executor to skip this field or fragment when the `if` argument is true.",
+		Locations:   []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+		Args:        []*ArgumentDefinition{{Name: "if", Description: "Skipped when true.", Type: &NonNull{Boolean}}},
+	},
+	{
+		Name:        "include",
+		Description: "Directs the executor to include this field or fragment only when the `if` argument is true.",
+		Locations:   []string{"FIELD", "FRAGMENT_SPREAD", "INLINE_FRAGMENT"},
+		Args:        []*ArgumentDefinition{{Name: "if", Description: "Included when true.", Type: &NonNull{Boolean}}},
+	},
+}
+
+// optional returns nil for empty descriptions
+func optional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func enumOf(name string, values ...string) *Enum {
+	enum := &Enum{Name: name}
+	for _, value := range values {
+		enum.Values = append(enum.Values, &EnumValueDefinition{Name: value})
+	}
+	return enum
+}
+
+func init() {
+	typeKindType = enumOf("__TypeKind",
+		"SCALAR", "OBJECT", "INTERFACE", "UNION", "ENUM", "INPUT_OBJECT", "LIST", "NON_NULL")
+	directiveLocationType = enumOf("__DirectiveLocation",
+		"QUERY", "MUTATION", "SUBSCRIPTION", "FIELD", "FRAGMENT_DEFINITION", "FRAGMENT_SPREAD",
+		"INLINE_FRAGMENT", "VARIABLE_DEFINITION", "SCHEMA", "SCALAR", "OBJECT", "FIELD_DEFINITION",
+		"ARGUMENT_DEFINITION", "INTERFACE", "UNION", "ENUM", "ENUM_VALUE", "INPUT_OBJECT",
+		"INPUT_FIELD_DEFINITION")
+
+	schemaType = &Object{Name: "__Schema"}
+	typeType = &Object{Name: "__Type"}
+	fieldType = &Object{Name: "__Field"}
+	inputValueType = &Object{Name: "__InputValue"}
+	enumValueType = &Object{Name: "__EnumValue"}
+	directiveType = &Object{Name: "__Directive"}
+
+	includeDeprecated := []*ArgumentDefinition{{Name: "includeDeprecated", Type: Boolean, DefaultValue: false}}
+	notDeprecated := []*FieldDefinition{
+		{Name: "isDeprecated", Type: &NonNull{Boolean}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return false, nil
+		}},
+		{Name: "deprecationReason", Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			return nil, nil
+		}},
+	}
+	typeList := &NonNull{&List{&NonNull{typeType}}}
+
+	schemaType.Fields = []*FieldDefinition{
+		{Name: "description", Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			return nil, nil
+		}},
+		{Name: "types", Type: typeList, Resolve: func(p ResolveParams) (interface{}, error) {
+			types := p.Source.(*Schema).introspectionTypes()
+			names := make([]string, 0, len(types))
+			for name := range types {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			result := make([]Type, len(names))
+			for i, name := range names {
+				result[i] = types[name]
+			}
+			return result, nil
+		}},
+		{Name: "queryType", Type: &NonNull{typeType}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*Schema).Query, nil
+		}},
+		{Name: "mutationType", Type: typeType, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*Schema).Mutation, nil
+		}},
+		{Name: "subscriptionType", Type: typeType, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*Schema).Subscription, nil
+		}},
+		{Name: "directives", Type: &NonNull{&List{&NonNull{directiveType}}}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return directives, nil
+		}},
+	}
+
+	typeType.Fields = []*FieldDefinition{
+		{Name: "kind", Type: &NonNull{typeKindType}, Resolve: func(p ResolveParams) (interface{}, error) {
+			switch p.Source.(type) {
+			case *Scalar:
+				return "SCALAR", nil
+			case *Enum:
+				return "ENUM", nil
+			case *Object:
+				return "OBJECT", nil
+			case *List:
+				return "LIST", nil
+			case *NonNull:
+				return "NON_NULL", nil
+			}
+			return nil, nil
+		}},
+		{Name: "name", Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			switch p.Source.(type) {
+			case *List, *NonNull:
+				return nil, nil
+			}
+			return p.Source.(Type).String(), nil
+		}},
+		{Name: "description", Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			switch t := p.Source.(type) {
+			case *Scalar:
+				return optional(t.Description), nil
+			case *Enum:
+				return optional(t.Description), nil
+			case *Object:
+				return optional(t.Description), nil
+			}
+			return nil, nil
+		}},
+		{Name: "specifiedByURL", Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			return nil, nil
+		}},
+		{Name: "fields", Type: &List{&NonNull{fieldType}}, Args: includeDeprecated, Resolve: func(p ResolveParams) (interface{}, error) {
+			if t, ok := p.Source.(*Object); ok {
+				return t.Fields, nil
+			}
+			return nil, nil
+		}},
+		{Name: "interfaces", Type: &List{&NonNull{typeType}}, Resolve: func(p ResolveParams) (interface{}, error) {
+			if _, ok := p.Source.(*Object); ok {
+				return []Type{}, nil
+			}
+			return nil, nil
+		}},
+		{Name: "possibleTypes", Type: &List{&NonNull{typeType}}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return nil, nil
+		}},
+		{Name: "enumValues", Type: &List{&NonNull{enumValueType}}, Args: includeDeprecated, Resolve: func(p ResolveParams) (interface{}, error) {
+			if t, ok := p.Source.(*Enum); ok {
+				return t.Values, nil
+			}
+			return nil, nil
+		}},
+		{Name: "inputFields", Type: &List{&NonNull{inputValueType}}, Args: includeDeprecated, Resolve: func(p ResolveParams) (interface{}, error) {
+			return nil, nil
+		}},
+		{Name: "ofType", Type: typeType, Resolve: func(p ResolveParams) (interface{}, error) {
+			switch t := p.Source.(type) {
+			case *List:
+				return t.OfType, nil
+			case *NonNull:
+				return t.OfType, nil
+			}
+			return nil, nil
+		}},
+		{Name: "isOneOf", Type: Boolean, Resolve: func(p ResolveParams) (interface{}, error) {
+			return nil, nil
+		}},
+	}
+
+	fieldType.Fields = append([]*FieldDefinition{
+		{Name: "name", Type: &NonNull{String}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*FieldDefinition).Name, nil
+		}},
+		{Name: "description", Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			return optional(p.Source.(*FieldDefinition).Description), nil
+		}},
+		{Name: "args", Type: &NonNull{&List{&NonNull{inputValueType}}}, Args: includeDeprecated, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*FieldDefinition).Args, nil
+		}},
+		{Name: "type", Type: &NonNull{typeType}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*FieldDefinition).Type, nil
+		}},
+	}, notDeprecated...)
+
+	inputValueType.Fields = append([]*FieldDefinition{
+		{Name: "name", Type: &NonNull{String}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*ArgumentDefinition).Name, nil
+		}},
+		{Name: "description", Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			return optional(p.Source.(*ArgumentDefinition).Description), nil
+		}},
+		{Name: "type", Type: &NonNull{typeType}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*ArgumentDefinition).Type, nil
+		}},
+		{Name: "defaultValue", Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			if value := p.Source.(*ArgumentDefinition).DefaultValue; value != nil {
+				return printGoValue(value), nil
+			}
+			return nil, nil
+		}},
+	}, notDeprecated...)
+
+	enumValueType.Fields = append([]*FieldDefinition{
+		{Name: "name", Type: &NonNull{String}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return p.Source.(*EnumValueDefinition).Name, nil
+		}},
+		{Name: "description", Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			return optional(p.Source.(*EnumValueDefinition).Description), nil
+		}},
+	}, notDeprecated...)
+
+	directiveType.Fields = []*FieldDefinition{
+		{Name: "name", Type: &NonNull{String}},
+		{Name: "description", Type: String, Resolve: func(p ResolveParams) (interface{}, error) {
+			return optional(p.Source.(*directive).Description), nil
+		}},
+		{Name: "locations", Type: &NonNull{&List{&NonNull{directiveLocationType}}}},
+		{Name: "args", Type: &NonNull{&List{&NonNull{inputValueType}}}, Args: includeDeprecated},
+		{Name: "isRepeatable", Type: &NonNull{Boolean}, Resolve: func(p ResolveParams) (interface{}, error) {
+			return false, nil
+		}},
+	}
+}
+
+// introspectionTypes returns the schema types including the introspection
+// types themselves
+func (s *Schema) introspectionTypes() map[string]Type {
+	types := s.types()
+	for _, t := range []Type{schemaType, typeType, fieldType, inputValueType, enumValueType, directiveType, typeKindType, directiveLocationType} {
+		types[t.String()] = t
+	}
+	return types
+}
+
+// schemaField is the __schema meta field of the query type
+func (s *Schema) schemaField() *FieldDefinition {
+	return &FieldDefinition{
+		Name: "__schema",
+		Type: &NonNull{schemaType},
+		Resolve: func(p ResolveParams) (interface{}, error) {
+			return s, nil
+		},
+	}
+}
+
+// typeField is the __type meta field of the query type
+func (s *Schema) typeField() *FieldDefinition {
+	return &FieldDefinition{
+		Name: "__type",
+		Type: typeType,
+		Args: []*ArgumentDefinition{{Name: "name", Type: &NonNull{String}}},
+		Resolve: func(p ResolveParams) (interface{}, error) {
+			if t, ok := s.introspectionTypes()[p.Args["name"].(string)]; ok {
+				return t, nil
+			}
+			return nil, nil
+		},
+	}
+}
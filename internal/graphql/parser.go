@@ -0,0 +1,671 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Document is a parsed GraphQL request document
+type Document struct {
+	Operations []*Operation
+	Fragments  map[string]*Fragment
+}
+
+// Operation is a query, mutation or subscription definition
+type Operation struct {
+	Type         string // query, mutation or subscription
+	Name         string
+	Variables    []*VariableDefinition
+	Directives   []*Directive
+	SelectionSet []Selection
+}
+
+// VariableDefinition declares an operation variable
+type VariableDefinition struct {
+	Name    string
+	Type    *TypeRef
+	Default Value // nil when there is no default
+}
+
+// TypeRef is a type as written in a variable definition
+type TypeRef struct {
+	Name    string
+	Elem    *TypeRef // set for list types
+	NonNull bool
+}
+
+func (t *TypeRef) String() string {
+	s := t.Name
+	if t.Elem != nil {
+		s = "[" + t.Elem.String() + "]"
+	}
+	if t.NonNull {
+		s += "!"
+	}
+	return s
+}
+
+// Fragment is a named fragment definition
+type Fragment struct {
+	Name          string
+	TypeCondition string
+	Directives    []*Directive
+	SelectionSet  []Selection
+}
+
+// Selection is a Field, FragmentSpread or InlineFragment
+type Selection interface {
+	directives() []*Directive
+}
+
+// Field selects a field, optionally under an alias
+type Field struct {
+	Alias        string
+	Name         string
+	Arguments    []*Argument
+	Directives   []*Directive
+	SelectionSet []Selection
+	Location     Location
+}
+
+// ResponseKey is the key of the field in the result
+func (f *Field) ResponseKey() string {
+	if f.Alias != "" {
+		return f.Alias
+	}
+	return f.Name
+}
+
+// FragmentSpread includes a named fragment
+type FragmentSpread struct {
+	Name       string
+	Directives []*Directive
+}
+
+// InlineFragment includes a selection set, optionally for a type
+type InlineFragment struct {
+	TypeCondition string
+	Directives    []*Directive
+	SelectionSet  []Selection
+}
+
+func (f *Field) directives() []*Directive          { return f.Directives }
+func (f *FragmentSpread) directives() []*Directive { return f.Directives }
+func (f *InlineFragment) directives() []*Directive { return f.Directives }
+
+// Argument is a named argument value
+type Argument struct {
+	Name  string
+	Value Value
+}
+
+// Directive is a directive such as @skip(if: true)
+type Directive struct {
+	Name      string
+	Arguments []*Argument
+}
+
+// Value is a literal or variable in a document: one of Variable,
+// IntValue, FloatValue, StringValue, BooleanValue, NullValue, EnumValue,
+// ListValue or ObjectValue
+type Value interface{}
+
+type (
+	// Variable references an operation variable
+	Variable string
+	// IntValue is an integer literal
+	IntValue string
+	// FloatValue is a float literal
+	FloatValue string
+	// StringValue is a string literal
+	StringValue string
+	// BooleanValue is true or false
+	BooleanValue bool
+	// NullValue is null
+	NullValue struct{}
+	// EnumValue is an enum literal
+	EnumValue string
+	// ListValue is a list literal
+	ListValue []Value
+	// ObjectValue is an input object literal
+	ObjectValue []*Argument
+)
+
+// Location is a position in the request document
+type Location struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// SyntaxError is returned by Parse for malformed documents
+type SyntaxError struct {
+	Message  string
+	Location Location
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %d:%d: %s", e.Location.Line, e.Location.Column, e.Message)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenPunct
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	loc   Location
+}
+
+type parser struct {
+	src  string
+	pos  int
+	line int
+	col  int
+	tok  token
+}
+
+// Parse parses a GraphQL executable document
+func Parse(src string) (doc *Document, err error) {
+	p := &parser{src: src, line: 1, col: 1}
+	defer func() {
+		if r := recover(); r != nil {
+			syntaxErr, ok := r.(*SyntaxError)
+			if !ok {
+				panic(r)
+			}
+			doc, err = nil, syntaxErr
+		}
+	}()
+
+	p.next()
+	doc = &Document{Fragments: make(map[string]*Fragment)}
+	for p.tok.kind != tokenEOF {
+		switch {
+		case p.peek(tokenPunct, "{"):
+			doc.Operations = append(doc.Operations, &Operation{
+				Type:         "query",
+				SelectionSet: p.parseSelectionSet(),
+			})
+		case p.peek(tokenName, "query"), p.peek(tokenName, "mutation"), p.peek(tokenName, "subscription"):
+			doc.Operations = append(doc.Operations, p.parseOperation())
+		case p.peek(tokenName, "fragment"):
+			fragment := p.parseFragment()
+			if _, ok := doc.Fragments[fragment.Name]; ok {
+				p.failAt(p.tok.loc, "duplicate fragment %q", fragment.Name)
+			}
+			doc.Fragments[fragment.Name] = fragment
+		default:
+			p.fail("unexpected %s", p.describe())
+		}
+	}
+
+	if len(doc.Operations) == 0 {
+		return nil, &SyntaxError{Message: "document contains no operations", Location: Location{1, 1}}
+	}
+	return doc, nil
+}
+
+func (p *parser) parseOperation() *Operation {
+	op := &Operation{Type: p.expectName()}
+	if p.tok.kind == tokenName {
+		op.Name = p.expectName()
+	}
+	if p.skip("(") {
+		for !p.skip(")") {
+			op.Variables = append(op.Variables, p.parseVariableDefinition())
+		}
+	}
+	op.Directives = p.parseDirectives(false)
+	op.SelectionSet = p.parseSelectionSet()
+	return op
+}
+
+func (p *parser) parseVariableDefinition() *VariableDefinition {
+	p.expect("$")
+	def := &VariableDefinition{Name: p.expectName()}
+	p.expect(":")
+	def.Type = p.parseTypeRef()
+	if p.skip("=") {
+		def.Default = p.parseValue(true)
+	}
+	p.parseDirectives(true)
+	return def
+}
+
+func (p *parser) parseTypeRef() *TypeRef {
+	t := &TypeRef{}
+	if p.skip("[") {
+		t.Elem = p.parseTypeRef()
+		p.expect("]")
+	} else {
+		t.Name = p.expectName()
+	}
+	t.NonNull = p.skip("!")
+	return t
+}
+
+func (p *parser) parseFragment() *Fragment {
+	p.expectKeyword("fragment")
+	fragment := &Fragment{Name: p.expectName()}
+	if fragment.Name == "on" {
+		p.fail("fragment cannot be named \"on\"")
+	}
+	p.expectKeyword("on")
+	fragment.TypeCondition = p.expectName()
+	fragment.Directives = p.parseDirectives(false)
+	fragment.SelectionSet = p.parseSelectionSet()
+	return fragment
+}
+
+func (p *parser) parseSelectionSet() []Selection {
+	p.expect("{")
+	var selections []Selection
+	for !p.skip("}") {
+		selections = append(selections, p.parseSelection())
+	}
+	if len(selections) == 0 {
+		p.fail("selection set cannot be empty")
+	}
+	return selections
+}
+
+func (p *parser) parseSelection() Selection {
+	if p.skip("...") {
+		if p.peek(tokenName, "on") {
+			p.next()
+			return &InlineFragment{
+				TypeCondition: p.expectName(),
+				Directives:    p.parseDirectives(false),
+				SelectionSet:  p.parseSelectionSet(),
+			}
+		}
+		if p.tok.kind == tokenName {
+			return &FragmentSpread{
+				Name:       p.expectName(),
+				Directives: p.parseDirectives(false),
+			}
+		}
+		return &InlineFragment{
+			Directives:   p.parseDirectives(false),
+			SelectionSet: p.parseSelectionSet(),
+		}
+	}
+
+	field := &Field{Location: p.tok.loc, Name: p.expectName()}
+	if p.skip(":") {
+		field.Alias = field.Name
+		field.Name = p.expectName()
+	}
+	field.Arguments = p.parseArguments(false)
+	field.Directives = p.parseDirectives(false)
+	if p.peek(tokenPunct, "{") {
+		field.SelectionSet = p.parseSelectionSet()
+	}
+	return field
+}
+
+func (p *parser) parseArguments(constant bool) []*Argument {
+	if !p.skip("(") {
+		return nil
+	}
+	var args []*Argument
+	for !p.skip(")") {
+		arg := &Argument{Name: p.expectName()}
+		p.expect(":")
+		arg.Value = p.parseValue(constant)
+		args = append(args, arg)
+	}
+	return args
+}
+
+func (p *parser) parseDirectives(constant bool) []*Directive {
+	var directives []*Directive
+	for p.skip("@") {
+		directives = append(directives, &Directive{
+			Name:      p.expectName(),
+			Arguments: p.parseArguments(constant),
+		})
+	}
+	return directives
+}
+
+func (p *parser) parseValue(constant bool) Value {
+	tok := p.tok
+	switch tok.kind {
+	case tokenInt:
+		p.next()
+		return IntValue(tok.value)
+	case tokenFloat:
+		p.next()
+		return FloatValue(tok.value)
+	case tokenString:
+		p.next()
+		return StringValue(tok.value)
+	case tokenName:
+		p.next()
+		switch tok.value {
+		case "true":
+			return BooleanValue(true)
+		case "false":
+			return BooleanValue(false)
+		case "null":
+			return NullValue{}
+		}
+		return EnumValue(tok.value)
+	case tokenPunct:
+		switch tok.value {
+		case "$":
+			if constant {
+				p.fail("unexpected variable")
+			}
+			p.next()
+			return Variable(p.expectName())
+		case "[":
+			p.next()
+			list := ListValue{}
+			for !p.skip("]") {
+				list = append(list, p.parseValue(constant))
+			}
+			return list
+		case "{":
+			p.next()
+			object := ObjectValue{}
+			for !p.skip("}") {
+				field := &Argument{Name: p.expectName()}
+				p.expect(":")
+				field.Value = p.parseValue(constant)
+				object = append(object, field)
+			}
+			return object
+		}
+	}
+	p.fail("unexpected %s", p.describe())
+	return nil
+}
+
+func (p *parser) peek(kind tokenKind, value string) bool {
+	return p.tok.kind == kind && p.tok.value == value
+}
+
+func (p *parser) skip(punct string) bool {
+	if p.peek(tokenPunct, punct) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(punct string) {
+	if !p.skip(punct) {
+		p.fail("expected %q, found %s", punct, p.describe())
+	}
+}
+
+func (p *parser) expectName() string {
+	if p.tok.kind != tokenName {
+		p.fail("expected name, found %s", p.describe())
+	}
+	name := p.tok.value
+	p.next()
+	return name
+}
+
+func (p *parser) expectKeyword(keyword string) {
+	if !p.peek(tokenName, keyword) {
+		p.fail("expected %q, found %s", keyword, p.describe())
+	}
+	p.next()
+}
+
+func (p *parser) describe() string {
+	switch p.tok.kind {
+	case tokenEOF:
+		return "end of document"
+	case tokenString:
+		return "string"
+	}
+	return strconv.Quote(p.tok.value)
+}
+
+func (p *parser) fail(format string, args ...interface{}) {
+	p.failAt(p.tok.loc, format, args...)
+}
+
+func (p *parser) failAt(loc Location, format string, args ...interface{}) {
+	panic(&SyntaxError{Message: fmt.Sprintf(format, args...), Location: loc})
+}
+
+// advance moves past n bytes of the current line
+func (p *parser) advance(n int) {
+	p.pos += n
+	p.col += n
+}
+
+// next reads the next token, skipping whitespace, commas and comments
+func (p *parser) next() {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		switch {
+		case c == '\n':
+			p.pos++
+			p.line++
+			p.col = 1
+		case c == ' ' || c == '\t' || c == '\r' || c == ',':
+			p.advance(1)
+		case c == '#':
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.advance(1)
+			}
+		case strings.HasPrefix(p.src[p.pos:], "\ufeff"):
+			p.advance(len("\ufeff"))
+		default:
+			p.lex()
+			return
+		}
+	}
+	p.tok = token{kind: tokenEOF, loc: Location{p.line, p.col}}
+}
+
+func (p *parser) lex() {
+	loc := Location{p.line, p.col}
+	start := p.pos
+	c := p.src[p.pos]
+
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.advance(3)
+		p.tok = token{kind: tokenPunct, value: "...", loc: loc}
+
+	case strings.IndexByte("!$&()[]{}:=@|", c) >= 0:
+		p.advance(1)
+		p.tok = token{kind: tokenPunct, value: string(c), loc: loc}
+
+	case c == '_' || isLetter(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.advance(1)
+		}
+		p.tok = token{kind: tokenName, value: p.src[start:p.pos], loc: loc}
+
+	case c == '-' || isDigit(c):
+		p.lexNumber(loc)
+
+	case strings.HasPrefix(p.src[p.pos:], `"""`):
+		p.lexBlockString(loc)
+
+	case c == '"':
+		p.lexString(loc)
+
+	default:
+		r, _ := utf8.DecodeRuneInString(p.src[p.pos:])
+		p.failAt(loc, "unexpected character %q", r)
+	}
+}
+
+func (p *parser) lexNumber(loc Location) {
+	start := p.pos
+	float := false
+	if p.src[p.pos] == '-' {
+		p.advance(1)
+	}
+	digits := func() {
+		n := 0
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.advance(1)
+			n++
+		}
+		if n == 0 {
+			p.failAt(Location{p.line, p.col}, "invalid number")
+		}
+	}
+	digits()
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		float = true
+		p.advance(1)
+		digits()
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		float = true
+		p.advance(1)
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.advance(1)
+		}
+		digits()
+	}
+
+	kind := tokenInt
+	if float {
+		kind = tokenFloat
+	}
+	p.tok = token{kind: kind, value: p.src[start:p.pos], loc: loc}
+}
+
+func (p *parser) lexString(loc Location) {
+	p.advance(1)
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+			p.failAt(loc, "unterminated string")
+		}
+		c := p.src[p.pos]
+		switch {
+		case c == '"':
+			p.advance(1)
+			p.tok = token{kind: tokenString, value: b.String(), loc: loc}
+			return
+		case c == '\\':
+			if p.pos+1 >= len(p.src) {
+				p.failAt(loc, "unterminated string")
+			}
+			escape := p.src[p.pos+1]
+			p.advance(2)
+			switch escape {
+			case '"', '\\', '/':
+				b.WriteByte(escape)
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if p.pos+4 > len(p.src) {
+					p.failAt(loc, "invalid unicode escape")
+				}
+				code, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+				if err != nil {
+					p.failAt(loc, "invalid unicode escape")
+				}
+				p.advance(4)
+				b.WriteRune(rune(code))
+			default:
+				p.failAt(loc, "invalid escape sequence \\%c", escape)
+			}
+		default:
+			_, size := utf8.DecodeRuneInString(p.src[p.pos:])
+			b.WriteString(p.src[p.pos : p.pos+size])
+			p.advance(size)
+		}
+	}
+}
+
+// lexBlockString reads a """block string""", removing common indentation
+func (p *parser) lexBlockString(loc Location) {
+	p.advance(3)
+	var b strings.Builder
+	for {
+		if p.pos >= len(p.src) {
+			p.failAt(loc, "unterminated block string")
+		}
+		switch {
+		case strings.HasPrefix(p.src[p.pos:], `"""`):
+			p.advance(3)
+			p.tok = token{kind: tokenString, value: blockStringValue(b.String()), loc: loc}
+			return
+		case strings.HasPrefix(p.src[p.pos:], `\"""`):
+			b.WriteString(`"""`)
+			p.advance(4)
+		case p.src[p.pos] == '\n':
+			b.WriteByte('\n')
+			p.pos++
+			p.line++
+			p.col = 1
+		default:
+			b.WriteByte(p.src[p.pos])
+			p.advance(1)
+		}
+	}
+}
+
+func blockStringValue(raw string) string {
+	lines := strings.Split(strings.ReplaceAll(raw, "\r\n", "\n"), "\n")
+
+	indent := -1
+	for _, line := range lines[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" {
+			continue
+		}
+		if n := len(line) - len(trimmed); indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent > 0 {
+		for i := 1; i < len(lines); i++ {
+			if len(lines[i]) >= indent {
+				lines[i] = lines[i][indent:]
+			} else {
+				lines[i] = ""
+			}
+		}
+	}
+
+	for len(lines) > 0 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return strings.Join(lines, "\n")
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
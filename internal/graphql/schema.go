@@ -0,0 +1,469 @@
+package graphql
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Type is a GraphQL output or input type: *Scalar, *Enum, *Object, *List
+// or *NonNull
+type Type interface {
+	String() string
+}
+
+// Scalar is a leaf type
+type Scalar struct {
+	Name        string
+	Description string
+
+	// Serialize converts a resolved Go value to its JSON result
+	Serialize func(value interface{}) (interface{}, error)
+
+	// ParseValue converts a JSON variable value to the Go argument value
+	ParseValue func(value interface{}) (interface{}, error)
+
+	// ParseLiteral converts a literal in the document to the Go argument value
+	ParseLiteral func(value Value) (interface{}, error)
+}
+
+func (t *Scalar) String() string { return t.Name }
+
+// Enum is a leaf type restricted to a set of string values
+type Enum struct {
+	Name        string
+	Description string
+	Values      []*EnumValueDefinition
+}
+
+func (t *Enum) String() string { return t.Name }
+
+// EnumValueDefinition defines one value of an enum
+type EnumValueDefinition struct {
+	Name        string
+	Description string
+}
+
+// has reports whether value is one of the enum values
+func (t *Enum) has(value string) bool {
+	for _, v := range t.Values {
+		if v.Name == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Object is a type with fields
+type Object struct {
+	Name        string
+	Description string
+	Fields      []*FieldDefinition
+}
+
+func (t *Object) String() string { return t.Name }
+
+// Field returns the field with the given name
+func (t *Object) Field(name string) *FieldDefinition {
+	for _, field := range t.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+// List is a list of another type
+type List struct {
+	OfType Type
+}
+
+func (t *List) String() string { return "[" + t.OfType.String() + "]" }
+
+// NonNull marks a type as never null
+type NonNull struct {
+	OfType Type
+}
+
+func (t *NonNull) String() string { return t.OfType.String() + "!" }
+
+// ResolveParams are passed to field resolvers
+type ResolveParams struct {
+	Context context.Context
+	Source  interface{}
+	Args    map[string]interface{}
+}
+
+// ResolveFunc produces the value of a field
+type ResolveFunc func(p ResolveParams) (interface{}, error)
+
+// SubscribeFunc produces the event stream of a subscription field. The
+// channel should be closed when the context is done.
+type SubscribeFunc func(p ResolveParams) (<-chan interface{}, error)
+
+// FieldDefinition defines a field of an object type
+type FieldDefinition struct {
+	Name        string
+	Description string
+	Type        Type
+	Args        []*ArgumentDefinition
+
+	// Resolve produces the field value; when nil the value is read from
+	// the source by map key or by the struct field with a matching json tag
+	Resolve ResolveFunc
+
+	// Subscribe is set on subscription root fields
+	Subscribe SubscribeFunc
+}
+
+// ArgumentDefinition defines a field argument
+type ArgumentDefinition struct {
+	Name         string
+	Description  string
+	Type         Type
+	DefaultValue interface{} // Go value; nil when there is no default
+}
+
+// Schema is the root of a GraphQL API
+type Schema struct {
+	Query        *Object
+	Mutation     *Object
+	Subscription *Object
+}
+
+// Built-in scalars
+var (
+	Int = &Scalar{
+		Name:        "Int",
+		Description: "The `Int` scalar type represents non-fractional signed whole numeric values.",
+		Serialize: func(value interface{}) (interface{}, error) {
+			switch v := value.(type) {
+			case int:
+				return v, nil
+			case int32:
+				return v, nil
+			case int64:
+				return v, nil
+			case bool:
+				if v {
+					return 1, nil
+				}
+				return 0, nil
+			}
+			return nil, fmt.Errorf("Int cannot represent %v", value)
+		},
+		ParseValue: func(value interface{}) (interface{}, error) {
+			f, ok := value.(float64)
+			if !ok || f != math.Trunc(f) || f < math.MinInt32 || f > math.MaxInt32 {
+				return nil, fmt.Errorf("Int cannot represent %v", value)
+			}
+			return int(f), nil
+		},
+		ParseLiteral: func(value Value) (interface{}, error) {
+			literal, ok := value.(IntValue)
+			if !ok {
+				return nil, fmt.Errorf("Int cannot represent %s", printValue(value))
+			}
+			n, err := strconv.ParseInt(string(literal), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Int cannot represent %s", literal)
+			}
+			return int(n), nil
+		},
+	}
+
+	Float = &Scalar{
+		Name:        "Float",
+		Description: "The `Float` scalar type represents signed double-precision fractional values.",
+		Serialize: func(value interface{}) (interface{}, error) {
+			switch v := value.(type) {
+			case float32:
+				return float64(v), nil
+			case float64:
+				return v, nil
+			case int:
+				return float64(v), nil
+			case int64:
+				return float64(v), nil
+			}
+			return nil, fmt.Errorf("Float cannot represent %v", value)
+		},
+		ParseValue: func(value interface{}) (interface{}, error) {
+			f, ok := value.(float64)
+			if !ok {
+				return nil, fmt.Errorf("Float cannot represent %v", value)
+			}
+			return f, nil
+		},
+		ParseLiteral: func(value Value) (interface{}, error) {
+			switch v := value.(type) {
+			case IntValue:
+				return strconv.ParseFloat(string(v), 64)
+			case FloatValue:
+				return strconv.ParseFloat(string(v), 64)
+			}
+			return nil, fmt.Errorf("Float cannot represent %s", printValue(value))
+		},
+	}
+
+	String = &Scalar{
+		Name:        "String",
+		Description: "The `String` scalar type represents textual data.",
+		Serialize: func(value interface{}) (interface{}, error) {
+			switch v := value.(type) {
+			case string:
+				return v, nil
+			case fmt.Stringer:
+				return v.String(), nil
+			}
+			return nil, fmt.Errorf("String cannot represent %v", value)
+		},
+		ParseValue: func(value interface{}) (interface{}, error) {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("String cannot represent %v", value)
+			}
+			return s, nil
+		},
+		ParseLiteral: func(value Value) (interface{}, error) {
+			s, ok := value.(StringValue)
+			if !ok {
+				return nil, fmt.Errorf("String cannot represent %s", printValue(value))
+			}
+			return string(s), nil
+		},
+	}
+
+	Boolean = &Scalar{
+		Name:        "Boolean",
+		Description: "The `Boolean` scalar type represents `true` or `false`.",
+		Serialize: func(value interface{}) (interface{}, error) {
+			b, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("Boolean cannot represent %v", value)
+			}
+			return b, nil
+		},
+		ParseValue: func(value interface{}) (interface{}, error) {
+			b, ok := value.(bool)
+			if !ok {
+				return nil, fmt.Errorf("Boolean cannot represent %v", value)
+			}
+			return b, nil
+		},
+		ParseLiteral: func(value Value) (interface{}, error) {
+			b, ok := value.(BooleanValue)
+			if !ok {
+				return nil, fmt.Errorf("Boolean cannot represent %s", printValue(value))
+			}
+			return bool(b), nil
+		},
+	}
+
+	// ID is serialized as a string; integer IDs are parsed to int64
+	ID = &Scalar{
+		Name:        "ID",
+		Description: "The `ID` scalar type represents a unique identifier.",
+		Serialize: func(value interface{}) (interface{}, error) {
+			switch v := value.(type) {
+			case string:
+				return v, nil
+			case int:
+				return strconv.Itoa(v), nil
+			case int64:
+				return strconv.FormatInt(v, 10), nil
+			}
+			return nil, fmt.Errorf("ID cannot represent %v", value)
+		},
+		ParseValue: func(value interface{}) (interface{}, error) {
+			switch v := value.(type) {
+			case string:
+				return parseID(v), nil
+			case float64:
+				if v == math.Trunc(v) {
+					return int64(v), nil
+				}
+			}
+			return nil, fmt.Errorf("ID cannot represent %v", value)
+		},
+		ParseLiteral: func(value Value) (interface{}, error) {
+			switch v := value.(type) {
+			case StringValue:
+				return parseID(string(v)), nil
+			case IntValue:
+				return strconv.ParseInt(string(v), 10, 64)
+			}
+			return nil, fmt.Errorf("ID cannot represent %s", printValue(value))
+		},
+	}
+)
+
+// parseID returns numeric IDs as int64 and others as strings
+func parseID(s string) interface{} {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	return s
+}
+
+var builtinScalars = map[string]*Scalar{
+	"Int":     Int,
+	"Float":   Float,
+	"String":  String,
+	"Boolean": Boolean,
+	"ID":      ID,
+}
+
+// namedType strips List and NonNull wrappers
+func namedType(t Type) Type {
+	for {
+		switch wrapped := t.(type) {
+		case *List:
+			t = wrapped.OfType
+		case *NonNull:
+			t = wrapped.OfType
+		default:
+			return t
+		}
+	}
+}
+
+// types returns every named type reachable from the schema, keyed by name
+func (s *Schema) types() map[string]Type {
+	types := make(map[string]Type)
+	var visit func(t Type)
+	visit = func(t Type) {
+		t = namedType(t)
+		if _, ok := types[t.String()]; ok {
+			return
+		}
+		types[t.String()] = t
+		if object, ok := t.(*Object); ok {
+			for _, field := range object.Fields {
+				visit(field.Type)
+				for _, arg := range field.Args {
+					visit(arg.Type)
+				}
+			}
+		}
+	}
+
+	for _, scalar := range builtinScalars {
+		visit(scalar)
+	}
+	for _, root := range []*Object{s.Query, s.Mutation, s.Subscription} {
+		if root != nil {
+			visit(root)
+		}
+	}
+	return types
+}
+
+// SDL prints the schema in the GraphQL schema definition language
+func (s *Schema) SDL() string {
+	types := s.types()
+	names := make([]string, 0, len(types))
+	for name := range types {
+		if _, builtin := builtinScalars[name]; !builtin && !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		if b.Len() > 0 {
+			b.WriteString("\n")
+		}
+		switch t := types[name].(type) {
+		case *Scalar:
+			writeDescription(&b, t.Description, "")
+			fmt.Fprintf(&b, "scalar %s\n", t.Name)
+		case *Enum:
+			writeDescription(&b, t.Description, "")
+			fmt.Fprintf(&b, "enum %s {\n", t.Name)
+			for _, value := range t.Values {
+				writeDescription(&b, value.Description, "  ")
+				b.WriteString("  " + value.Name + "\n")
+			}
+			b.WriteString("}\n")
+		case *Object:
+			writeDescription(&b, t.Description, "")
+			fmt.Fprintf(&b, "type %s {\n", t.Name)
+			for _, field := range t.Fields {
+				writeDescription(&b, field.Description, "  ")
+				b.WriteString("  " + field.Name)
+				if len(field.Args) > 0 {
+					args := make([]string, len(field.Args))
+					for i, arg := range field.Args {
+						args[i] = arg.Name + ": " + arg.Type.String()
+						if arg.DefaultValue != nil {
+							args[i] += " = " + printGoValue(arg.DefaultValue)
+						}
+					}
+					b.WriteString("(" + strings.Join(args, ", ") + ")")
+				}
+				b.WriteString(": " + field.Type.String() + "\n")
+			}
+			b.WriteString("}\n")
+		}
+	}
+	return b.String()
+}
+
+func writeDescription(b *strings.Builder, description, indent string) {
+	if description != "" {
+		b.WriteString(indent + strconv.Quote(description) + "\n")
+	}
+}
+
+// printGoValue prints a default argument value as a GraphQL literal
+func printGoValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return strconv.Quote(v)
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = printGoValue(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(value)
+}
+
+// printValue prints a document value for error messages
+func printValue(value Value) string {
+	switch v := value.(type) {
+	case Variable:
+		return "$" + string(v)
+	case IntValue:
+		return string(v)
+	case FloatValue:
+		return string(v)
+	case StringValue:
+		return strconv.Quote(string(v))
+	case BooleanValue:
+		return strconv.FormatBool(bool(v))
+	case NullValue:
+		return "null"
+	case EnumValue:
+		return string(v)
+	case ListValue:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = printValue(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case ObjectValue:
+		fields := make([]string, len(v))
+		for i, field := range v {
+			fields[i] = field.Name + ": " + printValue(field.Value)
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+	return fmt.Sprint(value)
+}
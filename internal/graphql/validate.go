@@ -0,0 +1,216 @@
+package graphql
+
+import (
+	"fmt"
+)
+
+// validate checks an operation against the schema before execution
+func (s *Schema) validate(doc *Document, op *Operation, root *Object) error {
+	v := &validator{schema: s, doc: doc, defined: make(map[string]bool)}
+	for _, def := range op.Variables {
+		if v.defined[def.Name] {
+			return fmt.Errorf("variable $%s is defined more than once", def.Name)
+		}
+		v.defined[def.Name] = true
+		if _, err := s.inputType(def.Type); err != nil {
+			return err
+		}
+	}
+
+	if err := v.directives(op.Directives); err != nil {
+		return err
+	}
+	if err := v.selections(root, op.SelectionSet, nil); err != nil {
+		return err
+	}
+
+	if op.Type == "subscription" {
+		e := &executor{doc: doc, vars: map[string]interface{}{}}
+		keys, groups := e.collectFields(root, op.SelectionSet, nil)
+		if len(keys) != 1 || groups[keys[0]][0].Name == "__typename" {
+			return fmt.Errorf("subscription must select exactly one top level field")
+		}
+	}
+	return nil
+}
+
+type validator struct {
+	schema  *Schema
+	doc     *Document
+	defined map[string]bool
+}
+
+func (v *validator) selections(obj *Object, selections []Selection, spreading []string) error {
+	for _, selection := range selections {
+		if err := v.directives(selection.directives()); err != nil {
+			return err
+		}
+
+		switch sel := selection.(type) {
+		case *Field:
+			if err := v.field(obj, sel, spreading); err != nil {
+				return err
+			}
+
+		case *InlineFragment:
+			if sel.TypeCondition != "" && sel.TypeCondition != obj.Name {
+				return fmt.Errorf("fragment on %q cannot be spread within type %q", sel.TypeCondition, obj.Name)
+			}
+			if err := v.selections(obj, sel.SelectionSet, spreading); err != nil {
+				return err
+			}
+
+		case *FragmentSpread:
+			fragment, ok := v.doc.Fragments[sel.Name]
+			if !ok {
+				return fmt.Errorf("unknown fragment %q", sel.Name)
+			}
+			for _, name := range spreading {
+				if name == sel.Name {
+					return fmt.Errorf("fragment %q spreads itself", sel.Name)
+				}
+			}
+			if fragment.TypeCondition != obj.Name {
+				return fmt.Errorf("fragment %q on %q cannot be spread within type %q", sel.Name, fragment.TypeCondition, obj.Name)
+			}
+			if err := v.directives(fragment.Directives); err != nil {
+				return err
+			}
+			if err := v.selections(obj, fragment.SelectionSet, append(spreading, sel.Name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *validator) field(obj *Object, field *Field, spreading []string) error {
+	if field.Name == "__typename" {
+		if len(field.Arguments) > 0 || field.SelectionSet != nil {
+			return v.errorf(field, "field \"__typename\" takes no arguments or selections")
+		}
+		return nil
+	}
+
+	def := v.schema.fieldDefinition(obj, field.Name)
+	if def == nil {
+		return v.errorf(field, "cannot query field %q on type %q", field.Name, obj.Name)
+	}
+
+	if err := v.arguments(field, def.Args, field.Arguments); err != nil {
+		return err
+	}
+
+	switch t := namedType(def.Type).(type) {
+	case *Object:
+		if field.SelectionSet == nil {
+			return v.errorf(field, "field %q of type %q must have a selection of subfields", field.Name, def.Type)
+		}
+		return v.selections(t, field.SelectionSet, spreading)
+	default:
+		if field.SelectionSet != nil {
+			return v.errorf(field, "field %q must not have a selection since type %q has no subfields", field.Name, def.Type)
+		}
+	}
+	return nil
+}
+
+func (v *validator) arguments(field *Field, defs []*ArgumentDefinition, args []*Argument) error {
+	given := make(map[string]bool)
+	for _, arg := range args {
+		if given[arg.Name] {
+			return v.errorf(field, "argument %q is given more than once", arg.Name)
+		}
+		given[arg.Name] = true
+
+		var def *ArgumentDefinition
+		for _, d := range defs {
+			if d.Name == arg.Name {
+				def = d
+			}
+		}
+		if def == nil {
+			return v.errorf(field, "unknown argument %q on field %q", arg.Name, field.Name)
+		}
+		if err := v.variables(arg.Value); err != nil {
+			return v.errorf(field, "%v", err)
+		}
+		if !containsVariable(arg.Value) {
+			if _, err := coerceLiteral(def.Type, arg.Value, nil); err != nil {
+				return v.errorf(field, "argument %q: %v", arg.Name, err)
+			}
+		}
+	}
+
+	for _, def := range defs {
+		if _, nonNull := def.Type.(*NonNull); nonNull && def.DefaultValue == nil && !given[def.Name] {
+			return v.errorf(field, "argument %q of type %q is required", def.Name, def.Type)
+		}
+	}
+	return nil
+}
+
+func (v *validator) directives(directives []*Directive) error {
+	for _, directive := range directives {
+		if directive.Name != "skip" && directive.Name != "include" {
+			return fmt.Errorf("unknown directive @%s", directive.Name)
+		}
+		if len(directive.Arguments) != 1 || directive.Arguments[0].Name != "if" {
+			return fmt.Errorf("directive @%s requires exactly the argument \"if\"", directive.Name)
+		}
+		if err := v.variables(directive.Arguments[0].Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// variables checks that every variable in a value is defined
+func (v *validator) variables(value Value) error {
+	switch val := value.(type) {
+	case Variable:
+		if !v.defined[string(val)] {
+			return fmt.Errorf("variable $%s is not defined", val)
+		}
+	case ListValue:
+		for _, item := range val {
+			if err := v.variables(item); err != nil {
+				return err
+			}
+		}
+	case ObjectValue:
+		for _, field := range val {
+			if err := v.variables(field.Value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v *validator) errorf(field *Field, format string, args ...interface{}) error {
+	return &Error{
+		Message:   fmt.Sprintf(format, args...),
+		Locations: []Location{field.Location},
+	}
+}
+
+func containsVariable(value Value) bool {
+	switch val := value.(type) {
+	case Variable:
+		return true
+	case ListValue:
+		for _, item := range val {
+			if containsVariable(item) {
+				return true
+			}
+		}
+	case ObjectValue:
+		for _, field := range val {
+			if containsVariable(field.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,706 @@
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/backendutil"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+
+	"gowebmail/internal/storage"
+)
+
+// Folder names besides INBOX; folders below them are named after a
+// recipient address or a tag
+const (
+	delimiter     = "/"
+	mailboxesRoot = "Mailboxes"
+	tagsRoot      = "Tags"
+	uidValidity   = 1
+)
+
+// supportedFlags are the flags kept for messages
+var supportedFlags = []string{imap.SeenFlag, imap.FlaggedFlag, imap.DeletedFlag}
+
+// user is a logged in IMAP user. With PerRecipient the user name is a
+// recipient address and every folder only lists mail addressed to it.
+type user struct {
+	server *Server
+	name   string
+
+	// moved holds emails copied to a tag folder in this session, which
+	// EXPUNGE only hides from the source folder rather than deleting, as
+	// clients move messages by copying and then expunging them
+	mu    sync.Mutex
+	moved map[int64]bool
+}
+
+// Username implements backend.User
+func (u *user) Username() string {
+	return u.name
+}
+
+// ListMailboxes implements backend.User. Every folder counts as subscribed.
+func (u *user) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+	mailboxes := []backend.Mailbox{u.mailbox(imap.InboxName, "", "")}
+
+	if !u.server.config.PerRecipient {
+		usage, err := u.server.storage.ListMailboxes()
+		if err != nil {
+			return nil, err
+		}
+		if len(usage) > 0 {
+			mailboxes = append(mailboxes, &parentFolder{name: mailboxesRoot})
+		}
+		for _, mb := range usage {
+			mailboxes = append(mailboxes, u.mailbox(mailboxesRoot+delimiter+mb.Address, mb.Address, ""))
+		}
+	}
+
+	tags, err := u.server.storage.ListTags()
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) > 0 {
+		mailboxes = append(mailboxes, &parentFolder{name: tagsRoot})
+	}
+	for _, tag := range tags {
+		mailboxes = append(mailboxes, u.mailbox(tagsRoot+delimiter+tag, "", tag))
+	}
+
+	return mailboxes, nil
+}
+
+// GetMailbox implements backend.User, listing the folder's emails as of now
+func (u *user) GetMailbox(name string) (backend.Mailbox, error) {
+	var mbox *mailbox
+	switch {
+	case strings.EqualFold(name, imap.InboxName):
+		mbox = u.mailbox(imap.InboxName, "", "")
+	case strings.HasPrefix(name, mailboxesRoot+delimiter) && !u.server.config.PerRecipient:
+		address := strings.TrimPrefix(name, mailboxesRoot+delimiter)
+		mbox = u.mailbox(name, strings.ToLower(address), "")
+	case strings.HasPrefix(name, tagsRoot+delimiter):
+		mbox = u.mailbox(name, "", strings.TrimPrefix(name, tagsRoot+delimiter))
+	default:
+		return nil, backend.ErrNoSuchMailbox
+	}
+
+	if err := mbox.load(); err != nil {
+		return nil, err
+	}
+	if mbox.tag != "" && len(mbox.entries) == 0 {
+		return nil, backend.ErrNoSuchMailbox
+	}
+	return mbox, nil
+}
+
+// CreateMailbox implements backend.User; folders cannot be created
+func (u *user) CreateMailbox(name string) error {
+	return errReadOnly
+}
+
+// DeleteMailbox implements backend.User; folders cannot be deleted
+func (u *user) DeleteMailbox(name string) error {
+	return errReadOnly
+}
+
+// RenameMailbox implements backend.User; folders cannot be renamed
+func (u *user) RenameMailbox(existingName, newName string) error {
+	return errReadOnly
+}
+
+// Logout implements backend.User
+func (u *user) Logout() error {
+	return nil
+}
+
+// mailbox returns the folder name listing the emails addressed to address
+// or tagged with tag, or every email if both are empty
+func (u *user) mailbox(name, address, tag string) *mailbox {
+	if u.server.config.PerRecipient {
+		address = strings.ToLower(u.name)
+	}
+	return &mailbox{
+		user:    u,
+		name:    name,
+		address: address,
+		tag:     tag,
+	}
+}
+
+// parentFolder is a folder that only holds other folders
+type parentFolder struct {
+	backend.Mailbox
+	name string
+}
+
+func (p *parentFolder) Name() string {
+	return p.name
+}
+
+func (p *parentFolder) Info() (*imap.MailboxInfo, error) {
+	return &imap.MailboxInfo{
+		Attributes: []string{imap.NoSelectAttr, imap.HasChildrenAttr},
+		Delimiter:  delimiter,
+		Name:       p.name,
+	}, nil
+}
+
+// entry is a message of a selected folder. Its sequence number is its
+// position in the folder and its UID is the email id, which is never
+// reused, so UIDVALIDITY never changes.
+type entry struct {
+	id      int64
+	deleted bool
+}
+
+// mailbox is a folder, holding the emails it listed when it was selected
+// plus those that arrived since
+type mailbox struct {
+	user    *user
+	name    string
+	address string
+	tag     string
+
+	mu      sync.Mutex
+	entries []*entry
+}
+
+// Name implements backend.Mailbox
+func (m *mailbox) Name() string {
+	return m.name
+}
+
+// Info implements backend.Mailbox
+func (m *mailbox) Info() (*imap.MailboxInfo, error) {
+	info := &imap.MailboxInfo{
+		Attributes: []string{imap.HasNoChildrenAttr},
+		Delimiter:  delimiter,
+		Name:       m.name,
+	}
+	return info, nil
+}
+
+// filter returns the storage filter selecting the folder's emails
+func (m *mailbox) filter() *storage.EmailFilter {
+	return &storage.EmailFilter{
+		Mailbox: m.address,
+		Tag:     m.tag,
+		Summary: true,
+	}
+}
+
+// matches reports whether email belongs in the folder
+func (m *mailbox) matches(email *storage.Email) bool {
+	if m.address != "" && !containsFold(email.To, m.address) {
+		return false
+	}
+	if m.tag != "" && !contains(email.Tags, m.tag) {
+		return false
+	}
+	return true
+}
+
+// emails returns the folder's emails by id, newest first up to MaxMessages
+func (m *mailbox) emails() (map[int64]*storage.Email, []*storage.Email, error) {
+	result, err := m.user.server.storage.ListEmails(m.filter(), m.user.server.config.MaxMessages, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byID := make(map[int64]*storage.Email, len(result.Emails))
+	for _, email := range result.Emails {
+		byID[email.ID] = email
+	}
+	return byID, result.Emails, nil
+}
+
+// load lists the folder's emails, oldest first as sequence numbers go
+func (m *mailbox) load() error {
+	_, emails, err := m.emails()
+	if err != nil {
+		return err
+	}
+
+	entries := make([]*entry, len(emails))
+	for i, email := range emails {
+		entries[len(entries)-1-i] = &entry{id: email.ID}
+	}
+
+	m.mu.Lock()
+	m.entries = entries
+	m.mu.Unlock()
+	return nil
+}
+
+// add appends a new email to the selected folder and returns the status
+// announcing it
+func (m *mailbox) add(email *storage.Email) *imap.MailboxStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = append(m.entries, &entry{id: email.ID})
+
+	status := imap.NewMailboxStatus(m.name, []imap.StatusItem{imap.StatusMessages, imap.StatusRecent})
+	status.Messages = uint32(len(m.entries))
+	status.Recent = 1
+	return status
+}
+
+// Status implements backend.Mailbox
+func (m *mailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+	byID, _, err := m.emails()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	entries := append([]*entry(nil), m.entries...)
+	m.mu.Unlock()
+
+	status := imap.NewMailboxStatus(m.name, items)
+	status.Flags = supportedFlags
+	status.PermanentFlags = supportedFlags
+
+	var unseen uint32
+	var uidNext int64 = 1
+	for i, ent := range entries {
+		if email, ok := byID[ent.id]; ok && !email.Read {
+			unseen++
+			if status.UnseenSeqNum == 0 {
+				status.UnseenSeqNum = uint32(i + 1)
+			}
+		}
+		if ent.id >= uidNext {
+			uidNext = ent.id + 1
+		}
+	}
+
+	for _, item := range items {
+		switch item {
+		case imap.StatusMessages:
+			status.Messages = uint32(len(entries))
+		case imap.StatusUidNext:
+			status.UidNext = uint32(uidNext)
+		case imap.StatusUidValidity:
+			status.UidValidity = uidValidity
+		case imap.StatusRecent:
+			status.Recent = 0
+		case imap.StatusUnseen:
+			status.Unseen = unseen
+		}
+	}
+
+	return status, nil
+}
+
+// SetSubscribed implements backend.Mailbox; every folder is subscribed
+func (m *mailbox) SetSubscribed(subscribed bool) error {
+	return nil
+}
+
+// Check implements backend.Mailbox
+func (m *mailbox) Check() error {
+	return nil
+}
+
+// selected is a message picked by a sequence set
+type selected struct {
+	seqNum uint32
+	entry  *entry
+}
+
+// pick returns the messages in seqSet, which holds UIDs if uid is set and
+// sequence numbers otherwise
+func (m *mailbox) pick(uid bool, seqSet *imap.SeqSet) []selected {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var picked []selected
+	for i, ent := range m.entries {
+		seqNum := uint32(i + 1)
+		id := seqNum
+		if uid {
+			id = uint32(ent.id)
+		}
+		if seqSet.Contains(id) {
+			picked = append(picked, selected{seqNum: seqNum, entry: ent})
+		}
+	}
+	return picked
+}
+
+// flags returns the IMAP flags of an email
+func (m *mailbox) flags(email *storage.Email, ent *entry) []string {
+	var flags []string
+	if email.Read {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if email.Pinned {
+		flags = append(flags, imap.FlaggedFlag)
+	}
+	m.mu.Lock()
+	if ent.deleted {
+		flags = append(flags, imap.DeletedFlag)
+	}
+	m.mu.Unlock()
+	return flags
+}
+
+// ListMessages implements backend.Mailbox. Emails deleted since the folder
+// was selected are left out. Fetching a body section without PEEK marks
+// the email as read.
+func (m *mailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
+	defer close(ch)
+
+	picked := m.pick(uid, seqSet)
+	if len(picked) == 0 {
+		return nil
+	}
+	byID, _, err := m.emails()
+	if err != nil {
+		return err
+	}
+
+	for _, sel := range picked {
+		email, ok := byID[sel.entry.id]
+		if !ok {
+			continue
+		}
+
+		msg, err := m.fetch(sel, email, items)
+		if err != nil {
+			m.user.server.logger.Error().Err(err).Int64("id", email.ID).Msg("Failed to fetch email over IMAP")
+			continue
+		}
+		ch <- msg
+	}
+
+	return nil
+}
+
+// fetch builds the response items of one message
+func (m *mailbox) fetch(sel selected, email *storage.Email, items []imap.FetchItem) (*imap.Message, error) {
+	msg := imap.NewMessage(sel.seqNum, items)
+
+	var raw []byte
+	content := func() (textproto.Header, *bufio.Reader, error) {
+		if raw == nil {
+			var err error
+			raw, err = m.user.server.storage.GetRawEmail(email.ID)
+			if err != nil {
+				return textproto.Header{}, nil, err
+			}
+		}
+		body := bufio.NewReader(bytes.NewReader(raw))
+		header, err := textproto.ReadHeader(body)
+		return header, body, err
+	}
+
+	var markRead bool
+	for _, item := range items {
+		switch item {
+		case imap.FetchEnvelope:
+			header, _, err := content()
+			if err != nil {
+				return nil, err
+			}
+			msg.Envelope, _ = backendutil.FetchEnvelope(header)
+		case imap.FetchBody, imap.FetchBodyStructure:
+			header, body, err := content()
+			if err != nil {
+				return nil, err
+			}
+			msg.BodyStructure, _ = backendutil.FetchBodyStructure(header, body, item == imap.FetchBodyStructure)
+		case imap.FetchFlags:
+			// Set below, once reading the body has been accounted for
+		case imap.FetchInternalDate:
+			msg.InternalDate = email.ReceivedAt
+		case imap.FetchRFC822Size:
+			msg.Size = uint32(email.Size)
+		case imap.FetchUid:
+			msg.Uid = uint32(email.ID)
+		default:
+			section, err := imap.ParseBodySectionName(item)
+			if err != nil {
+				break
+			}
+			header, body, err := content()
+			if err != nil {
+				return nil, err
+			}
+			literal, _ := backendutil.FetchBodySection(header, body, section)
+			msg.Body[section] = literal
+			markRead = markRead || !section.Peek
+		}
+	}
+
+	if markRead && !email.Read {
+		if err := m.user.server.storage.MarkRead(email.ID); err != nil {
+			return nil, err
+		}
+		email.Read = true
+		if _, ok := msg.Items[imap.FetchFlags]; !ok {
+			msg.Items[imap.FetchFlags] = nil
+		}
+	}
+	if _, ok := msg.Items[imap.FetchFlags]; ok {
+		msg.Flags = m.flags(email, sel.entry)
+	}
+
+	return msg, nil
+}
+
+// SearchMessages implements backend.Mailbox. Email sources are only read
+// when the criteria look at headers or bodies.
+func (m *mailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
+	byID, _, err := m.emails()
+	if err != nil {
+		return nil, err
+	}
+
+	all := new(imap.SeqSet)
+	all.AddRange(1, 0)
+
+	var ids []uint32
+	for _, sel := range m.pick(false, all) {
+		email, ok := byID[sel.entry.id]
+		if !ok {
+			continue
+		}
+
+		entity := &message.Entity{}
+		if needsContent(criteria) {
+			raw, err := m.user.server.storage.GetRawEmail(email.ID)
+			if err != nil {
+				return nil, err
+			}
+			if entity, err = message.Read(bytes.NewReader(raw)); err != nil && !message.IsUnknownCharset(err) {
+				continue
+			}
+		}
+
+		ok, err := backendutil.Match(entity, sel.seqNum, uint32(email.ID), email.ReceivedAt, m.flags(email, sel.entry), criteria)
+		if err != nil || !ok {
+			continue
+		}
+
+		if uid {
+			ids = append(ids, uint32(email.ID))
+		} else {
+			ids = append(ids, sel.seqNum)
+		}
+	}
+	return ids, nil
+}
+
+// needsContent reports whether matching criteria reads email sources
+func needsContent(c *imap.SearchCriteria) bool {
+	if !c.SentBefore.IsZero() || !c.SentSince.IsZero() || len(c.Header) > 0 ||
+		len(c.Body) > 0 || len(c.Text) > 0 || c.Larger > 0 || c.Smaller > 0 {
+		return true
+	}
+	for _, not := range c.Not {
+		if needsContent(not) {
+			return true
+		}
+	}
+	for _, or := range c.Or {
+		if needsContent(or[0]) || needsContent(or[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// CreateMessage implements backend.Mailbox; mail arrives over SMTP or the
+// API, not APPEND
+func (m *mailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	return errors.New("APPEND is not supported, send mail over SMTP instead")
+}
+
+// UpdateMessagesFlags implements backend.Mailbox. \Seen and \Flagged are
+// stored as the read and pinned state of the email; \Deleted lasts until
+// EXPUNGE or the end of the session. Other flags are ignored.
+func (m *mailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, op imap.FlagsOp, flags []string) error {
+	store := m.user.server.storage
+	for _, sel := range m.pick(uid, seqSet) {
+		email, err := store.GetEmail(sel.entry.id)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		updated := backendutil.UpdateFlags(m.flags(email, sel.entry), op, flags)
+		read := contains(updated, imap.SeenFlag)
+		pinned := contains(updated, imap.FlaggedFlag)
+		if read != email.Read || pinned != email.Pinned {
+			if err := store.UpdateEmail(email.ID, &storage.EmailUpdate{Read: &read, Pinned: &pinned}); err != nil {
+				return err
+			}
+		}
+
+		m.mu.Lock()
+		sel.entry.deleted = contains(updated, imap.DeletedFlag)
+		m.mu.Unlock()
+	}
+	return nil
+}
+
+// CopyMessages implements backend.Mailbox. Copying to a tag folder tags
+// the emails; every other folder already lists them.
+func (m *mailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	tag, ok := strings.CutPrefix(dest, tagsRoot+delimiter)
+	if !ok {
+		_, err := m.user.GetMailbox(dest)
+		return err
+	}
+
+	picked := m.pick(uid, seqSet)
+	ids := make([]int64, len(picked))
+	for i, sel := range picked {
+		ids[i] = sel.entry.id
+	}
+	if _, err := m.user.server.storage.BatchEmails(ids, &storage.BatchOperation{
+		Action: storage.BatchTag,
+		Tags:   []string{tag},
+	}); err != nil {
+		return err
+	}
+
+	m.user.mu.Lock()
+	for _, id := range ids {
+		m.user.moved[id] = true
+	}
+	m.user.mu.Unlock()
+	return nil
+}
+
+// MoveMessages implements backend.MoveMailbox. The emails are copied to
+// dest, untagged if this is a tag folder, and hidden from this folder for
+// the rest of the session.
+func (m *mailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, dest string) error {
+	if dest == m.name {
+		return nil
+	}
+	if err := m.CopyMessages(uid, seqSet, dest); err != nil {
+		return err
+	}
+
+	picked := m.pick(uid, seqSet)
+	if len(picked) == 0 {
+		return nil
+	}
+	if m.tag != "" {
+		ids := make([]int64, len(picked))
+		for i, sel := range picked {
+			ids[i] = sel.entry.id
+		}
+		if _, err := m.user.server.storage.BatchEmails(ids, &storage.BatchOperation{
+			Action: storage.BatchUntag,
+			Tags:   []string{m.tag},
+		}); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	moved := make(map[*entry]bool, len(picked))
+	for _, sel := range picked {
+		moved[sel.entry] = true
+	}
+	kept := m.entries[:0]
+	for _, ent := range m.entries {
+		if !moved[ent] {
+			kept = append(kept, ent)
+		}
+	}
+	m.entries = kept
+	m.mu.Unlock()
+
+	// Expunged sequence numbers go from the last, as each shifts the next
+	seqNums := make(chan uint32, len(picked))
+	for i := len(picked) - 1; i >= 0; i-- {
+		seqNums <- picked[i].seqNum
+	}
+	close(seqNums)
+	m.user.server.respond(m, &responses.Expunge{SeqNums: seqNums})
+	return nil
+}
+
+// Expunge implements backend.Mailbox. In a tag folder it removes the tag;
+// elsewhere it deletes the emails, unless they were copied to a tag folder
+// in this session.
+func (m *mailbox) Expunge() error {
+	m.mu.Lock()
+	var expunged []int64
+	kept := m.entries[:0]
+	for _, ent := range m.entries {
+		if ent.deleted {
+			expunged = append(expunged, ent.id)
+		} else {
+			kept = append(kept, ent)
+		}
+	}
+	m.entries = kept
+	m.mu.Unlock()
+
+	if len(expunged) == 0 {
+		return nil
+	}
+
+	store := m.user.server.storage
+	if m.tag != "" {
+		_, err := store.BatchEmails(expunged, &storage.BatchOperation{
+			Action: storage.BatchUntag,
+			Tags:   []string{m.tag},
+		})
+		return err
+	}
+
+	m.user.mu.Lock()
+	var deleted []int64
+	for _, id := range expunged {
+		if !m.user.moved[id] {
+			deleted = append(deleted, id)
+		}
+	}
+	m.user.mu.Unlock()
+
+	if len(deleted) == 0 {
+		return nil
+	}
+	_, err := store.BatchEmails(deleted, &storage.BatchOperation{Action: storage.BatchDelete})
+	return err
+}
+
+// contains reports whether values holds value
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsFold reports whether values holds value, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
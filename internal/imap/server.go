@@ -0,0 +1,201 @@
+package imap
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/responses"
+	"github.com/emersion/go-imap/server"
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/access"
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// Server serves captured mail to mail clients over IMAP4rev1 (RFC 3501),
+// with IDLE so clients see new mail as it arrives
+type Server struct {
+	config  *config.IMAPConfig
+	storage storage.Storage
+	logger  zerolog.Logger
+	server  *server.Server
+
+	// listening is set while the listener is bound, and closing once
+	// Shutdown has been called
+	listening atomic.Bool
+	closing   atomic.Bool
+}
+
+// NewServer creates a new IMAP server for the emails in store
+func NewServer(cfg *config.IMAPConfig, store storage.Storage, logger zerolog.Logger) *Server {
+	s := &Server{
+		config:  cfg,
+		storage: store,
+		logger:  logger.With().Str("component", "imap").Logger(),
+	}
+
+	s.server = server.New(s)
+	s.server.Addr = fmt.Sprintf("%s:%d", cfg.Host, cfg.Port)
+	s.server.AllowInsecureAuth = true
+	s.server.AutoLogout = cfg.Timeout
+	s.server.ErrorLog = &errorLogger{logger: s.logger}
+
+	return s
+}
+
+// Start starts the IMAP server and serves until Shutdown is called
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts IMAP connections on l until Shutdown is called
+func (s *Server) Serve(l net.Listener) error {
+	// Refuse clients outside the access lists before anything else
+	l, err := access.Listener(l, &s.config.Access, s.logger)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info().
+		Str("addr", l.Addr().String()).
+		Bool("per_recipient", s.config.PerRecipient).
+		Msg("Starting IMAP server")
+
+	s.listening.Store(true)
+	defer s.listening.Store(false)
+
+	err = s.server.Serve(l)
+	if s.closing.Load() {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and closes every session. IMAP
+// clients reconnect on their own, so sessions are not drained.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.logger.Info().Msg("Shutting down IMAP server")
+
+	s.closing.Store(true)
+	s.listening.Store(false)
+	return s.server.Close()
+}
+
+// Ready returns an error unless the server is accepting connections
+func (s *Server) Ready(ctx context.Context) error {
+	if !s.listening.Load() {
+		return fmt.Errorf("not listening on %s", s.server.Addr)
+	}
+	return nil
+}
+
+// Login implements backend.Backend. With PerRecipient the user name is the
+// recipient address whose mail is shown.
+func (s *Server) Login(connInfo *imap.ConnInfo, username, password string) (backend.User, error) {
+	if !s.authenticate(username, password) {
+		s.logger.Warn().
+			Str("user", username).
+			Str("remote", connInfo.RemoteAddr.String()).
+			Msg("IMAP authentication failed")
+		return nil, backend.ErrInvalidCredentials
+	}
+
+	return &user{
+		server: s,
+		name:   username,
+		moved:  make(map[int64]bool),
+	}, nil
+}
+
+// authenticate checks the credentials given with LOGIN or AUTHENTICATE
+func (s *Server) authenticate(username, password string) bool {
+	if !s.config.PerRecipient && s.config.Username != "" &&
+		subtle.ConstantTimeCompare([]byte(username), []byte(s.config.Username)) != 1 {
+		return false
+	}
+	if s.config.Password != "" &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.config.Password)) != 1 {
+		return false
+	}
+	return true
+}
+
+// NotifyNewEmail announces a newly stored email to the sessions that have
+// a folder it belongs to selected, which IDLE clients show right away
+func (s *Server) NotifyNewEmail(email *storage.Email) {
+	s.server.ForEachConn(func(conn server.Conn) {
+		ctx := conn.Context()
+		mbox, ok := ctx.Mailbox.(*mailbox)
+		if !ok || !mbox.matches(email) {
+			return
+		}
+
+		status := mbox.add(email)
+		go func() {
+			select {
+			case ctx.Responses <- &responses.Select{Mailbox: status}:
+			case <-ctx.LoggedOut:
+			}
+		}()
+	})
+}
+
+// respond sends res to the session that has m selected, and waits until
+// it is written so that it precedes the reply to the running command
+func (s *Server) respond(m *mailbox, res imap.WriterTo) {
+	var ctx *server.Context
+	s.server.ForEachConn(func(conn server.Conn) {
+		if conn.Context().Mailbox == m {
+			ctx = conn.Context()
+		}
+	})
+	if ctx == nil {
+		return
+	}
+
+	written := &writtenResponse{WriterTo: res, done: make(chan struct{})}
+	select {
+	case ctx.Responses <- written:
+		<-written.done
+	case <-ctx.LoggedOut:
+	}
+}
+
+// writtenResponse is a response that signals once it has been written
+type writtenResponse struct {
+	imap.WriterTo
+	done chan struct{}
+}
+
+func (r *writtenResponse) WriteTo(w *imap.Writer) error {
+	defer close(r.done)
+	return r.WriterTo.WriteTo(w)
+}
+
+// errorLogger passes errors of the IMAP library to the server's logger
+type errorLogger struct {
+	logger zerolog.Logger
+}
+
+func (l *errorLogger) Printf(format string, v ...interface{}) {
+	l.logger.Error().Msg(fmt.Sprintf(format, v...))
+}
+
+func (l *errorLogger) Println(v ...interface{}) {
+	l.logger.Error().Msg(fmt.Sprint(v...))
+}
+
+// errReadOnly is returned for commands that would change folders, which
+// follow the recipients and tags of the stored emails
+var errReadOnly = errors.New("folders cannot be changed over IMAP")
@@ -0,0 +1,211 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/email"
+	"gowebmail/internal/mailauth"
+	"gowebmail/internal/mailcrypt"
+	"gowebmail/internal/quota"
+	"gowebmail/internal/spam"
+	"gowebmail/internal/storage"
+)
+
+// ErrInvalidMessage is wrapped by the errors of messages that cannot be
+// parsed
+var ErrInvalidMessage = errors.New("invalid message")
+
+// Envelope describes how a message reached gowebmail
+type Envelope struct {
+	Source string   // e.g. "smtp" or "import", for logging
+	From   string   // MAIL FROM
+	To     []string // RCPT TO; empty if the envelope is unknown
+
+	// RemoteIP and Helo identify the SMTP client, for SPF; RemoteIP is nil
+	// for mail that did not arrive over SMTP
+	RemoteIP net.IP
+	Helo     string
+
+	// User is the SMTP AUTH user name, if the client authenticated
+	User string
+
+	// ReceivedAt defaults to the time of delivery
+	ReceivedAt time.Time
+}
+
+// Pipeline parses, checks, stores and announces incoming messages. Every
+// way of getting mail into gowebmail goes through it, so they all behave
+// the same.
+//
+// Deliver only does what decides whether a message is accepted, and saves
+// it with a job. Workers started by Start then run the checks that may be
+// slow and announce the email, so that a slow spam filter or DNS server
+// never holds up the SMTP client.
+type Pipeline struct {
+	storage   storage.Storage
+	parser    *email.Parser
+	logger    zerolog.Logger
+	config    config.ProcessingConfig
+	quota     *quota.Enforcer
+	spam      *spam.Checker
+	auth      *mailauth.Verifier
+	crypt     *mailcrypt.Processor
+	onNewMail func(*storage.Email)
+	onDeleted func(id int64)
+
+	// wake tells the workers that a job was queued
+	wake   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewPipeline creates a new ingest pipeline, whose jobs are processed as
+// cfg describes
+func NewPipeline(store storage.Storage, cfg *config.ProcessingConfig, logger zerolog.Logger) *Pipeline {
+	return &Pipeline{
+		storage: store,
+		parser:  email.NewParser(),
+		logger:  logger,
+		config:  *cfg,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+// SetNewMailCallback sets the callback that announces new emails. Workers
+// call it once the checks of an email are done.
+func (p *Pipeline) SetNewMailCallback(callback func(*storage.Email)) {
+	p.onNewMail = callback
+}
+
+// SetDeletedMailCallback sets the callback that announces the emails
+// evicted to make room under a mailbox quota, as deletions
+func (p *Pipeline) SetDeletedMailCallback(callback func(id int64)) {
+	p.onDeleted = callback
+}
+
+// SetQuotaEnforcer sets the enforcer that checks mailbox quotas before
+// emails are saved
+func (p *Pipeline) SetQuotaEnforcer(enforcer *quota.Enforcer) {
+	p.quota = enforcer
+}
+
+// SetSpamChecker sets the checker that scores emails after they are
+// saved
+func (p *Pipeline) SetSpamChecker(checker *spam.Checker) {
+	p.spam = checker
+}
+
+// SetAuthVerifier sets the verifier that checks DKIM, SPF and DMARC after
+// emails are saved
+func (p *Pipeline) SetAuthVerifier(verifier *mailauth.Verifier) {
+	p.auth = verifier
+}
+
+// SetCryptProcessor sets the processor that detects signed and encrypted
+// emails, and decrypts them, before they are saved
+func (p *Pipeline) SetCryptProcessor(processor *mailcrypt.Processor) {
+	p.crypt = processor
+}
+
+// Deliver parses the raw message read from r and stores it. Messages that
+// cannot be parsed return an error wrapping ErrInvalidMessage, and those
+// that do not fit a mailbox quota one wrapping quota.ErrQuotaExceeded.
+func (p *Pipeline) Deliver(r io.Reader, env *Envelope) (*storage.Email, error) {
+	// Parse email
+	email, err := p.parser.Parse(r)
+	if err != nil {
+		if recordErr := p.storage.RecordParseFailure(env.Source, err); recordErr != nil {
+			p.logger.Error().Err(recordErr).Msg("Failed to record parse failure")
+		}
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMessage, err)
+	}
+	// Large attachments are spooled to temporary files until stored
+	defer p.parser.Release(email)
+
+	// Decrypted content is stored in place of the encrypted one, so that
+	// it can be read and searched
+	if p.crypt != nil {
+		p.crypt.Process(email, p.parser)
+	}
+
+	// Keep the envelope, which is the only record of BCC recipients. When
+	// it is unknown, the header addresses stand in for it. As the final
+	// destination, gowebmail takes the return path from the envelope
+	// rather than from any Return-Path header.
+	if len(env.To) > 0 {
+		email.EnvelopeFrom = env.From
+		email.EnvelopeTo = append([]string(nil), env.To...)
+		email.ReturnPath = env.From
+	} else {
+		email.EnvelopeFrom = email.From
+		email.EnvelopeTo = append(append(append([]string(nil), email.To...), email.CC...), email.BCC...)
+	}
+
+	// Set envelope data if not present in headers
+	if email.From == "" {
+		email.From = env.From
+	}
+	if len(email.To) == 0 {
+		email.To = env.To
+	}
+
+	email.ReceivedAt = env.ReceivedAt
+	if email.ReceivedAt.IsZero() {
+		email.ReceivedAt = time.Now()
+	}
+
+	// Enforce mailbox quotas
+	if p.quota != nil {
+		evicted, err := p.quota.Enforce(email)
+		if p.onDeleted != nil {
+			for _, id := range evicted {
+				p.onDeleted(id)
+			}
+		}
+		if err != nil {
+			if errors.Is(err, quota.ErrQuotaExceeded) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("failed to enforce mailbox quota: %w", err)
+		}
+	}
+
+	// Save to storage, with the job that checks and announces the email.
+	// DKIM, SPF and DMARC are verified against the real MAIL FROM.
+	email.Job = &storage.Job{MailFrom: env.From, Helo: env.Helo}
+	if env.RemoteIP != nil {
+		email.Job.RemoteIP = env.RemoteIP.String()
+	}
+	id, err := p.storage.SaveEmail(email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save email: %w", err)
+	}
+
+	email.ID = id
+
+	p.logger.Info().
+		Str("source", env.Source).
+		Int64("id", id).
+		Str("from", email.From).
+		Strs("to", email.To).
+		Str("subject", email.Subject).
+		Int64("size", email.Size).
+		Msg("Email received and saved")
+
+	// Wake a worker, unless one is already due to look
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+
+	return email, nil
+}
@@ -0,0 +1,158 @@
+package ingest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"gowebmail/internal/storage"
+)
+
+const (
+	// jobLease is how long a claimed job is left to its worker before it
+	// is claimed again
+	jobLease = 5 * time.Minute
+	// jobPollInterval is how often workers look for jobs due for a retry
+	jobPollInterval = time.Second
+)
+
+// Start starts the workers that check and announce saved emails. Jobs left
+// by the last run, such as those of a crash, are resumed.
+func (p *Pipeline) Start() {
+	if err := p.storage.ResumeJobs(); err != nil {
+		p.logger.Error().Err(err).Msg("Failed to resume jobs")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	jobs := make(chan *storage.Job)
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.dispatch(ctx, jobs)
+	}()
+	for range p.config.Workers {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range jobs {
+				p.process(job)
+			}
+		}()
+	}
+}
+
+// Stop stops the workers, waiting for the jobs in progress. The others
+// stay queued for the next start.
+func (p *Pipeline) Stop() {
+	if p.cancel == nil {
+		return
+	}
+	p.cancel()
+	p.wg.Wait()
+}
+
+// dispatch claims the jobs that are due and hands them to the workers,
+// until ctx is done
+func (p *Pipeline) dispatch(ctx context.Context, jobs chan<- *storage.Job) {
+	defer close(jobs)
+	ticker := time.NewTicker(jobPollInterval)
+	defer ticker.Stop()
+
+	for {
+		claimed, err := p.storage.ClaimJobs(p.config.Workers, jobLease)
+		if err != nil {
+			p.logger.Error().Err(err).Msg("Failed to claim jobs")
+		}
+		for _, job := range claimed {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+		// More may be due already
+		if len(claimed) == p.config.Workers {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// process runs the checks of a saved email and announces it. Checks that
+// fail are retried later, and given up after the last attempt: a failing
+// spam filter never loses mail.
+func (p *Pipeline) process(job *storage.Job) {
+	email, err := p.storage.GetEmail(job.EmailID)
+	if err == storage.ErrNotFound {
+		// Deleted in the meantime, and its job with it
+		return
+	}
+	if err == nil {
+		err = p.check(email, job)
+	}
+	if err != nil {
+		if job.Attempts < p.config.MaxAttempts {
+			p.retry(job, err)
+			return
+		}
+		p.logger.Warn().Err(err).Int64("id", job.EmailID).Int("attempts", job.Attempts).Msg("Giving up on checks of email")
+	}
+
+	if err := p.storage.DeleteJob(job.ID); err != nil && err != storage.ErrNotFound {
+		p.logger.Error().Err(err).Int64("job", job.ID).Msg("Failed to delete job")
+	}
+	if email != nil && p.onNewMail != nil {
+		p.onNewMail(email)
+	}
+}
+
+// check runs the checks not yet done on an email, and saves their results.
+// Those that succeed are saved even when another fails, so that a retry
+// does not repeat them.
+func (p *Pipeline) check(email *storage.Email, job *storage.Job) error {
+	verify := p.auth != nil && email.Auth == nil
+	score := p.spam != nil && email.Spam == nil
+	if !verify && !score {
+		return nil
+	}
+
+	raw, err := p.storage.GetRawEmail(email.ID)
+	if err != nil {
+		return fmt.Errorf("failed to read email: %w", err)
+	}
+
+	if verify {
+		email.Auth = p.auth.Verify(raw, net.ParseIP(job.RemoteIP), job.Helo, job.MailFrom)
+	}
+	var spamErr error
+	if score {
+		email.Spam, spamErr = p.spam.Check(raw, email.EnvelopeFrom, email.EnvelopeTo)
+		if spamErr != nil {
+			spamErr = fmt.Errorf("spam check failed: %w", spamErr)
+		}
+	}
+
+	if err := p.storage.SetEmailChecks(email.ID, email.Spam, email.Auth); err != nil {
+		return fmt.Errorf("failed to save checks: %w", err)
+	}
+	return spamErr
+}
+
+// retry queues a failed job again, after the retry delay doubled for
+// every attempt before, up to a day
+func (p *Pipeline) retry(job *storage.Job, reason error) {
+	delay := min(p.config.RetryDelay<<min(job.Attempts-1, 16), 24*time.Hour)
+	p.logger.Warn().Err(reason).Int64("id", job.EmailID).Int("attempt", job.Attempts).Dur("retry_in", delay).Msg("Email processing failed")
+	if err := p.storage.RetryJob(job.ID, time.Now().Add(delay), reason.Error()); err != nil && err != storage.ErrNotFound {
+		p.logger.Error().Err(err).Int64("job", job.ID).Msg("Failed to queue job for retry")
+	}
+}
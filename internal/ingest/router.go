@@ -0,0 +1,130 @@
+package ingest
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// Deliverer stores incoming messages. A Pipeline stores them in one
+// namespace, a Router in the namespaces they are routed to.
+type Deliverer interface {
+	Deliver(r io.Reader, env *Envelope) (*storage.Email, error)
+}
+
+// Route is a namespace a Router delivers to
+type Route struct {
+	Namespace *config.NamespaceConfig
+	Pipeline  *Pipeline
+}
+
+// Router delivers messages to namespaces: to the namespace of the SMTP
+// AUTH user if there is one, otherwise to the namespaces of the
+// recipients. Recipients routed to no namespace go to the default
+// pipeline.
+type Router struct {
+	fallback *Pipeline
+	routes   []Route
+	logger   zerolog.Logger
+}
+
+// NewRouter creates a router that delivers to routes, and to fallback the
+// mail routed to none of them
+func NewRouter(fallback *Pipeline, routes []Route, logger zerolog.Logger) *Router {
+	return &Router{
+		fallback: fallback,
+		routes:   routes,
+		logger:   logger,
+	}
+}
+
+// delivery is a message's delivery to one pipeline, with the recipients
+// routed there
+type delivery struct {
+	name     string
+	pipeline *Pipeline
+	to       []string
+}
+
+// route returns the deliveries of a message, the default one last
+func (rt *Router) route(env *Envelope) []*delivery {
+	if env.User != "" {
+		for _, route := range rt.routes {
+			for _, user := range route.Namespace.SMTPUsers {
+				if user == env.User {
+					return []*delivery{{name: route.Namespace.Name, pipeline: route.Pipeline, to: env.To}}
+				}
+			}
+		}
+	}
+
+	var deliveries []*delivery
+	fallback := &delivery{pipeline: rt.fallback}
+	byName := make(map[string]*delivery)
+	for _, to := range env.To {
+		d := fallback
+		for _, route := range rt.routes {
+			if !route.Namespace.MatchRecipient(to) {
+				continue
+			}
+			if d = byName[route.Namespace.Name]; d == nil {
+				d = &delivery{name: route.Namespace.Name, pipeline: route.Pipeline}
+				byName[d.name] = d
+				deliveries = append(deliveries, d)
+			}
+			break
+		}
+		d.to = append(d.to, to)
+	}
+	if len(fallback.to) > 0 || len(deliveries) == 0 {
+		deliveries = append(deliveries, fallback)
+	}
+	return deliveries
+}
+
+// Deliver implements Deliverer. Each namespace sees only the recipients
+// routed to it in the envelope. It returns the first email stored, and the
+// errors of every delivery that failed.
+func (rt *Router) Deliver(r io.Reader, env *Envelope) (*storage.Email, error) {
+	deliveries := rt.route(env)
+	if len(deliveries) == 1 && deliveries[0].pipeline == rt.fallback {
+		return rt.fallback.Deliver(r, env)
+	}
+
+	// Each namespace reads the message from a temporary file rather than
+	// from memory
+	spool, err := os.CreateTemp("", "gowebmail-route-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var first *storage.Email
+	var errs []error
+	for _, d := range deliveries {
+		routed := *env
+		routed.To = d.to
+		stored, err := d.pipeline.Deliver(io.NewSectionReader(spool, 0, size), &routed)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if d.name != "" {
+			rt.logger.Debug().Str("namespace", d.name).Strs("to", d.to).Int64("id", stored.ID).Msg("Email routed to namespace")
+		}
+		if first == nil {
+			first = stored
+		}
+	}
+	return first, errors.Join(errs...)
+}
@@ -0,0 +1,267 @@
+package linkcheck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+// Link statuses
+const (
+	StatusOK     = "ok"     // the final response was 2xx
+	StatusBroken = "broken" // the final response was 4xx or 5xx
+	StatusError  = "error"  // no final response, e.g. a timeout
+)
+
+// errPrivateAddress is returned for links to blocked addresses
+var errPrivateAddress = errors.New("address is private and block_private is set")
+
+// Result is the outcome of checking one link
+type Result struct {
+	URL        string     `json:"url"`
+	Status     string     `json:"status"`
+	StatusCode int        `json:"statusCode,omitempty"` // of the final response
+	FinalURL   string     `json:"finalUrl,omitempty"`   // set when redirected
+	Redirects  []Redirect `json:"redirects,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	DurationMs int64      `json:"durationMs"`
+}
+
+// Redirect is a redirect response on the way to the final URL
+type Redirect struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"statusCode"`
+	Location   string `json:"location"`
+}
+
+// Checker fetches links and records their status codes and redirect
+// chains
+type Checker struct {
+	config *config.LinkCheckConfig
+	client *http.Client
+	logger zerolog.Logger
+}
+
+// NewChecker creates a new link checker
+func NewChecker(cfg *config.LinkCheckConfig, logger zerolog.Logger) *Checker {
+	dialer := &net.Dialer{Timeout: cfg.Timeout}
+	if cfg.BlockPrivate {
+		// Checked after name resolution, so DNS cannot point around it
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivate(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.Proxy = nil
+
+	return &Checker{
+		config: cfg,
+		client: &http.Client{
+			Transport: transport,
+			// Redirects are followed by hand to record them
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		logger: logger.With().Str("component", "linkcheck").Logger(),
+	}
+}
+
+// Check fetches every URL, up to max_links, and returns the results in the
+// same order
+func (c *Checker) Check(ctx context.Context, urls []string) []*Result {
+	if c.config.MaxLinks > 0 && len(urls) > c.config.MaxLinks {
+		urls = urls[:c.config.MaxLinks]
+	}
+
+	concurrency := c.config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	results := make([]*Result, len(urls))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			results[i] = c.checkLink(ctx, u)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// checkLink follows the redirects of one link
+func (c *Checker) checkLink(ctx context.Context, link string) *Result {
+	start := time.Now()
+	result := &Result{URL: link}
+	defer func() { result.DurationMs = time.Since(start).Milliseconds() }()
+
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
+	}
+
+	current := link
+	for {
+		resp, err := c.fetch(ctx, current)
+		if err != nil {
+			result.Status, result.Error = StatusError, errorMessage(err)
+			return result
+		}
+
+		location := resp.Header.Get("Location")
+		if resp.StatusCode < 300 || resp.StatusCode >= 400 || location == "" {
+			result.StatusCode = resp.StatusCode
+			result.Status = StatusOK
+			if resp.StatusCode >= 400 {
+				result.Status = StatusBroken
+			}
+			if current != link {
+				result.FinalURL = current
+			}
+			return result
+		}
+
+		next, err := resolveLocation(current, location)
+		if err != nil {
+			result.Status, result.Error = StatusError, "invalid redirect location "+location
+			return result
+		}
+		result.Redirects = append(result.Redirects, Redirect{URL: current, StatusCode: resp.StatusCode, Location: next})
+		if len(result.Redirects) > c.config.MaxRedirects {
+			result.Status = StatusError
+			result.Error = fmt.Sprintf("more than %d redirects", c.config.MaxRedirects)
+			return result
+		}
+		current = next
+	}
+}
+
+// OneClick sends the one-click unsubscribe request of RFC 8058 to link, as
+// mailbox providers do: a POST of List-Unsubscribe=One-Click, without
+// cookies. Redirects are not followed; a redirect is recorded as broken.
+func (c *Checker) OneClick(ctx context.Context, link string) *Result {
+	start := time.Now()
+	result := &Result{URL: link}
+	defer func() { result.DurationMs = time.Since(start).Milliseconds() }()
+
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", link, strings.NewReader("List-Unsubscribe=One-Click"))
+	if err != nil {
+		result.Status, result.Error = StatusError, err.Error()
+		return result
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", c.config.UserAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		result.Status, result.Error = StatusError, errorMessage(err)
+		return result
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	result.Status = StatusOK
+	if resp.StatusCode >= 300 {
+		result.Status = StatusBroken
+	}
+	if location := resp.Header.Get("Location"); location != "" && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		result.Error = "redirected to " + location
+	}
+	return result
+}
+
+// fetch requests a URL with HEAD, falling back to GET for servers that do
+// not handle HEAD properly
+func (c *Checker) fetch(ctx context.Context, u string) (*http.Response, error) {
+	resp, err := c.do(ctx, "HEAD", u)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented || resp.StatusCode == http.StatusForbidden) {
+		resp, err = c.do(ctx, "GET", u)
+	}
+	return resp, err
+}
+
+func (c *Checker) do(ctx context.Context, method, u string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", c.config.UserAgent)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	// Only the status and headers are needed
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	return resp, nil
+}
+
+// resolveLocation resolves a Location header against the URL that sent it
+func resolveLocation(base, location string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	l, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	resolved := b.ResolveReference(l)
+	if resolved.Scheme != "http" && resolved.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme %s", resolved.Scheme)
+	}
+	return resolved.String(), nil
+}
+
+// errorMessage shortens common network errors
+func errorMessage(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if urlErr.Timeout() {
+			return "timeout"
+		}
+		err = urlErr.Err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "timeout"
+	}
+	return err.Error()
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
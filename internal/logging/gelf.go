@@ -0,0 +1,114 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	"gowebmail/internal/config"
+)
+
+// GELF over UDP splits messages larger than gelfChunkSize into at most
+// gelfMaxChunks chunks
+const (
+	gelfChunkSize = 1420
+	gelfMaxChunks = 128
+)
+
+// gelfInvalidName matches the characters not allowed in additional field
+// names
+var gelfInvalidName = regexp.MustCompile(`[^\w.\-]`)
+
+// GELFWriter sends log lines to a Graylog GELF input, with the fields of
+// each line as additional fields
+type GELFWriter struct {
+	w      *netWriter
+	host   string
+	fields map[string]interface{}
+}
+
+// NewGELFWriter creates a writer for the input described by cfg. It
+// connects on the first line written.
+func NewGELFWriter(cfg *config.GELFConfig) *GELFWriter {
+	host := cfg.Host
+	if host == "" {
+		host = hostname()
+	}
+	fields := make(map[string]interface{}, len(cfg.Fields))
+	for name, value := range cfg.Fields {
+		fields[name] = value
+	}
+	return &GELFWriter{
+		w:      &netWriter{name: "GELF " + cfg.Address, network: cfg.Network, address: cfg.Address},
+		host:   host,
+		fields: fields,
+	}
+}
+
+// Write sends one log line written by zerolog. It never fails: lines that
+// cannot be sent are dropped.
+func (g *GELFWriter) Write(p []byte) (int, error) {
+	e := parseEntry(p)
+
+	message := map[string]interface{}{
+		"version":       "1.1",
+		"host":          g.host,
+		"short_message": e.message,
+		"timestamp":     float64(e.time.UnixMicro()) / 1e6,
+		"level":         severity(e.level),
+	}
+	if e.message == "" {
+		message["short_message"] = "-"
+	}
+	for _, fields := range []map[string]interface{}{g.fields, e.fields} {
+		for name, value := range fields {
+			name = "_" + gelfInvalidName.ReplaceAllString(name, "_")
+			if name == "_id" {
+				name = "_id_" // reserved by Graylog
+			}
+			if _, ok := value.(json.Number); !ok {
+				value = fieldString(value) // only strings and numbers are allowed
+			}
+			message[name] = value
+		}
+	}
+
+	body, err := json.Marshal(message)
+	if err != nil {
+		return len(p), nil
+	}
+
+	if g.w.network == "udp" {
+		g.writeChunked(body)
+	} else {
+		g.w.write(append(body, 0)) // null byte delimited
+	}
+	return len(p), nil
+}
+
+// writeChunked sends a message over UDP, in chunks if it does not fit in
+// one datagram
+func (g *GELFWriter) writeChunked(body []byte) {
+	if len(body) <= gelfChunkSize {
+		g.w.write(body)
+		return
+	}
+
+	const payload = gelfChunkSize - 12 // chunk header size
+	count := (len(body) + payload - 1) / payload
+	if count > gelfMaxChunks {
+		fmt.Fprintf(os.Stderr, "gowebmail: GELF message of %d bytes is too large for UDP, dropped\n", len(body))
+		return
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+	for i := 0; i < count; i++ {
+		chunk := body[i*payload : min((i+1)*payload, len(body))]
+		datagram := append([]byte{0x1e, 0x0f}, id...)
+		datagram = append(datagram, byte(i), byte(count))
+		g.w.write(append(datagram, chunk...))
+	}
+}
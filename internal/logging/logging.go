@@ -0,0 +1,192 @@
+// Package logging sends the log to syslog daemons and Graylog, alongside
+// the stdout or file output
+package logging
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// writeTimeout bounds each write, so a stuck log server cannot hold up
+// the goroutines that log
+const writeTimeout = 2 * time.Second
+
+// retryDelay is how long lines are dropped after a log server could not
+// be reached, before dialing it again
+const retryDelay = 5 * time.Second
+
+// errServerDown is returned for lines dropped while waiting to redial
+var errServerDown = errors.New("log server unreachable")
+
+// localSyslogPaths are where syslog daemons listen on the local host
+var localSyslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// netWriter is a connection to a log server, dialed on the first write and
+// again after it breaks. Lines that cannot be sent are dropped; the outage
+// is reported once on stderr.
+type netWriter struct {
+	name    string // for messages on stderr
+	network string // udp, tcp or tls; empty for the local syslog daemon
+	address string
+
+	mu      sync.Mutex
+	conn    net.Conn
+	retryAt time.Time
+	down    bool
+}
+
+// write sends p, in one datagram over UDP
+func (w *netWriter) write(p []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if w.conn == nil {
+			if time.Now().Before(w.retryAt) {
+				return
+			}
+			if w.conn, err = w.dial(); err != nil {
+				w.conn = nil
+				w.retryAt = time.Now().Add(retryDelay)
+				break
+			}
+		}
+
+		w.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if _, err = w.conn.Write(p); err == nil {
+			if w.down {
+				w.down = false
+				fmt.Fprintf(os.Stderr, "gowebmail: %s reachable again\n", w.name)
+			}
+			return
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+
+	if !w.down {
+		w.down = true
+		fmt.Fprintf(os.Stderr, "gowebmail: %s: %v; dropping log lines until it recovers\n", w.name, err)
+	}
+}
+
+// dial connects to the server, or to the local syslog daemon
+func (w *netWriter) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: writeTimeout}
+	switch w.network {
+	case "":
+		err := errServerDown
+		for _, path := range localSyslogPaths {
+			for _, network := range []string{"unixgram", "unix"} {
+				var conn net.Conn
+				if conn, err = dialer.Dial(network, path); err == nil {
+					return conn, nil
+				}
+			}
+		}
+		return nil, err
+	case "tls":
+		host, _, _ := net.SplitHostPort(w.address)
+		return tls.DialWithDialer(dialer, "tcp", w.address, &tls.Config{ServerName: host})
+	default:
+		return dialer.Dial(w.network, w.address)
+	}
+}
+
+// entry is a log line written by zerolog as JSON
+type entry struct {
+	time    time.Time
+	level   zerolog.Level
+	message string
+	fields  map[string]interface{} // the other fields
+}
+
+// parseEntry decodes a log line. Lines that are not JSON objects are kept
+// as the message.
+func parseEntry(p []byte) *entry {
+	e := &entry{time: time.Now(), level: zerolog.NoLevel}
+
+	d := json.NewDecoder(bytes.NewReader(p))
+	d.UseNumber()
+	if err := d.Decode(&e.fields); err != nil {
+		e.message = string(bytes.TrimSpace(p))
+		e.fields = nil
+		return e
+	}
+
+	if s, ok := e.fields[zerolog.LevelFieldName].(string); ok {
+		if level, err := zerolog.ParseLevel(s); err == nil {
+			e.level = level
+		}
+		delete(e.fields, zerolog.LevelFieldName)
+	}
+	if s, ok := e.fields[zerolog.MessageFieldName].(string); ok {
+		e.message = s
+		delete(e.fields, zerolog.MessageFieldName)
+	}
+	if s, ok := e.fields[zerolog.TimestampFieldName].(string); ok {
+		if t, err := time.Parse(zerolog.TimeFieldFormat, s); err == nil {
+			e.time = t
+		}
+		delete(e.fields, zerolog.TimestampFieldName)
+	}
+	return e
+}
+
+// names returns the names of the fields, sorted
+func (e *entry) names() []string {
+	names := make([]string, 0, len(e.fields))
+	for name := range e.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// severity returns the syslog severity of a level, which GELF uses too
+func severity(level zerolog.Level) int {
+	switch level {
+	case zerolog.PanicLevel:
+		return 1 // alert
+	case zerolog.FatalLevel:
+		return 2 // critical
+	case zerolog.ErrorLevel:
+		return 3
+	case zerolog.WarnLevel:
+		return 4
+	case zerolog.DebugLevel, zerolog.TraceLevel:
+		return 7
+	default:
+		return 6 // informational
+	}
+}
+
+// fieldString formats a field value: strings as they are, anything else
+// as JSON
+func fieldString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// hostname returns the name of the host, or - if it is unknown
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		return "-"
+	}
+	return name
+}
@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowebmail/internal/config"
+)
+
+// sdID names the structured data element holding the fields of a line.
+// 32473 is the enterprise number RFC 5612 reserves for examples, used
+// by software without one of its own.
+const sdID = "gowebmail@32473"
+
+// SyslogWriter sends log lines to a syslog daemon. The local daemon gets
+// the traditional format it parses best, with the fields appended to the
+// message as key=value pairs; remote daemons get RFC 5424 messages with
+// the fields as structured data.
+type SyslogWriter struct {
+	w        *netWriter
+	facility int
+	tag      string
+	hostname string
+	pid      int
+}
+
+// NewSyslogWriter creates a writer for the daemon described by cfg. It
+// connects on the first line written.
+func NewSyslogWriter(cfg *config.SyslogConfig) *SyslogWriter {
+	name := "local syslog"
+	if cfg.Network != "" {
+		name = "syslog " + cfg.Address
+	}
+	tag := cfg.Tag
+	if tag == "" {
+		tag = "gowebmail"
+	}
+	return &SyslogWriter{
+		w:        &netWriter{name: name, network: cfg.Network, address: cfg.Address},
+		facility: config.SyslogFacilities[cfg.Facility],
+		tag:      tag,
+		hostname: hostname(),
+		pid:      os.Getpid(),
+	}
+}
+
+// Write sends one log line written by zerolog. It never fails: lines that
+// cannot be sent are dropped.
+func (s *SyslogWriter) Write(p []byte) (int, error) {
+	e := parseEntry(p)
+	priority := s.facility*8 + severity(e.level)
+
+	var msg string
+	switch s.w.network {
+	case "":
+		msg = fmt.Sprintf("<%d>%s %s[%d]: %s", priority, e.time.Format(time.Stamp), s.tag, s.pid, s.text(e))
+	case "udp":
+		msg = s.rfc5424(priority, e)
+	default:
+		// Octet counting framing, RFC 6587
+		msg = s.rfc5424(priority, e)
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	s.w.write([]byte(msg))
+	return len(p), nil
+}
+
+// text formats the message and fields of a line for the local daemon
+func (s *SyslogWriter) text(e *entry) string {
+	var b strings.Builder
+	b.WriteString(e.message)
+	for _, name := range e.names() {
+		value := fieldString(e.fields[name])
+		if strings.ContainsAny(value, " \"=") || value == "" {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(" " + name + "=" + value)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// rfc5424 formats a line as an RFC 5424 message
+func (s *SyslogWriter) rfc5424(priority int, e *entry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d - ", priority, e.time.Format(time.RFC3339Nano), s.hostname, s.tag, s.pid)
+
+	if len(e.fields) == 0 {
+		b.WriteString("-")
+	} else {
+		b.WriteString("[" + sdID)
+		for _, name := range e.names() {
+			b.WriteString(" " + sdName(name) + `="` + sdEscape(fieldString(e.fields[name])) + `"`)
+		}
+		b.WriteString("]")
+	}
+
+	if e.message != "" {
+		b.WriteString(" " + e.message)
+	}
+	return b.String()
+}
+
+// sdName makes a field name a valid SD-NAME: at most 32 printable ASCII
+// characters other than =, space, ] and "
+func sdName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
+
+// sdEscape escapes a PARAM-VALUE
+func sdEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
@@ -0,0 +1,332 @@
+package mailauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256" // for crypto.SHA256
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowebmail/internal/storage"
+)
+
+// verifyDKIM verifies every DKIM-Signature field (RFC 6376)
+func (v *Verifier) verifyDKIM(ctx context.Context, fields []headerField, body string) []storage.DKIMResult {
+	results := []storage.DKIMResult{}
+	for i := range fields {
+		if !strings.EqualFold(fields[i].name, "DKIM-Signature") {
+			continue
+		}
+
+		result := storage.DKIMResult{Result: ResultPass}
+		if err := v.verifySignature(ctx, fields, &fields[i], body, &result); err != nil {
+			result.Result, result.Reason = ResultTempError, err.Error()
+			var resultErr *resultError
+			if errors.As(err, &resultErr) {
+				result.Result = resultErr.result
+			}
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// verifySignature verifies one signature, filling in result as far as the
+// signature could be parsed
+func (v *Verifier) verifySignature(ctx context.Context, fields []headerField, sig *headerField, body string, result *storage.DKIMResult) error {
+	tags, err := parseTags(sig.value())
+	if err != nil {
+		return permError("%v", err)
+	}
+	result.Domain = strings.ToLower(tags["d"])
+	result.Selector = tags["s"]
+	result.Algorithm = tags["a"]
+	for _, name := range strings.Split(tags["h"], ":") {
+		if name = strings.TrimSpace(name); name != "" {
+			result.Headers = append(result.Headers, name)
+		}
+	}
+
+	for _, tag := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return permError("missing %s= tag", tag)
+		}
+	}
+	if tags["v"] != "1" {
+		return permError("unsupported version %s", tags["v"])
+	}
+	signsFrom := false
+	for _, name := range result.Headers {
+		signsFrom = signsFrom || strings.EqualFold(name, "From")
+	}
+	if !signsFrom {
+		return permError("From is not signed")
+	}
+	if x := tags["x"]; x != "" {
+		expires, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return permError("invalid x= tag")
+		}
+		if time.Now().Unix() > expires {
+			return permError("signature expired")
+		}
+	}
+
+	var keyType string
+	var hashFunc crypto.Hash
+	switch strings.ToLower(result.Algorithm) {
+	case "rsa-sha256":
+		keyType, hashFunc = "rsa", crypto.SHA256
+	case "ed25519-sha256":
+		keyType, hashFunc = "ed25519", crypto.SHA256
+	case "rsa-sha1":
+		return permError("rsa-sha1 signatures are not accepted (RFC 8301)")
+	default:
+		return permError("unsupported algorithm %s", result.Algorithm)
+	}
+
+	headerCanon, bodyCanon, err := parseCanonicalization(tags["c"])
+	if err != nil {
+		return err
+	}
+
+	// Body hash
+	canonical := canonicalBody(body, bodyCanon == "relaxed")
+	if l := tags["l"]; l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(canonical) {
+			return permError("invalid l= tag")
+		}
+		canonical = canonical[:n]
+	}
+	bodyHash, err := base64.StdEncoding.DecodeString(stripSpace(tags["bh"]))
+	if err != nil {
+		return permError("invalid bh= tag")
+	}
+	h := hashFunc.New()
+	h.Write([]byte(canonical))
+	if subtle.ConstantTimeCompare(h.Sum(nil), bodyHash) != 1 {
+		return failError("body hash does not match")
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(stripSpace(tags["b"]))
+	if err != nil {
+		return permError("invalid b= tag")
+	}
+	key, err := v.lookupDKIMKey(ctx, result.Selector, result.Domain, keyType)
+	if err != nil {
+		return err
+	}
+
+	// Header hash over the signed fields and the signature itself with
+	// an empty b= tag
+	h = hashFunc.New()
+	writeSignedHeaders(h, fields, result.Headers, headerCanon == "relaxed")
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(removeSignature(sig.raw), headerCanon == "relaxed"), "\r\n")))
+	hashed := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, hashFunc, hashed, signature); err != nil {
+			return failError("signature does not verify")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, hashed, signature) {
+			return failError("signature does not verify")
+		}
+	}
+	return nil
+}
+
+// lookupDKIMKey fetches the public key of a selector
+func (v *Verifier) lookupDKIMKey(ctx context.Context, selector, domain, keyType string) (crypto.PublicKey, error) {
+	name := selector + "._domainkey." + domain
+	records, err := v.resolver.lookupTXT(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("key lookup failed: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, permError("no key at %s", name)
+	}
+
+	tags, err := parseTags(records[0])
+	if err != nil {
+		return nil, permError("invalid key record: %v", err)
+	}
+	if version, ok := tags["v"]; ok && version != "DKIM1" {
+		return nil, permError("invalid key record version %s", version)
+	}
+	k := tags["k"]
+	if k == "" {
+		k = "rsa"
+	}
+	if k != keyType {
+		return nil, permError("key type %s does not match the algorithm", k)
+	}
+	p := stripSpace(tags["p"])
+	if p == "" {
+		return nil, permError("key revoked")
+	}
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, permError("invalid key data")
+	}
+
+	if keyType == "ed25519" {
+		if len(data) != ed25519.PublicKeySize {
+			return nil, permError("invalid ed25519 key")
+		}
+		return ed25519.PublicKey(data), nil
+	}
+
+	var key *rsa.PublicKey
+	if parsed, err := x509.ParsePKIXPublicKey(data); err == nil {
+		key, _ = parsed.(*rsa.PublicKey)
+	} else {
+		key, _ = x509.ParsePKCS1PublicKey(data)
+	}
+	if key == nil {
+		return nil, permError("invalid RSA key")
+	}
+	if key.N.BitLen() < 1024 {
+		return nil, permError("RSA key is shorter than 1024 bits")
+	}
+	return key, nil
+}
+
+// parseTags parses a tag=value list as used by DKIM and DMARC records
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tag %q", strings.TrimSpace(spec))
+		}
+		name = strings.TrimSpace(name)
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %s", name)
+		}
+		tags[name] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+// parseCanonicalization parses the c= tag, e.g. "relaxed/simple"
+func parseCanonicalization(c string) (string, string, error) {
+	if c == "" {
+		return "simple", "simple", nil
+	}
+	header, body, ok := strings.Cut(strings.ToLower(c), "/")
+	if !ok {
+		body = "simple"
+	}
+	for _, canon := range []string{header, body} {
+		if canon != "simple" && canon != "relaxed" {
+			return "", "", permError("unsupported canonicalization %s", c)
+		}
+	}
+	return header, body, nil
+}
+
+// writeSignedHeaders writes the fields named in signed, each taking the
+// last instance not yet used. Names without an instance sign its absence.
+func writeSignedHeaders(h hash.Hash, fields []headerField, signed []string, relaxed bool) {
+	used := make(map[int]bool)
+	for _, name := range signed {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				h.Write([]byte(canonicalHeader(fields[i].raw, relaxed)))
+				break
+			}
+		}
+	}
+}
+
+// canonicalHeader canonicalizes a header field with the simple or relaxed
+// algorithm of RFC 6376 3.4
+func canonicalHeader(raw string, relaxed bool) string {
+	if !relaxed {
+		return raw
+	}
+	name, value, _ := strings.Cut(raw, ":")
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(compressSpace(value)) + "\r\n"
+}
+
+// canonicalBody canonicalizes a body with the simple or relaxed algorithm
+// of RFC 6376 3.4
+func canonicalBody(body string, relaxed bool) string {
+	lines := strings.Split(body, "\r\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if relaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(compressSpace(line), " ")
+		}
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		if relaxed {
+			return ""
+		}
+		return "\r\n"
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// compressSpace replaces runs of spaces and tabs with one space
+func compressSpace(s string) string {
+	var b strings.Builder
+	space := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteRune(r)
+	}
+	if space {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// signatureTag matches the b= tag, but not bh=
+var signatureTag = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// removeSignature empties the b= tag of a DKIM-Signature field
+func removeSignature(raw string) string {
+	name, value, _ := strings.Cut(raw, ":")
+	return name + ":" + signatureTag.ReplaceAllString(value, "${1}${2}")
+}
+
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,242 @@
+package mailauth
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// newTestVerifier returns a verifier that answers lookups from records
+// only, each given as "TYPE name value"
+func newTestVerifier(records ...string) *Verifier {
+	cfg := &config.MailAuthConfig{Enabled: true, StaticOnly: true}
+	for _, record := range records {
+		fields := strings.SplitN(record, " ", 3)
+		cfg.Records = append(cfg.Records, config.DNSRecord{Type: fields[0], Name: fields[1], Value: fields[2]})
+	}
+	return NewVerifier(cfg, zerolog.Nop())
+}
+
+// crlf writes a message with CRLF line endings
+func crlf(lines ...string) string {
+	return strings.Join(lines, "\r\n")
+}
+
+// The example of RFC 6376 3.4.5
+func TestCanonicalizationRFC6376Example(t *testing.T) {
+	raw := crlf("A: X", "B : Y\t", "\tZ  ", "", " C ", "D \t E", "", "")
+	fields, body := splitMessage([]byte(raw))
+	if len(fields) != 2 {
+		t.Fatalf("got %d header fields, want 2", len(fields))
+	}
+
+	for _, tc := range []struct {
+		relaxed bool
+		header  string
+		body    string
+	}{
+		{false, "A: X\r\nB : Y\t\r\n\tZ  \r\n", " C \r\nD \t E\r\n"},
+		{true, "a:X\r\nb:Y Z\r\n", " C\r\nD E\r\n"},
+	} {
+		header := canonicalHeader(fields[0].raw, tc.relaxed) + canonicalHeader(fields[1].raw, tc.relaxed)
+		if header != tc.header {
+			t.Errorf("relaxed=%v: header %q, want %q", tc.relaxed, header, tc.header)
+		}
+		if got := canonicalBody(body, tc.relaxed); got != tc.body {
+			t.Errorf("relaxed=%v: body %q, want %q", tc.relaxed, got, tc.body)
+		}
+	}
+}
+
+func TestCanonicalBodyEmpty(t *testing.T) {
+	// RFC 6376 3.4.3 and 3.4.4: an empty body is CRLF in simple and
+	// empty in relaxed canonicalization
+	for _, body := range []string{"", "\r\n", "\r\n\r\n", " \r\n\t\r\n"} {
+		if got := canonicalBody(body, true); got != "" {
+			t.Errorf("relaxed %q: got %q", body, got)
+		}
+	}
+	for _, body := range []string{"", "\r\n", "\r\n\r\n"} {
+		if got := canonicalBody(body, false); got != "\r\n" {
+			t.Errorf("simple %q: got %q", body, got)
+		}
+	}
+	if got := canonicalBody("a\r\n \r\n", false); got != "a\r\n \r\n" {
+		t.Errorf("simple keeps whitespace lines: got %q", got)
+	}
+}
+
+func TestRemoveSignatureKeepsBodyHash(t *testing.T) {
+	raw := "DKIM-Signature: v=1; bh=abc=;\r\n b=de\r\n f==; d=example.com\r\n"
+	want := "DKIM-Signature: v=1; bh=abc=;\r\n b=; d=example.com\r\n"
+	if got := removeSignature(raw); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// The signed example of RFC 8463 Appendix A, with an Ed25519 and an RSA
+// signature
+var rfc8463Message = crlf(
+	"DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;",
+	" d=football.example.com; i=@football.example.com;",
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :",
+	" subject : date : message-id : from : subject : date;",
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;",
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus",
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==",
+	"DKIM-Signature: v=1; a=rsa-sha256; c=relaxed/relaxed;",
+	" d=football.example.com; i=@football.example.com;",
+	" q=dns/txt; s=test; t=1528637909; h=from : to : subject :",
+	" date : message-id : from : subject : date;",
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;",
+	" b=F45dVWDfMbQDGHJFlXUNB2HKfbCeLRyhDXgFpEL8GwpsRe0IeIixNTe3",
+	" DhCVlUrSjV4BwcVcOF6+FF3Zo9Rpo1tFOeS9mPYQTnGdaSGsgeefOsk2Jz",
+	" dA+L10TeYt9BgDfQNZtKdN1WO//KgIqXP7OdEFE4LjFYNcUxZQ4FADY+8=",
+	"From: Joe SixPack <joe@football.example.com>",
+	"To: Suzie Q <suzie@shopping.example.net>",
+	"Subject: Is dinner ready?",
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)",
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>",
+	"",
+	"Hi.",
+	"",
+	"We lost the game.  Are you hungry yet?",
+	"",
+	"Joe.",
+	"",
+)
+
+var rfc8463Keys = []string{
+	"TXT brisbane._domainkey.football.example.com v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+	"TXT test._domainkey.football.example.com v=DKIM1; k=rsa; p=MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQDkHlOQoBTzWRiGs5V6NpP3idY6Wk08a5qhdR6wy5bdOKb2jLQiY/J16JYi0Qvx/byYzCNb3W91y3FutACDfzwQ/BC/e/8uBsCR+yz1Lxj+PL6lHvqMKrM3rG4hstT5QjvHO9PzoxZyVYLzBfO2EeC3Ip3G+2kryOTIKT+l/K4w3QIDAQAB",
+}
+
+func verifyDKIMMessage(v *Verifier, raw string) []storage.DKIMResult {
+	fields, body := splitMessage([]byte(raw))
+	return v.verifyDKIM(context.Background(), fields, body)
+}
+
+func TestVerifyDKIMRFC8463Example(t *testing.T) {
+	results := verifyDKIMMessage(newTestVerifier(rfc8463Keys...), rfc8463Message)
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want 2", len(results))
+	}
+	for _, result := range results {
+		if result.Result != ResultPass {
+			t.Errorf("%s: %s (%s)", result.Algorithm, result.Result, result.Reason)
+		}
+		if result.Domain != "football.example.com" {
+			t.Errorf("%s: domain %q", result.Algorithm, result.Domain)
+		}
+	}
+
+	// LF line endings, as a message may be stored, verify the same
+	results = verifyDKIMMessage(newTestVerifier(rfc8463Keys...), strings.ReplaceAll(rfc8463Message, "\r\n", "\n"))
+	for _, result := range results {
+		if result.Result != ResultPass {
+			t.Errorf("LF %s: %s (%s)", result.Algorithm, result.Result, result.Reason)
+		}
+	}
+}
+
+func TestVerifyDKIMRejects(t *testing.T) {
+	// signature is the index of the checked signature: 0 for Ed25519 and
+	// 1 for RSA
+	for _, tc := range []struct {
+		name      string
+		raw       string
+		records   []string
+		signature int
+		result    string
+		reason    string
+	}{
+		{
+			name:    "body changed",
+			raw:     strings.Replace(rfc8463Message, "lost the game", "won the game", 1),
+			records: rfc8463Keys,
+			result:  ResultFail,
+			reason:  "body hash",
+		},
+		{
+			name:    "relaxed body survives whitespace",
+			raw:     strings.Replace(rfc8463Message, "Hi.", "Hi.  \t", 1),
+			records: rfc8463Keys,
+			result:  ResultPass,
+		},
+		{
+			name:    "signed header changed",
+			raw:     strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1),
+			records: rfc8463Keys,
+			result:  ResultFail,
+			reason:  "signature does not verify",
+		},
+		{
+			// The second From instance in h= signs the absence of
+			// another From, so one added above the signed one breaks
+			// the signature
+			name:    "From added",
+			raw:     strings.Replace(rfc8463Message, "From: Joe", "From: Mallory <m@evil.example>\r\nFrom: Joe", 1),
+			records: rfc8463Keys,
+			result:  ResultFail,
+			reason:  "signature does not verify",
+		},
+		{
+			name:   "no key",
+			raw:    rfc8463Message,
+			result: ResultPermError,
+			reason: "no key",
+		},
+		{
+			name:    "revoked key",
+			raw:     rfc8463Message,
+			records: []string{"TXT brisbane._domainkey.football.example.com v=DKIM1; k=ed25519; p=", rfc8463Keys[1]},
+			result:  ResultPermError,
+			reason:  "key revoked",
+		},
+		{
+			name:    "key type mismatch",
+			raw:     rfc8463Message,
+			records: []string{strings.Replace(rfc8463Keys[1], "test.", "brisbane.", 1)},
+			result:  ResultPermError,
+			reason:  "does not match the algorithm",
+		},
+		{
+			name:      "rsa-sha1",
+			raw:       strings.Replace(rfc8463Message, "a=rsa-sha256", "a=rsa-sha1", 1),
+			records:   rfc8463Keys,
+			signature: 1,
+			result:    ResultPermError,
+			reason:    "rsa-sha1",
+		},
+		{
+			name:      "expired",
+			raw:       strings.Replace(rfc8463Message, "t=1528637909; h=from : to : subject", "t=1528637909; x=1528637910; h=from : to : subject", 1),
+			records:   rfc8463Keys,
+			signature: 1,
+			result:    ResultPermError,
+			reason:    "expired",
+		},
+		{
+			name:    "From not signed",
+			raw:     strings.NewReplacer("h=from : to :", "h=to :", " date : message-id : from : subject : date;", " date : message-id : subject : date;").Replace(rfc8463Message),
+			records: rfc8463Keys,
+			result:  ResultPermError,
+			reason:  "From is not signed",
+		},
+	} {
+		results := verifyDKIMMessage(newTestVerifier(tc.records...), tc.raw)
+		if len(results) != 2 {
+			t.Errorf("%s: got %d results, want 2", tc.name, len(results))
+			continue
+		}
+		result := results[tc.signature]
+		if result.Result != tc.result || !strings.Contains(result.Reason, tc.reason) {
+			t.Errorf("%s: got %s (%s), want %s (%s)", tc.name, result.Result, result.Reason, tc.result, tc.reason)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package mailauth
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// checkDMARC evaluates the DMARC policy of the From domain against the SPF
+// and DKIM results (RFC 7489)
+func (v *Verifier) checkDMARC(ctx context.Context, fields []headerField, spf *storage.SPFResult, dkim []storage.DKIMResult) storage.DMARCResult {
+	result := storage.DMARCResult{Result: ResultNone}
+
+	var from []*mail.Address
+	for i := range fields {
+		if !strings.EqualFold(fields[i].name, "From") {
+			continue
+		}
+		if from != nil {
+			result.Result, result.Reason = ResultPermError, "multiple From fields"
+			return result
+		}
+		var err error
+		if from, err = mail.ParseAddressList(fields[i].value()); err != nil {
+			result.Result, result.Reason = ResultPermError, "invalid From field"
+			return result
+		}
+	}
+	if len(from) == 0 {
+		result.Result, result.Reason = ResultPermError, "no From address"
+		return result
+	}
+	for _, address := range from[1:] {
+		if domainOf(address.Address) != domainOf(from[0].Address) {
+			result.Result, result.Reason = ResultPermError, "From addresses have different domains"
+			return result
+		}
+	}
+	result.Domain = domainOf(from[0].Address)
+
+	// The policy is published at the From domain, or else at its
+	// organizational domain, where sp= applies to subdomains
+	tags, err := v.lookupDMARC(ctx, result.Domain)
+	subdomain := false
+	if err == nil && tags == nil {
+		if org := organizationalDomain(result.Domain); org != result.Domain {
+			tags, err = v.lookupDMARC(ctx, org)
+			subdomain = true
+		}
+	}
+	if err != nil {
+		if resultErr, ok := err.(*resultError); ok {
+			result.Result, result.Reason = resultErr.result, resultErr.reason
+		} else {
+			result.Result, result.Reason = ResultTempError, err.Error()
+		}
+		return result
+	}
+	if tags == nil {
+		result.Reason = "no DMARC record for " + result.Domain
+		return result
+	}
+
+	result.Policy = strings.ToLower(tags["p"])
+	if sp := strings.ToLower(tags["sp"]); subdomain && sp != "" {
+		result.Policy = sp
+	}
+	switch result.Policy {
+	case "none", "quarantine", "reject":
+	default:
+		result.Result, result.Reason = ResultPermError, "invalid policy "+tags["p"]
+		return result
+	}
+
+	strictSPF := strings.EqualFold(tags["aspf"], "s")
+	strictDKIM := strings.EqualFold(tags["adkim"], "s")
+	result.SPFAligned = spf.Result == ResultPass && aligned(spf.Domain, result.Domain, strictSPF)
+	for _, signature := range dkim {
+		if signature.Result == ResultPass && aligned(signature.Domain, result.Domain, strictDKIM) {
+			result.DKIMAligned = true
+		}
+	}
+
+	if result.SPFAligned || result.DKIMAligned {
+		result.Result = ResultPass
+	} else {
+		result.Result = ResultFail
+		result.Reason = "no aligned SPF or DKIM pass"
+	}
+	return result
+}
+
+// lookupDMARC returns the tags of the DMARC record of domain, or nil if it
+// has none
+func (v *Verifier) lookupDMARC(ctx context.Context, domain string) (map[string]string, error) {
+	records, err := v.resolver.lookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		return nil, fmt.Errorf("lookup of _dmarc.%s failed: %v", domain, err)
+	}
+
+	var record string
+	for _, txt := range records {
+		if strings.HasPrefix(strings.ToLower(strings.ReplaceAll(txt, " ", "")), "v=dmarc1;") {
+			if record != "" {
+				return nil, permError("multiple DMARC records for %s", domain)
+			}
+			record = txt
+		}
+	}
+	if record == "" {
+		return nil, nil
+	}
+
+	tags, err := parseTags(record)
+	if err != nil {
+		return nil, permError("invalid DMARC record: %v", err)
+	}
+	return tags, nil
+}
+
+// aligned reports whether an authenticated domain aligns with the From
+// domain: equal in strict mode, or with the same organizational domain
+func aligned(domain, fromDomain string, strict bool) bool {
+	domain, fromDomain = strings.ToLower(domain), strings.ToLower(fromDomain)
+	if strict {
+		return domain == fromDomain
+	}
+	return organizationalDomain(domain) == organizationalDomain(fromDomain)
+}
+
+// organizationalDomain approximates the organizational domain as the last
+// two labels. Without the Public Suffix List, domains under suffixes such
+// as co.uk are not told apart.
+func organizationalDomain(domain string) string {
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	if len(labels) <= 2 {
+		return domain
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
@@ -0,0 +1,99 @@
+package mailauth
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"gowebmail/internal/storage"
+)
+
+func TestCheckDMARC(t *testing.T) {
+	v := newTestVerifier(
+		"TXT _dmarc.example.com v=DMARC1; p=reject; sp=quarantine",
+		"TXT _dmarc.strict.example v=DMARC1; p=reject; aspf=s; adkim=s",
+		"TXT _dmarc.invalid.example v=DMARC1; p=drop",
+		"TXT _dmarc.twice.example v=DMARC1; p=none",
+		"TXT _dmarc.twice.example v=DMARC1; p=reject",
+	)
+
+	pass := func(domain string) storage.SPFResult {
+		return storage.SPFResult{Result: ResultPass, Domain: domain}
+	}
+	signed := func(result, domain string) []storage.DKIMResult {
+		return []storage.DKIMResult{{Result: result, Domain: domain}}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		from   string
+		spf    storage.SPFResult
+		dkim   []storage.DKIMResult
+		result string
+		policy string
+	}{
+		{"SPF aligned", "From: a@example.com", pass("example.com"), nil, ResultPass, "reject"},
+		{"SPF relaxed alignment", "From: a@example.com", pass("bounce.example.com"), nil, ResultPass, "reject"},
+		{"DKIM relaxed alignment", "From: a@example.com", storage.SPFResult{Result: ResultFail}, signed(ResultPass, "mail.example.com"), ResultPass, "reject"},
+		{"SPF pass for another domain", "From: a@example.com", pass("example.net"), nil, ResultFail, "reject"},
+		{"DKIM fail", "From: a@example.com", storage.SPFResult{Result: ResultSoftFail, Domain: "example.com"}, signed(ResultFail, "example.com"), ResultFail, "reject"},
+		{"subdomain policy", "From: a@news.example.com", pass("example.net"), nil, ResultFail, "quarantine"},
+		{"strict SPF", "From: a@strict.example", pass("bounce.strict.example"), nil, ResultFail, "reject"},
+		{"strict DKIM", "From: a@strict.example", storage.SPFResult{}, signed(ResultPass, "mail.strict.example"), ResultFail, "reject"},
+		{"strict aligned", "From: a@strict.example", storage.SPFResult{}, signed(ResultPass, "strict.example"), ResultPass, "reject"},
+		{"no record", "From: a@example.net", pass("example.net"), nil, ResultNone, ""},
+		{"invalid policy", "From: a@invalid.example", pass("invalid.example"), nil, ResultPermError, ""},
+		{"multiple records", "From: a@twice.example", pass("twice.example"), nil, ResultPermError, ""},
+		{"multiple From fields", "From: a@example.com\r\nFrom: b@example.com", pass("example.com"), nil, ResultPermError, ""},
+		{"From domains differ", "From: a@example.com, b@example.net", pass("example.com"), nil, ResultPermError, ""},
+		{"no From", "To: a@example.com", pass("example.com"), nil, ResultPermError, ""},
+	} {
+		fields, _ := splitMessage([]byte(tc.from + "\r\n\r\nbody\r\n"))
+		result := v.checkDMARC(context.Background(), fields, &tc.spf, tc.dkim)
+		if result.Result != tc.result || result.Policy != tc.policy && tc.result != ResultPermError {
+			t.Errorf("%s: got %s, policy %q (%s), want %s, policy %q", tc.name, result.Result, result.Policy, result.Reason, tc.result, tc.policy)
+		}
+	}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	for domain, want := range map[string]string{
+		"example.com":           "example.com",
+		"mail.example.com":      "example.com",
+		"a.b.mail.example.com.": "example.com",
+		"localhost":             "localhost",
+	} {
+		if got := organizationalDomain(domain); got != want {
+			t.Errorf("%s: got %s, want %s", domain, got, want)
+		}
+	}
+	if aligned("example.com", "example.net", false) || !aligned("Mail.Example.com", "example.com", false) {
+		t.Error("relaxed alignment compares organizational domains")
+	}
+	if aligned("mail.example.com", "example.com", true) || !aligned("EXAMPLE.com", "example.com", true) {
+		t.Error("strict alignment compares domains")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	v := newTestVerifier(append(rfc8463Keys,
+		"TXT football.example.com v=spf1 ip4:192.0.2.0/24 -all",
+		"TXT _dmarc.football.example.com v=DMARC1; p=reject",
+	)...)
+
+	results := v.Verify([]byte(rfc8463Message), []byte{192, 0, 2, 1}, "mail.football.example.com", "joe@football.example.com")
+	if results.SPF.Result != ResultPass || len(results.DKIM) != 2 || results.DMARC.Result != ResultPass {
+		t.Errorf("got SPF %s, %d DKIM results, DMARC %s", results.SPF.Result, len(results.DKIM), results.DMARC.Result)
+	}
+	if !results.DMARC.SPFAligned || !results.DMARC.DKIMAligned {
+		t.Errorf("got SPF aligned %v, DKIM aligned %v", results.DMARC.SPFAligned, results.DMARC.DKIMAligned)
+	}
+
+	// A changed body fails DKIM, and from another address SPF, so DMARC
+	// fails with the policy to apply
+	tampered := strings.Replace(rfc8463Message, "lost the game", "won the game", 1)
+	results = v.Verify([]byte(tampered), []byte{198, 51, 100, 1}, "mail.evil.example", "joe@football.example.com")
+	if results.SPF.Result != ResultFail || results.DMARC.Result != ResultFail || results.DMARC.Policy != "reject" {
+		t.Errorf("got SPF %s, DMARC %s, policy %s", results.SPF.Result, results.DMARC.Result, results.DMARC.Policy)
+	}
+}
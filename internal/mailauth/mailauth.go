@@ -0,0 +1,130 @@
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// Results, as named by RFC 8601
+const (
+	ResultPass      = "pass"
+	ResultFail      = "fail"
+	ResultSoftFail  = "softfail"
+	ResultNeutral   = "neutral"
+	ResultNone      = "none"
+	ResultTempError = "temperror"
+	ResultPermError = "permerror"
+)
+
+// Verifier checks the DKIM signatures, SPF and DMARC of incoming emails. It
+// only reports results; mail is never rejected.
+type Verifier struct {
+	config   *config.MailAuthConfig
+	resolver *resolver
+	logger   zerolog.Logger
+}
+
+// NewVerifier creates a new mail authentication verifier
+func NewVerifier(cfg *config.MailAuthConfig, logger zerolog.Logger) *Verifier {
+	return &Verifier{
+		config:   cfg,
+		resolver: newResolver(cfg),
+		logger:   logger.With().Str("component", "mailauth").Logger(),
+	}
+}
+
+// Verify checks the raw message received from the SMTP client at ip,
+// which greeted with helo and sent MAIL FROM mailFrom. ip is nil when the
+// message did not arrive over SMTP; SPF is then none.
+func (v *Verifier) Verify(raw []byte, ip net.IP, helo, mailFrom string) *storage.AuthResults {
+	ctx := context.Background()
+	if v.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.config.Timeout)
+		defer cancel()
+	}
+
+	fields, body := splitMessage(raw)
+	results := &storage.AuthResults{
+		SPF:       v.checkSPF(ctx, ip, helo, mailFrom),
+		DKIM:      v.verifyDKIM(ctx, fields, body),
+		CheckedAt: time.Now(),
+	}
+	results.DMARC = v.checkDMARC(ctx, fields, &results.SPF, results.DKIM)
+	return results
+}
+
+// resultError ends a check with a result other than pass
+type resultError struct {
+	result string
+	reason string
+}
+
+func (e *resultError) Error() string { return e.reason }
+
+func permError(format string, args ...interface{}) error {
+	return &resultError{ResultPermError, fmt.Sprintf(format, args...)}
+}
+
+func failError(format string, args ...interface{}) error {
+	return &resultError{ResultFail, fmt.Sprintf(format, args...)}
+}
+
+// headerField is a header field exactly as received, including folding
+// and the final CRLF
+type headerField struct {
+	name string
+	raw  string
+}
+
+// value returns the field body after the colon, unfolded
+func (f *headerField) value() string {
+	_, value, _ := strings.Cut(f.raw, ":")
+	return strings.TrimSpace(strings.NewReplacer("\r\n", "").Replace(value))
+}
+
+// splitMessage returns the header fields and body of raw with line endings
+// normalized to CRLF
+func splitMessage(raw []byte) ([]headerField, string) {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	raw = bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+
+	header, body := string(raw), ""
+	if i := strings.Index(header, "\r\n\r\n"); i >= 0 {
+		header, body = header[:i+2], header[i+4:]
+	}
+
+	var fields []headerField
+	for _, line := range strings.SplitAfter(header, "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		name, _, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, headerField{name: strings.TrimSpace(name), raw: line})
+	}
+	return fields, body
+}
+
+// domainOf returns the domain of an address, lowercased
+func domainOf(address string) string {
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		return strings.ToLower(strings.TrimSuffix(address[at+1:], ">"))
+	}
+	return ""
+}
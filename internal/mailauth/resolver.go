@@ -0,0 +1,130 @@
+package mailauth
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gowebmail/internal/config"
+)
+
+// resolver answers lookups from the static records first, then DNS. An
+// empty answer means the name or record type does not exist.
+type resolver struct {
+	static map[string][]string // by "TYPE name"
+	dns    *net.Resolver       // nil with static_only
+}
+
+func newResolver(cfg *config.MailAuthConfig) *resolver {
+	r := &resolver{static: make(map[string][]string)}
+	for _, record := range cfg.Records {
+		key := recordKey(record.Type, record.Name)
+		r.static[key] = append(r.static[key], record.Value)
+	}
+
+	if cfg.StaticOnly {
+		return r
+	}
+	r.dns = net.DefaultResolver
+	if cfg.DNSServer != "" {
+		server := cfg.DNSServer
+		r.dns = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	return r
+}
+
+func recordKey(typ, name string) string {
+	return strings.ToUpper(typ) + " " + strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// lookupTXT returns the TXT records of name
+func (r *resolver) lookupTXT(ctx context.Context, name string) ([]string, error) {
+	if values, ok := r.static[recordKey("TXT", name)]; ok {
+		return values, nil
+	}
+	if r.dns == nil {
+		return nil, nil
+	}
+	records, err := r.dns.LookupTXT(ctx, name)
+	return records, notFound(err)
+}
+
+// lookupIP returns the A records of name, or its AAAA records if ipv6
+func (r *resolver) lookupIP(ctx context.Context, name string, ipv6 bool) ([]net.IP, error) {
+	typ, network := "A", "ip4"
+	if ipv6 {
+		typ, network = "AAAA", "ip6"
+	}
+	if values, ok := r.static[recordKey(typ, name)]; ok {
+		var ips []net.IP
+		for _, value := range values {
+			if ip := net.ParseIP(strings.TrimSpace(value)); ip != nil {
+				ips = append(ips, ip)
+			}
+		}
+		return ips, nil
+	}
+	if r.dns == nil {
+		return nil, nil
+	}
+	ips, err := r.dns.LookupIP(ctx, network, name)
+	return ips, notFound(err)
+}
+
+// lookupMX returns the mail exchangers of name, most preferred first
+func (r *resolver) lookupMX(ctx context.Context, name string) ([]string, error) {
+	if values, ok := r.static[recordKey("MX", name)]; ok {
+		type mx struct {
+			pref int
+			host string
+		}
+		var records []mx
+		for _, value := range values {
+			fields := strings.Fields(value)
+			switch len(fields) {
+			case 1:
+				records = append(records, mx{host: fields[0]})
+			case 2:
+				pref, _ := strconv.Atoi(fields[0])
+				records = append(records, mx{pref, fields[1]})
+			}
+		}
+		sort.SliceStable(records, func(i, j int) bool { return records[i].pref < records[j].pref })
+		hosts := make([]string, len(records))
+		for i, record := range records {
+			hosts[i] = strings.TrimSuffix(record.host, ".")
+		}
+		return hosts, nil
+	}
+	if r.dns == nil {
+		return nil, nil
+	}
+	records, err := r.dns.LookupMX(ctx, name)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	hosts := make([]string, len(records))
+	for i, record := range records {
+		hosts[i] = strings.TrimSuffix(record.Host, ".")
+	}
+	return hosts, nil
+}
+
+// notFound turns "no such host" errors into empty answers; anything else
+// is a temporary failure
+func notFound(err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,412 @@
+package mailauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// SPF processing limits (RFC 7208 4.6.4)
+const (
+	maxSPFLookups     = 10
+	maxSPFVoidLookups = 2
+	maxSPFMXHosts     = 10
+)
+
+// spfCheck is one evaluation of check_host() and its nested includes and
+// redirects, which share the lookup limits
+type spfCheck struct {
+	resolver *resolver
+	ctx      context.Context
+	ip       net.IP
+	sender   string
+	helo     string
+	lookups  int
+	voids    int
+}
+
+// checkSPF evaluates the SPF policy of the MAIL FROM domain, or of the HELO
+// name for bounces with an empty MAIL FROM (RFC 7208)
+func (v *Verifier) checkSPF(ctx context.Context, ip net.IP, helo, mailFrom string) storage.SPFResult {
+	sender := mailFrom
+	if sender == "" && helo != "" {
+		sender = "postmaster@" + helo
+	}
+	result := storage.SPFResult{Result: ResultNone, Domain: domainOf(sender)}
+	if ip == nil {
+		result.Reason = "client IP unknown"
+		return result
+	}
+	result.IP = ip.String()
+	if result.Domain == "" {
+		result.Reason = "no sender domain"
+		return result
+	}
+
+	check := &spfCheck{resolver: v.resolver, ctx: ctx, ip: ip, sender: sender, helo: helo}
+	result.Result, result.Reason = check.checkHost(result.Domain)
+	return result
+}
+
+// checkHost evaluates the SPF record of domain
+func (c *spfCheck) checkHost(domain string) (string, string) {
+	if !validDomain(domain) {
+		return ResultNone, "invalid domain " + domain
+	}
+
+	records, err := c.resolver.lookupTXT(c.ctx, domain)
+	if err != nil {
+		return ResultTempError, fmt.Sprintf("lookup of %s failed: %v", domain, err)
+	}
+	var record string
+	found := 0
+	for _, txt := range records {
+		if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			record = txt
+			found++
+		}
+	}
+	switch found {
+	case 0:
+		return ResultNone, "no SPF record for " + domain
+	case 1:
+	default:
+		return ResultPermError, "multiple SPF records for " + domain
+	}
+
+	result, reason, err := c.evaluate(domain, record)
+	if err != nil {
+		resultErr := err.(*resultError)
+		return resultErr.result, resultErr.reason
+	}
+	return result, reason
+}
+
+// qualifierResults maps mechanism qualifiers to results
+var qualifierResults = map[byte]string{
+	'+': ResultPass,
+	'-': ResultFail,
+	'~': ResultSoftFail,
+	'?': ResultNeutral,
+}
+
+// spfModifier matches a modifier such as redirect=example.com
+var spfModifier = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9_.-]*)=(.*)$`)
+
+// evaluate runs the terms of record for domain
+func (c *spfCheck) evaluate(domain, record string) (string, string, error) {
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if m := spfModifier.FindStringSubmatch(term); m != nil {
+			if strings.EqualFold(m[1], "redirect") {
+				redirect = m[2]
+			}
+			continue
+		}
+
+		qualifier := byte('+')
+		if _, ok := qualifierResults[term[0]]; ok {
+			qualifier, term = term[0], term[1:]
+		}
+		matched, err := c.matches(domain, term)
+		if err != nil {
+			return "", "", err
+		}
+		if matched {
+			return qualifierResults[qualifier], "matched " + string(qualifier) + term, nil
+		}
+	}
+
+	if redirect == "" {
+		return ResultNeutral, "no mechanism matched", nil
+	}
+	if err := c.countLookup(); err != nil {
+		return "", "", err
+	}
+	target, err := c.expand(redirect, domain)
+	if err != nil {
+		return "", "", err
+	}
+	result, reason := c.checkHost(target)
+	if result == ResultNone {
+		return ResultPermError, "redirect to " + target + " has no SPF record", nil
+	}
+	return result, reason, nil
+}
+
+// matches reports whether the client matches a mechanism without its
+// qualifier
+func (c *spfCheck) matches(domain, term string) (bool, error) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+
+	switch strings.ToLower(name) {
+	case "all":
+		return true, nil
+
+	case "include":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(strings.TrimPrefix(arg, ":"), domain)
+		if err != nil {
+			return false, err
+		}
+		switch result, reason := c.checkHost(target); result {
+		case ResultPass:
+			return true, nil
+		case ResultFail, ResultSoftFail, ResultNeutral:
+			return false, nil
+		case ResultTempError:
+			return false, &resultError{ResultTempError, reason}
+		default:
+			return false, &resultError{ResultPermError, "include:" + target + ": " + reason}
+		}
+
+	case "a", "mx":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, cidr4, cidr6, err := c.parseDomainCIDR(arg, domain)
+		if err != nil {
+			return false, err
+		}
+		hosts := []string{target}
+		if strings.EqualFold(name, "mx") {
+			if hosts, err = c.resolver.lookupMX(c.ctx, target); err != nil {
+				return false, &resultError{ResultTempError, fmt.Sprintf("MX lookup of %s failed: %v", target, err)}
+			}
+			if len(hosts) > maxSPFMXHosts {
+				return false, &resultError{ResultPermError, "too many MX hosts for " + target}
+			}
+			if len(hosts) == 0 {
+				return false, c.countVoid()
+			}
+		}
+		for _, host := range hosts {
+			matched, err := c.matchesHost(host, cidr4, cidr6)
+			if matched || err != nil {
+				return matched, err
+			}
+		}
+		return false, nil
+
+	case "ip4", "ip6":
+		_, network, err := net.ParseCIDR(cidrOf(strings.TrimPrefix(arg, ":"), strings.EqualFold(name, "ip6")))
+		if err != nil {
+			return false, &resultError{ResultPermError, "invalid " + term}
+		}
+		return network.Contains(c.ip), nil
+
+	case "exists":
+		if err := c.countLookup(); err != nil {
+			return false, err
+		}
+		target, err := c.expand(strings.TrimPrefix(arg, ":"), domain)
+		if err != nil {
+			return false, err
+		}
+		ips, err := c.resolver.lookupIP(c.ctx, target, false)
+		if err != nil {
+			return false, &resultError{ResultTempError, fmt.Sprintf("lookup of %s failed: %v", target, err)}
+		}
+		if len(ips) == 0 {
+			return false, c.countVoid()
+		}
+		return true, nil
+
+	case "ptr":
+		// ptr is deprecated (RFC 7208 5.5) and never matches here
+		return false, c.countLookup()
+	}
+
+	return false, &resultError{ResultPermError, "unknown mechanism " + term}
+}
+
+// matchesHost reports whether the client address is within the CIDR
+// length of an address of host
+func (c *spfCheck) matchesHost(host string, cidr4, cidr6 int) (bool, error) {
+	ipv6 := c.ip.To4() == nil
+	ips, err := c.resolver.lookupIP(c.ctx, host, ipv6)
+	if err != nil {
+		return false, &resultError{ResultTempError, fmt.Sprintf("lookup of %s failed: %v", host, err)}
+	}
+	if len(ips) == 0 {
+		return false, c.countVoid()
+	}
+
+	bits, ones := 32, cidr4
+	if ipv6 {
+		bits, ones = 128, cidr6
+	}
+	mask := net.CIDRMask(ones, bits)
+	for _, ip := range ips {
+		if ip.Mask(mask).Equal(c.ip.Mask(mask)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseDomainCIDR parses the ":domain/cidr4//cidr6" argument of a and mx
+func (c *spfCheck) parseDomainCIDR(arg, domain string) (string, int, int, error) {
+	cidr4, cidr6 := 32, 128
+	if i := strings.Index(arg, "//"); i >= 0 {
+		n, err := strconv.Atoi(arg[i+2:])
+		if err != nil || n < 0 || n > 128 {
+			return "", 0, 0, &resultError{ResultPermError, "invalid IPv6 prefix length in " + arg}
+		}
+		cidr6, arg = n, arg[:i]
+	}
+	if i := strings.Index(arg, "/"); i >= 0 {
+		n, err := strconv.Atoi(arg[i+1:])
+		if err != nil || n < 0 || n > 32 {
+			return "", 0, 0, &resultError{ResultPermError, "invalid IPv4 prefix length in " + arg}
+		}
+		cidr4, arg = n, arg[:i]
+	}
+
+	target := domain
+	if arg = strings.TrimPrefix(arg, ":"); arg != "" {
+		var err error
+		if target, err = c.expand(arg, domain); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	return target, cidr4, cidr6, nil
+}
+
+// cidrOf adds the full prefix length to an address without one
+func cidrOf(s string, ipv6 bool) string {
+	if strings.Contains(s, "/") {
+		return s
+	}
+	if ipv6 {
+		return s + "/128"
+	}
+	return s + "/32"
+}
+
+func (c *spfCheck) countLookup() error {
+	c.lookups++
+	if c.lookups > maxSPFLookups {
+		return &resultError{ResultPermError, "too many DNS lookups"}
+	}
+	return nil
+}
+
+func (c *spfCheck) countVoid() error {
+	c.voids++
+	if c.voids > maxSPFVoidLookups {
+		return &resultError{ResultPermError, "too many void DNS lookups"}
+	}
+	return nil
+}
+
+// spfMacro matches a macro of a domain-spec, e.g. %{ir}
+var spfMacro = regexp.MustCompile(`%(\{([a-zA-Z])([0-9]*)(r?)([-.+,/_=]*)\}|%|_|-)`)
+
+// expand expands the macros of a domain-spec (RFC 7208 7)
+func (c *spfCheck) expand(spec, domain string) (string, error) {
+	var expandErr error
+	expanded := spfMacro.ReplaceAllStringFunc(spec, func(macro string) string {
+		switch macro {
+		case "%%":
+			return "%"
+		case "%_":
+			return " "
+		case "%-":
+			return "%20"
+		}
+
+		m := spfMacro.FindStringSubmatch(macro)
+		var value string
+		switch strings.ToLower(m[2]) {
+		case "s":
+			value = c.sender
+		case "l":
+			value, _, _ = strings.Cut(c.sender, "@")
+		case "o":
+			value = domainOf(c.sender)
+		case "d":
+			value = domain
+		case "i":
+			value = dottedIP(c.ip)
+		case "p":
+			value = "unknown"
+		case "v":
+			value = "in-addr"
+			if c.ip.To4() == nil {
+				value = "ip6"
+			}
+		case "h":
+			value = c.helo
+		default:
+			expandErr = &resultError{ResultPermError, "invalid macro " + macro}
+			return ""
+		}
+
+		delimiters := m[5]
+		if delimiters == "" {
+			delimiters = "."
+		}
+		parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+		if m[4] == "r" {
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+		}
+		if m[3] != "" {
+			n, _ := strconv.Atoi(m[3])
+			if n == 0 {
+				expandErr = &resultError{ResultPermError, "invalid macro " + macro}
+				return ""
+			}
+			if n < len(parts) {
+				parts = parts[len(parts)-n:]
+			}
+		}
+		return strings.Join(parts, ".")
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	if strings.Contains(strings.ReplaceAll(expanded, "%20", ""), "%") {
+		return "", &resultError{ResultPermError, "invalid macro in " + spec}
+	}
+	return strings.TrimSuffix(expanded, "."), nil
+}
+
+// dottedIP formats an IPv4 address as usual and an IPv6 address as dotted
+// nibbles, as the i macro requires
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	const hex = "0123456789abcdef"
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, string(hex[b>>4]), string(hex[b&0xf]))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// validDomain reports whether domain is a fully qualified domain name
+func validDomain(domain string) bool {
+	if !strings.Contains(domain, ".") || len(domain) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,130 @@
+package mailauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckSPF(t *testing.T) {
+	records := []string{
+		"TXT include.example v=spf1 include:_spf.include.example -all",
+		"TXT _spf.include.example v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 -all",
+		"TXT redirect.example v=spf1 redirect=_spf.include.example",
+		"TXT dangling.example v=spf1 redirect=nothing.example",
+		"TXT broken-include.example v=spf1 include:nothing.example -all",
+		"TXT softfail.example v=spf1 include:neutral.example ~all",
+		"TXT neutral.example v=spf1 ?all",
+		"TXT a.example v=spf1 a a:other.a.example/24 -all",
+		"A a.example 198.51.100.1",
+		"A other.a.example 203.0.113.77",
+		"TXT mx.example v=spf1 mx -all",
+		"MX mx.example 20 mx2.mx.example",
+		"MX mx.example 10 mx1.mx.example",
+		"A mx2.mx.example 198.51.100.20",
+		"TXT exists.example v=spf1 exists:%{ir}.%{l1r-}.lp._spf.%{d} -all",
+		"A 1.2.0.192.strong.lp._spf.exists.example 127.0.0.2",
+		"TXT twice.example v=spf1 -all",
+		"TXT twice.example v=spf1 +all",
+		"TXT unknown.example v=spf1 foo:bar -all",
+		"TXT void.example v=spf1 a:n1.void.example a:n2.void.example a:n3.void.example -all",
+		"TXT two-voids.example v=spf1 a:n1.void.example a:n2.void.example +all",
+		"TXT other.example some other record",
+	}
+	// A chain of includes one lookup too long, and one as long as
+	// allowed
+	for i := 0; i < maxSPFLookups+1; i++ {
+		records = append(records, fmt.Sprintf("TXT l%d.chain.example v=spf1 include:l%d.chain.example -all", i, i+1))
+	}
+	records = append(records, fmt.Sprintf("TXT l%d.chain.example v=spf1 +all", maxSPFLookups+1))
+	v := newTestVerifier(records...)
+
+	for _, tc := range []struct {
+		ip       string
+		mailFrom string
+		helo     string
+		result   string
+		reason   string
+	}{
+		{"192.0.2.10", "user@include.example", "", ResultPass, ""},
+		{"2001:db8::1", "user@include.example", "", ResultPass, ""},
+		{"198.51.100.1", "user@include.example", "", ResultFail, "-all"},
+		{"192.0.2.10", "user@redirect.example", "", ResultPass, ""},
+		{"198.51.100.1", "user@redirect.example", "", ResultFail, ""},
+		{"192.0.2.10", "user@dangling.example", "", ResultPermError, "redirect to nothing.example"},
+		{"192.0.2.10", "user@broken-include.example", "", ResultPermError, "include:nothing.example"},
+		{"192.0.2.10", "user@softfail.example", "", ResultSoftFail, ""},
+		{"198.51.100.1", "user@a.example", "", ResultPass, "matched +a"},
+		{"203.0.113.200", "user@a.example", "", ResultPass, "other.a.example/24"},
+		{"203.0.114.1", "user@a.example", "", ResultFail, ""},
+		{"198.51.100.20", "user@mx.example", "", ResultPass, "mx"},
+		{"198.51.100.21", "user@mx.example", "", ResultFail, ""},
+		{"192.0.2.1", "strong-bad@exists.example", "", ResultPass, "exists"},
+		{"192.0.2.2", "strong-bad@exists.example", "", ResultFail, ""},
+		{"192.0.2.10", "user@twice.example", "", ResultPermError, "multiple SPF records"},
+		{"192.0.2.10", "user@unknown.example", "", ResultPermError, "unknown mechanism"},
+		{"192.0.2.10", "user@void.example", "", ResultPermError, "void"},
+		{"192.0.2.10", "user@two-voids.example", "", ResultPass, "+all"},
+		{"192.0.2.10", "user@other.example", "", ResultNone, "no SPF record"},
+		{"192.0.2.10", "user@nothing.example", "", ResultNone, "no SPF record"},
+		{"192.0.2.10", "user@l0.chain.example", "", ResultPermError, "too many DNS lookups"},
+		{"192.0.2.10", "user@l1.chain.example", "", ResultPass, ""},
+		// Bounces are checked against the HELO name
+		{"192.0.2.10", "", "include.example", ResultPass, ""},
+		{"192.0.2.10", "user@localhost", "", ResultNone, "invalid domain"},
+	} {
+		result := v.checkSPF(context.Background(), net.ParseIP(tc.ip), tc.helo, tc.mailFrom)
+		if result.Result != tc.result || !strings.Contains(result.Reason, tc.reason) {
+			t.Errorf("%s from %s: got %s (%s), want %s (%s)", tc.mailFrom, tc.ip, result.Result, result.Reason, tc.result, tc.reason)
+		}
+	}
+
+	if result := v.checkSPF(context.Background(), nil, "", "user@include.example"); result.Result != ResultNone {
+		t.Errorf("without a client IP: got %s", result.Result)
+	}
+}
+
+// The macro examples of RFC 7208 7.4
+func TestExpandRFC7208Examples(t *testing.T) {
+	check := &spfCheck{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com"}
+	for _, tc := range []struct{ spec, want string }{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{"%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+	} {
+		got, err := check.expand(tc.spec, "email.example.com")
+		if err != nil || got != tc.want {
+			t.Errorf("%s: got %q, %v, want %q", tc.spec, got, err, tc.want)
+		}
+	}
+
+	check.ip = net.ParseIP("2001:db8::cb01")
+	want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if got, err := check.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com"); err != nil || got != want {
+		t.Errorf("IPv6: got %q, %v, want %q", got, err, want)
+	}
+
+	for _, spec := range []string{"%{x}", "%{d0}", "%a", "100%"} {
+		if _, err := check.expand(spec, "email.example.com"); err == nil {
+			t.Errorf("%s: expanded", spec)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package mailcrypt
+
+import (
+	"errors"
+)
+
+// maxBERDepth bounds the nesting of BER values, which are parsed
+// recursively
+const maxBERDepth = 64
+
+// berToDER re-encodes the indefinite lengths of BER, as streamed by OpenSSL
+// and others, as definite lengths, which encoding/asn1 requires. Other BER
+// freedoms, such as constructed strings, are kept.
+func berToDER(data []byte) ([]byte, error) {
+	out, rest, err := convertBER(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after ASN.1 value")
+	}
+	return out, nil
+}
+
+// convertBER converts the value at the start of data, returning the rest
+func convertBER(data []byte, depth int) ([]byte, []byte, error) {
+	if depth > maxBERDepth {
+		return nil, nil, errors.New("ASN.1 nesting too deep")
+	}
+
+	// Identifier octets, including high tag numbers
+	if len(data) < 2 {
+		return nil, nil, errors.New("truncated ASN.1 value")
+	}
+	n := 1
+	if data[0]&0x1f == 0x1f {
+		for n < len(data) && data[n]&0x80 != 0 {
+			n++
+		}
+		n++
+	}
+	if n >= len(data) {
+		return nil, nil, errors.New("truncated ASN.1 tag")
+	}
+	tag := data[:n]
+	constructed := data[0]&0x20 != 0
+	data = data[n:]
+
+	// Indefinite length: children follow up to an end-of-contents marker
+	if data[0] == 0x80 {
+		if !constructed {
+			return nil, nil, errors.New("indefinite length of a primitive ASN.1 value")
+		}
+		data = data[1:]
+		var content []byte
+		for {
+			if len(data) >= 2 && data[0] == 0 && data[1] == 0 {
+				data = data[2:]
+				break
+			}
+			if len(data) == 0 {
+				return nil, nil, errors.New("missing end of ASN.1 contents")
+			}
+			child, rest, err := convertBER(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			content = append(content, child...)
+			data = rest
+		}
+		return encodeTLV(tag, content), data, nil
+	}
+
+	length, data, err := readBERLength(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if length > len(data) {
+		return nil, nil, errors.New("truncated ASN.1 value")
+	}
+	content, rest := data[:length], data[length:]
+	if !constructed {
+		return encodeTLV(tag, content), rest, nil
+	}
+
+	// Children of a definite length may still be indefinite
+	var converted []byte
+	for len(content) > 0 {
+		child, more, err := convertBER(content, depth+1)
+		if err != nil {
+			return nil, nil, err
+		}
+		converted = append(converted, child...)
+		content = more
+	}
+	return encodeTLV(tag, converted), rest, nil
+}
+
+// readBERLength reads definite length octets
+func readBERLength(data []byte) (int, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, errors.New("truncated ASN.1 length")
+	}
+	if data[0] < 0x80 {
+		return int(data[0]), data[1:], nil
+	}
+	n := int(data[0] & 0x7f)
+	if n == 0 || n > 4 || len(data) < 1+n {
+		return 0, nil, errors.New("invalid ASN.1 length")
+	}
+	length := 0
+	for _, b := range data[1 : 1+n] {
+		length = length<<8 | int(b)
+	}
+	if length < 0 {
+		return 0, nil, errors.New("invalid ASN.1 length")
+	}
+	return length, data[1+n:], nil
+}
+
+// encodeTLV encodes a value with a definite length in its shortest form
+func encodeTLV(tag, content []byte) []byte {
+	out := append([]byte(nil), tag...)
+	switch l := len(content); {
+	case l < 0x80:
+		out = append(out, byte(l))
+	case l < 0x100:
+		out = append(out, 0x81, byte(l))
+	case l < 0x10000:
+		out = append(out, 0x82, byte(l>>8), byte(l))
+	case l < 0x1000000:
+		out = append(out, 0x83, byte(l>>16), byte(l>>8), byte(l))
+	default:
+		out = append(out, 0x84, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+	return append(out, content...)
+}
@@ -0,0 +1,122 @@
+package mailcrypt
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestBERToDER(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ber  string
+		der  string
+	}{
+		{"definite", "30 03 02 01 05", "30 03 02 01 05"},
+		{"indefinite sequence", "30 80 02 01 05 00 00", "30 03 02 01 05"},
+		{"nested indefinite", "30 80 30 80 02 01 05 00 00 04 00 00 00", "30 07 30 03 02 01 05 04 00"},
+		{"indefinite in definite", "a0 09 30 80 02 01 05 00 00 05 00", "a0 07 30 03 02 01 05 05 00"},
+		{"long definite length", "04 81 03 61 62 63", "04 03 61 62 63"},
+		{"constructed string kept", "24 80 04 01 61 04 02 62 63 00 00", "24 07 04 01 61 04 02 62 63"},
+		{"high tag number", "bf 81 01 80 02 01 01 00 00", "bf 81 01 03 02 01 01"},
+	} {
+		der, err := berToDER(unhex(t, tc.ber))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if want := unhex(t, tc.der); !bytes.Equal(der, want) {
+			t.Errorf("%s: got % x, want % x", tc.name, der, want)
+		}
+	}
+
+	// A length of 200 octets takes the long form in DER
+	ber := append(unhex(t, "30 80 04 81 c8"), make([]byte, 200)...)
+	der, err := berToDER(append(ber, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(der, unhex(t, "30 81 cb 04 81 c8")) || len(der) != 3+3+200 {
+		t.Errorf("long form: got % x", der[:8])
+	}
+}
+
+func TestBERToDERRejectsMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ber  string
+	}{
+		{"empty", ""},
+		{"tag only", "30"},
+		{"truncated high tag", "bf 81"},
+		{"truncated content", "04 05 61 62"},
+		{"truncated long length", "04 82 01"},
+		{"five length octets", "04 85 00 00 00 00 01 00"},
+		{"indefinite primitive", "04 80 61 00 00"},
+		{"missing end of contents", "30 80 02 01 05"},
+		{"truncated child", "30 80 02 05 05 00 00"},
+		{"trailing data", "02 01 05 00"},
+		{"child past parent", "30 03 02 02 05 06"},
+	} {
+		if der, err := berToDER(unhex(t, tc.ber)); err == nil {
+			t.Errorf("%s: got % x", tc.name, der)
+		}
+	}
+
+	deep := append(bytes.Repeat([]byte{0x30, 0x80}, maxBERDepth+2), bytes.Repeat([]byte{0, 0}, maxBERDepth+2)...)
+	if _, err := berToDER(deep); err == nil || !strings.Contains(err.Error(), "too deep") {
+		t.Errorf("deep nesting: got %v", err)
+	}
+}
+
+// OpenSSL streams signed data with indefinite lengths; every prefix of it
+// is rejected, and the whole reads as the DER that OpenSSL re-encodes
+func TestBERToDERStreamedSignedData(t *testing.T) {
+	ber, err := decodedBody(readTestdata(t, "smime-opaque.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(ber, []byte{0x30, 0x80}) {
+		t.Fatal("vector is not indefinite-length BER")
+	}
+	for n := 0; n < len(ber); n++ {
+		if _, err := berToDER(ber[:n]); err == nil {
+			t.Fatalf("truncated to %d bytes: converted", n)
+		}
+	}
+
+	der, err := berToDER(ber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var converted, reencoded contentInfo
+	if _, err := asn1.Unmarshal(der, &converted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(readTestdata(t, "smime-opaque.der"), &reencoded); err != nil {
+		t.Fatal(err)
+	}
+	// The content differs only in keeping the eContent as a
+	// constructed string
+	var a, b signedData
+	if _, err := asn1.Unmarshal(converted.Content.Bytes, &a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := asn1.Unmarshal(reencoded.Content.Bytes, &b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Certificates.FullBytes, b.Certificates.FullBytes) || !bytes.Equal(a.SignerInfos[0].Signature, b.SignerInfos[0].Signature) {
+		t.Error("certificates or signature differ from OpenSSL's DER")
+	}
+}
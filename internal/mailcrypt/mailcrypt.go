@@ -0,0 +1,343 @@
+package mailcrypt
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/email"
+	"gowebmail/internal/storage"
+)
+
+// Signature results, named as in mail authentication
+const (
+	ResultPass = "pass"
+	ResultFail = "fail"
+	ResultNone = "none" // not verified, as for PGP signatures
+)
+
+// Formats of signed and encrypted emails
+const (
+	FormatSMIME = "smime"
+	FormatPGP   = "pgp"
+)
+
+// maxDepth bounds the layers of signing and encryption unwrapped, such as
+// an S/MIME signature inside an encryption
+const maxDepth = 4
+
+// Processor detects emails signed or encrypted with S/MIME or PGP. It
+// verifies S/MIME signatures, describes PGP ones, and decrypts the emails
+// encrypted to one of its keys.
+type Processor struct {
+	smime  []*smimeKey
+	pgp    []*pgpKey
+	logger zerolog.Logger
+}
+
+// NewProcessor creates a processor with the decryption keys of cfg
+func NewProcessor(cfg *config.DecryptionConfig, logger zerolog.Logger) (*Processor, error) {
+	p := &Processor{logger: logger.With().Str("component", "mailcrypt").Logger()}
+	for _, key := range cfg.SMIME {
+		k, err := loadSMIMEKey(key.CertFile, key.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load S/MIME key %s: %w", key.CertFile, err)
+		}
+		p.smime = append(p.smime, k)
+	}
+	for _, key := range cfg.PGP {
+		keys, err := loadPGPKeys(key.KeyFile, key.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load PGP key %s: %w", key.KeyFile, err)
+		}
+		p.pgp = append(p.pgp, keys...)
+	}
+	return p, nil
+}
+
+// Process sets the Security of a parsed email that is signed or encrypted.
+// The content of an email decrypted, or signed in an S/MIME envelope, is
+// parsed with parser and replaces its bodies, and its parts are added to
+// its attachments; the caller releases them with the email.
+func (p *Processor) Process(msg *storage.Email, parser *email.Parser) {
+	raw := msg.Raw
+	if msg.RawSpool != "" && wrapped(msg) {
+		// Signed and encrypted content is verified or decrypted whole
+		var err error
+		if raw, err = os.ReadFile(msg.RawSpool); err != nil {
+			p.logger.Warn().Err(err).Msg("Failed to read spooled email")
+			return
+		}
+	}
+
+	security, content := p.inspect(raw, 0)
+	if security == nil {
+		security = p.inspectInline(msg)
+	}
+	if security == nil {
+		return
+	}
+	msg.Security = security
+
+	if content == nil {
+		return
+	}
+	inner, err := parser.Parse(bytes.NewReader(content))
+	if err != nil {
+		security.Reason = fmt.Sprintf("content does not parse: %v", err)
+		return
+	}
+	msg.BodyPlain = inner.BodyPlain
+	msg.BodyHTML = inner.BodyHTML
+	msg.BodyAMP = inner.BodyAMP
+	msg.MissingAlternative = inner.MissingAlternative
+	msg.Attachments = append(msg.Attachments, inner.Attachments...)
+	if msg.Calendar == nil {
+		msg.Calendar = inner.Calendar
+	}
+	// The attachments are released with msg now
+	inner.Attachments = nil
+	parser.Release(inner)
+}
+
+// wrapped reports whether the type of an email is one that inspect
+// examines, so that a spooled email is only read for those
+func wrapped(msg *storage.Email) bool {
+	mediaType, _, _ := mime.ParseMediaType(mail.Header(msg.Headers).Get("Content-Type"))
+	switch mediaType {
+	case "multipart/signed", "multipart/encrypted", "application/pkcs7-mime", "application/x-pkcs7-mime":
+		return true
+	}
+	return false
+}
+
+// inspect examines the MIME entity raw, depth layers deep. It returns nil
+// if it is neither signed nor encrypted, and the content it wraps if that
+// is not readable as it is: decrypted content, or that of an S/MIME
+// envelope.
+func (p *Processor) inspect(raw []byte, depth int) (*storage.Security, []byte) {
+	if depth >= maxDepth {
+		return nil, nil
+	}
+	header, body, ok := splitEntity(raw)
+	if !ok {
+		return nil, nil
+	}
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil, nil
+	}
+	protocol := strings.ToLower(params["protocol"])
+
+	switch {
+	case mediaType == "multipart/signed":
+		parts := splitMultipart(body, params["boundary"])
+		var security *storage.Security
+		switch protocol {
+		case "application/pkcs7-signature", "application/x-pkcs7-signature":
+			security = &storage.Security{Format: FormatSMIME, Signed: true}
+		case "application/pgp-signature":
+			security = &storage.Security{Format: FormatPGP, Signed: true}
+		default:
+			return nil, nil
+		}
+		if len(parts) != 2 {
+			security.Reason = "signed message does not have two parts"
+			return security, nil
+		}
+		signature, err := decodedBody(parts[1])
+		if err != nil {
+			security.Reason = fmt.Sprintf("failed to read signature: %v", err)
+			return security, nil
+		}
+		if security.Format == FormatSMIME {
+			security.Signatures, err = verifyDetached(signature, parts[0])
+		} else {
+			security.Signatures, err = describePGPSignatures(signature)
+		}
+		if err != nil {
+			security.Reason = err.Error()
+		}
+		return security, nil
+
+	case mediaType == "application/pkcs7-mime" || mediaType == "application/x-pkcs7-mime":
+		security := &storage.Security{Format: FormatSMIME}
+		der, err := decodedBody(raw)
+		if err != nil {
+			security.Reason = fmt.Sprintf("failed to read S/MIME content: %v", err)
+			return security, nil
+		}
+		content, err := p.openSMIME(der, security)
+		if err != nil {
+			security.Reason = err.Error()
+			return security, nil
+		}
+		return security, p.unwrap(security, content, depth)
+
+	case mediaType == "multipart/encrypted" && protocol == "application/pgp-encrypted":
+		security := &storage.Security{Format: FormatPGP, Encrypted: true}
+		parts := splitMultipart(body, params["boundary"])
+		if len(parts) != 2 {
+			security.Reason = "encrypted message does not have two parts"
+			return security, nil
+		}
+		data, err := decodedBody(parts[1])
+		if err != nil {
+			security.Reason = fmt.Sprintf("failed to read encrypted part: %v", err)
+			return security, nil
+		}
+		content, err := p.decryptPGP(data, security)
+		if err != nil {
+			security.Reason = err.Error()
+			return security, nil
+		}
+		return security, p.unwrap(security, content, depth)
+	}
+	return nil, nil
+}
+
+// unwrap returns the content readable from content, which was decrypted
+// or taken from an envelope, adding the signatures and encryption of any
+// layer it has in turn
+func (p *Processor) unwrap(security *storage.Security, content []byte, depth int) []byte {
+	inner, innerContent := p.inspect(content, depth+1)
+	if inner == nil {
+		return content
+	}
+	security.Signed = security.Signed || inner.Signed
+	security.Encrypted = security.Encrypted || inner.Encrypted
+	security.Decrypted = inner.Decrypted || (security.Decrypted && !inner.Encrypted)
+	security.Recipients = append(security.Recipients, inner.Recipients...)
+	security.Signatures = append(security.Signatures, inner.Signatures...)
+	if inner.Reason != "" {
+		security.Reason = inner.Reason
+	}
+	if innerContent != nil {
+		return innerContent
+	}
+	return content
+}
+
+// Markers of inline PGP in a plain-text body
+const (
+	pgpMessageBegin = "-----BEGIN PGP MESSAGE-----"
+	pgpMessageEnd   = "-----END PGP MESSAGE-----"
+	pgpSignedBegin  = "-----BEGIN PGP SIGNED MESSAGE-----"
+)
+
+// inspectInline examines the plain-text body of an email for inline PGP,
+// which is not marked by any MIME type. An encrypted block decrypted with
+// a configured key is replaced by its plaintext.
+func (p *Processor) inspectInline(msg *storage.Email) *storage.Security {
+	body := msg.BodyPlain
+	if start := strings.Index(body, pgpMessageBegin); start >= 0 {
+		security := &storage.Security{Format: FormatPGP, Encrypted: true}
+		end := strings.Index(body[start:], pgpMessageEnd)
+		if end < 0 {
+			security.Reason = "encrypted block is not terminated"
+			return security
+		}
+		end += start + len(pgpMessageEnd)
+		plaintext, err := p.decryptPGP([]byte(body[start:end]), security)
+		if err != nil {
+			security.Reason = err.Error()
+			return security
+		}
+		msg.BodyPlain = body[:start] + string(plaintext) + body[end:]
+		return security
+	}
+	if strings.Contains(body, pgpSignedBegin) {
+		security := &storage.Security{Format: FormatPGP, Signed: true}
+		signatures, err := describePGPSignatures([]byte(body))
+		if err != nil {
+			security.Reason = err.Error()
+		}
+		security.Signatures = signatures
+		return security
+	}
+	return nil
+}
+
+// canonicalize normalizes line endings to CRLF, the form in which MIME
+// content is signed
+func canonicalize(raw []byte) []byte {
+	raw = bytes.ReplaceAll(raw, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(raw, []byte("\n"), []byte("\r\n"))
+}
+
+// splitEntity returns the header of a MIME entity and its body as it is
+// encoded, with line endings normalized to CRLF
+func splitEntity(raw []byte) (message.Header, []byte, bool) {
+	raw = canonicalize(raw)
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return message.Header{}, nil, false
+	}
+	if bytes.HasPrefix(raw, []byte("\r\n")) {
+		return entity.Header, raw[2:], true
+	}
+	i := bytes.Index(raw, []byte("\r\n\r\n"))
+	if i < 0 {
+		return entity.Header, nil, true
+	}
+	return entity.Header, raw[i+4:], true
+}
+
+// splitMultipart returns the body parts of a multipart body exactly as
+// they are encoded, headers included, as signatures cover them (RFC 1847)
+func splitMultipart(body []byte, boundary string) [][]byte {
+	if boundary == "" {
+		return nil
+	}
+	delimiter := []byte("\r\n--" + boundary)
+	// A delimiter at the very start has no CRLF before it
+	body = append([]byte("\r\n"), body...)
+
+	var parts [][]byte
+	i := bytes.Index(body, delimiter)
+	for i >= 0 {
+		rest := body[i+len(delimiter):]
+		if bytes.HasPrefix(rest, []byte("--")) {
+			break
+		}
+		// Skip transport padding up to the end of the delimiter line
+		eol := bytes.Index(rest, []byte("\r\n"))
+		if eol < 0 {
+			break
+		}
+		rest = rest[eol+2:]
+		next := bytes.Index(rest, delimiter)
+		if next < 0 {
+			break
+		}
+		parts = append(parts, rest[:next])
+		body, i = rest[next:], 0
+	}
+	return parts
+}
+
+// decodedBody returns the body of a MIME entity with its transfer encoding
+// decoded
+func decodedBody(raw []byte) ([]byte, error) {
+	entity, err := message.Read(bytes.NewReader(raw))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, err
+	}
+	data, err := io.ReadAll(entity.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty part")
+	}
+	return data, nil
+}
@@ -0,0 +1,152 @@
+package mailcrypt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/email"
+	"gowebmail/internal/storage"
+)
+
+// The vectors in testdata were made with OpenSSL 3.0 and GnuPG 2.2:
+//
+//	alice.crt, alice.key     RSA 2048 S/MIME certificate and key
+//	bob.crt                  a certificate whose key is not configured
+//	smime-signed.eml         openssl smime -sign (multipart/signed)
+//	smime-signed-ecdsa.eml   the same with a P-256 certificate
+//	smime-opaque.eml         openssl cms -sign -nodetach -stream, in
+//	                         indefinite-length BER
+//	smime-opaque.der         the same re-encoded in DER by openssl cms
+//	                         -cmsout -outform DER
+//	smime-aes256.eml         openssl smime -encrypt -aes256
+//	smime-des3.eml           openssl smime -encrypt -des3
+//	smime-oaep.eml           openssl cms -encrypt -stream -aes128 with
+//	                         RSAES-OAEP and SHA-256
+//	smime-gcm.eml            openssl cms -encrypt -aes-256-gcm
+//	smime-bob.eml            openssl smime -encrypt -aes256 to bob.crt
+//	smime-signed-encrypted.eml  smime-signed.eml encrypted with -aes256
+//	alice-pgp.asc            RSA 2048 key, unprotected
+//	dave-pgp.asc             Ed25519 key with a Curve25519 encryption
+//	                         subkey, protected with "secret"
+//	pgp-rsa.eml              gpg --sign --encrypt to Alice, as PGP/MIME
+//	pgp-cv25519.eml          gpg --encrypt to Dave, as PGP/MIME
+//	pgp-inline.eml           gpg --armor --encrypt to Alice, inline
+//	pgp-signed.eml           gpg --detach-sign by Alice, as PGP/MIME
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// newTestProcessor returns a processor with Alice's S/MIME and PGP keys
+// and Dave's PGP key
+func newTestProcessor(t *testing.T) *Processor {
+	t.Helper()
+	p, err := NewProcessor(&config.DecryptionConfig{
+		SMIME: []config.SMIMEKeyConfig{{CertFile: "testdata/alice.crt", KeyFile: "testdata/alice.key"}},
+		PGP: []config.PGPKeyConfig{
+			{KeyFile: "testdata/alice-pgp.asc"},
+			{KeyFile: "testdata/dave-pgp.asc", Passphrase: "secret"},
+		},
+	}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// process parses and processes a vector as ingestion does
+func process(t *testing.T, p *Processor, name string) *storage.Email {
+	t.Helper()
+	parser := email.NewParser()
+	msg, err := parser.Parse(strings.NewReader(string(readTestdata(t, name))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { parser.Release(msg) })
+	p.Process(msg, parser)
+	if msg.Security == nil {
+		t.Fatalf("%s: not detected as signed or encrypted", name)
+	}
+	return msg
+}
+
+func TestNewProcessorRejectsWrongPassphrase(t *testing.T) {
+	_, err := NewProcessor(&config.DecryptionConfig{
+		PGP: []config.PGPKeyConfig{{KeyFile: "testdata/dave-pgp.asc", Passphrase: "wrong"}},
+	}, zerolog.Nop())
+	if err == nil {
+		t.Fatal("key unlocked with the wrong passphrase")
+	}
+	_, err = NewProcessor(&config.DecryptionConfig{
+		SMIME: []config.SMIMEKeyConfig{{CertFile: "testdata/bob.crt", KeyFile: "testdata/alice.key"}},
+	}, zerolog.Nop())
+	if err == nil {
+		t.Fatal("certificate loaded with another key")
+	}
+}
+
+func TestProcessReplacesBodies(t *testing.T) {
+	p := newTestProcessor(t)
+	for _, tc := range []struct {
+		name string
+		body string
+	}{
+		{"smime-opaque.eml", "Hello from S/MIME."},
+		{"smime-aes256.eml", "Hello from S/MIME."},
+		{"smime-signed-encrypted.eml", "Hello from S/MIME."},
+		{"pgp-rsa.eml", "Hello from PGP."},
+		{"pgp-cv25519.eml", "Hello from PGP."},
+		{"pgp-inline.eml", "Before\nHello inline.\n\nAfter"},
+	} {
+		msg := process(t, p, tc.name)
+		if !msg.Security.Decrypted && msg.Security.Encrypted {
+			t.Errorf("%s: not decrypted: %s", tc.name, msg.Security.Reason)
+			continue
+		}
+		if got := strings.TrimSpace(strings.ReplaceAll(msg.BodyPlain, "\r\n", "\n")); got != tc.body {
+			t.Errorf("%s: body %q, want %q", tc.name, got, tc.body)
+		}
+	}
+}
+
+func TestProcessKeepsUndecryptedBodies(t *testing.T) {
+	p, err := NewProcessor(&config.DecryptionConfig{}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"smime-aes256.eml", "pgp-rsa.eml", "pgp-inline.eml"} {
+		msg := process(t, p, name)
+		if !msg.Security.Encrypted || msg.Security.Decrypted {
+			t.Errorf("%s: got %+v", name, msg.Security)
+		}
+		if !strings.Contains(msg.Security.Reason, "not encrypted to any configured") {
+			t.Errorf("%s: reason %q", name, msg.Security.Reason)
+		}
+		if len(msg.Security.Recipients) == 0 {
+			t.Errorf("%s: no recipients listed", name)
+		}
+	}
+}
+
+func TestProcessIgnoresPlainEmails(t *testing.T) {
+	parser := email.NewParser()
+	msg, err := parser.Parse(strings.NewReader("From: a@example.com\r\nSubject: Hi\r\n\r\nNothing to see.\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer parser.Release(msg)
+	newTestProcessor(t).Process(msg, parser)
+	if msg.Security != nil {
+		t.Errorf("got %+v", msg.Security)
+	}
+}
@@ -0,0 +1,513 @@
+package mailcrypt
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/zlib"
+	"crypto/cipher"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"gowebmail/internal/storage"
+)
+
+// OpenPGP packet tags (RFC 4880)
+const (
+	tagPKESK        = 1
+	tagSignature    = 2
+	tagSecretKey    = 5
+	tagCompressed   = 8
+	tagSED          = 9
+	tagLiteral      = 11
+	tagSecretSubkey = 7
+	tagSEIPD        = 18
+	tagAEAD         = 20
+)
+
+// maxPlaintext bounds the size of decompressed PGP data
+const maxPlaintext = 256 << 20
+
+// pgpPublicKeyAlgorithms names OpenPGP public key algorithms
+var pgpPublicKeyAlgorithms = map[byte]string{
+	1: "RSA", 2: "RSA", 3: "RSA", 16: "ElGamal", 17: "DSA", 18: "ECDH",
+	19: "ECDSA", 22: "EdDSA", 25: "X25519", 26: "X448", 27: "Ed25519", 28: "Ed448",
+}
+
+// pgpHashAlgorithms names OpenPGP hash algorithms
+var pgpHashAlgorithms = map[byte]string{
+	1: "MD5", 2: "SHA1", 3: "RIPEMD160", 8: "SHA256", 9: "SHA384", 10: "SHA512",
+	11: "SHA224", 12: "SHA3-256", 14: "SHA3-512",
+}
+
+// pgpPacket is an OpenPGP packet, with partial bodies joined
+type pgpPacket struct {
+	tag  int
+	body []byte
+}
+
+// dearmor decodes the first ASCII-armored block of data, or returns data
+// as it is if it is not armored
+func dearmor(data []byte) ([]byte, error) {
+	text := string(data)
+	start := strings.Index(text, "-----BEGIN PGP ")
+	if start < 0 {
+		return data, nil
+	}
+	// A cleartext signed message starts with its text; the signature
+	// block after it is the armored one
+	if strings.HasPrefix(text[start:], pgpSignedBegin) {
+		next := strings.Index(text[start+len(pgpSignedBegin):], "-----BEGIN PGP SIGNATURE-----")
+		if next < 0 {
+			return nil, errors.New("signed message has no signature")
+		}
+		start += len(pgpSignedBegin) + next
+	}
+
+	lines := strings.Split(strings.ReplaceAll(text[start:], "\r\n", "\n"), "\n")[1:]
+	// Armor headers, such as Version, end with an empty line
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			lines = lines[i+1:]
+			break
+		}
+		if !strings.Contains(line, ": ") {
+			break
+		}
+	}
+
+	var encoded strings.Builder
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "-----END ") || (strings.HasPrefix(line, "=") && len(line) == 5) {
+			data, err := base64.StdEncoding.DecodeString(encoded.String())
+			if err != nil {
+				return nil, fmt.Errorf("malformed armor: %w", err)
+			}
+			return data, nil
+		}
+		encoded.WriteString(line)
+	}
+	return nil, errors.New("armored block is not terminated")
+}
+
+// readPackets reads the OpenPGP packets of data
+func readPackets(data []byte) ([]pgpPacket, error) {
+	var packets []pgpPacket
+	for len(data) > 0 {
+		first := data[0]
+		if first&0x80 == 0 {
+			return nil, errors.New("invalid OpenPGP packet header")
+		}
+		data = data[1:]
+
+		// Old format: the tag and length type share the first octet
+		if first&0x40 == 0 {
+			tag := int(first>>2) & 0x0f
+			var length int
+			switch first & 3 {
+			case 0:
+				if len(data) < 1 {
+					return nil, errors.New("truncated OpenPGP packet")
+				}
+				length, data = int(data[0]), data[1:]
+			case 1:
+				if len(data) < 2 {
+					return nil, errors.New("truncated OpenPGP packet")
+				}
+				length, data = int(binary.BigEndian.Uint16(data)), data[2:]
+			case 2:
+				if len(data) < 4 {
+					return nil, errors.New("truncated OpenPGP packet")
+				}
+				length, data = int(binary.BigEndian.Uint32(data)), data[4:]
+			default:
+				length = len(data)
+			}
+			if length < 0 || length > len(data) {
+				return nil, errors.New("truncated OpenPGP packet")
+			}
+			packets = append(packets, pgpPacket{tag, data[:length]})
+			data = data[length:]
+			continue
+		}
+
+		// New format, whose body may come in partial lengths
+		tag := int(first & 0x3f)
+		var body []byte
+		for {
+			if len(data) < 1 {
+				return nil, errors.New("truncated OpenPGP packet")
+			}
+			var length int
+			partial := false
+			switch o := data[0]; {
+			case o < 192:
+				length, data = int(o), data[1:]
+			case o < 224:
+				if len(data) < 2 {
+					return nil, errors.New("truncated OpenPGP packet")
+				}
+				length, data = (int(o)-192)<<8+int(data[1])+192, data[2:]
+			case o == 255:
+				if len(data) < 5 {
+					return nil, errors.New("truncated OpenPGP packet")
+				}
+				length, data = int(binary.BigEndian.Uint32(data[1:])), data[5:]
+			default:
+				length, data, partial = 1<<(o&0x1f), data[1:], true
+			}
+			if length < 0 || length > len(data) {
+				return nil, errors.New("truncated OpenPGP packet")
+			}
+			body = append(body, data[:length]...)
+			data = data[length:]
+			if !partial {
+				break
+			}
+		}
+		packets = append(packets, pgpPacket{tag, body})
+	}
+	return packets, nil
+}
+
+// describePGPSignatures describes the signatures of an armored or binary
+// PGP signature, or of a cleartext signed message
+func describePGPSignatures(data []byte) ([]*storage.Signature, error) {
+	data, err := dearmor(data)
+	if err != nil {
+		return nil, err
+	}
+	packets, err := readPackets(data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PGP signature: %w", err)
+	}
+	var signatures []*storage.Signature
+	for _, packet := range packets {
+		if packet.tag != tagSignature {
+			continue
+		}
+		sig, err := describePGPSignature(packet.body)
+		if err != nil {
+			return signatures, fmt.Errorf("malformed PGP signature: %w", err)
+		}
+		signatures = append(signatures, sig)
+	}
+	if len(signatures) == 0 {
+		return nil, errors.New("no PGP signature found")
+	}
+	return signatures, nil
+}
+
+// describePGPSignature describes a signature packet: its issuer, creation
+// time and algorithms. PGP signatures are not verified, since the signer's
+// public key is not known.
+func describePGPSignature(body []byte) (*storage.Signature, error) {
+	sig := &storage.Signature{Result: ResultNone, Reason: "PGP signatures are not verified"}
+	if len(body) < 1 {
+		return nil, errors.New("empty signature")
+	}
+
+	switch version := body[0]; version {
+	case 3:
+		// Version 3 has fixed fields
+		if len(body) < 19 {
+			return nil, errors.New("truncated signature")
+		}
+		created := time.Unix(int64(binary.BigEndian.Uint32(body[3:7])), 0).UTC()
+		sig.SignedAt = &created
+		sig.KeyID = strings.ToUpper(hex.EncodeToString(body[7:15]))
+		sig.Algorithm = pgpAlgorithm(body[15], body[16])
+		return sig, nil
+
+	case 4, 5, 6:
+		if len(body) < 4 {
+			return nil, errors.New("truncated signature")
+		}
+		sig.Algorithm = pgpAlgorithm(body[2], body[3])
+		rest := body[4:]
+		// Hashed and then unhashed subpackets; version 6 counts their
+		// lengths with four octets
+		for range 2 {
+			var length int
+			if version == 6 {
+				if len(rest) < 4 {
+					return nil, errors.New("truncated signature")
+				}
+				length, rest = int(binary.BigEndian.Uint32(rest)), rest[4:]
+			} else {
+				if len(rest) < 2 {
+					return nil, errors.New("truncated signature")
+				}
+				length, rest = int(binary.BigEndian.Uint16(rest)), rest[2:]
+			}
+			if length < 0 || length > len(rest) {
+				return nil, errors.New("truncated signature")
+			}
+			if err := readSubpackets(rest[:length], sig); err != nil {
+				return nil, err
+			}
+			rest = rest[length:]
+		}
+		return sig, nil
+	}
+	return nil, fmt.Errorf("unsupported signature version %d", body[0])
+}
+
+// readSubpackets fills sig from the signature subpackets of data
+func readSubpackets(data []byte, sig *storage.Signature) error {
+	for len(data) > 0 {
+		var length int
+		switch o := data[0]; {
+		case o < 192:
+			length, data = int(o), data[1:]
+		case o < 255:
+			if len(data) < 2 {
+				return errors.New("truncated subpacket")
+			}
+			length, data = (int(o)-192)<<8+int(data[1])+192, data[2:]
+		default:
+			if len(data) < 5 {
+				return errors.New("truncated subpacket")
+			}
+			length, data = int(binary.BigEndian.Uint32(data[1:])), data[5:]
+		}
+		if length < 1 || length > len(data) {
+			return errors.New("truncated subpacket")
+		}
+		kind, value := data[0]&0x7f, data[1:length]
+		data = data[length:]
+
+		switch kind {
+		case 2: // creation time
+			if len(value) == 4 {
+				created := time.Unix(int64(binary.BigEndian.Uint32(value)), 0).UTC()
+				sig.SignedAt = &created
+			}
+		case 16: // issuer key ID
+			if sig.KeyID == "" {
+				sig.KeyID = strings.ToUpper(hex.EncodeToString(value))
+			}
+		case 28: // signer's user ID
+			sig.Signer = string(value)
+		case 33: // issuer fingerprint, after a version octet
+			if len(value) > 1 {
+				sig.Fingerprint = strings.ToUpper(hex.EncodeToString(value[1:]))
+				// The key ID of a version 4 key ends its fingerprint
+				if value[0] == 4 && len(value) == 21 {
+					sig.KeyID = sig.Fingerprint[24:]
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// pgpAlgorithm names a signature algorithm, e.g. RSA-SHA256
+func pgpAlgorithm(publicKey, hash byte) string {
+	pk, ok := pgpPublicKeyAlgorithms[publicKey]
+	if !ok {
+		pk = fmt.Sprintf("algorithm %d", publicKey)
+	}
+	h, ok := pgpHashAlgorithms[hash]
+	if !ok {
+		h = fmt.Sprintf("hash %d", hash)
+	}
+	return pk + "-" + h
+}
+
+// decryptPGP decrypts an armored or binary PGP message with one of the
+// configured keys. It lists the recipients and the signatures of the
+// message in security, and returns its literal data.
+func (p *Processor) decryptPGP(data []byte, security *storage.Security) ([]byte, error) {
+	data, err := dearmor(data)
+	if err != nil {
+		return nil, err
+	}
+	packets, err := readPackets(data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed PGP message: %w", err)
+	}
+
+	var sessionKey []byte
+	var cipherID byte
+	var lastErr error
+	for _, packet := range packets {
+		switch packet.tag {
+		case tagPKESK:
+			body := packet.body
+			if len(body) < 10 || body[0] != 3 {
+				security.Recipients = append(security.Recipients, "unsupported recipient")
+				continue
+			}
+			keyID := binary.BigEndian.Uint64(body[1:9])
+			if keyID == 0 {
+				security.Recipients = append(security.Recipients, "hidden recipient")
+			} else {
+				security.Recipients = append(security.Recipients, fmt.Sprintf("%016X", keyID))
+			}
+			if sessionKey != nil {
+				continue
+			}
+			for _, key := range p.pgp {
+				if keyID != 0 && keyID != key.keyID {
+					continue
+				}
+				if cipherID, sessionKey, lastErr = key.decryptSessionKey(body[9], body[10:]); sessionKey != nil {
+					break
+				}
+			}
+
+		case tagSEIPD:
+			if sessionKey == nil {
+				if lastErr != nil {
+					return nil, fmt.Errorf("failed to decrypt session key: %w", lastErr)
+				}
+				return nil, errors.New("not encrypted to any configured PGP key")
+			}
+			plaintext, err := decryptSEIPD(cipherID, sessionKey, packet.body)
+			if err != nil {
+				return nil, err
+			}
+			literal, signatures, err := readPGPMessage(plaintext, 0)
+			if err != nil {
+				return nil, err
+			}
+			if len(signatures) > 0 {
+				security.Signed = true
+				security.Signatures = append(security.Signatures, signatures...)
+			}
+			security.Decrypted = true
+			return literal, nil
+
+		case tagSED:
+			return nil, errors.New("message is not integrity protected; not decrypted")
+		case tagAEAD:
+			return nil, errors.New("AEAD encrypted messages are not supported")
+		}
+	}
+	return nil, errors.New("no encrypted data in PGP message")
+}
+
+// decryptSEIPD decrypts a version 1 symmetrically encrypted integrity
+// protected data packet, checking its modification detection code
+func decryptSEIPD(cipherID byte, key, body []byte) ([]byte, error) {
+	if len(body) < 1 || body[0] != 1 {
+		return nil, errors.New("unsupported encrypted data version")
+	}
+	block, err := pgpCipher(cipherID, key)
+	if err != nil {
+		return nil, err
+	}
+	bs := block.BlockSize()
+	data := body[1:]
+	if len(data) < bs+2+22 {
+		return nil, errors.New("encrypted data too short")
+	}
+
+	plaintext := make([]byte, len(data))
+	cipher.NewCFBDecrypter(block, make([]byte, bs)).XORKeyStream(plaintext, data)
+	// The random prefix repeats its last two octets
+	if plaintext[bs-2] != plaintext[bs] || plaintext[bs-1] != plaintext[bs+1] {
+		return nil, errors.New("wrong session key")
+	}
+	mdc := plaintext[len(plaintext)-22:]
+	if mdc[0] != 0xd3 || mdc[1] != 0x14 {
+		return nil, errors.New("missing modification detection code")
+	}
+	sum := sha1.Sum(plaintext[:len(plaintext)-20])
+	if subtle.ConstantTimeCompare(sum[:], mdc[2:]) != 1 {
+		return nil, errors.New("message was modified")
+	}
+	return plaintext[bs+2 : len(plaintext)-22], nil
+}
+
+// readPGPMessage reads the packets of decrypted data, depth compressions
+// deep, and returns its literal data and the signatures along with it
+func readPGPMessage(data []byte, depth int) ([]byte, []*storage.Signature, error) {
+	if depth > maxDepth {
+		return nil, nil, errors.New("PGP message nested too deep")
+	}
+	packets, err := readPackets(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed decrypted data: %w", err)
+	}
+
+	var literal []byte
+	var signatures []*storage.Signature
+	for _, packet := range packets {
+		switch packet.tag {
+		case tagCompressed:
+			decompressed, err := decompress(packet.body)
+			if err != nil {
+				return nil, nil, err
+			}
+			l, sigs, err := readPGPMessage(decompressed, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			if literal == nil {
+				literal = l
+			}
+			signatures = append(signatures, sigs...)
+		case tagLiteral:
+			// Format, file name and date come before the data
+			body := packet.body
+			if len(body) < 2 || len(body) < 2+int(body[1])+4 {
+				return nil, nil, errors.New("truncated literal data")
+			}
+			if literal == nil {
+				literal = body[2+int(body[1])+4:]
+			}
+		case tagSignature:
+			if sig, err := describePGPSignature(packet.body); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	if literal == nil {
+		return nil, nil, errors.New("no literal data in PGP message")
+	}
+	return literal, signatures, nil
+}
+
+// decompress decompresses the body of a compressed data packet
+func decompress(body []byte) ([]byte, error) {
+	if len(body) < 1 {
+		return nil, errors.New("empty compressed data")
+	}
+	var r io.Reader
+	switch body[0] {
+	case 0:
+		return body[1:], nil
+	case 1:
+		r = flate.NewReader(bytes.NewReader(body[1:]))
+	case 2:
+		zr, err := zlib.NewReader(bytes.NewReader(body[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("malformed compressed data: %w", err)
+		}
+		r = zr
+	case 3:
+		r = bzip2.NewReader(bytes.NewReader(body[1:]))
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %d", body[0])
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r, maxPlaintext+1))
+	if err != nil {
+		return nil, fmt.Errorf("malformed compressed data: %w", err)
+	}
+	if len(data) > maxPlaintext {
+		return nil, errors.New("decompressed data too large")
+	}
+	return data, nil
+}
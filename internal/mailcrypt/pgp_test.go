@@ -0,0 +1,138 @@
+package mailcrypt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gowebmail/internal/storage"
+)
+
+// Alice's key and Dave's encryption subkey, as gpg --list-keys shows them
+const (
+	aliceKeyID   = "B30ABF3C1CF6B7CA"
+	aliceFPR     = "549CCD0154F8B9B8DD08AB5CB30ABF3C1CF6B7CA"
+	daveSubkeyID = "E43D34759DD7AA21"
+)
+
+// encryptedPart returns the armored second part of a PGP/MIME vector
+func encryptedPart(t *testing.T, name string) []byte {
+	t.Helper()
+	raw := readTestdata(t, name)
+	start := bytes.Index(raw, []byte(pgpMessageBegin))
+	end := bytes.Index(raw, []byte(pgpMessageEnd))
+	if start < 0 || end < 0 {
+		t.Fatalf("%s has no armored message", name)
+	}
+	return raw[start : end+len(pgpMessageEnd)]
+}
+
+func TestDecryptPGP(t *testing.T) {
+	p := newTestProcessor(t)
+	for _, tc := range []struct {
+		name      string
+		recipient string
+		signed    bool
+	}{
+		{"pgp-rsa.eml", aliceKeyID, true},
+		{"pgp-cv25519.eml", daveSubkeyID, false},
+	} {
+		var security storage.Security
+		plaintext, err := p.decryptPGP(encryptedPart(t, tc.name), &security)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		want := "Content-Type: text/plain; charset=utf-8\r\n\r\nHello from PGP.\r\n"
+		if string(plaintext) != want {
+			t.Errorf("%s: plaintext %q, want %q", tc.name, plaintext, want)
+		}
+		if !security.Decrypted || len(security.Recipients) != 1 || security.Recipients[0] != tc.recipient {
+			t.Errorf("%s: got %+v", tc.name, security)
+		}
+		if security.Signed != tc.signed {
+			t.Errorf("%s: signed %v, want %v", tc.name, security.Signed, tc.signed)
+		}
+		if tc.signed && (len(security.Signatures) != 1 || security.Signatures[0].KeyID != aliceKeyID) {
+			t.Errorf("%s: signatures %+v", tc.name, security.Signatures)
+		}
+	}
+}
+
+func TestDecryptPGPRejectsTampering(t *testing.T) {
+	p := newTestProcessor(t)
+	data, err := dearmor(encryptedPart(t, "pgp-cv25519.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The encrypted data packet ends the message, and its modification
+	// detection code ends the packet
+	for _, tc := range []struct {
+		offset int
+		want   string
+	}{
+		{1, "message was modified"},
+		{30, "message was modified"},
+		{22, "missing modification detection code"},
+	} {
+		tampered := append([]byte(nil), data...)
+		tampered[len(tampered)-tc.offset] ^= 1
+		var security storage.Security
+		if _, err := p.decryptPGP(tampered, &security); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("byte %d from the end changed: got %v, want %q", tc.offset, err, tc.want)
+		}
+	}
+
+	// Truncated at any point, the message fails without a panic
+	for n := 0; n < len(data); n++ {
+		var security storage.Security
+		if _, err := p.decryptPGP(data[:n], &security); err == nil {
+			t.Errorf("truncated to %d bytes: decrypted", n)
+		}
+	}
+}
+
+func TestDecryptPGPNeedsKey(t *testing.T) {
+	p := &Processor{}
+	var security storage.Security
+	_, err := p.decryptPGP(encryptedPart(t, "pgp-rsa.eml"), &security)
+	if err == nil || !strings.Contains(err.Error(), "not encrypted to any configured PGP key") {
+		t.Errorf("got %v", err)
+	}
+	if len(security.Recipients) != 1 || security.Recipients[0] != aliceKeyID {
+		t.Errorf("recipients %q", security.Recipients)
+	}
+}
+
+func TestInspectPGPSigned(t *testing.T) {
+	security, content := newTestProcessor(t).inspect(readTestdata(t, "pgp-signed.eml"), 0)
+	if security == nil || security.Format != FormatPGP || !security.Signed || content != nil {
+		t.Fatalf("got %+v", security)
+	}
+	if len(security.Signatures) != 1 {
+		t.Fatalf("got %d signatures", len(security.Signatures))
+	}
+	sig := security.Signatures[0]
+	if sig.Result != ResultNone || sig.KeyID != aliceKeyID || sig.Fingerprint != aliceFPR ||
+		sig.Signer != "alice@example.com" || sig.Algorithm != "RSA-SHA512" {
+		t.Errorf("got %+v", sig)
+	}
+	if sig.SignedAt == nil || sig.SignedAt.Unix() != 1792145929 {
+		t.Errorf("signed at %v", sig.SignedAt)
+	}
+}
+
+func TestDescribePGPSignaturesRejectsGarbage(t *testing.T) {
+	for _, data := range []string{
+		"",
+		"-----BEGIN PGP SIGNATURE-----\n\niQ==\n",
+		"-----BEGIN PGP SIGNATURE-----\n\n!!!\n-----END PGP SIGNATURE-----\n",
+		"\x89\x01",
+		"\x88\x05\x04\x00\x01\x08\xff",
+	} {
+		if _, err := describePGPSignatures([]byte(data)); err == nil {
+			t.Errorf("%q: described", data)
+		}
+	}
+}
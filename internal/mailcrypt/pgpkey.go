@@ -0,0 +1,482 @@
+package mailcrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdh"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+
+	// Hashes of S2K and ECDH key derivation
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// Curves of ECDH keys, by the OIDs of their key packets
+var pgpCurves = map[string]ecdh.Curve{
+	"\x2b\x06\x01\x04\x01\x97\x55\x01\x05\x01": ecdh.X25519(),
+	"\x2a\x86\x48\xce\x3d\x03\x01\x07":         ecdh.P256(),
+	"\x2b\x81\x04\x00\x22":                     ecdh.P384(),
+	"\x2b\x81\x04\x00\x23":                     ecdh.P521(),
+}
+
+// pgpHashes maps the OpenPGP hash algorithms used for keys to hashes
+var pgpHashes = map[byte]crypto.Hash{
+	2: crypto.SHA1, 8: crypto.SHA256, 9: crypto.SHA384, 10: crypto.SHA512, 11: crypto.SHA224,
+}
+
+// pgpKey is a secret key or subkey that can decrypt session keys
+type pgpKey struct {
+	keyID       uint64
+	fingerprint []byte
+
+	rsa *rsa.PrivateKey
+
+	// ECDH (RFC 6637)
+	ecdh      *ecdh.PrivateKey
+	curveOID  []byte
+	kdfHash   crypto.Hash
+	kdfCipher byte
+}
+
+// loadPGPKeys loads the RSA and ECDH secret keys and subkeys of a key
+// file, decrypting them with passphrase if they are protected
+func loadPGPKeys(file, passphrase string) ([]*pgpKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = dearmor(data); err != nil {
+		return nil, err
+	}
+	packets, err := readPackets(data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed key: %w", err)
+	}
+
+	var keys []*pgpKey
+	for _, packet := range packets {
+		if packet.tag != tagSecretKey && packet.tag != tagSecretSubkey {
+			continue
+		}
+		key, err := parseSecretKey(packet.body, []byte(passphrase))
+		if err != nil {
+			return nil, err
+		}
+		if key != nil {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no RSA or ECDH secret key found")
+	}
+	return keys, nil
+}
+
+// mpiReader reads the fields of a key packet
+type mpiReader struct {
+	data []byte
+	err  error
+}
+
+func (r *mpiReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errors.New("truncated key")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *mpiReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+// mpi reads a multiprecision integer: a bit count and the octets holding
+// it
+func (r *mpiReader) mpi() []byte {
+	bits := r.bytes(2)
+	if bits == nil {
+		return nil
+	}
+	return r.bytes((int(binary.BigEndian.Uint16(bits)) + 7) / 8)
+}
+
+// oid reads a curve OID, prefixed with its length
+func (r *mpiReader) oid() []byte {
+	return r.bytes(int(r.byte()))
+}
+
+// parseSecretKey parses a version 4 secret key packet. Keys of other
+// algorithms and versions, and stubs without secret material, return nil.
+func parseSecretKey(body, passphrase []byte) (*pgpKey, error) {
+	if len(body) < 6 || body[0] != 4 {
+		return nil, nil
+	}
+	algorithm := body[5]
+	r := &mpiReader{data: body[6:]}
+	key := &pgpKey{}
+
+	var n, e []byte
+	switch algorithm {
+	case 1, 2:
+		n, e = r.mpi(), r.mpi()
+	case 18:
+		key.curveOID = r.oid()
+		r.mpi() // public point
+		if kdf := r.bytes(int(r.byte())); len(kdf) == 3 {
+			key.kdfHash, key.kdfCipher = pgpHashes[kdf[1]], kdf[2]
+		}
+	default:
+		return nil, nil
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// The fingerprint hashes the public part of the packet
+	public := body[:len(body)-len(r.data)]
+	h := sha1.New()
+	h.Write([]byte{0x99, byte(len(public) >> 8), byte(len(public))})
+	h.Write(public)
+	key.fingerprint = h.Sum(nil)
+	key.keyID = binary.BigEndian.Uint64(key.fingerprint[12:])
+
+	secret, err := unlockSecret(r, passphrase)
+	if err != nil || secret == nil {
+		return nil, err
+	}
+
+	s := &mpiReader{data: secret}
+	switch algorithm {
+	case 1, 2:
+		d, p, q := s.mpi(), s.mpi(), s.mpi()
+		if s.err != nil {
+			return nil, s.err
+		}
+		priv := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())},
+			D:         new(big.Int).SetBytes(d),
+			Primes:    []*big.Int{new(big.Int).SetBytes(p), new(big.Int).SetBytes(q)},
+		}
+		if err := priv.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid RSA key: %w", err)
+		}
+		priv.Precompute()
+		key.rsa = priv
+	case 18:
+		curve, ok := pgpCurves[string(key.curveOID)]
+		if !ok || key.kdfHash == 0 {
+			return nil, nil
+		}
+		scalar := s.mpi()
+		if s.err != nil {
+			return nil, s.err
+		}
+		size := 32
+		switch curve {
+		case ecdh.P384():
+			size = 48
+		case ecdh.P521():
+			size = 66
+		}
+		if len(scalar) > size {
+			return nil, errors.New("invalid ECDH key")
+		}
+		scalar = append(make([]byte, size-len(scalar)), scalar...)
+		// Curve25519 secrets are stored in reverse, big-endian order
+		if curve == ecdh.X25519() {
+			slices.Reverse(scalar)
+		}
+		if key.ecdh, err = curve.NewPrivateKey(scalar); err != nil {
+			return nil, fmt.Errorf("invalid ECDH key: %w", err)
+		}
+	}
+	return key, nil
+}
+
+// unlockSecret returns the secret key material following the public part
+// read by r, decrypted with passphrase if it is protected. Stubs, such as
+// keys on a smart card, return nil.
+func unlockSecret(r *mpiReader, passphrase []byte) ([]byte, error) {
+	usage := r.byte()
+	if usage == 0 {
+		// Unprotected, followed by a two-octet checksum
+		if len(r.data) < 2 {
+			return nil, errors.New("truncated key")
+		}
+		return r.data[:len(r.data)-2], r.err
+	}
+	if usage != 254 && usage != 255 {
+		return nil, errors.New("unsupported secret key protection")
+	}
+
+	cipherID := r.byte()
+	s2kType, hashID := r.byte(), r.byte()
+	var salt []byte
+	count := 0
+	switch s2kType {
+	case 0:
+	case 1:
+		salt = r.bytes(8)
+	case 3:
+		salt = r.bytes(8)
+		c := int(r.byte())
+		count = (16 + c&15) << (c>>4 + 6)
+	case 101:
+		// GNU extension for keys without secret material
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported S2K type %d", s2kType)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	hash, ok := pgpHashes[hashID]
+	if !ok {
+		return nil, fmt.Errorf("unsupported S2K hash %d", hashID)
+	}
+	keySize, ok := pgpKeySizes[cipherID]
+	if !ok {
+		return nil, fmt.Errorf("unsupported key cipher %d", cipherID)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("key is protected; a passphrase is required")
+	}
+
+	key := deriveS2K(keySize, passphrase, hash, salt, count)
+	block, err := pgpCipher(cipherID, key)
+	if err != nil {
+		return nil, err
+	}
+	iv := r.bytes(block.BlockSize())
+	if r.err != nil {
+		return nil, r.err
+	}
+	secret := make([]byte, len(r.data))
+	cipher.NewCFBDecrypter(block, iv).XORKeyStream(secret, r.data)
+
+	// A SHA-1 hash or a checksum of the material follows it
+	if usage == 254 {
+		if len(secret) < sha1.Size {
+			return nil, errors.New("truncated key")
+		}
+		material := secret[:len(secret)-sha1.Size]
+		sum := sha1.Sum(material)
+		if subtle.ConstantTimeCompare(sum[:], secret[len(material):]) != 1 {
+			return nil, errors.New("wrong passphrase")
+		}
+		return material, nil
+	}
+	if len(secret) < 2 {
+		return nil, errors.New("truncated key")
+	}
+	material := secret[:len(secret)-2]
+	if checksum(material) != binary.BigEndian.Uint16(secret[len(material):]) {
+		return nil, errors.New("wrong passphrase")
+	}
+	return material, nil
+}
+
+// deriveS2K derives a key of size octets from a passphrase (RFC 4880,
+// 3.7.1). Keys longer than a hash are made of several, each preloaded
+// with one more zero octet.
+func deriveS2K(size int, passphrase []byte, hash crypto.Hash, salt []byte, count int) []byte {
+	input := append(append([]byte(nil), salt...), passphrase...)
+	if count < len(input) {
+		count = len(input)
+	}
+	key := make([]byte, 0, size)
+	for i := 0; len(key) < size; i++ {
+		h := hash.New()
+		h.Write(make([]byte, i))
+		for remaining := count; remaining > 0; {
+			n := min(remaining, len(input))
+			h.Write(input[:n])
+			remaining -= n
+		}
+		key = h.Sum(key)
+	}
+	return key[:size]
+}
+
+// pgpKeySizes are the key sizes of the supported OpenPGP ciphers
+var pgpKeySizes = map[byte]int{2: 24, 7: 16, 8: 24, 9: 32}
+
+// pgpCipher returns the block cipher of an OpenPGP cipher ID
+func pgpCipher(cipherID byte, key []byte) (cipher.Block, error) {
+	size, ok := pgpKeySizes[cipherID]
+	if !ok {
+		return nil, fmt.Errorf("unsupported cipher %d", cipherID)
+	}
+	if len(key) != size {
+		return nil, errors.New("key has the wrong size")
+	}
+	if cipherID == 2 {
+		return des.NewTripleDESCipher(key)
+	}
+	return aes.NewCipher(key)
+}
+
+// checksum is the sum of octets modulo 65536 that follows session keys and
+// unprotected secret keys
+func checksum(data []byte) uint16 {
+	var sum uint16
+	for _, b := range data {
+		sum += uint16(b)
+	}
+	return sum
+}
+
+// decryptSessionKey decrypts the session key of a public-key encrypted
+// session key packet, with fields following its algorithm
+func (k *pgpKey) decryptSessionKey(algorithm byte, fields []byte) (byte, []byte, error) {
+	r := &mpiReader{data: fields}
+	var decoded []byte
+	switch {
+	case (algorithm == 1 || algorithm == 2) && k.rsa != nil:
+		c := r.mpi()
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		size := k.rsa.Size()
+		if len(c) > size {
+			return 0, nil, errors.New("invalid session key")
+		}
+		var err error
+		decoded, err = rsa.DecryptPKCS1v15(nil, k.rsa, append(make([]byte, size-len(c)), c...))
+		if err != nil {
+			return 0, nil, err
+		}
+	case algorithm == 18 && k.ecdh != nil:
+		point := r.mpi()
+		wrapped := r.bytes(int(r.byte()))
+		if r.err != nil {
+			return 0, nil, r.err
+		}
+		var err error
+		if decoded, err = k.unwrapECDH(point, wrapped); err != nil {
+			return 0, nil, err
+		}
+	default:
+		return 0, nil, errors.New("session key is for another key type")
+	}
+
+	// Cipher ID, key, checksum
+	if len(decoded) < 4 {
+		return 0, nil, errors.New("invalid session key")
+	}
+	cipherID, key := decoded[0], decoded[1:len(decoded)-2]
+	if checksum(key) != binary.BigEndian.Uint16(decoded[len(decoded)-2:]) {
+		return 0, nil, errors.New("session key checksum mismatch")
+	}
+	return cipherID, key, nil
+}
+
+// unwrapECDH derives the key encryption key shared with the ephemeral
+// point of a session key, and unwraps the session key with it (RFC 6637)
+func (k *pgpKey) unwrapECDH(point, wrapped []byte) ([]byte, error) {
+	// Curve25519 points are prefixed with 0x40
+	if k.ecdh.Curve() == ecdh.X25519() {
+		if len(point) != 33 || point[0] != 0x40 {
+			return nil, errors.New("invalid ephemeral point")
+		}
+		point = point[1:]
+	}
+	ephemeral, err := k.ecdh.Curve().NewPublicKey(point)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral point: %w", err)
+	}
+	shared, err := k.ecdh.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	kekSize, ok := pgpKeySizes[k.kdfCipher]
+	if !ok || k.kdfCipher == 2 {
+		return nil, fmt.Errorf("unsupported key wrap cipher %d", k.kdfCipher)
+	}
+	var param bytes.Buffer
+	param.WriteByte(byte(len(k.curveOID)))
+	param.Write(k.curveOID)
+	param.Write([]byte{18, 3, 1, hashID(k.kdfHash), k.kdfCipher})
+	param.WriteString("Anonymous Sender    ")
+	param.Write(k.fingerprint)
+
+	h := k.kdfHash.New()
+	h.Write([]byte{0, 0, 0, 1})
+	h.Write(shared)
+	h.Write(param.Bytes())
+	kek := h.Sum(nil)
+	if len(kek) < kekSize {
+		return nil, errors.New("key derivation hash too short")
+	}
+
+	key, err := aesKeyUnwrap(kek[:kekSize], wrapped)
+	if err != nil {
+		return nil, err
+	}
+	// PKCS #5 padding
+	pad := int(key[len(key)-1])
+	if pad == 0 || pad > len(key) {
+		return nil, errors.New("invalid session key padding")
+	}
+	return key[:len(key)-pad], nil
+}
+
+// hashID returns the OpenPGP ID of a hash
+func hashID(hash crypto.Hash) byte {
+	for id, h := range pgpHashes {
+		if h == hash {
+			return id
+		}
+	}
+	return 0
+}
+
+// aesKeyUnwrap unwraps a key wrapped with AES (RFC 3394)
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, errors.New("wrapped key has the wrong size")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := binary.BigEndian.Uint64(wrapped)
+	r := make([]byte, n*8)
+	copy(r, wrapped[8:])
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			binary.BigEndian.PutUint64(buf, a^uint64(n*j+i))
+			copy(buf[8:], r[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			a = binary.BigEndian.Uint64(buf)
+			copy(r[(i-1)*8:i*8], buf[8:])
+		}
+	}
+	if a != 0xa6a6a6a6a6a6a6a6 {
+		return nil, errors.New("key unwrap failed")
+	}
+	return r, nil
+}
@@ -0,0 +1,591 @@
+package mailcrypt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"gowebmail/internal/storage"
+)
+
+// Object identifiers of CMS (RFC 5652) and its algorithms
+var (
+	oidSignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidAuthEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 23}
+
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidEmailAddress  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidRSAESOAEP     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidRSASSAPSS     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 10}
+)
+
+// digestAlgorithms maps the OIDs of digest algorithms to hashes
+var digestAlgorithms = map[string]crypto.Hash{
+	"1.3.14.3.2.26":          crypto.SHA1,
+	"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+	"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+	"2.16.840.1.101.3.4.2.4": crypto.SHA224,
+}
+
+// contentCipher is a content encryption algorithm
+type contentCipher struct {
+	keySize int
+	gcm     bool
+	block   func(key []byte) (cipher.Block, error)
+}
+
+// contentCiphers maps the OIDs of content encryption algorithms to them
+var contentCiphers = map[string]contentCipher{
+	"2.16.840.1.101.3.4.1.2":  {16, false, aes.NewCipher},
+	"2.16.840.1.101.3.4.1.22": {24, false, aes.NewCipher},
+	"2.16.840.1.101.3.4.1.42": {32, false, aes.NewCipher},
+	"2.16.840.1.101.3.4.1.6":  {16, true, aes.NewCipher},
+	"2.16.840.1.101.3.4.1.26": {24, true, aes.NewCipher},
+	"2.16.840.1.101.3.4.1.46": {32, true, aes.NewCipher},
+	"1.2.840.113549.3.7":      {24, false, des.NewTripleDESCipher},
+}
+
+// contentInfo is a ContentInfo or EncapsulatedContentInfo. Its content is
+// explicitly tagged, and is the value inside the tag.
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo contentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+type envelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+	UnprotectedAttrs     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type authEnvelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+	AuthAttrs            asn1.RawValue `asn1:"optional,tag:1"`
+	MAC                  []byte
+	UnauthAttrs          asn1.RawValue `asn1:"optional,tag:2"`
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type gcmParameters struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+type oaepParameters struct {
+	Hash pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:0"`
+}
+
+// smimeKey is the certificate and private key of an S/MIME recipient
+type smimeKey struct {
+	cert *x509.Certificate
+	key  crypto.PrivateKey
+}
+
+// loadSMIMEKey loads a PEM certificate and the private key that goes with
+// it
+func loadSMIMEKey(certFile, keyFile string) (*smimeKey, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := pair.PrivateKey.(*rsa.PrivateKey); !ok {
+		return nil, errors.New("only RSA keys are supported")
+	}
+	return &smimeKey{cert: pair.Leaf, key: pair.PrivateKey}, nil
+}
+
+// parseContentInfo parses a CMS ContentInfo, which may be encoded as BER
+func parseContentInfo(data []byte) (*contentInfo, error) {
+	der, err := berToDER(data)
+	if err != nil {
+		return nil, err
+	}
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, err
+	}
+	return &ci, nil
+}
+
+// octets returns the content of an OCTET STRING, which BER may split into
+// a constructed string of segments
+func octets(v asn1.RawValue) ([]byte, error) {
+	if !v.IsCompound {
+		return v.Bytes, nil
+	}
+	var out []byte
+	rest := v.Bytes
+	for len(rest) > 0 {
+		var segment asn1.RawValue
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &segment); err != nil {
+			return nil, err
+		}
+		data, err := octets(segment)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, data...)
+	}
+	return out, nil
+}
+
+// verifyDetached verifies the S/MIME signature of the signed part of a
+// multipart/signed email
+func verifyDetached(signature, content []byte) ([]*storage.Signature, error) {
+	ci, err := parseContentInfo(signature)
+	if err != nil {
+		return nil, fmt.Errorf("malformed S/MIME signature: %w", err)
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("S/MIME signature is not signed data")
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("malformed S/MIME signature: %w", err)
+	}
+	return verifySignedData(&sd, content), nil
+}
+
+// verifySignedData verifies every signer of content
+func verifySignedData(sd *signedData, content []byte) []*storage.Signature {
+	var certs []*x509.Certificate
+	if len(sd.Certificates.Bytes) > 0 {
+		// Other kinds of certificates in the set are not parsed
+		certs, _ = x509.ParseCertificates(sd.Certificates.Bytes)
+	}
+
+	signatures := make([]*storage.Signature, 0, len(sd.SignerInfos))
+	for i := range sd.SignerInfos {
+		signatures = append(signatures, verifySigner(&sd.SignerInfos[i], certs, content))
+	}
+	return signatures
+}
+
+// verifySigner verifies the signature of one signer, with the certificate
+// it identifies
+func verifySigner(si *signerInfo, certs []*x509.Certificate, content []byte) *storage.Signature {
+	sig := &storage.Signature{Result: ResultFail}
+	cert := findSigner(si.SID, certs)
+	if cert == nil {
+		sig.Result = ResultNone
+		sig.Reason = "signer certificate not included"
+		return sig
+	}
+	describeCertificate(sig, cert)
+
+	hash, ok := digestAlgorithms[si.DigestAlgorithm.Algorithm.String()]
+	if !ok || !hash.Available() {
+		sig.Result = ResultNone
+		sig.Reason = fmt.Sprintf("unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+		return sig
+	}
+	sig.Algorithm = keyAlgorithm(cert.PublicKey) + "-" + strings.ReplaceAll(hash.String(), "-", "")
+
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+	signed := content
+
+	// With signed attributes, the signature covers them, and they cover
+	// the content with its digest
+	if len(si.SignedAttrs.FullBytes) > 0 {
+		attrsDER := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+		var attrs []attribute
+		if _, err := asn1.UnmarshalWithParams(attrsDER, &attrs, "set"); err != nil {
+			sig.Reason = fmt.Sprintf("malformed signed attributes: %v", err)
+			return sig
+		}
+		var messageDigest []byte
+		for _, attr := range attrs {
+			switch {
+			case attr.Type.Equal(oidMessageDigest):
+				asn1.Unmarshal(attr.Values.Bytes, &messageDigest)
+			case attr.Type.Equal(oidSigningTime):
+				var t time.Time
+				if _, err := asn1.Unmarshal(attr.Values.Bytes, &t); err == nil {
+					sig.SignedAt = &t
+				}
+			}
+		}
+		if !bytes.Equal(messageDigest, digest) {
+			sig.Reason = "content does not match the signed digest"
+			return sig
+		}
+		h = hash.New()
+		h.Write(attrsDER)
+		digest = h.Sum(nil)
+		signed = attrsDER
+	}
+
+	if err := checkSignature(cert.PublicKey, hash, digest, signed, si.Signature, si.SignatureAlgorithm.Algorithm.Equal(oidRSASSAPSS)); err != nil {
+		sig.Reason = fmt.Sprintf("signature does not verify: %v", err)
+		return sig
+	}
+	sig.Result = ResultPass
+	return sig
+}
+
+// checkSignature verifies sig of the digest of signed, or of signed itself
+// for Ed25519
+func checkSignature(pub crypto.PublicKey, hash crypto.Hash, digest, signed, sig []byte, pss bool) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if pss {
+			return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return errors.New("ECDSA verification failure")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(pub, signed, sig) {
+			return errors.New("Ed25519 verification failure")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key %T", pub)
+}
+
+// findSigner returns the certificate named by a signer or recipient
+// identifier: an issuer and serial number, or a subject key identifier
+func findSigner(sid asn1.RawValue, certs []*x509.Certificate) *x509.Certificate {
+	for _, cert := range certs {
+		if matchesIdentifier(sid, cert) {
+			return cert
+		}
+	}
+	return nil
+}
+
+// matchesIdentifier reports whether a signer or recipient identifier
+// names cert
+func matchesIdentifier(id asn1.RawValue, cert *x509.Certificate) bool {
+	if id.Class == asn1.ClassContextSpecific && id.Tag == 0 {
+		return len(cert.SubjectKeyId) > 0 && bytes.Equal(id.Bytes, cert.SubjectKeyId)
+	}
+	var ias issuerAndSerial
+	if _, err := asn1.Unmarshal(id.FullBytes, &ias); err != nil || ias.Serial == nil {
+		return false
+	}
+	return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.Serial.Cmp(cert.SerialNumber) == 0
+}
+
+// describeIdentifier describes a recipient identifier for display
+func describeIdentifier(id asn1.RawValue) string {
+	if id.Class == asn1.ClassContextSpecific && id.Tag == 0 {
+		return "subject key " + hex.EncodeToString(id.Bytes)
+	}
+	var ias issuerAndSerial
+	if _, err := asn1.Unmarshal(id.FullBytes, &ias); err != nil || ias.Serial == nil {
+		return "unknown"
+	}
+	var rdn pkix.RDNSequence
+	var issuer pkix.Name
+	if _, err := asn1.Unmarshal(ias.Issuer.FullBytes, &rdn); err == nil {
+		issuer.FillFromRDNSequence(&rdn)
+	}
+	return fmt.Sprintf("serial %X, issuer %s", ias.Serial, issuer.String())
+}
+
+// describeCertificate fills the certificate fields of a signature
+func describeCertificate(sig *storage.Signature, cert *x509.Certificate) {
+	sig.Signer = certificateSigner(cert)
+	sig.KeyID = fmt.Sprintf("%X", cert.SerialNumber)
+	fingerprint := sha256.Sum256(cert.Raw)
+	sig.Fingerprint = strings.ToUpper(hex.EncodeToString(fingerprint[:]))
+	sig.Subject = cert.Subject.String()
+	sig.Issuer = cert.Issuer.String()
+	notBefore, notAfter := cert.NotBefore, cert.NotAfter
+	sig.NotBefore, sig.NotAfter = &notBefore, &notAfter
+}
+
+// certificateSigner returns the email address of a certificate, or its
+// common name
+func certificateSigner(cert *x509.Certificate) string {
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+	for _, name := range cert.Subject.Names {
+		if address, ok := name.Value.(string); ok && name.Type.Equal(oidEmailAddress) {
+			return address
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+// keyAlgorithm names the algorithm of a public key
+func keyAlgorithm(pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		return "RSA"
+	case *ecdsa.PublicKey:
+		return "ECDSA"
+	case ed25519.PublicKey:
+		return "Ed25519"
+	}
+	return "unknown"
+}
+
+// openSMIME reads an application/pkcs7-mime body: it verifies signed data
+// and decrypts enveloped data, and returns the content inside
+func (p *Processor) openSMIME(data []byte, security *storage.Security) ([]byte, error) {
+	ci, err := parseContentInfo(data)
+	if err != nil {
+		return nil, fmt.Errorf("malformed S/MIME content: %w", err)
+	}
+
+	switch {
+	case ci.ContentType.Equal(oidSignedData):
+		security.Signed = true
+		var sd signedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+			return nil, fmt.Errorf("malformed S/MIME signed data: %w", err)
+		}
+		var eContent asn1.RawValue
+		if _, err := asn1.Unmarshal(sd.EncapContentInfo.Content.Bytes, &eContent); err != nil {
+			return nil, errors.New("S/MIME signed data has no content")
+		}
+		content, err := octets(eContent)
+		if err != nil || len(content) == 0 {
+			return nil, errors.New("S/MIME signed data has no content")
+		}
+		security.Signatures = verifySignedData(&sd, content)
+		return content, nil
+
+	case ci.ContentType.Equal(oidEnvelopedData):
+		security.Encrypted = true
+		var ed envelopedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+			return nil, fmt.Errorf("malformed S/MIME enveloped data: %w", err)
+		}
+		key, err := p.recipientKey(ed.RecipientInfos, security)
+		if err != nil {
+			return nil, err
+		}
+		content, err := decryptContent(&ed.EncryptedContentInfo, key, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		security.Decrypted = true
+		return content, nil
+
+	case ci.ContentType.Equal(oidAuthEnvelopedData):
+		security.Encrypted = true
+		var ed authEnvelopedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+			return nil, fmt.Errorf("malformed S/MIME enveloped data: %w", err)
+		}
+		key, err := p.recipientKey(ed.RecipientInfos, security)
+		if err != nil {
+			return nil, err
+		}
+		var aad []byte
+		if len(ed.AuthAttrs.FullBytes) > 0 {
+			aad = append([]byte{0x31}, ed.AuthAttrs.FullBytes[1:]...)
+		}
+		content, err := decryptContent(&ed.EncryptedContentInfo, key, aad, ed.MAC)
+		if err != nil {
+			return nil, err
+		}
+		security.Decrypted = true
+		return content, nil
+	}
+	return nil, fmt.Errorf("unsupported S/MIME content type %s", ci.ContentType)
+}
+
+// recipientKey lists the recipients of enveloped data in security, and
+// decrypts the content encryption key with the key of one of them
+func (p *Processor) recipientKey(infos []asn1.RawValue, security *storage.Security) ([]byte, error) {
+	var key []byte
+	var lastErr error
+	for _, info := range infos {
+		// Recipients by key agreement, password and so on are skipped
+		if info.Class != asn1.ClassUniversal || info.Tag != asn1.TagSequence {
+			security.Recipients = append(security.Recipients, "unsupported recipient type")
+			continue
+		}
+		var ktri keyTransRecipientInfo
+		if _, err := asn1.Unmarshal(info.FullBytes, &ktri); err != nil {
+			continue
+		}
+		security.Recipients = append(security.Recipients, describeIdentifier(ktri.RID))
+		if key != nil {
+			continue
+		}
+		for _, k := range p.smime {
+			if !matchesIdentifier(ktri.RID, k.cert) {
+				continue
+			}
+			if key, lastErr = decryptKey(&ktri, k.key.(*rsa.PrivateKey)); key != nil {
+				break
+			}
+		}
+	}
+	if key != nil {
+		return key, nil
+	}
+	if lastErr != nil {
+		return nil, fmt.Errorf("failed to decrypt content key: %w", lastErr)
+	}
+	return nil, errors.New("not encrypted to any configured S/MIME key")
+}
+
+// decryptKey decrypts a content encryption key with an RSA key
+func decryptKey(ktri *keyTransRecipientInfo, key *rsa.PrivateKey) ([]byte, error) {
+	switch algorithm := ktri.KeyEncryptionAlgorithm; {
+	case algorithm.Algorithm.Equal(oidRSAEncryption):
+		return rsa.DecryptPKCS1v15(nil, key, ktri.EncryptedKey)
+	case algorithm.Algorithm.Equal(oidRSAESOAEP):
+		hash := crypto.SHA1
+		var params oaepParameters
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err == nil && params.Hash.Algorithm != nil {
+			if h, ok := digestAlgorithms[params.Hash.Algorithm.String()]; ok {
+				hash = h
+			}
+		}
+		return rsa.DecryptOAEP(hash.New(), nil, key, ktri.EncryptedKey, nil)
+	default:
+		return nil, fmt.Errorf("unsupported key encryption algorithm %s", algorithm.Algorithm)
+	}
+}
+
+// decryptContent decrypts encrypted content with its content encryption
+// key. AES-GCM content of authenticated enveloped data is checked with its
+// MAC and the authenticated attributes aad.
+func decryptContent(eci *encryptedContentInfo, key, aad, mac []byte) ([]byte, error) {
+	alg, ok := contentCiphers[eci.ContentEncryptionAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported content encryption algorithm %s", eci.ContentEncryptionAlgorithm.Algorithm)
+	}
+	if len(key) != alg.keySize {
+		return nil, errors.New("content key has the wrong size")
+	}
+	ciphertext, err := octets(eci.EncryptedContent)
+	if err != nil {
+		return nil, fmt.Errorf("malformed encrypted content: %w", err)
+	}
+	block, err := alg.block(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if alg.gcm {
+		var params gcmParameters
+		if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("malformed GCM parameters: %w", err)
+		}
+		aead, err := cipher.NewGCMWithNonceSize(block, len(params.Nonce))
+		if err != nil {
+			return nil, err
+		}
+		if params.ICVLen != aead.Overhead() || len(mac) != aead.Overhead() {
+			return nil, errors.New("unsupported GCM tag size")
+		}
+		content, err := aead.Open(nil, params.Nonce, append(ciphertext, mac...), aad)
+		if err != nil {
+			return nil, errors.New("content fails authentication")
+		}
+		return content, nil
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil || len(iv) != block.BlockSize() {
+		return nil, errors.New("malformed content encryption IV")
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("encrypted content has the wrong size")
+	}
+	content := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(content, ciphertext)
+
+	// PKCS #7 padding
+	pad := int(content[len(content)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errors.New("invalid content padding")
+	}
+	for _, b := range content[len(content)-pad:] {
+		if int(b) != pad {
+			return nil, errors.New("invalid content padding")
+		}
+	}
+	return content[:len(content)-pad], nil
+}
@@ -0,0 +1,208 @@
+package mailcrypt
+
+import (
+	"bytes"
+	"mime"
+	"strings"
+	"testing"
+
+	"gowebmail/internal/storage"
+)
+
+// signedParts returns the signed part and the DER signature of a
+// multipart/signed vector
+func signedParts(t *testing.T, raw []byte) ([]byte, []byte) {
+	t.Helper()
+	header, body, ok := splitEntity(raw)
+	if !ok {
+		t.Fatal("message does not parse")
+	}
+	_, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := splitMultipart(body, params["boundary"])
+	if len(parts) != 2 {
+		t.Fatalf("got %d parts, want 2", len(parts))
+	}
+	signature, err := decodedBody(parts[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parts[0], signature
+}
+
+func TestInspectSMIMESigned(t *testing.T) {
+	p := newTestProcessor(t)
+	for _, tc := range []struct {
+		name      string
+		signer    string
+		algorithm string
+	}{
+		{"smime-signed.eml", "alice@example.com", "RSA-SHA256"},
+		{"smime-signed-ecdsa.eml", "carol@example.com", "ECDSA-SHA256"},
+	} {
+		security, content := p.inspect(readTestdata(t, tc.name), 0)
+		if security == nil || !security.Signed || security.Encrypted || security.Format != FormatSMIME {
+			t.Errorf("%s: got %+v", tc.name, security)
+			continue
+		}
+		if content != nil {
+			t.Errorf("%s: detached signature returned content", tc.name)
+		}
+		if len(security.Signatures) != 1 {
+			t.Errorf("%s: got %d signatures", tc.name, len(security.Signatures))
+			continue
+		}
+		sig := security.Signatures[0]
+		if sig.Result != ResultPass || sig.Signer != tc.signer || sig.Algorithm != tc.algorithm {
+			t.Errorf("%s: got %s by %s with %s (%s)", tc.name, sig.Result, sig.Signer, sig.Algorithm, sig.Reason)
+		}
+		if sig.SignedAt == nil || sig.NotAfter == nil || sig.Fingerprint == "" {
+			t.Errorf("%s: signing time or certificate missing: %+v", tc.name, sig)
+		}
+	}
+}
+
+func TestVerifyDetachedRejectsTampering(t *testing.T) {
+	raw := readTestdata(t, "smime-signed.eml")
+	content, signature := signedParts(t, raw)
+
+	for _, tc := range []struct {
+		name      string
+		content   []byte
+		signature []byte
+		reason    string
+	}{
+		{
+			name:      "content changed",
+			content:   bytes.Replace(content, []byte("Hello"), []byte("Hallo"), 1),
+			signature: signature,
+			reason:    "content does not match the signed digest",
+		},
+		{
+			name:      "content with LF line endings",
+			content:   bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n")),
+			signature: signature,
+			reason:    "content does not match the signed digest",
+		},
+		{
+			// The RSA signature value ends the SignerInfo, and the
+			// message
+			name:      "signature changed",
+			content:   content,
+			signature: append(append([]byte(nil), signature[:len(signature)-1]...), signature[len(signature)-1]^1),
+			reason:    "signature does not verify",
+		},
+	} {
+		signatures, err := verifyDetached(tc.signature, tc.content)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if len(signatures) != 1 || signatures[0].Result != ResultFail || !strings.Contains(signatures[0].Reason, tc.reason) {
+			t.Errorf("%s: got %+v, want a failure with %q", tc.name, signatures[0], tc.reason)
+		}
+	}
+
+	// The whole message tampered with fails the same way
+	security, _ := newTestProcessor(t).inspect(bytes.Replace(raw, []byte("Hello from"), []byte("Hello frum"), 1), 0)
+	if security == nil || len(security.Signatures) != 1 || security.Signatures[0].Result != ResultFail {
+		t.Errorf("tampered message: got %+v", security)
+	}
+
+	if _, err := verifyDetached([]byte("not a signature"), content); err == nil {
+		t.Error("garbage accepted as a signature")
+	}
+}
+
+func TestInspectSMIMEOpaque(t *testing.T) {
+	p := newTestProcessor(t)
+	security, content := p.inspect(readTestdata(t, "smime-opaque.eml"), 0)
+	if security == nil || !security.Signed || len(security.Signatures) != 1 || security.Signatures[0].Result != ResultPass {
+		t.Fatalf("got %+v", security)
+	}
+	want := "Content-Type: text/plain; charset=utf-8\r\n\r\nHello from S/MIME.\r\n"
+	if string(content) != want {
+		t.Errorf("content %q, want %q", content, want)
+	}
+
+	// The BER that OpenSSL streams and its DER re-encoding read the same
+	der := readTestdata(t, "smime-opaque.der")
+	var fromDER storage.Security
+	derContent, err := p.openSMIME(der, &fromDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(derContent) != want || len(fromDER.Signatures) != 1 || fromDER.Signatures[0].Result != ResultPass {
+		t.Errorf("DER: got %q, %+v", derContent, fromDER.Signatures)
+	}
+}
+
+func TestInspectSMIMEEncrypted(t *testing.T) {
+	p := newTestProcessor(t)
+	want := "Content-Type: text/plain; charset=utf-8\r\n\r\nHello from S/MIME.\r\n"
+	for _, name := range []string{"smime-aes256.eml", "smime-des3.eml", "smime-oaep.eml", "smime-gcm.eml"} {
+		security, content := p.inspect(readTestdata(t, name), 0)
+		if security == nil || !security.Encrypted || !security.Decrypted || security.Signed {
+			t.Errorf("%s: got %+v", name, security)
+			continue
+		}
+		if string(content) != want {
+			t.Errorf("%s: content %q, want %q", name, content, want)
+		}
+		if len(security.Recipients) != 1 || !strings.Contains(security.Recipients[0], "CN=Alice") {
+			t.Errorf("%s: recipients %q", name, security.Recipients)
+		}
+	}
+
+	security, content := p.inspect(readTestdata(t, "smime-bob.eml"), 0)
+	if security == nil || !security.Encrypted || security.Decrypted || content != nil {
+		t.Fatalf("encrypted to Bob: got %+v", security)
+	}
+	if !strings.Contains(security.Recipients[0], "CN=Bob") || !strings.Contains(security.Reason, "not encrypted to any configured S/MIME key") {
+		t.Errorf("encrypted to Bob: got %q, %q", security.Recipients, security.Reason)
+	}
+}
+
+func TestInspectSMIMESignedAndEncrypted(t *testing.T) {
+	security, content := newTestProcessor(t).inspect(readTestdata(t, "smime-signed-encrypted.eml"), 0)
+	if security == nil || !security.Encrypted || !security.Decrypted || !security.Signed {
+		t.Fatalf("got %+v", security)
+	}
+	if len(security.Signatures) != 1 || security.Signatures[0].Result != ResultPass {
+		t.Errorf("signatures %+v", security.Signatures)
+	}
+	// The signed layer is readable as it is: its first part is the text
+	if !bytes.Contains(content, []byte("multipart/signed")) || !bytes.Contains(content, []byte("Hello from S/MIME.")) {
+		t.Errorf("content %q", content)
+	}
+}
+
+func TestOpenSMIMERejectsTampering(t *testing.T) {
+	p := newTestProcessor(t)
+
+	// GCM content fails authentication when its MAC, at the end of the
+	// DER, is changed
+	gcm, err := decodedBody(readTestdata(t, "smime-gcm.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm[len(gcm)-1] ^= 1
+	var security storage.Security
+	if _, err := p.openSMIME(gcm, &security); err == nil || !strings.Contains(err.Error(), "fails authentication") {
+		t.Errorf("GCM: got %v", err)
+	}
+
+	// Changed CBC ciphertext decrypts to garbage, whose padding may be
+	// wrong; it never panics
+	cbc, err := decodedBody(readTestdata(t, "smime-aes256.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := len(cbc) - 32; i < len(cbc); i++ {
+		tampered := append([]byte(nil), cbc...)
+		tampered[i] ^= 0x80
+		p.openSMIME(tampered, &storage.Security{})
+	}
+}
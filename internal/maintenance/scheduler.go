@@ -0,0 +1,122 @@
+package maintenance
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// Status reports what maintenance has done since the server started
+type Status struct {
+	Enabled        bool                       `json:"enabled"`
+	Interval       string                     `json:"interval"`
+	Runs           int64                      `json:"runs"`
+	ReclaimedBytes int64                      `json:"reclaimedBytes"`
+	LastError      string                     `json:"lastError,omitempty"`
+	Last           *storage.MaintenanceResult `json:"last,omitempty"`
+}
+
+// Manager runs database maintenance on a schedule
+type Manager struct {
+	config  *config.MaintenanceConfig
+	storage storage.Storage
+	logger  zerolog.Logger
+	stop    chan struct{}
+	done    chan struct{}
+
+	mu     sync.Mutex
+	status Status
+}
+
+// NewManager creates a new maintenance manager
+func NewManager(cfg *config.MaintenanceConfig, store storage.Storage, logger zerolog.Logger) *Manager {
+	return &Manager{
+		config:  cfg,
+		storage: store,
+		logger:  logger,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+		status: Status{
+			Enabled:  cfg.Enabled,
+			Interval: cfg.Interval.String(),
+		},
+	}
+}
+
+// Start runs maintenance every configured interval until stopped
+func (m *Manager) Start(ctx context.Context) {
+	defer close(m.done)
+
+	if !m.config.Enabled || m.config.Interval <= 0 {
+		m.logger.Info().Msg("Scheduled database maintenance disabled")
+		return
+	}
+
+	m.logger.Info().
+		Dur("interval", m.config.Interval).
+		Bool("incremental_vacuum", m.config.IncrementalVacuum).
+		Bool("analyze", m.config.Analyze).
+		Msg("Starting database maintenance scheduler")
+
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.Run()
+		case <-m.stop:
+			m.logger.Info().Msg("Database maintenance scheduler stopped")
+			return
+		case <-ctx.Done():
+			m.logger.Info().Msg("Database maintenance scheduler context cancelled")
+			return
+		}
+	}
+}
+
+// Stop stops the maintenance scheduler
+func (m *Manager) Stop() {
+	close(m.stop)
+	<-m.done
+}
+
+// Run performs a maintenance pass immediately
+func (m *Manager) Run() (*storage.MaintenanceResult, error) {
+	result, err := m.storage.Maintain(m.config.IncrementalVacuum, m.config.Analyze)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.status.LastError = err.Error()
+		m.logger.Error().Err(err).Msg("Database maintenance failed")
+		return nil, err
+	}
+
+	m.status.Runs++
+	m.status.ReclaimedBytes += result.ReclaimedBytes
+	m.status.LastError = ""
+	m.status.Last = result
+
+	m.logger.Info().
+		Int64("reclaimed_bytes", result.ReclaimedBytes).
+		Int64("wal_bytes", result.WALBytesAfter).
+		Int64("free_pages", result.FreePagesAfter).
+		Int64("duration_ms", result.DurationMs).
+		Msg("Database maintenance completed")
+
+	return result, nil
+}
+
+// Status returns the maintenance history
+func (m *Manager) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
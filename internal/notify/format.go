@@ -0,0 +1,120 @@
+package notify
+
+import (
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// message returns the webhook payload announcing an email in the format
+// of a chat service: slack, discord or teams. link may be empty.
+func message(kind string, email *storage.Email, link string) interface{} {
+	subject := email.Subject
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	to := strings.Join(email.To, ", ")
+	if to == "" {
+		to = strings.Join(email.EnvelopeTo, ", ")
+	}
+
+	switch kind {
+	case "discord":
+		return discordMessage(email, subject, to, link)
+	case "teams":
+		return teamsMessage(email, subject, to, link)
+	default:
+		return slackMessage(email, subject, to, link)
+	}
+}
+
+// slackMessage formats a message for a Slack incoming webhook, in mrkdwn
+func slackMessage(email *storage.Email, subject, to, link string) interface{} {
+	title := slackEscape(subject)
+	if link != "" {
+		title = "<" + link + "|" + title + ">"
+	}
+
+	lines := []string{
+		"*New email:* " + title,
+		"*From:* " + slackEscape(email.From),
+		"*To:* " + slackEscape(to),
+	}
+	if text := preview(email); text != "" {
+		lines = append(lines, "> "+slackEscape(text))
+	}
+	return map[string]interface{}{"text": strings.Join(lines, "\n")}
+}
+
+// slackEscape escapes the characters that mrkdwn treats as markup
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// discordMessage formats a message for a Discord webhook, as an embed
+func discordMessage(email *storage.Email, subject, to, link string) interface{} {
+	embed := map[string]interface{}{
+		"title":       truncate(subject, 256),
+		"description": preview(email),
+		"timestamp":   email.ReceivedAt.UTC().Format("2006-01-02T15:04:05Z"),
+		"fields": []map[string]interface{}{
+			{"name": "From", "value": truncate(orNone(email.From), 1024), "inline": true},
+			{"name": "To", "value": truncate(orNone(to), 1024), "inline": true},
+		},
+	}
+	if link != "" {
+		embed["url"] = link
+	}
+	return map[string]interface{}{
+		"username": "GoWebMail",
+		"embeds":   []interface{}{embed},
+	}
+}
+
+// teamsMessage formats a message for a Microsoft Teams workflow webhook,
+// as an Adaptive Card
+func teamsMessage(email *storage.Email, subject, to, link string) interface{} {
+	body := []interface{}{
+		map[string]interface{}{"type": "TextBlock", "text": subject, "weight": "Bolder", "size": "Medium", "wrap": true},
+		map[string]interface{}{"type": "FactSet", "facts": []map[string]string{
+			{"title": "From", "value": orNone(email.From)},
+			{"title": "To", "value": orNone(to)},
+		}},
+	}
+	if text := preview(email); text != "" {
+		body = append(body, map[string]interface{}{"type": "TextBlock", "text": text, "wrap": true, "isSubtle": true})
+	}
+
+	card := map[string]interface{}{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body":    body,
+	}
+	if link != "" {
+		card["actions"] = []interface{}{
+			map[string]interface{}{"type": "Action.OpenUrl", "title": "Open in GoWebMail", "url": link},
+		}
+	}
+	return map[string]interface{}{
+		"type": "message",
+		"attachments": []interface{}{
+			map[string]interface{}{"contentType": "application/vnd.microsoft.card.adaptive", "content": card},
+		},
+	}
+}
+
+// truncate shortens s to at most n characters, the limit of a field
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n-1]) + "…"
+	}
+	return s
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
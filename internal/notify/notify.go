@@ -0,0 +1,182 @@
+// Package notify posts new emails to chat channels through the incoming
+// webhooks of Slack, Discord and Microsoft Teams, and sends them to the
+// desktops and phones of their recipients with ntfy and Web Push
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// previewLength is the most characters of the body shown in a message
+const previewLength = 300
+
+// Notifier posts a message to the chat webhook of every rule a new email
+// matches. Each message is posted once; failures are logged.
+type Notifier struct {
+	config atomic.Pointer[config.NotifyConfig] // replaced, never modified, by SetConfig
+	client *http.Client
+	logger zerolog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewNotifier creates a notifier
+func NewNotifier(cfg *config.NotifyConfig, logger zerolog.Logger) *Notifier {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		client: &http.Client{},
+		logger: logger.With().Str("component", "notify").Logger(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	n.SetConfig(*cfg)
+	return n
+}
+
+// SetConfig replaces the rules and settings
+func (n *Notifier) SetConfig(cfg config.NotifyConfig) {
+	cfg.Rules = append([]config.NotifyRule(nil), cfg.Rules...)
+	n.config.Store(&cfg)
+}
+
+// Notify posts an email to the rules it matches; savedSearches are the
+// names of the saved searches it matches. It does not block.
+func (n *Notifier) Notify(email *storage.Email, savedSearches []string) {
+	cfg := n.config.Load()
+	if !cfg.Enabled {
+		return
+	}
+
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if !matches(rule, email, savedSearches) {
+			continue
+		}
+
+		body, err := json.Marshal(message(rule.Type, email, link(cfg.BaseURL, email)))
+		if err != nil {
+			n.logger.Error().Err(err).Str("rule", rule.Name).Msg("Failed to encode notification")
+			continue
+		}
+
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			if err := n.post(cfg.Timeout, rule.URL, body); err != nil {
+				n.logger.Warn().Err(err).Str("rule", rule.Name).Int64("email_id", email.ID).Msg("Notification failed")
+				return
+			}
+			n.logger.Debug().Str("rule", rule.Name).Int64("email_id", email.ID).Msg("Notification posted")
+		}()
+	}
+}
+
+// post sends one message to a chat webhook
+func (n *Notifier) post(timeout time.Duration, url string, body []byte) error {
+	ctx, cancel := n.ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(n.ctx, timeout)
+	}
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoWebMail-Notify")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Stop cancels the messages being posted and waits for them
+func (n *Notifier) Stop() {
+	n.cancel()
+	n.wg.Wait()
+}
+
+// matches reports whether an email meets every condition of a rule
+func matches(rule *config.NotifyRule, email *storage.Email, savedSearches []string) bool {
+	if rule.From != "" && !match(rule.From, email.From) {
+		return false
+	}
+	if rule.Subject != "" && !match(rule.Subject, email.Subject) {
+		return false
+	}
+	if rule.To != "" && !matchAny(rule.To, recipients(email)) {
+		return false
+	}
+	if rule.SavedSearch != "" && !matchAny(rule.SavedSearch, savedSearches) {
+		return false
+	}
+	return true
+}
+
+// recipients returns the header and envelope recipients of an email
+func recipients(email *storage.Email) []string {
+	var addrs []string
+	addrs = append(addrs, email.To...)
+	addrs = append(addrs, email.CC...)
+	return append(addrs, email.EnvelopeTo...)
+}
+
+func matchAny(pattern string, values []string) bool {
+	for _, v := range values {
+		if match(pattern, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether s matches pattern, where * matches any characters,
+// ignoring case
+func match(pattern, s string) bool {
+	expr := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*")
+	return regexp.MustCompile(`(?is)^` + expr + `$`).MatchString(s)
+}
+
+// link returns the URL of an email in the web UI, or "" without a base
+// URL
+func link(baseURL string, email *storage.Email) string {
+	if baseURL == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/#email-%d", strings.TrimSuffix(baseURL, "/"), email.ID)
+}
+
+// preview returns the start of the plain-text body on one line
+func preview(email *storage.Email) string {
+	text := strings.Join(strings.Fields(email.BodyPlain), " ")
+	if runes := []rune(text); len(runes) > previewLength {
+		text = string(runes[:previewLength]) + "…"
+	}
+	return text
+}
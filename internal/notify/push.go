@@ -0,0 +1,248 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// ErrPushGone is returned when a push service reports that a browser
+// subscription has expired or was cancelled
+var ErrPushGone = errors.New("push subscription no longer valid")
+
+// webPushTTL is how many seconds a push service keeps a message for a
+// browser that is offline
+const webPushTTL = "86400"
+
+// PushMessage is what a push notification shows
+type PushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url,omitempty"` // opened on click
+	Email int64  `json:"emailId,omitempty"`
+}
+
+// Pusher sends desktop and phone notifications of new emails to the push
+// subscriptions of their recipients, kept in storage. Browser
+// subscriptions that the push service reports gone are deleted.
+type Pusher struct {
+	config  config.PushConfig
+	storage storage.Storage
+	client  *http.Client
+	logger  zerolog.Logger
+	vapid   *ecdsa.PrivateKey // nil without a key: no Web Push
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewPusher creates a pusher for the subscriptions in store
+func NewPusher(cfg *config.PushConfig, store storage.Storage, logger zerolog.Logger) *Pusher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pusher{
+		config:  *cfg,
+		storage: store,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		logger:  logger.With().Str("component", "push").Logger(),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if cfg.Enabled && cfg.VAPIDPrivateKey != "" {
+		key, err := ParseVAPIDKey(cfg.VAPIDPrivateKey)
+		if err != nil {
+			p.logger.Error().Err(err).Msg("Invalid VAPID key, Web Push disabled")
+		}
+		p.vapid = key
+	}
+	return p
+}
+
+// Enabled reports whether push notifications are sent
+func (p *Pusher) Enabled() bool {
+	return p.config.Enabled
+}
+
+// NtfyServer returns the server of ntfy topics subscribed to by name
+func (p *Pusher) NtfyServer() string {
+	return strings.TrimSuffix(p.config.NtfyServer, "/")
+}
+
+// VAPIDPublicKey returns the key browsers subscribe with, or "" when Web
+// Push is not available
+func (p *Pusher) VAPIDPublicKey() string {
+	if p.vapid == nil {
+		return ""
+	}
+	return vapidPublicKey(p.vapid)
+}
+
+// Notify sends a new email to the subscriptions of its recipients. It
+// does not block.
+func (p *Pusher) Notify(email *storage.Email) {
+	if !p.config.Enabled {
+		return
+	}
+
+	subs, err := p.storage.ListPushSubscriptions("")
+	if err != nil {
+		p.logger.Error().Err(err).Msg("Failed to list push subscriptions")
+		return
+	}
+
+	addrs := recipients(email)
+	for _, sub := range subs {
+		if !matchAny(sub.Address, addrs) {
+			continue
+		}
+
+		msg := p.message(email)
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			if err := p.Send(sub, msg); err != nil {
+				p.logger.Warn().Err(err).Int64("subscription", sub.ID).Int64("email_id", email.ID).Msg("Push notification failed")
+				return
+			}
+			p.logger.Debug().Int64("subscription", sub.ID).Int64("email_id", email.ID).Msg("Push notification sent")
+		}()
+	}
+}
+
+// message returns the notification of an email
+func (p *Pusher) message(email *storage.Email) *PushMessage {
+	subject := email.Subject
+	if subject == "" {
+		subject = "(no subject)"
+	}
+	body := "From: " + orNone(email.From)
+	if text := preview(email); text != "" {
+		body += "\n" + truncate(text, 200)
+	}
+	return &PushMessage{
+		Title: truncate(subject, 200),
+		Body:  body,
+		URL:   link(p.config.BaseURL, email),
+		Email: email.ID,
+	}
+}
+
+// Send delivers a message to one subscription. A browser subscription
+// the push service reports gone is deleted, and ErrPushGone returned.
+func (p *Pusher) Send(sub *storage.PushSubscription, msg *PushMessage) error {
+	switch sub.Type {
+	case "ntfy":
+		return p.sendNtfy(sub, msg)
+	case "webpush":
+		err := p.sendWebPush(sub, msg)
+		if err == ErrPushGone {
+			if err := p.storage.DeletePushSubscription(sub.ID); err != nil && err != storage.ErrNotFound {
+				p.logger.Warn().Err(err).Int64("subscription", sub.ID).Msg("Failed to delete expired push subscription")
+			}
+		}
+		return err
+	}
+	return fmt.Errorf("unknown subscription type %q", sub.Type)
+}
+
+// sendNtfy publishes a message to an ntfy topic, as JSON to the server
+func (p *Pusher) sendNtfy(sub *storage.PushSubscription, msg *PushMessage) error {
+	server, topic := p.NtfyServer(), sub.Topic
+	if i := strings.LastIndex(topic, "/"); strings.Contains(topic, "://") && i >= 0 {
+		server, topic = topic[:i], topic[i+1:]
+	}
+
+	payload := map[string]interface{}{
+		"topic":   topic,
+		"title":   msg.Title,
+		"message": msg.Body,
+		"tags":    []string{"envelope"},
+	}
+	if msg.URL != "" {
+		payload["click"] = msg.URL
+	}
+	body, _ := json.Marshal(payload)
+
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodPost, server, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if sub.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+sub.Token)
+	}
+	_, err = p.do(req)
+	return err
+}
+
+// sendWebPush sends an encrypted message to a browser's push service
+func (p *Pusher) sendWebPush(sub *storage.PushSubscription, msg *PushMessage) error {
+	if p.vapid == nil {
+		return errors.New("web push is not configured: push.vapid_private_key is not set")
+	}
+
+	plaintext, _ := json.Marshal(msg)
+	body, err := encryptWebPush(plaintext, sub.P256DH, sub.Auth)
+	if err != nil {
+		return err
+	}
+	authorization, err := vapidAuthorization(p.vapid, p.config.VAPIDSubject, sub.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(p.ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", webPushTTL)
+	req.Header.Set("Urgency", "high")
+	req.Header.Set("Authorization", authorization)
+
+	status, err := p.do(req)
+	if status == http.StatusNotFound || status == http.StatusGone {
+		return ErrPushGone
+	}
+	return err
+}
+
+// do sends a request, returning the status and an error for statuses
+// other than 2xx
+func (p *Pusher) do(req *http.Request) (int, error) {
+	req.Header.Set("User-Agent", "GoWebMail-Push")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if text := strings.TrimSpace(string(detail)); text != "" {
+			return resp.StatusCode, fmt.Errorf("push service returned %s: %s", resp.Status, text)
+		}
+		return resp.StatusCode, fmt.Errorf("push service returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// Stop cancels the notifications being sent and waits for them
+func (p *Pusher) Stop() {
+	p.cancel()
+	p.wg.Wait()
+}
@@ -0,0 +1,213 @@
+package notify
+
+import (
+	"crypto/ecdh"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// pushStore holds the push subscriptions of a test; the other methods of
+// storage are not used
+type pushStore struct {
+	storage.Storage
+	mu      sync.Mutex
+	subs    []*storage.PushSubscription
+	deleted []int64
+}
+
+func (s *pushStore) ListPushSubscriptions(address string) ([]*storage.PushSubscription, error) {
+	return s.subs, nil
+}
+
+func (s *pushStore) DeletePushSubscription(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, id)
+	return nil
+}
+
+// pushRequest is a request received by a fake push service
+type pushRequest struct {
+	header http.Header
+	path   string
+	body   []byte
+}
+
+// pushService serves requests with status and passes them on
+func pushService(t *testing.T, status int, detail string) (*httptest.Server, chan *pushRequest) {
+	requests := make(chan *pushRequest, 4)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- &pushRequest{header: r.Header, path: r.URL.Path, body: body}
+		w.WriteHeader(status)
+		io.WriteString(w, detail)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, requests
+}
+
+func newTestPusher(store storage.Storage, vapidKey string) *Pusher {
+	return NewPusher(&config.PushConfig{
+		Enabled:         true,
+		Timeout:         5 * time.Second,
+		BaseURL:         "https://mail.example.com/",
+		NtfyServer:      "https://ntfy.invalid/",
+		VAPIDPrivateKey: vapidKey,
+		VAPIDSubject:    "mailto:admin@example.com",
+	}, store, zerolog.Nop())
+}
+
+func TestSendWebPush(t *testing.T) {
+	srv, requests := pushService(t, http.StatusCreated, "")
+	p := newTestPusher(&pushStore{}, rfc8291ASPrivate)
+	defer p.Stop()
+
+	sub := &storage.PushSubscription{ID: 1, Type: "webpush", Endpoint: srv.URL + "/push/abc", P256DH: rfc8291UAPublic, Auth: rfc8291Auth}
+	msg := &PushMessage{Title: "Hello", Body: "From: a@example.com", URL: "https://mail.example.com/#email-7", Email: 7}
+	if err := p.Send(sub, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-requests
+	for name, want := range map[string]string{
+		"Content-Type":     "application/octet-stream",
+		"Content-Encoding": "aes128gcm",
+		"Ttl":              "86400",
+		"Urgency":          "high",
+	} {
+		if got := req.header.Get(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	claims, k, err := verifyVAPID(req.header.Get("Authorization"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k != rfc8291ASPublic || claims["aud"] != srv.URL {
+		t.Errorf("k %s, claims %v", k, claims)
+	}
+
+	uaPrivate, _ := ecdh.P256().NewPrivateKey(mustDecodeBase64URL(t, rfc8291UAPrivate))
+	plaintext, err := decryptWebPush(req.body, uaPrivate, mustDecodeBase64URL(t, rfc8291Auth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got PushMessage
+	if err := json.Unmarshal(plaintext, &got); err != nil || got != *msg {
+		t.Errorf("got %s", plaintext)
+	}
+}
+
+func TestSendWebPushGone(t *testing.T) {
+	for _, status := range []int{http.StatusNotFound, http.StatusGone} {
+		srv, _ := pushService(t, status, "")
+		store := &pushStore{}
+		p := newTestPusher(store, rfc8291ASPrivate)
+		sub := &storage.PushSubscription{ID: 3, Type: "webpush", Endpoint: srv.URL, P256DH: rfc8291UAPublic, Auth: rfc8291Auth}
+		if err := p.Send(sub, &PushMessage{}); err != ErrPushGone {
+			t.Errorf("%d: got %v", status, err)
+		}
+		if len(store.deleted) != 1 || store.deleted[0] != 3 {
+			t.Errorf("%d: deleted %v", status, store.deleted)
+		}
+		p.Stop()
+	}
+
+	// Other failures keep the subscription
+	srv, _ := pushService(t, http.StatusTooManyRequests, "slow down\n")
+	store := &pushStore{}
+	p := newTestPusher(store, rfc8291ASPrivate)
+	defer p.Stop()
+	sub := &storage.PushSubscription{ID: 3, Type: "webpush", Endpoint: srv.URL, P256DH: rfc8291UAPublic, Auth: rfc8291Auth}
+	err := p.Send(sub, &PushMessage{})
+	if err == nil || err.Error() != "push service returned 429 Too Many Requests: slow down" {
+		t.Errorf("got %v", err)
+	}
+	if len(store.deleted) != 0 {
+		t.Errorf("deleted %v", store.deleted)
+	}
+}
+
+func TestSendWebPushWithoutVAPIDKey(t *testing.T) {
+	p := newTestPusher(&pushStore{}, "")
+	defer p.Stop()
+	if p.VAPIDPublicKey() != "" {
+		t.Error("public key without a private key")
+	}
+	err := p.Send(&storage.PushSubscription{Type: "webpush", Endpoint: "https://push.invalid/"}, &PushMessage{})
+	if err == nil || !strings.Contains(err.Error(), "vapid_private_key") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSendNtfy(t *testing.T) {
+	srv, requests := pushService(t, http.StatusOK, `{"id":"x"}`)
+	p := newTestPusher(&pushStore{}, "")
+	defer p.Stop()
+
+	// A topic given as a URL names its own server
+	sub := &storage.PushSubscription{Type: "ntfy", Topic: srv.URL + "/mail-alerts", Token: "tk_123"}
+	msg := &PushMessage{Title: "Hello", Body: "From: a@example.com", URL: "https://mail.example.com/#email-7", Email: 7}
+	if err := p.Send(sub, msg); err != nil {
+		t.Fatal(err)
+	}
+	req := <-requests
+	if req.path != "/" || req.header.Get("Authorization") != "Bearer tk_123" || req.header.Get("Content-Type") != "application/json" {
+		t.Errorf("request to %s with %v", req.path, req.header)
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["topic"] != "mail-alerts" || payload["title"] != "Hello" || payload["message"] != msg.Body || payload["click"] != msg.URL {
+		t.Errorf("payload %s", req.body)
+	}
+
+	err := p.Send(&storage.PushSubscription{Type: "sms"}, msg)
+	if err == nil || errors.Is(err, ErrPushGone) {
+		t.Errorf("unknown type: got %v", err)
+	}
+}
+
+func TestNotify(t *testing.T) {
+	srv, requests := pushService(t, http.StatusOK, "")
+	store := &pushStore{subs: []*storage.PushSubscription{
+		{ID: 1, Address: "*@example.com", Type: "ntfy", Topic: srv.URL + "/all"},
+		{ID: 2, Address: "bob@example.com", Type: "ntfy", Topic: srv.URL + "/bob"},
+		{ID: 3, Address: "alice@example.com", Type: "ntfy", Topic: srv.URL + "/alice"},
+	}}
+	p := newTestPusher(store, "")
+	defer p.Stop()
+	p.Notify(&storage.Email{ID: 9, From: "carol@example.org", To: []string{"Alice@Example.com"}, BodyPlain: "Lunch\n\n at  noon?"})
+
+	// Sending is asynchronous: Stop would cancel it
+	topics := make(map[string]string)
+	for len(topics) < 2 {
+		select {
+		case req := <-requests:
+			var payload struct{ Topic, Title, Message, Click string }
+			if err := json.Unmarshal(req.body, &payload); err != nil {
+				t.Fatal(err)
+			}
+			topics[payload.Topic] = payload.Title + "|" + payload.Message + "|" + payload.Click
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %q", topics)
+		}
+	}
+	want := "(no subject)|From: carol@example.org\nLunch at noon?|https://mail.example.com/#email-9"
+	if topics["all"] != want || topics["alice"] != want {
+		t.Errorf("got %q", topics)
+	}
+}
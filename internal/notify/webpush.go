@@ -0,0 +1,165 @@
+package notify
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// webPushRecordSize is the record size of the encrypted content. A push
+// message is a single record, so the plaintext must fit in it.
+const webPushRecordSize = 4096
+
+// vapidTokenLifetime is how long a VAPID token is valid; push services
+// accept at most 24 hours
+const vapidTokenLifetime = 12 * time.Hour
+
+// GenerateVAPIDKey returns a new VAPID private key, base64url encoded as
+// push.vapid_private_key expects it
+func GenerateVAPIDKey() (string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	raw, err := key.Bytes()
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// ParseVAPIDKey decodes a VAPID private key
+func ParseVAPIDKey(s string) (*ecdsa.PrivateKey, error) {
+	raw, err := decodeBase64URL(s)
+	if err != nil {
+		return nil, err
+	}
+	return ecdsa.ParseRawPrivateKey(elliptic.P256(), raw)
+}
+
+// vapidPublicKey returns the public key browsers subscribe with, base64url
+// encoded
+func vapidPublicKey(key *ecdsa.PrivateKey) string {
+	raw, _ := key.PublicKey.Bytes()
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// vapidAuthorization returns the Authorization header of a push request
+// to endpoint (RFC 8292)
+func vapidAuthorization(key *ecdsa.PrivateKey, subject, endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header, _ := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(vapidTokenLifetime).Unix(),
+		"sub": subject,
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	token := unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+	return "vapid t=" + token + ", k=" + vapidPublicKey(key), nil
+}
+
+// encryptWebPush encrypts a push message for a browser with the aes128gcm
+// content encoding (RFC 8291 and RFC 8188). p256dh and auth are the keys
+// of the browser's subscription, base64url encoded.
+func encryptWebPush(plaintext []byte, p256dh, auth string) ([]byte, error) {
+	uaRaw, err := decodeBase64URL(p256dh)
+	if err != nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+	authSecret, err := decodeBase64URL(auth)
+	if err != nil || len(authSecret) == 0 {
+		return nil, errors.New("invalid auth secret")
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaRaw)
+	if err != nil {
+		return nil, errors.New("invalid p256dh key")
+	}
+	if len(plaintext)+1+16 > webPushRecordSize {
+		return nil, errors.New("push message too large")
+	}
+
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return sealWebPush(plaintext, uaPublic, authSecret, asPrivate, salt)
+}
+
+// sealWebPush encrypts plaintext as one aes128gcm record with the
+// sender's key pair asPrivate and salt
+func sealWebPush(plaintext []byte, uaPublic *ecdh.PublicKey, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	uaRaw := uaPublic.Bytes()
+	asRaw := asPrivate.PublicKey().Bytes()
+	shared, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaRaw...)
+	keyInfo = append(keyInfo, asRaw...)
+	ikm, err := hkdf.Key(sha256.New, shared, authSecret, string(keyInfo), 32)
+	if err != nil {
+		return nil, err
+	}
+
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header: salt, record size, and the sender's public key as key ID
+	body := append([]byte{}, salt...)
+	body = binary.BigEndian.AppendUint32(body, webPushRecordSize)
+	body = append(body, byte(len(asRaw)))
+	body = append(body, asRaw...)
+
+	// 0x02 marks the last, and only, record
+	return gcm.Seal(body, nonce, append(plaintext, 0x02), nil), nil
+}
+
+// decodeBase64URL decodes base64url with or without padding, as browsers
+// and key generators differ
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
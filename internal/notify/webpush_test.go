@@ -0,0 +1,274 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example of RFC 8291, Appendix A
+const (
+	rfc8291Plaintext = "When I grow up, I want to be a watermelon"
+	rfc8291ASPrivate = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfc8291ASPublic  = "BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8"
+	rfc8291UAPrivate = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfc8291UAPublic  = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfc8291Salt      = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfc8291Auth      = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfc8291Message   = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func mustDecodeBase64URL(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := decodeBase64URL(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSealWebPushRFC8291(t *testing.T) {
+	asPrivate, err := ecdh.P256().NewPrivateKey(mustDecodeBase64URL(t, rfc8291ASPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := base64.RawURLEncoding.EncodeToString(asPrivate.PublicKey().Bytes()); got != rfc8291ASPublic {
+		t.Fatalf("application server public key %s", got)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(mustDecodeBase64URL(t, rfc8291UAPublic))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := sealWebPush([]byte(rfc8291Plaintext), uaPublic, mustDecodeBase64URL(t, rfc8291Auth), asPrivate, mustDecodeBase64URL(t, rfc8291Salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := base64.RawURLEncoding.EncodeToString(body); got != rfc8291Message {
+		t.Errorf("got %s", got)
+	}
+}
+
+// decryptWebPush decrypts an aes128gcm push message as the browser with
+// the private key uaPrivate does
+func decryptWebPush(body []byte, uaPrivate *ecdh.PrivateKey, authSecret []byte) ([]byte, error) {
+	if len(body) < 21 || len(body) < 21+int(body[20]) {
+		return nil, errors.New("short header")
+	}
+	salt, recordSize, idLen := body[:16], binary.BigEndian.Uint32(body[16:]), int(body[20])
+	asRaw, record := body[21:21+idLen], body[21+idLen:]
+	if len(record) > int(recordSize) {
+		return nil, errors.New("more than one record")
+	}
+	asPublic, err := ecdh.P256().NewPublicKey(asRaw)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	info := append([]byte("WebPush: info\x00"), uaPrivate.PublicKey().Bytes()...)
+	ikm, err := hkdf.Key(sha256.New, shared, authSecret, string(append(info, asRaw...)), 32)
+	if err != nil {
+		return nil, err
+	}
+	cek, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, nonce, record, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// The padding delimiter of the last record follows the content,
+	// then zeros
+	plaintext = bytes.TrimRight(plaintext, "\x00")
+	if len(plaintext) == 0 || plaintext[len(plaintext)-1] != 0x02 {
+		return nil, errors.New("not the last record")
+	}
+	return plaintext[:len(plaintext)-1], nil
+}
+
+func TestEncryptWebPush(t *testing.T) {
+	uaPrivate, err := ecdh.P256().NewPrivateKey(mustDecodeBase64URL(t, rfc8291UAPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := mustDecodeBase64URL(t, rfc8291Auth)
+
+	// The example message decrypts with the browser's key
+	plaintext, err := decryptWebPush(mustDecodeBase64URL(t, rfc8291Message), uaPrivate, auth)
+	if err != nil || string(plaintext) != rfc8291Plaintext {
+		t.Fatalf("example message: got %q, %v", plaintext, err)
+	}
+
+	// Messages take a new key and salt each time; padded base64 keys
+	// are accepted
+	first, err := encryptWebPush([]byte("hello"), rfc8291UAPublic+"=", rfc8291Auth+"==")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := encryptWebPush([]byte("hello"), rfc8291UAPublic, rfc8291Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(first[:16], second[:16]) || bytes.Equal(first[21:86], second[21:86]) {
+		t.Error("salt or key reused")
+	}
+	for _, body := range [][]byte{first, second} {
+		if plaintext, err := decryptWebPush(body, uaPrivate, auth); err != nil || string(plaintext) != "hello" {
+			t.Errorf("got %q, %v", plaintext, err)
+		}
+	}
+
+	// A modified record does not decrypt
+	first[len(first)-1] ^= 1
+	if _, err := decryptWebPush(first, uaPrivate, auth); err == nil {
+		t.Error("modified message decrypted")
+	}
+
+	// The largest message fits in the record
+	if _, err := encryptWebPush(make([]byte, webPushRecordSize-17), rfc8291UAPublic, rfc8291Auth); err != nil {
+		t.Error(err)
+	}
+	for _, tc := range []struct {
+		plaintext    []byte
+		p256dh, auth string
+		want         string
+	}{
+		{make([]byte, webPushRecordSize-16), rfc8291UAPublic, rfc8291Auth, "push message too large"},
+		{nil, "not base64!", rfc8291Auth, "invalid p256dh key"},
+		{nil, rfc8291UAPublic[:20], rfc8291Auth, "invalid p256dh key"},
+		// A point not on the curve
+		{nil, "BA" + strings.Repeat("A", 85), rfc8291Auth, "invalid p256dh key"},
+		{nil, rfc8291UAPublic, "", "invalid auth secret"},
+	} {
+		if _, err := encryptWebPush(tc.plaintext, tc.p256dh, tc.auth); err == nil || err.Error() != tc.want {
+			t.Errorf("got %v, want %s", err, tc.want)
+		}
+	}
+}
+
+func TestVAPIDKey(t *testing.T) {
+	// The RFC 8291 application server key serves as a VAPID key
+	key, err := ParseVAPIDKey(rfc8291ASPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := vapidPublicKey(key); got != rfc8291ASPublic {
+		t.Errorf("public key %s", got)
+	}
+
+	generated, err := GenerateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseVAPIDKey(generated); err != nil {
+		t.Errorf("generated key: %v", err)
+	}
+	for _, s := range []string{"", "AAAA", strings.Repeat("A", 43), strings.Repeat("_", 43)} {
+		if _, err := ParseVAPIDKey(s); err == nil {
+			t.Errorf("%q accepted", s)
+		}
+	}
+}
+
+// verifyVAPID checks an Authorization header of RFC 8292 as a push
+// service does and returns the claims of its token
+func verifyVAPID(authorization string) (map[string]interface{}, string, error) {
+	credentials, ok := strings.CutPrefix(authorization, "vapid ")
+	if !ok {
+		return nil, "", errors.New("not the vapid scheme")
+	}
+	params := make(map[string]string)
+	for _, p := range strings.Split(credentials, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(p), "=")
+		params[name] = value
+	}
+
+	raw, err := decodeBase64URL(params["k"])
+	if err != nil {
+		return nil, "", err
+	}
+	public, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), raw)
+	if err != nil {
+		return nil, "", err
+	}
+
+	parts := strings.Split(params["t"], ".")
+	if len(parts) != 3 {
+		return nil, "", errors.New("not a JWS")
+	}
+	var header map[string]interface{}
+	if b, err := decodeBase64URL(parts[0]); err != nil || json.Unmarshal(b, &header) != nil {
+		return nil, "", errors.New("invalid header")
+	}
+	if header["alg"] != "ES256" || header["typ"] != "JWT" {
+		return nil, "", errors.New("not an ES256 JWT")
+	}
+	signature, err := decodeBase64URL(parts[2])
+	if err != nil || len(signature) != 64 {
+		return nil, "", errors.New("signature is not r || s")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(public, digest[:], r, s) {
+		return nil, "", errors.New("bad signature")
+	}
+
+	var claims map[string]interface{}
+	if b, err := decodeBase64URL(parts[1]); err != nil || json.Unmarshal(b, &claims) != nil {
+		return nil, "", errors.New("invalid claims")
+	}
+	return claims, params["k"], nil
+}
+
+func TestVAPIDAuthorization(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorization, err := vapidAuthorization(key, "mailto:admin@example.com", "https://fcm.googleapis.com:443/fcm/send/dKq1?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, k, err := verifyVAPID(authorization)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k != vapidPublicKey(key) {
+		t.Errorf("k %s", k)
+	}
+	// The audience is the origin of the endpoint
+	if claims["aud"] != "https://fcm.googleapis.com:443" || claims["sub"] != "mailto:admin@example.com" {
+		t.Errorf("claims %v", claims)
+	}
+	exp, _ := claims["exp"].(float64)
+	if lifetime := time.Until(time.Unix(int64(exp), 0)); lifetime <= 0 || lifetime > 24*time.Hour {
+		t.Errorf("token valid for %s", lifetime)
+	}
+
+	// The signature does not verify for another key
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	forged := strings.Replace(authorization, "k="+k, "k="+vapidPublicKey(other), 1)
+	if _, _, err := verifyVAPID(forged); err == nil {
+		t.Error("token verified with another key")
+	}
+}
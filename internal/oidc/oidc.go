@@ -0,0 +1,358 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+// ErrInvalidToken is wrapped by every token validation error
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrLoginDisabled is returned by the code flow when no client is configured
+var ErrLoginDisabled = errors.New("OIDC login requires client_id and redirect_url")
+
+// leeway allows for clock skew between gowebmail and the issuer
+const leeway = time.Minute
+
+// Claims are the validated claims of a token
+type Claims struct {
+	Issuer    string    `json:"iss"`
+	Subject   string    `json:"sub"`
+	Audience  audience  `json:"aud"`
+	Expiry    timestamp `json:"exp"`
+	NotBefore timestamp `json:"nbf"`
+	Nonce     string    `json:"nonce"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+}
+
+// ExpiresAt returns when the token expires
+func (c *Claims) ExpiresAt() time.Time {
+	return time.Time(c.Expiry)
+}
+
+// Provider validates JWTs issued by an OpenID Connect provider and runs the
+// authorization code flow for the web UI
+type Provider struct {
+	config *config.OIDCConfig
+	logger zerolog.Logger
+	client *http.Client
+
+	mu        sync.Mutex
+	discovery *discovery
+	keys      *keySet
+}
+
+// discovery is the subset of the provider metadata gowebmail uses
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewProvider creates a new provider. Metadata and signing keys are fetched
+// when first needed.
+func NewProvider(cfg *config.OIDCConfig, logger zerolog.Logger) *Provider {
+	return &Provider{
+		config: cfg,
+		logger: logger,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// LoginEnabled reports whether the web UI login flow is configured
+func (p *Provider) LoginEnabled() bool {
+	return p.config.ClientID != "" && p.config.RedirectURL != ""
+}
+
+// Verify validates a signed JWT and its issuer, audience and lifetime
+func (p *Provider) Verify(ctx context.Context, token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed JWT", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+
+	keys, err := p.keySet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := keys.verify(ctx, header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+	if err := p.validateClaims(&claims, time.Now()); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	return &claims, nil
+}
+
+func (p *Provider) validateClaims(claims *Claims, now time.Time) error {
+	if claims.Issuer != p.config.Issuer {
+		return fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+
+	aud := p.config.Audience
+	if aud == "" {
+		aud = p.config.ClientID
+	}
+	if aud != "" && !claims.Audience.contains(aud) {
+		return fmt.Errorf("audience does not include %q", aud)
+	}
+
+	if claims.ExpiresAt().IsZero() {
+		return errors.New("token has no expiry")
+	}
+	if now.After(claims.ExpiresAt().Add(leeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf := time.Time(claims.NotBefore); !nbf.IsZero() && now.Add(leeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
+
+// AuthCodeURL returns the URL to send the browser to for login. The state,
+// nonce and PKCE verifier must be kept until the callback.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	if !p.LoginEnabled() {
+		return "", ErrLoginDisabled
+	}
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.scopes(), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + query.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the validated ID token
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (string, *Claims, error) {
+	if !p.LoginEnabled() {
+		return "", nil, ErrLoginDisabled
+	}
+	meta, err := p.metadata(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", nil, fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("token endpoint returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", nil, fmt.Errorf("invalid token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return "", nil, errors.New("token response has no id_token")
+	}
+
+	claims, err := p.Verify(ctx, tokens.IDToken)
+	if err != nil {
+		return "", nil, err
+	}
+	if claims.Nonce != nonce {
+		return "", nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+	return tokens.IDToken, claims, nil
+}
+
+// RandomString returns a URL-safe random string for states, nonces and
+// PKCE verifiers
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (p *Provider) scopes() []string {
+	if len(p.config.Scopes) == 0 {
+		return []string{"openid", "email", "profile"}
+	}
+	return p.config.Scopes
+}
+
+// metadata returns the discovery document, fetching it on first use
+func (p *Provider) metadata(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var meta discovery
+	wellKnown := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &meta); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if meta.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", meta.Issuer, p.config.Issuer)
+	}
+	p.discovery = &meta
+	return p.discovery, nil
+}
+
+// keySet returns the issuer's signing keys, from jwks_url or discovery
+func (p *Provider) keySet(ctx context.Context) (*keySet, error) {
+	jwksURL := p.config.JWKSURL
+	if jwksURL == "" {
+		meta, err := p.metadata(ctx)
+		if err != nil {
+			return nil, err
+		}
+		jwksURL = meta.JWKSURI
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys == nil {
+		p.keys = newKeySet(jwksURL, p.getJSON, p.logger)
+	}
+	return p.keys, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, rawURL string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// audience accepts the aud claim as a string or an array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+func (a audience) contains(aud string) bool {
+	for _, v := range a {
+		if v == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// timestamp is a NumericDate claim
+type timestamp time.Time
+
+func (t *timestamp) UnmarshalJSON(b []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(b, &seconds); err != nil {
+		return err
+	}
+	*t = timestamp(time.Unix(int64(seconds), 0))
+	return nil
+}
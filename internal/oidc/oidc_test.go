@@ -0,0 +1,347 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+// issuer serves a JWKS of its keys and signs tokens with them
+type issuer struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]crypto.Signer
+	fetches int
+}
+
+func newIssuer(t *testing.T) *issuer {
+	iss := &issuer{keys: make(map[string]crypto.Signer)}
+	iss.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		iss.mu.Lock()
+		defer iss.mu.Unlock()
+		iss.fetches++
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range iss.keys {
+			set.Keys = append(set.Keys, publicJWK(kid, key.Public()))
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(iss.server.Close)
+	return iss
+}
+
+func (iss *issuer) addKey(kid string, key crypto.Signer) {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	iss.keys[kid] = key
+}
+
+func (iss *issuer) fetchCount() int {
+	iss.mu.Lock()
+	defer iss.mu.Unlock()
+	return iss.fetches
+}
+
+func (iss *issuer) provider() *Provider {
+	return NewProvider(&config.OIDCConfig{
+		Enabled:  true,
+		Issuer:   "https://issuer.example.com",
+		Audience: "gowebmail",
+		JWKSURL:  iss.server.URL,
+	}, zerolog.Nop())
+}
+
+func publicJWK(kid string, pub crypto.PublicKey) jwk {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return jwk{Kty: "RSA", Kid: kid, N: enc(pub.N.Bytes()), E: enc(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		return jwk{Kty: "EC", Kid: kid, Crv: pub.Curve.Params().Name,
+			X: enc(pub.X.FillBytes(make([]byte, size))), Y: enc(pub.Y.FillBytes(make([]byte, size)))}
+	}
+	panic("unsupported key")
+}
+
+// validClaims returns the claims of a token the provider accepts
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   "https://issuer.example.com",
+		"sub":   "user-1",
+		"aud":   "gowebmail",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"email": "qa@example.com",
+	}
+}
+
+// sign returns a JWT of claims signed with key as alg
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	hash := map[string]crypto.Hash{"256": crypto.SHA256, "384": crypto.SHA384, "512": crypto.SHA512}[alg[2:]]
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, key, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, digest)
+		}
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key, digest)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func generateRSA(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func generateEC(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestVerifyAcceptsSupportedAlgorithms(t *testing.T) {
+	iss := newIssuer(t)
+	rsaKey := generateRSA(t)
+	iss.addKey("rsa", rsaKey)
+	iss.addKey("p256", generateEC(t, elliptic.P256()))
+	iss.addKey("p384", generateEC(t, elliptic.P384()))
+	iss.addKey("p521", generateEC(t, elliptic.P521()))
+	p := iss.provider()
+
+	for _, tc := range []struct{ alg, kid string }{
+		{"RS256", "rsa"}, {"RS512", "rsa"}, {"PS256", "rsa"},
+		{"ES256", "p256"}, {"ES384", "p384"}, {"ES512", "p521"},
+	} {
+		iss.mu.Lock()
+		key := iss.keys[tc.kid]
+		iss.mu.Unlock()
+		claims, err := p.Verify(context.Background(), sign(t, tc.alg, tc.kid, key, validClaims()))
+		if err != nil {
+			t.Errorf("%s: %v", tc.alg, err)
+			continue
+		}
+		if claims.Subject != "user-1" || claims.Email != "qa@example.com" {
+			t.Errorf("%s: unexpected claims %+v", tc.alg, claims)
+		}
+	}
+}
+
+func TestVerifyRejectsInvalidTokens(t *testing.T) {
+	iss := newIssuer(t)
+	rsaKey := generateRSA(t)
+	iss.addKey("rsa", rsaKey)
+	p384 := generateEC(t, elliptic.P384())
+	iss.addKey("p384", p384)
+	p := iss.provider()
+
+	withClaim := func(name string, value interface{}) map[string]interface{} {
+		claims := validClaims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	unsigned := func(alg string) string {
+		header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "rsa"})
+		payload, _ := json.Marshal(validClaims())
+		return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+	}
+	// HS256 keyed with the public key, the classic algorithm confusion
+	hs256 := func() string {
+		header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "rsa"})
+		payload, _ := json.Marshal(validClaims())
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		mac := hmac.New(sha256.New, rsaKey.PublicKey.N.Bytes())
+		mac.Write([]byte(signed))
+		return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	// ES256 over a P-384 key, hashing with SHA-256 instead of SHA-384
+	es256OnP384 := func() string {
+		header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "p384"})
+		payload, _ := json.Marshal(validClaims())
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, p384, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := append(r.FillBytes(make([]byte, 48)), s.FillBytes(make([]byte, 48))...)
+		return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+	}
+	tampered := func() string {
+		token := sign(t, "RS256", "rsa", rsaKey, validClaims())
+		parts := strings.Split(token, ".")
+		payload, _ := json.Marshal(withClaim("sub", "admin"))
+		return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"alg none", unsigned("none"), "unsupported algorithm"},
+		{"alg None", unsigned("None"), "unsupported algorithm"},
+		{"HS256", hs256(), "unsupported algorithm"},
+		{"ES256 on P-384", es256OnP384(), "not on the curve"},
+		{"tampered claims", tampered(), "verification error"},
+		{"expired", sign(t, "RS256", "rsa", rsaKey, withClaim("exp", time.Now().Add(-2*time.Minute).Unix())), "expired"},
+		{"no expiry", sign(t, "RS256", "rsa", rsaKey, withClaim("exp", nil)), "no expiry"},
+		{"not yet valid", sign(t, "RS256", "rsa", rsaKey, withClaim("nbf", time.Now().Add(time.Hour).Unix())), "not valid yet"},
+		{"wrong audience", sign(t, "RS256", "rsa", rsaKey, withClaim("aud", "other")), "audience"},
+		{"wrong audience list", sign(t, "RS256", "rsa", rsaKey, withClaim("aud", []string{"a", "b"})), "audience"},
+		{"wrong issuer", sign(t, "RS256", "rsa", rsaKey, withClaim("iss", "https://evil.example.com")), "issuer"},
+		{"malformed", "not.a-token", "malformed"},
+		{"wrong key type", sign(t, "ES384", "rsa", p384, validClaims()), "not an EC key"},
+	} {
+		_, err := p.Verify(context.Background(), tc.token)
+		if err == nil {
+			t.Errorf("%s: token accepted", tc.name)
+			continue
+		}
+		if !errors.Is(err, ErrInvalidToken) && !strings.Contains(err.Error(), "signing key") {
+			t.Errorf("%s: error %v does not wrap ErrInvalidToken", tc.name, err)
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want an error containing %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestVerifyAcceptsAudienceList(t *testing.T) {
+	iss := newIssuer(t)
+	key := generateRSA(t)
+	iss.addKey("rsa", key)
+	claims := validClaims()
+	claims["aud"] = []string{"other", "gowebmail"}
+	if _, err := iss.provider().Verify(context.Background(), sign(t, "RS256", "rsa", key, claims)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnknownKeyRefreshesKeySet(t *testing.T) {
+	iss := newIssuer(t)
+	first := generateRSA(t)
+	iss.addKey("first", first)
+	p := iss.provider()
+	ctx := context.Background()
+
+	if _, err := p.Verify(ctx, sign(t, "RS256", "first", first, validClaims())); err != nil {
+		t.Fatal(err)
+	}
+	if n := iss.fetchCount(); n != 1 {
+		t.Fatalf("fetched keys %d times, want 1", n)
+	}
+
+	// The issuer rotates its keys
+	second := generateRSA(t)
+	iss.addKey("second", second)
+	token := sign(t, "RS256", "second", second, validClaims())
+
+	// Refetches triggered by unknown keys are rate limited
+	if _, err := p.Verify(ctx, token); err == nil || !strings.Contains(err.Error(), "unknown signing key") {
+		t.Fatalf("got %v, want an unknown signing key error", err)
+	}
+	if n := iss.fetchCount(); n != 1 {
+		t.Fatalf("fetched keys %d times within the minimum refresh interval, want 1", n)
+	}
+
+	p.keys.mu.Lock()
+	p.keys.fetchedAt = time.Now().Add(-keysMinRefresh)
+	p.keys.mu.Unlock()
+	if _, err := p.Verify(ctx, token); err != nil {
+		t.Fatalf("token signed with the new key: %v", err)
+	}
+	if n := iss.fetchCount(); n != 2 {
+		t.Fatalf("fetched keys %d times, want 2", n)
+	}
+
+	// Keys that are still unknown after a refresh are rejected
+	third := generateRSA(t)
+	p.keys.mu.Lock()
+	p.keys.fetchedAt = time.Now().Add(-keysMinRefresh)
+	p.keys.mu.Unlock()
+	if _, err := p.Verify(ctx, sign(t, "RS256", "third", third, validClaims())); err == nil {
+		t.Fatal("token signed with an unpublished key accepted")
+	}
+}
+
+func TestCachedKeysSurviveUnreachableIssuer(t *testing.T) {
+	iss := newIssuer(t)
+	key := generateRSA(t)
+	iss.addKey("rsa", key)
+	p := iss.provider()
+	token := sign(t, "RS256", "rsa", key, validClaims())
+	if _, err := p.Verify(context.Background(), token); err != nil {
+		t.Fatal(err)
+	}
+
+	iss.server.Close()
+	p.keys.mu.Lock()
+	p.keys.fetchedAt = time.Now().Add(-keysMaxAge)
+	p.keys.mu.Unlock()
+	if _, err := p.Verify(context.Background(), token); err != nil {
+		t.Fatalf("cached key not used while the issuer is unreachable: %v", err)
+	}
+}
+
+func TestJWKRejectsPointsOffCurve(t *testing.T) {
+	key := generateEC(t, elliptic.P256())
+	k := publicJWK("ec", key.Public())
+	y := new(big.Int).Add(key.Y, big.NewInt(1))
+	k.Y = base64.RawURLEncoding.EncodeToString(y.Bytes())
+	if _, err := k.publicKey(); err == nil {
+		t.Fatal("point off the curve accepted")
+	}
+}
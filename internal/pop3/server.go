@@ -0,0 +1,224 @@
+package pop3
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/access"
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// maxLineLength bounds a command line; RFC 2449 allows 255 octets
+const maxLineLength = 512
+
+// Server serves captured mail to mail clients over POP3 (RFC 1939)
+type Server struct {
+	config  *config.POP3Config
+	storage storage.Storage
+	logger  zerolog.Logger
+	addr    string
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	sessions sync.WaitGroup
+
+	// listening is set while the listener is bound, and closing once
+	// Shutdown has been called
+	listening atomic.Bool
+	closing   atomic.Bool
+}
+
+// NewServer creates a new POP3 server for the emails in store
+func NewServer(cfg *config.POP3Config, store storage.Storage, logger zerolog.Logger) *Server {
+	return &Server{
+		config:  cfg,
+		storage: store,
+		logger:  logger.With().Str("component", "pop3").Logger(),
+		addr:    fmt.Sprintf("%s:%d", cfg.Host, cfg.Port),
+		conns:   make(map[net.Conn]struct{}),
+	}
+}
+
+// Start starts the POP3 server and serves until Shutdown is called
+func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts POP3 connections on l until Shutdown is called
+func (s *Server) Serve(l net.Listener) error {
+	// Refuse clients outside the access lists before anything else
+	l, err := access.Listener(l, &s.config.Access, s.logger)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info().
+		Str("addr", l.Addr().String()).
+		Bool("per_recipient", s.config.PerRecipient).
+		Msg("Starting POP3 server")
+
+	s.mu.Lock()
+	if s.closing.Load() {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	s.mu.Unlock()
+
+	s.listening.Store(true)
+	defer s.listening.Store(false)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.closing.Load() {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		if s.closing.Load() {
+			s.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.sessions.Add(1)
+		s.mu.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+// Shutdown stops accepting connections and ends idle sessions. Sessions
+// busy with a command finish it first; they are cut off when ctx expires.
+// Messages marked for deletion are kept, as after a dropped connection.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.logger.Info().Msg("Shutting down POP3 server")
+
+	s.mu.Lock()
+	s.closing.Store(true)
+	s.listening.Store(false)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	// Wake sessions waiting for a command; they see closing and leave
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.sessions.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Ready returns an error unless the server is accepting connections
+func (s *Server) Ready(ctx context.Context) error {
+	if !s.listening.Load() {
+		return fmt.Errorf("not listening on %s", s.addr)
+	}
+	return nil
+}
+
+// handle runs a session on conn until the client quits or goes away
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.sessions.Done()
+	}()
+
+	sess := &session{
+		server: s,
+		conn:   conn,
+		r:      bufio.NewReaderSize(conn, maxLineLength),
+		w:      bufio.NewWriter(conn),
+		logger: s.logger.With().Str("remote", conn.RemoteAddr().String()).Logger(),
+	}
+	sess.run()
+}
+
+// authenticate checks the credentials given with USER and PASS
+func (s *Server) authenticate(user, pass string) bool {
+	if !s.config.PerRecipient && s.config.Username != "" &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(s.config.Username)) != 1 {
+		return false
+	}
+	if s.config.Password != "" &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(s.config.Password)) != 1 {
+		return false
+	}
+	return true
+}
+
+// loadMailbox returns the emails listed to user, oldest first as POP3
+// clients expect
+func (s *Server) loadMailbox(user string) ([]*message, error) {
+	filter := &storage.EmailFilter{Summary: true}
+	if s.config.PerRecipient {
+		filter.Mailbox = user
+	}
+
+	result, err := s.storage.ListEmails(filter, s.config.MaxMessages, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]*message, len(result.Emails))
+	for i, email := range result.Emails {
+		messages[len(messages)-1-i] = &message{id: email.ID, size: email.Size}
+	}
+	return messages, nil
+}
+
+// parseArgs splits the arguments of a command, e.g. "1 10" for TOP
+func parseArgs(arg string) []string {
+	return strings.Fields(arg)
+}
+
+// parseNumber parses a message number argument
+func parseNumber(arg string) (int, bool) {
+	n, err := strconv.Atoi(arg)
+	return n, err == nil && n > 0
+}
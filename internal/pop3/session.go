@@ -0,0 +1,404 @@
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// message is an email listed in a session's mailbox
+type message struct {
+	id      int64
+	size    int64
+	deleted bool
+}
+
+// session is the state of one POP3 connection
+type session struct {
+	server *Server
+	conn   net.Conn
+	r      *bufio.Reader
+	w      *bufio.Writer
+	logger zerolog.Logger
+
+	// user is set by USER; messages is loaded once PASS succeeds
+	user     string
+	messages []*message
+}
+
+// errLineTooLong is returned for command lines over maxLineLength
+var errLineTooLong = errors.New("line too long")
+
+// run greets the client and handles commands until QUIT or an error
+func (sess *session) run() {
+	sess.logger.Debug().Msg("POP3 session started")
+	sess.reply("+OK gowebmail POP3 server ready")
+
+	for {
+		line, err := sess.readLine()
+		if err != nil {
+			if errors.Is(err, errLineTooLong) {
+				sess.reply("-ERR line too long")
+				continue
+			}
+			sess.logger.Debug().Err(err).Msg("POP3 session ended")
+			return
+		}
+
+		cmd, arg, _ := strings.Cut(line, " ")
+		cmd = strings.ToUpper(cmd)
+		if cmd == "QUIT" {
+			sess.quit()
+			return
+		}
+		sess.handle(cmd, strings.TrimSpace(arg))
+	}
+}
+
+// readLine reads a command line, waiting at most the configured timeout.
+// It fails at once when the server is shutting down.
+func (sess *session) readLine() (string, error) {
+	if err := sess.w.Flush(); err != nil {
+		return "", err
+	}
+	if sess.server.config.Timeout > 0 {
+		sess.conn.SetReadDeadline(time.Now().Add(sess.server.config.Timeout))
+	}
+	// Checked after the deadline is set, so a Shutdown that races with it
+	// either is seen here or interrupts the read below
+	if sess.server.closing.Load() {
+		return "", errors.New("server shutting down")
+	}
+
+	line, err := sess.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		// Discard the rest of the line
+		for errors.Is(err, bufio.ErrBufferFull) {
+			_, err = sess.r.ReadSlice('\n')
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errLineTooLong
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// handle runs a command other than QUIT
+func (sess *session) handle(cmd, arg string) {
+	switch cmd {
+	case "CAPA":
+		sess.capa()
+		return
+	case "NOOP":
+		sess.reply("+OK")
+		return
+	case "USER", "PASS":
+		if sess.messages != nil {
+			sess.reply("-ERR already authenticated")
+			return
+		}
+		if cmd == "USER" {
+			sess.userCmd(arg)
+		} else {
+			sess.pass(arg)
+		}
+		return
+	}
+
+	if sess.messages == nil {
+		sess.reply("-ERR authenticate first")
+		return
+	}
+
+	switch cmd {
+	case "STAT":
+		count, size := sess.stat()
+		sess.reply("+OK %d %d", count, size)
+	case "LIST":
+		sess.list(arg)
+	case "UIDL":
+		sess.uidl(arg)
+	case "RETR":
+		sess.retr(arg)
+	case "TOP":
+		sess.top(arg)
+	case "DELE":
+		sess.dele(arg)
+	case "RSET":
+		for _, msg := range sess.messages {
+			msg.deleted = false
+		}
+		count, size := sess.stat()
+		sess.reply("+OK %d messages (%d octets)", count, size)
+	default:
+		sess.reply("-ERR unknown command")
+	}
+}
+
+// capa lists the supported extensions (RFC 2449)
+func (sess *session) capa() {
+	sess.reply("+OK capability list follows")
+	sess.reply("USER")
+	sess.reply("TOP")
+	sess.reply("UIDL")
+	sess.reply("RESP-CODES")
+	sess.reply("IMPLEMENTATION gowebmail")
+	sess.reply(".")
+}
+
+// userCmd records the user name to be checked by PASS
+func (sess *session) userCmd(arg string) {
+	if arg == "" {
+		sess.reply("-ERR user name required")
+		return
+	}
+	sess.user = arg
+	sess.reply("+OK")
+}
+
+// pass checks the credentials and loads the user's mailbox
+func (sess *session) pass(arg string) {
+	if sess.user == "" {
+		sess.reply("-ERR USER first")
+		return
+	}
+
+	if !sess.server.authenticate(sess.user, arg) {
+		sess.logger.Warn().Str("user", sess.user).Msg("POP3 authentication failed")
+		sess.user = ""
+		sess.reply("-ERR [AUTH] invalid user name or password")
+		return
+	}
+
+	messages, err := sess.server.loadMailbox(sess.user)
+	if err != nil {
+		sess.logger.Error().Err(err).Str("user", sess.user).Msg("Failed to load POP3 mailbox")
+		sess.reply("-ERR [SYS/TEMP] failed to load mailbox")
+		return
+	}
+	sess.messages = messages
+	sess.logger = sess.logger.With().Str("user", sess.user).Logger()
+
+	count, size := sess.stat()
+	sess.logger.Debug().Int("messages", count).Msg("POP3 user logged in")
+	sess.reply("+OK %d messages (%d octets)", count, size)
+}
+
+// stat returns the number and total size of the messages not deleted
+func (sess *session) stat() (int, int64) {
+	var count int
+	var size int64
+	for _, msg := range sess.messages {
+		if !msg.deleted {
+			count++
+			size += msg.size
+		}
+	}
+	return count, size
+}
+
+// lookup returns the message numbered arg, replying with an error if there
+// is none
+func (sess *session) lookup(arg string) (int, *message) {
+	n, ok := parseNumber(arg)
+	if !ok || n > len(sess.messages) || sess.messages[n-1].deleted {
+		sess.reply("-ERR no such message")
+		return 0, nil
+	}
+	return n, sess.messages[n-1]
+}
+
+// list replies with the size of one message, or of every message
+func (sess *session) list(arg string) {
+	if arg != "" {
+		if n, msg := sess.lookup(arg); msg != nil {
+			sess.reply("+OK %d %d", n, msg.size)
+		}
+		return
+	}
+
+	count, size := sess.stat()
+	sess.reply("+OK %d messages (%d octets)", count, size)
+	for i, msg := range sess.messages {
+		if !msg.deleted {
+			sess.reply("%d %d", i+1, msg.size)
+		}
+	}
+	sess.reply(".")
+}
+
+// uidl replies with the unique id of one message, or of every message.
+// Email ids are never reused, so they serve as unique ids.
+func (sess *session) uidl(arg string) {
+	if arg != "" {
+		if n, msg := sess.lookup(arg); msg != nil {
+			sess.reply("+OK %d %d", n, msg.id)
+		}
+		return
+	}
+
+	sess.reply("+OK")
+	for i, msg := range sess.messages {
+		if !msg.deleted {
+			sess.reply("%d %d", i+1, msg.id)
+		}
+	}
+	sess.reply(".")
+}
+
+// retr sends a whole message
+func (sess *session) retr(arg string) {
+	_, msg := sess.lookup(arg)
+	if msg == nil {
+		return
+	}
+
+	raw, ok := sess.rawEmail(msg)
+	if !ok {
+		return
+	}
+	sess.reply("+OK %d octets", len(raw))
+	sess.writeMultiline(raw)
+}
+
+// top sends the headers of a message and the first lines of its body
+func (sess *session) top(arg string) {
+	args := parseArgs(arg)
+	if len(args) != 2 {
+		sess.reply("-ERR usage: TOP msg n")
+		return
+	}
+	lines, ok := parseNumber(args[1])
+	if !ok && args[1] != "0" {
+		sess.reply("-ERR invalid line count")
+		return
+	}
+
+	_, msg := sess.lookup(args[0])
+	if msg == nil {
+		return
+	}
+
+	raw, ok := sess.rawEmail(msg)
+	if !ok {
+		return
+	}
+	sess.reply("+OK")
+	sess.writeMultiline(topLines(raw, lines))
+}
+
+// dele marks a message for deletion at QUIT
+func (sess *session) dele(arg string) {
+	n, msg := sess.lookup(arg)
+	if msg == nil {
+		return
+	}
+	msg.deleted = true
+	sess.reply("+OK message %d deleted", n)
+}
+
+// quit ends the session, deleting the marked messages if it is
+// authenticated and the server is configured to
+func (sess *session) quit() {
+	if sess.messages == nil {
+		sess.reply("+OK bye")
+		sess.w.Flush()
+		return
+	}
+
+	var failed bool
+	deleted := 0
+	for _, msg := range sess.messages {
+		if !msg.deleted {
+			continue
+		}
+		if sess.server.config.Delete {
+			if err := sess.server.storage.DeleteEmail(msg.id); err != nil {
+				sess.logger.Error().Err(err).Int64("id", msg.id).Msg("Failed to delete email over POP3")
+				failed = true
+				continue
+			}
+		}
+		deleted++
+	}
+
+	sess.logger.Debug().Int("deleted", deleted).Msg("POP3 session quit")
+	if failed {
+		sess.reply("-ERR [SYS/TEMP] some deleted messages not removed")
+	} else {
+		sess.reply("+OK bye, %d messages deleted", deleted)
+	}
+	sess.w.Flush()
+}
+
+// rawEmail loads the source of a message, replying with an error if it
+// cannot be read
+func (sess *session) rawEmail(msg *message) ([]byte, bool) {
+	raw, err := sess.server.storage.GetRawEmail(msg.id)
+	if err != nil {
+		sess.logger.Error().Err(err).Int64("id", msg.id).Msg("Failed to load email for POP3")
+		sess.reply("-ERR [SYS/TEMP] failed to load message")
+		return nil, false
+	}
+	return raw, true
+}
+
+// topLines returns the headers of raw, the blank line after them and the
+// first n lines of the body
+func topLines(raw []byte, n int) []byte {
+	end := bytes.Index(raw, []byte("\r\n\r\n"))
+	sep := 4
+	if lf := bytes.Index(raw, []byte("\n\n")); lf >= 0 && (end < 0 || lf < end) {
+		end, sep = lf, 2
+	}
+	if end < 0 {
+		return raw
+	}
+
+	end += sep
+	for ; n > 0 && end < len(raw); n-- {
+		next := bytes.IndexByte(raw[end:], '\n')
+		if next < 0 {
+			return raw
+		}
+		end += next + 1
+	}
+	return raw[:end]
+}
+
+// writeMultiline writes data as a multi-line response: lines end in CRLF,
+// lines starting with "." are dot-stuffed, and a lone "." terminates it
+func (sess *session) writeMultiline(data []byte) {
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			data = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if len(line) > 0 && line[0] == '.' {
+			sess.w.WriteByte('.')
+		}
+		sess.w.Write(line)
+		sess.w.WriteString("\r\n")
+	}
+	sess.w.WriteString(".\r\n")
+}
+
+// reply writes a response line
+func (sess *session) reply(format string, args ...interface{}) {
+	fmt.Fprintf(sess.w, format, args...)
+	sess.w.WriteString("\r\n")
+}
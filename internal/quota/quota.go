@@ -0,0 +1,139 @@
+package quota
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// ErrQuotaExceeded is returned when an email does not fit a recipient's quota
+var ErrQuotaExceeded = errors.New("mailbox quota exceeded")
+
+// Enforcer applies per-recipient quotas to incoming email. Quotas are
+// checked before the email is saved, so concurrent deliveries to the same
+// mailbox may briefly exceed them.
+type Enforcer struct {
+	config  *config.QuotaConfig
+	storage storage.Storage
+	logger  zerolog.Logger
+}
+
+// NewEnforcer creates a new quota enforcer
+func NewEnforcer(cfg *config.QuotaConfig, store storage.Storage, logger zerolog.Logger) *Enforcer {
+	return &Enforcer{
+		config:  cfg,
+		storage: store,
+		logger:  logger,
+	}
+}
+
+// Limit returns the quota that applies to address
+func Limit(cfg *config.QuotaConfig, address string) config.QuotaLimit {
+	address = normalize(address)
+	for mailbox, limit := range cfg.Mailboxes {
+		if normalize(mailbox) == address {
+			return limit
+		}
+	}
+	return cfg.QuotaLimit
+}
+
+// Enforce checks email against the quota of each of its envelope
+// recipients, or of its To and Cc recipients when it has no envelope. In
+// evict mode the oldest emails of a full mailbox are deleted to make room,
+// otherwise ErrQuotaExceeded is returned. It returns the IDs of the emails
+// evicted, even when a later mailbox fails.
+func (e *Enforcer) Enforce(email *storage.Email) ([]int64, error) {
+	if !e.config.Enabled {
+		return nil, nil
+	}
+
+	recipients := email.EnvelopeTo
+	if len(recipients) == 0 {
+		recipients = append(append([]string(nil), email.To...), email.CC...)
+	}
+
+	var evicted []int64
+	seen := make(map[string]bool)
+	for _, rcpt := range recipients {
+		address := normalize(rcpt)
+		if address == "" || seen[address] {
+			continue
+		}
+		seen[address] = true
+
+		ids, err := e.enforceMailbox(address, email.Size)
+		evicted = append(evicted, ids...)
+		if err != nil {
+			return evicted, err
+		}
+	}
+
+	return evicted, nil
+}
+
+// enforceMailbox makes room for a message of size bytes in address, and
+// returns the IDs of the emails it evicts
+func (e *Enforcer) enforceMailbox(address string, size int64) ([]int64, error) {
+	limit := Limit(e.config, address)
+	if limit.MaxMessages <= 0 && limit.MaxBytes <= 0 {
+		return nil, nil
+	}
+
+	// A message larger than the whole quota never fits
+	if limit.MaxBytes > 0 && size > limit.MaxBytes {
+		return nil, fmt.Errorf("%w: %s", ErrQuotaExceeded, address)
+	}
+
+	usage, err := e.storage.MailboxUsage(address)
+	if err != nil {
+		return nil, err
+	}
+
+	full := (limit.MaxMessages > 0 && usage.Messages+1 > int64(limit.MaxMessages)) ||
+		(limit.MaxBytes > 0 && usage.Bytes+size > limit.MaxBytes)
+	if !full {
+		return nil, nil
+	}
+
+	if e.config.Overflow != "evict" {
+		e.logger.Warn().
+			Str("mailbox", address).
+			Int64("messages", usage.Messages).
+			Int64("bytes", usage.Bytes).
+			Msg("Rejected email over mailbox quota")
+		return nil, fmt.Errorf("%w: %s", ErrQuotaExceeded, address)
+	}
+
+	// Leave room for the incoming message; negative limits are not enforced
+	maxMessages := -1
+	if limit.MaxMessages > 0 {
+		maxMessages = limit.MaxMessages - 1
+	}
+	maxBytes := int64(-1)
+	if limit.MaxBytes > 0 {
+		maxBytes = limit.MaxBytes - size
+	}
+
+	evicted, err := e.storage.EvictMailbox(address, maxMessages, maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evict emails: %w", err)
+	}
+
+	e.logger.Info().
+		Str("mailbox", address).
+		Int("count", len(evicted)).
+		Msg("Evicted emails over mailbox quota")
+
+	return evicted, nil
+}
+
+// normalize returns the canonical form of a mailbox address
+func normalize(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
@@ -0,0 +1,100 @@
+package quota
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// mailboxStore holds the usage of mailboxes and records evictions; the
+// other methods of storage are not used
+type mailboxStore struct {
+	storage.Storage
+	usage   map[string]*storage.MailboxUsage
+	evict   map[string][]int64 // the IDs EvictMailbox deletes
+	checked []string
+}
+
+func (s *mailboxStore) MailboxUsage(address string) (*storage.MailboxUsage, error) {
+	s.checked = append(s.checked, address)
+	if usage, ok := s.usage[address]; ok {
+		return usage, nil
+	}
+	return &storage.MailboxUsage{Address: address}, nil
+}
+
+func (s *mailboxStore) EvictMailbox(address string, maxMessages int, maxBytes int64) ([]int64, error) {
+	return s.evict[address], nil
+}
+
+func TestEnforceRecipients(t *testing.T) {
+	cfg := &config.QuotaConfig{Enabled: true, QuotaLimit: config.QuotaLimit{MaxMessages: 10}, Overflow: "reject"}
+	for _, tc := range []struct {
+		email *storage.Email
+		want  []string
+	}{
+		// Bcc recipients are only in the envelope
+		{&storage.Email{To: []string{"list@example.com"}, EnvelopeTo: []string{"Alice@Example.com", "bob@example.com", "alice@example.com"}},
+			[]string{"alice@example.com", "bob@example.com"}},
+		{&storage.Email{To: []string{"alice@example.com"}, CC: []string{" carol@example.com", "alice@example.com"}, BCC: []string{"dave@example.com"}},
+			[]string{"alice@example.com", "carol@example.com"}},
+	} {
+		store := &mailboxStore{}
+		if _, err := NewEnforcer(cfg, store, zerolog.Nop()).Enforce(tc.email); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(store.checked, tc.want) {
+			t.Errorf("checked %v, want %v", store.checked, tc.want)
+		}
+	}
+}
+
+func TestEnforceEvict(t *testing.T) {
+	cfg := &config.QuotaConfig{
+		Enabled:    true,
+		QuotaLimit: config.QuotaLimit{MaxMessages: 2},
+		Overflow:   "evict",
+		Mailboxes:  map[string]config.QuotaLimit{"bob@example.com": {MaxBytes: 100}},
+	}
+	store := &mailboxStore{
+		usage: map[string]*storage.MailboxUsage{
+			"alice@example.com": {Messages: 2},
+			"bob@example.com":   {Messages: 1, Bytes: 90},
+		},
+		evict: map[string][]int64{"alice@example.com": {3}, "bob@example.com": {4, 5}},
+	}
+	e := NewEnforcer(cfg, store, zerolog.Nop())
+
+	evicted, err := e.Enforce(&storage.Email{Size: 20, EnvelopeTo: []string{"alice@example.com", "bob@example.com", "carol@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(evicted, []int64{3, 4, 5}) {
+		t.Errorf("evicted %v", evicted)
+	}
+
+	// Emails evicted before a mailbox that cannot take the email are
+	// still reported
+	evicted, err = e.Enforce(&storage.Email{Size: 200, EnvelopeTo: []string{"alice@example.com", "bob@example.com"}})
+	if !errors.Is(err, ErrQuotaExceeded) || !slices.Equal(evicted, []int64{3}) {
+		t.Errorf("got %v, %v", evicted, err)
+	}
+}
+
+func TestEnforceReject(t *testing.T) {
+	cfg := &config.QuotaConfig{Enabled: true, QuotaLimit: config.QuotaLimit{MaxMessages: 2}}
+	store := &mailboxStore{
+		usage: map[string]*storage.MailboxUsage{"bob@example.com": {Messages: 2}},
+		evict: map[string][]int64{"bob@example.com": {1}},
+	}
+	evicted, err := NewEnforcer(cfg, store, zerolog.Nop()).Enforce(&storage.Email{EnvelopeTo: []string{"bob@example.com"}})
+	if !errors.Is(err, ErrQuotaExceeded) || err.Error() != "mailbox quota exceeded: bob@example.com" || evicted != nil {
+		t.Errorf("got %v, %v", evicted, err)
+	}
+}
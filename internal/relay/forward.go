@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// forwardDropHeaders are removed from forwarded messages: traces of the
+// original delivery, blind copies, and signatures that no longer verify
+// once the headers are rewritten
+var forwardDropHeaders = map[string]bool{
+	"bcc":                        true,
+	"return-path":                true,
+	"delivered-to":               true,
+	"x-original-to":              true,
+	"dkim-signature":             true,
+	"arc-seal":                   true,
+	"arc-message-signature":      true,
+	"arc-authentication-results": true,
+	"authentication-results":     true,
+}
+
+// ForwardMessage prepares raw to be forwarded to to on behalf of sender.
+// Resent-* fields (RFC 5322 section 3.6.6) record the forward. When
+// rewriteFrom is set it replaces the From header, so the receiving provider
+// does not reject the message for failing the original domain's DMARC
+// policy; the original sender is kept in Reply-To and X-Original-From.
+func ForwardMessage(raw []byte, sender string, to []string, rewriteFrom string) []byte {
+	head, body := splitMessage(raw)
+	fields := splitFields(head)
+
+	var originalFrom string
+	hasReplyTo := false
+	kept := fields[:0]
+	for _, field := range fields {
+		name, value, _ := strings.Cut(field, ":")
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case forwardDropHeaders[name]:
+			continue
+		case name == "reply-to":
+			hasReplyTo = true
+		case rewriteFrom != "" && (name == "from" || name == "sender"):
+			if name == "from" {
+				originalFrom = strings.TrimSpace(value)
+			}
+			continue
+		}
+		kept = append(kept, field)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("Resent-From: " + sender + "\r\n")
+	buf.WriteString("Resent-To: " + strings.Join(to, ", ") + "\r\n")
+	buf.WriteString("Resent-Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	buf.WriteString("Resent-Message-ID: " + messageID(sender) + "\r\n")
+	if rewriteFrom != "" {
+		buf.WriteString("From: " + rewriteFrom + "\r\n")
+		if originalFrom != "" {
+			buf.WriteString("X-Original-From: " + originalFrom + "\r\n")
+			if !hasReplyTo {
+				buf.WriteString("Reply-To: " + originalFrom + "\r\n")
+			}
+		}
+	}
+	for _, field := range kept {
+		buf.WriteString(field + "\r\n")
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+// splitMessage splits a message at the blank line ending the header
+func splitMessage(raw []byte) (head, body []byte) {
+	crlf := bytes.Index(raw, []byte("\r\n\r\n"))
+	lf := bytes.Index(raw, []byte("\n\n"))
+	switch {
+	case crlf >= 0 && (lf < 0 || crlf < lf):
+		return raw[:crlf], raw[crlf+4:]
+	case lf >= 0:
+		return raw[:lf], raw[lf+2:]
+	}
+	return raw, nil
+}
+
+// splitFields returns the header fields of head, each with its folded
+// continuation lines
+func splitFields(head []byte) []string {
+	var fields []string
+	for _, line := range strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+			continue
+		}
+		if line != "" {
+			fields = append(fields, line)
+		}
+	}
+	return fields
+}
+
+// messageID returns a new Message-ID in the domain of address
+func messageID(address string) string {
+	domain := "gowebmail.local"
+	if at := strings.LastIndex(address, "@"); at >= 0 && at < len(address)-1 {
+		domain = strings.TrimRight(address[at+1:], ">")
+	}
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "<" + hex.EncodeToString(b) + "@" + domain + ">"
+}
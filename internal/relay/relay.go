@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+var (
+	// ErrNoRecipients is returned when there is nobody to deliver to
+	ErrNoRecipients = errors.New("no recipients")
+	// ErrRecipientNotAllowed is returned for recipients outside the allow list
+	ErrRecipientNotAllowed = errors.New("recipient not allowed")
+)
+
+// Relayer delivers captured messages to a real SMTP server
+type Relayer struct {
+	config *config.RelayConfig
+	logger zerolog.Logger
+}
+
+// NewRelayer creates a new relayer
+func NewRelayer(cfg *config.RelayConfig, logger zerolog.Logger) *Relayer {
+	return &Relayer{
+		config: cfg,
+		logger: logger,
+	}
+}
+
+// Allowed reports whether address matches the configured allow list.
+// An empty allow list permits every recipient.
+func (r *Relayer) Allowed(address string) bool {
+	if len(r.config.AllowedRecipients) == 0 {
+		return true
+	}
+
+	address = strings.ToLower(strings.TrimSpace(address))
+	for _, pattern := range r.config.AllowedRecipients {
+		if ok, _ := path.Match(strings.ToLower(pattern), address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Send delivers raw to the given recipients through the upstream server.
+// The configured sender overrides from when set.
+func (r *Relayer) Send(from string, to []string, raw []byte) error {
+	if len(to) == 0 {
+		return ErrNoRecipients
+	}
+	for _, rcpt := range to {
+		if !r.Allowed(rcpt) {
+			return fmt.Errorf("%w: %s", ErrRecipientNotAllowed, rcpt)
+		}
+	}
+	if r.config.From != "" {
+		from = r.config.From
+	}
+
+	addr := net.JoinHostPort(r.config.Host, strconv.Itoa(r.config.Port))
+	tlsConfig := &tls.Config{
+		ServerName:         r.config.Host,
+		InsecureSkipVerify: r.config.InsecureSkipVerify,
+	}
+
+	var client *smtp.Client
+	if r.config.TLS == "tls" {
+		conn, err := tls.Dial("tcp", addr, tlsConfig)
+		if err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", addr, err)
+		}
+		if client, err = smtp.NewClient(conn, r.config.Host); err != nil {
+			conn.Close()
+			return err
+		}
+	} else {
+		var err error
+		if client, err = smtp.Dial(addr); err != nil {
+			return fmt.Errorf("failed to connect to %s: %w", addr, err)
+		}
+	}
+	defer client.Close()
+
+	if r.config.TLS == "starttls" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("starttls failed: %w", err)
+		}
+	}
+
+	if r.config.Username != "" {
+		auth := smtp.PlainAuth("", r.config.Username, r.config.Password, r.config.Host)
+		if err := client.Auth(auth); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := client.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", rcpt, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(raw); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	r.logger.Info().
+		Str("server", addr).
+		Str("from", from).
+		Strs("to", to).
+		Msg("Email relayed")
+
+	return client.Quit()
+}
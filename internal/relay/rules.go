@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"path"
+	"strings"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// RuleRecipients returns the addresses rule relays email to, or nil if the
+// rule does not match it. A rule matches when the email has its tag and
+// at least one recipient matching its patterns. Addresses outside the
+// allow list are left out.
+func (r *Relayer) RuleRecipients(rule *config.RelayRule, email *storage.Email) []string {
+	if rule.Tag != "" && !hasTag(email.Tags, rule.Tag) {
+		return nil
+	}
+
+	recipients := email.EnvelopeTo
+	if len(recipients) == 0 {
+		recipients = append(append([]string(nil), email.To...), email.CC...)
+	}
+
+	var matched []string
+	for _, rcpt := range recipients {
+		if matchRecipient(rule.Recipients, rcpt) {
+			matched = append(matched, rcpt)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+	if len(rule.To) > 0 {
+		matched = rule.To
+	}
+
+	var to []string
+	for _, rcpt := range matched {
+		if r.Allowed(rcpt) {
+			to = append(to, rcpt)
+		} else {
+			r.logger.Warn().Str("rule", rule.Name).Str("to", rcpt).Msg("Relay rule recipient not allowed, skipped")
+		}
+	}
+	return to
+}
+
+// matchRecipient reports whether address matches one of patterns; no
+// patterns match every address
+func matchRecipient(patterns []string, address string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	address = strings.ToLower(strings.TrimSpace(address))
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), address); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasTag reports whether tags contains tag
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package render
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+// ErrBrowserNotFound is returned when no Chrome or Chromium binary is found
+var ErrBrowserNotFound = errors.New("no headless Chrome or Chromium found; set render.chrome_path")
+
+// browserNames are looked up on PATH when no chrome_path is configured
+var browserNames = []string{
+	"chromium",
+	"chromium-browser",
+	"google-chrome",
+	"google-chrome-stable",
+	"chrome",
+	"headless-shell",
+}
+
+// pageTemplate wraps an email body. The CSP stops the browser from loading
+// anything but inline styles and data: images, so screenshots do not
+// depend on the network.
+const pageTemplate = `<!DOCTYPE html>
+<html><head><meta charset="utf-8">
+<meta http-equiv="Content-Security-Policy" content="default-src 'none'; style-src 'unsafe-inline'; img-src data:">
+</head><body style="margin:0">%s</body></html>`
+
+// Renderer takes screenshots of HTML using a headless Chrome process
+type Renderer struct {
+	config *config.RenderConfig
+	logger zerolog.Logger
+	slots  chan struct{} // limits concurrent browser processes
+}
+
+// NewRenderer creates a new renderer
+func NewRenderer(cfg *config.RenderConfig, logger zerolog.Logger) *Renderer {
+	n := cfg.MaxConcurrent
+	if n < 1 {
+		n = 1
+	}
+	return &Renderer{
+		config: cfg,
+		logger: logger,
+		slots:  make(chan struct{}, n),
+	}
+}
+
+// Screenshot renders html in a viewport of the given size and returns a PNG
+func (r *Renderer) Screenshot(ctx context.Context, html string, width, height int) ([]byte, error) {
+	browser, err := r.browserPath()
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case r.slots <- struct{}{}:
+		defer func() { <-r.slots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	dir, err := os.MkdirTemp("", "gowebmail-render-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	page := filepath.Join(dir, "email.html")
+	if err := os.WriteFile(page, []byte(fmt.Sprintf(pageTemplate, html)), 0600); err != nil {
+		return nil, err
+	}
+	shot := filepath.Join(dir, "screenshot.png")
+
+	args := []string{
+		"--headless",
+		"--disable-gpu",
+		"--hide-scrollbars",
+		"--no-first-run",
+		"--disable-extensions",
+		"--user-data-dir=" + filepath.Join(dir, "profile"),
+		"--window-size=" + strconv.Itoa(width) + "," + strconv.Itoa(height),
+		"--screenshot=" + shot,
+	}
+	if r.config.NoSandbox {
+		args = append(args, "--no-sandbox")
+	}
+	args = append(args, "file://"+filepath.ToSlash(page))
+
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, browser, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("rendering timed out after %s", r.config.Timeout)
+		}
+		r.logger.Debug().Str("stderr", stderr.String()).Msg("Headless browser failed")
+		return nil, fmt.Errorf("headless browser failed: %w", err)
+	}
+
+	png, err := os.ReadFile(shot)
+	if err != nil {
+		return nil, fmt.Errorf("headless browser did not write a screenshot: %w", err)
+	}
+	return png, nil
+}
+
+// browserPath returns the configured browser, or the first one on PATH
+func (r *Renderer) browserPath() (string, error) {
+	if r.config.ChromePath != "" {
+		return r.config.ChromePath, nil
+	}
+	for _, name := range browserNames {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", ErrBrowserNotFound
+}
@@ -2,6 +2,7 @@ package retention
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -12,49 +13,90 @@ import (
 
 // Manager handles retention policy enforcement
 type Manager struct {
-	config  *config.RetentionConfig
 	storage storage.Storage
 	logger  zerolog.Logger
 	stop    chan struct{}
 	done    chan struct{}
+
+	mu     sync.Mutex
+	config config.RetentionConfig
+	reload chan struct{} // signals that SetConfig changed the policy
 }
 
 // NewManager creates a new retention policy manager
 func NewManager(cfg *config.RetentionConfig, store storage.Storage, logger zerolog.Logger) *Manager {
 	return &Manager{
-		config:  cfg,
+		config:  *cfg,
 		storage: store,
 		logger:  logger,
 		stop:    make(chan struct{}),
 		done:    make(chan struct{}),
+		reload:  make(chan struct{}, 1),
+	}
+}
+
+// SetConfig replaces the policy; a running manager applies it at once,
+// including enabling or disabling it
+func (m *Manager) SetConfig(cfg config.RetentionConfig) {
+	m.mu.Lock()
+	m.config = cfg
+	m.mu.Unlock()
+
+	select {
+	case m.reload <- struct{}{}:
+	default:
 	}
 }
 
+// Config returns the current policy
+func (m *Manager) Config() config.RetentionConfig {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.config
+}
+
 // Start starts the retention policy enforcement
 func (m *Manager) Start(ctx context.Context) {
 	defer close(m.done)
 
-	if !m.config.Enabled {
-		m.logger.Info().Msg("Retention policy disabled")
-		return
-	}
+	var ticker *time.Ticker
+	schedule := func() <-chan time.Time {
+		if ticker != nil {
+			ticker.Stop()
+			ticker = nil
+		}
+
+		cfg := m.Config()
+		if !cfg.Enabled {
+			m.logger.Info().Msg("Retention policy disabled")
+			return nil
+		}
 
-	m.logger.Info().
-		Dur("max_age", m.config.MaxAge).
-		Int("max_count", m.config.MaxCount).
-		Dur("cleanup_interval", m.config.CleanupInterval).
-		Msg("Starting retention policy manager")
+		m.logger.Info().
+			Dur("max_age", cfg.MaxAge).
+			Int("max_count", cfg.MaxCount).
+			Dur("cleanup_interval", cfg.CleanupInterval).
+			Msg("Starting retention policy manager")
 
-	ticker := time.NewTicker(m.config.CleanupInterval)
-	defer ticker.Stop()
+		ticker = time.NewTicker(cfg.CleanupInterval)
 
-	// Run cleanup immediately on start
-	m.cleanup()
+		// Run cleanup immediately on start
+		m.cleanup()
+		return ticker.C
+	}
+	tick := schedule()
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-tick:
 			m.cleanup()
+		case <-m.reload:
+			tick = schedule()
 		case <-m.stop:
 			m.logger.Info().Msg("Retention policy manager stopped")
 			return
@@ -71,17 +113,68 @@ func (m *Manager) Stop() {
 	<-m.done
 }
 
+// Result describes a retention pass
+type Result struct {
+	DryRun bool `json:"dryRun"`
+
+	// Before is the cut-off of max_age, MaxCount the limit of max_count;
+	// each is left out if not set
+	Before   *time.Time `json:"before,omitempty"`
+	MaxCount int        `json:"maxCount,omitempty"`
+
+	// Deleted counts the emails deleted, or for a dry run the emails that
+	// would be, in total and by the limit they exceed
+	Deleted  int64            `json:"deleted"`
+	ByReason map[string]int64 `json:"byReason"`
+
+	// Emails lists the emails a dry run would delete, oldest first
+	Emails []*storage.ExpiredEmail `json:"emails,omitempty"`
+}
+
 // cleanup performs the cleanup operation
 func (m *Manager) cleanup() {
-	m.logger.Debug().Msg("Running retention policy cleanup")
+	m.Run(false)
+}
+
+// Run applies the policy now, whether or not it is enabled. A dry run
+// deletes nothing and lists what would be deleted instead.
+func (m *Manager) Run(dryRun bool) (*Result, error) {
+	cfg := m.Config()
+	m.logger.Debug().Bool("dry_run", dryRun).Msg("Running retention policy cleanup")
+
+	result := &Result{
+		DryRun:   dryRun,
+		MaxCount: cfg.MaxCount,
+		ByReason: map[string]int64{},
+	}
+	var before time.Time
+	if cfg.MaxAge > 0 {
+		before = time.Now().Add(-cfg.MaxAge)
+		result.Before = &before
+	}
+
+	if dryRun {
+		expired, err := m.storage.ExpiredEmails(before, cfg.MaxCount)
+		if err != nil {
+			return nil, err
+		}
+		result.Emails = expired
+		for _, email := range expired {
+			result.ByReason[email.Reason]++
+		}
+		result.Deleted = int64(len(expired))
+		return result, nil
+	}
 
 	// Delete old emails
-	if m.config.MaxAge > 0 {
-		before := time.Now().Add(-m.config.MaxAge)
+	if cfg.MaxAge > 0 {
 		deleted, err := m.storage.DeleteOldEmails(before)
 		if err != nil {
 			m.logger.Error().Err(err).Msg("Failed to delete old emails")
-		} else if deleted > 0 {
+			return nil, err
+		}
+		result.ByReason["max_age"] = deleted
+		if deleted > 0 {
 			m.logger.Info().
 				Int64("count", deleted).
 				Time("before", before).
@@ -90,15 +183,21 @@ func (m *Manager) cleanup() {
 	}
 
 	// Delete excess emails
-	if m.config.MaxCount > 0 {
-		deleted, err := m.storage.DeleteExcessEmails(m.config.MaxCount)
+	if cfg.MaxCount > 0 {
+		deleted, err := m.storage.DeleteExcessEmails(cfg.MaxCount)
 		if err != nil {
 			m.logger.Error().Err(err).Msg("Failed to delete excess emails")
-		} else if deleted > 0 {
+			return nil, err
+		}
+		result.ByReason["max_count"] = deleted
+		if deleted > 0 {
 			m.logger.Info().
 				Int64("count", deleted).
-				Int("max_count", m.config.MaxCount).
+				Int("max_count", cfg.MaxCount).
 				Msg("Deleted excess emails")
 		}
 	}
+
+	result.Deleted = result.ByReason["max_age"] + result.ByReason["max_count"]
+	return result, nil
 }
@@ -0,0 +1,491 @@
+// Package seed generates realistic fake emails, with varied senders, HTML
+// templates, attachments and reply threads, for UI development and demos
+package seed
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"gowebmail/internal/email"
+)
+
+// MaxCount bounds the number of emails generated at once
+const MaxCount = 1000
+
+// Options controls what Generate produces
+type Options struct {
+	Count int
+
+	// Seed makes the output repeatable; 0 picks a random seed
+	Seed int64
+
+	// To are the recipients to address; a made-up team when empty
+	To []string
+
+	// Spread is how far back receipt times go; 0 receives everything now
+	Spread time.Duration
+
+	// Now is the time of the latest email; the current time when zero
+	Now time.Time
+}
+
+// Message is a generated message and its envelope
+type Message struct {
+	Raw        []byte
+	From       string
+	To         []string
+	ReceivedAt time.Time
+}
+
+// person is a sender or recipient
+type person struct {
+	name    string
+	address string
+}
+
+func (p person) String() string {
+	return (&mail.Address{Name: p.name, Address: p.address}).String()
+}
+
+var (
+	firstNames = []string{"Alice", "Bob", "Carol", "Dave", "Erin", "Frank", "Grace", "Heidi", "Ivan", "Judy", "Mallory", "Niaj", "Olivia", "Peggy", "Rupert", "Sybil", "Trent", "Victor", "Walter", "Yuki"}
+	lastNames  = []string{"Anderson", "Brown", "Chen", "Dubois", "Evans", "Fischer", "Garcia", "Haddad", "Ivanova", "Jensen", "Kowalski", "Lopez", "Moreau", "Nakamura", "Okafor", "Patel", "Rossi", "Silva", "Tanaka", "Weber"}
+	domains    = []string{"example.com", "example.org", "example.net", "acme.example", "globex.example"}
+
+	// services send the transactional templates
+	services = map[string]person{
+		"shop":       {"Acme Store", "orders@shop.example"},
+		"cloud":      {"Globex Cloud", "no-reply@globex.example"},
+		"newsletter": {"The Weekly Byte", "newsletter@weeklybyte.example"},
+		"tracker":    {"Tracker", "notifications@tracker.example"},
+		"hr":         {"Initech People Team", "people@initech.example"},
+	}
+
+	products = []string{"Mechanical Keyboard", "USB-C Hub", "Noise-Cancelling Headphones", "Standing Desk Mat", "27\" Monitor", "Ergonomic Mouse", "Webcam Cover", "Laptop Sleeve"}
+	projects = []string{"checkout-service", "mobile-app", "billing", "design-system", "data-pipeline", "docs"}
+	topics   = []string{"Q3 planning", "the offsite", "Friday's demo", "the migration", "hiring plan", "the new dashboard", "customer feedback", "release notes"}
+)
+
+// generator holds the state of one Generate call
+type generator struct {
+	rand       *rand.Rand
+	recipients []person
+	drafts     []*email.Draft
+}
+
+// templates are weighted by how often they appear in a real inbox
+var templates = []struct {
+	weight int
+	build  func(g *generator, to person) (*email.Draft, error)
+}{
+	{4, (*generator).conversation},
+	{2, (*generator).orderConfirmation},
+	{1, (*generator).passwordReset},
+	{1, (*generator).welcome},
+	{2, (*generator).newsletter},
+	{3, (*generator).notification},
+	{1, (*generator).report},
+}
+
+// Generate returns opts.Count messages, oldest first
+func Generate(opts Options) ([]*Message, error) {
+	if opts.Count < 1 || opts.Count > MaxCount {
+		return nil, fmt.Errorf("count must be between 1 and %d", MaxCount)
+	}
+	if opts.Spread < 0 {
+		return nil, errors.New("spread must not be negative")
+	}
+	seed := opts.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	g := &generator{rand: rand.New(rand.NewSource(seed))}
+	for _, to := range opts.To {
+		addr, err := mail.ParseAddress(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %s", to)
+		}
+		g.recipients = append(g.recipients, person{addr.Name, addr.Address})
+	}
+	if len(g.recipients) == 0 {
+		for i := 0; i < 4; i++ {
+			g.recipients = append(g.recipients, g.person("example.com"))
+		}
+	}
+
+	total := 0
+	for _, t := range templates {
+		total += t.weight
+	}
+	for len(g.drafts) < opts.Count {
+		n := g.rand.Intn(total)
+		build := templates[0].build
+		for _, t := range templates {
+			if n < t.weight {
+				build = t.build
+				break
+			}
+			n -= t.weight
+		}
+
+		draft, err := build(g, g.pick(g.recipients))
+		if err != nil {
+			return nil, err
+		}
+		g.drafts = append(g.drafts, draft)
+	}
+	g.drafts = g.drafts[:opts.Count]
+
+	// Receipt times are spread in order, so replies follow what they
+	// answer
+	offsets := make([]time.Duration, len(g.drafts))
+	for i := range offsets {
+		if opts.Spread > 0 {
+			offsets[i] = time.Duration(g.rand.Int63n(int64(opts.Spread)))
+		}
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] > offsets[j] })
+
+	messages := make([]*Message, len(g.drafts))
+	for i, draft := range g.drafts {
+		received := now.Add(-offsets[i]).Add(time.Duration(i-len(g.drafts)+1) * time.Second).Truncate(time.Second)
+		msg, err := compose(draft, received)
+		if err != nil {
+			return nil, err
+		}
+		messages[i] = msg
+	}
+	return messages, nil
+}
+
+// compose composes draft as received at the given time
+func compose(draft *email.Draft, received time.Time) (*Message, error) {
+	if draft.Headers == nil {
+		draft.Headers = make(map[string]string)
+	}
+	draft.Headers["Date"] = received.Format(time.RFC1123Z)
+
+	raw, err := email.Compose(draft)
+	if err != nil {
+		return nil, err
+	}
+	from, err := mail.ParseAddress(draft.From)
+	if err != nil {
+		return nil, err
+	}
+	var rcpts []string
+	for _, to := range append(append([]string(nil), draft.To...), draft.CC...) {
+		if addr, err := mail.ParseAddress(to); err == nil {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	return &Message{Raw: raw, From: from.Address, To: rcpts, ReceivedAt: received}, nil
+}
+
+func (g *generator) pick(list []person) person {
+	return list[g.rand.Intn(len(list))]
+}
+
+func (g *generator) pickString(list []string) string {
+	return list[g.rand.Intn(len(list))]
+}
+
+// person makes up a person, at domain or a random one
+func (g *generator) person(domain string) person {
+	first, last := g.pickString(firstNames), g.pickString(lastNames)
+	if domain == "" {
+		domain = g.pickString(domains)
+	}
+	return person{first + " " + last, strings.ToLower(first+"."+last) + "@" + domain}
+}
+
+// messageID makes up a Message-ID at domain
+func (g *generator) messageID(domain string) string {
+	return fmt.Sprintf("<seed.%016x@%s>", g.rand.Uint64(), domain)
+}
+
+// domainOf returns the domain of an address
+func domainOf(address string) string {
+	if at := strings.LastIndex(address, "@"); at >= 0 {
+		return address[at+1:]
+	}
+	return "gowebmail.local"
+}
+
+// conversation is a plain-text message between people, often followed by
+// replies that thread with it
+func (g *generator) conversation(to person) (*email.Draft, error) {
+	from := g.person("")
+	topic := g.pickString(topics)
+	subject := g.pickString([]string{
+		"Quick question about %s",
+		"Notes from %s",
+		"Re-scheduling %s",
+		"Thoughts on %s?",
+	})
+	subject = fmt.Sprintf(subject, topic)
+
+	id := g.messageID(domainOf(from.address))
+	body := fmt.Sprintf("Hi %s,\n\n%s\n\nBest,\n%s\n",
+		firstName(to),
+		g.pickString([]string{
+			"Do you have a few minutes this week to go over " + topic + "? I put some notes in the shared doc.",
+			"I went through " + topic + " again and I think we can simplify the timeline. Let me know what you think.",
+			"Following up on " + topic + ": could you send me the latest numbers before Thursday?",
+		}),
+		firstName(from))
+	draft := &email.Draft{
+		From:    from.String(),
+		To:      []string{to.String()},
+		Subject: subject,
+		Text:    body,
+		Headers: map[string]string{"Message-Id": id},
+	}
+	if g.rand.Intn(3) == 0 {
+		draft.CC = []string{g.person(domainOf(from.address)).String()}
+	}
+
+	if g.rand.Intn(2) == 0 {
+		return draft, nil
+	}
+
+	// The original and all but the last reply are queued here; the
+	// caller queues the last reply
+	g.drafts = append(g.drafts, draft)
+	replies := 1 + g.rand.Intn(3)
+	references := id
+	sender, recipient := to, from
+	quoted := body
+	for i := 0; ; i++ {
+		replyID := g.messageID(domainOf(sender.address))
+		quotedName := recipient.name
+		if quotedName == "" {
+			quotedName = recipient.address
+		}
+		text := fmt.Sprintf("%s\n\n%s\n\n%s wrote:\n%s",
+			g.pickString([]string{"Sounds good, thanks!", "Works for me. Tuesday at 10?", "I've added my comments to the doc.", "Can we loop in the rest of the team?"}),
+			firstName(sender),
+			quotedName,
+			quote(quoted))
+		reply := &email.Draft{
+			From:    sender.String(),
+			To:      []string{recipient.String()},
+			Subject: "Re: " + subject,
+			Text:    text,
+			Headers: map[string]string{
+				"Message-Id":  replyID,
+				"In-Reply-To": references[strings.LastIndex(references, " ")+1:],
+				"References":  references,
+			},
+		}
+		if i == replies-1 {
+			return reply, nil
+		}
+		g.drafts = append(g.drafts, reply)
+
+		references += " " + replyID
+		quoted = text
+		sender, recipient = recipient, sender
+	}
+}
+
+// quote prefixes every line of text with "> "
+func quote(text string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (g *generator) orderConfirmation(to person) (*email.Draft, error) {
+	order := 100000 + g.rand.Intn(900000)
+	var rows, csv strings.Builder
+	total := 0
+	for i, n := 0, 1+g.rand.Intn(3); i < n; i++ {
+		product := g.pickString(products)
+		cents := 999 + g.rand.Intn(20000)
+		total += cents
+		fmt.Fprintf(&rows, `<tr><td style="padding:8px;border-bottom:1px solid #eee">%s</td><td style="padding:8px;border-bottom:1px solid #eee;text-align:right">$%d.%02d</td></tr>`, product, cents/100, cents%100)
+		fmt.Fprintf(&csv, "%s: $%d.%02d\n", product, cents/100, cents%100)
+	}
+
+	html := layout("Thanks for your order!", fmt.Sprintf(
+		`<p>Hi %s, we've received order <strong>#%d</strong> and will let you know when it ships.</p>
+<table style="width:100%%;border-collapse:collapse">%s<tr><td style="padding:8px"><strong>Total</strong></td><td style="padding:8px;text-align:right"><strong>$%d.%02d</strong></td></tr></table>
+%s`, firstName(to), order, rows.String(), total/100, total%100, button("View your order", fmt.Sprintf("https://shop.example/orders/%d", order))))
+
+	return &email.Draft{
+		From:    services["shop"].String(),
+		To:      []string{to.String()},
+		Subject: fmt.Sprintf("Your Acme Store order #%d", order),
+		Text:    fmt.Sprintf("Thanks for your order #%d!\n\n%sTotal: $%d.%02d\n", order, csv.String(), total/100, total%100),
+		HTML:    html,
+		Attachments: []email.DraftAttachment{{
+			Filename:    fmt.Sprintf("invoice-%d.pdf", order),
+			ContentType: "application/pdf",
+			Content:     fakePDF(fmt.Sprintf("Invoice %d", order)),
+		}},
+	}, nil
+}
+
+func (g *generator) passwordReset(to person) (*email.Draft, error) {
+	token := fmt.Sprintf("%016x", g.rand.Uint64())
+	link := "https://app.globex.example/reset?token=" + token
+	return &email.Draft{
+		From:    services["cloud"].String(),
+		To:      []string{to.String()},
+		Subject: "Reset your Globex Cloud password",
+		Text:    fmt.Sprintf("Hi %s,\n\nUse this link to reset your password within the next hour:\n%s\n\nIf you didn't ask for this, you can ignore this email.\n", firstName(to), link),
+		HTML: layout("Reset your password", fmt.Sprintf(
+			`<p>Hi %s,</p><p>Someone asked to reset the password of your Globex Cloud account. The link expires in one hour.</p>%s<p style="color:#888;font-size:12px">If you didn't ask for this, you can ignore this email.</p>`,
+			firstName(to), button("Reset password", link))),
+	}, nil
+}
+
+func (g *generator) welcome(to person) (*email.Draft, error) {
+	return &email.Draft{
+		From:    services["cloud"].String(),
+		To:      []string{to.String()},
+		Subject: "Welcome to Globex Cloud, " + firstName(to) + "!",
+		Text:    "Welcome aboard! Your workspace is ready at https://app.globex.example\n",
+		HTML: layout("Welcome aboard 🎉", fmt.Sprintf(
+			`<p>Hi %s, your workspace is ready. Here's how to get started:</p><ol><li>Invite your team</li><li>Connect a repository</li><li>Deploy your first app</li></ol>%s`,
+			firstName(to), button("Open your workspace", "https://app.globex.example"))),
+	}, nil
+}
+
+func (g *generator) newsletter(to person) (*email.Draft, error) {
+	issue := 1 + g.rand.Intn(200)
+	var html, text strings.Builder
+	for i := 0; i < 3; i++ {
+		topic := g.pickString(topics)
+		project := g.pickString(projects)
+		fmt.Fprintf(&html, `<h2 style="font-size:18px">How teams handle %s</h2><p>This week we look at how the %s team approached %s, and what they'd do differently next time.</p><p><a href="https://weeklybyte.example/%d/%d">Read more →</a></p>`, topic, project, topic, issue, i)
+		fmt.Fprintf(&text, "How teams handle %s\nhttps://weeklybyte.example/%d/%d\n\n", topic, issue, i)
+	}
+	html.WriteString(`<p style="color:#888;font-size:12px"><a href="https://weeklybyte.example/unsubscribe">Unsubscribe</a></p>`)
+
+	return &email.Draft{
+		From:    services["newsletter"].String(),
+		To:      []string{to.String()},
+		Subject: fmt.Sprintf("The Weekly Byte #%d", issue),
+		Text:    text.String(),
+		HTML:    layout(fmt.Sprintf("The Weekly Byte — Issue %d", issue), html.String()),
+		Headers: map[string]string{
+			"List-Unsubscribe": "<https://weeklybyte.example/unsubscribe>",
+		},
+	}, nil
+}
+
+func (g *generator) notification(to person) (*email.Draft, error) {
+	project := g.pickString(projects)
+	number := 1 + g.rand.Intn(999)
+	actor := g.person("")
+	event := g.pickString([]string{"commented on", "approved", "requested changes on", "merged"})
+	url := fmt.Sprintf("https://tracker.example/%s/pull/%d", project, number)
+
+	return &email.Draft{
+		From:    (person{actor.name + " (Tracker)", services["tracker"].address}).String(),
+		To:      []string{to.String()},
+		Subject: fmt.Sprintf("[%s] %s %s #%d", project, actor.name, event, number),
+		Text:    fmt.Sprintf("%s %s pull request #%d in %s.\n\n%s\n", actor.name, event, number, project, url),
+		HTML: layout(project, fmt.Sprintf(`<p><strong>%s</strong> %s pull request <a href="%s">#%d</a>.</p>%s`,
+			actor.name, event, url, number, button("View on Tracker", url))),
+		Headers: map[string]string{
+			// Threads notifications about the same pull request
+			"References": fmt.Sprintf("<%s/pull/%d@tracker.example>", project, number),
+		},
+	}, nil
+}
+
+func (g *generator) report(to person) (*email.Draft, error) {
+	var csv strings.Builder
+	csv.WriteString("date,signups,revenue\n")
+	for day := 1; day <= 7; day++ {
+		fmt.Fprintf(&csv, "2026-01-%02d,%d,%d\n", day, 20+g.rand.Intn(80), 1000+g.rand.Intn(9000))
+	}
+
+	return &email.Draft{
+		From:    services["hr"].String(),
+		To:      []string{to.String()},
+		Subject: "Weekly metrics report",
+		Text:    "Hi all,\n\nAttached are this week's numbers, plus the team photo from the offsite.\n\nThe People Team\n",
+		Attachments: []email.DraftAttachment{
+			{Filename: "metrics.csv", ContentType: "text/csv", Content: []byte(csv.String())},
+			{Filename: "team.png", ContentType: "image/png", Content: pixelPNG},
+		},
+	}, nil
+}
+
+// firstName returns the first name of a person, or the local part of
+// their address if the name is unknown
+func firstName(p person) string {
+	if fields := strings.Fields(p.name); len(fields) > 0 {
+		return fields[0]
+	}
+	local, _, _ := strings.Cut(p.address, "@")
+	return local
+}
+
+// layout wraps content in the table-based layout common to HTML emails
+func layout(title, content string) string {
+	return `<!DOCTYPE html><html><body style="margin:0;background:#f4f4f7;font-family:Helvetica,Arial,sans-serif">
+<table width="100%" cellpadding="0" cellspacing="0"><tr><td align="center" style="padding:24px">
+<table width="600" cellpadding="0" cellspacing="0" style="background:#fff;border-radius:6px">
+<tr><td style="padding:24px;border-bottom:1px solid #eee"><h1 style="margin:0;font-size:22px;color:#333">` + title + `</h1></td></tr>
+<tr><td style="padding:24px;color:#333;line-height:1.5">` + content + `</td></tr>
+</table></td></tr></table></body></html>`
+}
+
+// button renders a call-to-action link
+func button(label, href string) string {
+	return `<p><a href="` + href + `" style="display:inline-block;padding:12px 20px;background:#3869d4;color:#fff;text-decoration:none;border-radius:4px">` + label + `</a></p>`
+}
+
+// fakePDF returns a minimal one-page PDF showing text
+func fakePDF(text string) []byte {
+	stream := fmt.Sprintf("BT /F1 24 Tf 72 720 Td (%s) Tj ET", text)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(stream), stream),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+
+	var b strings.Builder
+	b.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, obj := range objects {
+		offsets[i] = b.Len()
+		fmt.Fprintf(&b, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xref := b.Len()
+	fmt.Fprintf(&b, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&b, "%010d 00000 n \n", off)
+	}
+	fmt.Fprintf(&b, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return []byte(b.String())
+}
+
+// pixelPNG is a 1x1 PNG image
+var pixelPNG = []byte{
+	0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0x00, 0x00, 0x0d,
+	0x49, 0x48, 0x44, 0x52, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01,
+	0x08, 0x06, 0x00, 0x00, 0x00, 0x1f, 0x15, 0xc4, 0x89, 0x00, 0x00, 0x00,
+	0x0d, 0x49, 0x44, 0x41, 0x54, 0x78, 0x9c, 0x63, 0x60, 0x60, 0xf8, 0xcf,
+	0x00, 0x00, 0x02, 0x05, 0x01, 0x02, 0xa7, 0x6e, 0x3b, 0x95, 0x00, 0x00,
+	0x00, 0x00, 0x49, 0x45, 0x4e, 0x44, 0xae, 0x42, 0x60, 0x82,
+}
@@ -2,35 +2,40 @@ package smtp
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"time"
+	"net"
+	"sync/atomic"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 	"github.com/rs/zerolog"
 
+	"gowebmail/internal/access"
 	"gowebmail/internal/config"
-	"gowebmail/internal/email"
-	"gowebmail/internal/storage"
+	"gowebmail/internal/ingest"
+	"gowebmail/internal/quota"
 )
 
 // Server represents the SMTP server
 type Server struct {
-	config    *config.SMTPConfig
-	storage   storage.Storage
-	parser    *email.Parser
-	logger    zerolog.Logger
-	server    *smtp.Server
-	onNewMail func(*storage.Email)
+	config   *config.SMTPConfig
+	pipeline ingest.Deliverer
+	logger   zerolog.Logger
+	server   *smtp.Server
+
+	// listening is set while the listener is bound
+	listening atomic.Bool
 }
 
-// NewServer creates a new SMTP server
-func NewServer(cfg *config.SMTPConfig, store storage.Storage, logger zerolog.Logger) *Server {
+// NewServer creates a new SMTP server that hands received messages to
+// pipeline, or to a router that picks their namespaces
+func NewServer(cfg *config.SMTPConfig, pipeline ingest.Deliverer, logger zerolog.Logger) *Server {
 	s := &Server{
-		config:  cfg,
-		storage: store,
-		parser:  email.NewParser(),
-		logger:  logger,
+		config:   cfg,
+		pipeline: pipeline,
+		logger:   logger,
 	}
 
 	// Create SMTP server
@@ -46,29 +51,57 @@ func NewServer(cfg *config.SMTPConfig, store storage.Storage, logger zerolog.Log
 	return s
 }
 
-// SetNewMailCallback sets the callback for new emails
-func (s *Server) SetNewMailCallback(callback func(*storage.Email)) {
-	s.onNewMail = callback
-}
-
 // Start starts the SMTP server
 func (s *Server) Start() error {
+	l, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts SMTP connections on l until Shutdown is called
+func (s *Server) Serve(l net.Listener) error {
+	// Refuse clients outside the access lists before anything else
+	l, err := access.Listener(l, &s.config.Access, s.logger)
+	if err != nil {
+		return err
+	}
+
 	s.logger.Info().
-		Str("addr", s.server.Addr).
+		Str("addr", l.Addr().String()).
 		Msg("Starting SMTP server")
-	return s.server.ListenAndServe()
+
+	s.listening.Store(true)
+	defer s.listening.Store(false)
+
+	err = s.server.Serve(l)
+	if errors.Is(err, smtp.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
 // Shutdown gracefully shuts down the SMTP server
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.logger.Info().Msg("Shutting down SMTP server")
+	s.listening.Store(false)
 	return s.server.Shutdown(ctx)
 }
 
+// Ready returns an error unless the server is accepting connections
+func (s *Server) Ready(ctx context.Context) error {
+	if !s.listening.Load() {
+		return fmt.Errorf("not listening on %s", s.server.Addr)
+	}
+	return nil
+}
+
 // NewSession implements smtp.Backend interface
 func (s *Server) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	return &Session{
 		server: s,
+		conn:   c,
 		logger: s.logger.With().
 			Str("remote", c.Conn().RemoteAddr().String()).
 			Logger(),
@@ -78,14 +111,26 @@ func (s *Server) NewSession(c *smtp.Conn) (smtp.Session, error) {
 // Session represents an SMTP session
 type Session struct {
 	server *Server
+	conn   *smtp.Conn
 	logger zerolog.Logger
 	from   string
 	to     []string
+	user   string
 }
 
-// AuthPlain implements smtp.Session interface (not used, auth disabled)
-func (s *Session) AuthPlain(username, password string) error {
-	return nil
+// AuthMechanisms implements smtp.AuthSession interface
+func (s *Session) AuthMechanisms() []string {
+	return []string{sasl.Plain}
+}
+
+// Auth implements smtp.AuthSession interface. Any credentials are
+// accepted; the user name routes the mail to a namespace.
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		s.user = username
+		s.logger.Debug().Str("user", username).Msg("AUTH PLAIN")
+		return nil
+	}), nil
 }
 
 // Mail implements smtp.Session interface
@@ -106,42 +151,24 @@ func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
 func (s *Session) Data(r io.Reader) error {
 	s.logger.Debug().Msg("Receiving email data")
 
-	// Parse email
-	email, err := s.server.parser.Parse(r)
-	if err != nil {
-		s.logger.Error().Err(err).Msg("Failed to parse email")
-		return fmt.Errorf("failed to parse email: %w", err)
-	}
-
-	// Set envelope data if not present in headers
-	if email.From == "" {
-		email.From = s.from
+	_, err := s.server.pipeline.Deliver(r, &ingest.Envelope{
+		Source:   "smtp",
+		From:     s.from,
+		To:       s.to,
+		RemoteIP: remoteIP(s.conn.Conn().RemoteAddr()),
+		Helo:     s.conn.Hostname(),
+		User:     s.user,
+	})
+	if errors.Is(err, quota.ErrQuotaExceeded) {
+		return &smtp.SMTPError{
+			Code:         552,
+			EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+			Message:      err.Error(),
+		}
 	}
-	if len(email.To) == 0 {
-		email.To = s.to
-	}
-	email.ReceivedAt = time.Now()
-
-	// Save to storage
-	id, err := s.server.storage.SaveEmail(email)
 	if err != nil {
-		s.logger.Error().Err(err).Msg("Failed to save email")
-		return fmt.Errorf("failed to save email: %w", err)
-	}
-
-	email.ID = id
-
-	s.logger.Info().
-		Int64("id", id).
-		Str("from", email.From).
-		Strs("to", email.To).
-		Str("subject", email.Subject).
-		Int64("size", email.Size).
-		Msg("Email received and saved")
-
-	// Notify callback
-	if s.server.onNewMail != nil {
-		go s.server.onNewMail(email)
+		s.logger.Error().Err(err).Msg("Failed to deliver email")
+		return err
 	}
 
 	return nil
@@ -157,3 +184,11 @@ func (s *Session) Reset() {
 func (s *Session) Logout() error {
 	return nil
 }
+
+// remoteIP returns the IP address of a TCP client
+func remoteIP(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return nil
+}
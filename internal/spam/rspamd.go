@@ -0,0 +1,79 @@
+package spam
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"gowebmail/internal/storage"
+)
+
+// rspamdResponse is the part of the /checkv2 response we use
+type rspamdResponse struct {
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	Action        string  `json:"action"`
+	Symbols       map[string]struct {
+		Name        string  `json:"name"`
+		Score       float64 `json:"score"`
+		Description string  `json:"description"`
+	} `json:"symbols"`
+	Error string `json:"error"`
+}
+
+// checkRspamd scans a message with the rspamd HTTP protocol
+func (c *Checker) checkRspamd(raw []byte, from string, to []string) (*storage.SpamResult, error) {
+	req, err := http.NewRequest("POST", strings.TrimSuffix(c.config.URL, "/")+"/checkv2", bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	if c.config.Password != "" {
+		req.Header.Set("Password", c.config.Password)
+	}
+	if from != "" {
+		req.Header.Set("From", from)
+	}
+	for _, rcpt := range to {
+		req.Header.Add("Rcpt", rcpt)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var r rspamdResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	if r.Error != "" {
+		return nil, fmt.Errorf("%s", r.Error)
+	}
+
+	result := &storage.SpamResult{
+		Score:     r.Score,
+		Threshold: r.RequiredScore,
+		Action:    r.Action,
+		Rules:     []storage.SpamRule{},
+	}
+	// rspamd always scores; the action says what it would do with the
+	// message, and anything that is not let through counts as spam
+	result.IsSpam = r.Action != "" && r.Action != "no action" && r.Action != "greylist"
+	for name, symbol := range r.Symbols {
+		result.Rules = append(result.Rules, storage.SpamRule{
+			Name:        name,
+			Score:       symbol.Score,
+			Description: symbol.Description,
+		})
+	}
+	return result, nil
+}
@@ -0,0 +1,73 @@
+package spam
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+	"gowebmail/internal/storage"
+)
+
+// Engines
+const (
+	EngineRspamd       = "rspamd"
+	EngineSpamAssassin = "spamassassin"
+)
+
+// Checker scores messages with rspamd or SpamAssassin. It only reports
+// verdicts; mail is never rejected.
+type Checker struct {
+	config *config.SpamConfig
+	client *http.Client
+	logger zerolog.Logger
+}
+
+// NewChecker creates a new spam checker
+func NewChecker(cfg *config.SpamConfig, logger zerolog.Logger) (*Checker, error) {
+	switch cfg.Engine {
+	case EngineRspamd, EngineSpamAssassin:
+	default:
+		return nil, fmt.Errorf("unknown spam engine %q; use rspamd or spamassassin", cfg.Engine)
+	}
+
+	return &Checker{
+		config: cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		logger: logger.With().Str("component", "spam").Logger(),
+	}, nil
+}
+
+// Check scores the raw message. The envelope sender and recipients help
+// rules that look at them, such as SPF.
+func (c *Checker) Check(raw []byte, from string, to []string) (*storage.SpamResult, error) {
+	var result *storage.SpamResult
+	var err error
+	switch c.config.Engine {
+	case EngineRspamd:
+		result, err = c.checkRspamd(raw, from, to)
+	default:
+		result, err = c.checkSpamd(raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.config.Engine, err)
+	}
+
+	result.Engine = c.config.Engine
+	result.CheckedAt = time.Now()
+	sortRules(result.Rules)
+	return result, nil
+}
+
+// sortRules puts the rules that added the most to the score first
+func sortRules(rules []storage.SpamRule) {
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Score != rules[j].Score {
+			return rules[i].Score > rules[j].Score
+		}
+		return rules[i].Name < rules[j].Name
+	})
+}
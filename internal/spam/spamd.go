@@ -0,0 +1,120 @@
+package spam
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gowebmail/internal/storage"
+)
+
+// spamHeader is the Spam header of a spamd response, e.g.
+// "True ; 15.2 / 5.0"
+var spamHeader = regexp.MustCompile(`^(True|False|Yes|No)\s*;\s*(-?[0-9.]+)\s*/\s*(-?[0-9.]+)`)
+
+// reportRule is a line of the report table, e.g.
+// " 1.2 MISSING_HEADERS        Missing To: header"
+var reportRule = regexp.MustCompile(`^\s*(-?[0-9]+\.[0-9]+)\s+([A-Z0-9_]+)\s*(.*)$`)
+
+// checkSpamd scans a message with the spamd protocol (SPAMC/1.5). The
+// REPORT command returns the score and the table of matched rules.
+func (c *Checker) checkSpamd(raw []byte) (*storage.SpamResult, error) {
+	conn, err := net.DialTimeout("tcp", c.config.Address, c.config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if c.config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(c.config.Timeout))
+	}
+
+	request := fmt.Sprintf("REPORT SPAMC/1.5\r\nContent-length: %d\r\n", len(raw))
+	if c.config.User != "" {
+		request += "User: " + c.config.User + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(raw); err != nil {
+		return nil, err
+	}
+
+	return parseSpamdResponse(bufio.NewReader(conn))
+}
+
+// parseSpamdResponse reads the status line, headers and report of a spamd
+// response
+func parseSpamdResponse(r *bufio.Reader) (*storage.SpamResult, error) {
+	status, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("invalid response: %w", err)
+	}
+	// e.g. "SPAMD/1.1 0 EX_OK"
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return nil, fmt.Errorf("invalid response %q", strings.TrimSpace(status))
+	}
+	if fields[1] != "0" {
+		return nil, fmt.Errorf("spamd error: %s", strings.Join(fields[1:], " "))
+	}
+
+	var result *storage.SpamResult
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("invalid response: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if !strings.EqualFold(name, "Spam") {
+			continue
+		}
+		m := spamHeader.FindStringSubmatch(strings.TrimSpace(value))
+		if m == nil {
+			return nil, fmt.Errorf("invalid Spam header %q", value)
+		}
+		result = &storage.SpamResult{IsSpam: m[1] == "True" || m[1] == "Yes"}
+		result.Score, _ = strconv.ParseFloat(m[2], 64)
+		result.Threshold, _ = strconv.ParseFloat(m[3], 64)
+	}
+	if result == nil {
+		return nil, fmt.Errorf("response has no Spam header")
+	}
+
+	result.Rules = parseSpamdReport(r)
+	return result, nil
+}
+
+// parseSpamdReport reads the rules from the table at the end of a report.
+// Descriptions may continue on indented lines without a score.
+func parseSpamdReport(r *bufio.Reader) []storage.SpamRule {
+	rules := []storage.SpamRule{}
+	scanner := bufio.NewScanner(r)
+	inTable := false
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if !inTable {
+			inTable = strings.HasPrefix(line, "----")
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		if m := reportRule.FindStringSubmatch(line); m != nil {
+			score, _ := strconv.ParseFloat(m[1], 64)
+			rules = append(rules, storage.SpamRule{Name: m[2], Score: score, Description: strings.TrimSpace(m[3])})
+		} else if len(rules) > 0 {
+			last := &rules[len(rules)-1]
+			last.Description = strings.TrimSpace(last.Description + " " + strings.TrimSpace(line))
+		}
+	}
+	return rules
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Histogram intervals supported by Analytics
+const (
+	IntervalHour = "hour"
+	IntervalDay  = "day"
+)
+
+// AnalyticsQuery selects the emails Analytics summarizes
+type AnalyticsQuery struct {
+	Since    time.Time
+	Until    time.Time
+	Interval string // IntervalHour or IntervalDay
+	Top      int    // number of top senders and recipients
+}
+
+// Analytics summarizes the mail received in a time range
+type Analytics struct {
+	Since         time.Time         `json:"since"`
+	Until         time.Time         `json:"until"`
+	Interval      string            `json:"interval"`
+	Received      int64             `json:"received"`
+	Bytes         int64             `json:"bytes"`
+	Histogram     []HistogramBucket `json:"histogram"` // buckets without mail are left out
+	TopSenders    []AddressCount    `json:"topSenders"`
+	TopRecipients []AddressCount    `json:"topRecipients"`
+	Sizes         SizeStats         `json:"sizes"`
+	ParseFailures int64             `json:"parseFailures"`
+}
+
+// HistogramBucket counts the emails received in one hour or day. Start is
+// the hour ("2006-01-02 15:00") or day ("2006-01-02") as stored.
+type HistogramBucket struct {
+	Start string `json:"start"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+// AddressCount is the number of emails sent from or to an address
+type AddressCount struct {
+	Address string `json:"address"`
+	Count   int64  `json:"count"`
+}
+
+// SizeStats describes the distribution of message sizes in bytes
+type SizeStats struct {
+	Min     int64   `json:"min"`
+	Max     int64   `json:"max"`
+	Average float64 `json:"average"`
+	P50     int64   `json:"p50"`
+	P90     int64   `json:"p90"`
+	P99     int64   `json:"p99"`
+}
+
+// Analytics computes volume, sender, recipient and size statistics for the
+// emails received between q.Since and q.Until
+func (s *SQLiteStorage) Analytics(q *AnalyticsQuery) (*Analytics, error) {
+	result := &Analytics{
+		Since:         q.Since,
+		Until:         q.Until,
+		Interval:      q.Interval,
+		Histogram:     []HistogramBucket{},
+		TopSenders:    []AddressCount{},
+		TopRecipients: []AddressCount{},
+	}
+	inRange := "received_at >= ? AND received_at <= ?"
+	args := []interface{}{q.Since, q.Until}
+
+	var avg float64
+	err := s.reader.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(size), 0), COALESCE(MIN(size), 0), COALESCE(MAX(size), 0), COALESCE(AVG(size), 0)
+		FROM emails WHERE `+inRange, args...).
+		Scan(&result.Received, &result.Bytes, &result.Sizes.Min, &result.Sizes.Max, &avg)
+	if err != nil {
+		return nil, err
+	}
+	result.Sizes.Average = math.Round(avg*10) / 10
+
+	// Percentiles by rank (nearest-rank method)
+	for _, p := range []struct {
+		dest    *int64
+		percent float64
+	}{{&result.Sizes.P50, 50}, {&result.Sizes.P90, 90}, {&result.Sizes.P99, 99}} {
+		if result.Received == 0 {
+			break
+		}
+		rank := int64(math.Ceil(p.percent/100*float64(result.Received))) - 1
+		err := s.reader.QueryRow("SELECT size FROM emails WHERE "+inRange+" ORDER BY size LIMIT 1 OFFSET ?",
+			append(args, rank)...).Scan(p.dest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// received_at is stored as "2006-01-02 15:04:05...", so prefixes of
+	// it are the hour and day buckets
+	bucket := "substr(received_at, 1, 10)"
+	if q.Interval == IntervalHour {
+		bucket = "substr(received_at, 1, 13) || ':00'"
+	}
+	rows, err := s.reader.Query(`
+		SELECT `+bucket+` AS bucket, COUNT(*), COALESCE(SUM(size), 0)
+		FROM emails WHERE `+inRange+`
+		GROUP BY bucket
+		ORDER BY bucket
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var b HistogramBucket
+		if err := rows.Scan(&b.Start, &b.Count, &b.Bytes); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result.Histogram = append(result.Histogram, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if result.TopSenders, err = s.topAddresses(`
+		SELECT lower(from_address) AS address, COUNT(*) AS n
+		FROM emails WHERE `+inRange+` AND from_address != ''
+		GROUP BY address ORDER BY n DESC, address LIMIT ?
+	`, append(args, q.Top)); err != nil {
+		return nil, err
+	}
+
+	// Recipients come from the envelope so BCC recipients are counted
+	if result.TopRecipients, err = s.topAddresses(`
+		SELECT address, COUNT(*) AS n FROM (
+			SELECT DISTINCT emails.id, lower(json_each.value) AS address
+			FROM emails, json_each(emails.envelope_to)
+			WHERE `+inRange+`
+		)
+		GROUP BY address ORDER BY n DESC, address LIMIT ?
+	`, append(args, q.Top)); err != nil {
+		return nil, err
+	}
+
+	err = s.reader.QueryRow("SELECT COUNT(*) FROM parse_failures WHERE failed_at >= ? AND failed_at <= ?", args...).
+		Scan(&result.ParseFailures)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (s *SQLiteStorage) topAddresses(query string, args []interface{}) ([]AddressCount, error) {
+	rows, err := s.reader.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []AddressCount{}
+	for rows.Next() {
+		var c AddressCount
+		if err := rows.Scan(&c.Address, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// RecordParseFailure records a message that could not be parsed
+func (s *SQLiteStorage) RecordParseFailure(source string, reason error) error {
+	_, err := s.db.Exec("INSERT INTO parse_failures (failed_at, source, error) VALUES (?, ?, ?)",
+		time.Now(), source, fmt.Sprint(reason))
+	return err
+}
@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// CreateAPIKey stores a new API key and sets its ID and creation time
+func (s *SQLiteStorage) CreateAPIKey(key *APIKey, hash string) error {
+	key.CreatedAt = time.Now()
+	result, err := s.db.Exec(`
+		INSERT INTO api_keys (name, key_hash, prefix, scope, created_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, key.Name, hash, key.Prefix, key.Scope, key.CreatedAt)
+	if err != nil {
+		return err
+	}
+	key.ID, err = result.LastInsertId()
+	return err
+}
+
+// ListAPIKeys returns all stored API keys, oldest first
+func (s *SQLiteStorage) ListAPIKeys() ([]*APIKey, error) {
+	rows, err := s.reader.Query("SELECT id, name, prefix, scope, created_at FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &key.Scope, &key.CreatedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	return keys, rows.Err()
+}
+
+// FindAPIKey returns the API key with the given hash
+func (s *SQLiteStorage) FindAPIKey(hash string) (*APIKey, error) {
+	var key APIKey
+	err := s.reader.QueryRow(`
+		SELECT id, name, prefix, scope, created_at FROM api_keys WHERE key_hash = ?
+	`, hash).Scan(&key.ID, &key.Name, &key.Prefix, &key.Scope, &key.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// DeleteAPIKey deletes a stored API key
+func (s *SQLiteStorage) DeleteAPIKey(id int64) error {
+	result, err := s.db.Exec("DELETE FROM api_keys WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// attachmentConditions builds the SQL conditions and arguments for filter,
+// prefixed with AND as filterConditions does
+func (s *SQLiteStorage) attachmentConditions(filter *AttachmentFilter) (string, []interface{}) {
+	conditions := ""
+	args := []interface{}{}
+
+	if filter.ContentType != "" {
+		if prefix, ok := strings.CutSuffix(filter.ContentType, "*"); ok && strings.HasSuffix(prefix, "/") {
+			conditions += " AND substr(lower(attachments.content_type), 1, ?) = lower(?)"
+			args = append(args, len(prefix), prefix)
+		} else {
+			conditions += " AND attachments.content_type = ? COLLATE NOCASE"
+			args = append(args, filter.ContentType)
+		}
+	}
+	if filter.Filename != "" {
+		if strings.ContainsAny(filter.Filename, "*?[") {
+			conditions += " AND lower(attachments.filename) GLOB lower(?)"
+			args = append(args, filter.Filename)
+		} else {
+			conditions += " AND attachments.filename LIKE ?"
+			args = append(args, "%"+filter.Filename+"%")
+		}
+	}
+	if filter.MinSize > 0 {
+		conditions += " AND attachments.size >= ?"
+		args = append(args, filter.MinSize)
+	}
+	if emailConditions, emailArgs := s.filterConditions(filter.Emails); emailConditions != "" {
+		conditions += " AND attachments.email_id IN (SELECT id FROM emails WHERE 1=1" + emailConditions + ")"
+		args = append(args, emailArgs...)
+	}
+	return conditions, args
+}
+
+// ListAttachments returns the attachments matching filter across emails,
+// those of the newest emails first, each with a summary of its email
+func (s *SQLiteStorage) ListAttachments(filter *AttachmentFilter, limit, offset int) (*AttachmentListResult, error) {
+	result := &AttachmentListResult{Attachments: []*AttachmentListing{}}
+	conditions, args := s.attachmentConditions(filter)
+
+	err := s.reader.QueryRow("SELECT COUNT(*) FROM attachments WHERE 1=1"+conditions, args...).Scan(&result.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.reader.Query(`
+		SELECT attachments.id, attachments.email_id, attachments.filename, attachments.content_type, attachments.size,
+			attachments.content_id, attachments.inline, attachments.message, attachments.detected_type, attachments.type_mismatch
+		FROM attachments JOIN emails ON emails.id = attachments.email_id
+		WHERE 1=1`+conditions+`
+		ORDER BY emails.received_at DESC, emails.id DESC, attachments.id
+		LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		listing := &AttachmentListing{AttachmentMeta: &AttachmentMeta{}}
+		var messageJSON sql.NullString
+		if err := rows.Scan(&listing.ID, &listing.EmailID, &listing.Filename, &listing.ContentType, &listing.Size,
+			&listing.ContentID, &listing.Inline, &messageJSON, &listing.DetectedType, &listing.TypeMismatch); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		listing.Message = scanMessageInfo(messageJSON)
+		result.Attachments = append(result.Attachments, listing)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := s.attachmentEmails(result.Attachments); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// attachmentEmails sets the summaries of the emails of attachments, reading
+// each email once
+func (s *SQLiteStorage) attachmentEmails(attachments []*AttachmentListing) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	byID := make(map[int64]*EmailSummary)
+	placeholders := []string{}
+	args := []interface{}{}
+	for _, att := range attachments {
+		if _, ok := byID[att.EmailID]; !ok {
+			byID[att.EmailID] = nil
+			placeholders = append(placeholders, "?")
+			args = append(args, att.EmailID)
+		}
+	}
+
+	rows, err := s.reader.Query("SELECT "+summaryColumns()+" FROM emails WHERE id IN ("+strings.Join(placeholders, ", ")+")", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		email, err := s.scanEmail(rows)
+		if err != nil {
+			return err
+		}
+		email.Preview = makePreview(email.BodyPlain)
+		byID[email.ID] = email.Summary()
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, att := range attachments {
+		att.Email = byID[att.EmailID]
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// RecordAudit stores an audit entry and sets its ID, and its time if unset
+func (s *SQLiteStorage) RecordAudit(entry *AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	var details sql.NullString
+	if len(entry.Details) > 0 {
+		data, err := json.Marshal(entry.Details)
+		if err != nil {
+			return err
+		}
+		details = sql.NullString{String: string(data), Valid: true}
+	}
+
+	result, err := s.db.Exec(`
+		INSERT INTO audit_log (time, action, actor, auth, remote_ip, target, details)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, entry.Time, entry.Action, entry.Actor, entry.Auth, entry.RemoteIP, entry.Target, details)
+	if err != nil {
+		return err
+	}
+	entry.ID, err = result.LastInsertId()
+	return err
+}
+
+// ListAudit returns the audit entries matching filter, newest first
+func (s *SQLiteStorage) ListAudit(filter *AuditFilter, limit, offset int) (*AuditListResult, error) {
+	var conditions []string
+	var args []interface{}
+	if filter != nil {
+		if strings.HasSuffix(filter.Action, ".") {
+			conditions = append(conditions, "substr(action, 1, ?) = ?")
+			args = append(args, len(filter.Action), filter.Action)
+		} else if filter.Action != "" {
+			conditions = append(conditions, "action = ?")
+			args = append(args, filter.Action)
+		}
+		if filter.Actor != "" {
+			conditions = append(conditions, "actor = ?")
+			args = append(args, filter.Actor)
+		}
+		if filter.Since != nil {
+			conditions = append(conditions, "time >= ?")
+			args = append(args, *filter.Since)
+		}
+		if filter.Until != nil {
+			conditions = append(conditions, "time <= ?")
+			args = append(args, *filter.Until)
+		}
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int64
+	if err := s.reader.QueryRow("SELECT COUNT(*) FROM audit_log"+where, args...).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.reader.Query(`
+		SELECT id, time, action, actor, auth, remote_ip, target, details
+		FROM audit_log`+where+` ORDER BY time DESC, id DESC LIMIT ? OFFSET ?
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var details sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.Time, &entry.Action, &entry.Actor, &entry.Auth,
+			&entry.RemoteIP, &entry.Target, &details); err != nil {
+			return nil, err
+		}
+		if details.Valid {
+			json.Unmarshal([]byte(details.String), &entry.Details)
+		}
+		entries = append(entries, &entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return &AuditListResult{Entries: entries, Total: total}, nil
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+// ErrClosed is returned when saving through a closed BatchWriter
+var ErrClosed = errors.New("storage is closed")
+
+// saveRequest is an email waiting to be written by a BatchWriter
+type saveRequest struct {
+	email  *Email
+	queued time.Time
+	done   chan saveResult
+}
+
+type saveResult struct {
+	id  int64
+	err error
+}
+
+// BatchWriter wraps a Storage and coalesces concurrent SaveEmail calls
+// into shared transactions. A batch is written when it reaches the
+// configured size or the flush interval elapses, whichever comes first.
+type BatchWriter struct {
+	Storage
+
+	maxSize  int
+	interval time.Duration
+	logger   zerolog.Logger
+
+	requests  chan *saveRequest
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	started      time.Time
+	stats        BatchStats
+	totalLatency time.Duration
+}
+
+// NewBatchWriter creates a batching wrapper around store
+func NewBatchWriter(store Storage, cfg *config.BatchConfig, logger zerolog.Logger) *BatchWriter {
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = 100
+	}
+	interval := cfg.FlushInterval
+	if interval <= 0 {
+		interval = 10 * time.Millisecond
+	}
+
+	w := &BatchWriter{
+		Storage:  store,
+		maxSize:  maxSize,
+		interval: interval,
+		logger:   logger,
+		requests: make(chan *saveRequest),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		started:  time.Now(),
+	}
+	go w.run()
+
+	logger.Info().
+		Int("max_size", maxSize).
+		Dur("flush_interval", interval).
+		Msg("Batched email writes enabled")
+
+	return w
+}
+
+// SaveEmail queues email for the next batch and waits until it is written
+func (w *BatchWriter) SaveEmail(email *Email) (int64, error) {
+	req := &saveRequest{
+		email:  email,
+		queued: time.Now(),
+		done:   make(chan saveResult, 1),
+	}
+
+	select {
+	case w.requests <- req:
+	case <-w.stop:
+		return 0, ErrClosed
+	}
+
+	result := <-req.done
+	return result.id, result.err
+}
+
+// BatchStats returns throughput and latency statistics
+func (w *BatchWriter) BatchStats() BatchStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	stats := w.stats
+	if elapsed := time.Since(w.started).Seconds(); elapsed > 0 {
+		stats.EmailsPerSecond = float64(stats.Emails) / elapsed
+	}
+	return stats
+}
+
+// Close writes any pending emails and closes the underlying storage
+func (w *BatchWriter) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		<-w.done
+	})
+	return w.Storage.Close()
+}
+
+// run collects requests into batches until the writer is closed
+func (w *BatchWriter) run() {
+	defer close(w.done)
+
+	timer := time.NewTimer(w.interval)
+	timer.Stop()
+
+	var batch []*saveRequest
+	for {
+		if len(batch) == 0 {
+			select {
+			case req := <-w.requests:
+				batch = append(batch, req)
+				timer.Reset(w.interval)
+			case <-w.stop:
+				return
+			}
+			continue
+		}
+
+		select {
+		case req := <-w.requests:
+			batch = append(batch, req)
+			if len(batch) >= w.maxSize {
+				timer.Stop()
+				w.flush(batch)
+				batch = nil
+			}
+		case <-timer.C:
+			w.flush(batch)
+			batch = nil
+		case <-w.stop:
+			w.flush(batch)
+			return
+		}
+	}
+}
+
+// flush writes batch in one transaction. If that fails, each email is
+// retried on its own so one bad message does not fail the others.
+func (w *BatchWriter) flush(batch []*saveRequest) {
+	emails := make([]*Email, len(batch))
+	for i, req := range batch {
+		emails[i] = req.email
+	}
+
+	results := make([]saveResult, len(batch))
+	ids, err := w.Storage.SaveEmails(emails)
+	if err == nil {
+		for i, id := range ids {
+			results[i].id = id
+		}
+	} else {
+		w.logger.Warn().Err(err).Int("size", len(batch)).Msg("Batch write failed, saving emails individually")
+		for i, email := range emails {
+			results[i].id, results[i].err = w.Storage.SaveEmail(email)
+		}
+	}
+
+	now := time.Now()
+	w.mu.Lock()
+	w.stats.Batches++
+	if err != nil {
+		w.stats.FailedBatches++
+	}
+	if len(batch) > w.stats.MaxBatchSize {
+		w.stats.MaxBatchSize = len(batch)
+	}
+	for i, req := range batch {
+		latency := now.Sub(req.queued)
+		w.totalLatency += latency
+		if ms := float64(latency.Microseconds()) / 1000; ms > w.stats.MaxLatencyMs {
+			w.stats.MaxLatencyMs = ms
+		}
+		if results[i].err != nil {
+			w.stats.FailedEmails++
+		} else {
+			w.stats.Emails++
+		}
+	}
+	total := w.stats.Emails + w.stats.FailedEmails
+	w.stats.AvgBatchSize = float64(total) / float64(w.stats.Batches)
+	w.stats.AvgLatencyMs = float64(w.totalLatency.Microseconds()) / 1000 / float64(total)
+	w.mu.Unlock()
+
+	for i, req := range batch {
+		req.done <- results[i]
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gowebmail/internal/config"
+)
+
+// ErrInvalidBlobKey is returned when a blob key is not a content hash
+var ErrInvalidBlobKey = errors.New("invalid blob key")
+
+// BlobStore persists large payloads outside the database, keyed by content hash
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+// BlobStreamer is implemented by blob stores that can store a payload of
+// size bytes read from r, rather than held in memory
+type BlobStreamer interface {
+	PutFrom(key string, r io.ReadSeeker, size int64) error
+}
+
+// NewBlobStore creates the blob store described by the configuration.
+// It returns nil when payloads should be kept in the database.
+func NewBlobStore(cfg *config.BlobConfig) (BlobStore, error) {
+	switch cfg.Type {
+	case "", "database":
+		return nil, nil
+	case "filesystem":
+		return NewFileBlobStore(cfg.Path)
+	case "s3":
+		return NewS3BlobStore(&cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown blob store type: %s", cfg.Type)
+	}
+}
+
+// contentHash returns the hex-encoded SHA-256 hash of data
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validBlobKey reports whether key looks like a hex-encoded SHA-256 hash
+func validBlobKey(key string) bool {
+	if len(key) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// FileBlobStore stores blobs in a content-addressed directory tree
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore creates a blob store rooted at dir
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	if dir == "" {
+		return nil, errors.New("blob store path is required")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+// path returns the on-disk location for key, fanned out by its first two characters
+func (f *FileBlobStore) path(key string) string {
+	return filepath.Join(f.dir, key[:2], key)
+}
+
+// Put writes data under key. Existing blobs are left untouched since the
+// key is derived from the content.
+func (f *FileBlobStore) Put(key string, data []byte) error {
+	return f.PutFrom(key, bytes.NewReader(data), int64(len(data)))
+}
+
+// PutFrom writes the payload read from r under key, as Put does
+func (f *FileBlobStore) PutFrom(key string, r io.ReadSeeker, size int64) error {
+	if !validBlobKey(key) {
+		return ErrInvalidBlobKey
+	}
+
+	path := f.path(key)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so readers never see partial blobs
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tmp, r, size); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads the blob stored under key
+func (f *FileBlobStore) Get(key string) ([]byte, error) {
+	if !validBlobKey(key) {
+		return nil, ErrInvalidBlobKey
+	}
+
+	data, err := os.ReadFile(f.path(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// Delete removes the blob stored under key
+func (f *FileBlobStore) Delete(key string) error {
+	if !validBlobKey(key) {
+		return ErrInvalidBlobKey
+	}
+
+	err := os.Remove(f.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"container/list"
+	"slices"
+	"sync"
+)
+
+// cacheOverhead is the cost counted for an entry beyond its bodies and
+// data
+const cacheOverhead = 1024
+
+// cacheKey identifies an email or an attachment in the cache
+type cacheKey struct {
+	attachment bool
+	id         int64
+}
+
+type cacheEntry struct {
+	key   cacheKey
+	email int64 // the email an attachment belongs to
+	value interface{}
+	size  int64
+}
+
+// readCache keeps the emails and attachments read last in memory, up to a
+// total size, dropping the least recently used first. Writes invalidate
+// the entries of the emails they change.
+type readCache struct {
+	mu      sync.Mutex
+	maxSize int64
+	size    int64
+	order   *list.List // most recently used first
+	entries map[cacheKey]*list.Element
+	// gen changes on every invalidation, so that a read that started
+	// before one does not store what it read
+	gen uint64
+}
+
+// newReadCache returns a cache of up to maxSize bytes, or nil when maxSize
+// is 0. A nil cache caches nothing.
+func newReadCache(maxSize int64) *readCache {
+	if maxSize <= 0 {
+		return nil
+	}
+	return &readCache{
+		maxSize: maxSize,
+		order:   list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// generation returns the generation to pass to put with what is read next
+func (c *readCache) generation() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.gen
+}
+
+func (c *readCache) get(key cacheKey) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+// put stores a value read at generation gen, unless something was
+// invalidated since
+func (c *readCache) put(gen uint64, key cacheKey, email int64, value interface{}, size int64) {
+	if c == nil {
+		return
+	}
+	size += cacheOverhead
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if gen != c.gen || size > c.maxSize {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, email: email, value: value, size: size})
+	c.size += size
+	for c.size > c.maxSize {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops the emails with these IDs and their attachments
+func (c *readCache) invalidate(ids ...int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	for _, id := range ids {
+		if el, ok := c.entries[cacheKey{id: id}]; ok {
+			c.remove(el)
+		}
+	}
+	// Attachments are few next to emails, so they are scanned
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*cacheEntry); e.key.attachment && slices.Contains(ids, e.email) {
+			c.remove(el)
+		}
+		el = next
+	}
+}
+
+// clear drops every entry
+func (c *readCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.order.Init()
+	clear(c.entries)
+	c.size = 0
+}
+
+func (c *readCache) remove(el *list.Element) {
+	e := c.order.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+// emailCost returns the size counted for an email in the cache
+func emailCost(email *Email) int64 {
+	size := int64(len(email.BodyPlain) + len(email.BodyHTML) + len(email.BodyAMP) + len(email.Subject))
+	for key, values := range email.Headers {
+		size += int64(len(key))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+// cloneEmail returns a copy of a cached email that callers may change
+// without changing the cache. The data of its attachments and its raw
+// message are shared, and must not be changed.
+func cloneEmail(email *Email) *Email {
+	c := *email
+	c.To = slices.Clone(email.To)
+	c.CC = slices.Clone(email.CC)
+	c.BCC = slices.Clone(email.BCC)
+	c.Tags = slices.Clone(email.Tags)
+	c.EnvelopeTo = slices.Clone(email.EnvelopeTo)
+	c.ReplyTo = slices.Clone(email.ReplyTo)
+	c.References = slices.Clone(email.References)
+	if email.Headers != nil {
+		c.Headers = make(map[string][]string, len(email.Headers))
+		for key, values := range email.Headers {
+			c.Headers[key] = slices.Clone(values)
+		}
+	}
+	c.Attachments = clonePtrs(email.Attachments, cloneAttachment)
+
+	if email.Spam != nil {
+		c.Spam = clonePtr(email.Spam)
+		c.Spam.Rules = slices.Clone(email.Spam.Rules)
+	}
+	if email.Auth != nil {
+		c.Auth = clonePtr(email.Auth)
+		c.Auth.DKIM = slices.Clone(email.Auth.DKIM)
+		for i := range c.Auth.DKIM {
+			c.Auth.DKIM[i].Headers = slices.Clone(c.Auth.DKIM[i].Headers)
+		}
+	}
+	if email.Calendar != nil {
+		c.Calendar = clonePtr(email.Calendar)
+		c.Calendar.Events = clonePtrs(email.Calendar.Events, cloneCalendarEvent)
+	}
+	if email.Security != nil {
+		c.Security = clonePtr(email.Security)
+		c.Security.Recipients = slices.Clone(email.Security.Recipients)
+		c.Security.Signatures = clonePtrs(email.Security.Signatures, cloneSignature)
+	}
+	if email.Unsubscribe != nil {
+		c.Unsubscribe = clonePtr(email.Unsubscribe)
+		c.Unsubscribe.Mailto = slices.Clone(email.Unsubscribe.Mailto)
+		c.Unsubscribe.URLs = slices.Clone(email.Unsubscribe.URLs)
+		c.Unsubscribe.Problems = slices.Clone(email.Unsubscribe.Problems)
+		if email.Unsubscribe.Test != nil {
+			c.Unsubscribe.Test = clonePtr(email.Unsubscribe.Test)
+			c.Unsubscribe.Test.Results = clonePtrs(email.Unsubscribe.Test.Results, clonePtr)
+		}
+	}
+	if email.SizeBreakdown != nil {
+		c.SizeBreakdown = clonePtr(email.SizeBreakdown)
+		c.SizeBreakdown.Parts = clonePtrs(email.SizeBreakdown.Parts, clonePtr)
+	}
+	c.Received = clonePtrs(email.Received, cloneReceivedHop)
+	if email.Match != nil {
+		c.Match = clonePtr(email.Match)
+		c.Match.Fields = slices.Clone(email.Match.Fields)
+	}
+	c.Job = clonePtr(email.Job)
+	return &c
+}
+
+// clonePtr returns a pointer to a copy of the value p points to, or nil
+func clonePtr[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	return &c
+}
+
+// clonePtrs copies a slice of pointers, copying what each points to with
+// clone
+func clonePtrs[T any](items []*T, clone func(*T) *T) []*T {
+	if items == nil {
+		return nil
+	}
+	c := make([]*T, len(items))
+	for i, item := range items {
+		c[i] = clone(item)
+	}
+	return c
+}
+
+func cloneCalendarEvent(event *CalendarEvent) *CalendarEvent {
+	c := *event
+	c.Start = clonePtr(event.Start)
+	c.End = clonePtr(event.End)
+	c.Organizer = clonePtr(event.Organizer)
+	c.Attendees = clonePtrs(event.Attendees, clonePtr)
+	return &c
+}
+
+func cloneSignature(sig *Signature) *Signature {
+	c := *sig
+	c.SignedAt = clonePtr(sig.SignedAt)
+	c.NotBefore = clonePtr(sig.NotBefore)
+	c.NotAfter = clonePtr(sig.NotAfter)
+	return &c
+}
+
+func cloneReceivedHop(hop *ReceivedHop) *ReceivedHop {
+	c := *hop
+	c.Timestamp = clonePtr(hop.Timestamp)
+	c.DelayMs = clonePtr(hop.DelayMs)
+	return &c
+}
+
+// cloneMessageInfo copies the summary of an attached email, with the
+// emails attached to it in turn
+func cloneMessageInfo(info *MessageInfo) *MessageInfo {
+	if info == nil {
+		return nil
+	}
+	c := *info
+	c.To = slices.Clone(info.To)
+	c.CC = slices.Clone(info.CC)
+	c.Date = clonePtr(info.Date)
+	c.Attachments = clonePtrs(info.Attachments, func(meta *AttachmentMeta) *AttachmentMeta {
+		m := *meta
+		m.Message = cloneMessageInfo(meta.Message)
+		return &m
+	})
+	return &c
+}
+
+// cloneAttachment returns a copy of a cached attachment. Its data is
+// shared, and must not be changed.
+func cloneAttachment(att *Attachment) *Attachment {
+	c := *att
+	c.Message = cloneMessageInfo(att.Message)
+	return &c
+}
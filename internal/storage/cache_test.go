@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// cachedEmail returns an email with every field that holds pointers,
+// slices or maps set
+func cachedEmail() *Email {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	delay := int64(1500)
+	return &Email{
+		ID:         1,
+		To:         []string{"to@example.com"},
+		CC:         []string{"cc@example.com"},
+		BCC:        []string{"bcc@example.com"},
+		Tags:       []string{"tag"},
+		EnvelopeTo: []string{"rcpt@example.com"},
+		ReplyTo:    []string{"reply@example.com"},
+		References: []string{"<ref@example.com>"},
+		Headers:    map[string][]string{"Subject": {"Hello"}},
+		Attachments: []*Attachment{{AttachmentMeta: AttachmentMeta{
+			Filename: "fwd.eml",
+			Message: &MessageInfo{
+				To:          []string{"inner@example.com"},
+				Date:        &at,
+				Attachments: []*AttachmentMeta{{Filename: "inner.eml", Message: &MessageInfo{Subject: "Inner"}}},
+			},
+		}}},
+		Spam: &SpamResult{Score: 1, Rules: []SpamRule{{Name: "RULE"}}},
+		Auth: &AuthResults{SPF: SPFResult{Result: "pass"}, DKIM: []DKIMResult{{Result: "pass", Headers: []string{"from"}}}},
+		Calendar: &Calendar{Events: []*CalendarEvent{{
+			Summary:   "Meeting",
+			Start:     &at,
+			Organizer: &CalendarAttendee{Email: "org@example.com"},
+			Attendees: []*CalendarAttendee{{Email: "guest@example.com"}},
+		}}},
+		Security: &Security{
+			Recipients: []string{"key"},
+			Signatures: []*Signature{{Result: "pass", SignedAt: &at, NotAfter: &at}},
+		},
+		Unsubscribe: &Unsubscribe{
+			Mailto:   []string{"mailto:unsub@example.com"},
+			URLs:     []string{"https://example.com/unsub"},
+			Problems: []string{"no one-click"},
+			Test:     &UnsubscribeTest{Results: []*UnsubscribeResult{{Status: "ok"}}},
+		},
+		SizeBreakdown: &SizeBreakdown{Headers: 100, Parts: []*PartSize{{Part: "1", Size: 10}}},
+		Received:      []*ReceivedHop{{By: "mx.example.com", Timestamp: &at, DelayMs: &delay}},
+		Match:         &SearchMatch{Fields: []string{"subject"}},
+		Job:           &Job{ID: 1},
+	}
+}
+
+func TestCloneEmail(t *testing.T) {
+	cached := cachedEmail()
+	c := cloneEmail(cached)
+	if !reflect.DeepEqual(c, cached) {
+		t.Fatalf("clone differs: %+v", c)
+	}
+
+	// Changing anything reachable from the clone leaves the cached email
+	// as it was
+	c.To[0], c.CC[0], c.BCC[0], c.Tags[0] = "x", "x", "x", "x"
+	c.EnvelopeTo[0], c.ReplyTo[0], c.References[0] = "x", "x", "x"
+	c.Headers["Subject"][0] = "x"
+	c.Headers["X-New"] = []string{"x"}
+	att := c.Attachments[0]
+	att.Filename = "x"
+	att.Message.To[0] = "x"
+	*att.Message.Date = time.Time{}
+	att.Message.Attachments[0].Message.Subject = "x"
+	c.Spam.Score = 9
+	c.Spam.Rules[0].Name = "x"
+	c.Auth.SPF.Result = "fail"
+	c.Auth.DKIM[0].Result = "fail"
+	c.Auth.DKIM[0].Headers[0] = "x"
+	event := c.Calendar.Events[0]
+	event.Summary = "x"
+	*event.Start = time.Time{}
+	event.Organizer.Email = "x"
+	event.Attendees[0].Email = "x"
+	c.Security.Recipients[0] = "x"
+	c.Security.Signatures[0].Result = "fail"
+	*c.Security.Signatures[0].NotAfter = time.Time{}
+	c.Unsubscribe.Mailto[0], c.Unsubscribe.URLs[0], c.Unsubscribe.Problems[0] = "x", "x", "x"
+	c.Unsubscribe.Test.Results[0].Status = "failed"
+	c.SizeBreakdown.Headers = 0
+	c.SizeBreakdown.Parts[0].Size = 0
+	c.Received[0].By = "x"
+	*c.Received[0].Timestamp = time.Time{}
+	*c.Received[0].DelayMs = 0
+	c.Match.Fields[0] = "x"
+	c.Job.Attempts = 3
+
+	if !reflect.DeepEqual(cached, cachedEmail()) {
+		t.Errorf("cached email changed: %+v", cached)
+	}
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressMinSize is the smallest payload worth compressing
+const compressMinSize = 1024
+
+// gzipMagic and zstdMagic start every gzip and zstd stream. Neither HTML
+// nor RFC 822 messages can begin with them, so compressed and plain values
+// can live side by side.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// isCompressed reports whether data was written by compress
+func isCompressed(data []byte) bool {
+	return bytes.HasPrefix(data, gzipMagic) || bytes.HasPrefix(data, zstdMagic)
+}
+
+// newCompressor returns a writer compressing to w with the configured
+// codec, or nil when compression is off
+func (s *SQLiteStorage) newCompressor(w io.Writer) (io.WriteCloser, error) {
+	switch s.compression {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return nil, nil
+}
+
+// compress compresses data when compression is enabled and the result is
+// smaller, otherwise it returns data unchanged
+func (s *SQLiteStorage) compress(data []byte) []byte {
+	if len(data) < compressMinSize {
+		return data
+	}
+
+	var buf bytes.Buffer
+	zw, err := s.newCompressor(&buf)
+	if zw == nil || err != nil {
+		return data
+	}
+	if _, err := zw.Write(data); err != nil {
+		return data
+	}
+	if err := zw.Close(); err != nil {
+		return data
+	}
+
+	if buf.Len() >= len(data) {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// compressFile is compress for the size bytes read from r. A compressed
+// payload is written to a temporary file, which the returned function
+// removes; otherwise r is returned as it is.
+func (s *SQLiteStorage) compressFile(r io.ReadSeeker, size int64) (io.ReadSeeker, int64, func(), error) {
+	if s.compression == "" || s.compression == "none" || size < compressMinSize {
+		return r, size, func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "gowebmail-blob-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	remove := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+
+	zw, err := s.newCompressor(tmp)
+	if err != nil {
+		remove()
+		return nil, 0, nil, err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		remove()
+		return nil, 0, nil, err
+	}
+	if err := zw.Close(); err != nil {
+		remove()
+		return nil, 0, nil, err
+	}
+	n, err := tmp.Seek(0, io.SeekCurrent)
+	if err == nil && n < size {
+		_, err = tmp.Seek(0, io.SeekStart)
+		return tmp, n, remove, err
+	}
+	remove()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return r, size, func() {}, err
+}
+
+// decompress reverses compress. Values stored without compression are
+// returned as is.
+func decompress(data []byte) ([]byte, error) {
+	var zr io.Reader
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+		defer gr.Close()
+		zr = gr
+	case bytes.HasPrefix(data, zstdMagic):
+		dr, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+		defer dr.Close()
+		zr = dr
+	default:
+		return data, nil
+	}
+
+	out, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+	return out, nil
+}
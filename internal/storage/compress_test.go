@@ -0,0 +1,53 @@
+package storage
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"strings"
+	"testing"
+)
+
+func TestCompress(t *testing.T) {
+	text := []byte(strings.Repeat("<p>Hello, world</p>\r\n", 100))
+	short := []byte("<p>Hello</p>")
+	random := make([]byte, 4096)
+	rand.NewChaCha8([32]byte{}).Read(random)
+
+	for _, tc := range []struct {
+		compression string
+		magic       []byte
+	}{
+		{"none", nil},
+		{"gzip", gzipMagic},
+		{"zstd", zstdMagic},
+	} {
+		s := &SQLiteStorage{compression: tc.compression}
+		stored := s.compress(text)
+		if tc.magic == nil && !bytes.Equal(stored, text) || tc.magic != nil && !bytes.HasPrefix(stored, tc.magic) {
+			t.Errorf("%s: stored % x...", tc.compression, stored[:4])
+		}
+		if tc.magic != nil && len(stored) >= len(text) {
+			t.Errorf("%s: %d bytes for %d", tc.compression, len(stored), len(text))
+		}
+
+		// Reading does not depend on the configured codec
+		if got, err := decompress(stored); err != nil || !bytes.Equal(got, text) {
+			t.Errorf("%s: read back %d bytes, %v", tc.compression, len(got), err)
+		}
+
+		// Short payloads, and those that do not shrink, are kept as they are
+		if got := s.compress(short); !bytes.Equal(got, short) {
+			t.Errorf("%s: short value stored as % x", tc.compression, got)
+		}
+		if got := s.compress(random); !bytes.Equal(got, random) {
+			t.Errorf("%s: incompressible value stored as %d bytes", tc.compression, len(got))
+		}
+	}
+
+	// A truncated stream is an error rather than a short value
+	s := &SQLiteStorage{compression: "zstd"}
+	stored := s.compress(text)
+	if _, err := decompress(stored[:len(stored)/2]); err == nil {
+		t.Error("truncated zstd value decompressed")
+	}
+}
@@ -0,0 +1,90 @@
+package storage
+
+import "strings"
+
+// EmailCounts are the numbers of emails, and of unread ones, in each
+// mailbox and with each tag
+type EmailCounts struct {
+	Mailboxes []MailboxCount `json:"mailboxes"`
+	Tags      []TagCount     `json:"tags"`
+}
+
+// MailboxCount counts the emails addressed to a mailbox in their To header,
+// as ListMailboxes does
+type MailboxCount struct {
+	Address string `json:"address"`
+	Total   int64  `json:"total"`
+	Unread  int64  `json:"unread"`
+}
+
+// TagCount counts the emails with a tag
+type TagCount struct {
+	Tag    string `json:"tag"`
+	Total  int64  `json:"total"`
+	Unread int64  `json:"unread"`
+}
+
+// CountEmails counts all and unread emails by mailbox and by tag, in the
+// order of their names. With mailboxes, only the mailboxes matching one of
+// these patterns, and the tags of the emails addressed to them, are
+// counted, as with EmailFilter.Mailboxes.
+func (s *SQLiteStorage) CountEmails(mailboxes []string) (*EmailCounts, error) {
+	counts := &EmailCounts{Mailboxes: []MailboxCount{}, Tags: []TagCount{}}
+
+	// Each pattern is GLOB matched against the address; nil matches all
+	addresses, args := "1", []interface{}{}
+	if mailboxes != nil {
+		globs := []string{"0"}
+		for _, pattern := range mailboxes {
+			globs = append(globs, "address GLOB ?")
+			args = append(args, strings.ToLower(pattern))
+		}
+		addresses = "(" + strings.Join(globs, " OR ") + ")"
+	}
+
+	rows, err := s.reader.Query(`
+		SELECT address, COUNT(*), COALESCE(SUM(emails.read = 0), 0)
+		FROM email_recipients JOIN emails ON emails.id = email_recipients.email_id
+		WHERE kind = ? AND `+addresses+`
+		GROUP BY address
+		ORDER BY address
+	`, append([]interface{}{recipientTo}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var c MailboxCount
+		if err := rows.Scan(&c.Address, &c.Total, &c.Unread); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		counts.Mailboxes = append(counts.Mailboxes, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	visible := ""
+	if mailboxes != nil {
+		visible = " WHERE emails.id IN (SELECT email_id FROM email_recipients WHERE " + addresses + ")"
+	}
+	rows, err = s.reader.Query(`
+		SELECT json_each.value AS tag, COUNT(*), COALESCE(SUM(emails.read = 0), 0)
+		FROM emails, json_each(emails.tags)`+visible+`
+		GROUP BY tag
+		ORDER BY tag
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c TagCount
+		if err := rows.Scan(&c.Tag, &c.Total, &c.Unread); err != nil {
+			return nil, err
+		}
+		counts.Tags = append(counts.Tags, c)
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,49 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Cursor marks a position in the email list, which is ordered by
+// received_at and id, newest first
+type Cursor struct {
+	ReceivedAt time.Time
+	ID         int64
+}
+
+// Encode returns the opaque token form of the cursor
+func (c *Cursor) Encode() string {
+	token := c.ReceivedAt.Format(time.RFC3339Nano) + "|" + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+// ParseCursor decodes a token produced by Cursor.Encode
+func ParseCursor(token string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	ts, id, ok := strings.Cut(string(data), "|")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+
+	receivedAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	emailID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || emailID <= 0 {
+		return nil, ErrInvalidCursor
+	}
+
+	return &Cursor{ReceivedAt: receivedAt, ID: emailID}, nil
+}
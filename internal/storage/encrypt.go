@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// ErrNoEncryptionKey is returned when reading encrypted data without a key
+var ErrNoEncryptionKey = errors.New("data is encrypted but no encryption key is configured")
+
+// encryptedMagic prefixes every value written by seal
+var encryptedMagic = []byte("\x00GWE\x01")
+
+// newAEAD creates the AES-256-GCM cipher for a hex or base64 encoded key.
+// It returns nil when key is empty.
+func newAEAD(key string) (cipher.AEAD, error) {
+	if key == "" {
+		return nil, nil
+	}
+
+	raw, err := hex.DecodeString(key)
+	if err != nil {
+		if raw, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return nil, errors.New("encryption key must be hex or base64 encoded")
+		}
+	}
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(raw))
+	}
+
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data when an encryption key is configured
+func (s *SQLiteStorage) seal(data []byte) ([]byte, error) {
+	if s.aead == nil || data == nil {
+		return data, nil
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := append([]byte{}, encryptedMagic...)
+	out = append(out, nonce...)
+	return s.aead.Seal(out, nonce, data, nil), nil
+}
+
+// open reverses seal. Values stored without encryption are returned as is.
+func (s *SQLiteStorage) open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, encryptedMagic) {
+		return data, nil
+	}
+	if s.aead == nil {
+		return nil, ErrNoEncryptionKey
+	}
+
+	data = data[len(encryptedMagic):]
+	if len(data) < s.aead.NonceSize() {
+		return nil, errors.New("encrypted value is truncated")
+	}
+
+	nonce, ciphertext := data[:s.aead.NonceSize()], data[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return plain, nil
+}
+
+// encode prepares a payload for storage, compressing and then encrypting
+// it as configured
+func (s *SQLiteStorage) encode(data []byte) ([]byte, error) {
+	return s.seal(s.compress(data))
+}
+
+// encodeText is encode for text columns, optionally skipping compression
+// so the column stays searchable. Values that end up neither compressed
+// nor encrypted are kept as strings so they stay readable in the database.
+func (s *SQLiteStorage) encodeText(text string, compress bool) (interface{}, error) {
+	data := []byte(text)
+	if compress {
+		data = s.compress(data)
+	}
+	data, err := s.seal(data)
+	if err != nil {
+		return nil, err
+	}
+	if isCompressed(data) || bytes.HasPrefix(data, encryptedMagic) {
+		return data, nil
+	}
+	return text, nil
+}
+
+// decode reverses encode
+func (s *SQLiteStorage) decode(data []byte) ([]byte, error) {
+	data, err := s.open(data)
+	if err != nil {
+		return nil, err
+	}
+	return decompress(data)
+}
@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"database/sql"
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Markers passed to FTS5 highlight()/snippet(). Control characters are
+	// used so the surrounding text can be HTML-escaped before they are
+	// turned into <mark> tags.
+	highlightOpen  = "\x02"
+	highlightClose = "\x03"
+
+	// snippetContext is the number of bytes shown around a LIKE match
+	snippetContext = 80
+)
+
+// ftsHighlightColumns selects highlighted subject/from/to and a body
+// snippet for the row matched by an FTS5 query
+const ftsHighlightColumns = `
+	highlight(emails_fts, 0, char(2), char(3)),
+	highlight(emails_fts, 1, char(2), char(3)),
+	highlight(emails_fts, 2, char(2), char(3)),
+	snippet(emails_fts, 3, char(2), char(3), '…', 16)`
+
+// markHighlights HTML-escapes text and converts FTS markers into <mark> tags
+func markHighlights(text string) string {
+	text = html.EscapeString(text)
+	text = strings.ReplaceAll(text, highlightOpen, "<mark>")
+	return strings.ReplaceAll(text, highlightClose, "</mark>")
+}
+
+// ftsMatch builds a SearchMatch from the columns selected by ftsHighlightColumns
+func ftsMatch(subject, from, to, body sql.NullString) *SearchMatch {
+	match := &SearchMatch{Fields: []string{}}
+
+	if strings.Contains(subject.String, highlightOpen) {
+		match.Fields = append(match.Fields, "subject")
+		match.Subject = markHighlights(subject.String)
+	}
+	if strings.Contains(from.String, highlightOpen) {
+		match.Fields = append(match.Fields, "from")
+	}
+	if strings.Contains(to.String, highlightOpen) {
+		match.Fields = append(match.Fields, "to")
+	}
+	if strings.Contains(body.String, highlightOpen) {
+		match.Fields = append(match.Fields, "body")
+		match.Body = markHighlights(body.String)
+	}
+
+	return match
+}
+
+// likeMatch builds a SearchMatch for the LIKE-based search fallback
+func likeMatch(email *Email, terms []string) *SearchMatch {
+	match := &SearchMatch{Fields: []string{}}
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	re, err := regexp.Compile("(?i)" + strings.Join(quoted, "|"))
+	if err != nil || len(terms) == 0 {
+		return match
+	}
+
+	if re.MatchString(email.Subject) {
+		match.Fields = append(match.Fields, "subject")
+		match.Subject = highlightText(email.Subject, re)
+	}
+	if re.MatchString(email.From) {
+		match.Fields = append(match.Fields, "from")
+	}
+	if re.MatchString(strings.Join(email.To, ", ")) {
+		match.Fields = append(match.Fields, "to")
+	}
+	if loc := re.FindStringIndex(email.BodyPlain); loc != nil {
+		match.Fields = append(match.Fields, "body")
+		match.Body = highlightText(snippetAround(email.BodyPlain, loc[0], loc[1]), re)
+	}
+
+	return match
+}
+
+// highlightText HTML-escapes text and wraps every match of re in <mark> tags
+func highlightText(text string, re *regexp.Regexp) string {
+	var b strings.Builder
+	last := 0
+	for _, loc := range re.FindAllStringIndex(text, -1) {
+		b.WriteString(html.EscapeString(text[last:loc[0]]))
+		b.WriteString("<mark>" + html.EscapeString(text[loc[0]:loc[1]]) + "</mark>")
+		last = loc[1]
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
+
+// snippetAround returns the part of text surrounding [start, end), cut on
+// rune boundaries and marked with ellipses where truncated
+func snippetAround(text string, start, end int) string {
+	from := start - snippetContext
+	if from < 0 {
+		from = 0
+	}
+	to := end + snippetContext
+	if to > len(text) {
+		to = len(text)
+	}
+
+	for from > 0 && !utf8.RuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+
+	snippet := strings.Join(strings.Fields(text[from:to]), " ")
+	if from > 0 {
+		snippet = "…" + snippet
+	}
+	if to < len(text) {
+		snippet += "…"
+	}
+	return snippet
+}
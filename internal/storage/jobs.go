@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// insertJob queues a job within tx, due now
+func insertJob(tx *sql.Tx, job *Job) error {
+	result, err := tx.Exec(`
+		INSERT INTO jobs (email_id, mail_from, remote_ip, helo, run_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, job.EmailID, job.MailFrom, job.RemoteIP, job.Helo, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	job.ID, err = result.LastInsertId()
+	return err
+}
+
+// ClaimJobs returns up to limit jobs that are due, oldest first, and
+// postpones them by lease
+func (s *SQLiteStorage) ClaimJobs(limit int, lease time.Duration) ([]*Job, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	rows, err := tx.Query(`
+		SELECT id, email_id, mail_from, remote_ip, helo, attempts, error
+		FROM jobs WHERE run_at <= ? ORDER BY run_at, id LIMIT ?
+	`, now.UnixMilli(), limit)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []*Job
+	for rows.Next() {
+		var job Job
+		if err := rows.Scan(&job.ID, &job.EmailID, &job.MailFrom, &job.RemoteIP, &job.Helo, &job.Attempts, &job.Error); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		jobs = append(jobs, &job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, job := range jobs {
+		job.Attempts++
+		if _, err := tx.Exec("UPDATE jobs SET attempts = ?, run_at = ? WHERE id = ?",
+			job.Attempts, now.Add(lease).UnixMilli(), job.ID); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, tx.Commit()
+}
+
+// RetryJob makes a job due again at a later time, recording why it failed
+func (s *SQLiteStorage) RetryJob(id int64, at time.Time, reason string) error {
+	result, err := s.db.Exec("UPDATE jobs SET run_at = ?, error = ? WHERE id = ?", at.UnixMilli(), reason, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteJob deletes a job that is done
+func (s *SQLiteStorage) DeleteJob(id int64) error {
+	result, err := s.db.Exec("DELETE FROM jobs WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ResumeJobs makes every job due now, including those claimed by workers
+// that stopped without finishing them
+func (s *SQLiteStorage) ResumeJobs() error {
+	now := time.Now().UnixMilli()
+	_, err := s.db.Exec("UPDATE jobs SET run_at = ? WHERE run_at > ?", now, now)
+	return err
+}
+
+// CountJobs returns the number of jobs queued or running
+func (s *SQLiteStorage) CountJobs() (int64, error) {
+	var count int64
+	err := s.reader.QueryRow("SELECT COUNT(*) FROM jobs").Scan(&count)
+	return count, err
+}
+
+// SetEmailChecks saves the spam and DKIM, SPF and DMARC results of an
+// email
+func (s *SQLiteStorage) SetEmailChecks(id int64, spam *SpamResult, auth *AuthResults) error {
+	spamScore, spamJSON, authJSON := checkColumns(spam, auth)
+	result, err := s.db.Exec("UPDATE emails SET spam_score = ?, spam = ?, auth = ?, updated_at = ? WHERE id = ?",
+		spamScore, spamJSON, authJSON, time.Now().UnixMilli(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	s.cache.invalidate(id)
+	return nil
+}
+
+// checkColumns returns the spam_score, spam and auth columns of check
+// results
+func checkColumns(spam *SpamResult, auth *AuthResults) (sql.NullFloat64, sql.NullString, sql.NullString) {
+	var spamScore sql.NullFloat64
+	var spamJSON sql.NullString
+	if spam != nil {
+		data, _ := json.Marshal(spam)
+		spamScore = sql.NullFloat64{Float64: spam.Score, Valid: true}
+		spamJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	var authJSON sql.NullString
+	if auth != nil {
+		data, _ := json.Marshal(auth)
+		authJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	return spamScore, spamJSON, authJSON
+}
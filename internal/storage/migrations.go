@@ -20,8 +20,6 @@ CREATE TABLE IF NOT EXISTS emails (
 );
 
 -- Indexes for emails table
-CREATE INDEX IF NOT EXISTS idx_emails_from ON emails(from_address);
-CREATE INDEX IF NOT EXISTS idx_emails_received ON emails(received_at DESC);
 CREATE INDEX IF NOT EXISTS idx_emails_subject ON emails(subject);
 
 -- Attachments table
@@ -51,19 +49,264 @@ CREATE VIRTUAL TABLE IF NOT EXISTS emails_fts USING fts5(
     content_rowid='id'
 );
 
--- Triggers to keep FTS table in sync
-CREATE TRIGGER IF NOT EXISTS emails_ai AFTER INSERT ON emails BEGIN
+-- Triggers to keep FTS table in sync. They are recreated on startup so
+-- existing databases pick up changes to them. Encrypted bodies, which are
+-- stored as blobs, are not indexed.
+DROP TRIGGER IF EXISTS emails_ai;
+CREATE TRIGGER emails_ai AFTER INSERT ON emails BEGIN
     INSERT INTO emails_fts(rowid, subject, from_address, to_addresses, body_plain)
-    VALUES (new.id, new.subject, new.from_address, new.to_addresses, new.body_plain);
+    VALUES (new.id, new.subject, new.from_address, new.to_addresses,
+        CASE WHEN typeof(new.body_plain) = 'text' THEN new.body_plain END);
 END;
 
-CREATE TRIGGER IF NOT EXISTS emails_ad AFTER DELETE ON emails BEGIN
-    DELETE FROM emails_fts WHERE rowid = old.id;
+DROP TRIGGER IF EXISTS emails_ad;
+CREATE TRIGGER emails_ad AFTER DELETE ON emails BEGIN
+    INSERT INTO emails_fts(emails_fts, rowid, subject, from_address, to_addresses, body_plain)
+    VALUES ('delete', old.id, old.subject, old.from_address, old.to_addresses,
+        CASE WHEN typeof(old.body_plain) = 'text' THEN old.body_plain END);
 END;
 
-CREATE TRIGGER IF NOT EXISTS emails_au AFTER UPDATE ON emails BEGIN
-    DELETE FROM emails_fts WHERE rowid = old.id;
+-- Only reindex when searchable columns change, not on flag updates
+DROP TRIGGER IF EXISTS emails_au;
+CREATE TRIGGER emails_au AFTER UPDATE OF subject, from_address, to_addresses, body_plain ON emails BEGIN
+    INSERT INTO emails_fts(emails_fts, rowid, subject, from_address, to_addresses, body_plain)
+    VALUES ('delete', old.id, old.subject, old.from_address, old.to_addresses,
+        CASE WHEN typeof(old.body_plain) = 'text' THEN old.body_plain END);
     INSERT INTO emails_fts(rowid, subject, from_address, to_addresses, body_plain)
-    VALUES (new.id, new.subject, new.from_address, new.to_addresses, new.body_plain);
+    VALUES (new.id, new.subject, new.from_address, new.to_addresses,
+        CASE WHEN typeof(new.body_plain) = 'text' THEN new.body_plain END);
 END;
 `
+
+// unindexEncrypted removes from the FTS index the encrypted bodies that
+// triggers without the blob check indexed, keeping the other columns
+const unindexEncrypted = `
+INSERT INTO emails_fts(emails_fts, rowid, subject, from_address, to_addresses, body_plain)
+    SELECT 'delete', id, subject, from_address, to_addresses, body_plain FROM emails WHERE typeof(body_plain) = 'blob';
+INSERT INTO emails_fts(rowid, subject, from_address, to_addresses, body_plain)
+    SELECT id, subject, from_address, to_addresses, NULL FROM emails WHERE typeof(body_plain) = 'blob';
+`
+
+// migrations contains schema changes applied on top of the base schema.
+// Each entry is applied once, in order, and the database's user_version
+// records how many have been applied.
+var migrations = []string{
+	// 1: content hash for attachments stored in a blob store
+	`ALTER TABLE attachments ADD COLUMN hash TEXT;
+	CREATE INDEX IF NOT EXISTS idx_attachments_hash ON attachments(hash);`,
+
+	// 2: raw RFC822 message, inline or by hash in the blob store
+	`ALTER TABLE emails ADD COLUMN raw BLOB;
+	ALTER TABLE emails ADD COLUMN raw_hash TEXT;
+	CREATE INDEX IF NOT EXISTS idx_emails_raw_hash ON emails(raw_hash);`,
+
+	// 3: content-addressed payloads shared by identical attachments and
+	// raw messages; inline payloads are moved over
+	`CREATE TABLE IF NOT EXISTS blobs (
+		hash TEXT PRIMARY KEY,
+		data BLOB NOT NULL,
+		size INTEGER NOT NULL
+	);
+	INSERT OR IGNORE INTO blobs (hash, data, size)
+		SELECT hash, data, length(data) FROM attachments
+		WHERE hash IS NOT NULL AND data IS NOT NULL;
+	UPDATE attachments SET data = NULL WHERE hash IS NOT NULL AND data IS NOT NULL;
+	INSERT OR IGNORE INTO blobs (hash, data, size)
+		SELECT raw_hash, raw, length(raw) FROM emails
+		WHERE raw_hash IS NOT NULL AND raw IS NOT NULL;
+	UPDATE emails SET raw = NULL WHERE raw_hash IS NOT NULL AND raw IS NOT NULL;`,
+
+	// 4: SMTP envelope sender and recipients
+	`ALTER TABLE emails ADD COLUMN envelope_from TEXT NOT NULL DEFAULT '';
+	ALTER TABLE emails ADD COLUMN envelope_to TEXT NOT NULL DEFAULT '[]';`,
+
+	// 5: user-managed tags and pinning
+	`ALTER TABLE emails ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';
+	ALTER TABLE emails ADD COLUMN pinned BOOLEAN NOT NULL DEFAULT 0;
+	CREATE INDEX IF NOT EXISTS idx_emails_pinned ON emails(pinned) WHERE pinned = 1;`,
+
+	// 6: conversation threads; existing emails each start their own
+	`ALTER TABLE emails ADD COLUMN thread_id TEXT NOT NULL DEFAULT '';
+	UPDATE emails SET thread_id = printf('%016x', id);
+	CREATE INDEX IF NOT EXISTS idx_emails_thread ON emails(thread_id);`,
+
+	// 7: API keys managed through the admin API; only hashes are stored
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		key_hash TEXT NOT NULL UNIQUE,
+		prefix TEXT NOT NULL,
+		scope TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`,
+
+	// 8: last change to an email's flags or tags, in Unix milliseconds,
+	// used for ETags
+	`ALTER TABLE emails ADD COLUMN updated_at INTEGER NOT NULL DEFAULT 0;
+	UPDATE emails SET updated_at = CAST(strftime('%s', 'now') AS INTEGER) * 1000;
+	CREATE INDEX IF NOT EXISTS idx_emails_updated_at ON emails(updated_at);`,
+
+	// 9: saved searches; criteria are stored as JSON
+	`CREATE TABLE IF NOT EXISTS saved_searches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		criteria TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);`,
+
+	// 10: messages that could not be parsed, counted by the analytics
+	`CREATE TABLE IF NOT EXISTS parse_failures (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		failed_at DATETIME NOT NULL,
+		source TEXT NOT NULL,
+		error TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_parse_failures_failed_at ON parse_failures(failed_at);`,
+
+	// 11: notes on emails, deleted with them
+	`CREATE TABLE IF NOT EXISTS notes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email_id INTEGER NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+		author TEXT NOT NULL,
+		body TEXT NOT NULL,
+		created_at DATETIME NOT NULL,
+		updated_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_notes_email ON notes(email_id);`,
+
+	// 12: spam filter verdicts; the score is kept in its own column for
+	// filtering and the full result as JSON
+	`ALTER TABLE emails ADD COLUMN spam_score REAL;
+	ALTER TABLE emails ADD COLUMN spam TEXT;
+	CREATE INDEX IF NOT EXISTS idx_emails_spam_score ON emails(spam_score) WHERE spam_score IS NOT NULL;`,
+
+	// 13: DKIM, SPF and DMARC results as JSON
+	`ALTER TABLE emails ADD COLUMN auth TEXT;`,
+
+	// 14: audit log of destructive and administrative actions
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time DATETIME NOT NULL,
+		action TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		auth TEXT NOT NULL,
+		remote_ip TEXT NOT NULL,
+		target TEXT NOT NULL,
+		details TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_log_time ON audit_log(time);`,
+
+	// 15: Content-ID and disposition of attachments, for inline images
+	`ALTER TABLE attachments ADD COLUMN content_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE attachments ADD COLUMN inline INTEGER NOT NULL DEFAULT 0;`,
+
+	// 16: ntfy and Web Push subscriptions to the mail of an address
+	`CREATE TABLE IF NOT EXISTS push_subscriptions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		address TEXT NOT NULL,
+		type TEXT NOT NULL,
+		topic TEXT NOT NULL DEFAULT '',
+		token TEXT NOT NULL DEFAULT '',
+		endpoint TEXT NOT NULL DEFAULT '',
+		p256dh TEXT NOT NULL DEFAULT '',
+		auth TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_push_subscriptions_address ON push_subscriptions(address);`,
+
+	// 17: jobs that check and announce new emails once they are saved;
+	// run_at is in Unix milliseconds
+	`CREATE TABLE IF NOT EXISTS jobs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		email_id INTEGER NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+		mail_from TEXT NOT NULL DEFAULT '',
+		remote_ip TEXT NOT NULL DEFAULT '',
+		helo TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		run_at INTEGER NOT NULL,
+		error TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX IF NOT EXISTS idx_jobs_run_at ON jobs(run_at);
+	CREATE INDEX IF NOT EXISTS idx_jobs_email ON jobs(email_id);`,
+
+	// 18: recipients of every email by lower-cased address, so filtering
+	// by recipient looks them up instead of scanning the JSON of every
+	// email; kind is to, cc, bcc or envelope, and the email's size is
+	// copied for mailbox usage. Lists are ordered by received_at and id,
+	// and the unread ones counted, from indexes.
+	`CREATE TABLE IF NOT EXISTS email_recipients (
+		address TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		email_id INTEGER NOT NULL REFERENCES emails(id) ON DELETE CASCADE,
+		size INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (address, kind, email_id)
+	) WITHOUT ROWID;
+	-- One pass over the emails; the kind is the key of the list an address is in
+	INSERT OR IGNORE INTO email_recipients (address, kind, email_id, size)
+		SELECT lower(trim(t.value)), substr(t.path, 3), emails.id, COALESCE(emails.size, 0)
+		FROM emails, json_tree(json_object(
+			'to', json(emails.to_addresses),
+			'cc', json(COALESCE(emails.cc_addresses, '[]')),
+			'bcc', json(COALESCE(emails.bcc_addresses, '[]')),
+			'envelope', json(emails.envelope_to)
+		)) AS t
+		WHERE t.type = 'text' AND trim(t.value) != '';
+	CREATE INDEX IF NOT EXISTS idx_email_recipients_email ON email_recipients(email_id);
+	DROP INDEX IF EXISTS idx_emails_received;
+	CREATE INDEX IF NOT EXISTS idx_emails_received_id ON emails(received_at DESC, id DESC);
+	CREATE INDEX IF NOT EXISTS idx_emails_unread ON emails(received_at DESC, id DESC) WHERE read = 0;
+	DROP INDEX IF EXISTS idx_emails_from;
+	CREATE INDEX IF NOT EXISTS idx_emails_from_nocase ON emails(from_address COLLATE NOCASE);`,
+
+	// 19: events of a text/calendar part as JSON
+	`ALTER TABLE emails ADD COLUMN calendar TEXT;`,
+
+	// 20: summaries of attached emails as JSON
+	`ALTER TABLE attachments ADD COLUMN message TEXT;`,
+
+	// 21: S/MIME and PGP signatures and encryption as JSON
+	`ALTER TABLE emails ADD COLUMN security TEXT;`,
+
+	// 22: relays parsed from the Received headers as JSON
+	`ALTER TABLE emails ADD COLUMN received_hops TEXT;`,
+
+	// 23: the body an email lacks when it has only one of plain text and
+	// HTML
+	`ALTER TABLE emails ADD COLUMN missing_alternative TEXT;
+	CREATE INDEX IF NOT EXISTS idx_emails_missing_alternative ON emails(missing_alternative)
+		WHERE missing_alternative IS NOT NULL;`,
+
+	// 24: List-Unsubscribe URIs and the last unsubscribe test as JSON
+	`ALTER TABLE emails ADD COLUMN unsubscribe TEXT;`,
+
+	// 25: the AMP for Email (text/x-amp-html) body
+	`ALTER TABLE emails ADD COLUMN body_amp BLOB;`,
+
+	// 26: attachment types sniffed from their data
+	`ALTER TABLE attachments ADD COLUMN detected_type TEXT NOT NULL DEFAULT '';
+	ALTER TABLE attachments ADD COLUMN type_mismatch TEXT NOT NULL DEFAULT '';`,
+
+	// 27: Reply-To addresses as JSON, Sender and the return path
+	`ALTER TABLE emails ADD COLUMN reply_to TEXT;
+	ALTER TABLE emails ADD COLUMN sender TEXT NOT NULL DEFAULT '';
+	ALTER TABLE emails ADD COLUMN return_path TEXT NOT NULL DEFAULT '';`,
+
+	// 28: the priority flagged by the X-Priority or Importance header
+	`ALTER TABLE emails ADD COLUMN priority TEXT;
+	CREATE INDEX IF NOT EXISTS idx_emails_priority ON emails(priority) WHERE priority IS NOT NULL;`,
+
+	// 29: sizes of the parts of an email as JSON
+	`ALTER TABLE emails ADD COLUMN size_breakdown TEXT;`,
+
+	// 30: envelope recipients normalized to their mailbox and subaddress,
+	// and the settings they were normalized with
+	`ALTER TABLE email_recipients ADD COLUMN mailbox TEXT;
+	ALTER TABLE email_recipients ADD COLUMN subaddress TEXT;
+	CREATE INDEX IF NOT EXISTS idx_email_recipients_mailbox ON email_recipients(mailbox, subaddress)
+		WHERE mailbox IS NOT NULL;
+	CREATE TABLE IF NOT EXISTS settings (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);`,
+}
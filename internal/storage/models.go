@@ -2,7 +2,9 @@ package storage
 
 import (
 	"errors"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 var (
@@ -10,6 +12,10 @@ var (
 	ErrNotFound = errors.New("email not found")
 	// ErrInvalidID is returned when an invalid ID is provided
 	ErrInvalidID = errors.New("invalid email ID")
+	// ErrRawNotAvailable is returned for emails stored without their raw message
+	ErrRawNotAvailable = errors.New("raw message not available")
+	// ErrNameTaken is returned when a saved search name is already in use
+	ErrNameTaken = errors.New("name already in use")
 )
 
 // Email represents an email message
@@ -23,11 +29,302 @@ type Email struct {
 	Subject     string              `json:"subject"`
 	BodyPlain   string              `json:"bodyPlain"`
 	BodyHTML    string              `json:"bodyHTML"`
+	BodyAMP     string              `json:"bodyAMP,omitempty"` // text/x-amp-html alternative, AMP for Email
 	Headers     map[string][]string `json:"headers"`
-	Attachments []AttachmentMeta    `json:"attachments,omitempty"`
+	Attachments []*Attachment       `json:"attachments,omitempty"`
 	Size        int64               `json:"size"`
 	ReceivedAt  time.Time           `json:"receivedAt"`
 	Read        bool                `json:"read"`
+	Pinned      bool                `json:"pinned"`
+	Tags        []string            `json:"tags"`
+
+	// Envelope holds the SMTP MAIL FROM and RCPT TO addresses, which may
+	// differ from the headers (e.g. BCC recipients)
+	EnvelopeFrom string   `json:"envelopeFrom"`
+	EnvelopeTo   []string `json:"envelopeTo"`
+
+	// ReplyTo and Sender are the addresses of the headers of the same
+	// names. ReturnPath is where bounces go: the MAIL FROM address when
+	// the email was received over SMTP, or else its Return-Path header.
+	ReplyTo    []string `json:"replyTo,omitempty"`
+	Sender     string   `json:"sender,omitempty"`
+	ReturnPath string   `json:"returnPath,omitempty"`
+
+	// Priority is high, normal or low when the headers flag one, as mail
+	// clients do with X-Priority or Importance
+	Priority string `json:"priority,omitempty"`
+
+	// ThreadID groups an email with the emails it replies to and their
+	// replies; it is assigned when the email is saved
+	ThreadID string `json:"threadId"`
+
+	// UpdatedAt is when the email was stored or its flags or tags last
+	// changed
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// InReplyTo and References hold the Message-IDs from the headers of
+	// the same names; they are used to assign ThreadID
+	InReplyTo  string   `json:"-"`
+	References []string `json:"-"`
+
+	// MissingAlternative is set on an email with only an HTML or only a
+	// plain-text body: plain when it has no text alternative, in which case
+	// BodyPlain is derived from the HTML, or html
+	MissingAlternative string `json:"missingAlternative,omitempty"`
+
+	// Spam is the spam filter verdict, if spam scoring is enabled
+	Spam *SpamResult `json:"spam,omitempty"`
+
+	// Auth holds the DKIM, SPF and DMARC results, if verification is
+	// enabled
+	Auth *AuthResults `json:"auth,omitempty"`
+
+	// Calendar holds the events of a text/calendar part, such as a
+	// meeting invitation
+	Calendar *Calendar `json:"calendar,omitempty"`
+
+	// Security describes the S/MIME or PGP signatures and encryption of a
+	// signed or encrypted email
+	Security *Security `json:"security,omitempty"`
+
+	// Unsubscribe is set on an email with a List-Unsubscribe header, as
+	// sent by mailing lists and bulk senders
+	Unsubscribe *Unsubscribe `json:"unsubscribe,omitempty"`
+
+	// SizeBreakdown shows where the bytes of the message go, as the parts
+	// are encoded in it
+	SizeBreakdown *SizeBreakdown `json:"sizeBreakdown,omitempty"`
+
+	// Received lists the relays the email passed through, parsed from its
+	// Received headers, in the order it reached them
+	Received []*ReceivedHop `json:"received,omitempty"`
+
+	// Match is set on search results to show where the query matched
+	Match *SearchMatch `json:"match,omitempty"`
+
+	// Job, when set, is queued in the transaction that saves the email
+	Job *Job `json:"-"`
+
+	// Preview is the start of the plain-text body, set on summaries
+	Preview string `json:"-"`
+
+	// Raw holds the message exactly as received; it is served separately
+	Raw []byte `json:"-"`
+
+	// RawSpool is the temporary file holding a large message in place of
+	// Raw, until the email is stored
+	RawSpool string `json:"-"`
+}
+
+// SizeBreakdown is the size of an email by what its bytes are spent on.
+// Headers is the size of the message header, and Text, HTML, AMP and
+// Attachments that of its bodies and attachments as they are encoded in
+// the message. Structure is the rest: the headers of the parts, their
+// boundaries and any preamble. Together they are the size of the email.
+type SizeBreakdown struct {
+	Headers     int64       `json:"headers"`
+	Text        int64       `json:"text"`
+	HTML        int64       `json:"html"`
+	AMP         int64       `json:"amp"`
+	Attachments int64       `json:"attachments"`
+	Structure   int64       `json:"structure"`
+	Parts       []*PartSize `json:"parts"`
+}
+
+// PartSize is the size of a body or attachment of an email
+type PartSize struct {
+	Part        string `json:"part"` // numbered as in IMAP, such as 1.2
+	ContentType string `json:"contentType"`
+	Kind        string `json:"kind"` // text, html, amp or attachment
+	Filename    string `json:"filename,omitempty"`
+	Encoding    string `json:"encoding,omitempty"` // Content-Transfer-Encoding
+	Size        int64  `json:"size"`               // as encoded in the message
+	DecodedSize int64  `json:"decodedSize"`
+}
+
+// SpamResult is the verdict of a spam filter on an email
+type SpamResult struct {
+	Engine    string     `json:"engine"` // rspamd or spamassassin
+	Score     float64    `json:"score"`
+	Threshold float64    `json:"threshold"` // required score reported by the engine
+	IsSpam    bool       `json:"isSpam"`
+	Action    string     `json:"action,omitempty"` // rspamd only, e.g. "add header"
+	Rules     []SpamRule `json:"rules"`
+	CheckedAt time.Time  `json:"checkedAt"`
+}
+
+// SpamRule is a spam filter rule that matched an email
+type SpamRule struct {
+	Name        string  `json:"name"`
+	Score       float64 `json:"score"`
+	Description string  `json:"description,omitempty"`
+}
+
+// AuthResults are the DKIM, SPF and DMARC results of an email. Results use
+// the names of RFC 8601: pass, fail, softfail, neutral, none, temperror
+// and permerror.
+type AuthResults struct {
+	SPF       SPFResult    `json:"spf"`
+	DKIM      []DKIMResult `json:"dkim"` // one per signature
+	DMARC     DMARCResult  `json:"dmarc"`
+	CheckedAt time.Time    `json:"checkedAt"`
+}
+
+// SPFResult is the SPF result for the envelope sender
+type SPFResult struct {
+	Result string `json:"result"`
+	Domain string `json:"domain"` // of MAIL FROM, or the HELO name
+	IP     string `json:"ip"`     // of the SMTP client
+	Reason string `json:"reason,omitempty"`
+}
+
+// DKIMResult is the result of verifying one DKIM signature
+type DKIMResult struct {
+	Result    string   `json:"result"`
+	Domain    string   `json:"domain"`
+	Selector  string   `json:"selector"`
+	Algorithm string   `json:"algorithm"`
+	Headers   []string `json:"headers"` // signed header fields
+	Reason    string   `json:"reason,omitempty"`
+}
+
+// DMARCResult is the DMARC result for the From domain
+type DMARCResult struct {
+	Result      string `json:"result"`
+	Domain      string `json:"domain"`
+	Policy      string `json:"policy,omitempty"` // none, quarantine or reject
+	SPFAligned  bool   `json:"spfAligned"`
+	DKIMAligned bool   `json:"dkimAligned"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// Security describes how an email is signed or encrypted with S/MIME or
+// PGP. Encrypted emails decrypted with a configured key have their bodies
+// and attachments replaced by the decrypted ones; their raw message stays
+// as received.
+type Security struct {
+	Format     string       `json:"format"` // smime or pgp
+	Signed     bool         `json:"signed"`
+	Encrypted  bool         `json:"encrypted"`
+	Decrypted  bool         `json:"decrypted"`
+	Recipients []string     `json:"recipients,omitempty"` // the keys the email is encrypted to
+	Signatures []*Signature `json:"signatures,omitempty"`
+	Reason     string       `json:"reason,omitempty"` // why it was not decrypted, or its signature not read
+}
+
+// Signature is an S/MIME or PGP signature of an email. S/MIME signatures
+// are verified against the certificate they carry, whose trust is not
+// checked; PGP signatures are only described, with a result of none.
+type Signature struct {
+	Result      string     `json:"result"` // pass, fail or none
+	Signer      string     `json:"signer,omitempty"`
+	KeyID       string     `json:"keyId,omitempty"` // PGP key ID, or S/MIME certificate serial number
+	Fingerprint string     `json:"fingerprint,omitempty"`
+	Algorithm   string     `json:"algorithm,omitempty"` // e.g. RSA-SHA256
+	SignedAt    *time.Time `json:"signedAt,omitempty"`
+
+	// The S/MIME signer's certificate
+	Subject   string     `json:"subject,omitempty"`
+	Issuer    string     `json:"issuer,omitempty"`
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+
+	Reason string `json:"reason,omitempty"`
+}
+
+// Unsubscribe is the unsubscribe mechanism an email offers in its
+// List-Unsubscribe (RFC 2369) and List-Unsubscribe-Post (RFC 8058) headers
+type Unsubscribe struct {
+	Mailto   []string `json:"mailto,omitempty"` // mailto: URIs
+	URLs     []string `json:"urls,omitempty"`   // http and https URIs
+	OneClick bool     `json:"oneClick"`         // List-Unsubscribe-Post: List-Unsubscribe=One-Click
+
+	// Problems are the ways the headers fall short of what bulk senders
+	// must offer, such as a missing one-click URL
+	Problems []string `json:"problems,omitempty"`
+
+	// Test is the outcome of the last unsubscribe test
+	Test *UnsubscribeTest `json:"test,omitempty"`
+}
+
+// UnsubscribeTest is the outcome of exercising the unsubscribe mechanism
+// of an email
+type UnsubscribeTest struct {
+	TestedAt time.Time            `json:"testedAt"`
+	Results  []*UnsubscribeResult `json:"results"`
+}
+
+// UnsubscribeResult is the outcome of one unsubscribe request
+type UnsubscribeResult struct {
+	Method     string `json:"method"` // one-click, link or mailto
+	Target     string `json:"target"` // the URL requested or address mailed
+	Status     string `json:"status"` // ok, failed or skipped
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// ReceivedHop is a relay an email passed through, as its Received header
+// (RFC 5321 section 4.4) records it. Fields the relay did not write are
+// empty.
+type ReceivedHop struct {
+	From      string     `json:"from,omitempty"`     // the name the client greeted the relay with
+	FromHost  string     `json:"fromHost,omitempty"` // the client's host name, as the relay looked it up
+	FromIP    string     `json:"fromIp,omitempty"`
+	By        string     `json:"by,omitempty"`       // the relay
+	Protocol  string     `json:"protocol,omitempty"` // e.g. ESMTPS
+	ID        string     `json:"id,omitempty"`
+	For       string     `json:"for,omitempty"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+
+	// DelayMs is the time since the hop before, if both have a timestamp.
+	// It is negative when the relays' clocks disagree.
+	DelayMs *int64 `json:"delayMs,omitempty"`
+
+	Header string `json:"header"` // the header as received, unfolded
+}
+
+// Calendar is the iCalendar (RFC 5545) data of an email
+type Calendar struct {
+	// Method is the iTIP method: REQUEST for an invitation or update,
+	// CANCEL, REPLY, PUBLISH and so on
+	Method string           `json:"method,omitempty"`
+	Events []*CalendarEvent `json:"events"`
+}
+
+// CalendarEvent is a VEVENT of a calendar. Times with a TZID are in that
+// time zone; floating times, which have none, are read as UTC.
+type CalendarEvent struct {
+	UID         string              `json:"uid"`
+	Summary     string              `json:"summary"`
+	Description string              `json:"description,omitempty"`
+	Location    string              `json:"location,omitempty"`
+	Start       *time.Time          `json:"start,omitempty"`
+	End         *time.Time          `json:"end,omitempty"`
+	AllDay      bool                `json:"allDay,omitempty"`
+	TimeZone    string              `json:"timeZone,omitempty"`   // TZID of the start
+	Recurrence  string              `json:"recurrence,omitempty"` // RRULE
+	Status      string              `json:"status,omitempty"`     // CONFIRMED, TENTATIVE or CANCELLED
+	Sequence    int                 `json:"sequence"`
+	Organizer   *CalendarAttendee   `json:"organizer,omitempty"`
+	Attendees   []*CalendarAttendee `json:"attendees"`
+}
+
+// CalendarAttendee is the organizer or an attendee of an event
+type CalendarAttendee struct {
+	Email  string `json:"email"`
+	Name   string `json:"name,omitempty"`
+	Role   string `json:"role,omitempty"`   // e.g. REQ-PARTICIPANT or OPT-PARTICIPANT
+	Status string `json:"status,omitempty"` // PARTSTAT, e.g. NEEDS-ACTION or ACCEPTED
+	RSVP   bool   `json:"rsvp,omitempty"`
+}
+
+// SearchMatch describes where a search query matched an email. Subject and
+// Body are HTML-escaped fragments with matches wrapped in <mark> tags.
+type SearchMatch struct {
+	Fields  []string `json:"fields"`
+	Subject string   `json:"subject,omitempty"`
+	Body    string   `json:"body,omitempty"`
 }
 
 // AttachmentMeta represents attachment metadata
@@ -36,25 +333,507 @@ type AttachmentMeta struct {
 	Filename    string `json:"filename"`
 	ContentType string `json:"contentType"`
 	Size        int64  `json:"size"`
+
+	// ContentID is referenced by cid: URLs in the HTML body; Inline parts
+	// are meant to be shown in the body rather than listed
+	ContentID string `json:"contentId,omitempty"`
+	Inline    bool   `json:"inline,omitempty"`
+
+	// DetectedType is the type sniffed from the data's magic bytes, and
+	// TypeMismatch says how it contradicts ContentType or the extension of
+	// Filename
+	DetectedType string `json:"detectedType,omitempty"`
+	TypeMismatch string `json:"typeMismatch,omitempty"`
+
+	// Message summarizes an attached email, such as one forwarded as an
+	// attachment
+	Message *MessageInfo `json:"message,omitempty"`
+}
+
+// MessageInfo summarizes an email attached to another as a message/rfc822
+// part. Attachments of its own are listed, with the emails they hold in
+// turn; their IDs are 0, as only the outer parts are stored.
+type MessageInfo struct {
+	MessageID   string            `json:"messageId,omitempty"`
+	From        string            `json:"from"`
+	To          []string          `json:"to,omitempty"`
+	CC          []string          `json:"cc,omitempty"`
+	Subject     string            `json:"subject"`
+	Date        *time.Time        `json:"date,omitempty"`
+	Attachments []*AttachmentMeta `json:"attachments,omitempty"`
 }
 
 // Attachment represents a full attachment with data
 type Attachment struct {
 	AttachmentMeta
 	Data []byte `json:"-"`
+
+	// Spool is the temporary file holding the data of a large attachment
+	// in place of Data, until the email is stored
+	Spool string `json:"-"`
 }
 
 // EmailFilter represents filter criteria for listing emails
 type EmailFilter struct {
+	// Query is a full-text search query, as for SearchEmails
+	Query string
+
 	From    string
 	To      string
 	Subject string
 	Since   *time.Time
 	Until   *time.Time
+	Unread  bool
+
+	// EnvelopeTo matches emails delivered to this RCPT TO address
+	EnvelopeTo string
+
+	// Inbox matches emails delivered to an address or, unless InboxExact,
+	// to the same mailbox as normalized by SetAddresses: an address
+	// without a tag also matches its subaddresses, and one with a tag
+	// that subaddress alone
+	Inbox      string
+	InboxExact bool
+
+	// ReplyTo, Sender and ReturnPath match those addresses of an email, as
+	// From does
+	ReplyTo    string
+	Sender     string
+	ReturnPath string
+
+	// Priority matches emails flagged with this priority, high, normal or
+	// low
+	Priority string
+
+	// Mailbox matches emails addressed to exactly this address, as counted
+	// by ListMailboxes
+	Mailbox string
+
+	// Mailboxes restricts emails to those addressed to an address matching
+	// one of these patterns, such as *@example.com, in any recipient field
+	// or the envelope. Nil matches every email.
+	Mailboxes []string
+
+	Tag    string
+	Pinned bool
+
+	// MissingAlternative matches emails without a body of this kind, plain
+	// or html, that have the other
+	MissingAlternative string
+
+	// Spam matches emails the spam filter classified as spam, and
+	// MinSpamScore emails scored at least this much
+	Spam         bool
+	MinSpamScore *float64
+
+	// Cursor restricts ListEmails to emails after this position; the
+	// offset is ignored when it is set
+	Cursor *Cursor
+
+	// Summary makes ListEmails skip the HTML body and headers and set
+	// Preview instead of the plain-text body
+	Summary bool
+}
+
+// SearchCriteria are the conditions of a saved search. Empty fields match
+// every email.
+type SearchCriteria struct {
+	Query   string `json:"query,omitempty"` // full-text search query
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Rcpt    string `json:"rcpt,omitempty"`
+	Tag     string `json:"tag,omitempty"`
+	Unread  bool   `json:"unread,omitempty"`
+	Pinned  bool   `json:"pinned,omitempty"`
+}
+
+// Filter returns the email filter for the criteria
+func (c *SearchCriteria) Filter() *EmailFilter {
+	return &EmailFilter{
+		Query:      c.Query,
+		From:       c.From,
+		To:         c.To,
+		Subject:    c.Subject,
+		EnvelopeTo: c.Rcpt,
+		Tag:        c.Tag,
+		Unread:     c.Unread,
+		Pinned:     c.Pinned,
+	}
+}
+
+// SavedSearch is a named search kept in storage, e.g. "bounce notifications"
+type SavedSearch struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+	SearchCriteria
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Job is the processing of a new email once it is saved: the checks that
+// may be slow, such as spam scoring, and announcing it. Jobs are kept in
+// the database so that they survive a restart.
+type Job struct {
+	ID      int64
+	EmailID int64
+
+	// MailFrom, RemoteIP and Helo are the SMTP envelope and client, for
+	// SPF; the email does not keep them
+	MailFrom string
+	RemoteIP string
+	Helo     string
+
+	Attempts int    // including the one in progress
+	Error    string // of the last failed attempt
+}
+
+// Note is a comment attached to an email, e.g. "broken template from
+// ticket #123"
+type Note struct {
+	ID        int64     `json:"id"`
+	EmailID   int64     `json:"emailId"`
+	Author    string    `json:"author"`
+	Body      string    `json:"body"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// EmailUpdate holds changes to the mutable fields of an email. Nil
+// fields are left unchanged.
+type EmailUpdate struct {
+	Read   *bool
+	Pinned *bool
+	Tags   *[]string
+}
+
+// Batch actions supported by BatchEmails
+const (
+	BatchDelete     = "delete"
+	BatchMarkRead   = "mark-read"
+	BatchMarkUnread = "mark-unread"
+	BatchTag        = "tag"
+	BatchUntag      = "untag"
+)
+
+// BatchOperation is an action applied to several emails in one transaction
+type BatchOperation struct {
+	Action string
+	Tags   []string // for BatchTag and BatchUntag
+}
+
+// BatchItemResult reports the outcome of a batch action for one email
+type BatchItemResult struct {
+	ID      int64  `json:"id"`
+	Success bool   `json:"success"`
+	Error   string `json:"error,omitempty"`
+}
+
+// EmailSummary is the metadata of an email, as listed without bodies
+type EmailSummary struct {
+	ID                 int64        `json:"id"`
+	MessageID          string       `json:"messageId"`
+	From               string       `json:"from"`
+	To                 []string     `json:"to"`
+	CC                 []string     `json:"cc,omitempty"`
+	BCC                []string     `json:"bcc,omitempty"`
+	Subject            string       `json:"subject"`
+	Preview            string       `json:"preview"`
+	Size               int64        `json:"size"`
+	ReceivedAt         time.Time    `json:"receivedAt"`
+	Read               bool         `json:"read"`
+	Pinned             bool         `json:"pinned"`
+	Tags               []string     `json:"tags"`
+	EnvelopeFrom       string       `json:"envelopeFrom"`
+	EnvelopeTo         []string     `json:"envelopeTo"`
+	ReplyTo            []string     `json:"replyTo,omitempty"`
+	Sender             string       `json:"sender,omitempty"`
+	ReturnPath         string       `json:"returnPath,omitempty"`
+	Priority           string       `json:"priority,omitempty"`
+	ThreadID           string       `json:"threadId"`
+	UpdatedAt          time.Time    `json:"updatedAt"`
+	MissingAlternative string       `json:"missingAlternative,omitempty"`
+	Spam               *SpamResult  `json:"spam,omitempty"`
+	Auth               *AuthResults `json:"auth,omitempty"`
+	Security           *Security    `json:"security,omitempty"`
+}
+
+// Summary returns the metadata of the email. Preview is computed from the
+// plain-text body unless it is already set.
+func (e *Email) Summary() *EmailSummary {
+	preview := e.Preview
+	if preview == "" {
+		preview = makePreview(e.BodyPlain)
+	}
+	return &EmailSummary{
+		ID:                 e.ID,
+		MessageID:          e.MessageID,
+		From:               e.From,
+		To:                 e.To,
+		CC:                 e.CC,
+		BCC:                e.BCC,
+		Subject:            e.Subject,
+		Preview:            preview,
+		Size:               e.Size,
+		ReceivedAt:         e.ReceivedAt,
+		Read:               e.Read,
+		Pinned:             e.Pinned,
+		Tags:               e.Tags,
+		EnvelopeFrom:       e.EnvelopeFrom,
+		EnvelopeTo:         e.EnvelopeTo,
+		ReplyTo:            e.ReplyTo,
+		Sender:             e.Sender,
+		ReturnPath:         e.ReturnPath,
+		Priority:           e.Priority,
+		ThreadID:           e.ThreadID,
+		UpdatedAt:          e.UpdatedAt,
+		MissingAlternative: e.MissingAlternative,
+		Spam:               e.Spam,
+		Auth:               e.Auth,
+		Security:           e.Security,
+	}
 }
 
 // EmailListResult represents a paginated list of emails
 type EmailListResult struct {
 	Emails []*Email `json:"emails"`
 	Total  int64    `json:"total"`
+
+	// NextCursor is set by ListEmails when more emails may follow
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+// MailboxUsage reports how many emails a recipient address holds
+type MailboxUsage struct {
+	Address  string `json:"address"`
+	Messages int64  `json:"messages"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// StorageStats summarizes how much space captured mail is using
+type StorageStats struct {
+	DatabaseBytes   int64        `json:"databaseBytes"`
+	WALBytes        int64        `json:"walBytes"`
+	EmailCount      int64        `json:"emailCount"`
+	EmailBytes      int64        `json:"emailBytes"`
+	AttachmentCount int64        `json:"attachmentCount"`
+	AttachmentBytes int64        `json:"attachmentBytes"`
+	BlobCount       int64        `json:"blobCount"` // unique payloads in the database
+	BlobBytes       int64        `json:"blobBytes"`
+	DailyCounts     []DailyCount `json:"dailyCounts"`
+	LargestEmails   []EmailSize  `json:"largestEmails"`
+}
+
+// DailyCount represents the number and total size of emails received on a day
+type DailyCount struct {
+	Date  string `json:"date"`
+	Count int64  `json:"count"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Thread summarizes a conversation. The first and last emails are the
+// earliest and latest stored.
+type Thread struct {
+	ID              string    `json:"threadId"`
+	Subject         string    `json:"subject"` // of the first email
+	Participants    []string  `json:"participants"`
+	Count           int64     `json:"count"`
+	UnreadCount     int64     `json:"unreadCount"`
+	FirstEmailID    int64     `json:"firstEmailId"`
+	LastEmailID     int64     `json:"lastEmailId"`
+	FirstReceivedAt time.Time `json:"firstReceivedAt"`
+	LastReceivedAt  time.Time `json:"lastReceivedAt"`
+}
+
+// ThreadListResult represents a paginated list of threads
+type ThreadListResult struct {
+	Threads []*Thread `json:"threads"`
+	Total   int64     `json:"total"`
+}
+
+// TemplateGroup summarizes the emails generated from one template, as
+// named by a header such as X-Template-ID. The first and last emails are
+// the earliest and latest stored.
+type TemplateGroup struct {
+	Template        string          `json:"template"`
+	Count           int64           `json:"count"`
+	FirstEmailID    int64           `json:"firstEmailId"`
+	LastEmailID     int64           `json:"lastEmailId"`
+	FirstReceivedAt time.Time       `json:"firstReceivedAt"`
+	LastReceivedAt  time.Time       `json:"lastReceivedAt"`
+	Samples         []*EmailSummary `json:"samples"` // the latest emails
+}
+
+// TemplateListResult represents a paginated list of templates. Untagged
+// counts the emails without the header.
+type TemplateListResult struct {
+	Templates []*TemplateGroup `json:"templates"`
+	Total     int64            `json:"total"`
+	Untagged  int64            `json:"untagged"`
+}
+
+// AttachmentFilter selects attachments across emails. Empty fields match
+// every attachment.
+type AttachmentFilter struct {
+	// ContentType matches the declared type, ignoring case; a type ending
+	// in /* such as image/* matches all its subtypes
+	ContentType string
+
+	// Filename matches as a glob such as invoice-*.pdf when it has *, ?
+	// or [, and otherwise as a part of the name, ignoring case
+	Filename string
+
+	// MinSize matches attachments of at least this many bytes
+	MinSize int64
+
+	// Emails restricts attachments to those of emails matching it
+	Emails *EmailFilter
+}
+
+// AttachmentListing is an attachment with a summary of the email it
+// belongs to
+type AttachmentListing struct {
+	*AttachmentMeta
+	EmailID int64         `json:"emailId"`
+	Email   *EmailSummary `json:"email"`
+}
+
+// AttachmentListResult represents a paginated list of attachments
+type AttachmentListResult struct {
+	Attachments []*AttachmentListing `json:"attachments"`
+	Total       int64                `json:"total"`
+}
+
+// API key scopes
+const (
+	ScopeRead = "read" // GET requests outside the admin API
+	ScopeFull = "full"
+)
+
+// APIKey is an API key managed through the admin API. The key itself is
+// only shown when it is created; Prefix identifies it afterwards.
+type APIKey struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Prefix    string    `json:"prefix"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// PushSubscription sends a desktop or phone notification for each new
+// email to an address: through an ntfy topic, or to a browser with Web
+// Push. The credentials are never returned by the API.
+type PushSubscription struct {
+	ID      int64  `json:"id"`
+	Address string `json:"address"` // lower case; * matches any characters
+	Type    string `json:"type"`    // ntfy or webpush
+
+	// Topic is the ntfy topic, a name on the configured server or a URL,
+	// and Token its access token, if it needs one
+	Topic string `json:"topic,omitempty"`
+	Token string `json:"-"`
+
+	// Endpoint, P256DH and Auth are the browser's push subscription
+	Endpoint string `json:"endpoint,omitempty"`
+	P256DH   string `json:"-"`
+	Auth     string `json:"-"`
+
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AuditEntry records a destructive or administrative action and who
+// performed it
+type AuditEntry struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"` // e.g. email.delete or api_key.create
+	Actor    string    `json:"actor"`  // user name, OIDC email or subject, or API key name
+	Auth     string    `json:"auth"`   // basic, oidc, api_key or none
+	RemoteIP string    `json:"remoteIp"`
+	Target   string    `json:"target,omitempty"` // e.g. the email ID
+
+	// Details are action specific, e.g. the recipients of a release
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// AuditFilter selects audit entries; empty fields match everything
+type AuditFilter struct {
+	Action string // exact, or a prefix ending in ".", e.g. "email."
+	Actor  string
+	Since  *time.Time
+	Until  *time.Time
+}
+
+// AuditListResult represents a paginated list of audit entries, newest
+// first
+type AuditListResult struct {
+	Entries []*AuditEntry `json:"entries"`
+	Total   int64         `json:"total"`
+}
+
+// EmailSize identifies an email by its size
+type EmailSize struct {
+	ID         int64     `json:"id"`
+	From       string    `json:"from"`
+	Subject    string    `json:"subject"`
+	Size       int64     `json:"size"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// ExpiredEmail is an email a retention pass would delete, and the limit
+// it exceeds: max_age or max_count
+type ExpiredEmail struct {
+	EmailSize
+	Reason string `json:"reason"`
+}
+
+// MaintenanceResult describes a database maintenance run
+type MaintenanceResult struct {
+	StartedAt           time.Time `json:"startedAt"`
+	DurationMs          int64     `json:"durationMs"`
+	Checkpointed        bool      `json:"checkpointed"`
+	Vacuumed            bool      `json:"vacuumed"`
+	Analyzed            bool      `json:"analyzed"`
+	DatabaseBytesBefore int64     `json:"databaseBytesBefore"`
+	DatabaseBytesAfter  int64     `json:"databaseBytesAfter"`
+	WALBytesBefore      int64     `json:"walBytesBefore"`
+	WALBytesAfter       int64     `json:"walBytesAfter"`
+	FreePagesBefore     int64     `json:"freePagesBefore"`
+	FreePagesAfter      int64     `json:"freePagesAfter"`
+	ReclaimedBytes      int64     `json:"reclaimedBytes"`
+}
+
+// BatchStats reports throughput and latency of batched email writes.
+// Latency is measured from SaveEmail being called to the batch committing.
+type BatchStats struct {
+	Batches         int64   `json:"batches"`
+	FailedBatches   int64   `json:"failedBatches"`
+	Emails          int64   `json:"emails"`
+	FailedEmails    int64   `json:"failedEmails"`
+	MaxBatchSize    int     `json:"maxBatchSize"`
+	AvgBatchSize    float64 `json:"avgBatchSize"`
+	AvgLatencyMs    float64 `json:"avgLatencyMs"`
+	MaxLatencyMs    float64 `json:"maxLatencyMs"`
+	EmailsPerSecond float64 `json:"emailsPerSecond"`
+}
+
+// BackupInfo describes a database backup artifact
+type BackupInfo struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// previewLength is the number of characters in an email preview
+const previewLength = 200
+
+// makePreview returns the start of a plain-text body with whitespace
+// collapsed, cut at previewLength characters
+func makePreview(body string) string {
+	preview := strings.Join(strings.Fields(body), " ")
+	if utf8.RuneCountInString(preview) <= previewLength {
+		return preview
+	}
+	runes := []rune(preview)
+	return strings.TrimRight(string(runes[:previewLength]), " ") + "…"
 }
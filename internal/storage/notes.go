@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+)
+
+// ListNotes returns the notes on an email, oldest first
+func (s *SQLiteStorage) ListNotes(emailID int64) ([]*Note, error) {
+	if err := s.checkEmailExists(emailID); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.reader.Query(`
+		SELECT id, email_id, author, body, created_at, updated_at
+		FROM notes WHERE email_id = ? ORDER BY created_at, id
+	`, emailID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := []*Note{}
+	for rows.Next() {
+		var note Note
+		if err := rows.Scan(&note.ID, &note.EmailID, &note.Author, &note.Body, &note.CreatedAt, &note.UpdatedAt); err != nil {
+			return nil, err
+		}
+		notes = append(notes, &note)
+	}
+	return notes, rows.Err()
+}
+
+// CreateNote stores a new note and sets its ID and times
+func (s *SQLiteStorage) CreateNote(note *Note) error {
+	if err := s.checkEmailExists(note.EmailID); err != nil {
+		return err
+	}
+
+	note.CreatedAt = time.Now()
+	note.UpdatedAt = note.CreatedAt
+	result, err := s.db.Exec(`
+		INSERT INTO notes (email_id, author, body, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, note.EmailID, note.Author, note.Body, note.CreatedAt, note.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	note.ID, err = result.LastInsertId()
+	return err
+}
+
+// UpdateNote replaces the body of a note, and its author if one is given
+func (s *SQLiteStorage) UpdateNote(note *Note) error {
+	note.UpdatedAt = time.Now()
+	result, err := s.db.Exec(`
+		UPDATE notes SET body = ?, author = CASE WHEN ? = '' THEN author ELSE ? END, updated_at = ?
+		WHERE id = ? AND email_id = ?
+	`, note.Body, note.Author, note.Author, note.UpdatedAt, note.ID, note.EmailID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	return s.reader.QueryRow("SELECT author, created_at FROM notes WHERE id = ?", note.ID).
+		Scan(&note.Author, &note.CreatedAt)
+}
+
+// DeleteNote deletes a note from an email
+func (s *SQLiteStorage) DeleteNote(emailID, id int64) error {
+	result, err := s.db.Exec("DELETE FROM notes WHERE id = ? AND email_id = ?", id, emailID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// checkEmailExists returns ErrNotFound if there is no email with the ID
+func (s *SQLiteStorage) checkEmailExists(id int64) error {
+	var exists int
+	err := s.reader.QueryRow("SELECT 1 FROM emails WHERE id = ?", id).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	return err
+}
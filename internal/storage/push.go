@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// pushColumns are the columns scanned by scanPushSubscription
+const pushColumns = "id, address, type, topic, token, endpoint, p256dh, auth, created_at"
+
+// CreatePushSubscription stores a push subscription and sets its ID and
+// creation time. A browser subscribing again, or a topic subscribed to
+// again, replaces the credentials of the existing subscription.
+func (s *SQLiteStorage) CreatePushSubscription(sub *PushSubscription) error {
+	sub.Address = strings.ToLower(sub.Address)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
+		SELECT id, created_at FROM push_subscriptions
+		WHERE address = ? AND type = ? AND topic = ? AND endpoint = ?
+	`, sub.Address, sub.Type, sub.Topic, sub.Endpoint).Scan(&sub.ID, &sub.CreatedAt)
+	switch err {
+	case nil:
+		_, err = tx.Exec(`
+			UPDATE push_subscriptions SET token = ?, p256dh = ?, auth = ? WHERE id = ?
+		`, sub.Token, sub.P256DH, sub.Auth, sub.ID)
+	case sql.ErrNoRows:
+		sub.CreatedAt = time.Now()
+		var result sql.Result
+		result, err = tx.Exec(`
+			INSERT INTO push_subscriptions (address, type, topic, token, endpoint, p256dh, auth, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, sub.Address, sub.Type, sub.Topic, sub.Token, sub.Endpoint, sub.P256DH, sub.Auth, sub.CreatedAt)
+		if err == nil {
+			sub.ID, err = result.LastInsertId()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListPushSubscriptions returns the push subscriptions of an address, or
+// all of them for "", oldest first
+func (s *SQLiteStorage) ListPushSubscriptions(address string) ([]*PushSubscription, error) {
+	query, args := "SELECT "+pushColumns+" FROM push_subscriptions", []interface{}{}
+	if address != "" {
+		query += " WHERE address = ?"
+		args = append(args, strings.ToLower(address))
+	}
+	rows, err := s.reader.Query(query+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []*PushSubscription{}
+	for rows.Next() {
+		sub, err := scanPushSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// GetPushSubscription returns a push subscription by ID
+func (s *SQLiteStorage) GetPushSubscription(id int64) (*PushSubscription, error) {
+	row := s.reader.QueryRow("SELECT "+pushColumns+" FROM push_subscriptions WHERE id = ?", id)
+	sub, err := scanPushSubscription(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return sub, err
+}
+
+// DeletePushSubscription deletes a push subscription
+func (s *SQLiteStorage) DeletePushSubscription(id int64) error {
+	result, err := s.db.Exec("DELETE FROM push_subscriptions WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func scanPushSubscription(row rowScanner) (*PushSubscription, error) {
+	var sub PushSubscription
+	err := row.Scan(&sub.ID, &sub.Address, &sub.Type, &sub.Topic, &sub.Token,
+		&sub.Endpoint, &sub.P256DH, &sub.Auth, &sub.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
@@ -0,0 +1,447 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidSearch is returned for searches that cannot be run, such as
+// one that only excludes terms
+var ErrInvalidSearch = errors.New("invalid search query")
+
+var errExcludesOnly = fmt.Errorf("%w: a search cannot only exclude terms", ErrInvalidSearch)
+
+// SearchQuery is a full-text search. Text is searched in the subject, the
+// addresses and the plain-text body, and Subject and Body in those alone,
+// in the syntax of parseSearch. Header matches emails with that header, and
+// HeaderValue those with a value of it containing the text, ignoring case.
+// The fields that are set must all match.
+type SearchQuery struct {
+	Text        string
+	Subject     string
+	Body        string
+	Header      string
+	HeaderValue string
+}
+
+// searchColumns are the columns of emails_fts, which the fallback without
+// FTS5 searches with LIKE, and the field: prefixes that restrict a term to
+// one of them
+var (
+	searchColumns = []string{"subject", "from_address", "to_addresses", "body_plain"}
+	searchFields  = map[string]string{"subject": "subject", "from": "from_address", "to": "to_addresses", "body": "body_plain"}
+)
+
+// searchNode is a parsed search: a term, or a group of nodes that must all
+// (and) or any (or) match
+type searchNode struct {
+	op       string // "term", "and" or "or"
+	text     string // the words of a term, matched as a phrase
+	prefix   bool   // a term ending in *, matching words starting with it
+	column   string // the column a term is restricted to, "" for all
+	negated  bool
+	children []*searchNode
+}
+
+// ValidateSearch returns an ErrInvalidSearch for a search in the syntax of
+// parseSearch that cannot be run
+func ValidateSearch(input string) error {
+	_, err := parseSearch(input)
+	return err
+}
+
+// parseSearch parses a search as users type it. Words must all match, in
+// any order and ignoring case; "quoted words" must match as a phrase, and a
+// word ending in * matches the words starting with it. OR between terms
+// matches either, and parentheses group them. A term or group preceded by
+// - or NOT must not match. subject:, from:, to: and body: restrict a term
+// or a group to one field. Other punctuation is taken as text and unmatched
+// parentheses are ignored, so any input can be searched; a search that
+// only excludes terms is an ErrInvalidSearch.
+func parseSearch(input string) (*searchNode, error) {
+	p := &searchParser{tokens: tokenizeSearch(input)}
+	node := p.parseOr("")
+	if err := node.check(); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// searchToken is a word, a quoted phrase or a parenthesis, with its - and
+// field: prefixes. Operators are words the parser recognizes.
+type searchToken struct {
+	text    string
+	quoted  bool
+	open    bool // (
+	close   bool // )
+	negated bool
+	column  string
+}
+
+// tokenizeSearch splits a search into words, phrases and parentheses
+func tokenizeSearch(input string) []searchToken {
+	var tokens []searchToken
+	var next searchToken // the prefixes of the next phrase or group
+	for i := 0; i < len(input); {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			next = searchToken{}
+			i++
+		case c == '(':
+			next.open = true
+			tokens = append(tokens, next)
+			next = searchToken{}
+			i++
+		case c == ')':
+			tokens = append(tokens, searchToken{close: true})
+			next = searchToken{}
+			i++
+		case c == '"':
+			end := strings.IndexByte(input[i+1:], '"')
+			if end < 0 {
+				end = len(input) - i - 1
+			}
+			next.text, next.quoted = input[i+1:i+1+end], true
+			tokens = append(tokens, next)
+			next = searchToken{}
+			i += end + 2
+		default:
+			end := i
+			for end < len(input) && !strings.ContainsRune(" \t\r\n()\"", rune(input[end])) {
+				end++
+			}
+			t := searchToken{text: input[i:end]}
+			i = end
+			if t.text == "-" && i < len(input) && (input[i] == '"' || input[i] == '(') {
+				next = searchToken{negated: true}
+				continue
+			}
+			if len(t.text) > 1 && t.text[0] == '-' {
+				t.negated, t.text = true, t.text[1:]
+			}
+			if field, rest, ok := strings.Cut(t.text, ":"); ok {
+				if column, ok := searchFields[strings.ToLower(field)]; ok {
+					if rest == "" && i < len(input) && (input[i] == '"' || input[i] == '(') {
+						// A prefix of the phrase or group that follows
+						next = searchToken{negated: t.negated, column: column}
+						continue
+					}
+					if rest != "" {
+						t.text, t.column = rest, column
+					}
+				}
+			}
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+type searchParser struct {
+	tokens []searchToken
+	pos    int
+	depth  int // of the groups being parsed
+}
+
+func (p *searchParser) peek() *searchToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+// parseOr parses terms separated by OR, up to a closing parenthesis or the
+// end, restricted to column if it is set
+func (p *searchParser) parseOr(column string) *searchNode {
+	or := &searchNode{op: "or"}
+	for {
+		and := p.parseAnd(column)
+		if len(and.children) > 0 {
+			or.children = append(or.children, and)
+		}
+		t := p.peek()
+		if t == nil || t.close {
+			break
+		}
+		p.pos++ // OR
+	}
+	if len(or.children) == 1 {
+		return or.children[0]
+	}
+	return or
+}
+
+// parseAnd parses terms that must all match, up to OR, a closing
+// parenthesis or the end. AND between them is optional.
+func (p *searchParser) parseAnd(column string) *searchNode {
+	and := &searchNode{op: "and"}
+	negated := false
+	for t := p.peek(); t != nil; t = p.peek() {
+		if t.close && p.depth == 0 {
+			p.pos++
+			continue // a ) without its (
+		}
+		if t.close || (!t.quoted && !t.negated && t.column == "" && t.text == "OR") {
+			break
+		}
+		p.pos++
+		if !t.quoted && !t.negated && t.column == "" {
+			switch t.text {
+			case "AND":
+				continue
+			case "NOT":
+				negated = !negated
+				continue
+			}
+		}
+
+		col := column
+		if t.column != "" {
+			col = t.column
+		}
+		var node *searchNode
+		if t.open {
+			p.depth++
+			node = p.parseOr(col)
+			p.depth--
+			if t := p.peek(); t != nil && t.close {
+				p.pos++
+			}
+			if node.op != "term" && len(node.children) == 0 {
+				negated = false
+				continue // ()
+			}
+		} else {
+			node = &searchNode{op: "term", text: t.text, column: col}
+			if !t.quoted && strings.HasSuffix(t.text, "*") {
+				node.text, node.prefix = strings.TrimRight(t.text, "*"), true
+			}
+			if !hasWord(node.text) {
+				negated = false
+				continue // punctuation, which FTS5 does not index
+			}
+		}
+		node.negated, negated = negated != t.negated, false
+		and.children = append(and.children, node)
+	}
+	return and
+}
+
+// hasWord reports whether text has a letter or digit to search for
+func hasWord(text string) bool {
+	return strings.IndexFunc(text, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }) >= 0
+}
+
+// check returns an ErrInvalidSearch for a search that is empty, or with a
+// group that only excludes terms, which FTS5 cannot run
+func (n *searchNode) check() error {
+	switch n.op {
+	case "term":
+		if n.negated {
+			return errExcludesOnly
+		}
+		return nil
+	case "and":
+		if len(n.children) == 0 {
+			return fmt.Errorf("%w: the search has no words", ErrInvalidSearch)
+		}
+		positive := false
+		for _, child := range n.children {
+			if !child.negated {
+				positive = true
+				if err := child.check(); err != nil {
+					return err
+				}
+			} else if child.op != "term" {
+				if err := (&searchNode{op: child.op, children: child.children}).check(); err != nil {
+					return err
+				}
+			}
+		}
+		if !positive {
+			return errExcludesOnly
+		}
+		return nil
+	default:
+		if len(n.children) == 0 {
+			return fmt.Errorf("%w: the search has no words", ErrInvalidSearch)
+		}
+		if n.negated {
+			return errExcludesOnly
+		}
+		for _, child := range n.children {
+			if err := child.check(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// fts renders the node as an FTS5 query, with every term quoted so that
+// FTS5 takes none of its text for syntax
+func (n *searchNode) fts() string {
+	switch n.op {
+	case "term":
+		phrase := `"` + strings.ReplaceAll(n.text, `"`, `""`) + `"`
+		if n.prefix {
+			phrase += "*"
+		}
+		if n.column != "" {
+			phrase = n.column + " : " + phrase
+		}
+		return phrase
+	case "and":
+		var positive, negative []string
+		for _, child := range n.children {
+			if child.negated {
+				negative = append(negative, child.unnegated().fts())
+			} else {
+				positive = append(positive, child.fts())
+			}
+		}
+		query := "(" + strings.Join(positive, " AND ") + ")"
+		for _, term := range negative {
+			query = "(" + query + " NOT " + term + ")"
+		}
+		return query
+	default:
+		parts := make([]string, len(n.children))
+		for i, child := range n.children {
+			parts[i] = child.fts()
+		}
+		return "(" + strings.Join(parts, " OR ") + ")"
+	}
+}
+
+// unnegated returns a copy of the node that is not negated
+func (n *searchNode) unnegated() *searchNode {
+	c := *n
+	c.negated = false
+	return &c
+}
+
+// like renders the node as SQL conditions matching its terms as parts of
+// the searched columns with LIKE, for databases without FTS5
+func (n *searchNode) like() (string, []interface{}) {
+	var condition string
+	var args []interface{}
+	switch n.op {
+	case "term":
+		columns := searchColumns
+		if n.column != "" {
+			columns = []string{n.column}
+		}
+		parts := make([]string, len(columns))
+		for i, column := range columns {
+			parts[i] = column + ` LIKE ? ESCAPE '\'`
+			args = append(args, likePattern(n.text))
+		}
+		condition = "(" + strings.Join(parts, " OR ") + ")"
+	default:
+		separator := " AND "
+		if n.op == "or" {
+			separator = " OR "
+		}
+		parts := make([]string, len(n.children))
+		for i, child := range n.children {
+			var childArgs []interface{}
+			parts[i], childArgs = child.like()
+			args = append(args, childArgs...)
+		}
+		condition = "(" + strings.Join(parts, separator) + ")"
+	}
+	if n.negated {
+		condition = "NOT " + condition
+	}
+	return condition, args
+}
+
+// terms returns the text of the terms that must or may match, for
+// highlighting them
+func (n *searchNode) terms() []string {
+	if n.negated {
+		return nil
+	}
+	if n.op == "term" {
+		return []string{n.text}
+	}
+	var terms []string
+	for _, child := range n.children {
+		terms = append(terms, child.terms()...)
+	}
+	return terms
+}
+
+// parse parses the text fields of the query into one node, nil when they
+// are all empty
+func (q *SearchQuery) parse() (*searchNode, error) {
+	and := &searchNode{op: "and"}
+	for _, field := range []struct{ text, column string }{
+		{q.Text, ""},
+		{q.Subject, "subject"},
+		{q.Body, "body_plain"},
+	} {
+		if strings.TrimSpace(field.text) == "" {
+			continue
+		}
+		node, err := parseSearch(field.text)
+		if err != nil {
+			return nil, err
+		}
+		if field.column != "" {
+			node.restrict(field.column)
+		}
+		and.children = append(and.children, node)
+	}
+	switch len(and.children) {
+	case 0:
+		return nil, nil
+	case 1:
+		return and.children[0], nil
+	}
+	return and, nil
+}
+
+// restrict restricts the terms of the node to column
+func (n *searchNode) restrict(column string) {
+	n.column = column
+	for _, child := range n.children {
+		child.restrict(column)
+	}
+}
+
+// searchCondition returns the condition matching emails to a parsed
+// search, and its arguments
+func (s *SQLiteStorage) searchCondition(node *searchNode) (string, []interface{}) {
+	if s.hasFTS5 {
+		return " AND id IN (SELECT rowid FROM emails_fts WHERE emails_fts MATCH ?)", []interface{}{node.fts()}
+	}
+	condition, args := node.like()
+	return " AND " + condition, args
+}
+
+// headerCondition returns the condition on the header of a query, and its
+// arguments, or "" when the query has none. Header names are stored
+// canonicalized, as net/textproto does.
+func (q *SearchQuery) headerCondition() (string, []interface{}) {
+	if q.Header == "" {
+		return "", nil
+	}
+	key := textproto.CanonicalMIMEHeaderKey(q.Header)
+	if q.HeaderValue == "" {
+		return " AND EXISTS (SELECT 1 FROM json_each(emails.headers) WHERE key = ?)", []interface{}{key}
+	}
+	return ` AND EXISTS (SELECT 1 FROM json_each(emails.headers) AS h, json_each(h.value) AS v WHERE h.key = ? AND v.value LIKE ? ESCAPE '\')`,
+		[]interface{}{key, likePattern(q.HeaderValue)}
+}
+
+// likePattern returns a LIKE pattern matching text as a part of a value,
+// with the wildcards of text escaped for ESCAPE '\'
+func likePattern(text string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text) + "%"
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSearch(t *testing.T) {
+	s := newTestStorage(t)
+	for _, tc := range []struct {
+		input string
+		want  string // as FTS5 renders it, "" for an ErrInvalidSearch
+	}{
+		{"hello world", `("hello" AND "world")`},
+		{"Hello AND world", `("Hello" AND "world")`},
+		{"a OR b c", `(("a") OR ("b" AND "c"))`},
+		{`"quoted words" invoice*`, `("quoted words" AND "invoice"*)`},
+
+		// Unbalanced quotes and parentheses
+		{`"unbalanced phrase`, `("unbalanced phrase")`},
+		{`"a""b"`, `("a" AND "b")`},
+		{"(a OR b", `((("a") OR ("b")))`},
+		{"((a", `((("a")))`},
+		{"a) b", `("a" AND "b")`},
+		{"()", ""},
+		{`"" a`, `("a")`},
+
+		// NOT and -
+		{"NOT", ""},
+		{"NOT a", ""},
+		{"-a", ""},
+		{"a NOT", `("a")`},
+		{"a NOT b", `(("a") NOT "b")`},
+		{"a -b", `(("a") NOT "b")`},
+		{"NOT NOT a", `("a")`},
+		{"a AND NOT (b OR c)", `(("a") NOT (("b") OR ("c")))`},
+		{"-(a b)", ""},
+		{`a -"x y" -(b OR c)`, `((("a") NOT "x y") NOT (("b") OR ("c")))`},
+		{"a - b", `("a" AND "b")`},
+		{"a (b -c -d)", `("a" AND ((("b") NOT "c") NOT "d"))`},
+		{"a (-b)", ""},
+
+		// FTS5 syntax is taken as text
+		{"NEAR(a b)", `("NEAR" AND ("a" AND "b"))`},
+		{"a+b ^c", `("a+b" AND "^c")`},
+		{"{a b}:c", `("{a" AND "b}:c")`},
+		{`"a OR b"`, `("a OR b")`},
+		{"a or b", `("a" AND "or" AND "b")`},
+		{"OR", ""},
+		{"a OR", `("a")`},
+		{"x AND", `("x")`},
+		{": - *", ""},
+
+		// Field prefixes
+		{"FROM:alice", `(from_address : "alice")`},
+		{`subject:(a OR b) -body:"x y"`, `((((subject : "a") OR (subject : "b"))) NOT body_plain : "x y")`},
+		{"-subject:(a b) c", `(("c") NOT (subject : "a" AND subject : "b"))`},
+		{"foo:bar", `("foo:bar")`},
+		{"cc:(a b)", `("cc:" AND ("a" AND "b"))`},
+		{`col:"x`, `("col:" AND "x")`},
+	} {
+		node, err := parseSearch(tc.input)
+		if tc.want == "" {
+			if !errors.Is(err, ErrInvalidSearch) {
+				t.Errorf("%q: got %v, want an invalid search", tc.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.input, err)
+			continue
+		}
+		if got := node.fts(); got != tc.want {
+			t.Errorf("%q: got %s, want %s", tc.input, got, tc.want)
+		}
+
+		// FTS5 accepts what is rendered
+		if s.hasFTS5 {
+			if _, err := s.reader.Exec("SELECT rowid FROM emails_fts WHERE emails_fts MATCH ?", node.fts()); err != nil {
+				t.Errorf("%q: FTS5: %v", tc.input, err)
+			}
+		}
+	}
+}
+
+func TestSearchFTSQuoting(t *testing.T) {
+	for _, tc := range []struct {
+		node *searchNode
+		want string
+	}{
+		{&searchNode{op: "term", text: `say "hi"`}, `"say ""hi"""`},
+		{&searchNode{op: "term", text: `a"`, prefix: true, column: "subject"}, `subject : "a"""*`},
+	} {
+		if got := tc.node.fts(); got != tc.want {
+			t.Errorf("%q: got %s, want %s", tc.node.text, got, tc.want)
+		}
+	}
+}
+
+func TestSearchLike(t *testing.T) {
+	// anyColumn is the condition on a term that is not restricted to a
+	// column
+	anyColumn := "(" + strings.Join([]string{
+		`subject LIKE ? ESCAPE '\'`,
+		`from_address LIKE ? ESCAPE '\'`,
+		`to_addresses LIKE ? ESCAPE '\'`,
+		`body_plain LIKE ? ESCAPE '\'`,
+	}, " OR ") + ")"
+	// inAll repeats a pattern for each searched column
+	inAll := func(patterns ...string) []interface{} {
+		var args []interface{}
+		for _, p := range patterns {
+			args = append(args, p, p, p, p)
+		}
+		return args
+	}
+
+	for _, tc := range []struct {
+		input     string
+		condition string
+		args      []interface{}
+	}{
+		{"hello", "(" + anyColumn + ")", inAll("%hello%")},
+		{"a -b", "(" + anyColumn + " AND NOT " + anyColumn + ")", inAll("%a%", "%b%")},
+		{"a OR b", "((" + anyColumn + ") OR (" + anyColumn + "))", inAll("%a%", "%b%")},
+		{"invoice*", "(" + anyColumn + ")", inAll("%invoice%")},
+
+		// Wildcards are escaped
+		{"50% off_x", "(" + anyColumn + " AND " + anyColumn + ")", inAll(`%50\%%`, `%off\_x%`)},
+		{`a\b`, "(" + anyColumn + ")", inAll(`%a\\b%`)},
+		{`"100% _sure_"`, "(" + anyColumn + ")", inAll(`%100\% \_sure\_%`)},
+
+		// Field prefixes, and unknown ones taken as text
+		{"from:alice", `((from_address LIKE ? ESCAPE '\'))`, []interface{}{"%alice%"}},
+		{`subject:(a b) -body:"x_y"`,
+			`(((subject LIKE ? ESCAPE '\') AND (subject LIKE ? ESCAPE '\')) AND NOT (body_plain LIKE ? ESCAPE '\'))`,
+			[]interface{}{"%a%", "%b%", `%x\_y%`}},
+		{"foo:bar", "(" + anyColumn + ")", inAll("%foo:bar%")},
+	} {
+		node, err := parseSearch(tc.input)
+		if err != nil {
+			t.Errorf("%q: %v", tc.input, err)
+			continue
+		}
+		condition, args := node.like()
+		if condition != tc.condition {
+			t.Errorf("%q: got %s, want %s", tc.input, condition, tc.condition)
+		}
+		if !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("%q: got args %q, want %q", tc.input, args, tc.args)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// Kinds of recipients in the email_recipients table
+const (
+	recipientTo       = "to"
+	recipientCC       = "cc"
+	recipientBCC      = "bcc"
+	recipientEnvelope = "envelope"
+)
+
+// mailboxKinds are the kinds of recipients an email is delivered to: its
+// envelope recipients, and the To header of emails stored before the
+// envelope was kept
+const mailboxKinds = `kind IN ('` + recipientTo + `', '` + recipientEnvelope + `')`
+
+// mailboxEmailIDs selects the IDs of the emails delivered to a mailbox,
+// matching the address case-insensitively
+const mailboxEmailIDs = `SELECT DISTINCT email_id FROM email_recipients WHERE address = lower(?) AND ` + mailboxKinds
+
+// insertRecipients indexes the recipients of an email within tx. Addresses
+// are lower-cased by SQLite, as they are when the table is filled by its
+// migration and when it is queried. Envelope recipients are normalized to
+// their mailbox as SetAddresses says.
+func (s *SQLiteStorage) insertRecipients(tx *sql.Tx, emailID int64, email *Email) error {
+	for _, r := range []struct {
+		kind      string
+		addresses []string
+	}{
+		{recipientTo, email.To},
+		{recipientCC, email.CC},
+		{recipientBCC, email.BCC},
+		{recipientEnvelope, email.EnvelopeTo},
+	} {
+		for _, address := range r.addresses {
+			if address = strings.TrimSpace(address); address == "" {
+				continue
+			}
+			var mailbox, subaddress interface{}
+			if r.kind == recipientEnvelope {
+				mailbox, subaddress = normalizeAddress(address, s.addresses)
+			}
+			_, err := tx.Exec("INSERT OR IGNORE INTO email_recipients (address, kind, email_id, size, mailbox, subaddress) VALUES (lower(?), ?, ?, ?, ?, ?)",
+				address, r.kind, emailID, email.Size, mailbox, subaddress)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recipientCondition returns the filter condition on recipients of a kind,
+// and its argument. A whole address is looked up exactly, ignoring case;
+// anything else, such as a domain, matches as a part of an address, with
+// % and _ taken literally.
+func recipientCondition(kind, value string) (string, interface{}) {
+	if isAddress(value) {
+		return " AND id IN (SELECT email_id FROM email_recipients WHERE address = lower(?) AND kind = '" + kind + "')", value
+	}
+	return " AND id IN (SELECT email_id FROM email_recipients WHERE address LIKE ? ESCAPE '\\' AND kind = '" + kind + "')", likePattern(value)
+}
+
+// addressCondition returns the filter condition on an address column, and
+// its argument, matching as recipientCondition does
+func addressCondition(column, value string) (string, interface{}) {
+	if isAddress(value) {
+		return " AND " + column + " = ? COLLATE NOCASE", value
+	}
+	return " AND " + column + " LIKE ? ESCAPE '\\'", likePattern(value)
+}
+
+// isAddress reports whether value is a whole email address rather than a
+// part of one: it has text on both sides of a single @, and no spaces,
+// commas, angle brackets or quotes
+func isAddress(value string) bool {
+	local, domain, ok := strings.Cut(value, "@")
+	return ok && local != "" && domain != "" &&
+		!strings.ContainsAny(value, " ,<>\"") && !strings.Contains(domain, "@")
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+// newTestStorage opens a database in a temporary directory
+func newTestStorage(t *testing.T) *SQLiteStorage {
+	t.Helper()
+	s, err := NewSQLiteStorage(&config.StorageConfig{Path: filepath.Join(t.TempDir(), "test.db")}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestRecipientFilters(t *testing.T) {
+	s := newTestStorage(t)
+	for i, e := range []*Email{
+		{From: "a_b@example.com", To: []string{"x_y@example.com"}, EnvelopeTo: []string{"100%@example.com"}},
+		{From: "axb@example.com", To: []string{"xzy@example.com"}, EnvelopeTo: []string{"1000@example.com"}},
+		{From: `a\b@example.org`, To: []string{"Alice@Example.org"}, EnvelopeTo: []string{"bob@example.org"}},
+	} {
+		e.MessageID = fmt.Sprintf("<%d@example.com>", i)
+		e.ReceivedAt = time.Now()
+		if _, err := s.SaveEmail(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		filter EmailFilter
+		want   []string
+	}{
+		// % and _ are not wildcards
+		{EmailFilter{From: "a_b"}, []string{"<0@example.com>"}},
+		{EmailFilter{To: "x_y"}, []string{"<0@example.com>"}},
+		{EmailFilter{EnvelopeTo: "100%"}, []string{"<0@example.com>"}},
+		{EmailFilter{EnvelopeTo: "%"}, []string{"<0@example.com>"}},
+		{EmailFilter{From: `a\b`}, []string{"<2@example.com>"}},
+		// Parts of addresses match ignoring case, whole ones exactly
+		{EmailFilter{To: "EXAMPLE.COM"}, []string{"<0@example.com>", "<1@example.com>"}},
+		{EmailFilter{To: "alice@example.org"}, []string{"<2@example.com>"}},
+		{EmailFilter{To: "lice@example.org"}, nil},
+		{EmailFilter{EnvelopeTo: "Bob@Example.org"}, []string{"<2@example.com>"}},
+	} {
+		result, err := s.ListEmails(&tc.filter, 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range result.Emails {
+			got = append(got, e.MessageID)
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%+v: got %v, want %v", tc.filter, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gowebmail/internal/config"
+)
+
+var (
+	// ErrSchemaTooNew is returned when a backup was created by a newer version
+	ErrSchemaTooNew = errors.New("backup schema is newer than this version supports")
+	// ErrDatabaseExists is returned when restoring over an existing database without force
+	ErrDatabaseExists = errors.New("database already exists")
+)
+
+// SchemaVersion returns the schema version written by this build
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// ValidateBackup checks that path is a readable gowebmail database this
+// build can open, returning its schema version
+func ValidateBackup(path string) (int, error) {
+	if _, err := os.Stat(path); err != nil {
+		return 0, err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, fmt.Errorf("failed to open backup: %w", err)
+	}
+	defer db.Close()
+
+	var integrity string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&integrity); err != nil {
+		return 0, fmt.Errorf("failed to read backup: %w", err)
+	}
+	if integrity != "ok" {
+		return 0, fmt.Errorf("backup failed integrity check: %s", integrity)
+	}
+
+	for _, table := range []string{"emails", "attachments"} {
+		var name string
+		err := db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&name)
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf("backup is missing the %s table", table)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	if version > SchemaVersion() {
+		return version, fmt.Errorf("%w (backup %d, supported %d)", ErrSchemaTooNew, version, SchemaVersion())
+	}
+
+	return version, nil
+}
+
+// RestoreBackup validates src and copies it into place as the database
+// configured in cfg. Existing databases are only replaced when force is set.
+// Pending migrations are applied the next time the storage is opened.
+func RestoreBackup(src string, cfg *config.StorageConfig, force bool) (int, error) {
+	version, err := ValidateBackup(src)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(cfg.Path); err == nil && !force {
+		return 0, fmt.Errorf("%w: %s", ErrDatabaseExists, cfg.Path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	// Copy to a temporary file first so a failed copy leaves nothing behind
+	tmp := cfg.Path + ".restore"
+	if err := copyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return 0, fmt.Errorf("failed to copy backup: %w", err)
+	}
+
+	// Stale WAL files belong to the database being replaced
+	os.Remove(cfg.Path + "-wal")
+	os.Remove(cfg.Path + "-shm")
+
+	if err := os.Rename(tmp, cfg.Path); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// copyFile copies the contents of src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
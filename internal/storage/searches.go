@@ -0,0 +1,139 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// CreateSavedSearch stores a new saved search and sets its ID and times
+func (s *SQLiteStorage) CreateSavedSearch(search *SavedSearch) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkSearchName(tx, search.Name, 0); err != nil {
+		return err
+	}
+
+	criteria, _ := json.Marshal(search.SearchCriteria)
+	search.CreatedAt = time.Now()
+	search.UpdatedAt = search.CreatedAt
+	result, err := tx.Exec(`
+		INSERT INTO saved_searches (name, criteria, created_at, updated_at)
+		VALUES (?, ?, ?, ?)
+	`, search.Name, string(criteria), search.CreatedAt, search.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if search.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListSavedSearches returns all saved searches ordered by name
+func (s *SQLiteStorage) ListSavedSearches() ([]*SavedSearch, error) {
+	rows, err := s.reader.Query("SELECT id, name, criteria, created_at, updated_at FROM saved_searches ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	searches := []*SavedSearch{}
+	for rows.Next() {
+		search, err := scanSavedSearch(rows)
+		if err != nil {
+			return nil, err
+		}
+		searches = append(searches, search)
+	}
+	return searches, rows.Err()
+}
+
+// GetSavedSearch returns a saved search by ID
+func (s *SQLiteStorage) GetSavedSearch(id int64) (*SavedSearch, error) {
+	row := s.reader.QueryRow("SELECT id, name, criteria, created_at, updated_at FROM saved_searches WHERE id = ?", id)
+	search, err := scanSavedSearch(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return search, err
+}
+
+// UpdateSavedSearch replaces the name and criteria of a saved search
+func (s *SQLiteStorage) UpdateSavedSearch(search *SavedSearch) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := checkSearchName(tx, search.Name, search.ID); err != nil {
+		return err
+	}
+
+	criteria, _ := json.Marshal(search.SearchCriteria)
+	search.UpdatedAt = time.Now()
+	result, err := tx.Exec(`
+		UPDATE saved_searches SET name = ?, criteria = ?, updated_at = ? WHERE id = ?
+	`, search.Name, string(criteria), search.UpdatedAt, search.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	if err := tx.QueryRow("SELECT created_at FROM saved_searches WHERE id = ?", search.ID).Scan(&search.CreatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteSavedSearch deletes a saved search
+func (s *SQLiteStorage) DeleteSavedSearch(id int64) error {
+	result, err := s.db.Exec("DELETE FROM saved_searches WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// EmailMatches reports whether the email with the given ID matches filter
+func (s *SQLiteStorage) EmailMatches(id int64, filter *EmailFilter) (bool, error) {
+	conditions, args := s.filterConditions(filter)
+	var match int
+	err := s.reader.QueryRow("SELECT 1 FROM emails WHERE id = ?"+conditions, append([]interface{}{id}, args...)...).Scan(&match)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkSearchName returns ErrNameTaken if another saved search uses name
+func checkSearchName(tx *sql.Tx, name string, id int64) error {
+	var existing int64
+	err := tx.QueryRow("SELECT id FROM saved_searches WHERE name = ? AND id != ?", name, id).Scan(&existing)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return ErrNameTaken
+}
+
+func scanSavedSearch(row rowScanner) (*SavedSearch, error) {
+	var search SavedSearch
+	var criteria string
+	if err := row.Scan(&search.ID, &search.Name, &criteria, &search.CreatedAt, &search.UpdatedAt); err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(criteria), &search.SearchCriteria)
+	return &search, nil
+}
@@ -1,45 +1,90 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
 )
 
-// SQLiteStorage implements the Storage interface using SQLite
+// SQLiteStorage implements the Storage interface using SQLite. Writes go
+// through a single connection, db; queries use a pool of read-only
+// connections, reader, which WAL lets read while the writer writes.
 type SQLiteStorage struct {
-	db      *sql.DB
-	logger  zerolog.Logger
-	hasFTS5 bool
+	db          *sql.DB
+	reader      *sql.DB // db itself for in-memory databases
+	path        string
+	blobs       BlobStore
+	blobMu      sync.Mutex // serializes blob writes against orphan cleanup
+	written     []string   // external blobs written by the save in progress; guarded by blobMu
+	compression string
+	aead        cipher.AEAD // nil unless encryption at rest is enabled
+	logger      zerolog.Logger
+	hasFTS5     bool
+	cache       *readCache // nil when disabled
+	addresses   config.AddressesConfig
 }
 
 // NewSQLiteStorage creates a new SQLite storage instance
-func NewSQLiteStorage(dbPath string, logger zerolog.Logger) (*SQLiteStorage, error) {
+func NewSQLiteStorage(cfg *config.StorageConfig, logger zerolog.Logger) (*SQLiteStorage, error) {
+	dbPath := cfg.Path
+
 	// Ensure directory exists
 	dir := filepath.Dir(dbPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create database directory: %w", err)
 	}
 
+	switch cfg.Compression {
+	case "", "none", "gzip", "zstd":
+	default:
+		return nil, fmt.Errorf("unknown storage compression: %s", cfg.Compression)
+	}
+
+	aead, err := newAEAD(cfg.EncryptionKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+
+	blobs, err := NewBlobStore(&cfg.Blobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize blob store: %w", err)
+	}
+
 	// Open database
-	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_busy_timeout=5000")
+	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
 	// Set connection pool settings
-	db.SetMaxOpenConns(1) // SQLite works best with single connection
+	db.SetMaxOpenConns(1) // SQLite allows one writer at a time
 	db.SetMaxIdleConns(1)
 
 	storage := &SQLiteStorage{
-		db:     db,
-		logger: logger,
+		db:          db,
+		reader:      db,
+		path:        dbPath,
+		blobs:       blobs,
+		compression: cfg.Compression,
+		aead:        aead,
+		logger:      logger,
+		cache:       newReadCache(cfg.CacheSize),
 	}
 
 	// Initialize schema
@@ -47,8 +92,39 @@ func NewSQLiteStorage(dbPath string, logger zerolog.Logger) (*SQLiteStorage, err
 		db.Close()
 		return nil, fmt.Errorf("failed to initialize schema: %w", err)
 	}
+	if err := storage.loadAddresses(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to read address settings: %w", err)
+	}
+
+	if cfg.Maintenance.Enabled && cfg.Maintenance.IncrementalVacuum {
+		if err := storage.enableIncrementalVacuum(); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to enable incremental vacuum: %w", err)
+		}
+	}
+
+	// Opened once the schema exists. Each connection to :memory: would be
+	// a database of its own.
+	if cfg.ReadConnections > 0 && dbPath != ":memory:" {
+		reader, err := sql.Open("sqlite3", "file:"+dbPath+"?mode=ro&_busy_timeout=5000")
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to open database for reading: %w", err)
+		}
+		reader.SetMaxOpenConns(cfg.ReadConnections)
+		reader.SetMaxIdleConns(cfg.ReadConnections)
+		storage.reader = reader
+	}
 
-	logger.Info().Str("path", dbPath).Msg("SQLite storage initialized")
+	logger.Info().
+		Str("path", dbPath).
+		Str("blobs", cfg.Blobs.Type).
+		Str("compression", cfg.Compression).
+		Bool("encrypted", aead != nil).
+		Int("read_connections", cfg.ReadConnections).
+		Int64("cache_size", cfg.CacheSize).
+		Msg("SQLite storage initialized")
 
 	return storage, nil
 }
@@ -60,13 +136,57 @@ func (s *SQLiteStorage) initSchema() error {
 		return err
 	}
 
+	if err := s.migrate(); err != nil {
+		return fmt.Errorf("failed to apply migrations: %w", err)
+	}
+
+	// Insert triggers from before encrypted bodies were skipped indexed
+	// them as text
+	var trigger string
+	err := s.db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'trigger' AND name = 'emails_ai'").Scan(&trigger)
+	unindex := err == nil && !strings.Contains(trigger, "typeof")
+
 	// Try to create FTS5 schema (optional)
 	if _, err := s.db.Exec(fts5Schema); err != nil {
 		s.logger.Warn().Err(err).Msg("FTS5 not available, full-text search will use LIKE-based fallback")
 		s.hasFTS5 = false
-	} else {
-		s.logger.Info().Msg("FTS5 full-text search enabled")
-		s.hasFTS5 = true
+		return nil
+	}
+	s.logger.Info().Msg("FTS5 full-text search enabled")
+	s.hasFTS5 = true
+
+	if unindex {
+		if _, err := s.db.Exec(unindexEncrypted); err != nil {
+			return fmt.Errorf("failed to remove encrypted bodies from the search index: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrate applies any migrations newer than the database's user_version
+func (s *SQLiteStorage) migrate() error {
+	var version int
+	if err := s.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		s.logger.Info().Int("version", i+1).Msg("Applied database migration")
 	}
 
 	return nil
@@ -74,28 +194,144 @@ func (s *SQLiteStorage) initSchema() error {
 
 // SaveEmail saves an email to the database
 func (s *SQLiteStorage) SaveEmail(email *Email) (int64, error) {
-	tx, err := s.db.Begin()
+	ids, err := s.SaveEmails([]*Email{email})
 	if err != nil {
 		return 0, err
 	}
+	return ids[0], nil
+}
+
+// SaveEmails saves several emails in a single transaction. Either all of
+// them are saved or none is.
+func (s *SQLiteStorage) SaveEmails(emails []*Email) ([]int64, error) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	// External blobs are written before the transaction commits, so those
+	// of a failed save are deleted unless other emails refer to them
+	s.written = nil
+	ids, err := s.saveEmails(emails)
+	if err != nil {
+		s.deleteUnreferencedBlobs(s.written)
+	}
+	s.written = nil
+	return ids, err
+}
+
+// saveEmails saves emails in a single transaction. Callers must hold
+// blobMu.
+func (s *SQLiteStorage) saveEmails(emails []*Email) ([]int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
 	defer tx.Rollback()
 
+	ids := make([]int64, len(emails))
+	for i, email := range emails {
+		if ids[i], err = s.insertEmail(tx, email); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return ids, nil
+}
+
+// insertEmail inserts an email and its attachments within tx
+func (s *SQLiteStorage) insertEmail(tx *sql.Tx, email *Email) (int64, error) {
 	// Marshal JSON fields
 	toJSON, _ := json.Marshal(email.To)
 	ccJSON, _ := json.Marshal(email.CC)
 	bccJSON, _ := json.Marshal(email.BCC)
+	envelopeToJSON, _ := json.Marshal(email.EnvelopeTo)
+	tagsJSON, _ := json.Marshal(normalizeTags(email.Tags))
 	headersJSON, _ := json.Marshal(email.Headers)
 
+	spamScore, spamJSON, authJSON := checkColumns(email.Spam, email.Auth)
+	var calendarJSON sql.NullString
+	if email.Calendar != nil {
+		data, _ := json.Marshal(email.Calendar)
+		calendarJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	var securityJSON sql.NullString
+	if email.Security != nil {
+		data, _ := json.Marshal(email.Security)
+		securityJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	var unsubscribeJSON sql.NullString
+	if email.Unsubscribe != nil {
+		data, _ := json.Marshal(email.Unsubscribe)
+		unsubscribeJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	var replyToJSON sql.NullString
+	if len(email.ReplyTo) > 0 {
+		data, _ := json.Marshal(email.ReplyTo)
+		replyToJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	var sizesJSON sql.NullString
+	if email.SizeBreakdown != nil {
+		data, _ := json.Marshal(email.SizeBreakdown)
+		sizesJSON = sql.NullString{String: string(data), Valid: true}
+	}
+	var receivedJSON sql.NullString
+	if len(email.Received) > 0 {
+		data, _ := json.Marshal(email.Received)
+		receivedJSON = sql.NullString{String: string(data), Valid: true}
+	}
+
+	// Bodies are compressed and encrypted as configured. The plain-text
+	// body is never compressed since it feeds full-text search.
+	bodyPlain, err := s.encodeText(email.BodyPlain, false)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode body: %w", err)
+	}
+	bodyHTML, err := s.encodeText(email.BodyHTML, true)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode body: %w", err)
+	}
+	var bodyAMP interface{}
+	if email.BodyAMP != "" {
+		if bodyAMP, err = s.encodeText(email.BodyAMP, true); err != nil {
+			return 0, fmt.Errorf("failed to encode body: %w", err)
+		}
+	}
+
+	if email.ThreadID == "" {
+		if email.ThreadID, err = threadIDTx(tx, email); err != nil {
+			return 0, fmt.Errorf("failed to assign thread: %w", err)
+		}
+	}
+
+	// Raw message is stored content-addressed like attachments
+	rawHash, err := s.putPayload(tx, email.Raw, email.RawSpool)
+	if err != nil {
+		return 0, fmt.Errorf("failed to store raw message: %w", err)
+	}
+
 	// Insert email
+	email.UpdatedAt = time.Now()
 	result, err := tx.Exec(`
 		INSERT INTO emails (
 			message_id, from_address, to_addresses, cc_addresses, bcc_addresses,
-			subject, body_plain, body_html, headers, size, received_at, read
-		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+			subject, body_plain, body_html, headers, size, received_at, read,
+			raw_hash, envelope_from, envelope_to, tags, pinned, thread_id, updated_at,
+			spam_score, spam, auth, calendar, security, received_hops, missing_alternative,
+			unsubscribe, body_amp, reply_to, sender, return_path, priority, size_breakdown
+		) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`,
 		email.MessageID, email.From, string(toJSON), string(ccJSON), string(bccJSON),
-		email.Subject, email.BodyPlain, email.BodyHTML, string(headersJSON),
+		email.Subject, bodyPlain, bodyHTML, string(headersJSON),
 		email.Size, email.ReceivedAt, email.Read,
+		rawHash, email.EnvelopeFrom, string(envelopeToJSON), string(tagsJSON), email.Pinned,
+		email.ThreadID, email.UpdatedAt.UnixMilli(),
+		spamScore, spamJSON, authJSON, calendarJSON, securityJSON, receivedJSON,
+		sql.NullString{String: email.MissingAlternative, Valid: email.MissingAlternative != ""},
+		unsubscribeJSON, bodyAMP, replyToJSON, email.Sender, email.ReturnPath,
+		sql.NullString{String: email.Priority, Valid: email.Priority != ""}, sizesJSON,
 	)
 	if err != nil {
 		return 0, err
@@ -108,246 +344,778 @@ func (s *SQLiteStorage) SaveEmail(email *Email) (int64, error) {
 
 	// Insert attachments
 	for _, att := range email.Attachments {
-		if attWithData, ok := interface{}(&att).(*Attachment); ok {
-			_, err = tx.Exec(`
-				INSERT INTO attachments (email_id, filename, content_type, size, data)
-				VALUES (?, ?, ?, ?, ?)
-			`, emailID, att.Filename, att.ContentType, att.Size, attWithData.Data)
-			if err != nil {
-				return 0, err
-			}
+		hash, err := s.putPayload(tx, att.Data, att.Spool)
+		if err != nil {
+			return 0, fmt.Errorf("failed to store attachment: %w", err)
+		}
+
+		var messageJSON sql.NullString
+		if att.Message != nil {
+			data, _ := json.Marshal(att.Message)
+			messageJSON = sql.NullString{String: string(data), Valid: true}
+		}
+
+		result, err := tx.Exec(`
+			INSERT INTO attachments (email_id, filename, content_type, size, hash, content_id, inline, message,
+				detected_type, type_mismatch)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, emailID, att.Filename, att.ContentType, att.Size, hash, att.ContentID, att.Inline, messageJSON,
+			att.DetectedType, att.TypeMismatch)
+		if err != nil {
+			return 0, err
+		}
+
+		if att.ID, err = result.LastInsertId(); err != nil {
+			return 0, err
 		}
 	}
 
-	if err := tx.Commit(); err != nil {
-		return 0, err
+	if err := s.insertRecipients(tx, emailID, email); err != nil {
+		return 0, fmt.Errorf("failed to index recipients: %w", err)
+	}
+
+	if email.Job != nil {
+		email.Job.EmailID = emailID
+		if err := insertJob(tx, email.Job); err != nil {
+			return 0, fmt.Errorf("failed to queue job: %w", err)
+		}
 	}
 
 	return emailID, nil
 }
 
-// GetEmail retrieves an email by ID
-func (s *SQLiteStorage) GetEmail(id int64) (*Email, error) {
+// emailColumns returns the columns read by scanEmail, qualified with
+// table when it is not empty
+func emailColumns(table string) string {
+	columns := []string{
+		"id", "message_id", "from_address", "to_addresses", "cc_addresses", "bcc_addresses",
+		"subject", "body_plain", "body_html", "headers", "size", "received_at", "read",
+		"envelope_from", "envelope_to", "tags", "pinned", "thread_id", "updated_at",
+		"spam", "auth", "calendar", "security", "received_hops", "missing_alternative",
+		"unsubscribe", "body_amp", "reply_to", "sender", "return_path",
+		"priority", "size_breakdown",
+	}
+	if table != "" {
+		for i, column := range columns {
+			columns[i] = table + "." + column
+		}
+	}
+	return strings.Join(columns, ", ")
+}
+
+// summaryPrefix is the number of characters of a plain-text body read for
+// a preview. It leaves room for the whitespace collapsed by makePreview.
+const summaryPrefix = 4 * previewLength
+
+// summaryColumns returns emailColumns for listing summaries. The HTML body
+// and headers are not read, and plain-text bodies stored as text only up
+// to summaryPrefix; encrypted ones are blobs and have to be read whole.
+func summaryColumns() string {
+	columns := emailColumns("")
+	columns = strings.Replace(columns, "body_plain",
+		fmt.Sprintf("CASE WHEN typeof(body_plain) = 'text' THEN substr(body_plain, 1, %d) ELSE body_plain END", summaryPrefix), 1)
+	columns = strings.Replace(columns, "body_html", "NULL", 1)
+	columns = strings.Replace(columns, "body_amp", "NULL", 1)
+	columns = strings.Replace(columns, "calendar", "NULL", 1)
+	columns = strings.Replace(columns, "received_hops", "NULL", 1)
+	columns = strings.Replace(columns, "unsubscribe", "NULL", 1)
+	columns = strings.Replace(columns, "size_breakdown", "NULL", 1)
+	return strings.Replace(columns, "headers", "'{}'", 1)
+}
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanEmail scans a row selected with emailColumns. Any extra destinations
+// are scanned from the columns following them.
+func (s *SQLiteStorage) scanEmail(row rowScanner, extra ...interface{}) (*Email, error) {
 	var email Email
-	var toJSON, ccJSON, bccJSON, headersJSON string
+	var toJSON, ccJSON, bccJSON, headersJSON, envelopeToJSON, tagsJSON string
+	var bodyPlain, bodyHTML, bodyAMP []byte
+	var updatedAt int64
+	var spamJSON, authJSON, calendarJSON, securityJSON, receivedJSON sql.NullString
+	var missingAlternative, unsubscribeJSON, replyToJSON, priority, sizesJSON sql.NullString
 
-	err := s.db.QueryRow(`
-		SELECT id, message_id, from_address, to_addresses, cc_addresses, bcc_addresses,
-		       subject, body_plain, body_html, headers, size, received_at, read
-		FROM emails WHERE id = ?
-	`, id).Scan(
+	dest := []interface{}{
 		&email.ID, &email.MessageID, &email.From, &toJSON, &ccJSON, &bccJSON,
-		&email.Subject, &email.BodyPlain, &email.BodyHTML, &headersJSON,
+		&email.Subject, &bodyPlain, &bodyHTML, &headersJSON,
 		&email.Size, &email.ReceivedAt, &email.Read,
-	)
+		&email.EnvelopeFrom, &envelopeToJSON, &tagsJSON, &email.Pinned,
+		&email.ThreadID, &updatedAt, &spamJSON, &authJSON, &calendarJSON,
+		&securityJSON, &receivedJSON, &missingAlternative, &unsubscribeJSON, &bodyAMP,
+		&replyToJSON, &email.Sender, &email.ReturnPath, &priority, &sizesJSON,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	email.UpdatedAt = time.UnixMilli(updatedAt)
+	email.MissingAlternative = missingAlternative.String
+	email.Priority = priority.String
 
-	if err == sql.ErrNoRows {
-		return nil, ErrNotFound
+	bodyPlain, err := s.decode(bodyPlain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
 	}
+	bodyHTML, err = s.decode(bodyHTML)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to read HTML body: %w", err)
+	}
+	bodyAMP, err = s.decode(bodyAMP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read AMP body: %w", err)
 	}
+	email.BodyPlain = string(bodyPlain)
+	email.BodyHTML = string(bodyHTML)
+	email.BodyAMP = string(bodyAMP)
 
 	// Unmarshal JSON fields
 	json.Unmarshal([]byte(toJSON), &email.To)
 	json.Unmarshal([]byte(ccJSON), &email.CC)
 	json.Unmarshal([]byte(bccJSON), &email.BCC)
 	json.Unmarshal([]byte(headersJSON), &email.Headers)
-
-	// Get attachments metadata
-	rows, err := s.db.Query(`
-		SELECT id, filename, content_type, size
-		FROM attachments WHERE email_id = ?
-	`, id)
-	if err != nil {
-		return nil, err
+	json.Unmarshal([]byte(envelopeToJSON), &email.EnvelopeTo)
+	json.Unmarshal([]byte(tagsJSON), &email.Tags)
+	if replyToJSON.Valid {
+		json.Unmarshal([]byte(replyToJSON.String), &email.ReplyTo)
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var att AttachmentMeta
-		if err := rows.Scan(&att.ID, &att.Filename, &att.ContentType, &att.Size); err != nil {
-			return nil, err
-		}
-		email.Attachments = append(email.Attachments, att)
+	if spamJSON.Valid {
+		email.Spam = &SpamResult{}
+		json.Unmarshal([]byte(spamJSON.String), email.Spam)
+	}
+	if authJSON.Valid {
+		email.Auth = &AuthResults{}
+		json.Unmarshal([]byte(authJSON.String), email.Auth)
+	}
+	if calendarJSON.Valid {
+		email.Calendar = &Calendar{}
+		json.Unmarshal([]byte(calendarJSON.String), email.Calendar)
+	}
+	if securityJSON.Valid {
+		email.Security = &Security{}
+		json.Unmarshal([]byte(securityJSON.String), email.Security)
+	}
+	if sizesJSON.Valid {
+		email.SizeBreakdown = &SizeBreakdown{}
+		json.Unmarshal([]byte(sizesJSON.String), email.SizeBreakdown)
+	}
+	if receivedJSON.Valid {
+		json.Unmarshal([]byte(receivedJSON.String), &email.Received)
+	}
+	if unsubscribeJSON.Valid {
+		email.Unsubscribe = &Unsubscribe{}
+		json.Unmarshal([]byte(unsubscribeJSON.String), email.Unsubscribe)
 	}
 
 	return &email, nil
 }
 
-// ListEmails retrieves a paginated list of emails with optional filtering
-func (s *SQLiteStorage) ListEmails(filter *EmailFilter, limit, offset int) (*EmailListResult, error) {
-	query := `
-		SELECT id, message_id, from_address, to_addresses, cc_addresses, bcc_addresses,
-		       subject, body_plain, body_html, headers, size, received_at, read
-		FROM emails WHERE 1=1
-	`
-	countQuery := "SELECT COUNT(*) FROM emails WHERE 1=1"
+// scanMessageInfo unmarshals the summary of an attached email, if the
+// attachment is one
+func scanMessageInfo(data sql.NullString) *MessageInfo {
+	if !data.Valid {
+		return nil
+	}
+	info := &MessageInfo{}
+	json.Unmarshal([]byte(data.String), info)
+	return info
+}
+
+// filterConditions builds the SQL conditions and arguments for filter.
+// The conditions are prefixed with AND so they can follow a WHERE clause.
+func (s *SQLiteStorage) filterConditions(filter *EmailFilter) (string, []interface{}) {
+	conditions := ""
 	args := []interface{}{}
 
-	// Apply filters
-	if filter != nil {
-		if filter.From != "" {
-			query += " AND from_address LIKE ?"
-			countQuery += " AND from_address LIKE ?"
-			args = append(args, "%"+filter.From+"%")
+	if filter == nil {
+		return conditions, args
+	}
+
+	if filter.Query != "" {
+		// A search that cannot be run matches nothing; saved searches are
+		// validated when they are saved
+		if node, err := parseSearch(filter.Query); err == nil {
+			condition, searchArgs := s.searchCondition(node)
+			conditions += condition
+			args = append(args, searchArgs...)
+		} else {
+			conditions += " AND 0"
+		}
+	}
+
+	for _, f := range []struct{ column, value string }{
+		{"from_address", filter.From},
+		{"sender", filter.Sender},
+		{"return_path", filter.ReturnPath},
+	} {
+		if f.value != "" {
+			condition, arg := addressCondition(f.column, f.value)
+			conditions += condition
+			args = append(args, arg)
 		}
-		if filter.To != "" {
-			query += " AND to_addresses LIKE ?"
-			countQuery += " AND to_addresses LIKE ?"
-			args = append(args, "%"+filter.To+"%")
+	}
+	if filter.To != "" {
+		condition, arg := recipientCondition(recipientTo, filter.To)
+		conditions += condition
+		args = append(args, arg)
+	}
+	if filter.Subject != "" {
+		conditions += " AND subject LIKE ?"
+		args = append(args, "%"+filter.Subject+"%")
+	}
+	if filter.Since != nil {
+		conditions += " AND received_at >= ?"
+		args = append(args, filter.Since)
+	}
+	if filter.Until != nil {
+		conditions += " AND received_at <= ?"
+		args = append(args, filter.Until)
+	}
+	if filter.Unread {
+		conditions += " AND read = 0"
+	}
+	if filter.EnvelopeTo != "" {
+		condition, arg := recipientCondition(recipientEnvelope, filter.EnvelopeTo)
+		conditions += condition
+		args = append(args, arg)
+	}
+	if filter.Inbox != "" {
+		condition, inboxArgs := s.inboxCondition(filter.Inbox, filter.InboxExact)
+		conditions += condition
+		args = append(args, inboxArgs...)
+	}
+	if filter.ReplyTo != "" {
+		// Reply-To is not indexed with the recipients, which decide what
+		// users may see
+		if isAddress(filter.ReplyTo) {
+			conditions += " AND EXISTS (SELECT 1 FROM json_each(emails.reply_to) WHERE json_each.value = ? COLLATE NOCASE)"
+			args = append(args, filter.ReplyTo)
+		} else {
+			conditions += " AND reply_to LIKE ?"
+			args = append(args, "%"+filter.ReplyTo+"%")
+		}
+	}
+	if filter.Mailbox != "" {
+		conditions += " AND id IN (" + mailboxEmailIDs + ")"
+		args = append(args, filter.Mailbox)
+	}
+	if filter.Mailboxes != nil {
+		// GLOB has the wildcards of the patterns, and no pattern matches
+		// nothing
+		globs := []string{"0"}
+		for _, pattern := range filter.Mailboxes {
+			globs = append(globs, "address GLOB ?")
+			args = append(args, strings.ToLower(pattern))
+		}
+		conditions += " AND id IN (SELECT email_id FROM email_recipients WHERE " + strings.Join(globs, " OR ") + ")"
+	}
+	if filter.Tag != "" {
+		conditions += " AND EXISTS (SELECT 1 FROM json_each(emails.tags) WHERE json_each.value = ?)"
+		args = append(args, filter.Tag)
+	}
+	if filter.Pinned {
+		conditions += " AND pinned = 1"
+	}
+	if filter.Priority != "" {
+		conditions += " AND priority = ?"
+		args = append(args, filter.Priority)
+	}
+	if filter.MissingAlternative != "" {
+		conditions += " AND missing_alternative = ?"
+		args = append(args, filter.MissingAlternative)
+	}
+	if filter.Spam {
+		conditions += " AND json_extract(spam, '$.isSpam') = 1"
+	}
+	if filter.MinSpamScore != nil {
+		conditions += " AND spam_score >= ?"
+		args = append(args, *filter.MinSpamScore)
+	}
+
+	return conditions, args
+}
+
+// blobStreamSize is the size above which payloads are streamed to blob
+// stores that support it rather than read into memory
+const blobStreamSize = 1 << 20
+
+// putBlob stores the size bytes read from r content-addressed by their
+// SHA-256 hash, either in the configured blob store or the blobs table, and
+// returns the hash. Identical payloads are stored once; rows referencing
+// the hash act as its reference count. Payloads are compressed and
+// encrypted as configured.
+//
+// Large payloads are streamed to a BlobStreamer. The blobs table and
+// encryption, which seals a payload in one piece, take it whole.
+func (s *SQLiteStorage) putBlob(tx *sql.Tx, r io.ReadSeeker, size int64) (sql.NullString, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return sql.NullString{}, err
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	if s.blobs == nil {
+		var exists int
+		err := tx.QueryRow("SELECT 1 FROM blobs WHERE hash = ?", hash).Scan(&exists)
+		if err == nil {
+			return sql.NullString{String: hash, Valid: true}, nil
 		}
-		if filter.Subject != "" {
-			query += " AND subject LIKE ?"
-			countQuery += " AND subject LIKE ?"
-			args = append(args, "%"+filter.Subject+"%")
+		if err != sql.ErrNoRows {
+			return sql.NullString{}, err
 		}
-		if filter.Since != nil {
-			query += " AND received_at >= ?"
-			countQuery += " AND received_at >= ?"
-			args = append(args, filter.Since)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return sql.NullString{}, err
+	}
+
+	if streamer, ok := s.blobs.(BlobStreamer); ok && s.aead == nil && size > blobStreamSize {
+		body, n, done, err := s.compressFile(r, size)
+		if err != nil {
+			return sql.NullString{}, err
 		}
-		if filter.Until != nil {
-			query += " AND received_at <= ?"
-			countQuery += " AND received_at <= ?"
-			args = append(args, filter.Until)
+		err = streamer.PutFrom(hash, body, n)
+		done()
+		s.written = append(s.written, hash)
+		if err != nil {
+			return sql.NullString{}, err
 		}
+		return sql.NullString{String: hash, Valid: true}, nil
 	}
 
-	// Get total count
-	var total int64
-	err := s.db.QueryRow(countQuery, args...).Scan(&total)
+	data, err := io.ReadAll(r)
 	if err != nil {
-		return nil, err
+		return sql.NullString{}, err
+	}
+	encoded, err := s.encode(data)
+	if err != nil {
+		return sql.NullString{}, err
 	}
 
-	// Add ordering and pagination
-	query += " ORDER BY received_at DESC LIMIT ? OFFSET ?"
-	args = append(args, limit, offset)
+	if s.blobs == nil {
+		_, err = tx.Exec("INSERT INTO blobs (hash, data, size) VALUES (?, ?, ?)", hash, encoded, len(encoded))
+	} else {
+		err = s.blobs.Put(hash, encoded)
+		s.written = append(s.written, hash)
+	}
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: hash, Valid: true}, nil
+}
 
-	// Execute query
-	rows, err := s.db.Query(query, args...)
+// putPayload stores data, or the spool file holding it in its place, with
+// putBlob. It returns a null hash when there is neither.
+func (s *SQLiteStorage) putPayload(tx *sql.Tx, data []byte, spool string) (sql.NullString, error) {
+	if spool == "" {
+		if data == nil {
+			return sql.NullString{}, nil
+		}
+		return s.putBlob(tx, bytes.NewReader(data), int64(len(data)))
+	}
+
+	f, err := os.Open(spool)
 	if err != nil {
-		return nil, err
+		return sql.NullString{}, fmt.Errorf("failed to read spool file: %w", err)
 	}
-	defer rows.Close()
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return sql.NullString{}, fmt.Errorf("failed to read spool file: %w", err)
+	}
+	return s.putBlob(tx, f, info.Size())
+}
 
-	emails := []*Email{}
-	for rows.Next() {
-		var email Email
-		var toJSON, ccJSON, bccJSON, headersJSON string
+// blobReferences counts the attachments and raw messages stored in a blob
+const blobReferences = `SELECT (SELECT COUNT(*) FROM attachments WHERE hash = ?) + (SELECT COUNT(*) FROM emails WHERE raw_hash = ?)`
 
-		err := rows.Scan(
-			&email.ID, &email.MessageID, &email.From, &toJSON, &ccJSON, &bccJSON,
-			&email.Subject, &email.BodyPlain, &email.BodyHTML, &headersJSON,
-			&email.Size, &email.ReceivedAt, &email.Read,
-		)
+// deleteUnreferencedBlobs removes the external blobs of a failed save that
+// no stored email refers to. Callers must hold blobMu.
+func (s *SQLiteStorage) deleteUnreferencedBlobs(hashes []string) {
+	var orphans []string
+	seen := make(map[string]bool)
+	for _, hash := range hashes {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		var refs int
+		err := s.db.QueryRow(blobReferences, hash, hash).Scan(&refs)
 		if err != nil {
-			return nil, err
+			s.logger.Warn().Err(err).Str("hash", hash).Msg("Failed to check references of attachment blob")
+			continue
 		}
+		if refs == 0 {
+			orphans = append(orphans, hash)
+		}
+	}
+	s.deleteExternalBlobs(orphans)
+}
 
-		// Unmarshal JSON fields
-		json.Unmarshal([]byte(toJSON), &email.To)
-		json.Unmarshal([]byte(ccJSON), &email.CC)
-		json.Unmarshal([]byte(bccJSON), &email.BCC)
-		json.Unmarshal([]byte(headersJSON), &email.Headers)
+// getBlob returns data if it was stored inline, otherwise reads hash from
+// the blob store or the blobs table. The result still has to be decoded.
+func (s *SQLiteStorage) getBlob(data []byte, hash sql.NullString) ([]byte, error) {
+	if data != nil || !hash.Valid {
+		return data, nil
+	}
 
-		emails = append(emails, &email)
+	if s.blobs != nil {
+		data, err := s.blobs.Get(hash.String)
+		if err != ErrNotFound {
+			return data, err
+		}
+		// Fall through: the payload may predate the blob store
 	}
 
-	return &EmailListResult{
-		Emails: emails,
-		Total:  total,
-	}, nil
+	err := s.reader.QueryRow("SELECT data FROM blobs WHERE hash = ?", hash.String).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return data, err
 }
 
-// SearchEmails performs full-text search on emails
-func (s *SQLiteStorage) SearchEmails(query string, limit, offset int) (*EmailListResult, error) {
-	var sqlQuery string
-	var countQuery string
-	var args []interface{}
+// GetEmail retrieves an email by ID
+func (s *SQLiteStorage) GetEmail(id int64) (*Email, error) {
+	key := cacheKey{id: id}
+	if cached, ok := s.cache.get(key); ok {
+		return cloneEmail(cached.(*Email)), nil
+	}
+	gen := s.cache.generation()
 
-	if s.hasFTS5 {
-		// Use FTS5 for search
-		sqlQuery = `
-			SELECT e.id, e.message_id, e.from_address, e.to_addresses, e.cc_addresses, e.bcc_addresses,
-			       e.subject, e.body_plain, e.body_html, e.headers, e.size, e.received_at, e.read
-			FROM emails e
-			JOIN emails_fts fts ON e.id = fts.rowid
-			WHERE emails_fts MATCH ?
-			ORDER BY e.received_at DESC
-			LIMIT ? OFFSET ?
-		`
-		countQuery = "SELECT COUNT(*) FROM emails_fts WHERE emails_fts MATCH ?"
-		args = []interface{}{query, limit, offset}
-	} else {
-		// Fallback to LIKE-based search
-		sqlQuery = `
-			SELECT id, message_id, from_address, to_addresses, cc_addresses, bcc_addresses,
-			       subject, body_plain, body_html, headers, size, received_at, read
-			FROM emails
-			WHERE subject LIKE ? OR from_address LIKE ? OR to_addresses LIKE ? OR body_plain LIKE ?
-			ORDER BY received_at DESC
-			LIMIT ? OFFSET ?
-		`
-		countQuery = `
-			SELECT COUNT(*) FROM emails
-			WHERE subject LIKE ? OR from_address LIKE ? OR to_addresses LIKE ? OR body_plain LIKE ?
-		`
-		searchPattern := "%" + query + "%"
-		args = []interface{}{searchPattern, searchPattern, searchPattern, searchPattern, limit, offset}
+	email, err := s.scanEmail(s.reader.QueryRow("SELECT "+emailColumns("")+" FROM emails WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	rows, err := s.db.Query(sqlQuery, args...)
+	// Get attachments metadata
+	rows, err := s.reader.Query(`
+		SELECT id, filename, content_type, size, content_id, inline, message, detected_type, type_mismatch
+		FROM attachments WHERE email_id = ?
+	`, id)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	emails := []*Email{}
 	for rows.Next() {
-		var email Email
-		var toJSON, ccJSON, bccJSON, headersJSON string
-
-		err := rows.Scan(
-			&email.ID, &email.MessageID, &email.From, &toJSON, &ccJSON, &bccJSON,
-			&email.Subject, &email.BodyPlain, &email.BodyHTML, &headersJSON,
-			&email.Size, &email.ReceivedAt, &email.Read,
-		)
-		if err != nil {
+		var att Attachment
+		var messageJSON sql.NullString
+		if err := rows.Scan(&att.ID, &att.Filename, &att.ContentType, &att.Size, &att.ContentID, &att.Inline, &messageJSON,
+			&att.DetectedType, &att.TypeMismatch); err != nil {
 			return nil, err
 		}
+		att.Message = scanMessageInfo(messageJSON)
+		email.Attachments = append(email.Attachments, &att)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-		// Unmarshal JSON fields
-		json.Unmarshal([]byte(toJSON), &email.To)
-		json.Unmarshal([]byte(ccJSON), &email.CC)
-		json.Unmarshal([]byte(bccJSON), &email.BCC)
-		json.Unmarshal([]byte(headersJSON), &email.Headers)
+	s.cache.put(gen, key, id, cloneEmail(email), emailCost(email))
+	return email, nil
+}
 
-		emails = append(emails, &email)
+// GetEmailByMessageID retrieves the most recent email with a Message-ID,
+// which may be given with or without its angle brackets
+func (s *SQLiteStorage) GetEmailByMessageID(messageID string) (*Email, error) {
+	bare := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(messageID), "<"), ">")
+	if bare == "" {
+		return nil, ErrNotFound
 	}
 
-	// Get total count for search
-	var total int64
-	if s.hasFTS5 {
-		err = s.db.QueryRow(countQuery, query).Scan(&total)
-	} else {
-		searchPattern := "%" + query + "%"
-		err = s.db.QueryRow(countQuery, searchPattern, searchPattern, searchPattern, searchPattern).Scan(&total)
+	var id int64
+	err := s.reader.QueryRow("SELECT id FROM emails WHERE message_id IN (?, ?) ORDER BY id DESC LIMIT 1",
+		"<"+bare+">", bare).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
 	}
 	if err != nil {
-		total = int64(len(emails))
+		return nil, err
 	}
-
-	return &EmailListResult{
-		Emails: emails,
-		Total:  total,
-	}, nil
+	return s.GetEmail(id)
 }
 
-// DeleteEmail deletes an email by ID
-func (s *SQLiteStorage) DeleteEmail(id int64) error {
-	result, err := s.db.Exec("DELETE FROM emails WHERE id = ?", id)
+// GetRawEmail retrieves the raw message of an email as it was received
+func (s *SQLiteStorage) GetRawEmail(id int64) ([]byte, error) {
+	var raw []byte
+	var rawHash sql.NullString
+	err := s.reader.QueryRow("SELECT raw, raw_hash FROM emails WHERE id = ?", id).Scan(&raw, &rawHash)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if raw == nil && !rawHash.Valid {
+		return nil, ErrRawNotAvailable
+	}
+
+	raw, err = s.getBlob(raw, rawHash)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read raw message blob: %w", err)
+	}
+	return s.decode(raw)
+}
+
+// ListEmails retrieves a paginated list of emails with optional filtering
+func (s *SQLiteStorage) ListEmails(filter *EmailFilter, limit, offset int) (*EmailListResult, error) {
+	conditions, args := s.filterConditions(filter)
+	columns := emailColumns("")
+	summary := filter != nil && filter.Summary
+	if summary {
+		columns = summaryColumns()
+	}
+	query := "SELECT " + columns + " FROM emails WHERE 1=1" + conditions
+	countQuery := "SELECT COUNT(*) FROM emails WHERE 1=1" + conditions
+
+	// Get total count
+	var total int64
+	err := s.reader.QueryRow(countQuery, args...).Scan(&total)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add ordering and pagination. A cursor continues after the last email
+	// of the previous page, which stays stable while new mail arrives.
+	if filter != nil && filter.Cursor != nil {
+		query += " AND (received_at < ? OR (received_at = ? AND id < ?))"
+		args = append(args, filter.Cursor.ReceivedAt, filter.Cursor.ReceivedAt, filter.Cursor.ID)
+		offset = 0
+	}
+	query += " ORDER BY received_at DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	// Execute query
+	rows, err := s.reader.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []*Email{}
+	for rows.Next() {
+		email, err := s.scanEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		if summary {
+			email.Preview = makePreview(email.BodyPlain)
+			email.BodyPlain = ""
+		}
+		emails = append(emails, email)
+	}
+
+	result := &EmailListResult{
+		Emails: emails,
+		Total:  total,
+	}
+	if limit > 0 && len(emails) == limit {
+		last := emails[len(emails)-1]
+		result.NextCursor = (&Cursor{ReceivedAt: last.ReceivedAt, ID: last.ID}).Encode()
+	}
+
+	return result, nil
+}
+
+// exportBatchSize is the number of emails ForEachEmail loads at a time
+const exportBatchSize = 100
+
+// ForEachEmail calls fn for every email matching filter, oldest first,
+// with the raw message loaded. Emails are read in small batches so the
+// database is not held while fn runs. Iteration stops at the first error.
+func (s *SQLiteStorage) ForEachEmail(filter *EmailFilter, fn func(*Email) error) error {
+	conditions, filterArgs := s.filterConditions(filter)
+	query := "SELECT " + emailColumns("") + ", raw, raw_hash FROM emails WHERE id > ?" +
+		conditions + " ORDER BY id LIMIT ?"
+
+	var lastID int64
+	for {
+		args := append([]interface{}{lastID}, filterArgs...)
+		args = append(args, exportBatchSize)
+
+		batch, err := s.rawEmailBatch(query, args)
+		if err != nil {
+			return err
+		}
+
+		for _, email := range batch {
+			if err := fn(email); err != nil {
+				return err
+			}
+		}
+
+		if len(batch) < exportBatchSize {
+			return nil
+		}
+		lastID = batch[len(batch)-1].ID
+	}
+}
+
+// rawEmailBatch runs a query selecting emailColumns plus raw and raw_hash
+// and loads the raw messages of the results
+func (s *SQLiteStorage) rawEmailBatch(query string, args []interface{}) ([]*Email, error) {
+	rows, err := s.reader.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []*Email
+	var hashes []sql.NullString
+	for rows.Next() {
+		var raw []byte
+		var rawHash sql.NullString
+		email, err := s.scanEmail(rows, &raw, &rawHash)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		email.Raw = raw
+		emails = append(emails, email)
+		hashes = append(hashes, rawHash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Fetch externally stored messages once the rows are released
+	for i, email := range emails {
+		if email.Raw, err = s.getBlob(email.Raw, hashes[i]); err != nil {
+			return nil, fmt.Errorf("failed to read raw message blob: %w", err)
+		}
+		if email.Raw, err = s.decode(email.Raw); err != nil {
+			return nil, err
+		}
+	}
+
+	return emails, nil
+}
+
+// SearchEmails returns the emails matching a search and filter, newest
+// first, with where the search matched. A search that cannot be run is an
+// ErrInvalidSearch.
+func (s *SQLiteStorage) SearchEmails(query *SearchQuery, filter *EmailFilter, limit, offset int) (*EmailListResult, error) {
+	node, err := query.parse()
+	if err != nil {
+		return nil, err
+	}
+	if node == nil && query.Header == "" {
+		return nil, fmt.Errorf("%w: the search is empty", ErrInvalidSearch)
+	}
+
+	conditions, args := s.filterConditions(filter)
+	headerCondition, headerArgs := query.headerCondition()
+	conditions += headerCondition
+	args = append(args, headerArgs...)
+
+	var sqlQuery, countQuery string
+	highlight := s.hasFTS5 && node != nil
+	if highlight {
+		// The FTS table has columns named as those of emails, so the
+		// conditions select IDs on their own
+		ids, countIDs := "", ""
+		if conditions != "" {
+			selected := "(SELECT id FROM emails WHERE 1=1" + conditions + ")"
+			ids, countIDs = " AND e.id IN "+selected, " AND rowid IN "+selected
+		}
+		sqlQuery = `
+			SELECT ` + emailColumns("e") + `, ` + ftsHighlightColumns + `
+			FROM emails e
+			JOIN emails_fts fts ON e.id = fts.rowid
+			WHERE emails_fts MATCH ?` + ids + `
+			ORDER BY e.received_at DESC
+			LIMIT ? OFFSET ?
+		`
+		countQuery = "SELECT COUNT(*) FROM emails_fts WHERE emails_fts MATCH ?" + countIDs
+		args = append([]interface{}{node.fts()}, args...)
+	} else {
+		if node != nil {
+			searchCondition, searchArgs := s.searchCondition(node)
+			conditions += searchCondition
+			args = append(args, searchArgs...)
+		}
+		sqlQuery = `
+			SELECT ` + emailColumns("") + `
+			FROM emails
+			WHERE 1=1` + conditions + `
+			ORDER BY received_at DESC
+			LIMIT ? OFFSET ?
+		`
+		countQuery = "SELECT COUNT(*) FROM emails WHERE 1=1" + conditions
+	}
+
+	rows, err := s.reader.Query(sqlQuery, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	emails := []*Email{}
+	for rows.Next() {
+		var email *Email
+		if highlight {
+			var subject, from, to, body sql.NullString
+			email, err = s.scanEmail(rows, &subject, &from, &to, &body)
+			if err != nil {
+				return nil, err
+			}
+			email.Match = ftsMatch(subject, from, to, body)
+		} else {
+			email, err = s.scanEmail(rows)
+			if err != nil {
+				return nil, err
+			}
+			if node != nil {
+				email.Match = likeMatch(email, node.terms())
+			}
+		}
+		emails = append(emails, email)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var total int64
+	if err := s.reader.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	return &EmailListResult{
+		Emails: emails,
+		Total:  total,
+	}, nil
+}
+
+// DeleteEmail deletes an email by ID
+func (s *SQLiteStorage) DeleteEmail(id int64) error {
+	rows, err := s.deleteEmailsWhere("id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	if rows == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// MarkRead marks an email as read
+func (s *SQLiteStorage) MarkRead(id int64) error {
+	return s.setRead(id, true)
+}
+
+// MarkUnread marks an email as unread
+func (s *SQLiteStorage) MarkUnread(id int64) error {
+	return s.setRead(id, false)
+}
+
+// setRead updates the read flag of an email
+func (s *SQLiteStorage) setRead(id int64, read bool) error {
+	result, err := s.db.Exec("UPDATE emails SET read = ?, updated_at = ? WHERE id = ?", read, time.Now().UnixMilli(), id)
 	if err != nil {
 		return err
 	}
@@ -361,29 +1129,353 @@ func (s *SQLiteStorage) DeleteEmail(id int64) error {
 		return ErrNotFound
 	}
 
+	s.cache.invalidate(id)
+	return nil
+}
+
+// UpdateEmail applies update to the email with the given ID
+func (s *SQLiteStorage) UpdateEmail(id int64, update *EmailUpdate) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := updateEmailTx(tx, id, update); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.cache.invalidate(id)
 	return nil
 }
 
+// SetUnsubscribeTest saves the outcome of testing the unsubscribe mechanism
+// of an email, replacing that of any earlier test
+func (s *SQLiteStorage) SetUnsubscribeTest(id int64, test *UnsubscribeTest) error {
+	data, err := json.Marshal(test)
+	if err != nil {
+		return err
+	}
+	result, err := s.db.Exec(`UPDATE emails SET unsubscribe = json_set(unsubscribe, '$.test', json(?)), updated_at = ?
+		WHERE id = ? AND unsubscribe IS NOT NULL`, string(data), time.Now().UnixMilli(), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrNotFound
+	}
+
+	s.cache.invalidate(id)
+	return nil
+}
+
+// updateEmailTx applies update to the email with the given ID within tx
+func updateEmailTx(tx *sql.Tx, id int64, update *EmailUpdate) error {
+	var sets []string
+	var args []interface{}
+
+	if update.Read != nil {
+		sets = append(sets, "read = ?")
+		args = append(args, *update.Read)
+	}
+	if update.Pinned != nil {
+		sets = append(sets, "pinned = ?")
+		args = append(args, *update.Pinned)
+	}
+	if update.Tags != nil {
+		tagsJSON, _ := json.Marshal(normalizeTags(*update.Tags))
+		sets = append(sets, "tags = ?")
+		args = append(args, string(tagsJSON))
+	}
+
+	// Nothing to change, but the email must still exist
+	if len(sets) == 0 {
+		var exists int
+		err := tx.QueryRow("SELECT 1 FROM emails WHERE id = ?", id).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	sets = append(sets, "updated_at = ?")
+	args = append(args, time.Now().UnixMilli())
+
+	result, err := tx.Exec("UPDATE emails SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, id)...)
+	if err != nil {
+		return err
+	}
+
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// BatchEmails applies op to every email in ids within a single
+// transaction. Missing emails are reported per item and do not abort the
+// batch; storage errors roll back the whole batch.
+func (s *SQLiteStorage) BatchEmails(ids []int64, op *BatchOperation) ([]BatchItemResult, error) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	results := make([]BatchItemResult, len(ids))
+	var orphans []string
+	for i, id := range ids {
+		results[i].ID = id
+
+		var err error
+		switch op.Action {
+		case BatchDelete:
+			var deleted int64
+			var removed []string
+			deleted, removed, err = s.deleteEmailsTx(tx, "id = ?", id)
+			orphans = append(orphans, removed...)
+			if err == nil && deleted == 0 {
+				err = ErrNotFound
+			}
+		case BatchMarkRead, BatchMarkUnread:
+			read := op.Action == BatchMarkRead
+			err = updateEmailTx(tx, id, &EmailUpdate{Read: &read})
+		case BatchTag, BatchUntag:
+			err = retagEmailTx(tx, id, op.Tags, op.Action == BatchTag)
+		default:
+			return nil, fmt.Errorf("unknown batch action: %s", op.Action)
+		}
+
+		if err == ErrNotFound {
+			results[i].Error = err.Error()
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		results[i].Success = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	s.cache.invalidate(ids...)
+	s.deleteExternalBlobs(orphans)
+
+	return results, nil
+}
+
+// retagEmailTx adds tags to, or removes them from, an email's tags within tx
+func retagEmailTx(tx *sql.Tx, id int64, tags []string, add bool) error {
+	var tagsJSON string
+	err := tx.QueryRow("SELECT tags FROM emails WHERE id = ?", id).Scan(&tagsJSON)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	var current []string
+	json.Unmarshal([]byte(tagsJSON), &current)
+
+	if add {
+		current = append(current, tags...)
+	} else {
+		remove := make(map[string]bool)
+		for _, tag := range normalizeTags(tags) {
+			remove[tag] = true
+		}
+		kept := current[:0]
+		for _, tag := range current {
+			if !remove[tag] {
+				kept = append(kept, tag)
+			}
+		}
+		current = kept
+	}
+
+	return updateEmailTx(tx, id, &EmailUpdate{Tags: &current})
+}
+
+// normalizeTags trims tags and drops empty and duplicate entries
+func normalizeTags(tags []string) []string {
+	normalized := []string{}
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+	return normalized
+}
+
 // DeleteAllEmails deletes all emails
 func (s *SQLiteStorage) DeleteAllEmails() error {
-	_, err := s.db.Exec("DELETE FROM emails")
+	_, err := s.deleteEmailsWhere("1=1")
 	return err
 }
 
+// deleteEmailsWhere deletes the emails matching cond and removes blobs
+// that are no longer referenced by any attachment
+func (s *SQLiteStorage) deleteEmailsWhere(cond string, args ...interface{}) (int64, error) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	deleted, orphans, err := s.deleteEmailsTx(tx, cond, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	// Which emails cond matched is not known, so nothing cached is kept
+	if deleted > 0 {
+		s.cache.clear()
+	}
+	s.deleteExternalBlobs(orphans)
+
+	return deleted, nil
+}
+
+// deleteEmailsTx deletes the emails matching cond within tx, along with
+// blobs in the blobs table that lose their last reference. It returns the
+// orphaned hashes so external blobs can be removed once tx commits.
+// Callers must hold blobMu.
+func (s *SQLiteStorage) deleteEmailsTx(tx *sql.Tx, cond string, args ...interface{}) (int64, []string, error) {
+	// Collect blob keys referenced by the emails about to be deleted
+	var hashes []string
+	selected := "SELECT id FROM emails WHERE " + cond
+	rows, err := tx.Query(`
+		SELECT hash FROM attachments
+		WHERE hash IS NOT NULL AND data IS NULL AND email_id IN (`+selected+`)
+		UNION
+		SELECT raw_hash FROM emails
+		WHERE raw_hash IS NOT NULL AND raw IS NULL AND id IN (`+selected+`)
+	`, append(args, args...)...)
+	if err != nil {
+		return 0, nil, err
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return 0, nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, nil, err
+	}
+
+	result, err := tx.Exec("DELETE FROM emails WHERE "+cond, args...)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// Attachments are removed by the cascade; find blobs left without references
+	var orphans []string
+	for _, hash := range hashes {
+		var refs int
+		err := tx.QueryRow(blobReferences, hash, hash).Scan(&refs)
+		if err != nil {
+			return 0, nil, err
+		}
+		if refs == 0 {
+			orphans = append(orphans, hash)
+		}
+	}
+
+	for _, hash := range orphans {
+		if _, err := tx.Exec("DELETE FROM blobs WHERE hash = ?", hash); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return deleted, orphans, nil
+}
+
+// deleteExternalBlobs removes orphaned blobs from the external blob store
+func (s *SQLiteStorage) deleteExternalBlobs(orphans []string) {
+	if s.blobs == nil {
+		return
+	}
+	for _, hash := range orphans {
+		if err := s.blobs.Delete(hash); err != nil {
+			s.logger.Warn().Err(err).Str("hash", hash).Msg("Failed to delete attachment blob")
+		}
+	}
+}
+
 // GetEmailCount returns the total number of emails
 func (s *SQLiteStorage) GetEmailCount() (int64, error) {
 	var count int64
-	err := s.db.QueryRow("SELECT COUNT(*) FROM emails").Scan(&count)
+	err := s.reader.QueryRow("SELECT COUNT(*) FROM emails").Scan(&count)
 	return count, err
 }
 
+// EmailsVersion returns the number of emails, the highest ID and the
+// latest update. Any insert, delete or update changes at least one of them.
+func (s *SQLiteStorage) EmailsVersion() (string, error) {
+	var count, maxID, updatedAt int64
+	// Separate subqueries, so that each maximum is read from an index
+	// instead of scanning every email
+	err := s.reader.QueryRow(`SELECT (SELECT COUNT(*) FROM emails),
+		(SELECT COALESCE(MAX(id), 0) FROM emails),
+		(SELECT COALESCE(MAX(updated_at), 0) FROM emails)`).
+		Scan(&count, &maxID, &updatedAt)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d-%d", count, maxID, updatedAt), nil
+}
+
 // GetAttachment retrieves an attachment by ID
 func (s *SQLiteStorage) GetAttachment(id int64) (*Attachment, error) {
+	key := cacheKey{attachment: true, id: id}
+	if cached, ok := s.cache.get(key); ok {
+		return cloneAttachment(cached.(*Attachment)), nil
+	}
+	gen := s.cache.generation()
+
 	var att Attachment
-	err := s.db.QueryRow(`
-		SELECT id, filename, content_type, size, data
+	var emailID int64
+	var hash, messageJSON sql.NullString
+	err := s.reader.QueryRow(`
+		SELECT id, email_id, filename, content_type, size, data, hash, content_id, inline, message,
+			detected_type, type_mismatch
 		FROM attachments WHERE id = ?
-	`, id).Scan(&att.ID, &att.Filename, &att.ContentType, &att.Size, &att.Data)
+	`, id).Scan(&att.ID, &emailID, &att.Filename, &att.ContentType, &att.Size, &att.Data, &hash, &att.ContentID, &att.Inline, &messageJSON,
+		&att.DetectedType, &att.TypeMismatch)
 
 	if err == sql.ErrNoRows {
 		return nil, ErrNotFound
@@ -391,37 +1483,364 @@ func (s *SQLiteStorage) GetAttachment(id int64) (*Attachment, error) {
 	if err != nil {
 		return nil, err
 	}
+	att.Message = scanMessageInfo(messageJSON)
+
+	// Payload may live in the blob store
+	if att.Size > 0 {
+		if att.Data, err = s.getBlob(att.Data, hash); err != nil {
+			return nil, fmt.Errorf("failed to read attachment blob: %w", err)
+		}
+		if att.Data, err = s.decode(att.Data); err != nil {
+			return nil, fmt.Errorf("failed to read attachment: %w", err)
+		}
+	}
 
+	s.cache.put(gen, key, emailID, cloneAttachment(&att), int64(len(att.Data)))
 	return &att, nil
 }
 
-// DeleteOldEmails deletes emails older than the specified time
-func (s *SQLiteStorage) DeleteOldEmails(before time.Time) (int64, error) {
-	result, err := s.db.Exec("DELETE FROM emails WHERE received_at < ?", before)
+// Stats returns storage usage statistics
+func (s *SQLiteStorage) Stats() (*StorageStats, error) {
+	stats := &StorageStats{
+		DailyCounts:   []DailyCount{},
+		LargestEmails: []EmailSize{},
+	}
+
+	// File sizes on disk
+	stats.DatabaseBytes, stats.WALBytes = s.fileSizes()
+
+	err := s.reader.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM emails").
+		Scan(&stats.EmailCount, &stats.EmailBytes)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	return result.RowsAffected()
+	err = s.reader.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM attachments").
+		Scan(&stats.AttachmentCount, &stats.AttachmentBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Deduplicated payloads actually stored in the database
+	err = s.reader.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM blobs").
+		Scan(&stats.BlobCount, &stats.BlobBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Per-day counts for the last 30 days with mail
+	rows, err := s.reader.Query(`
+		SELECT substr(received_at, 1, 10) AS day, COUNT(*), COALESCE(SUM(size), 0)
+		FROM emails
+		GROUP BY day
+		ORDER BY day DESC
+		LIMIT 30
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var day DailyCount
+		if err := rows.Scan(&day.Date, &day.Count, &day.Bytes); err != nil {
+			return nil, err
+		}
+		stats.DailyCounts = append(stats.DailyCounts, day)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Largest messages
+	rows, err = s.reader.Query(`
+		SELECT id, from_address, subject, size, received_at
+		FROM emails
+		ORDER BY size DESC
+		LIMIT 10
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var email EmailSize
+		if err := rows.Scan(&email.ID, &email.From, &email.Subject, &email.Size, &email.ReceivedAt); err != nil {
+			return nil, err
+		}
+		stats.LargestEmails = append(stats.LargestEmails, email)
+	}
+
+	return stats, rows.Err()
+}
+
+// DeleteOldEmails deletes unpinned emails older than the specified time,
+// along with parse failures recorded before it
+func (s *SQLiteStorage) DeleteOldEmails(before time.Time) (int64, error) {
+	if _, err := s.db.Exec("DELETE FROM parse_failures WHERE failed_at < ?", before); err != nil {
+		return 0, err
+	}
+	return s.deleteEmailsWhere("received_at < ? AND pinned = 0", before)
 }
 
-// DeleteExcessEmails deletes emails exceeding the maximum count
+// DeleteExcessEmails deletes the oldest unpinned emails beyond the maximum
+// count. Pinned emails are not counted.
 func (s *SQLiteStorage) DeleteExcessEmails(maxCount int) (int64, error) {
-	result, err := s.db.Exec(`
-		DELETE FROM emails WHERE id IN (
-			SELECT id FROM emails
+	return s.deleteEmailsWhere(`id IN (
+		SELECT id FROM emails
+		WHERE pinned = 0
+		ORDER BY received_at DESC
+		LIMIT -1 OFFSET ?
+	)`, maxCount)
+}
+
+// ExpiredEmails lists the emails a retention pass would delete
+func (s *SQLiteStorage) ExpiredEmails(before time.Time, maxCount int) ([]*ExpiredEmail, error) {
+	var queries []string
+	var args []interface{}
+	if !before.IsZero() {
+		queries = append(queries, `SELECT id, from_address, subject, size, received_at, 'max_age'
+			FROM emails WHERE received_at < ? AND pinned = 0`)
+		args = append(args, before)
+	}
+	if maxCount > 0 {
+		// The emails left once the old ones are gone
+		queries = append(queries, `SELECT * FROM (
+			SELECT id, from_address, subject, size, received_at, 'max_count'
+			FROM emails WHERE received_at >= ? AND pinned = 0
 			ORDER BY received_at DESC
 			LIMIT -1 OFFSET ?
+		)`)
+		args = append(args, before, maxCount)
+	}
+	if len(queries) == 0 {
+		return nil, nil
+	}
+
+	rows, err := s.reader.Query(strings.Join(queries, " UNION ALL ")+" ORDER BY received_at, id", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var expired []*ExpiredEmail
+	for rows.Next() {
+		var email ExpiredEmail
+		if err := rows.Scan(&email.ID, &email.From, &email.Subject, &email.Size, &email.ReceivedAt, &email.Reason); err != nil {
+			return nil, err
+		}
+		expired = append(expired, &email)
+	}
+	return expired, rows.Err()
+}
+
+// mailboxEmails selects the emails delivered to a mailbox, matching
+// recipients case-insensitively
+const mailboxEmails = `SELECT id, size, received_at FROM emails WHERE id IN (` + mailboxEmailIDs + `)`
+
+// ListMailboxes returns the usage of every recipient address
+func (s *SQLiteStorage) ListMailboxes() ([]*MailboxUsage, error) {
+	rows, err := s.reader.Query(`
+		SELECT address, COUNT(*), COALESCE(SUM(size), 0)
+		FROM (SELECT DISTINCT address, email_id, size FROM email_recipients WHERE ` + mailboxKinds + `)
+		GROUP BY address
+		ORDER BY address
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mailboxes := []*MailboxUsage{}
+	for rows.Next() {
+		var usage MailboxUsage
+		if err := rows.Scan(&usage.Address, &usage.Messages, &usage.Bytes); err != nil {
+			return nil, err
+		}
+		mailboxes = append(mailboxes, &usage)
+	}
+
+	return mailboxes, rows.Err()
+}
+
+// MailboxUsage returns the number and total size of emails delivered to address
+func (s *SQLiteStorage) MailboxUsage(address string) (*MailboxUsage, error) {
+	address = strings.ToLower(address)
+	usage := &MailboxUsage{Address: address}
+	err := s.reader.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM (SELECT DISTINCT email_id, size FROM email_recipients WHERE address = lower(?) AND "+mailboxKinds+")",
+		address).Scan(&usage.Messages, &usage.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// ListTags returns every tag in use, sorted
+func (s *SQLiteStorage) ListTags() ([]string, error) {
+	rows, err := s.reader.Query(`
+		SELECT DISTINCT json_each.value
+		FROM emails, json_each(emails.tags)
+		ORDER BY json_each.value
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []string{}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// EvictMailbox deletes the oldest emails delivered to address until at
+// most maxMessages emails totalling maxBytes remain, and returns their IDs.
+// Negative limits are ignored.
+func (s *SQLiteStorage) EvictMailbox(address string, maxMessages int, maxBytes int64) ([]int64, error) {
+	if maxMessages < 0 && maxBytes < 0 {
+		return nil, nil
+	}
+
+	var conditions []string
+	args := []interface{}{strings.ToLower(address)}
+	if maxMessages >= 0 {
+		conditions = append(conditions, "n > ?")
+		args = append(args, maxMessages)
+	}
+	if maxBytes >= 0 {
+		conditions = append(conditions, "total > ?")
+		args = append(args, maxBytes)
+	}
+
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// The emails are selected in the transaction that deletes them, so
+	// the IDs returned are those deleted
+	rows, err := tx.Query(`
+		SELECT id FROM (
+			SELECT id,
+				ROW_NUMBER() OVER w AS n,
+				SUM(size) OVER w AS total
+			FROM (`+mailboxEmails+`)
+			WINDOW w AS (ORDER BY received_at DESC, id DESC)
 		)
-	`, maxCount)
+		WHERE `+strings.Join(conditions, " OR "), args...)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	var ids []int64
+	var idArgs []interface{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		idArgs = append(idArgs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	_, orphans, err := s.deleteEmailsTx(tx, "id IN ("+placeholders+")", idArgs...)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
 
-	return result.RowsAffected()
+	s.cache.invalidate(ids...)
+	s.deleteExternalBlobs(orphans)
+
+	return ids, nil
+}
+
+// Backup writes a consistent snapshot of the database into dir using
+// VACUUM INTO, which does not block the server while it runs. Blobs held
+// in an external blob store are not part of the snapshot.
+func (s *SQLiteStorage) Backup(dir string) (*BackupInfo, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	now := time.Now()
+	path, err := reserveBackup(dir, now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create backup file: %w", err)
+	}
+
+	if _, err := s.db.Exec("VACUUM INTO ?", path); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to back up database: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info().Str("path", path).Int64("size", info.Size()).Msg("Database backup created")
+
+	return &BackupInfo{
+		Path:      path,
+		Size:      info.Size(),
+		CreatedAt: now,
+	}, nil
+}
+
+// reserveBackup creates an empty file in dir for a backup taken at t,
+// which VACUUM INTO accepts, and returns its path. Backups taken within
+// the same second are numbered.
+func reserveBackup(dir string, t time.Time) (string, error) {
+	name := "gowebmail-" + t.Format("20060102-150405")
+	for n := 1; ; n++ {
+		path := filepath.Join(dir, name+".db")
+		if n > 1 {
+			path = filepath.Join(dir, fmt.Sprintf("%s-%d.db", name, n))
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return path, f.Close()
+	}
+}
+
+// Ping runs a trivial query, which fails when the database file is
+// unavailable or locked for longer than ctx allows
+func (s *SQLiteStorage) Ping(ctx context.Context) error {
+	var tables int
+	return s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master").Scan(&tables)
 }
 
 // Close closes the database connection
 func (s *SQLiteStorage) Close() error {
+	if s.reader != s.db {
+		s.reader.Close()
+	}
 	return s.db.Close()
 }
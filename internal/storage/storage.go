@@ -1,25 +1,129 @@
 package storage
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 // Storage defines the interface for email storage operations
 type Storage interface {
 	// Email operations
 	SaveEmail(email *Email) (int64, error)
+	SaveEmails(emails []*Email) ([]int64, error)
 	GetEmail(id int64) (*Email, error)
+	GetEmailByMessageID(messageID string) (*Email, error)
+	GetRawEmail(id int64) ([]byte, error)
 	ListEmails(filter *EmailFilter, limit, offset int) (*EmailListResult, error)
-	SearchEmails(query string, limit, offset int) (*EmailListResult, error)
+	SearchEmails(query *SearchQuery, filter *EmailFilter, limit, offset int) (*EmailListResult, error)
+	ForEachEmail(filter *EmailFilter, fn func(*Email) error) error
 	DeleteEmail(id int64) error
+	MarkRead(id int64) error
+	MarkUnread(id int64) error
+	UpdateEmail(id int64, update *EmailUpdate) error
+	BatchEmails(ids []int64, op *BatchOperation) ([]BatchItemResult, error)
 	DeleteAllEmails() error
 	GetEmailCount() (int64, error)
 
+	// EmailsVersion returns a value that changes whenever an email is
+	// stored, deleted or updated
+	EmailsVersion() (string, error)
+
+	// Thread operations
+	ListThreads(limit, offset int) (*ThreadListResult, error)
+	GetThread(threadID string) ([]*Email, error)
+
+	// ListTemplates groups the emails matching filter by the first value
+	// of a header, by template name, with the latest samples of each
+	ListTemplates(header string, filter *EmailFilter, samples, limit, offset int) (*TemplateListResult, error)
+
 	// Attachment operations
 	GetAttachment(id int64) (*Attachment, error)
+	ListAttachments(filter *AttachmentFilter, limit, offset int) (*AttachmentListResult, error)
+
+	// Saved search operations. Names are unique; EmailMatches reports
+	// whether an email matches a filter.
+	CreateSavedSearch(search *SavedSearch) error
+	ListSavedSearches() ([]*SavedSearch, error)
+	GetSavedSearch(id int64) (*SavedSearch, error)
+	UpdateSavedSearch(search *SavedSearch) error
+	DeleteSavedSearch(id int64) error
+	EmailMatches(id int64, filter *EmailFilter) (bool, error)
+
+	// Note operations. Notes are deleted with their email; operations on
+	// a missing email or note return ErrNotFound.
+	ListNotes(emailID int64) ([]*Note, error)
+	CreateNote(note *Note) error
+	UpdateNote(note *Note) error
+	DeleteNote(emailID, id int64) error
+
+	// API key operations; keys are looked up by their SHA-256 hash
+	CreateAPIKey(key *APIKey, hash string) error
+	ListAPIKeys() ([]*APIKey, error)
+	FindAPIKey(hash string) (*APIKey, error)
+	DeleteAPIKey(id int64) error
+
+	// Push subscription operations. Creating a subscription that exists,
+	// with the same address and topic or endpoint, updates it instead.
+	// ListPushSubscriptions lists those of an address, or all of them.
+	CreatePushSubscription(sub *PushSubscription) error
+	ListPushSubscriptions(address string) ([]*PushSubscription, error)
+	GetPushSubscription(id int64) (*PushSubscription, error)
+	DeletePushSubscription(id int64) error
+
+	// Job operations. ClaimJobs returns up to limit jobs that are due,
+	// oldest first, counting an attempt of each and postponing it by lease
+	// so that it is not claimed again while it runs. ResumeJobs makes
+	// every job due, for when none can be running. Jobs are deleted with
+	// their email.
+	ClaimJobs(limit int, lease time.Duration) ([]*Job, error)
+	RetryJob(id int64, at time.Time, reason string) error
+	DeleteJob(id int64) error
+	ResumeJobs() error
+	CountJobs() (int64, error)
+
+	// SetEmailChecks saves the spam and DKIM, SPF and DMARC results of an
+	// email, either of which may be nil
+	SetEmailChecks(id int64, spam *SpamResult, auth *AuthResults) error
 
-	// Retention operations
+	// SetUnsubscribeTest saves the outcome of testing the unsubscribe
+	// mechanism of an email with a List-Unsubscribe header
+	SetUnsubscribeTest(id int64, test *UnsubscribeTest) error
+
+	// Audit log operations
+	RecordAudit(entry *AuditEntry) error
+	ListAudit(filter *AuditFilter, limit, offset int) (*AuditListResult, error)
+
+	// Mailbox operations
+	ListMailboxes() ([]*MailboxUsage, error)
+	MailboxUsage(address string) (*MailboxUsage, error)
+	EvictMailbox(address string, maxMessages int, maxBytes int64) ([]int64, error)
+
+	// ListTags returns every tag in use, sorted
+	ListTags() ([]string, error)
+
+	// Statistics
+	Stats() (*StorageStats, error)
+	Analytics(q *AnalyticsQuery) (*Analytics, error)
+	CountEmails(mailboxes []string) (*EmailCounts, error)
+	RecordParseFailure(source string, reason error) error
+
+	// Retention operations; pinned emails are never deleted
 	DeleteOldEmails(before time.Time) (int64, error)
 	DeleteExcessEmails(maxCount int) (int64, error)
 
-	// Lifecycle
+	// ExpiredEmails lists, oldest first, the emails DeleteOldEmails(before)
+	// followed by DeleteExcessEmails(maxCount) would delete. A zero before
+	// or maxCount leaves out that limit.
+	ExpiredEmails(before time.Time, maxCount int) ([]*ExpiredEmail, error)
+
+	// Maintain runs database housekeeping: WAL checkpoint, incremental
+	// vacuum and ANALYZE
+	Maintain(vacuum, analyze bool) (*MaintenanceResult, error)
+
+	// Backup writes a consistent snapshot of the database into dir
+	Backup(dir string) (*BackupInfo, error)
+
+	// Lifecycle. Ping checks that the database answers queries.
+	Ping(ctx context.Context) error
 	Close() error
 }
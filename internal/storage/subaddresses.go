@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"gowebmail/internal/config"
+)
+
+// SetAddresses sets how envelope recipients are normalized to their
+// mailbox for EmailFilter.Inbox. Recipients stored with other settings,
+// or before the settings were kept, are normalized again.
+func (s *SQLiteStorage) SetAddresses(cfg config.AddressesConfig) error {
+	s.addresses = cfg
+	settings, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	var stored string
+	err = s.db.QueryRow("SELECT value FROM settings WHERE name = 'addresses'").Scan(&stored)
+	if err == nil && stored == string(settings) {
+		return nil
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT DISTINCT address FROM email_recipients WHERE kind = ?", recipientEnvelope)
+	if err != nil {
+		return err
+	}
+	var addresses []string
+	for rows.Next() {
+		var address string
+		if err := rows.Scan(&address); err != nil {
+			rows.Close()
+			return err
+		}
+		addresses = append(addresses, address)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, address := range addresses {
+		mailbox, subaddress := normalizeAddress(address, cfg)
+		_, err := tx.Exec("UPDATE email_recipients SET mailbox = ?, subaddress = ? WHERE address = ? AND kind = ?",
+			mailbox, subaddress, address, recipientEnvelope)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("INSERT OR REPLACE INTO settings (name, value) VALUES ('addresses', ?)", string(settings)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.logger.Info().Int("addresses", len(addresses)).Msg("Normalized envelope recipients to their mailboxes")
+	return nil
+}
+
+// loadAddresses sets the address settings to those the stored recipients
+// were normalized with, if any, for a storage whose owner does not call
+// SetAddresses
+func (s *SQLiteStorage) loadAddresses() error {
+	var stored string
+	err := s.db.QueryRow("SELECT value FROM settings WHERE name = 'addresses'").Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(stored), &s.addresses)
+}
+
+// inboxCondition returns the filter condition for EmailFilter.Inbox, and
+// its arguments. An address without a tag matches its mailbox, tagged or
+// not, and one with a tag that subaddress alone.
+func (s *SQLiteStorage) inboxCondition(address string, exact bool) (string, []interface{}) {
+	if exact {
+		return " AND id IN (SELECT email_id FROM email_recipients WHERE address = lower(?) AND kind = '" + recipientEnvelope + "')",
+			[]interface{}{address}
+	}
+	mailbox, subaddress := normalizeAddress(address, s.addresses)
+	if subaddress == "" {
+		return " AND id IN (SELECT email_id FROM email_recipients WHERE mailbox = ? AND kind = '" + recipientEnvelope + "')",
+			[]interface{}{mailbox}
+	}
+	return " AND id IN (SELECT email_id FROM email_recipients WHERE mailbox = ? AND subaddress = ? AND kind = '" + recipientEnvelope + "')",
+		[]interface{}{mailbox, subaddress}
+}
+
+// normalizeAddress returns an address, lower-cased and without its tag or
+// the dots of its local part if they are ignored, and the tag, which
+// starts with its separator
+func normalizeAddress(address string, cfg config.AddressesConfig) (mailbox, subaddress string) {
+	address = strings.ToLower(strings.TrimSpace(address))
+	i := strings.LastIndex(address, "@")
+	if i < 0 {
+		return address, ""
+	}
+	local, domain := address[:i], address[i+1:]
+	if cfg.SubaddressSeparators != "" {
+		if i := strings.IndexAny(local, cfg.SubaddressSeparators); i >= 0 {
+			local, subaddress = local[:i], local[i:]
+		}
+	}
+	if cfg.IgnoreDots {
+		local = strings.ReplaceAll(local, ".", "")
+	}
+	return local + "@" + domain, subaddress
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"net/textproto"
+	"strings"
+)
+
+// templateValue selects the first value of the header named by its
+// parameter, NULL when the email has none or it is blank. Header names are
+// stored canonicalized, as net/textproto does.
+const templateValue = `(SELECT NULLIF(trim(json_extract(value, '$[0]')), '') FROM json_each(emails.headers) WHERE key = ?)`
+
+// ListTemplates groups the emails matching filter by the first value of a
+// header, such as X-Template-ID, in the order of their names
+func (s *SQLiteStorage) ListTemplates(header string, filter *EmailFilter, samples, limit, offset int) (*TemplateListResult, error) {
+	result := &TemplateListResult{Templates: []*TemplateGroup{}}
+	key := textproto.CanonicalMIMEHeaderKey(header)
+	conditions, filterArgs := s.filterConditions(filter)
+	grouped := "SELECT " + templateValue + " AS template, id FROM emails WHERE 1=1" + conditions
+	args := append([]interface{}{key}, filterArgs...)
+
+	err := s.reader.QueryRow(`
+		SELECT COUNT(DISTINCT template), COALESCE(SUM(template IS NULL), 0) FROM (`+grouped+`)
+	`, args...).Scan(&result.Total, &result.Untagged)
+	if err != nil {
+		return nil, err
+	}
+
+	// The first and last emails are joined so the driver parses their
+	// dates as times, which it does not for aggregates
+	rows, err := s.reader.Query(`
+		SELECT g.template, g.count, g.first_id, g.last_id, first.received_at, last.received_at
+		FROM (
+			SELECT template, COUNT(*) AS count, MIN(id) AS first_id, MAX(id) AS last_id FROM (`+grouped+`)
+			WHERE template IS NOT NULL
+			GROUP BY template
+			ORDER BY template
+			LIMIT ? OFFSET ?
+		) AS g
+		JOIN emails AS first ON first.id = g.first_id
+		JOIN emails AS last ON last.id = g.last_id
+		ORDER BY g.template
+	`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, err
+	}
+	byTemplate := make(map[string]*TemplateGroup)
+	for rows.Next() {
+		group := &TemplateGroup{Samples: []*EmailSummary{}}
+		if err := rows.Scan(&group.Template, &group.Count, &group.FirstEmailID, &group.LastEmailID,
+			&group.FirstReceivedAt, &group.LastReceivedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		result.Templates = append(result.Templates, group)
+		byTemplate[group.Template] = group
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if samples > 0 && len(result.Templates) > 0 {
+		if err := s.templateSamples(key, byTemplate, conditions, filterArgs, samples); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// templateSamples sets the samples of groups, the latest emails of each
+// template that match the filter conditions, reading them in one query
+func (s *SQLiteStorage) templateSamples(key string, groups map[string]*TemplateGroup, conditions string, filterArgs []interface{}, limit int) error {
+	placeholders := []string{}
+	templates := []interface{}{}
+	for template := range groups {
+		placeholders = append(placeholders, "?")
+		templates = append(templates, template)
+	}
+	args := append([]interface{}{key}, filterArgs...)
+	args = append(append(args, templates...), limit)
+
+	rows, err := s.reader.Query(`
+		SELECT `+summaryColumns()+`, template FROM (
+			SELECT *, ROW_NUMBER() OVER (PARTITION BY template ORDER BY received_at DESC, id DESC) AS sample
+			FROM (SELECT *, `+templateValue+` AS template FROM emails WHERE 1=1`+conditions+`)
+			WHERE template IN (`+strings.Join(placeholders, ", ")+`)
+		)
+		WHERE sample <= ?
+		ORDER BY template, sample
+	`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var template string
+		email, err := s.scanEmail(rows, &template)
+		if err != nil {
+			return err
+		}
+		email.Preview = makePreview(email.BodyPlain)
+		groups[template].Samples = append(groups[template].Samples, email.Summary())
+	}
+	return rows.Err()
+}
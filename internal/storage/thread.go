@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// maxThreadReferences bounds how many referenced Message-IDs are looked up
+// when assigning a thread; long References headers keep the most recent
+const maxThreadReferences = 50
+
+// threadIDTx assigns a new email to a thread. An email joins the thread of
+// any stored email it replies to or references. Otherwise the thread is
+// named after the first message it references, or its own Message-ID, so
+// replies that arrive before their parent still end up in the same thread.
+func threadIDTx(tx *sql.Tx, email *Email) (string, error) {
+	refs := email.References
+	if len(refs) > maxThreadReferences {
+		refs = refs[len(refs)-maxThreadReferences:]
+	}
+	if email.InReplyTo != "" {
+		refs = append(append([]string(nil), refs...), email.InReplyTo)
+	}
+
+	if len(refs) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(refs)), ", ")
+		args := make([]interface{}, len(refs))
+		for i, ref := range refs {
+			args[i] = ref
+		}
+
+		var threadID string
+		err := tx.QueryRow(`SELECT thread_id FROM emails
+			WHERE message_id IN (`+placeholders+`) AND thread_id != ''
+			ORDER BY id LIMIT 1`, args...).Scan(&threadID)
+		if err == nil {
+			return threadID, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", err
+		}
+	}
+
+	switch {
+	case len(email.References) > 0:
+		return threadKey(email.References[0]), nil
+	case email.InReplyTo != "":
+		return threadKey(email.InReplyTo), nil
+	case email.MessageID != "":
+		return threadKey(email.MessageID), nil
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// threadKey derives a URL-safe thread ID from a Message-ID
+func threadKey(messageID string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(messageID))))
+	return hex.EncodeToString(sum[:8])
+}
+
+// ListThreads returns threads, most recently active first
+func (s *SQLiteStorage) ListThreads(limit, offset int) (*ThreadListResult, error) {
+	result := &ThreadListResult{Threads: []*Thread{}}
+
+	if err := s.reader.QueryRow("SELECT COUNT(DISTINCT thread_id) FROM emails").Scan(&result.Total); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.reader.Query(`
+		SELECT thread_id, COUNT(*), SUM(CASE WHEN read = 0 THEN 1 ELSE 0 END),
+			MIN(id), MAX(id), json_group_array(DISTINCT from_address)
+		FROM emails
+		GROUP BY thread_id
+		ORDER BY MAX(id) DESC
+		LIMIT ? OFFSET ?
+	`, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		thread := &Thread{}
+		var participants string
+		if err := rows.Scan(&thread.ID, &thread.Count, &thread.UnreadCount,
+			&thread.FirstEmailID, &thread.LastEmailID, &participants); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		json.Unmarshal([]byte(participants), &thread.Participants)
+		result.Threads = append(result.Threads, thread)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Dates are read from their rows rather than aggregated so the driver
+	// parses them as times
+	for _, thread := range result.Threads {
+		err := s.reader.QueryRow("SELECT subject, received_at FROM emails WHERE id = ?", thread.FirstEmailID).
+			Scan(&thread.Subject, &thread.FirstReceivedAt)
+		if err != nil {
+			return nil, err
+		}
+		err = s.reader.QueryRow("SELECT received_at FROM emails WHERE id = ?", thread.LastEmailID).
+			Scan(&thread.LastReceivedAt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// GetThread returns the emails of a thread in the order they were received
+func (s *SQLiteStorage) GetThread(threadID string) ([]*Email, error) {
+	rows, err := s.reader.Query("SELECT "+emailColumns("")+" FROM emails WHERE thread_id = ? ORDER BY id", threadID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []*Email
+	for rows.Next() {
+		email, err := s.scanEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(emails) == 0 {
+		return nil, ErrNotFound
+	}
+	return emails, nil
+}
@@ -0,0 +1,321 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/config"
+)
+
+// DefaultEvents are sent to endpoints that do not list events
+var DefaultEvents = []string{"email.new", "email.deleted", "email.released"}
+
+// Delivery statuses
+const (
+	StatusPending   = "pending"
+	StatusDelivered = "delivered"
+	StatusFailed    = "failed"
+)
+
+// SignatureHeader carries the HMAC-SHA256 of the request body, keyed with
+// the endpoint secret, as "sha256=<hex>"
+const SignatureHeader = "X-GoWebMail-Signature"
+
+// Payload is the JSON body posted to endpoints
+type Payload struct {
+	ID        string      `json:"id"` // shared by all deliveries of the event
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Delivery records the attempts to send one event to one endpoint
+type Delivery struct {
+	ID          string     `json:"id"`
+	EventID     string     `json:"eventId"`
+	Event       string     `json:"event"`
+	URL         string     `json:"url"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	StatusCode  int        `json:"statusCode,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+}
+
+// Dispatcher posts events to the configured endpoints, retrying failed
+// deliveries with exponential backoff, and keeps a log of recent deliveries
+type Dispatcher struct {
+	config atomic.Pointer[config.WebhookConfig] // replaced, never modified, by SetConfig
+	client *http.Client
+	logger zerolog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	log []*Delivery // oldest first, at most LogSize entries
+}
+
+// NewDispatcher creates a new webhook dispatcher
+func NewDispatcher(cfg *config.WebhookConfig, logger zerolog.Logger) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		client: &http.Client{},
+		logger: logger.With().Str("component", "webhook").Logger(),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	d.SetConfig(*cfg)
+	return d
+}
+
+// SetConfig replaces the endpoints and delivery settings. Deliveries
+// already under way finish with the settings they started with.
+func (d *Dispatcher) SetConfig(cfg config.WebhookConfig) {
+	cfg.Endpoints = append([]config.WebhookEndpoint(nil), cfg.Endpoints...)
+	d.config.Store(&cfg)
+}
+
+// Enabled reports whether events are dispatched
+func (d *Dispatcher) Enabled() bool {
+	return d.config.Load().Enabled
+}
+
+// Dispatch sends an event to every endpoint subscribed to it. It does not
+// block; deliveries run in the background.
+func (d *Dispatcher) Dispatch(event string, data interface{}) {
+	cfg := d.config.Load()
+	if !cfg.Enabled {
+		return
+	}
+
+	payload := &Payload{
+		ID:        newID(),
+		Event:     event,
+		Timestamp: time.Now().UTC(),
+		Data:      data,
+	}
+
+	var body []byte
+	for i := range cfg.Endpoints {
+		endpoint := &cfg.Endpoints[i]
+		if !subscribed(endpoint, event) || !matchesSearch(endpoint, event, data) {
+			continue
+		}
+
+		if body == nil {
+			var err error
+			body, err = json.Marshal(payload)
+			if err != nil {
+				d.logger.Error().Err(err).Str("event", event).Msg("Failed to encode webhook payload")
+				return
+			}
+		}
+
+		delivery := &Delivery{
+			ID:        newID(),
+			EventID:   payload.ID,
+			Event:     event,
+			URL:       endpoint.URL,
+			Status:    StatusPending,
+			CreatedAt: payload.Timestamp,
+		}
+		d.record(delivery, cfg.LogSize)
+
+		d.wg.Add(1)
+		go d.deliver(cfg, endpoint, delivery, body)
+	}
+}
+
+// matchesSearch reports whether an email.new event is for an email matching
+// the endpoint's saved search. The API lists the matching searches in the
+// savedSearches field of the event data.
+func matchesSearch(endpoint *config.WebhookEndpoint, event string, data interface{}) bool {
+	if endpoint.SavedSearch == "" || event != "email.new" {
+		return true
+	}
+	fields, _ := data.(map[string]interface{})
+	names, _ := fields["savedSearches"].([]string)
+	for _, name := range names {
+		if name == endpoint.SavedSearch {
+			return true
+		}
+	}
+	return false
+}
+
+// subscribed reports whether an endpoint receives an event
+func subscribed(endpoint *config.WebhookEndpoint, event string) bool {
+	events := endpoint.Events
+	if len(events) == 0 {
+		events = DefaultEvents
+	}
+	for _, e := range events {
+		if e == event || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver posts the body until it succeeds, fails permanently or runs out
+// of attempts
+func (d *Dispatcher) deliver(cfg *config.WebhookConfig, endpoint *config.WebhookEndpoint, delivery *Delivery, body []byte) {
+	defer d.wg.Done()
+
+	backoff := cfg.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		statusCode, err := d.post(cfg.Timeout, endpoint, delivery, body)
+		retry := err != nil && retryable(statusCode)
+
+		d.mu.Lock()
+		now := time.Now()
+		delivery.Attempts = attempt
+		delivery.LastAttempt = &now
+		delivery.StatusCode = statusCode
+		delivery.NextAttempt = nil
+		switch {
+		case err == nil:
+			delivery.Status = StatusDelivered
+			delivery.Error = ""
+		case retry && attempt < cfg.MaxAttempts:
+			delivery.Error = err.Error()
+			next := now.Add(backoff)
+			delivery.NextAttempt = &next
+		default:
+			delivery.Status = StatusFailed
+			delivery.Error = err.Error()
+		}
+		status := delivery.Status
+		d.mu.Unlock()
+
+		if status != StatusPending {
+			event := d.logger.Debug()
+			if status == StatusFailed {
+				event = d.logger.Warn().Err(err)
+			}
+			event.
+				Str("event", delivery.Event).
+				Str("url", delivery.URL).
+				Int("attempts", attempt).
+				Msg("Webhook delivery " + status)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-d.ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > cfg.MaxBackoff {
+			backoff = cfg.MaxBackoff
+		}
+	}
+}
+
+// post makes one delivery attempt and returns the response status code
+func (d *Dispatcher) post(timeout time.Duration, endpoint *config.WebhookEndpoint, delivery *Delivery, body []byte) (int, error) {
+	ctx, cancel := d.ctx, context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(d.ctx, timeout)
+	}
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoWebMail-Webhook")
+	req.Header.Set("X-GoWebMail-Event", delivery.Event)
+	req.Header.Set("X-GoWebMail-Delivery", delivery.ID)
+	if endpoint.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(endpoint.Secret, body))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryable reports whether a failed attempt should be retried: network
+// errors, timeouts, rate limiting and server errors are, other client
+// errors are not
+func retryable(statusCode int) bool {
+	return statusCode == 0 ||
+		statusCode == http.StatusRequestTimeout ||
+		statusCode == http.StatusTooManyRequests ||
+		statusCode >= 500
+}
+
+// Sign returns the signature header value for a body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// record adds a delivery to the log, dropping the oldest entries beyond
+// size
+func (d *Dispatcher) record(delivery *Delivery, size int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.log = append(d.log, delivery)
+	if excess := len(d.log) - size; excess > 0 {
+		d.log = append(d.log[:0], d.log[excess:]...)
+	}
+}
+
+// Deliveries returns the logged deliveries, newest first, optionally only
+// those with the given status
+func (d *Dispatcher) Deliveries(status string) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	result := make([]Delivery, 0, len(d.log))
+	for i := len(d.log) - 1; i >= 0; i-- {
+		if status == "" || d.log[i].Status == status {
+			result = append(result, *d.log[i])
+		}
+	}
+	return result
+}
+
+// Stop cancels pending retries and waits for in-flight deliveries
+func (d *Dispatcher) Stop() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
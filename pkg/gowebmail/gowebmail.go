@@ -0,0 +1,512 @@
+// Package gowebmail runs a gowebmail instance inside the calling process,
+// so that integration tests can send mail to it and inspect what arrived,
+// much like httptest.Server does for HTTP:
+//
+//	srv, err := gowebmail.Run(gowebmail.DefaultConfig())
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer srv.Close()
+//
+//	// Point the code under test at srv.SMTPAddr(), then
+//	result, err := srv.Storage().ListEmails(&gowebmail.EmailFilter{}, 10, 0)
+package gowebmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/api"
+	"gowebmail/internal/config"
+	"gowebmail/internal/fixtures"
+	"gowebmail/internal/imap"
+	"gowebmail/internal/ingest"
+	"gowebmail/internal/logging"
+	"gowebmail/internal/mailauth"
+	"gowebmail/internal/mailcrypt"
+	"gowebmail/internal/maintenance"
+	"gowebmail/internal/pop3"
+	"gowebmail/internal/quota"
+	"gowebmail/internal/retention"
+	"gowebmail/internal/smtp"
+	"gowebmail/internal/spam"
+	"gowebmail/internal/storage"
+)
+
+// Config is the configuration of an instance, as read from gowebmail.yml
+type Config = config.Config
+
+// Storage gives access to the captured emails
+type Storage = storage.Storage
+
+// Email is a captured email
+type Email = storage.Email
+
+// EmailFilter selects emails from Storage
+type EmailFilter = storage.EmailFilter
+
+// DefaultConfig returns the default configuration adjusted for running
+// inside tests: every server listens on a random loopback port, emails are
+// kept in memory, retention and maintenance are off and nothing is logged
+func DefaultConfig() *Config {
+	cfg := config.Default()
+
+	cfg.SMTP.Host, cfg.SMTP.Port = "127.0.0.1", 0
+	cfg.HTTP.Host, cfg.HTTP.Port = "127.0.0.1", 0
+	cfg.POP3.Host, cfg.POP3.Port = "127.0.0.1", 0
+	cfg.IMAP.Host, cfg.IMAP.Port = "127.0.0.1", 0
+
+	cfg.Storage.Path = ":memory:"
+	cfg.Retention.Enabled = false
+	cfg.Storage.Maintenance.Enabled = false
+	cfg.Logging.Output = "discard"
+
+	return cfg
+}
+
+// NewLogger creates the logger described by cfg. It sets zerolog's global
+// level, so it applies to every logger in the process.
+func NewLogger(cfg config.LoggingConfig) zerolog.Logger {
+	zerolog.SetGlobalLevel(logLevel(cfg.Level))
+
+	// Configure output
+	var writers []io.Writer
+	var output io.Writer = os.Stdout
+	switch cfg.Output {
+	case "stdout", "":
+	case "discard":
+		output = nil
+	default:
+		file, err := os.OpenFile(cfg.Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err == nil {
+			output = file
+		}
+	}
+
+	// Configure format
+	if output != nil {
+		if cfg.Format == "text" {
+			output = zerolog.ConsoleWriter{Out: output, TimeFormat: time.RFC3339}
+		}
+		writers = append(writers, output)
+	}
+
+	// Copies for log servers, which read the JSON whatever the format
+	if cfg.Syslog.Enabled {
+		writers = append(writers, logging.NewSyslogWriter(&cfg.Syslog))
+	}
+	if cfg.GELF.Enabled {
+		writers = append(writers, logging.NewGELFWriter(&cfg.GELF))
+	}
+
+	switch len(writers) {
+	case 0:
+		return zerolog.Nop()
+	case 1:
+		output = writers[0]
+	default:
+		output = zerolog.MultiLevelWriter(writers...)
+	}
+
+	return zerolog.New(output).With().Timestamp().Logger()
+}
+
+// logLevel returns the level named by logging.level
+func logLevel(name string) zerolog.Level {
+	switch name {
+	case "debug":
+		return zerolog.DebugLevel
+	case "warn":
+		return zerolog.WarnLevel
+	case "error":
+		return zerolog.ErrorLevel
+	default:
+		return zerolog.InfoLevel
+	}
+}
+
+// validate returns an error listing the invalid settings among problems,
+// if any
+func validate(problems []config.Problem) error {
+	errs := config.Errors(problems)
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, p := range errs {
+		msgs[i] = p.String()
+	}
+	return fmt.Errorf("invalid configuration: %s", strings.Join(msgs, "; "))
+}
+
+// Server is a running instance
+type Server struct {
+	logger zerolog.Logger
+	store  storage.Storage
+
+	// config is the configuration last applied, by Start or Reload
+	config    *Config
+	reloadMu  sync.Mutex
+	retention *retention.Manager
+
+	http     *api.Server
+	smtp     *smtp.Server
+	pop3     *pop3.Server
+	imap     *imap.Server
+	pipeline *ingest.Pipeline
+
+	// namespaces keep mail apart from the default namespace
+	namespaces []*namespace
+
+	// Bound addresses; pop3Addr and imapAddr are nil unless enabled
+	httpAddr net.Addr
+	smtpAddr net.Addr
+	pop3Addr net.Addr
+	imapAddr net.Addr
+
+	// stop ends the retention and maintenance schedulers
+	stop context.CancelFunc
+}
+
+// Run starts an instance with the logger described by cfg.Logging. The
+// servers are listening once it returns; a port of 0 picks a free one.
+func Run(cfg *Config) (*Server, error) {
+	return Start(cfg, NewLogger(cfg.Logging))
+}
+
+// Start starts an instance that logs to logger. It fails if cfg has
+// invalid settings; see Config.Validate.
+func Start(cfg *Config, logger zerolog.Logger) (*Server, error) {
+	if err := validate(cfg.Validate()); err != nil {
+		return nil, err
+	}
+
+	store, err := openStorage(cfg, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize storage: %w", err)
+	}
+
+	s := &Server{
+		logger: logger,
+		store:  store,
+		config: cfg,
+	}
+	if err := s.start(cfg); err != nil {
+		s.closeNamespaces()
+		store.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// openStorage opens the storage described by cfg.Storage, normalizing
+// recipients as cfg.Addresses says
+func openStorage(cfg *Config, logger zerolog.Logger) (storage.Storage, error) {
+	sqlite, err := storage.NewSQLiteStorage(&cfg.Storage, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlite.SetAddresses(cfg.Addresses); err != nil {
+		sqlite.Close()
+		return nil, err
+	}
+	var store storage.Storage = sqlite
+	if cfg.Storage.Batch.Enabled {
+		store = storage.NewBatchWriter(store, &cfg.Storage.Batch, logger)
+	}
+	return store, nil
+}
+
+// newPipeline creates the pipeline that stores incoming mail in store,
+// with the checks enabled in cfg
+func newPipeline(cfg *Config, store storage.Storage, logger zerolog.Logger) (*ingest.Pipeline, error) {
+	pipeline := ingest.NewPipeline(store, &cfg.Processing, logger)
+	if cfg.Quotas.Enabled {
+		pipeline.SetQuotaEnforcer(quota.NewEnforcer(&cfg.Quotas, store, logger))
+	}
+	if cfg.MailAuth.Enabled {
+		pipeline.SetAuthVerifier(mailauth.NewVerifier(&cfg.MailAuth, logger))
+	}
+	processor, err := mailcrypt.NewProcessor(&cfg.Decryption, logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize decryption: %w", err)
+	}
+	pipeline.SetCryptProcessor(processor)
+	if cfg.Spam.Enabled {
+		checker, err := spam.NewChecker(&cfg.Spam, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize spam checker: %w", err)
+		}
+		pipeline.SetSpamChecker(checker)
+	}
+	return pipeline, nil
+}
+
+// start creates the servers, binds their listeners and serves
+func (s *Server) start(cfg *Config) error {
+	logger := s.logger
+
+	// Create HTTP server
+	s.http = api.NewServer(cfg, s.store, logger)
+
+	// Create the pipeline shared by SMTP and the import API
+	pipeline, err := newPipeline(cfg, s.store, logger)
+	if err != nil {
+		return err
+	}
+
+	// Create IMAP server
+	if cfg.IMAP.Enabled {
+		s.imap = imap.NewServer(&cfg.IMAP, s.store, logger)
+		s.http.AddReadinessCheck("imap", s.imap.Ready)
+	}
+
+	// Set callback for new emails to broadcast via WebSocket and IMAP IDLE
+	pipeline.SetNewMailCallback(func(email *storage.Email) {
+		s.http.BroadcastNewEmail(email)
+		if s.imap != nil {
+			s.imap.NotifyNewEmail(email)
+		}
+	})
+	pipeline.SetDeletedMailCallback(s.http.BroadcastDeletedEmail)
+	s.http.SetIngestPipeline(pipeline)
+	s.pipeline = pipeline
+
+	// Store the fixtures before anything is served
+	if cfg.Storage.Fixtures != "" {
+		if _, err := fixtures.Load(cfg.Storage.Fixtures, s.store, pipeline, logger); err != nil {
+			return fmt.Errorf("failed to load fixtures: %w", err)
+		}
+	}
+
+	// Namespaces keep their mail apart, each in its own storage
+	if err := s.openNamespaces(cfg); err != nil {
+		return err
+	}
+	namespaces := make(map[string]*api.Server)
+	for _, ns := range s.namespaces {
+		namespaces[ns.config.Name] = ns.http
+	}
+	s.http.SetNamespaces(namespaces)
+
+	// Create SMTP server, which routes mail to the namespaces
+	var deliverer ingest.Deliverer = pipeline
+	if len(s.namespaces) > 0 {
+		deliverer = ingest.NewRouter(pipeline, s.routes(), logger)
+	}
+	s.smtp = smtp.NewServer(&cfg.SMTP, deliverer, logger)
+	s.http.AddReadinessCheck("smtp", s.smtp.Ready)
+
+	// Create POP3 server
+	if cfg.POP3.Enabled {
+		s.pop3 = pop3.NewServer(&cfg.POP3, s.store, logger)
+		s.http.AddReadinessCheck("pop3", s.pop3.Ready)
+	}
+
+	// Bind every listener before serving, so a port in use fails Start
+	var listeners []net.Listener
+	listen := func(host string, port int) (net.Listener, error) {
+		l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		return l, nil
+	}
+
+	smtpListener, err := listen(cfg.SMTP.Host, cfg.SMTP.Port)
+	if err != nil {
+		return fmt.Errorf("SMTP server: %w", err)
+	}
+	httpListener, err := listen(cfg.HTTP.Host, cfg.HTTP.Port)
+	if err != nil {
+		return fmt.Errorf("HTTP server: %w", err)
+	}
+	var pop3Listener, imapListener net.Listener
+	if s.pop3 != nil {
+		if pop3Listener, err = listen(cfg.POP3.Host, cfg.POP3.Port); err != nil {
+			return fmt.Errorf("POP3 server: %w", err)
+		}
+		s.pop3Addr = pop3Listener.Addr()
+	}
+	if s.imap != nil {
+		if imapListener, err = listen(cfg.IMAP.Host, cfg.IMAP.Port); err != nil {
+			return fmt.Errorf("IMAP server: %w", err)
+		}
+		s.imapAddr = imapListener.Addr()
+	}
+	nsListeners := make(map[*namespace]net.Listener)
+	for _, ns := range s.namespaces {
+		if ns.smtp == nil {
+			continue
+		}
+		l, err := listen(cfg.SMTP.Host, ns.config.SMTPPort)
+		if err != nil {
+			return fmt.Errorf("SMTP server of namespace %s: %w", ns.config.Name, err)
+		}
+		nsListeners[ns] = l
+		ns.smtpAddr = l.Addr()
+	}
+	s.smtpAddr = smtpListener.Addr()
+	s.httpAddr = httpListener.Addr()
+
+	// Start retention policy manager
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stop = cancel
+
+	// Runs even when disabled, so Reload can enable it
+	s.retention = retention.NewManager(&cfg.Retention, s.store, logger)
+	s.http.SetRetentionManager(s.retention)
+	go s.retention.Start(ctx)
+
+	// Start database maintenance scheduler
+	maintenanceMgr := maintenance.NewManager(&cfg.Storage.Maintenance, s.store, logger)
+	s.http.SetMaintenanceManager(maintenanceMgr)
+	go maintenanceMgr.Start(ctx)
+	s.startNamespaces(ctx, cfg)
+
+	// Start the workers that check and announce new emails
+	s.pipeline.Start()
+
+	// Start servers in goroutines
+	go s.serve("SMTP", func() error { return s.smtp.Serve(smtpListener) })
+	for ns, l := range nsListeners {
+		go s.serve("SMTP", func() error { return ns.smtp.Serve(l) })
+	}
+	if s.pop3 != nil {
+		go s.serve("POP3", func() error { return s.pop3.Serve(pop3Listener) })
+	}
+	if s.imap != nil {
+		go s.serve("IMAP", func() error { return s.imap.Serve(imapListener) })
+	}
+	go s.serve("HTTP", func() error { return s.http.Serve(httpListener) })
+
+	return nil
+}
+
+// serve runs a server until it is shut down, logging why it stopped if it
+// failed
+func (s *Server) serve(name string, serve func() error) {
+	if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error().Err(err).Msg(name + " server failed")
+	}
+}
+
+// SMTPAddr returns the address the SMTP server listens on, as host:port
+func (s *Server) SMTPAddr() string {
+	return s.smtpAddr.String()
+}
+
+// HTTPAddr returns the address the web UI and API listen on, as host:port
+func (s *Server) HTTPAddr() string {
+	return s.httpAddr.String()
+}
+
+// URL returns the base URL of the web UI and API, e.g. http://127.0.0.1:41234
+func (s *Server) URL() string {
+	return "http://" + s.HTTPAddr()
+}
+
+// POP3Addr returns the address the POP3 server listens on, or "" if it is
+// disabled
+func (s *Server) POP3Addr() string {
+	if s.pop3Addr == nil {
+		return ""
+	}
+	return s.pop3Addr.String()
+}
+
+// IMAPAddr returns the address the IMAP server listens on, or "" if it is
+// disabled
+func (s *Server) IMAPAddr() string {
+	if s.imapAddr == nil {
+		return ""
+	}
+	return s.imapAddr.String()
+}
+
+// Storage returns the instance's storage, for reading captured emails
+// directly. It is closed by Shutdown.
+func (s *Server) Storage() Storage {
+	return s.store
+}
+
+// Shutdown gracefully shuts down the servers and closes the storage
+func (s *Server) Shutdown(ctx context.Context) error {
+	var errs []error
+
+	// Shutdown servers gracefully
+	s.logger.Info().Msg("Shutting down SMTP server...")
+	if err := s.smtp.Shutdown(ctx); err != nil {
+		s.logger.Error().Err(err).Msg("SMTP server shutdown error")
+		errs = append(errs, err)
+	}
+	for _, ns := range s.namespaces {
+		if ns.smtp == nil {
+			continue
+		}
+		if err := ns.smtp.Shutdown(ctx); err != nil {
+			ns.logger.Error().Err(err).Msg("SMTP server shutdown error")
+			errs = append(errs, err)
+		}
+	}
+
+	if s.pop3 != nil {
+		s.logger.Info().Msg("Shutting down POP3 server...")
+		if err := s.pop3.Shutdown(ctx); err != nil {
+			s.logger.Error().Err(err).Msg("POP3 server shutdown error")
+			errs = append(errs, err)
+		}
+	}
+
+	if s.imap != nil {
+		s.logger.Info().Msg("Shutting down IMAP server...")
+		if err := s.imap.Shutdown(ctx); err != nil {
+			s.logger.Error().Err(err).Msg("IMAP server shutdown error")
+			errs = append(errs, err)
+		}
+	}
+
+	s.logger.Info().Msg("Shutting down HTTP server...")
+	if err := s.http.Shutdown(ctx); err != nil {
+		s.logger.Error().Err(err).Msg("HTTP server shutdown error")
+		errs = append(errs, err)
+	}
+
+	// Nothing is delivered any more; let the jobs in progress finish
+	s.pipeline.Stop()
+	for _, ns := range s.namespaces {
+		ns.pipeline.Stop()
+	}
+
+	s.stop()
+	if err := s.store.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, s.closeNamespaces()...)
+
+	s.logger.Info().Msg("Shutdown complete")
+	return errors.Join(errs...)
+}
+
+// Close shuts the instance down, giving open connections up to 30 seconds
+// to finish
+func (s *Server) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
@@ -0,0 +1,125 @@
+package gowebmail
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/rs/zerolog"
+
+	"gowebmail/internal/api"
+	"gowebmail/internal/config"
+	"gowebmail/internal/ingest"
+	"gowebmail/internal/maintenance"
+	"gowebmail/internal/retention"
+	"gowebmail/internal/smtp"
+	"gowebmail/internal/storage"
+)
+
+// namespace is the part of an instance that serves one namespace: its own
+// storage and pipeline, the API served under /ns/<name>/, and the SMTP
+// server of its own port, if it has one
+type namespace struct {
+	config    config.NamespaceConfig
+	logger    zerolog.Logger
+	store     storage.Storage
+	pipeline  *ingest.Pipeline
+	http      *api.Server
+	retention *retention.Manager
+
+	smtp     *smtp.Server
+	smtpAddr net.Addr
+}
+
+// openNamespaces opens the storage of every namespace and creates their
+// servers. The namespaces opened are kept in s.namespaces even if it
+// fails, for closeNamespaces.
+func (s *Server) openNamespaces(cfg *Config) error {
+	for _, nsCfg := range cfg.Namespaces {
+		nsConfig := cfg.Namespace(nsCfg)
+		logger := s.logger.With().Str("namespace", nsCfg.Name).Logger()
+
+		store, err := openStorage(nsConfig, logger)
+		if err != nil {
+			return fmt.Errorf("namespace %s: failed to initialize storage: %w", nsCfg.Name, err)
+		}
+		ns := &namespace{
+			config: nsCfg,
+			logger: logger,
+			store:  store,
+			http:   api.NewServer(nsConfig, store, logger),
+		}
+		s.namespaces = append(s.namespaces, ns)
+
+		if ns.pipeline, err = newPipeline(nsConfig, store, logger); err != nil {
+			return fmt.Errorf("namespace %s: %w", nsCfg.Name, err)
+		}
+		ns.pipeline.SetNewMailCallback(ns.http.BroadcastNewEmail)
+		ns.pipeline.SetDeletedMailCallback(ns.http.BroadcastDeletedEmail)
+		ns.http.SetIngestPipeline(ns.pipeline)
+
+		if nsCfg.SMTPPort != 0 {
+			ns.smtp = smtp.NewServer(&nsConfig.SMTP, ns.pipeline, logger)
+			s.http.AddReadinessCheck("smtp "+nsCfg.Name, ns.smtp.Ready)
+		}
+	}
+	return nil
+}
+
+// routes returns the routes of the SMTP router, in configuration order
+func (s *Server) routes() []ingest.Route {
+	routes := make([]ingest.Route, len(s.namespaces))
+	for i, ns := range s.namespaces {
+		routes[i] = ingest.Route{Namespace: &ns.config, Pipeline: ns.pipeline}
+	}
+	return routes
+}
+
+// startNamespaces starts the schedulers and workers of every namespace,
+// with the retention and maintenance settings of the instance
+func (s *Server) startNamespaces(ctx context.Context, cfg *Config) {
+	for _, ns := range s.namespaces {
+		ns.retention = retention.NewManager(&cfg.Retention, ns.store, ns.logger)
+		ns.http.SetRetentionManager(ns.retention)
+		go ns.retention.Start(ctx)
+
+		maintenanceMgr := maintenance.NewManager(&cfg.Storage.Maintenance, ns.store, ns.logger)
+		ns.http.SetMaintenanceManager(maintenanceMgr)
+		go maintenanceMgr.Start(ctx)
+
+		ns.pipeline.Start()
+	}
+}
+
+// closeNamespaces closes the storage of every namespace
+func (s *Server) closeNamespaces() []error {
+	var errs []error
+	for _, ns := range s.namespaces {
+		if err := ns.store.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("namespace %s: %w", ns.config.Name, err))
+		}
+	}
+	return errs
+}
+
+// NamespaceStorage returns the storage of a namespace, or false if there
+// is no namespace of that name
+func (s *Server) NamespaceStorage(name string) (Storage, bool) {
+	for _, ns := range s.namespaces {
+		if ns.config.Name == name {
+			return ns.store, true
+		}
+	}
+	return nil, false
+}
+
+// NamespaceSMTPAddr returns the address of a namespace's own SMTP
+// listener, or "" if it has none
+func (s *Server) NamespaceSMTPAddr(name string) string {
+	for _, ns := range s.namespaces {
+		if ns.config.Name == name && ns.smtpAddr != nil {
+			return ns.smtpAddr.String()
+		}
+	}
+	return ""
+}
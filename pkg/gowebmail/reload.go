@@ -0,0 +1,85 @@
+package gowebmail
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// Reload applies the settings of cfg that can change while running:
+// logging.level, retention, web.auth other than OIDC, webhooks and
+// notifications. Connections are kept, so SMTP sessions under way are not
+// interrupted. Other settings that differ are logged as needing a restart.
+// If cfg has invalid settings, nothing changes and an error is returned.
+func (s *Server) Reload(cfg *Config) error {
+	problems := cfg.Validate()
+	if err := validate(problems); err != nil {
+		return err
+	}
+	for _, p := range problems {
+		s.logger.Warn().Str("setting", p.Field).Msg(p.Message)
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	old := s.config
+	applied := reloadable(old, cfg)
+	zerolog.SetGlobalLevel(logLevel(applied.Logging.Level))
+	s.retention.SetConfig(applied.Retention)
+	for _, ns := range s.namespaces {
+		ns.retention.SetConfig(applied.Retention)
+	}
+	s.http.Reload(applied)
+	s.config = applied
+
+	if ignored := changedSettings(applied, cfg); len(ignored) > 0 {
+		s.logger.Warn().Strs("settings", ignored).Msg("Changed settings take effect after a restart")
+	}
+	s.logger.Info().Strs("changed", changedSettings(old, applied)).Msg("Configuration reloaded")
+	return nil
+}
+
+// reloadable returns old with the settings of cfg that Reload applies
+func reloadable(old, cfg *Config) *Config {
+	applied := *old
+	applied.Logging.Level = cfg.Logging.Level
+	applied.Retention = cfg.Retention
+	applied.Webhooks = cfg.Webhooks
+	applied.Notifications = cfg.Notifications
+	applied.Web.Auth = cfg.Web.Auth
+	applied.Web.Auth.OIDC = old.Web.Auth.OIDC
+	return &applied
+}
+
+// changedSettings returns the YAML paths of the settings that differ
+// between a and b, e.g. smtp.port, down to the first field that is not a
+// section
+func changedSettings(a, b *Config) []string {
+	changed := []string{}
+	diffSettings(reflect.ValueOf(*a), reflect.ValueOf(*b), "", &changed)
+	return changed
+}
+
+func diffSettings(a, b reflect.Value, path string, changed *[]string) {
+	if a.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+			*changed = append(*changed, path)
+		}
+		return
+	}
+
+	for i := 0; i < a.NumField(); i++ {
+		field := a.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		fieldPath := path
+		if name != "" { // inline sections share the path of their parent
+			fieldPath = strings.TrimPrefix(path+"."+name, ".")
+		}
+		diffSettings(a.Field(i), b.Field(i), fieldPath, changed)
+	}
+}
@@ -0,0 +1,234 @@
+// Package mailtest provides assertions on the emails captured by an
+// instance started with package gowebmail:
+//
+//	e := mailtest.WaitForEmail(t, srv.Storage(), mailtest.All(
+//		mailtest.To("user@example.com"),
+//		mailtest.SubjectContains("Reset your password"),
+//	), 5*time.Second)
+//	mailtest.MatchSnapshot(t, e, "password-reset")
+package mailtest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"gowebmail/pkg/gowebmail"
+)
+
+// pollInterval is how often Wait looks for new emails
+const pollInterval = 20 * time.Millisecond
+
+// Matcher selects emails. String describes the emails it selects, for
+// failure messages.
+type Matcher interface {
+	Match(e *gowebmail.Email) bool
+	String() string
+}
+
+// matcher is a Matcher made from a function
+type matcher struct {
+	desc  string
+	match func(e *gowebmail.Email) bool
+}
+
+func (m *matcher) Match(e *gowebmail.Email) bool { return m.match(e) }
+func (m *matcher) String() string                { return m.desc }
+
+// Any matches every email
+func Any() Matcher {
+	return &matcher{"any email", func(*gowebmail.Email) bool { return true }}
+}
+
+// All matches emails that every one of ms matches
+func All(ms ...Matcher) Matcher {
+	descs := make([]string, len(ms))
+	for i, m := range ms {
+		descs[i] = m.String()
+	}
+	return &matcher{strings.Join(descs, " and "), func(e *gowebmail.Email) bool {
+		for _, m := range ms {
+			if !m.Match(e) {
+				return false
+			}
+		}
+		return true
+	}}
+}
+
+// Subject matches emails whose subject is s
+func Subject(s string) Matcher {
+	return &matcher{fmt.Sprintf("subject %q", s), func(e *gowebmail.Email) bool {
+		return e.Subject == s
+	}}
+}
+
+// SubjectContains matches emails whose subject contains s
+func SubjectContains(s string) Matcher {
+	return &matcher{fmt.Sprintf("subject containing %q", s), func(e *gowebmail.Email) bool {
+		return strings.Contains(e.Subject, s)
+	}}
+}
+
+// From matches emails sent from addr, by header or envelope
+func From(addr string) Matcher {
+	return &matcher{"from " + addr, func(e *gowebmail.Email) bool {
+		return containsAddress(e.From, addr) || strings.EqualFold(e.EnvelopeFrom, addr)
+	}}
+}
+
+// To matches emails addressed to addr in To, Cc or Bcc, or delivered to it
+// by the envelope
+func To(addr string) Matcher {
+	return &matcher{"to " + addr, func(e *gowebmail.Email) bool {
+		for _, list := range [][]string{e.To, e.CC, e.BCC, e.EnvelopeTo} {
+			for _, rcpt := range list {
+				if containsAddress(rcpt, addr) {
+					return true
+				}
+			}
+		}
+		return false
+	}}
+}
+
+// containsAddress reports whether field, e.g. "Jane <jane@example.com>",
+// holds addr. Addresses are compared case-insensitively.
+func containsAddress(field, addr string) bool {
+	field, addr = strings.ToLower(field), strings.ToLower(addr)
+	return field == addr || strings.Contains(field, "<"+addr+">")
+}
+
+// BodyContains matches emails whose text or HTML body contains s
+func BodyContains(s string) Matcher {
+	return &matcher{fmt.Sprintf("body containing %q", s), func(e *gowebmail.Email) bool {
+		return strings.Contains(e.BodyPlain, s) || strings.Contains(e.BodyHTML, s)
+	}}
+}
+
+// HasAttachment matches emails with an attachment named filename, or with
+// any attachment if filename is empty
+func HasAttachment(filename string) Matcher {
+	desc := "an attachment"
+	if filename != "" {
+		desc = fmt.Sprintf("attachment %q", filename)
+	}
+	return &matcher{desc, func(e *gowebmail.Email) bool {
+		for _, a := range e.Attachments {
+			if filename == "" || a.Filename == filename {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// HasInline matches emails with an inline part, such as an image of the
+// HTML body, of this Content-ID, or with any inline part if contentID is
+// empty
+func HasInline(contentID string) Matcher {
+	desc := "an inline part"
+	if contentID != "" {
+		desc = fmt.Sprintf("inline part <%s>", contentID)
+	}
+	return &matcher{desc, func(e *gowebmail.Email) bool {
+		for _, a := range e.Attachments {
+			if a.Inline && (contentID == "" || strings.EqualFold(a.ContentID, contentID)) {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// HasTag matches emails with tag
+func HasTag(tag string) Matcher {
+	return &matcher{"tag " + tag, func(e *gowebmail.Email) bool {
+		for _, t := range e.Tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	}}
+}
+
+// Find returns the newest stored email that m matches, or nil if there is
+// none
+func Find(store gowebmail.Storage, m Matcher) (*gowebmail.Email, error) {
+	return find(store, m, nil)
+}
+
+// find is Find, skipping the emails in seen and adding the emails it
+// checks to it
+func find(store gowebmail.Storage, m Matcher, seen map[int64]bool) (*gowebmail.Email, error) {
+	const pageSize = 100
+	for offset := 0; ; offset += pageSize {
+		result, err := store.ListEmails(&gowebmail.EmailFilter{}, pageSize, offset)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, listed := range result.Emails {
+			if seen[listed.ID] {
+				continue
+			}
+			// Listed emails lack attachments
+			e, err := store.GetEmail(listed.ID)
+			if err != nil {
+				// Deleted since it was listed
+				continue
+			}
+			if seen != nil {
+				seen[e.ID] = true
+			}
+			if m.Match(e) {
+				return e, nil
+			}
+		}
+
+		if len(result.Emails) < pageSize {
+			return nil, nil
+		}
+	}
+}
+
+// Wait returns the newest email that m matches, waiting up to timeout for
+// one to arrive. Emails stored before Wait is called count.
+func Wait(store gowebmail.Storage, m Matcher, timeout time.Duration) (*gowebmail.Email, error) {
+	deadline := time.Now().Add(timeout)
+	seen := make(map[int64]bool)
+	for {
+		e, err := find(store, m, seen)
+		if err != nil || e != nil {
+			return e, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no email with %s within %s", m, timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// WaitForEmail is Wait that fails t if no email arrives in time
+func WaitForEmail(t testing.TB, store gowebmail.Storage, m Matcher, timeout time.Duration) *gowebmail.Email {
+	t.Helper()
+	e, err := Wait(store, m, timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// AssertNoEmail fails t if an email that m matches is stored
+func AssertNoEmail(t testing.TB, store gowebmail.Storage, m Matcher) {
+	t.Helper()
+	e, err := Find(store, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e != nil {
+		t.Fatalf("unexpected email with %s: #%d %q", m, e.ID, e.Subject)
+	}
+}
@@ -0,0 +1,102 @@
+package mailtest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gowebmail/pkg/gowebmail"
+)
+
+// UpdateSnapshotsEnv is the environment variable that makes MatchSnapshot
+// write the bodies it is given instead of comparing them
+const UpdateSnapshotsEnv = "GOWEBMAIL_UPDATE_SNAPSHOTS"
+
+// SnapshotDir is where MatchSnapshot keeps snapshots, relative to the
+// package under test
+var SnapshotDir = filepath.Join("testdata", "snapshots")
+
+// MatchSnapshot compares the text and HTML bodies of e with the snapshots
+// <name>.txt and <name>.html in SnapshotDir. Missing snapshots are written,
+// as are all of them when UpdateSnapshotsEnv is set.
+//
+// Line endings and trailing whitespace are normalized. Bodies containing
+// values that change between runs, such as tokens, should be passed
+// through replace first, e.g. with strings.NewReplacer(token, "TOKEN").
+func MatchSnapshot(t testing.TB, e *gowebmail.Email, name string, replace ...*strings.Replacer) {
+	t.Helper()
+
+	for _, body := range []struct {
+		ext, content string
+	}{{".txt", e.BodyPlain}, {".html", e.BodyHTML}} {
+		content := body.content
+		for _, r := range replace {
+			content = r.Replace(content)
+		}
+		matchSnapshot(t, filepath.Join(SnapshotDir, name+body.ext), normalizeBody(content))
+	}
+}
+
+// matchSnapshot compares got with the snapshot at path
+func matchSnapshot(t testing.TB, path, got string) {
+	t.Helper()
+
+	want, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) || os.Getenv(UpdateSnapshotsEnv) != "" {
+		if got == "" && errors.Is(err, os.ErrNotExist) {
+			// Don't write snapshots of missing bodies
+			return
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("wrote snapshot %s", path)
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(want) != got {
+		t.Errorf("body differs from snapshot %s (set %s=1 to update it)\n%s", path, UpdateSnapshotsEnv, firstDifference(string(want), got))
+	}
+}
+
+// normalizeBody makes line endings and trailing whitespace consistent, so
+// that snapshots are stable across encodings and editors
+func normalizeBody(body string) string {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	if body == "" {
+		return ""
+	}
+
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n") + "\n"
+}
+
+// firstDifference describes the first line where want and got differ
+func firstDifference(want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	for i := 0; ; i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g || i >= len(wantLines) || i >= len(gotLines) {
+			return fmt.Sprintf("line %d:\n  want: %q\n  got:  %q", i+1, w, g)
+		}
+	}
+}
@@ -1,44 +1,137 @@
+// Namespaces serve the UI under /ns/<name>/, and their API beside it
+const basePath = (window.location.pathname.match(/^\/ns\/[^/]+/) || [''])[0];
+
 // API Client
 class APIClient {
-    constructor(baseURL = '/api') {
+    constructor(baseURL = `${basePath}/api`) {
         this.baseURL = baseURL;
+        this.csrfToken = null;
+        this.onUnauthorized = null;
+    }
+
+    // Requests carry X-Requested-With, so that the server answers 401
+    // without the browser's basic auth popup, and those that change
+    // something carry the session's CSRF token
+    async request(path, options = {}) {
+        const headers = { 'X-Requested-With': 'XMLHttpRequest', ...options.headers };
+        const method = options.method || 'GET';
+        if (this.csrfToken && method !== 'GET' && method !== 'HEAD') {
+            headers['X-CSRF-Token'] = this.csrfToken;
+        }
+        const response = await fetch(`${this.baseURL}${path}`, { ...options, headers });
+        if (response.status === 401 && this.onUnauthorized && path !== '/login') {
+            this.onUnauthorized();
+        }
+        return response;
+    }
+
+    async getSession() {
+        const response = await this.request('/session');
+        if (!response.ok) {
+            return null;
+        }
+        const data = await response.json();
+        this.csrfToken = data.data.csrfToken || null;
+        return data.data;
+    }
+
+    async login(username, password) {
+        const response = await this.request('/login', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ username, password })
+        });
+        const data = await response.json();
+        if (!data.success) {
+            throw new Error(data.error.message);
+        }
+        this.csrfToken = data.data.csrfToken;
+        return data.data;
+    }
+
+    async logout() {
+        await this.request('/logout', { method: 'POST' });
+        this.csrfToken = null;
     }
 
     async listEmails(params = {}) {
         const query = new URLSearchParams(params).toString();
-        const response = await fetch(`${this.baseURL}/emails?${query}`);
+        const response = await this.request(`/emails?${query}`);
         const data = await response.json();
         return data.success ? data.data : null;
     }
 
     async getEmail(id) {
-        const response = await fetch(`${this.baseURL}/emails/${id}`);
+        const response = await this.request(`/emails/${id}`);
+        const data = await response.json();
+        return data.success ? data.data : null;
+    }
+
+    async updateEmail(id, fields) {
+        const response = await this.request(`/emails/${id}`, {
+            method: 'PATCH',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(fields)
+        });
         const data = await response.json();
         return data.success ? data.data : null;
     }
 
+    async getAMP(id) {
+        const response = await this.request(`/emails/${id}/amp`);
+        const data = await response.json();
+        return data.success ? data.data : null;
+    }
+
+    async testUnsubscribe(id) {
+        const response = await this.request(`/emails/${id}/unsubscribe-test`, {
+            method: 'POST'
+        });
+        const data = await response.json();
+        if (!data.success) {
+            throw new Error(data.error?.message || 'Unsubscribe test failed');
+        }
+        return data.data;
+    }
+
     async deleteEmail(id) {
-        const response = await fetch(`${this.baseURL}/emails/${id}`, {
+        const response = await this.request(`/emails/${id}`, {
             method: 'DELETE'
         });
         return response.ok;
     }
 
     async deleteAllEmails() {
-        const response = await fetch(`${this.baseURL}/emails`, {
+        const response = await this.request('/emails', {
             method: 'DELETE'
         });
         return response.ok;
     }
 
     async searchEmails(query) {
-        const response = await fetch(`${this.baseURL}/emails/search?q=${encodeURIComponent(query)}`);
+        const response = await this.request(`/emails/search?q=${encodeURIComponent(query)}`);
         const data = await response.json();
         return data.success ? data.data : null;
     }
 
     async getStats() {
-        const response = await fetch(`${this.baseURL}/stats`);
+        const response = await this.request('/stats');
+        const data = await response.json();
+        return data.success ? data.data : null;
+    }
+
+    async getPush() {
+        const response = await this.request('/push');
+        const data = await response.json();
+        return data.success ? data.data : null;
+    }
+
+    async createPushSubscription(subscription) {
+        const response = await this.request('/push/subscriptions', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(subscription)
+        });
         const data = await response.json();
         return data.success ? data.data : null;
     }
@@ -46,7 +139,7 @@ class APIClient {
 
 // WebSocket Client
 class WebSocketClient {
-    constructor(url = '/ws') {
+    constructor(url = `${basePath}/ws`) {
         this.url = url;
         this.ws = null;
         this.listeners = {};
@@ -113,11 +206,134 @@ class App {
         this.init();
     }
 
-    init() {
+    async init() {
         this.setupEventListeners();
+        this.setupLogin();
+
+        // Without a session, the login form is shown and start runs once
+        // signed in
+        this.session = await this.api.getSession();
+        if (this.session) {
+            this.start();
+        }
+    }
+
+    start() {
+        this.started = true;
+        this.showSession();
         this.setupWebSocket();
-        this.loadEmails();
+        this.loadEmails().then(() => this.openLinkedEmail());
         this.updateStats();
+        this.setupPush();
+    }
+
+    setupLogin() {
+        this.api.onUnauthorized = () => this.showLogin(true);
+
+        document.getElementById('login-form').addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const error = document.getElementById('login-error');
+            const password = document.getElementById('login-password');
+            try {
+                this.session = await this.api.login(document.getElementById('login-username').value, password.value);
+            } catch (err) {
+                error.textContent = err.message;
+                error.style.display = '';
+                return;
+            }
+            password.value = '';
+            error.style.display = 'none';
+
+            // A session that expired while the app was open: reload, so
+            // the WebSocket connects as the user signed in now
+            if (this.started) {
+                window.location.reload();
+                return;
+            }
+            this.showLogin(false);
+            this.start();
+        });
+
+        document.getElementById('logout-btn').addEventListener('click', async () => {
+            await this.api.logout();
+            window.location.reload();
+        });
+    }
+
+    showLogin(show) {
+        document.getElementById('login').style.display = show ? 'flex' : 'none';
+        if (show) {
+            document.getElementById('login-username').focus();
+        }
+    }
+
+    // Shows who is signed in, and the logout button for password sessions
+    showSession() {
+        if (this.session.auth !== 'session') {
+            return;
+        }
+        document.getElementById('session-user').textContent = this.session.username;
+        document.getElementById('session-user').style.display = '';
+        document.getElementById('logout-btn').style.display = '';
+    }
+
+    // Offer desktop notifications of new mail for an address when the
+    // server has Web Push configured and the browser supports it
+    async setupPush() {
+        if (!('serviceWorker' in navigator) || !('PushManager' in window)) {
+            return;
+        }
+        const push = await this.api.getPush();
+        if (!push || !push.enabled || !push.vapidPublicKey) {
+            return;
+        }
+
+        const button = document.getElementById('push-btn');
+        button.style.display = '';
+        button.addEventListener('click', () => this.subscribePush(push.vapidPublicKey));
+    }
+
+    async subscribePush(vapidPublicKey) {
+        const address = prompt('Notify me of new mail to:', localStorage.getItem('pushAddress') || '');
+        if (!address) {
+            return;
+        }
+        localStorage.setItem('pushAddress', address);
+
+        try {
+            if (await Notification.requestPermission() !== 'granted') {
+                alert('Notifications are blocked for this site');
+                return;
+            }
+            const registration = await navigator.serviceWorker.register('sw.js');
+            await navigator.serviceWorker.ready;
+            const subscription = await registration.pushManager.subscribe({
+                userVisibleOnly: true,
+                applicationServerKey: this.decodeBase64URL(vapidPublicKey)
+            });
+
+            const { endpoint, keys } = subscription.toJSON();
+            const result = await this.api.createPushSubscription({ address, type: 'webpush', endpoint, keys });
+            alert(result ? `You will be notified of new mail to ${address}` : 'Subscribing failed');
+        } catch (e) {
+            console.error('Push subscription failed:', e);
+            alert(`Subscribing failed: ${e.message}`);
+        }
+    }
+
+    decodeBase64URL(text) {
+        const base64 = (text + '='.repeat((4 - text.length % 4) % 4)).replace(/-/g, '+').replace(/_/g, '/');
+        return Uint8Array.from(atob(base64), c => c.charCodeAt(0));
+    }
+
+    // Notifications link to an email as #email-<id>
+    openLinkedEmail() {
+        const match = window.location.hash.match(/^#email-(\d+)$/);
+        if (!match) {
+            return;
+        }
+        const id = Number(match[1]);
+        this.selectEmail(this.emails.find(e => e.id === id) || { id, read: true });
     }
 
     setupEventListeners() {
@@ -174,6 +390,10 @@ class App {
             this.handleEmailDeleted(data);
         });
 
+        this.ws.on('email.read', (data) => {
+            this.handleEmailRead(data);
+        });
+
         this.ws.on('emails.cleared', () => {
             this.handleEmailsCleared();
         });
@@ -238,9 +458,9 @@ class App {
         const subject = email.subject || '(No subject)';
 
         return `
-            <div class="email-item ${email.id === this.selectedEmail?.id ? 'selected' : ''}" data-id="${email.id}">
+            <div class="email-item ${email.id === this.selectedEmail?.id ? 'selected' : ''} ${email.read ? '' : 'unread'}" data-id="${email.id}">
                 <div class="email-from">${this.escapeHtml(from)}</div>
-                <div class="email-subject">${this.escapeHtml(subject)}</div>
+                <div class="email-subject">${email.priority === 'high' ? '<span class="email-priority" title="High priority">!</span>' : ''}${this.escapeHtml(subject)}</div>
                 <div class="email-meta">
                     <span>${timeStr}</span>
                     <span>${this.formatSize(email.size)}</span>
@@ -261,6 +481,46 @@ class App {
         if (fullEmail) {
             this.renderEmailPreview(fullEmail);
         }
+
+        // Mark as read
+        if (!email.read) {
+            email.read = true;
+            this.renderEmailList();
+            this.api.updateEmail(email.id, { read: true });
+        }
+    }
+
+    describeSecurity(security) {
+        const parts = [security.format === 'smime' ? 'S/MIME' : 'PGP'];
+        if (security.encrypted) {
+            parts.push(security.decrypted ? 'encrypted, decrypted' : 'encrypted');
+        }
+        (security.signatures || []).forEach(sig => {
+            const signer = sig.signer || sig.keyId || 'unknown signer';
+            const result = { pass: 'valid', fail: 'invalid', none: 'not verified' }[sig.result] || sig.result;
+            parts.push(`signed by ${signer} (${result})`);
+        });
+        if (security.signed && !(security.signatures || []).length) {
+            parts.push('signed');
+        }
+        if (security.reason) {
+            parts.push(security.reason);
+        }
+        return parts.join('; ');
+    }
+
+    describeUnsubscribe(unsubscribe) {
+        const parts = [unsubscribe.oneClick ? 'one-click' : 'no one-click'];
+        if (unsubscribe.mailto && unsubscribe.mailto.length > 0) {
+            parts.push('mailto');
+        }
+        parts.push(...(unsubscribe.problems || []));
+        if (unsubscribe.test) {
+            const results = unsubscribe.test.results.map(result =>
+                `${result.method} ${result.status}${result.statusCode ? ` (${result.statusCode})` : ''}${result.error ? `: ${result.error}` : ''}`);
+            parts.push(`last test: ${results.join(', ')}`);
+        }
+        return parts.join('; ');
     }
 
     renderEmailPreview(email) {
@@ -277,27 +537,82 @@ class App {
                         <div class="email-detail-label">From:</div>
                         <div class="email-detail-value">${this.escapeHtml(email.from)}</div>
                     </div>
+                    ${email.sender && email.sender !== email.from ? `
+                    <div class="email-detail">
+                        <div class="email-detail-label">Sender:</div>
+                        <div class="email-detail-value">${this.escapeHtml(email.sender)}</div>
+                    </div>
+                    ` : ''}
+                    ${email.replyTo && email.replyTo.length > 0 ? `
+                    <div class="email-detail">
+                        <div class="email-detail-label">Reply-To:</div>
+                        <div class="email-detail-value">${this.escapeHtml(email.replyTo.join(', '))}</div>
+                    </div>
+                    ` : ''}
+                    ${email.returnPath && email.returnPath !== email.from ? `
+                    <div class="email-detail">
+                        <div class="email-detail-label">Return-Path:</div>
+                        <div class="email-detail-value">${this.escapeHtml(email.returnPath)}</div>
+                    </div>
+                    ` : ''}
                     <div class="email-detail">
                         <div class="email-detail-label">To:</div>
                         <div class="email-detail-value">${this.escapeHtml(email.to.join(', '))}</div>
                     </div>
+                    ${email.envelopeTo && email.envelopeTo.length > 0 && email.envelopeTo.join(',') !== (email.to || []).join(',') ? `
+                    <div class="email-detail">
+                        <div class="email-detail-label">Delivered To:</div>
+                        <div class="email-detail-value">${this.escapeHtml(email.envelopeTo.join(', '))}</div>
+                    </div>
+                    ` : ''}
                     ${email.cc && email.cc.length > 0 ? `
                     <div class="email-detail">
                         <div class="email-detail-label">CC:</div>
                         <div class="email-detail-value">${this.escapeHtml(email.cc.join(', '))}</div>
                     </div>
                     ` : ''}
+                    ${email.security ? `
+                    <div class="email-detail">
+                        <div class="email-detail-label">Security:</div>
+                        <div class="email-detail-value">${this.escapeHtml(this.describeSecurity(email.security))}</div>
+                    </div>
+                    ` : ''}
+                    ${email.unsubscribe ? `
+                    <div class="email-detail">
+                        <div class="email-detail-label">Unsubscribe:</div>
+                        <div class="email-detail-value">
+                            ${this.escapeHtml(this.describeUnsubscribe(email.unsubscribe))}
+                            <button class="email-unsubscribe-test" id="unsubscribe-test-btn">Test unsubscribe</button>
+                        </div>
+                    </div>
+                    ` : ''}
+                    ${email.priority && email.priority !== 'normal' ? `
+                    <div class="email-detail">
+                        <div class="email-detail-label">Priority:</div>
+                        <div class="email-detail-value">${email.priority === 'high' ? 'High' : 'Low'}</div>
+                    </div>
+                    ` : ''}
+                    ${email.missingAlternative ? `
+                    <div class="email-detail">
+                        <div class="email-detail-label">Alternatives:</div>
+                        <div class="email-detail-value">${email.missingAlternative === 'plain' ? 'No plain-text part; the plain text shown is generated from the HTML' : 'No HTML part'}</div>
+                    </div>
+                    ` : ''}
                     <div class="email-detail">
                         <div class="email-detail-label">Date:</div>
                         <div class="email-detail-value">${new Date(email.receivedAt).toLocaleString()}</div>
                     </div>
                 </div>
+                <a class="email-download" href="${basePath}/api/emails/${email.id}/download">Download .eml</a>
             </div>
             <div class="email-body">
                 <div class="email-tabs">
                     ${hasHTML ? '<button class="email-tab active" data-view="html">HTML</button>' : ''}
-                    ${hasPlain ? `<button class="email-tab ${!hasHTML ? 'active' : ''}" data-view="plain">Plain Text</button>` : ''}
+                    ${hasPlain ? `<button class="email-tab ${!hasHTML ? 'active' : ''}" data-view="plain">${email.missingAlternative === 'plain' ? 'Plain Text (generated)' : 'Plain Text'}</button>` : ''}
+                    ${email.bodyAMP ? '<button class="email-tab" data-view="amp">AMP</button>' : ''}
                     <button class="email-tab" data-view="raw">Raw</button>
+                    ${email.received && email.received.length > 0 ? '<button class="email-tab" data-view="path">Delivery Path</button>' : ''}
+                    ${email.sizeBreakdown ? '<button class="email-tab" data-view="size">Size</button>' : ''}
                 </div>
                 <div class="email-content" id="email-content">
                     ${this.renderEmailContent(email, hasHTML ? 'html' : 'plain')}
@@ -307,9 +622,18 @@ class App {
                     <h3>Attachments (${email.attachments.length})</h3>
                     ${email.attachments.map(att => `
                         <div class="attachment-item">
-                            📎 <a href="/api/emails/${email.id}/attachments/${att.id}" download="${att.filename}">
-                                ${this.escapeHtml(att.filename)} (${this.formatSize(att.size)})
+                            📎 <a href="${basePath}/api/emails/${email.id}/attachments/${att.id}" download="${att.filename}">
+                                ${this.escapeHtml(att.filename)} (${this.formatSize(att.size)}${att.inline ? ', inline' : ''})
                             </a>
+                            ${att.typeMismatch ? `
+                            <span class="attachment-mismatch" title="Declared ${this.escapeHtml(att.contentType)}">⚠ ${this.escapeHtml(att.typeMismatch)}</span>
+                            ` : ''}
+                            ${att.message ? `
+                            <span class="attachment-message">${this.escapeHtml(att.message.subject || '(no subject)')} from ${this.escapeHtml(att.message.from)}</span>
+                            ` : ''}
+                            ${this.isPreviewable(att.contentType) ? `
+                            <a class="attachment-preview" href="${basePath}/api/emails/${email.id}/attachments/${att.id}/view" target="_blank" rel="noopener">Preview</a>
+                            ` : ''}
                         </div>
                     `).join('')}
                 </div>
@@ -317,6 +641,20 @@ class App {
             </div>
         `;
 
+        const unsubscribeButton = document.getElementById('unsubscribe-test-btn');
+        if (unsubscribeButton) {
+            unsubscribeButton.addEventListener('click', async () => {
+                unsubscribeButton.disabled = true;
+                try {
+                    email.unsubscribe.test = await this.api.testUnsubscribe(email.id);
+                    this.renderEmailPreview(email);
+                } catch (err) {
+                    alert(err.message);
+                    unsubscribeButton.disabled = false;
+                }
+            });
+        }
+
         // Add tab click listeners
         previewEl.querySelectorAll('.email-tab').forEach(tab => {
             tab.addEventListener('click', () => {
@@ -329,6 +667,9 @@ class App {
                 
                 // Update content
                 document.getElementById('email-content').innerHTML = this.renderEmailContent(email, view);
+                if (view === 'amp') {
+                    this.loadAMPValidation(email.id);
+                }
             });
         });
     }
@@ -348,11 +689,101 @@ class App {
                 }
                 raw += '\n' + (email.bodyPlain || email.bodyHTML || '');
                 return `<pre>${this.escapeHtml(raw)}</pre>`;
+            case 'path':
+                return this.renderDeliveryPath(email.received || []);
+            case 'size':
+                return this.renderSizeBreakdown(email.sizeBreakdown, email.size);
+            case 'amp':
+                return `<div class="amp-validation" id="amp-validation">Validating...</div><pre>${this.escapeHtml(email.bodyAMP)}</pre>`;
             default:
                 return '';
         }
     }
 
+    async loadAMPValidation(id) {
+        const amp = await this.api.getAMP(id);
+        const el = document.getElementById('amp-validation');
+        if (!el || !amp) {
+            return;
+        }
+        if (amp.warnings.length === 0) {
+            el.innerHTML = '<div class="amp-valid">Valid AMP for Email</div>';
+            return;
+        }
+        el.innerHTML = `
+            <div class="${amp.valid ? 'amp-valid' : 'amp-invalid'}">${amp.valid ? 'Valid AMP for Email, with warnings' : 'Invalid AMP for Email; clients show the HTML body instead'}</div>
+            <ul>
+                ${amp.warnings.map(w => `<li>Line ${w.line}: ${this.escapeHtml(w.message)}${w.count > 1 ? ` (${w.count} times)` : ''}</li>`).join('')}
+            </ul>
+        `;
+    }
+
+    renderDeliveryPath(hops) {
+        const rows = hops.map((hop, i) => {
+            const from = [hop.from, hop.fromHost, hop.fromIp].filter(Boolean)
+                .filter((v, j, all) => all.indexOf(v) === j).join(' / ');
+            const delay = hop.delayMs === undefined ? '' : `${(hop.delayMs / 1000).toFixed(0)}s`;
+            return `
+                <tr title="${this.escapeHtml(hop.header)}">
+                    <td>${i + 1}</td>
+                    <td>${this.escapeHtml(from)}</td>
+                    <td>${this.escapeHtml(hop.by || '')}</td>
+                    <td>${this.escapeHtml(hop.protocol || '')}</td>
+                    <td>${hop.timestamp ? new Date(hop.timestamp).toLocaleString() : ''}</td>
+                    <td class="${hop.delayMs > 60000 ? 'delivery-slow' : ''}">${delay}</td>
+                </tr>
+            `;
+        }).join('');
+        return `
+            <table class="delivery-path">
+                <thead>
+                    <tr><th>#</th><th>From</th><th>By</th><th>With</th><th>Time</th><th>Delay</th></tr>
+                </thead>
+                <tbody>${rows}</tbody>
+            </table>
+        `;
+    }
+
+    renderSizeBreakdown(sizes, total) {
+        // Gmail clips messages whose HTML is larger than this
+        const gmailClip = 102 * 1024;
+        const totals = [
+            ['Headers', sizes.headers],
+            ['Plain text', sizes.text],
+            ['HTML', sizes.html],
+            ['AMP', sizes.amp],
+            ['Attachments', sizes.attachments],
+            ['Structure', sizes.structure],
+        ].filter(([, size]) => size > 0).map(([label, size]) => `
+            <tr class="${label === 'HTML' && size > gmailClip ? 'delivery-slow' : ''}">
+                <td>${label}</td>
+                <td>${this.formatSize(size)}</td>
+                <td>${total ? (100 * size / total).toFixed(1) : 0}%</td>
+            </tr>
+        `).join('');
+        const parts = sizes.parts.map(part => `
+            <tr>
+                <td>${this.escapeHtml(part.part)}</td>
+                <td>${this.escapeHtml(part.filename || part.kind)}</td>
+                <td>${this.escapeHtml(part.contentType)}</td>
+                <td>${this.escapeHtml(part.encoding || '')}</td>
+                <td>${this.formatSize(part.size)}</td>
+                <td>${this.formatSize(part.decodedSize)}</td>
+            </tr>
+        `).join('');
+        return `
+            <table class="size-breakdown">
+                <thead><tr><th>Total</th><th>${this.formatSize(total)}</th><th></th></tr></thead>
+                <tbody>${totals}</tbody>
+            </table>
+            ${sizes.html > gmailClip ? '<p class="delivery-slow">The HTML is over 102 KB; Gmail will clip this message.</p>' : ''}
+            <table class="size-breakdown">
+                <thead><tr><th>Part</th><th>Name</th><th>Type</th><th>Encoding</th><th>Size</th><th>Decoded</th></tr></thead>
+                <tbody>${parts}</tbody>
+            </table>
+        `;
+    }
+
     async deleteEmail(id) {
         if (!confirm('Are you sure you want to delete this email?')) {
             return;
@@ -403,6 +834,14 @@ class App {
         this.updateStats();
     }
 
+    handleEmailRead(data) {
+        const email = this.emails.find(e => e.id === data.id);
+        if (email) {
+            email.read = data.read;
+            this.renderEmailList();
+        }
+    }
+
     handleEmailsCleared() {
         this.emails = [];
         this.selectedEmail = null;
@@ -443,6 +882,12 @@ class App {
         return (bytes / (1024 * 1024)).toFixed(1) + ' MB';
     }
 
+    // Matches the types the server renders inline; others are downloaded
+    isPreviewable(contentType) {
+        const type = (contentType || '').split(';')[0].trim().toLowerCase();
+        return ['image/png', 'image/jpeg', 'image/gif', 'image/webp', 'image/bmp', 'application/pdf', 'text/plain'].includes(type);
+    }
+
     escapeHtml(text) {
         const div = document.createElement('div');
         div.textContent = text;
@@ -0,0 +1,14 @@
+// Service worker showing the Web Push notifications of new mail
+self.addEventListener('push', (event) => {
+    const message = event.data ? event.data.json() : {};
+    event.waitUntil(self.registration.showNotification(message.title || 'New email', {
+        body: message.body || '',
+        tag: message.emailId ? `email-${message.emailId}` : undefined,
+        data: { url: message.url || self.registration.scope }
+    }));
+});
+
+self.addEventListener('notificationclick', (event) => {
+    event.notification.close();
+    event.waitUntil(clients.openWindow(event.notification.data.url));
+});